@@ -4,6 +4,6 @@ import "github.com/husobee/peerstore/models"
 
 const (
 	// MaxFingerTableSize - the maximum number of entries in a finger table which
-	// is the number of bits in the hash, 8 bits per byte, 20 bytes in hash
+	// is the number of bits in an identifier, 8 bits per byte
 	MaxFingerTableSize int = models.M
 )
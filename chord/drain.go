@@ -0,0 +1,160 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Drain - prepare the node to be shut down.  New data is rejected from here
+// on, every key stored in dataPath is copied to our successor, and once the
+// copy is complete the node advertises itself as leaving: our predecessor
+// and successor are told to take each other in our place, and lookups of our
+// keys which still reach us are routed on to the successor.  Keys are kept
+// locally, so reads of them keep working until the node is stopped.
+func (ln *LocalNode) Drain(dataPath string) (models.DrainResponse, error) {
+	ln.rebalanceMutex.Lock()
+	defer ln.rebalanceMutex.Unlock()
+
+	var result = models.DrainResponse{}
+
+	finger, err := ln.fingerTable.GetIth(1)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to get successor: ")
+	}
+	successor := finger.Successor
+	if successor.Addr == "" || successor.ID.Equal(ln.ID) {
+		return result, errors.New("no other node to hand keys off to")
+	}
+
+	ln.server.SetDraining(true)
+
+	keys, err := file.ListKeys(dataPath)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to list keys: ")
+	}
+	glog.Infof("draining %d keys to %s", len(keys), successor)
+
+	rn, err := NewRemoteNode(successor.Addr, successor.PublicKey)
+	if err != nil {
+		return result, errors.Wrap(err, "error creating new remote node for successor: ")
+	}
+	for _, key := range keys {
+		_, err := ln.transferKey(rn, dataPath, key)
+		if os.IsNotExist(errors.Cause(err)) {
+			// removed since we listed it
+			continue
+		}
+		if err != nil {
+			glog.Infof("failed to transfer %s to %s: %v", key, successor, err)
+			result.Failed++
+			continue
+		}
+		result.Transferred++
+	}
+
+	if result.Failed > 0 {
+		return result, nil
+	}
+	atomic.StoreInt32(&ln.drained, 1)
+	if err := ln.leaveNeighbours(successor); err != nil {
+		return result, errors.Wrap(err, "failed to leave: ")
+	}
+	return result, nil
+}
+
+// Undrain - take the node out of draining, so it accepts new data again.  A
+// node which was drained rejoins the ring through its successor, which hands
+// back the keys it is responsible for, as when the node is restarted.
+func (ln *LocalNode) Undrain() error {
+	ln.rebalanceMutex.Lock()
+	defer ln.rebalanceMutex.Unlock()
+
+	ln.server.SetDraining(false)
+	if !atomic.CompareAndSwapInt32(&ln.drained, 1, 0) {
+		return nil
+	}
+	successor, err := ln.successor()
+	if err != nil {
+		return err
+	}
+	if successor.ID.Equal(ln.ID) {
+		return nil
+	}
+	glog.Infof("undrained, rejoining the ring through %s", successor)
+	return ln.Initialize(successor)
+}
+
+// drainedSuccessor - the node lookups of our keys are routed on to once we
+// are drained, ok is false if we are not drained
+func (ln *LocalNode) drainedSuccessor() (models.Node, bool) {
+	if atomic.LoadInt32(&ln.drained) == 0 {
+		return models.Node{}, false
+	}
+	finger, err := ln.fingerTable.GetIth(1)
+	if err != nil {
+		return models.Node{}, false
+	}
+	successor := finger.Successor
+	if successor.Addr == "" || successor.ID.Equal(ln.ID) {
+		return models.Node{}, false
+	}
+	return successor, true
+}
+
+// DrainHandler - the handler to handle all server calls to drain this local
+// node ahead of shutdown, or to undrain it.  Only admins can drain a node.
+func (ln *LocalNode) DrainHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		dataPath = ctx.Value(models.DataPathContextKey).(string)
+		in       = &models.DrainRequest{}
+		out      = &bytes.Buffer{}
+	)
+
+	if !protocol.IsAdmin(ctx, r) {
+		glog.Infof("drain by %s rejected, not an admin", r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "drain is only accepted from admins")
+	}
+
+	if len(r.Data) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(in); err != nil {
+			glog.Infof("decode drain request error: %v\n", err)
+			return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid request")
+		}
+	}
+	if in.Undrain {
+		if err := ln.Undrain(); err != nil {
+			glog.Infof("undrain failed: %v\n", err)
+			return protocol.ErrorResponse(protocol.InternalErrorCode, "undrain failed: "+errors.Cause(err).Error())
+		}
+		glog.Infof("undrain complete")
+		return protocol.Response{
+			Status: protocol.Success,
+		}
+	}
+
+	result, err := ln.Drain(dataPath)
+	if err != nil {
+		glog.Infof("drain failed: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "drain failed: "+errors.Cause(err).Error())
+	}
+	glog.Infof("drain complete: transferred=%d, failed=%d",
+		result.Transferred, result.Failed)
+
+	if err := gob.NewEncoder(out).Encode(result); err != nil {
+		glog.Infof("encode drain response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
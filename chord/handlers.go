@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
-	"encoding/hex"
 
 	"github.com/golang/glog"
 	"github.com/husobee/peerstore/models"
@@ -20,7 +19,6 @@ func (ln *LocalNode) SuccessorHandler(ctx context.Context, r *protocol.Request)
 		}
 		body = bytes.NewBuffer(r.Data)
 		in   = &models.SuccessorRequest{}
-		out  = &bytes.Buffer{}
 	)
 
 	// create a gob decoder to decode the body
@@ -29,28 +27,21 @@ func (ln *LocalNode) SuccessorHandler(ctx context.Context, r *protocol.Request)
 	err := dec.Decode(in)
 	if err != nil {
 		glog.Infof("decode successor request error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid request")
 	}
 
 	// this point we have the ID, time to call successor on ln
 	node, err := ln.Successor(in.ID)
 	glog.Infof("successor found: %s\n",
-		node.ToString())
+		node)
 
-	enc := gob.NewEncoder(out)
-	if err := enc.Encode(node); err != nil {
+	if response.Data, err = node.Encode(); err != nil {
 		glog.Infof("encode successor response error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
 	}
-	// write the response to the bytes of the response data
-	response.Data = out.Bytes()
 
 	glog.Infof("response for successor handler: %s\n",
-		node.ToString())
+		node)
 
 	return response
 }
@@ -61,23 +52,37 @@ func (ln *LocalNode) GetPredecessorHandler(ctx context.Context, r *protocol.Requ
 		response = protocol.Response{
 			Status: protocol.Success,
 		}
-		out = new(bytes.Buffer)
+		err error
 	)
-	enc := gob.NewEncoder(out)
 	predecessor, _ := ln.GetPredecessor()
-	if err := enc.Encode(predecessor); err != nil {
-		glog.Infof("encode successor response error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+	if response.Data, err = predecessor.Encode(); err != nil {
+		glog.Infof("encode predecessor response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
 	}
-	// write the response to the bytes of the response data
-	response.Data = out.Bytes()
 
 	glog.Infof("response for get predecessor handler: Node.Addr=%s, Node.ID=%s\n",
 		predecessor.Addr,
-		hex.EncodeToString(predecessor.ID[:]))
+		predecessor.ID.String())
+
+	return response
+}
 
+// ImmediateSuccessorHandler - the handler to handle all server calls to get
+// the current successor of this local node, as GetPredecessorHandler does
+// its predecessor
+func (ln *LocalNode) ImmediateSuccessorHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var response = protocol.Response{
+		Status: protocol.Success,
+	}
+	successor, err := ln.successor()
+	if err != nil {
+		glog.Infof("get immediate successor error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to get successor")
+	}
+	if response.Data, err = successor.Encode(); err != nil {
+		glog.Infof("encode immediate successor response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
 	return response
 }
 
@@ -88,36 +93,27 @@ func (ln *LocalNode) SetPredecessorHandler(ctx context.Context, r *protocol.Requ
 		response = protocol.Response{
 			Status: protocol.Success,
 		}
-		body = bytes.NewBuffer(r.Data)
-		in   = &models.Node{}
 	)
 
-	// create a gob decoder to decode the body
-	dec := gob.NewDecoder(body)
-
-	err := dec.Decode(in)
+	in, err := models.DecodeNode(bytes.NewBuffer(r.Data))
 	if err != nil {
-		glog.Infof("decode successor request error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		glog.Infof("decode set predecessor request error: %v\n", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid request")
 	}
 
 	glog.Infof("Set Predecessor Handler is getting set to: %s", in)
 
 	// set the predecessor in ln
-	err = ln.SetPredecessor(*in)
+	err = ln.SetPredecessor(in)
 	if err != nil {
 		glog.Infof("set predecessor failed: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.ConflictCode, "predecessor not updated")
 	}
 
 	newPredecessor, _ := ln.GetPredecessor()
 	glog.Infof("!!! Set New Predecessor: Node.Addr=%s, Node.ID=%s\n",
 		newPredecessor.Addr,
-		hex.EncodeToString(newPredecessor.ID[:]))
+		newPredecessor.ID.String())
 
 	return response
 }
@@ -134,9 +130,7 @@ func (ln *LocalNode) FingerTableHandler(ctx context.Context, r *protocol.Request
 
 	enc := gob.NewEncoder(out)
 	if err := enc.Encode(ln.fingerTable); err != nil {
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
 	}
 	// write the response to the bytes of the response data
 	response.Data = out.Bytes()
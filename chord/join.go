@@ -0,0 +1,141 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// handOff - transfer the keys stored in dataPath which newcomer, having
+// joined the ring as our predecessor in place of previous, is now
+// responsible for.  Keys are removed once newcomer has them, unless the ring
+// keeps replicas, as we are the first of newcomer's.
+func (ln *LocalNode) handOff(dataPath string, newcomer, previous models.Node) (models.RebalanceResponse, error) {
+	ln.rebalanceMutex.Lock()
+	defer ln.rebalanceMutex.Unlock()
+
+	var (
+		result = models.RebalanceResponse{}
+		lnID   = models.KeyToID(ln.ID)
+		newID  = models.KeyToID(newcomer.ID)
+		prevID = models.KeyToID(previous.ID)
+		keep   = ln.server.RingSettings().ReplicationFactor >= 2
+	)
+
+	keys, err := file.ListKeys(dataPath)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to list keys: ")
+	}
+
+	rn, err := NewRemoteNode(newcomer.Addr, newcomer.PublicKey)
+	if err != nil {
+		return result, errors.Wrap(err, "error creating new remote node for newcomer: ")
+	}
+	for _, key := range keys {
+		keyID := models.KeyToID(key)
+		if keyID == lnID || models.Between(keyID, newID, lnID) {
+			// still ours
+			result.Kept++
+			continue
+		}
+		if previous.Addr != "" && keyID != newID && !models.Between(keyID, prevID, newID) {
+			// a replica we hold of another node
+			continue
+		}
+
+		data, err := ln.transferKey(rn, dataPath, key)
+		if os.IsNotExist(errors.Cause(err)) {
+			// removed since we listed it
+			continue
+		}
+		if err != nil {
+			glog.Infof("failed to transfer %s to %s: %v", key, newcomer, err)
+			result.Failed++
+			continue
+		}
+		if keep {
+			result.Kept++
+			continue
+		}
+		removed, err := file.RemoveKeyIfUnchanged(dataPath, key, data)
+		if err != nil {
+			glog.Infof("failed to remove transferred %s: %v", key, err)
+			result.Failed++
+			continue
+		}
+		if !removed {
+			// written to during the handoff, a rebalance moves it on later
+			glog.Infof("%s changed during transfer, keeping it", key)
+			result.Kept++
+			continue
+		}
+		result.Transferred++
+	}
+	return result, nil
+}
+
+// sentByNode - was the request being handled sent by n about itself, signed
+// by the trusted node n claims to be, at the address and with the key that
+// node registered, the only node which can tell us of its place in the ring
+func sentByNode(ctx context.Context, r *protocol.Request, n models.Node) bool {
+	if caller, _ := protocol.CallerTypeFromContext(ctx); caller != protocol.NodeType {
+		return false
+	}
+	trusted, ok := protocol.CallerNodeFromContext(ctx)
+	return ok && n.ID.Equal(r.Header.From) && n.ID.Equal(trusted.ID) && n.Equal(trusted)
+}
+
+// NodeJoinHandler - the handler to handle a node joining the ring as our
+// predecessor.  It is taken as our predecessor, and the keys it is now
+// responsible for are handed off to it in the background, as the joining
+// node does not serve requests until it has joined.  Only the joining node
+// itself can join, as it is handed the keys of the range it claims.
+func (ln *LocalNode) NodeJoinHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		dataPath = ctx.Value(models.DataPathContextKey).(string)
+		in       = &models.Node{}
+	)
+
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(in); err != nil {
+		glog.Infof("decode node join request error: %v\n", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid request")
+	}
+	if !sentByNode(ctx, r, *in) {
+		glog.Infof("node join of %s from %s rejected, not sent by the node", in, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "node join not sent by the joining node")
+	}
+
+	previous, _ := ln.GetPredecessor()
+	if err := ln.SetPredecessor(*in); err != nil {
+		glog.Infof("node join of %s refused: %v\n", in, err)
+		return protocol.ErrorResponse(protocol.ConflictCode, "node does not precede us")
+	}
+	glog.Infof("%s joined the ring before us", in)
+	if successor, err := ln.successor(); err == nil && successor.ID.Equal(ln.ID) {
+		// we were alone, so it follows us as well.  Until we stabilize we
+		// would otherwise name ourselves the successor of the next node to
+		// join, which may belong between it and us
+		ln.SetSuccessor(*in)
+	}
+
+	go func(newcomer models.Node) {
+		result, err := ln.handOff(dataPath, newcomer, previous)
+		if err != nil {
+			glog.Infof("handoff to %s failed: %v", newcomer, err)
+			return
+		}
+		glog.Infof("handoff to %s complete: transferred=%d, kept=%d, failed=%d",
+			newcomer, result.Transferred, result.Kept, result.Failed)
+	}(*in)
+
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
@@ -0,0 +1,108 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Leave - leave the ring ahead of shutting down.  Every key stored in
+// dataPath is pushed to our successor, and our predecessor and successor
+// take each other in our place, as with Drain, which fails the leave if any
+// key could not be handed off.  Lookups of our keys reach the successor
+// straight away, rather than once the ring has stabilized around us.
+func (ln *LocalNode) Leave(dataPath string) (models.DrainResponse, error) {
+	result, err := ln.Drain(dataPath)
+	if err != nil {
+		return result, err
+	}
+	if result.Failed > 0 {
+		return result, errors.Errorf("failed to hand off %d keys", result.Failed)
+	}
+	glog.Infof("left the ring, %d keys handed off", result.Transferred)
+	return result, nil
+}
+
+// leaveNeighbours - tell our predecessor and successor we are leaving, so
+// they take each other in our place and stop routing to us
+func (ln *LocalNode) leaveNeighbours(successor models.Node) error {
+	predecessor, _ := ln.GetPredecessor()
+	leave := models.NodeLeaveRequest{
+		Node:        ln.ToNode(),
+		Predecessor: predecessor,
+		Successor:   successor,
+	}
+	neighbours := []models.Node{predecessor}
+	if !successor.ID.Equal(predecessor.ID) {
+		neighbours = append(neighbours, successor)
+	}
+	for _, n := range neighbours {
+		if n.Addr == "" || n.ID.Equal(ln.ID) {
+			continue
+		}
+		rn, err := NewRemoteNode(n.Addr, n.PublicKey)
+		if err != nil {
+			return errors.Wrap(err, "error creating new remote node: ")
+		}
+		if err := rn.Leave(leave, ln.server.PrivateKey); err != nil {
+			glog.Infof("failed to tell %s we are leaving: %v", n, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// NodeLeaveHandler - the handler to handle our predecessor or successor
+// leaving the ring, its own successor or predecessor taking its place.  Only
+// the leaving node itself can leave, as it names the nodes taking its place.
+func (ln *LocalNode) NodeLeaveHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var in = &models.NodeLeaveRequest{}
+
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(in); err != nil {
+		glog.Infof("decode node leave request error: %v\n", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid request")
+	}
+	if !sentByNode(ctx, r, in.Node) {
+		glog.Infof("node leave of %s from %s rejected, not sent by the node", in.Node, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "node leave not sent by the leaving node")
+	}
+
+	replacement := in.Successor
+	if replacement.Addr == "" || replacement.ID.Equal(in.Node.ID) {
+		replacement = ln.ToNode()
+	}
+	if successor, _ := ln.successor(); successor.ID.Equal(in.Node.ID) {
+		glog.Infof("successor %s left, taking %s", in.Node, replacement)
+		ln.SetSuccessor(replacement)
+	}
+	ln.fingerTable.Replace(in.Node, replacement)
+
+	ln.successorsMutex.Lock()
+	var successors []models.Node
+	for _, s := range ln.successors {
+		if !s.ID.Equal(in.Node.ID) {
+			successors = append(successors, s)
+		}
+	}
+	ln.successors = successors
+	ln.successorsMutex.Unlock()
+
+	ln.predecessorMutex.Lock()
+	if ln.predecessor.ID.Equal(in.Node.ID) {
+		ln.predecessor = in.Predecessor
+		if ln.predecessor.ID.Equal(ln.ID) {
+			ln.predecessor = models.Node{}
+		}
+		glog.Infof("predecessor %s left, taking %s", in.Node, ln.predecessor)
+	}
+	ln.predecessorMutex.Unlock()
+
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
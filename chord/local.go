@@ -1,12 +1,10 @@
 package chord
 
 import (
-	"bytes"
 	"context"
 	"crypto/rsa"
-	"crypto/sha1"
-	"encoding/hex"
 	"sync"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 	"github.com/husobee/peerstore/models"
@@ -24,16 +22,35 @@ type LocalNode struct {
 	predecessor      models.Node
 	predecessorMutex *sync.RWMutex
 	server           *protocol.Server
+	// rebalanceMutex - only one rebalance of this node runs at a time
+	rebalanceMutex *sync.Mutex
+	// drained - set once the node has handed its keys off to its successor,
+	// accessed atomically
+	drained int32
+	// successors - the successor list, the first being the successor
+	successors      []models.Node
+	successorsMutex *sync.RWMutex
+	// dataPath - where the resources this node is responsible for are
+	// stored, to copy them to replicas which join its successor list
+	dataPath string
+	// replications - changed resources waiting to be copied to the replicas,
+	// in the order they changed, replicationQueued the keys among them which
+	// are copied to every replica, so each is only queued once
+	replications      []replication
+	replicationQueued map[models.Identifier]bool
+	replicationMutex  *sync.Mutex
+	// replicationReady - signalled whenever a resource is queued
+	replicationReady chan struct{}
+	replicationOnce  *sync.Once
 }
 
-// NewLocalNode - Creation of the new local node
-func NewLocalNode(s *protocol.Server, addr string, peer models.Node) (*LocalNode, error) {
+// NewLocalNode - Creation of the new local node, storing resources in
+// dataPath
+func NewLocalNode(s *protocol.Server, addr, dataPath string, peer models.Node) (*LocalNode, error) {
 	// make a new finger table for this node
 	n := models.Node{
-		Addr: addr,
-		ID: models.Identifier(
-			sha1.Sum([]byte(addr)),
-		),
+		Addr:      addr,
+		ID:        models.HashBytes([]byte(addr)),
 		PublicKey: s.PrivateKey.Public().(*rsa.PublicKey),
 	}
 
@@ -43,13 +60,15 @@ func NewLocalNode(s *protocol.Server, addr string, peer models.Node) (*LocalNode
 	)
 	// set initial finger table to have self for the whole range
 	ln := &LocalNode{
-		&n, fingerTable, models.Node{}, new(sync.RWMutex), s,
+		&n, fingerTable, models.Node{}, new(sync.RWMutex), s, new(sync.Mutex), 0,
+		nil, new(sync.RWMutex), dataPath,
+		nil, make(map[models.Identifier]bool), new(sync.Mutex), make(chan struct{}, 1), new(sync.Once),
 	}
 	fingerTable.SetIth(1, models.NewInterval(n, n), n, ln.ToNode())
 	glog.Infof("bootstrapping fingertable: %s", fingerTable.ToString())
 	// create a new local node
 
-	if &peer != nil {
+	if peer.Addr != "" {
 		// run the initialization process
 		err = ln.Initialize(peer)
 	}
@@ -65,7 +84,7 @@ func (ln *LocalNode) UserRegistrationHandler(ctx context.Context, r *protocol.Re
 }
 
 // ToNode - Convert LocalNode to just a plain Node
-func (ln LocalNode) ToNode() models.Node {
+func (ln *LocalNode) ToNode() models.Node {
 	return models.Node{
 		Addr:      ln.Addr,
 		ID:        ln.ID,
@@ -73,197 +92,108 @@ func (ln LocalNode) ToNode() models.Node {
 	}
 }
 
-// Stabilize - stabilize the chord ring, makes sure we are actually predecessor
+// Stabilize - stabilize the chord ring.  We ask our successor for its
+// predecessor, and take it as our successor if it has joined between us,
+// then notify the successor that we may be its predecessor, unless we are
+// drained.  A successor which cannot be reached is replaced by the next of
+// the successor list which can.  It is run periodically, so nodes joining
+// and leaving are picked up by the rest of the ring.
 func (ln *LocalNode) Stabilize() error {
-	// call successor's predecessor function to see we we are still the predecessor
-	currentSuccessor, err := ln.Successor(ln.ID)
+	ln.checkPredecessor()
+
+	successor, err := ln.successor()
 	if err != nil {
-		glog.Infof("failed to get successor for stabilize: %s", err)
 		return errors.Wrap(err, "failed to get successor: ")
 	}
 
-	glog.Infof("current successor: %s, this: %s", currentSuccessor.ToString(), ln.ToString())
-
-	// we need to close the loop if successor of this node is nil
-	// if successor is nil, ask every pred in the chain if they have a nil pred
-	// when we find the end of the line, set our successor to that node, and that node's pred
-	// to us thereby closing the ring
-	if ln.Compare(currentSuccessor) == 0 {
-		// if no successor, traverse back through chain and make node with no predecessor
-		// the successor
-		newPredecessor, _ := ln.GetPredecessor()
-		if newPredecessor.Addr != "" {
-			// if the first entry in finger is ourself, then we dont have a successor
-			predecessor := newPredecessor
-			glog.Infof("--------------here is predecessor: %s", predecessor)
-			for {
-				// lookup the public key for the predecessor
-				predecessorRN, err := NewRemoteNode(predecessor.Addr, predecessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for predecessor: %v\n", err)
-					break
-				}
-
-				nextPredecessor, err := predecessorRN.GetPredecessor(ln.server.PrivateKey)
-				if err != nil {
-					glog.Infof("error getting new predecessor on remote node: %v\n", err)
-					break
-				}
-
-				if nextPredecessor.Addr == "" {
-					// predecessor was our last one in the chain
-					ln.SetSuccessor(predecessor)
-					newPredecessorRN, err := NewRemoteNode(predecessor.Addr, predecessor.PublicKey)
-					if err != nil {
-						glog.Infof("error creating new remote node for predecessor: %v\n", err)
-						break
-					}
-					newPredecessorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey)
-					break
-				}
-				predecessor = nextPredecessor
-			}
-		}
+	var successorPredecessor models.Node
+	if successor.ID.Equal(ln.ID) {
+		// alone on the ring, until a node joins and notifies us
+		successorPredecessor, _ = ln.GetPredecessor()
 	} else {
-
-		successorRN, err := NewRemoteNode(currentSuccessor.Addr, currentSuccessor.PublicKey)
+		successorRN, err := NewRemoteNode(successor.Addr, successor.PublicKey)
 		if err != nil {
-			glog.Infof("error creating new remote node for successor: %v\n", err)
 			return errors.Wrap(err, "error creating new remote node for successor: ")
 		}
-
-		currentSuccessorPredecessor, err := successorRN.GetPredecessor(ln.server.PrivateKey)
-		glog.Infof("stabilize for id=%s, successor id=%s thinks id=%s is predecessor\n",
-			hex.EncodeToString(ln.ID[:]),
-			hex.EncodeToString(currentSuccessor.ID[:]),
-			hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-		)
-
+		successorPredecessor, err = successorRN.GetPredecessor(ln.server.PrivateKey)
 		if err != nil {
-			glog.Infof("error setting new predecessor on remote node: %v\n", err)
-			return errors.Wrap(err, "error setting new predecessor on remote node:")
+			glog.Infof("successor %s is unreachable: %v", successor, err)
+			return ln.replaceSuccessor(successor)
 		}
+	}
 
-		lnID := models.KeyToID(ln.ID)
-		succPredID := models.KeyToID(currentSuccessorPredecessor.ID)
-		succID := models.KeyToID(currentSuccessor.ID)
-
-		if succPredID == lnID {
-			// no update! We are still the predecessor
-			glog.Infof("self is still predecessor of successor - %s == %s\n",
-				hex.EncodeToString(ln.ID[:]),
-				hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-			)
-			return nil
-		}
+	lnID := models.KeyToID(ln.ID)
+	if successorPredecessor.Addr != "" &&
+		models.Between(models.KeyToID(successorPredecessor.ID), lnID, models.KeyToID(successor.ID)) {
+		glog.Infof("stabilize for id=%s, %s joined before successor %s",
+			ln.ID.String(), successorPredecessor, successor)
+		successor = successorPredecessor
+		ln.SetSuccessor(successor)
+	}
 
-		if succPredID < succID {
-			if succPredID < lnID && lnID < succID {
-				// change the successor to use ln as predecessor
-				successorRN, err = NewRemoteNode(currentSuccessor.Addr, currentSuccessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for successor: %v\n", err)
-					errors.Wrap(err, "error creating new remote node for successor: ")
-				}
-				glog.Info("!!! succPredID < lnID -> CORRECTING HERE")
-				if err := successorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error resetting successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
-
-				glog.Infof("stabilize for id=%s, corrected successor id=%s thinks id=%s is predecessor now\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessor.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-			} else {
-				// change ln successor to new successor pred
-				glog.Infof("self is no longer predecessor of successor - %s < %s\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				ln.SetSuccessor(currentSuccessorPredecessor)
-				glog.Infof("self is setting successor to id=%s\n",
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				newSuccessorRN, err := NewRemoteNode(currentSuccessorPredecessor.Addr, currentSuccessorPredecessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for new successor: %v\n", err)
-					return errors.Wrap(err, "error creating new remote node for new  successor: ")
-				}
-
-				// set the new successor's predecessor to ourselves
-				if err := newSuccessorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error setting new successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
-				glog.Infof("self is setting predecessor of the new successor id=%s to self\n",
-					hex.EncodeToString(ln.ID[:]),
-				)
-			}
-		} else {
-			if succPredID < lnID || lnID < succID {
-				// use new succ pred
-				// change ln successor to new successor pred
-				glog.Infof("self is no longer predecessor of successor - %s < %s\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				glog.Infof("!!! lnID < succPredID && succPredID < succID : %d < %d && %d < %d",
-					lnID, succPredID, succPredID, succID,
-				)
-				ln.SetSuccessor(currentSuccessorPredecessor)
-				glog.Infof("self is setting successor to id=%s\n",
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				newSuccessorRN, err := NewRemoteNode(currentSuccessorPredecessor.Addr, currentSuccessorPredecessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for new successor: %v\n", err)
-					return errors.Wrap(err, "error creating new remote node for new  successor: ")
-				}
-
-				// set the new successor's predecessor to ourselves
-				if err := newSuccessorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error setting new successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
-				glog.Infof("self is setting predecessor of the new successor id=%s to self\n",
-					hex.EncodeToString(ln.ID[:]),
-				)
-
-			} else {
-				// change the successor to use ln as predecessor
-				successorRN, err = NewRemoteNode(currentSuccessor.Addr, currentSuccessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for successor: %v\n", err)
-					return errors.Wrap(err, "error creating new remote node for successor: ")
-				}
-				glog.Info("!!!CORRECTING HERE")
-				glog.Infof("!!! lnID < succPredID && succPredID < succID : %d < %d && %d < %d",
-					lnID, succPredID, succPredID, succID,
-				)
-				if err := successorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error resetting successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
-
-				glog.Infof("stabilize for id=%s, corrected successor id=%s thinks id=%s is predecessor now\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessor.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-			}
+	if atomic.LoadInt32(&ln.drained) == 1 {
+		// a drained node has left its neighbours, and the successor would
+		// take it back as its predecessor
+		return nil
+	}
+	return ln.notify(successor)
+}
+
+// notify - tell the node n we may be its predecessor
+func (ln *LocalNode) notify(n models.Node) error {
+	if n.ID.Equal(ln.ID) {
+		return nil
+	}
+	rn, err := NewRemoteNode(n.Addr, n.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "error creating new remote node for successor: ")
+	}
+	if err := rn.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
+		return errors.Wrap(err, "error setting new predecessor on remote node: ")
+	}
+	return nil
+}
+
+// replaceSuccessor - take the first node of the successor list after the
+// unreachable successor dead which can be reached as our successor, or
+// ourself if there are none
+func (ln *LocalNode) replaceSuccessor(dead models.Node) error {
+	for _, successor := range ln.successorsAfter(dead) {
+		if ln.reachable(successor) {
+			glog.Infof("replacing unreachable successor %s with %s",
+				dead, successor)
+			ln.SetSuccessor(successor)
+			return ln.notify(successor)
 		}
 	}
+	glog.Infof("no successor after unreachable %s can be reached", dead)
+	return ln.SetSuccessor(ln.ToNode())
+}
 
-	// if not, set this node's successor to the predecessor, and update the new
-	// successor with us as it's predecessor
+// checkPredecessor - forget our predecessor if it cannot be reached, so
+// whichever node now precedes us can take its place when it notifies us
+func (ln *LocalNode) checkPredecessor() {
+	predecessor, _ := ln.GetPredecessor()
+	if predecessor.Addr == "" || ln.reachable(predecessor) {
+		return
+	}
+	glog.Infof("predecessor %s is unreachable", predecessor)
+	ln.predecessorMutex.Lock()
+	if ln.predecessor.ID.Equal(predecessor.ID) {
+		ln.predecessor = models.Node{}
+	}
+	ln.predecessorMutex.Unlock()
+}
 
-	// TODO: migrate values we are now in charge of!
+// FixFingers - refresh the finger table, pointing each finger past the
+// successor at the node now responsible for the position it starts at.  It
+// is run periodically along with Stabilize, as nodes join and leave.
+func (ln *LocalNode) FixFingers() error {
+	if err := ln.fingerTable.Fix(ln.ToNode(), ln.Successor); err != nil {
+		glog.Infof("failed to fix fingers: %v", err)
+		return err
+	}
+	glog.Infof("fixed finger table: %s", ln.fingerTable.ToString())
 	return nil
 }
 
@@ -273,13 +203,13 @@ func (ln *LocalNode) SetSuccessor(node models.Node) error {
 	return ln.fingerTable.SetIth(1, models.NewInterval(ln.ToNode(), node), node, ln.ToNode())
 }
 
-// Initialize - initialize the chord node
+// Initialize - join the ring peer is part of.  Our successor is the node
+// peer finds responsible for our ID, which is told we have joined, and hands
+// off the keys we are now responsible for.  The rest of the ring learns of
+// us as it stabilizes.
 func (ln *LocalNode) Initialize(peer models.Node) error {
-	// create a new remote node and transport
-	glog.Infof("this node: %s\n", ln.ToString())
-	glog.Infof("initial finger table: %s\n", ln.fingerTable.ToString())
-
-	glog.Infof("initializing chord node against remote: %s\n", peer.ToString())
+	glog.Infof("this node: %s\n", ln)
+	glog.Infof("initializing chord node against remote: %s\n", peer)
 
 	rn, err := NewRemoteNode(peer.Addr, peer.PublicKey)
 	if err != nil {
@@ -290,100 +220,100 @@ func (ln *LocalNode) Initialize(peer models.Node) error {
 
 	// call successor on remote node with our ID to figure out our successor
 	successor, err := rn.Successor(ln.ID, ln.server.PrivateKey)
-
 	if err != nil {
 		glog.Infof("failed initializing chord node against remote: %v\n", err)
 		return errors.Wrap(err,
 			"failed to initialize, could not get successor: ")
 	}
-
-	glog.Infof("recieved successor from remote: %s\n", successor.ToString())
+	glog.Infof("recieved successor from remote: %s\n", successor)
 
 	// update the first finger to include successor
 	ln.SetSuccessor(successor)
 	glog.Infof("finger table updated: %s\n", ln.fingerTable.ToString())
+	if successor.ID.Equal(ln.ID) {
+		return nil
+	}
 
-	// set the successor's new predecessor
 	successorRN, err := NewRemoteNode(successor.Addr, successor.PublicKey)
 	if err != nil {
-		glog.Infof("error creating new remote node for successor: %v\n", err)
-		errors.Wrap(err, "error creating new remote node for successor: ")
+		return errors.Wrap(err, "error creating new remote node for successor: ")
 	}
-
-	glog.Infof("!!! should only initialize once")
-	if err := successorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-		glog.Infof("error setting new predecessor on remote node: %v\n", err)
-		errors.Wrap(err, "error setting new predecessor on remote node:")
+	if err := successorRN.Join(ln.ToNode(), ln.server.PrivateKey); err != nil {
+		glog.Infof("error joining successor: %v\n", err)
+		return errors.Wrap(err, "failed to join successor: ")
 	}
-
 	return nil
 }
 
 // ClosestPrecedingNode - Find the node that directly preceeds ID
-// closest preceeding node
+// closest preceding node, from the finger table, so a lookup halves the
+// distance to ID with each hop
 func (ln *LocalNode) ClosestPrecedingNode(id models.Identifier) (models.Node, error) {
-	// convert hash to big int
-	lnID := models.KeyToID(ln.ID)
-	nID := models.KeyToID(id)
-
-	for i := models.M; i >= 1; i-- {
-		ith, err := ln.fingerTable.GetIth(uint64(i))
-		ithSuccessorID := models.KeyToID(ith.Successor.ID)
-
-		if err != nil {
-			return models.Node{}, errors.Wrap(err, "failed to get closest preceding: ")
-		}
-
-		if ith.Successor.Addr == "" {
-			continue
-		}
-
-		// if ith.Successor is within lnID and nID
-		if lnID < nID {
-			if lnID < ithSuccessorID && ithSuccessorID < nID {
-				glog.Infof("closest preceding node to id=%s is %s", models.KeyToID(id), ith.Successor.ToString())
-				return ith.Successor, nil
-			}
-		} else {
-			if lnID < ithSuccessorID || ithSuccessorID < nID {
-				glog.Infof("closest preceding node to id=%s is %s", models.KeyToID(id), ith.Successor.ToString())
-				return ith.Successor, nil
-			}
-		}
-	}
-	glog.Infof("closest preceding node to id=%s is %s", models.KeyToID(id), ln.ToString())
-	return ln.ToNode(), nil
+	node := ln.fingerTable.ClosestPreceding(ln.ToNode(), id)
+	glog.Infof("closest preceding node to id=%d is %s", models.KeyToID(id), node)
+	return node, nil
 }
 
 // Successor - This is what this is all about, given an Key we will return
-// the node that is responsible for that Key
+// the node that is responsible for that Key, the first node at or after it
+// around the ring
 func (ln *LocalNode) Successor(id models.Identifier) (models.Node, error) {
-	// does the key fall within ln's ID and the first entry of the finger table
-	// if the key is greater than ln.ID and less than ln.successor.ID, return
-	// ln.successor
+	if successor, ok := ln.drainedSuccessor(); ok && ln.responsibleFor(id) {
+		// a drained node has handed its keys off, and routes them on
+		return successor, nil
+	}
 	nPrime, err := ln.ClosestPrecedingNode(id)
 	if err != nil {
 		return nPrime, errors.Wrap(err, "failed to get successor: ")
 	}
-	glog.Infof("successor called: based on finger table, goto: %s", nPrime.ToString())
-	glog.Infof("finger table: %s", ln.fingerTable.ToString())
-	// if we are the nPrime, return self
-	if bytes.Compare(nPrime.ID[:], ln.ID[:]) == 0 {
-		return ln.ToNode(), nil
+	glog.Infof("successor called: based on finger table, goto: %s", nPrime)
+	// if we are the nPrime, the key falls between us and our successor
+	if nPrime.ID.Equal(ln.ID) {
+		return ln.successor()
 	}
 
 	// call whoever we think is closest
-	rn, err := NewRemoteNode(nPrime.Addr, nPrime.PublicKey)
+	return ln.forwardSuccessor(nPrime, id)
+}
+
+// successor - our successor, the first entry of the finger table
+func (ln *LocalNode) successor() (models.Node, error) {
+	finger, err := ln.fingerTable.GetIth(1)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to get successor: ")
+	}
+	if finger.Successor.Addr == "" {
+		return ln.ToNode(), nil
+	}
+	return finger.Successor, nil
+}
+
+// responsibleFor - does id fall between our predecessor and us, so we are
+// the node responsible for it
+func (ln *LocalNode) responsibleFor(id models.Identifier) bool {
+	predecessor, _ := ln.GetPredecessor()
+	if predecessor.Addr == "" {
+		return false
+	}
+	nID, lnID := models.KeyToID(id), models.KeyToID(ln.ID)
+	return nID == lnID || models.Between(nID, models.KeyToID(predecessor.ID), lnID)
+}
+
+// forwardSuccessor - ask the remote node n for the successor of id, routing
+// around n if it cannot be reached
+func (ln *LocalNode) forwardSuccessor(n models.Node, id models.Identifier) (models.Node, error) {
+	rn, err := NewRemoteNode(n.Addr, n.PublicKey)
 	if err != nil {
 		return models.Node{}, errors.Wrap(err, "failure creating new remote node: ")
 	}
 
-	glog.Infof("contacting node: %s\n", nPrime.ToString())
+	glog.Infof("contacting node: %s\n", n)
 	node, err := rn.Successor(id, ln.server.PrivateKey)
 	if err != nil {
-		return models.Node{}, errors.Wrap(err, "failure getting successor from remote node: ")
+		glog.Infof("failure getting successor from remote node, routing around it: %v", err)
+		return ln.routeAround(n, id)
 	}
-	glog.Infof("recieved successor from remote rpc call: %s\n", node.ToString())
+	glog.Infof("recieved successor from remote rpc call: %s\n", node)
 
 	return node, nil
 }
@@ -392,43 +322,25 @@ func (ln *LocalNode) Successor(id models.Identifier) (models.Node, error) {
 func (ln *LocalNode) GetPredecessor() (models.Node, error) {
 	ln.predecessorMutex.RLock()
 	defer ln.predecessorMutex.RUnlock()
-	glog.Infof("get predescessor currently set to: %s\n", ln.predecessor.ToString())
+	glog.Infof("get predescessor currently set to: %s\n", ln.predecessor)
 	return ln.predecessor, nil
 }
 
-// SetPredecessor - Set the predecessor node for this local node
+// SetPredecessor - Set the predecessor node for this local node, when we
+// are notified of it.  It is only taken if we have no predecessor, or it
+// falls between our predecessor and us.
 func (ln *LocalNode) SetPredecessor(n models.Node) error {
 	ln.predecessorMutex.Lock()
 	defer ln.predecessorMutex.Unlock()
 
-	lnID := models.KeyToID(ln.ID)
-	nID := models.KeyToID(n.ID)
-	pID := models.KeyToID(ln.predecessor.ID)
-
-	if ln.predecessor.Addr == "" {
-		ln.predecessor = n
-		glog.Infof("predescessor set to: %s\n", ln.predecessor.ToString())
+	if n.ID.Equal(ln.ID) || n.ID.Equal(ln.predecessor.ID) {
 		return nil
 	}
-
-	if pID < lnID {
-		// easy, no wrapping
-		if pID < nID && nID < lnID {
-			// yep, closer, change it
-			ln.predecessor = n
-			glog.Infof("predescessor set to: %s\n", ln.predecessor.ToString())
-			return nil
-		}
-		return errors.New("not updating as new isn't between")
-	} else {
-		// not easy, wrapping around the horn
-		if nID < lnID || pID < nID {
-			// yep, closer, change it
-			ln.predecessor = n
-			glog.Infof("predescessor set to: %s\n", ln.predecessor.ToString())
-			return nil
-		}
+	if ln.predecessor.Addr != "" && !models.Between(models.KeyToID(n.ID),
+		models.KeyToID(ln.predecessor.ID), models.KeyToID(ln.ID)) {
 		return errors.New("not updating as new isn't between")
 	}
+	ln.predecessor = n
+	glog.Infof("predescessor set to: %s\n", ln.predecessor)
 	return nil
 }
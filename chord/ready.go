@@ -0,0 +1,67 @@
+package chord
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Ready - check the node is ready to serve requests.  It is not while it is
+// joining the ring, until its predecessor has stabilized with it, once it is
+// drained, or while it cannot write to dataPath.  A node alone on the ring
+// has no predecessor, and is ready without one.
+func (ln *LocalNode) Ready(dataPath string) error {
+	if atomic.LoadInt32(&ln.drained) == 1 {
+		return errors.New("node is drained")
+	}
+	successor, err := ln.successor()
+	if err != nil {
+		return err
+	}
+	if predecessor, _ := ln.GetPredecessor(); predecessor.Addr == "" && !successor.ID.Equal(ln.ID) {
+		return errors.New("node has no predecessor yet")
+	}
+	return writable(dataPath)
+}
+
+// writable - check dataPath is a directory files can be written to.  The
+// permissions are checked as well as writing a file, as root can write to a
+// directory made read only.  The reason it is not is sent to the caller, so
+// it does not include the path.
+func writable(dataPath string) error {
+	fi, err := os.Stat(dataPath)
+	if err != nil {
+		glog.Infof("failed to stat data path: %v", err)
+		return errors.New("data path is not readable")
+	}
+	if !fi.IsDir() {
+		return errors.New("data path is not a directory")
+	}
+	if fi.Mode().Perm()&0200 == 0 {
+		return errors.New("data path is read only")
+	}
+	f, err := ioutil.TempFile(dataPath, ".ready-")
+	if err != nil {
+		glog.Infof("failed to write to data path: %v", err)
+		return errors.New("data path is not writable")
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// ReadyHandler - the handler to handle all server calls to check this local
+// node is ready to serve, answering with an error while it is not
+func (ln *LocalNode) ReadyHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	dataPath := ctx.Value(models.DataPathContextKey).(string)
+	if err := ln.Ready(dataPath); err != nil {
+		glog.Infof("not ready: %v", err)
+		return protocol.ErrorResponse(protocol.ConflictCode, "not ready: "+err.Error())
+	}
+	return protocol.Response{Status: protocol.Success}
+}
@@ -0,0 +1,207 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Rebalance - hand off every key stored in dataPath which the ring now routes
+// to another node, and unless pushOnly, ask our successor to hand off the
+// keys which are now routed to us.  A key is only removed locally once the
+// new owner has it, and only if it was not written to during the handoff, so
+// this is safe to run alongside normal traffic.
+func (ln *LocalNode) Rebalance(dataPath string, pushOnly bool) (models.RebalanceResponse, error) {
+	ln.rebalanceMutex.Lock()
+	defer ln.rebalanceMutex.Unlock()
+
+	var (
+		result = models.RebalanceResponse{}
+		// replicas - the replicas of each owner, keys we hold as one of
+		// them are copied to the owner but kept
+		replicas = make(map[models.Identifier][]models.Node)
+	)
+
+	keys, err := file.ListKeys(dataPath)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to list keys: ")
+	}
+	glog.Infof("rebalancing %d keys", len(keys))
+
+	for _, key := range keys {
+		owner, err := ln.Successor(key)
+		if err != nil {
+			glog.Infof("failed to find owner of %s: %v", key, err)
+			result.Failed++
+			continue
+		}
+		if owner.ID.Equal(ln.ID) {
+			result.Kept++
+			continue
+		}
+
+		rn, err := NewRemoteNode(owner.Addr, owner.PublicKey)
+		if err != nil {
+			glog.Infof("error creating new remote node for owner: %v", err)
+			result.Failed++
+			continue
+		}
+		data, err := ln.transferKey(rn, dataPath, key)
+		if os.IsNotExist(errors.Cause(err)) {
+			// removed since we listed it
+			continue
+		}
+		if err != nil {
+			glog.Infof("failed to transfer %s to %s: %v", key, owner, err)
+			result.Failed++
+			continue
+		}
+		if ln.replicaOf(owner, replicas) {
+			result.Kept++
+			continue
+		}
+		removed, err := file.RemoveKeyIfUnchanged(dataPath, key, data)
+		if err != nil {
+			glog.Infof("failed to remove transferred %s: %v", key, err)
+			result.Failed++
+			continue
+		}
+		if !removed {
+			// written to during the handoff, leave it for the next rebalance
+			glog.Infof("%s changed during transfer, keeping it", key)
+			result.Kept++
+			continue
+		}
+		result.Transferred++
+	}
+
+	if pushOnly {
+		return result, nil
+	}
+
+	// keys between our predecessor and us are held by our successor until
+	// it is told to hand them off
+	finger, err := ln.fingerTable.GetIth(1)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to get successor: ")
+	}
+	successor := finger.Successor
+	if successor.Addr == "" || successor.ID.Equal(ln.ID) {
+		return result, nil
+	}
+	rn, err := NewRemoteNode(successor.Addr, successor.PublicKey)
+	if err != nil {
+		return result, errors.Wrap(err, "error creating new remote node for successor: ")
+	}
+	pulled, err := rn.Rebalance(true, ln.server.PrivateKey)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to rebalance successor: ")
+	}
+	glog.Infof("successor %s handed off %d keys",
+		successor, pulled.Transferred)
+	return result, nil
+}
+
+// transferKey - hand off the resource key stored in dataPath to rn, its
+// archived versions first so its history goes with it, then its current
+// copy, which is returned so it is only removed here if it is unchanged
+func (ln *LocalNode) transferKey(rn *RemoteNode, dataPath string, key models.Identifier) ([]byte, error) {
+	current, archived, err := file.ReadKeyVersions(dataPath, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ln.transferVersions(rn, key, archived); err != nil {
+		return nil, err
+	}
+	if err := rn.TransferKey(key, current.Data, current.Version, false, ln.server.PrivateKey); err != nil {
+		return nil, err
+	}
+	return current.Data, nil
+}
+
+// transferVersions - hand off the archived versions of the resource key to
+// rn, oldest first, which keeps any it already has
+func (ln *LocalNode) transferVersions(rn *RemoteNode, key models.Identifier, archived []file.KeyVersion) error {
+	for _, version := range archived {
+		if err := rn.TransferKey(key, version.Data, version.Version, true, ln.server.PrivateKey); err != nil {
+			return errors.Wrapf(err, "failed to transfer version %d: ", version.Version)
+		}
+	}
+	return nil
+}
+
+// replicaOf - is this node one of the replicas of owner, replicas caching
+// the replicas of each owner asked already
+func (ln *LocalNode) replicaOf(owner models.Node, replicas map[models.Identifier][]models.Node) bool {
+	if ln.server.RingSettings().ReplicationFactor < 2 {
+		return false
+	}
+	nodes, ok := replicas[owner.ID]
+	if !ok {
+		rn, err := NewRemoteNode(owner.Addr, owner.PublicKey)
+		if err != nil {
+			return false
+		}
+		list, err := rn.SuccessorList(ln.server.PrivateKey)
+		if err != nil {
+			glog.Infof("failed to get replicas of %s: %v", owner, err)
+		}
+		nodes = list.Replicas()
+		replicas[owner.ID] = nodes
+	}
+	for _, node := range nodes {
+		if node.ID.Equal(ln.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// RebalanceHandler - the handler to handle all server calls to rebalance the
+// keys stored on this local node
+func (ln *LocalNode) RebalanceHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		dataPath = ctx.Value(models.DataPathContextKey).(string)
+		in       = &models.RebalanceRequest{}
+		out      = &bytes.Buffer{}
+	)
+
+	if len(r.Data) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(in); err != nil {
+			glog.Infof("decode rebalance request error: %v\n", err)
+			return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid request")
+		}
+	}
+
+	// a node rebalancing asks its successor to push the keys now routed to
+	// it, anything more is for admins
+	caller, _ := protocol.CallerTypeFromContext(ctx)
+	if !protocol.IsAdmin(ctx, r) && !(in.PushOnly && caller == protocol.NodeType) {
+		glog.Infof("rebalance by %s rejected, not an admin", r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "rebalance is only accepted from admins")
+	}
+
+	result, err := ln.Rebalance(dataPath, in.PushOnly)
+	if err != nil {
+		glog.Infof("rebalance failed: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "rebalance failed")
+	}
+	glog.Infof("rebalance complete: transferred=%d, kept=%d, failed=%d",
+		result.Transferred, result.Kept, result.Failed)
+
+	if err := gob.NewEncoder(out).Encode(result); err != nil {
+		glog.Infof("encode rebalance response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
@@ -2,8 +2,8 @@ package chord
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
-	"crypto/sha1"
 	"encoding/gob"
 
 	"github.com/golang/glog"
@@ -28,14 +28,27 @@ func NewRemoteNode(addr string, key *rsa.PublicKey) (*RemoteNode, error) {
 		&models.Node{
 			Addr:      addr,
 			PublicKey: key,
-			ID: models.Identifier(
-				sha1.Sum([]byte(addr)),
-			),
+			ID:        models.HashBytes([]byte(addr)),
 		},
 		nil,
 	}, nil
 }
 
+// Ping - check the remote node is alive and answering, giving up when ctx is
+// cancelled or its deadline passes
+func (rn *RemoteNode) Ping(ctx context.Context, key *rsa.PrivateKey) error {
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+	err := rn.transport.Ping(ctx)
+	rn.transport.Close()
+	return err
+}
+
 // GetPredecessor - Get the predecessor of a remote node
 func (rn *RemoteNode) GetPredecessor(key *rsa.PrivateKey) (models.Node, error) {
 	// if connection is nil, create a new connection to the remote node
@@ -68,15 +81,10 @@ func (rn *RemoteNode) GetPredecessor(key *rsa.PrivateKey) (models.Node, error) {
 	}
 
 	// decode the response body into a node object
-	var (
-		buf  = bytes.NewBuffer(resp.Data)
-		node = models.Node{}
-	)
-	dec := gob.NewDecoder(buf)
-	if err := dec.Decode(&node); err != nil {
-		errors.Wrap(err, "failure decoding successor response from body")
+	node, err := models.DecodeNode(bytes.NewBuffer(resp.Data))
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failure decoding response from body")
 	}
-
 	return node, nil
 
 }
@@ -99,7 +107,6 @@ func (rn *RemoteNode) Successor(id models.Identifier, key *rsa.PrivateKey) (mode
 		return models.Node{}, errors.Wrap(err, "failed to encode request: ")
 	}
 
-	glog.Infof("rn.PublicKey is %v", rn.PublicKey)
 	// send request to the remote
 	resp, err := rn.transport.RoundTrip(&protocol.Request{
 		Header: protocol.Header{
@@ -120,15 +127,10 @@ func (rn *RemoteNode) Successor(id models.Identifier, key *rsa.PrivateKey) (mode
 	}
 
 	// decode the response body into a node object
-	var (
-		buf  = bytes.NewBuffer(resp.Data)
-		node = models.Node{}
-	)
-	dec := gob.NewDecoder(buf)
-	if err := dec.Decode(&node); err != nil {
-		errors.Wrap(err, "failure decoding successor response from body")
+	node, err := models.DecodeNode(bytes.NewBuffer(resp.Data))
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failure decoding response from body")
 	}
-
 	return node, nil
 }
 
@@ -144,15 +146,13 @@ func (rn *RemoteNode) SetPredecessor(node models.Node, key *rsa.PrivateKey) erro
 		}
 	}
 
-	var reqBuffer = new(bytes.Buffer)
-
-	enc := gob.NewEncoder(reqBuffer)
-	if err := enc.Encode(node); err != nil {
+	data, err := node.Encode()
+	if err != nil {
 		return errors.Wrap(err, "failed to encode request: ")
 	}
 
 	// send request to the remote
-	_, err := rn.transport.RoundTrip(&protocol.Request{
+	_, err = rn.transport.RoundTrip(&protocol.Request{
 		Header: protocol.Header{
 			From:     rn.ID,
 			FromAddr: rn.Addr,
@@ -160,6 +160,84 @@ func (rn *RemoteNode) SetPredecessor(node models.Node, key *rsa.PrivateKey) erro
 			PubKey:   rn.PublicKey,
 		},
 		Method: protocol.SetPredecessorMethod,
+		Data:   data,
+	})
+
+	rn.transport.Close()
+
+	if err != nil {
+		return errors.Wrap(err, "failed round trip: ")
+	}
+
+	return nil
+}
+
+// Join - tell the remote node, our successor, that node has joined the ring
+// before it, so it hands off the keys node is now responsible for
+func (rn *RemoteNode) Join(node models.Node, key *rsa.PrivateKey) error {
+	// if connection is nil, create a new connection to the remote node
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+
+	data, err := node.Encode()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode request: ")
+	}
+
+	// send request to the remote
+	resp, err := rn.transport.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:     node.ID,
+			FromAddr: rn.Addr,
+			Type:     protocol.NodeType,
+			PubKey:   rn.PublicKey,
+		},
+		Method: protocol.NodeJoinMethod,
+		Data:   data,
+	})
+
+	rn.transport.Close()
+
+	if err != nil {
+		return errors.Wrap(err, "failed round trip: ")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrap(resp.Err(), "remote node refused join")
+	}
+	return nil
+}
+
+// Leave - tell the remote node, our predecessor or successor, that we are
+// leaving the ring, as described by leave
+func (rn *RemoteNode) Leave(leave models.NodeLeaveRequest, key *rsa.PrivateKey) error {
+	// if connection is nil, create a new connection to the remote node
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+
+	var reqBuffer = new(bytes.Buffer)
+	if err := gob.NewEncoder(reqBuffer).Encode(leave); err != nil {
+		return errors.Wrap(err, "failed to encode request: ")
+	}
+
+	// send request to the remote
+	resp, err := rn.transport.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:     leave.Node.ID,
+			FromAddr: rn.Addr,
+			Type:     protocol.NodeType,
+			PubKey:   rn.PublicKey,
+		},
+		Method: protocol.NodeLeaveMethod,
 		Data:   reqBuffer.Bytes(),
 	})
 
@@ -168,6 +246,172 @@ func (rn *RemoteNode) SetPredecessor(node models.Node, key *rsa.PrivateKey) erro
 	if err != nil {
 		return errors.Wrap(err, "failed round trip: ")
 	}
+	if resp.Status != protocol.Success {
+		return errors.Wrap(resp.Err(), "remote node refused leave")
+	}
+	return nil
+}
+
+// TransferKey - hand off the raw stored data of a resource to a remote node,
+// as its version id version, and as an archived version of it if archived
+func (rn *RemoteNode) TransferKey(id models.Identifier, data []byte, version uint64, archived bool, key *rsa.PrivateKey) error {
+	// if connection is nil, create a new connection to the remote node
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+
+	// send request to the remote
+	resp, err := rn.transport.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:       rn.ID,
+			FromAddr:   rn.Addr,
+			Type:       protocol.NodeType,
+			PubKey:     rn.PublicKey,
+			Key:        id,
+			DataLength: uint64(len(data)),
+			Version:    version,
+			Archived:   archived,
+		},
+		Method: protocol.TransferKeyMethod,
+		Data:   data,
+	})
+	rn.transport.Close()
+	rn.transport = nil
+
+	if err != nil {
+		return errors.Wrap(err, "failed round trip: ")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrap(resp.Err(), "remote node refused transfer")
+	}
+	return nil
+}
+
+// Rebalance - ask a remote node to rebalance its keys
+func (rn *RemoteNode) Rebalance(pushOnly bool, key *rsa.PrivateKey) (models.RebalanceResponse, error) {
+	// if connection is nil, create a new connection to the remote node
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return models.RebalanceResponse{}, errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+
+	var reqBuffer = new(bytes.Buffer)
+
+	enc := gob.NewEncoder(reqBuffer)
+	if err := enc.Encode(models.RebalanceRequest{PushOnly: pushOnly}); err != nil {
+		return models.RebalanceResponse{}, errors.Wrap(err, "failed to encode request: ")
+	}
+
+	// send request to the remote
+	resp, err := rn.transport.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:     rn.ID,
+			FromAddr: rn.Addr,
+			Type:     protocol.NodeType,
+			PubKey:   rn.PublicKey,
+		},
+		Method: protocol.RebalanceMethod,
+		Data:   reqBuffer.Bytes(),
+	})
+	rn.transport.Close()
+	rn.transport = nil
+
+	if err != nil {
+		return models.RebalanceResponse{}, errors.Wrap(err, "failed round trip: ")
+	}
+	if resp.Status != protocol.Success {
+		return models.RebalanceResponse{}, errors.Wrap(resp.Err(), "remote node failed to rebalance")
+	}
+
+	var out = models.RebalanceResponse{}
+	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
+	if err := dec.Decode(&out); err != nil {
+		return out, errors.Wrap(err, "failure decoding rebalance response from body")
+	}
+	return out, nil
+}
+
+// SuccessorList - get the successor list of a remote node
+func (rn *RemoteNode) SuccessorList(key *rsa.PrivateKey) (models.SuccessorListResponse, error) {
+	// if connection is nil, create a new connection to the remote node
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return models.SuccessorListResponse{}, errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+
+	// send request to the remote
+	resp, err := rn.transport.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:     rn.ID,
+			FromAddr: rn.Addr,
+			Type:     protocol.NodeType,
+			PubKey:   rn.PublicKey,
+		},
+		Method: protocol.GetSuccessorListMethod,
+	})
+	rn.transport.Close()
+	rn.transport = nil
+
+	if err != nil {
+		return models.SuccessorListResponse{}, errors.Wrap(err, "failed round trip: ")
+	}
+	if resp.Status != protocol.Success {
+		return models.SuccessorListResponse{}, errors.Wrap(resp.Err(), "remote node failed to list successors")
+	}
 
+	var out = models.SuccessorListResponse{}
+	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
+	if err := dec.Decode(&out); err != nil {
+		return out, errors.Wrap(err, "failure decoding successor list response from body")
+	}
+	return out, nil
+}
+
+// ReplicateKey - copy the raw stored data of a changed resource, as its
+// version id version, to a remote node holding a replica of it, no data
+// meaning it was deleted
+func (rn *RemoteNode) ReplicateKey(id models.Identifier, data []byte, version uint64, key *rsa.PrivateKey) error {
+	// if connection is nil, create a new connection to the remote node
+	if rn.transport == nil {
+		var err error
+		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+			// we had an error setting up our connection
+			return errors.Wrap(err, "failed creating transport: ")
+		}
+	}
+
+	// send request to the remote
+	resp, err := rn.transport.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:       rn.ID,
+			FromAddr:   rn.Addr,
+			Type:       protocol.NodeType,
+			PubKey:     rn.PublicKey,
+			Key:        id,
+			DataLength: uint64(len(data)),
+			Version:    version,
+		},
+		Method: protocol.ReplicateKeyMethod,
+		Data:   data,
+	})
+	rn.transport.Close()
+	rn.transport = nil
+
+	if err != nil {
+		return errors.Wrap(err, "failed round trip: ")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrap(resp.Err(), "remote node refused replica")
+	}
 	return nil
 }
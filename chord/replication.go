@@ -0,0 +1,361 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// pingTimeout - how long a node is given to answer a ping before it is
+// taken to be down
+const pingTimeout = 5 * time.Second
+
+const (
+	// replicationAttempts - the most times a resource is copied to a replica
+	// which failed to take it
+	replicationAttempts = 6
+	// replicationBackoff - how long a failed copy waits before it is queued
+	// again, doubling for each attempt after it
+	replicationBackoff = 500 * time.Millisecond
+)
+
+// replication - a changed resource waiting to be copied to the replicas, or
+// to only the nodes to, if it is being copied to replicas which were added
+type replication struct {
+	dataPath string
+	key      models.Identifier
+	to       []models.Node
+	// attempt - how many times the copy failed before
+	attempt int
+}
+
+// SuccessorList - the successor list of this local node, in order around
+// the ring.  It ends at this node when the ring is shorter than the list.
+func (ln *LocalNode) SuccessorList() []models.Node {
+	ln.successorsMutex.RLock()
+	defer ln.successorsMutex.RUnlock()
+	return append([]models.Node{}, ln.successors...)
+}
+
+// Replicas - the successors which hold a replica of every resource this node
+// is responsible for, the first ReplicationFactor - 1 of the successor list
+func (ln *LocalNode) Replicas() []models.Node {
+	return models.SuccessorListResponse{
+		Successors:        ln.successorsBefore(ln.ToNode()),
+		ReplicationFactor: ln.server.RingSettings().ReplicationFactor,
+	}.Replicas()
+}
+
+// successorsBefore - the successor list up to, but not including, n
+func (ln *LocalNode) successorsBefore(n models.Node) []models.Node {
+	successors := ln.SuccessorList()
+	for i, successor := range successors {
+		if successor.ID.Equal(n.ID) {
+			return successors[:i]
+		}
+	}
+	return successors
+}
+
+// successorsAfter - the successor list following n, empty if n is not in it
+func (ln *LocalNode) successorsAfter(n models.Node) []models.Node {
+	successors := ln.SuccessorList()
+	for i, successor := range successors {
+		if successor.ID.Equal(n.ID) {
+			return successors[i+1:]
+		}
+	}
+	return nil
+}
+
+// UpdateSuccessorList - refresh the successor list from our successor and
+// its own successor list, so the ring can be routed past a failed node.  It
+// is run periodically along with Stabilize.
+func (ln *LocalNode) UpdateSuccessorList() error {
+	finger, err := ln.fingerTable.GetIth(1)
+	if err != nil {
+		return errors.Wrap(err, "failed to get successor: ")
+	}
+	successor := finger.Successor
+	if successor.Addr == "" {
+		return nil
+	}
+	successors := []models.Node{successor}
+	if !successor.ID.Equal(ln.ID) {
+		rn, err := NewRemoteNode(successor.Addr, successor.PublicKey)
+		if err != nil {
+			return errors.Wrap(err, "error creating new remote node for successor: ")
+		}
+		theirs, err := rn.SuccessorList(ln.server.PrivateKey)
+		if err != nil {
+			// keep the list we have, which still reaches past the successor
+			glog.Infof("failed to get successor list of %s: %v", successor, err)
+			return errors.Wrap(err, "failed to get successor list: ")
+		}
+		successors = append(successors, theirs.Successors...)
+	}
+	// the list stops once it comes back around to us
+	for i, s := range successors {
+		if s.ID.Equal(ln.ID) {
+			successors = successors[:i+1]
+			break
+		}
+	}
+	if length := ln.server.RingSettings().SuccessorListLength; len(successors) > length {
+		successors = successors[:length]
+	}
+
+	replicas := ln.Replicas()
+	ln.successorsMutex.Lock()
+	ln.successors = successors
+	ln.successorsMutex.Unlock()
+	glog.Infof("successor list updated, %d successors", len(successors))
+
+	// a node which became a replica, as one failed or another joined before
+	// it, holds none of what we are responsible for until it is copied
+	if added := nodesNotIn(ln.Replicas(), replicas); len(added) > 0 {
+		ln.replicateTo(added)
+	}
+	return nil
+}
+
+// nodesNotIn - the nodes which are not in others
+func nodesNotIn(nodes, others []models.Node) []models.Node {
+	var missing []models.Node
+Nodes:
+	for _, n := range nodes {
+		for _, other := range others {
+			if n.ID.Equal(other.ID) {
+				continue Nodes
+			}
+		}
+		missing = append(missing, n)
+	}
+	return missing
+}
+
+// replicateTo - queue every resource this node is responsible for to be
+// copied to the nodes to, which were made replicas of it
+func (ln *LocalNode) replicateTo(to []models.Node) {
+	if ln.server.RingSettings().ReplicationFactor < 2 || ln.dataPath == "" {
+		return
+	}
+	keys, err := file.ListKeys(ln.dataPath)
+	if err != nil {
+		glog.Infof("failed to list keys to replicate: %v", err)
+		return
+	}
+	predecessor, _ := ln.GetPredecessor()
+	var (
+		lnID   = models.KeyToID(ln.ID)
+		predID = models.KeyToID(predecessor.ID)
+		queued []replication
+	)
+	for _, key := range keys {
+		keyID := models.KeyToID(key)
+		if predecessor.Addr != "" && keyID != lnID && !models.Between(keyID, predID, lnID) {
+			// a replica we hold of another node
+			continue
+		}
+		queued = append(queued, replication{dataPath: ln.dataPath, key: key, to: to})
+	}
+	glog.Infof("replicating %d keys to %d new replicas", len(queued), len(to))
+	ln.queueReplications(queued...)
+}
+
+// reachable - does the node answer a ping within pingTimeout
+func (ln *LocalNode) reachable(n models.Node) bool {
+	if n.ID.Equal(ln.ID) {
+		return true
+	}
+	rn, err := NewRemoteNode(n.Addr, n.PublicKey)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return rn.Ping(ctx, ln.server.PrivateKey) == nil
+}
+
+// routeAround - find the node to serve id, when the lookup could not be
+// forwarded to dead as it cannot be reached.  The lookup goes to the closest
+// finger before dead instead, until it gets to the node whose successor dead
+// is, which knows the nodes following dead from its successor list.  When
+// dead was responsible for id, the first of them which can be reached stands
+// in for it, as it holds a replica of everything dead did.
+func (ln *LocalNode) routeAround(dead models.Node, id models.Identifier) (models.Node, error) {
+	before := ln.fingerTable.ClosestPreceding(ln.ToNode(), dead.ID)
+	if !before.ID.Equal(ln.ID) {
+		return ln.forwardSuccessor(before, id)
+	}
+
+	lnID, nID := models.KeyToID(ln.ID), models.KeyToID(id)
+	for _, successor := range ln.successorsAfter(dead) {
+		if successor.ID.Equal(ln.ID) {
+			// back around to us
+			return ln.ToNode(), nil
+		}
+		if !ln.reachable(successor) {
+			glog.Infof("successor %s is unreachable too", successor)
+			continue
+		}
+		succID := models.KeyToID(successor.ID)
+		if nID == succID || models.Between(nID, lnID, succID) {
+			glog.Infof("%s stands in for unreachable %s", successor, dead)
+			return successor, nil
+		}
+		return ln.forwardSuccessor(successor, id)
+	}
+	return models.Node{}, errors.Errorf("%s is unreachable, and no successor of it is known", dead.Addr)
+}
+
+// Replicate - queue the resource key stored in dataPath to be copied to the
+// replicas, the file handlers call it whenever they change a resource.  The
+// copies are made in the background in the order they were queued, so
+// writes are not held up by them.  A resource changed again before it is
+// copied is copied once, as it is then.  A copy a replica fails to take is
+// queued again for that replica, with backoff, up to replicationAttempts
+// times, after which the replica has it once it rejoins the successor list.
+func (ln *LocalNode) Replicate(dataPath string, key models.Identifier) {
+	if ln.server.RingSettings().ReplicationFactor < 2 {
+		return
+	}
+	ln.queueReplications(replication{dataPath: dataPath, key: key})
+}
+
+// queueReplications - add rs to the replication queue, and wake the
+// replicator, starting it the first time
+func (ln *LocalNode) queueReplications(rs ...replication) {
+	ln.replicationMutex.Lock()
+	for _, r := range rs {
+		if r.to == nil {
+			if ln.replicationQueued[r.key] {
+				continue
+			}
+			ln.replicationQueued[r.key] = true
+		}
+		ln.replications = append(ln.replications, r)
+	}
+	ln.replicationMutex.Unlock()
+
+	ln.replicationOnce.Do(func() {
+		go ln.replicate()
+	})
+	select {
+	case ln.replicationReady <- struct{}{}:
+	default:
+		// already signalled, the replicator will find these too
+	}
+}
+
+// nextReplication - take the oldest queued replication, false if there is
+// none
+func (ln *LocalNode) nextReplication() (replication, bool) {
+	ln.replicationMutex.Lock()
+	defer ln.replicationMutex.Unlock()
+	if len(ln.replications) == 0 {
+		return replication{}, false
+	}
+	r := ln.replications[0]
+	ln.replications[0] = replication{}
+	ln.replications = ln.replications[1:]
+	if r.to == nil {
+		delete(ln.replicationQueued, r.key)
+	}
+	return r, true
+}
+
+// replicate - copy each queued resource, as it is now, to the replicas
+func (ln *LocalNode) replicate() {
+	for range ln.replicationReady {
+		for {
+			r, ok := ln.nextReplication()
+			if !ok {
+				break
+			}
+			ln.replicateKey(r)
+		}
+	}
+}
+
+// replicateKey - copy the resource r to its replicas, with its archived
+// versions first, as transferKey hands it off.  A resource which no longer
+// exists was deleted, and is sent with no data.  The replicas which failed
+// to take it are retried.
+func (ln *LocalNode) replicateKey(r replication) {
+	to := r.to
+	if to == nil {
+		to = ln.Replicas()
+	}
+	current, archived, err := file.ReadKeyVersions(r.dataPath, r.key)
+	deleted := os.IsNotExist(errors.Cause(err))
+	if err != nil && !deleted {
+		glog.Infof("failed to read %s to replicate: %v", r.key, err)
+		ln.retryReplication(r, to)
+		return
+	}
+	var failed []models.Node
+	for _, replica := range to {
+		rn, err := NewRemoteNode(replica.Addr, replica.PublicKey)
+		if err != nil {
+			glog.Infof("error creating new remote node for replica: %v", err)
+			failed = append(failed, replica)
+			continue
+		}
+		if !deleted {
+			if err := ln.transferVersions(rn, r.key, archived); err != nil {
+				// the current copy matters most, so it is still sent
+				glog.Infof("failed to replicate versions of %s to %s: %v", r.key, replica, err)
+			}
+		}
+		if err := rn.ReplicateKey(r.key, current.Data, current.Version, ln.server.PrivateKey); err != nil {
+			glog.Infof("failed to replicate %s to %s: %v", r.key, replica, err)
+			failed = append(failed, replica)
+		}
+	}
+	ln.retryReplication(r, failed)
+}
+
+// retryReplication - queue r again for the replicas which failed to take
+// it, once it has waited out its backoff, unless it has used its attempts
+func (ln *LocalNode) retryReplication(r replication, failed []models.Node) {
+	if len(failed) == 0 {
+		return
+	}
+	if r.attempt+1 >= replicationAttempts {
+		glog.Warningf("giving up replicating %s to %d replicas after %d attempts",
+			r.key, len(failed), replicationAttempts)
+		return
+	}
+	retry := replication{dataPath: r.dataPath, key: r.key, to: failed, attempt: r.attempt + 1}
+	wait := replicationBackoff << uint(r.attempt)
+	glog.Infof("replicating %s to %d replicas again in %s", r.key, len(failed), wait)
+	time.AfterFunc(wait, func() {
+		ln.queueReplications(retry)
+	})
+}
+
+// SuccessorListHandler - the handler to handle all server calls to get the
+// successor list of the local node
+func (ln *LocalNode) SuccessorListHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var out = new(bytes.Buffer)
+	if err := gob.NewEncoder(out).Encode(models.SuccessorListResponse{
+		Successors:        ln.SuccessorList(),
+		ReplicationFactor: ln.server.RingSettings().ReplicationFactor,
+	}); err != nil {
+		glog.Infof("encode successor list response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
@@ -0,0 +1,66 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// Stats - the resources stored in dataPath, the requests the node has
+// handled since it started, and the breakers of the peers it is failing to
+// reach
+func (ln *LocalNode) Stats(dataPath string) (models.StatsResponse, error) {
+	resources, size, err := file.Usage(dataPath)
+	if err != nil {
+		return models.StatsResponse{}, err
+	}
+	requests, failures := ln.server.RequestCounts()
+	breakers := make(map[string]models.BreakerStats)
+	for _, stat := range protocol.Breakers.Stats() {
+		breakers[stat.Addr] = models.BreakerStats{
+			State:               protocol.BreakerStateToString[stat.State],
+			ConsecutiveFailures: stat.ConsecutiveFailures,
+		}
+	}
+	return models.StatsResponse{
+		Resources: resources,
+		Bytes:     size,
+		Requests:  requests,
+		Failures:  failures,
+		Uptime:    ln.server.Uptime(),
+		Breakers:  breakers,
+	}, nil
+}
+
+// StatsHandler - the handler to handle all server calls for the stats of
+// this local node, which only admins can ask for
+func (ln *LocalNode) StatsHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		dataPath = ctx.Value(models.DataPathContextKey).(string)
+		out      = &bytes.Buffer{}
+	)
+
+	if !protocol.IsAdmin(ctx, r) {
+		glog.Infof("stats by %s rejected, not an admin", r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "stats are only given to admins")
+	}
+
+	result, err := ln.Stats(dataPath)
+	if err != nil {
+		glog.Infof("stats failed: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read stored resources")
+	}
+	if err := gob.NewEncoder(out).Encode(result); err != nil {
+		glog.Infof("encode stats response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
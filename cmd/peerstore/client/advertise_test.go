@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/node"
+)
+
+func TestAdvertiseAddr(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "advertise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenAddr := l.Addr().String()
+	l.Close()
+	// reaches the same listener, as a public address behind NAT would
+	_, port, _ := net.SplitHostPort(listenAddr)
+	advertiseAddr := net.JoinHostPort("localhost", port)
+
+	key, err := node.LoadOrCreateKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := node.Start(node.Config{
+		ListenAddr:         listenAddr,
+		AdvertiseAddr:      advertiseAddr,
+		DataPath:           dir,
+		RequestQueueBuffer: uint(runtime.NumCPU() * 20),
+		RequestNumWorkers:  16,
+		RingSettings: models.RingSettings{
+			SuccessorListLength: 1,
+			ReplicationFactor:   1,
+		},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quit, done := make(chan bool), make(chan bool)
+	go n.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	peer := models.Node{Addr: listenAddr, PublicKey: key.Public().(*rsa.PublicKey)}
+	id, privateKey := registerTestUser(t, peer)
+	tr, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	successor, err := getNode(fileToKeyIdentifier("advertised.txt"), id, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successor.Addr != advertiseAddr {
+		t.Errorf("expected the successor at the advertised address %s, got %s", advertiseAddr, successor.Addr)
+	}
+}
+
+func TestEmbeddedAdvertiseAddr(t *testing.T) {
+	defer func(listen, advertise, peer string) {
+		embeddedAddr, embeddedAdvertiseAddr, peerAddr = listen, advertise, peer
+	}(embeddedAddr, embeddedAdvertiseAddr, peerAddr)
+
+	var cases = []struct {
+		listen, advertise, peer string
+		expected                string
+		ok                      bool
+	}{
+		// standalone, nothing needs to reach it
+		{":3000", "", "", ":3000", true},
+		// joining a ring, the other nodes cannot reach :3000
+		{":3000", "", "peer:3000", "", false},
+		{":3000", "laptop.example.com:3000", "peer:3000", "laptop.example.com:3000", true},
+		{"10.0.0.5:3000", "", "peer:3000", "10.0.0.5:3000", true},
+	}
+	for _, c := range cases {
+		embeddedAddr, embeddedAdvertiseAddr, peerAddr = c.listen, c.advertise, c.peer
+		err := validateEmbeddedAddrs()
+		if (err == nil) != c.ok {
+			t.Errorf("listen %q, advertise %q, peer %q: got %v", c.listen, c.advertise, c.peer, err)
+			continue
+		}
+		if c.ok && embeddedAdvertiseAddr != c.expected {
+			t.Errorf("listen %q, advertise %q: advertised %q, expected %q", c.listen, c.advertise, embeddedAdvertiseAddr, c.expected)
+		}
+	}
+}
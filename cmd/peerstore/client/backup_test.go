@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+func TestBackupEmptyFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	saved := encryption
+	defer func() { encryption = saved }()
+	for _, mode := range []string{cbcEncryption, gcmEncryption, streamEncryption} {
+		encryption = mode
+		name := mode + ".txt"
+		if err := ioutil.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(id, root, filepath.Join(root, name), n.peer, privateKey, nil, nil); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+
+		// the iv or nonce is stored even with no data to encrypt
+		resp, _ := getTestFile(t, fileToKeyIdentifier(name), id, n.peer, privateKey)
+		if len(resp.Data) == 0 {
+			t.Errorf("%s: expected the empty file stored encrypted, got no data", mode)
+		}
+		dest := filepath.Join(root, name+".restored")
+		if err := getFileToPath(id, fileToKeyIdentifier(name), 0, n.peer, privateKey, dest); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if got, err := ioutil.ReadFile(dest); err != nil || len(got) != 0 {
+			t.Errorf("%s: restored %q, %v, expected an empty file", mode, got, err)
+		}
+	}
+}
+
+func TestBackupLargerThanChunk(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	saved := encryption
+	defer func() { encryption = saved }()
+	encryption = streamEncryption
+
+	// two full chunks and a short one, staged by the node until the last
+	data := bytes.Repeat([]byte("chunked "), (2*uploadChunkSize+100)/8)
+	path := filepath.Join(root, "large.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(root, "large.restored")
+	if err := getFileToPath(id, fileToKeyIdentifier("large.bin"), 0, n.peer, privateKey, dest); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dest); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("restored %d bytes, %v, expected the %d backed up", len(got), err, len(data))
+	}
+}
+
+func TestBackupSkipsUnreadableFiles(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "unreadable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// a file deleted between the walk listing it and reading it
+	err = backupFile(id, root, filepath.Join(root, "vanished.txt"), n.peer, privateKey, nil, nil)
+	if err == nil || !isUnreadable(err) {
+		t.Fatalf("expected a vanished file to be unreadable, got %v", err)
+	}
+
+	// a socket is listed by the walk, but cannot be opened, and the files
+	// either side of it are still backed up
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("unix", filepath.Join(root, "b.sock"))
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	defer l.Close()
+
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatalf("expected the backup to skip the unreadable file, got %v", err)
+	}
+	tl, err := GetTransactionLog(id, n.peer, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if _, ok := tl[name]; !ok {
+			t.Errorf("expected %s backed up", name)
+		}
+	}
+	if _, ok := tl["b.sock"]; ok {
+		t.Error("expected the socket skipped")
+	}
+
+	// an atomic backup is all or none, so the unreadable file fails it,
+	// and the file walked before it is not logged
+	if err := ioutil.WriteFile(filepath.Join(root, "0.txt"), []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old bool) { atomicBackup = old }(atomicBackup)
+	atomicBackup = true
+	if err := backupTree(id, root, n.peer, privateKey); err == nil {
+		t.Fatal("expected an atomic backup with an unreadable file to fail")
+	}
+	if tl, err = GetTransactionLog(id, n.peer, &privateKey.PublicKey, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tl["0.txt"]; ok {
+		t.Error("expected nothing of the failed atomic backup logged")
+	}
+
+	// only reading the file to back up makes it unreadable
+	if isUnreadable(errors.Wrap(&os.PathError{Op: "open", Path: "manifest", Err: os.ErrPermission}, "failed to save manifest")) {
+		t.Error("expected a failure writing the manifest not to be unreadable")
+	}
+
+	// nor is a file sync cannot read posted as empty
+	defer func(saved string) { localPath = saved }(localPath)
+	localPath = root
+	if err := PostFile(id, "missing.txt", n.peer, privateKey); !isUnreadable(err) {
+		t.Errorf("expected a missing file unreadable, got %v", err)
+	}
+}
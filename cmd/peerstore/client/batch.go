@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// maxBatchFileSize - the largest file fetched in a batch when restoring,
+// larger ones are downloaded on their own in ranges
+const maxBatchFileSize = 1 << 20
+
+// restoreFile - a file of a transaction log to restore to dest
+type restoreFile struct {
+	name, dest string
+	entry      models.TransactionEntry
+}
+
+// getBatch - get the resources keys from node in one round trip, the ones
+// missing from the result have to be fetched one by one
+func getBatch(id models.Identifier, keys []models.Identifier, node models.Node, privateKey *rsa.PrivateKey) (map[models.Identifier]models.BatchResource, error) {
+	var reqBuffer = new(bytes.Buffer)
+	if err := gob.NewEncoder(reqBuffer).Encode(keys); err != nil {
+		return nil, errors.Wrap(err, "failed to encode keys")
+	}
+	t, err := createTransport(id, node, privateKey)
+	if err != nil {
+		lookups.invalidate(node)
+		return nil, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+
+	resp, err := retryRoundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type:       protocol.UserType,
+			From:       id,
+			DataLength: uint64(reqBuffer.Len()),
+		},
+		Method: protocol.BatchGetMethod,
+		Data:   reqBuffer.Bytes(),
+	})
+	if err == nil {
+		err = resp.Err()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed batch get")
+	}
+	var result models.BatchGetResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "failed to decode batch get response")
+	}
+	return result.Resources, nil
+}
+
+// writeBatchResource - decrypt resource, fetched in a batch, and write it to
+// dest
+func writeBatchResource(resource models.BatchResource, dest string, privateKey *rsa.PrivateKey) error {
+	sessionKey, err := crypto.DecryptRSA(privateKey, resource.Secret)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt session key")
+	}
+	if err := verifyPayloadTag(sessionKey, resource.Data, resource.Tag); err != nil {
+		return err
+	}
+	plaintext, err := openPayload(sessionKey, resource.Data, resource.Tag)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt data")
+	}
+	tmp := dest + ".part"
+	if err := ioutil.WriteFile(tmp, plaintext, 0644); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to write destination")
+	}
+	return os.Rename(tmp, dest)
+}
+
+// restoreFiles - restore files, getting the small ones stored on the same
+// node in batches rather than a round trip each.  A file a batch leaves out
+// is downloaded on its own.  Each file restored is recorded in manifest, if
+// given.  It returns how many were restored and failed.
+func restoreFiles(id models.Identifier, files []restoreFile, peer models.Node, privateKey *rsa.PrivateKey, manifest *restoreManifest) (restored, failed int) {
+	var (
+		nodes   = map[string]models.Node{}
+		batches = map[string][]restoreFile{}
+		single  []restoreFile
+	)
+	for _, f := range files {
+		if f.entry.Size > maxBatchFileSize {
+			single = append(single, f)
+			continue
+		}
+		node, err := findNode(fileToKeyIdentifier(f.name), id, peer, privateKey)
+		if err != nil {
+			single = append(single, f)
+			continue
+		}
+		nodes[node.Addr] = node
+		batches[node.Addr] = append(batches[node.Addr], f)
+	}
+
+	restore := func(f restoreFile, resource *models.BatchResource) {
+		err := os.MkdirAll(filepath.Dir(f.dest), 0700)
+		if err == nil && resource != nil {
+			err = writeBatchResource(*resource, f.dest, privateKey)
+		} else if err == nil {
+			err = getFileToPath(id, fileToKeyIdentifier(f.name), f.entry.Version, peer, privateKey, f.dest)
+		}
+		if err == nil && xattrs {
+			err = restoreAttributes(id, f.name, f.dest, peer, privateKey)
+		}
+		if err == nil {
+			err = applyModTime(f.dest, f.entry)
+		}
+		if !handleError(errors.Wrapf(err, "failed to restore %s", f.name)) {
+			failed++
+			return
+		}
+		manifest.record(f.name, f.entry)
+		restored++
+	}
+
+	for addr, batch := range batches {
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > models.MaxBatchKeys {
+				n = models.MaxBatchKeys
+			}
+			var keys []models.Identifier
+			for _, f := range batch[:n] {
+				keys = append(keys, fileToKeyIdentifier(f.name))
+			}
+			resources, err := getBatch(id, keys, nodes[addr], privateKey)
+			if err != nil {
+				log.Printf("failed to get %d resources from %s in a batch, getting them one by one: %v", n, addr, err)
+			}
+			for i, f := range batch[:n] {
+				resource, ok := resources[keys[i]]
+				// a pinned version other than the latest is only kept
+				// in the node's archive
+				if ok && (f.entry.Version == 0 || f.entry.Version == resource.Version) {
+					restore(f, &resource)
+				} else {
+					restore(f, nil)
+				}
+			}
+			batch = batch[n:]
+		}
+	}
+	for _, f := range single {
+		restore(f, nil)
+	}
+	return restored, failed
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestBatchGet(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+	otherID, otherKey := registerTestUser(t, n.peer)
+
+	mine := map[string]string{
+		"a.txt":     "first",
+		"b.txt":     "second",
+		"dir/c.txt": "third",
+	}
+	for owner, files := range map[models.Identifier]map[string]string{
+		id:      mine,
+		otherID: {"theirs.txt": "not yours"},
+	} {
+		root, err := ioutil.TempDir("", "batch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		for name, contents := range files {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		key := privateKey
+		if owner == otherID {
+			key = otherKey
+		}
+		if err := backupTree(owner, root, n.peer, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := []models.Identifier{fileToKeyIdentifier("theirs.txt"), fileToKeyIdentifier("missing.txt")}
+	for name := range mine {
+		keys = append(keys, fileToKeyIdentifier(name))
+	}
+	resources, err := getBatch(id, keys, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != len(mine) {
+		t.Errorf("expected only the %d resources owned, got %d", len(mine), len(resources))
+	}
+	if _, ok := resources[fileToKeyIdentifier("theirs.txt")]; ok {
+		t.Error("expected the resource of another user left out")
+	}
+
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, contents := range mine {
+		resource, ok := resources[fileToKeyIdentifier(name)]
+		if !ok {
+			t.Errorf("expected %s in the batch", name)
+			continue
+		}
+		dest := filepath.Join(dir, filepath.Base(name))
+		if err := writeBatchResource(resource, dest, privateKey); err != nil {
+			t.Fatalf("failed to decrypt %s: %v", name, err)
+		}
+		if got, _ := ioutil.ReadFile(dest); string(got) != contents {
+			t.Errorf("expected %s to be %q, got %q", name, contents, got)
+		}
+	}
+
+	// the other user cannot read the first user's resources either
+	if resources, err := getBatch(otherID, keys, n.peer, otherKey); err != nil || len(resources) != 1 {
+		t.Errorf("expected only the other user's resource, got %d, %v", len(resources), err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// deviceID - the id this client stamps its changes in the transaction log
+// with.  Every device of a user shares the user's id, so the id is derived
+// from the device and the directory it syncs as well, telling changes made
+// concurrently on two devices apart.
+var deviceID models.Identifier
+
+// clientDeviceID - the device id of the client of the user id syncing
+// localPath on this host
+func clientDeviceID(id models.Identifier, localPath string) models.Identifier {
+	hostname, _ := os.Hostname()
+	if abs, err := filepath.Abs(localPath); err == nil {
+		localPath = abs
+	}
+	return models.HashBytes([]byte(id.String() + hostname + localPath))
+}
+
+// clocksFile - the file at the root of localPath recording the vector clock
+// of each resource as this client last knew it, so a restarted client still
+// tells changes it knew of from those made concurrently
+const clocksFile = ".peerstoreclocks"
+
+// knownClocks - the vector clock of each resource as this client last synced
+// or changed it.  A change the client makes is stamped as following only the
+// changes it knew of, so a change another client made in the meantime is
+// seen as concurrent rather than overwritten.
+type knownClocks struct {
+	// path - where the clocks are saved, empty if they are not
+	path   string
+	clocks map[string]models.VectorClock
+	mu     *sync.Mutex
+}
+
+// newKnownClocks - a client which knows of no changes yet
+func newKnownClocks() *knownClocks {
+	return &knownClocks{
+		clocks: make(map[string]models.VectorClock),
+		mu:     new(sync.Mutex),
+	}
+}
+
+// loadKnownClocks - the clocks of the resources the client syncing root
+// knew of when it last ran, none if there are none.  Clocks which cannot be
+// read are started afresh, as a resource the client knows of no changes to
+// is taken to be deliberately overwritten.
+func loadKnownClocks(root string) *knownClocks {
+	kc := newKnownClocks()
+	kc.path = filepath.Join(root, clocksFile)
+	data, err := ioutil.ReadFile(kc.path)
+	if os.IsNotExist(err) {
+		return kc
+	}
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&kc.clocks)
+	}
+	if err != nil {
+		log.Printf("ignoring unreadable clocks %s: %s", kc.path, err)
+		kc.clocks = make(map[string]models.VectorClock)
+	}
+	return kc
+}
+
+// known - the clocks of the resources this client has synced or changed
+var known = newKnownClocks()
+
+// learn - record that the client now knows of every change clock knows of
+// to the resource at path
+func (kc *knownClocks) learn(path string, clock models.VectorClock) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	current, ok := kc.clocks[path]
+	merged := current.Merge(clock)
+	if ok && merged.Compare(current) == models.ClocksEqual {
+		// nothing new to save
+		return
+	}
+	kc.clocks[path] = merged
+	handleError(kc.save())
+}
+
+// next - the clock of a change by clientID to the resource at path, which
+// the client then knows of.  A resource the client has never synced is
+// being deliberately overwritten, so the change follows every change in
+// remote, the resource's entity in the transaction log.
+func (kc *knownClocks) next(path string, clientID models.Identifier, remote models.TransactionEntity) models.VectorClock {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	base, ok := kc.clocks[path]
+	if !ok {
+		base = remote.Clock()
+	}
+	clock := base.Increment(clientID)
+	kc.clocks[path] = clock
+	handleError(kc.save())
+	return clock
+}
+
+func (kc *knownClocks) save() error {
+	if kc.path == "" {
+		return nil
+	}
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(kc.clocks); err != nil {
+		return errors.Wrap(err, "failed to encode clocks")
+	}
+	return errors.Wrap(writeFileAtomic(kc.path, buf.Bytes()), "failed to write clocks")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// loadConfig - apply the settings of the json config file at path to every
+// flag of fs not given on the command line, so the command line overrides the
+// file.  The file is an object keyed by flag name, such as
+// {"peerAddr": ":3001", "poll": "5s", "exclude": ["*.swp", ".git/"]}, a
+// list setting a repeatable flag once for each of its values.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config")
+	}
+	var settings map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			return errors.Errorf("%s is not valid json, line %d: %s",
+				path, lineOf(data, syntaxErr.Offset), syntaxErr)
+		}
+		return errors.Errorf("%s must be a json object of flag names to values: %s", path, err)
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	// sorted, so the same bad file always reports the same error
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return errors.Errorf("%s: unknown setting %q, settings are named as the flags", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		values, ok := settings[name].([]interface{})
+		if !ok {
+			values = []interface{}{settings[name]}
+		}
+		for _, value := range values {
+			switch value.(type) {
+			case string, json.Number, bool:
+			default:
+				return errors.Errorf("%s: setting %q must be a string, number, boolean or a list of them", path, name)
+			}
+			if err := fs.Set(name, fmt.Sprint(value)); err != nil {
+				return errors.Wrapf(err, "%s: invalid value %v for setting %q", path, value, name)
+			}
+		}
+	}
+	return nil
+}
+
+// lineOf - the line of data the byte offset is on, counting from one
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags - a flag set with a few of the client's kinds of flag
+type testFlags struct {
+	fs       *flag.FlagSet
+	peerAddr string
+	poll     time.Duration
+	atomic   bool
+	streams  int
+	excludes patternList
+}
+
+func newTestFlags() *testFlags {
+	tf := &testFlags{fs: flag.NewFlagSet("client", flag.ContinueOnError)}
+	tf.fs.SetOutput(ioutil.Discard)
+	tf.fs.StringVar(&tf.peerAddr, "peerAddr", "", "")
+	tf.fs.DurationVar(&tf.poll, "poll", time.Second, "")
+	tf.fs.BoolVar(&tf.atomic, "atomic", false, "")
+	tf.fs.IntVar(&tf.streams, "downloadStreams", 4, "")
+	tf.fs.Var(&tf.excludes, "exclude", "")
+	return tf
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "client.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, `{
+	"peerAddr": ":3001",
+	"poll": "5s",
+	"atomic": true,
+	"downloadStreams": 8,
+	"exclude": ["*.swp", ".git/"]
+}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	tf := newTestFlags()
+	if err := tf.fs.Parse([]string{"-peerAddr", ":4001", "-downloadStreams", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(tf.fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if tf.peerAddr != ":4001" || tf.streams != 2 {
+		t.Errorf("expected the command line to override the file, got peerAddr %q, downloadStreams %d",
+			tf.peerAddr, tf.streams)
+	}
+	if tf.poll != 5*time.Second || !tf.atomic {
+		t.Errorf("expected the file to set the flags not given, got poll %s, atomic %v", tf.poll, tf.atomic)
+	}
+	if len(tf.excludes) != 2 || tf.excludes[0] != "*.swp" || tf.excludes[1] != ".git/" {
+		t.Errorf("expected a list to set a repeatable flag once for each value, got %v", tf.excludes)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		contents string
+		expected string
+	}{
+		{"{\n\t\"peerAddr\": \":3001\",\n\t\"poll\" \"5s\"\n}", "not valid json, line 3"},
+		{`["peerAddr"]`, "must be a json object"},
+		{`{"peerAdress": ":3001"}`, `unknown setting "peerAdress"`},
+		{`{"poll": "often"}`, `invalid value often for setting "poll"`},
+		{`{"peerAddr": {"host": "localhost"}}`, `setting "peerAddr" must be a string`},
+	} {
+		path := writeConfig(t, c.contents)
+		err := loadConfig(newTestFlags().fs, path)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("expected an error containing %q for %s, got %v", c.expected, c.contents, err)
+		}
+	}
+}
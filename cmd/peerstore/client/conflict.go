@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/husobee/peerstore/models"
+)
+
+const (
+	// newestWins - the conflicting change with the latest lamport timestamp
+	// replaces the others.  The client which made it posts it again, which
+	// resolves the conflict.
+	newestWins = "newest-wins"
+	// keepBoth - the local file is kept, and every other conflicting change
+	// is written beside it, named by conflictCopyName.  Editing the file
+	// resolves the conflict.
+	keepBoth = "keep-both"
+	// promptConflict - ask on the terminal which change to keep
+	promptConflict = "prompt"
+)
+
+// conflictCopyMarker - what the names of conflict copies contain
+const conflictCopyMarker = ".conflict-"
+
+// promptInput - where the answers to prompts on the terminal are read from
+var promptInput = bufio.NewReader(os.Stdin)
+
+// conflictCopyName - the name of the copy of the resource at path, holding
+// the conflicting change made by client
+func conflictCopyName(path string, client models.Identifier) string {
+	return path + conflictCopyMarker + client.String()
+}
+
+// isConflictCopy - check if path is a conflict copy, named as
+// conflictCopyName names them.  Copies are never uploaded, or every other
+// client would sync them and conflict in turn.
+func isConflictCopy(path string) bool {
+	base := filepath.Base(path)
+	i := strings.LastIndex(base, conflictCopyMarker)
+	if i <= 0 {
+		return false
+	}
+	client := base[i+len(conflictCopyMarker):]
+	if len(client) != hex.EncodedLen(models.IdentifierLen) {
+		return false
+	}
+	_, err := hex.DecodeString(client)
+	return err == nil
+}
+
+// conflictResolution - what resolving a conflict does to the resource
+type conflictResolution struct {
+	// fetch - the change to write over the local file, nil keeps the local
+	// file
+	fetch *models.TransactionEntry
+	// copies - the changes to write beside the local file as conflict copies
+	copies []models.TransactionEntry
+	// post - post the local file once fetched, the change following every
+	// conflicting change, which resolves the conflict
+	post bool
+}
+
+// newestChange - the change with the latest lamport timestamp, ties broken
+// by client id so every client picks the same one
+func newestChange(changes []models.TransactionEntry) models.TransactionEntry {
+	newest := changes[0]
+	for _, c := range changes[1:] {
+		if c.Timestamp > newest.Timestamp || c.Timestamp == newest.Timestamp &&
+			bytes.Compare(c.ClientID[:], newest.ClientID[:]) > 0 {
+			newest = c
+		}
+	}
+	return newest
+}
+
+// changesBy - the changes made by client, and the changes made by others
+func changesBy(client models.Identifier, changes []models.TransactionEntry) (mine, others []models.TransactionEntry) {
+	for _, c := range changes {
+		if c.ClientID.Equal(client) {
+			mine = append(mine, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+	return mine, others
+}
+
+// allDirectories - check if every change records a directory, creating the
+// same directory concurrently is not a conflict
+func allDirectories(changes []models.TransactionEntry) bool {
+	for _, c := range changes {
+		if c.Operation != models.DirectoryOperation {
+			return false
+		}
+	}
+	return true
+}
+
+// unversioned - the first of the changes to keep a copy of which was stored
+// by a node which does not retain versions, so cannot be fetched as it was
+func unversioned(changes []models.TransactionEntry) (models.TransactionEntry, bool) {
+	for _, c := range changes {
+		if c.Operation == models.UpdateOperation && c.Version == 0 {
+			return c, true
+		}
+	}
+	return models.TransactionEntry{}, false
+}
+
+// resolveConflict - how strategy resolves the concurrent changes heads to
+// the resource at path, on the client device
+func resolveConflict(strategy string, device models.Identifier, path string, heads []models.TransactionEntry) conflictResolution {
+	switch strategy {
+	case newestWins:
+		newest := newestChange(heads)
+		if newest.ClientID.Equal(device) {
+			return conflictResolution{post: true}
+		}
+		// the client which made it resolves the conflict
+		return conflictResolution{fetch: &newest}
+	case keepBoth:
+		mine, others := changesBy(device, heads)
+		var res conflictResolution
+		if len(mine) > 0 {
+			res.copies = others
+		} else {
+			// the conflict is between other clients, keep the newest
+			// change in place of our stale copy
+			newest := newestChange(others)
+			res.fetch = &newest
+			for _, c := range others {
+				if c.ClientID != newest.ClientID || c.Timestamp != newest.Timestamp {
+					res.copies = append(res.copies, c)
+				}
+			}
+		}
+		if c, ok := unversioned(res.copies); ok {
+			// the copy would be of whichever change was stored last, which
+			// could be our own, and the other change lost
+			log.Printf("cannot keep both changes to %s, the change by %s was stored without a version, leaving the conflict",
+				path, c.ClientID)
+			return conflictResolution{}
+		}
+		return res
+	case promptConflict:
+		return promptResolution(device, path, heads)
+	}
+	return conflictResolution{}
+}
+
+// promptResolution - ask on the terminal how to resolve the concurrent
+// changes heads to the resource at path.  Without an answer the conflict is
+// left as it is.
+func promptResolution(device models.Identifier, path string, heads []models.TransactionEntry) conflictResolution {
+	fmt.Printf("%s was changed concurrently:\n", path)
+	for _, h := range heads {
+		by := h.ClientID.String()
+		if h.ClientID.Equal(device) {
+			by = "this client"
+		}
+		op := "changed"
+		if h.Operation == models.DeleteOperation {
+			op = "deleted"
+		}
+		fmt.Printf("  %s by %s at %d\n", op, by, h.Timestamp)
+	}
+	fmt.Print("keep [l]ocal, take [r]emote or keep [b]oth? ")
+	answer, err := promptInput.ReadString('\n')
+	if err != nil && answer == "" {
+		log.Printf("no answer for the conflict on %s, leaving it: %v", path, err)
+		return conflictResolution{}
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "l", "local":
+		return conflictResolution{post: true}
+	case "r", "remote":
+		_, others := changesBy(device, heads)
+		if len(others) == 0 {
+			return conflictResolution{post: true}
+		}
+		newest := newestChange(others)
+		return conflictResolution{fetch: &newest, post: true}
+	case "b", "both":
+		return resolveConflict(keepBoth, device, path, heads)
+	}
+	log.Printf("unrecognized answer %q for the conflict on %s, leaving it", answer, path)
+	return conflictResolution{}
+}
+
+// applyConflictResolution - make the changes res resolves the conflict on
+// the resource at path with
+func applyConflictResolution(clientID models.Identifier, path string, res conflictResolution, peer models.Node, privateKey *rsa.PrivateKey) {
+	local := filepath.Join(localPath, filepath.FromSlash(path))
+	for _, c := range res.copies {
+		if c.Operation != models.UpdateOperation {
+			// nothing to keep a copy of
+			continue
+		}
+		copyPath := filepath.FromSlash(conflictCopyName(path, c.ClientID))
+		log.Printf("keeping the conflicting change to %s in %s", path, copyPath)
+		fetchFile(clientID, path, c.Version, peer, privateKey,
+			filepath.Join(localPath, copyPath))
+	}
+	if res.fetch != nil {
+		switch res.fetch.Operation {
+		case models.DeleteOperation:
+			os.Remove(local)
+			status.recordDelete()
+		case models.DirectoryOperation:
+			os.MkdirAll(local, 0700)
+		case models.SymlinkOperation:
+			handleError(restoreSymlink(local, *res.fetch))
+		default:
+			fetchFile(clientID, path, res.fetch.Version, peer, privateKey, local)
+		}
+	}
+	if res.post {
+		fi, err := os.Lstat(local)
+		switch {
+		case os.IsNotExist(err):
+			DeleteFile(clientID, path, peer, privateKey)
+		case err == nil && fi.IsDir():
+			PostDirectory(clientID, path, peer, privateKey)
+		default:
+			PostFile(clientID, path, peer, privateKey)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+var (
+	deviceA = models.Identifier{0: 0xa}
+	deviceB = models.Identifier{0: 0xb}
+)
+
+// concurrentEdits - the log entity of path after device a and device b both
+// synced the same change and then edited path before syncing again, a's
+// edit stamped later than b's
+func concurrentEdits(t *testing.T, path string) (entity models.TransactionEntity, a, b *knownClocks) {
+	a, b = newKnownClocks(), newKnownClocks()
+	entity.Entries = []models.TransactionEntry{{
+		ClientID:  deviceA,
+		Timestamp: 1,
+		Clock:     a.next(path, deviceA, entity),
+	}}
+	b.learn(path, entity.Clock())
+
+	editA := models.TransactionEntry{ClientID: deviceA, Timestamp: 5, Version: 3, Clock: a.next(path, deviceA, entity)}
+	editB := models.TransactionEntry{ClientID: deviceB, Timestamp: 3, Version: 2, Clock: b.next(path, deviceB, entity)}
+	entity.Entries = append(entity.Entries, editA, editB)
+	if latest := entity.Latest(); len(latest) != 2 {
+		t.Fatalf("expected the edits to conflict, latest is %+v", latest)
+	}
+	return entity, a, b
+}
+
+func TestKnownClocksSurviveRestart(t *testing.T) {
+	root, err := ioutil.TempDir("", "clocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var entity models.TransactionEntity
+	a := loadKnownClocks(root)
+	entity.Entries = []models.TransactionEntry{{
+		ClientID: deviceA, Timestamp: 1, Clock: a.next("file.txt", deviceA, entity),
+	}}
+	b := newKnownClocks()
+	b.learn("file.txt", entity.Clock())
+	entity.Entries = append(entity.Entries, models.TransactionEntry{
+		ClientID: deviceB, Timestamp: 2, Clock: b.next("file.txt", deviceB, entity),
+	})
+
+	// a restarts before syncing b's edit, and edits the file again, which is
+	// concurrent with b's edit rather than following it
+	a = loadKnownClocks(root)
+	entity.Entries = append(entity.Entries, models.TransactionEntry{
+		ClientID: deviceA, Timestamp: 3, Clock: a.next("file.txt", deviceA, entity),
+	})
+	if latest := entity.Latest(); len(latest) != 2 {
+		t.Errorf("expected the edit after the restart to conflict, latest is %+v", latest)
+	}
+}
+
+func TestConflictNewestWins(t *testing.T) {
+	entity, a, _ := concurrentEdits(t, "file.txt")
+	heads := entity.Latest()
+
+	resA := resolveConflict(newestWins, deviceA, "file.txt", heads)
+	if !resA.post || resA.fetch != nil || len(resA.copies) != 0 {
+		t.Errorf("expected a, which made the newest edit, to post it, got %+v", resA)
+	}
+	resB := resolveConflict(newestWins, deviceB, "file.txt", heads)
+	if resB.post || resB.fetch == nil || !resB.fetch.ClientID.Equal(deviceA) {
+		t.Errorf("expected b to fetch a's edit, got %+v", resB)
+	}
+
+	// a's post follows both edits, resolving the conflict
+	a.learn("file.txt", entity.Clock())
+	entity.Entries = append(entity.Entries, models.TransactionEntry{
+		ClientID: deviceA, Timestamp: 6, Clock: a.next("file.txt", deviceA, entity),
+	})
+	if latest := entity.Latest(); len(latest) != 1 || latest[0].Timestamp != 6 {
+		t.Errorf("expected the post to resolve the conflict, latest is %+v", latest)
+	}
+}
+
+func TestConflictKeepBoth(t *testing.T) {
+	entity, _, _ := concurrentEdits(t, "dir/file.txt")
+	heads := entity.Latest()
+
+	for _, c := range []struct{ device, other models.Identifier }{
+		{deviceA, deviceB},
+		{deviceB, deviceA},
+	} {
+		res := resolveConflict(keepBoth, c.device, "dir/file.txt", heads)
+		if res.post || res.fetch != nil {
+			t.Errorf("expected the local file to be kept as it is, got %+v", res)
+		}
+		if len(res.copies) != 1 || !res.copies[0].ClientID.Equal(c.other) {
+			t.Fatalf("expected a copy of the other edit, got %+v", res.copies)
+		}
+		name := conflictCopyName("dir/file.txt", c.other)
+		if name != "dir/file.txt.conflict-"+c.other.String() {
+			t.Errorf("unexpected conflict copy name %s", name)
+		}
+		if !isConflictCopy(name) {
+			t.Errorf("expected %s to be a conflict copy, which is never uploaded", name)
+		}
+	}
+	for _, name := range []string{
+		"dir/file.txt", "conflict/file.txt", "notes.conflict-resolution.txt",
+		".conflict-" + deviceA.String(), "file.txt.conflict-" + deviceA.String()[2:],
+	} {
+		if isConflictCopy(name) {
+			t.Errorf("expected %s not to be a conflict copy", name)
+		}
+	}
+
+	// a third client which edited neither takes the newest edit, and keeps
+	// the other beside it
+	res := resolveConflict(keepBoth, models.Identifier{0: 0xc}, "dir/file.txt", heads)
+	if res.fetch == nil || !res.fetch.ClientID.Equal(deviceA) ||
+		len(res.copies) != 1 || !res.copies[0].ClientID.Equal(deviceB) {
+		t.Errorf("expected a's edit fetched and b's copied, got %+v", res)
+	}
+}
+
+func TestConflictKeepBothNeedsVersions(t *testing.T) {
+	entity, _, _ := concurrentEdits(t, "file.txt")
+	heads := entity.Latest()
+	for i := range heads {
+		heads[i].Version = 0
+	}
+	// a copy of a change stored without a version would be of whichever
+	// change was stored last, so the conflict is left instead
+	res := resolveConflict(keepBoth, deviceB, "file.txt", heads)
+	if res.post || res.fetch != nil || len(res.copies) != 0 {
+		t.Errorf("expected the conflict left as it is, got %+v", res)
+	}
+}
+
+func TestConflictPrompt(t *testing.T) {
+	entity, _, _ := concurrentEdits(t, "file.txt")
+	heads := entity.Latest()
+	saved := promptInput
+	defer func() { promptInput = saved }()
+
+	answer := func(s string) conflictResolution {
+		promptInput = bufio.NewReader(strings.NewReader(s))
+		return resolveConflict(promptConflict, deviceB, "file.txt", heads)
+	}
+	if res := answer("l\n"); !res.post || res.fetch != nil {
+		t.Errorf("keep local: expected b to post its edit, got %+v", res)
+	}
+	if res := answer("r\n"); !res.post || res.fetch == nil || !res.fetch.ClientID.Equal(deviceA) {
+		t.Errorf("take remote: expected b to fetch a's edit and post it, got %+v", res)
+	}
+	if res := answer("both\n"); res.post || len(res.copies) != 1 {
+		t.Errorf("keep both: expected a copy of a's edit, got %+v", res)
+	}
+	if res := answer(""); res.post || res.fetch != nil || len(res.copies) != 0 {
+		t.Errorf("no answer: expected the conflict left as it is, got %+v", res)
+	}
+}
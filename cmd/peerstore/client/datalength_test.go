@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+func TestServerChecksDataLength(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	post := func(data []byte, length uint64) (protocol.Response, error) {
+		tr, err := createTransport(id, n.peer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		return tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:          fileToKeyIdentifier("length.txt"),
+				Type:         protocol.UserType,
+				From:         id,
+				PubKey:       privateKey.Public().(*rsa.PublicKey),
+				ResourceName: "length.txt",
+				Secret:       make([]byte, 256),
+				DataLength:   length,
+			},
+			Method: protocol.PostFileMethod,
+			Data:   data,
+		})
+	}
+
+	data := []byte("ten bytes!")
+	if resp, err := post(data, uint64(len(data))); err != nil || resp.Status != protocol.Success {
+		t.Fatalf("expected a post declaring its length to succeed, got %v, %v", err, resp.Err())
+	}
+	for _, length := range []uint64{100, 1 << 40} {
+		resp, err := post(data, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respErr, ok := resp.Err().(*protocol.ResponseError)
+		if !ok || respErr.Code != protocol.BadHeaderCode {
+			t.Errorf("expected a post declaring %d bytes of 10 rejected as a bad header, got %v", length, resp.Err())
+		}
+	}
+
+	// a request larger than the node reads is never read
+	n.Server.SetMaxRequestSize(64 << 10)
+	defer n.Server.SetMaxRequestSize(0)
+	large := make([]byte, 128<<10)
+	if resp, err := post(large, uint64(len(large))); err == nil {
+		t.Errorf("expected a request over the maximum size to fail, got %v", resp.Status)
+	}
+	if resp, err := post(data, uint64(len(data))); err != nil || resp.Status != protocol.Success {
+		t.Errorf("expected the node to carry on serving, got %v, %v", err, errors.Cause(resp.Err()))
+	}
+}
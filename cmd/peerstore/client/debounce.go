@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer - coalesces the events on each path which arrive within window
+// of each other, so fire is called once the path has been quiet for window.
+// Editors write files in bursts, each write of which would otherwise be
+// uploaded in full.
+type debouncer struct {
+	window time.Duration
+	fire   func(path string)
+	timers map[string]*time.Timer
+	mu     *sync.Mutex
+}
+
+// newDebouncer - a debouncer calling fire for a path once its events have
+// stopped for window
+func newDebouncer(window time.Duration, fire func(path string)) *debouncer {
+	return &debouncer{
+		window: window,
+		fire:   fire,
+		timers: make(map[string]*time.Timer),
+		mu:     new(sync.Mutex),
+	}
+}
+
+// event - an event on path, which restarts its quiet period
+func (d *debouncer) event(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.timers[path]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.window, func() {
+		d.mu.Lock()
+		if d.timers[path] != t {
+			// a later event restarted the quiet period, or cancelled it
+			d.mu.Unlock()
+			return
+		}
+		delete(d.timers, path)
+		d.mu.Unlock()
+		d.fire(path)
+	})
+	d.timers[path] = t
+}
+
+// cancel - forget the events on path, fire is not called for them
+func (d *debouncer) cancel(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.timers[path]; ok {
+		t.Stop()
+		delete(d.timers, path)
+	}
+}
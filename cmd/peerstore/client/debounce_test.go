@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// uploadCounter - counts the uploads a debouncer fires, by path
+type uploadCounter struct {
+	uploads map[string]int
+	mu      sync.Mutex
+}
+
+func (uc *uploadCounter) upload(path string) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.uploads[path]++
+}
+
+func (uc *uploadCounter) count(path string) int {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.uploads[path]
+}
+
+func TestDebounceCoalescesWrites(t *testing.T) {
+	uc := &uploadCounter{uploads: make(map[string]int)}
+	d := newDebouncer(50*time.Millisecond, uc.upload)
+
+	for i := 0; i < 10; i++ {
+		d.event("file.txt")
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.event("other.txt")
+	if n := uc.count("file.txt"); n != 0 {
+		t.Fatalf("expected no upload while the file is being written, got %d", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if n := uc.count("file.txt"); n != 1 {
+		t.Errorf("expected exactly one upload of the written file, got %d", n)
+	}
+	if n := uc.count("other.txt"); n != 1 {
+		t.Errorf("expected the other file uploaded on its own, got %d", n)
+	}
+}
+
+func TestDebounceCancel(t *testing.T) {
+	uc := &uploadCounter{uploads: make(map[string]int)}
+	d := newDebouncer(20*time.Millisecond, uc.upload)
+
+	// the file is removed before the writes stop
+	d.event("file.txt")
+	d.cancel("file.txt")
+	time.Sleep(100 * time.Millisecond)
+	if n := uc.count("file.txt"); n != 0 {
+		t.Errorf("expected no upload of the removed file, got %d", n)
+	}
+}
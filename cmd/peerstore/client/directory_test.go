@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// readTree - every file and directory under root, by resource name, with
+// the contents of the files
+func readTree(t *testing.T, root string) map[string]string {
+	tree := make(map[string]string)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := resourceName(root, path)
+		if err != nil {
+			return err
+		}
+		if name == restoredFile {
+			// what restore records of the tree, not part of it
+			return nil
+		}
+		if fi.IsDir() {
+			tree[name+"/"] = ""
+			return nil
+		}
+		contents, err := ioutil.ReadFile(path)
+		tree[name] = string(contents)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestSyncRestoresEmptyDirectories(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	src, err := ioutil.TempDir("", "dirsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	for _, dir := range []string{"a/b", "a/empty", "c"} {
+		if err := os.MkdirAll(filepath.Join(src, filepath.FromSlash(dir)), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"a/b/file.txt": "contents", "empty.txt": ""}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved, savedKnown := localPath, known
+	defer func() { localPath, known = saved, savedKnown }()
+
+	// back the tree up
+	localPath = src
+	if _, err := Synchronize(id, src, n.peer, privateKey, models.TransactionLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// and restore it to a clean location, as a new client
+	dest, err := ioutil.TempDir("", "dirdest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	localPath, known = dest, newKnownClocks()
+	if _, err := Synchronize(id, dest, n.peer, privateKey, models.TransactionLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := readTree(t, src), readTree(t, dest); !reflect.DeepEqual(want, got) {
+		t.Errorf("restored tree %v, expected %v", got, want)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// doctorProbeName - the name the doctor operation posts its probe file as,
+// followed by the id of the user so users running it at once do not collide
+const doctorProbeName = ".peerstore-doctor-probe-"
+
+// doctorCheck - a step of the doctor operation, and why it failed if it did
+type doctorCheck struct {
+	Step string
+	Err  error
+}
+
+// doctorReason - the kind of failure err is, so a failed step says whether
+// the node refused the request, or could not be reached at all
+func doctorReason(err error) string {
+	cause := errors.Cause(err)
+	if respErr, ok := cause.(*protocol.ResponseError); ok {
+		return protocol.ErrorCodeToString[respErr.Code]
+	}
+	switch {
+	case cause == protocol.ErrResourceNotFound:
+		return "not found"
+	case cause == protocol.ErrDraining:
+		return "draining"
+	case cause == context.DeadlineExceeded:
+		return "timeout"
+	case os.IsNotExist(cause):
+		return "missing file"
+	}
+	if _, ok := cause.(net.Error); ok {
+		return "network"
+	}
+	return "failed"
+}
+
+// readSelfKey - read the private key of the client from the pem file at
+// path, decrypting it with passphrase if it is not nil.  An encrypted key
+// read without a passphrase asks for one on the terminal.
+func readSelfKey(path string, passphrase []byte) (*rsa.PrivateKey, error) {
+	keyFile, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open key file")
+	}
+	defer keyFile.Close()
+	if passphrase != nil {
+		return crypto.ReadEncryptedKeypairAsPem(keyFile, passphrase)
+	}
+	contents, err := ioutil.ReadAll(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key file")
+	}
+	key, err := crypto.ReadKeypairAsPem(bytes.NewReader(contents))
+	if err != crypto.ErrPassphraseRequired {
+		return key, err
+	}
+	fmt.Fprintf(os.Stderr, "passphrase for %s: ", path)
+	answer, _ := promptInput.ReadString('\n')
+	if answer = strings.TrimRight(answer, "\r\n"); answer == "" {
+		return nil, crypto.ErrPassphraseRequired
+	}
+	return crypto.ReadEncryptedKeypairAsPem(bytes.NewReader(contents), []byte(answer))
+}
+
+// createSelfKey - generate a keypair for the client and write it to a new
+// pem file at path, with the private key encrypted with passphrase if it is
+// not nil.  A key file which fails to be written in full is removed, so it
+// is not mistaken for a key the next time.
+func createSelfKey(path string, passphrase []byte) (*rsa.PrivateKey, error) {
+	privateKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate keypair")
+	}
+	keyFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create keypair file")
+	}
+	if passphrase != nil {
+		err = crypto.WriteEncryptedPrivateKeyAsPem(keyFile, privateKey, passphrase)
+		if err == nil {
+			err = crypto.WritePublicKeyAsPem(keyFile, privateKey.Public().(*rsa.PublicKey))
+		}
+	} else {
+		err = crypto.WriteKeypairAsPem(keyFile, privateKey)
+	}
+	if closeErr := keyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, errors.Wrap(err, "failed to write keypair file")
+	}
+	return privateKey, nil
+}
+
+// runDoctor - check each thing the client needs to use the ring in turn:
+// that the key in keyFile parses, the peer at peerAddr with the key in
+// peerKeyFile registers the user and answers a ping, and a tiny probe file
+// can be posted, fetched back and deleted.  The steps after one which fails
+// cannot be run, so the checks stop there, except that a posted probe file is
+// always deleted.
+func runDoctor(keyFile string, passphrase []byte, peerAddr, peerKeyFile string) []doctorCheck {
+	var checks []doctorCheck
+	check := func(step string, err error) bool {
+		checks = append(checks, doctorCheck{Step: step, Err: err})
+		return err == nil
+	}
+
+	privateKey, err := readSelfKey(keyFile, passphrase)
+	if !check("read selfKeyFile", err) {
+		return checks
+	}
+	kb, err := crypto.GobEncodePublicKey(privateKey.Public().(*rsa.PublicKey))
+	if !check("encode public key", err) {
+		return checks
+	}
+	id := models.HashBytes(kb)
+
+	peerKey, err := readPeerKey(peerKeyFile)
+	if !check("read peerKeyFile", err) {
+		return checks
+	}
+	peer := models.Node{Addr: peerAddr, PublicKey: &peerKey}
+
+	t, err := createTransport(id, peer, privateKey)
+	if !check("connect to "+peerAddr, err) {
+		return checks
+	}
+	defer t.Close()
+
+	// nodes drop the requests of users they do not know, so the user is
+	// registered before the peer can be pinged
+	resp, err := roundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			From:   id,
+			Type:   protocol.UserType,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.UserRegistrationMethod,
+	})
+	if err == nil {
+		err = resp.Err()
+	}
+	if !check("register user", err) {
+		return checks
+	}
+	ctx, cancel := requestContext()
+	err = t.Ping(ctx)
+	cancel()
+	if !check("ping "+peerAddr, err) {
+		return checks
+	}
+
+	var (
+		key   = fileToKeyIdentifier(doctorProbeName + id.String())
+		probe = []byte(fmt.Sprintf("peerstore doctor probe of %s", id))
+	)
+	node, st, err := connectWriteNode(key, id, t, privateKey)
+	if !check("find node of probe file", err) {
+		return checks
+	}
+	defer st.Close()
+
+	if !check("post probe file to "+node.Addr, postProbe(id, key, probe, st, privateKey)) {
+		return checks
+	}
+	// the probe is deleted even if it did not come back as posted
+	check("get probe file from "+node.Addr, getProbe(id, key, probe, st, privateKey))
+	check("delete probe file", deleteProbe(id, key, st, privateKey))
+	return checks
+}
+
+// postProbe - encrypt probe and post it as the resource key over st, without
+// recording it in the transaction log
+func postProbe(id, key models.Identifier, probe []byte, st *protocol.Transport, privateKey *rsa.PrivateKey) error {
+	sessionKey, secret, err := crypto.GenerateSessionKey(privateKey.Public().(*rsa.PublicKey))
+	if err != nil {
+		return errors.Wrap(err, "failed to generate session key")
+	}
+	// the plaintext is encrypted in place, and probe is compared against later
+	data, err := sealPayload(sessionKey, append([]byte{}, probe...))
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt probe")
+	}
+	resp, err := postPayload(st, protocol.Header{
+		Key:    key,
+		Type:   protocol.UserType,
+		From:   id,
+		PubKey: privateKey.Public().(*rsa.PublicKey),
+		Secret: secret,
+	}, sessionKey, bytes.NewReader(data), false)
+	if err != nil {
+		return errors.Wrap(err, "failed to post probe")
+	}
+	return resp.Err()
+}
+
+// getProbe - get the resource key over st, and check it decrypts to probe
+func getProbe(id, key models.Identifier, probe []byte, st *protocol.Transport, privateKey *rsa.PrivateKey) error {
+	resp, err := getKey(key, id, st)
+	if err != nil {
+		return err
+	}
+	sessionKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt session key")
+	}
+	if err := verifyPayloadTag(sessionKey, resp.Data, resp.Header.Tag); err != nil {
+		return err
+	}
+	plaintext, err := openPayload(sessionKey, resp.Data, resp.Header.Tag)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt probe")
+	}
+	if !bytes.Equal(plaintext, probe) {
+		return errors.New("probe file came back changed")
+	}
+	return nil
+}
+
+// deleteProbe - delete the resource key over st
+func deleteProbe(id, key models.Identifier, st *protocol.Transport, privateKey *rsa.PrivateKey) error {
+	resp, err := roundTrip(st, &protocol.Request{
+		Header: protocol.Header{
+			Key:    key,
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.DeleteFileMethod,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete probe")
+	}
+	return resp.Err()
+}
+
+// printDoctor - write the outcome of each of checks to w, returning whether
+// they all passed
+func printDoctor(w io.Writer, checks []doctorCheck) bool {
+	ok := true
+	for _, c := range checks {
+		if c.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "FAIL  %s: %s: %v\n", c.Step, doctorReason(c.Err), c.Err)
+			continue
+		}
+		fmt.Fprintf(w, "PASS  %s\n", c.Step)
+	}
+	return ok
+}
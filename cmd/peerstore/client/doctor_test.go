@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestDoctor(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privateKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	crypto.WriteKeypairAsPem(&buf, privateKey)
+	keyFile := filepath.Join(dir, "self.pem")
+	if err := ioutil.WriteFile(keyFile, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	crypto.WritePublicKeyAsPem(&buf, n.peer.PublicKey)
+	peerKeyFile := filepath.Join(dir, "peer.pem")
+	if err := ioutil.WriteFile(peerKeyFile, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := runDoctor(keyFile, nil, n.peer.Addr, peerKeyFile)
+	var out bytes.Buffer
+	if !printDoctor(&out, checks) {
+		t.Fatalf("expected every check to pass, got\n%s", out.String())
+	}
+	if got := checks[len(checks)-1].Step; got != "delete probe file" {
+		t.Errorf("expected the checks to end with the probe deleted, ended with %q", got)
+	}
+
+	// the probe file is gone afterwards
+	kb, _ := crypto.GobEncodePublicKey(&privateKey.PublicKey)
+	id := models.HashBytes(kb)
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if _, err := getKey(fileToKeyIdentifier(doctorProbeName+id.String()), id, tr); err != protocol.ErrResourceNotFound {
+		t.Errorf("expected the probe file deleted, got %v", err)
+	}
+
+	cases := []struct {
+		name, keyFile, addr, step, reason string
+	}{
+		{"missing key", filepath.Join(dir, "missing.pem"), n.peer.Addr, "read selfKeyFile", "missing file"},
+		{"not a key", peerKeyFile, n.peer.Addr, "read selfKeyFile", "failed"},
+		{"no peer", keyFile, "127.0.0.1:1", "connect to 127.0.0.1:1", "network"},
+	}
+	for _, c := range cases {
+		checks := runDoctor(c.keyFile, nil, c.addr, peerKeyFile)
+		last := checks[len(checks)-1]
+		if last.Step != c.step || last.Err == nil {
+			t.Errorf("%s: expected %q to fail, got %q, %v", c.name, c.step, last.Step, last.Err)
+			continue
+		}
+		out.Reset()
+		if printDoctor(&out, checks) {
+			t.Errorf("%s: expected the checks to fail", c.name)
+		}
+		if !strings.Contains(out.String(), "FAIL  "+c.step+": "+c.reason+": ") {
+			t.Errorf("%s: expected the failure reason %q, got\n%s", c.name, c.reason, out.String())
+		}
+	}
+}
+
+func TestSelfKeyPassphrasePrompt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selfkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "self.pem")
+
+	key, err := createSelfKey(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key file only readable by its owner, got %v, %v", info.Mode(), err)
+	}
+	if _, err := createSelfKey(path, nil); err == nil {
+		t.Error("expected an existing key file kept")
+	}
+
+	saved := promptInput
+	defer func() { promptInput = saved }()
+	for answer, expected := range map[string]error{
+		"":           crypto.ErrPassphraseRequired,
+		"wrong\n":    crypto.ErrIncorrectPassphrase,
+		"secret\n":   nil,
+		"secret\r\n": nil,
+	} {
+		promptInput = bufio.NewReader(strings.NewReader(answer))
+		read, err := readSelfKey(path, nil)
+		if err != expected {
+			t.Errorf("read with %q answered = %v, expected %v", answer, err, expected)
+		}
+		if err == nil && read.D.Cmp(key.D) != 0 {
+			t.Errorf("read with %q answered a different key", answer)
+		}
+	}
+}
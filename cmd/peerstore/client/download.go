@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// downloadChunkSize - the size of each range requested from a node by a
+// parallel download, files no larger than this are fetched in one request
+const downloadChunkSize = 8 << 20
+
+// downloadStreams - the number of ranges of a large file to download at once
+var downloadStreams int
+
+// fileSources - the nodes which hold the resource key, owner being the node
+// the ring routes it to, asked over t for the replicas it copies resources
+// to.  If it cannot say the owner is the only source.
+func fileSources(key, id models.Identifier, owner models.Node, t *protocol.Transport) []models.Node {
+	sources := []models.Node{owner}
+	resp, err := retryRoundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type: protocol.UserType,
+			From: id,
+			Key:  key,
+		},
+		Method: protocol.GetSuccessorListMethod,
+	})
+	if err == nil {
+		err = resp.Err()
+	}
+	if err != nil {
+		log.Printf("failed to get replicas of %s: %v", owner.Addr, err)
+		return sources
+	}
+	var list models.SuccessorListResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&list); err != nil {
+		log.Printf("failed to decode replicas of %s: %v", owner.Addr, err)
+		return sources
+	}
+	return append(sources, list.Replicas()...)
+}
+
+// getRange - get length bytes of the stored resource starting at offset
+func getRange(key, id models.Identifier, version, offset, length uint64, t *protocol.Transport) (protocol.Response, error) {
+	resp, err := retryRoundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type:    protocol.UserType,
+			From:    id,
+			Key:     key,
+			Version: version,
+			Offset:  offset,
+			Length:  length,
+		},
+		Method: protocol.GetFileMethod,
+	})
+	if err != nil {
+		return protocol.Response{}, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return resp, resp.Err()
+	}
+	if resp.Header.DataLength == 0 && (offset == 0 || len(resp.Data) > 0) {
+		// nodes from before ranges were supported send the whole resource
+		resp.Header.DataLength = uint64(len(resp.Data))
+	}
+	if offset > 0 && uint64(len(resp.Data)) == resp.Header.DataLength {
+		// the whole resource, from a node from before ranges were supported
+		return resp, nil
+	}
+	if uint64(len(resp.Data)) != length && offset+uint64(len(resp.Data)) != resp.Header.DataLength {
+		return resp, errors.Errorf("short range at %d", offset)
+	}
+	return resp, nil
+}
+
+// downloadKey - download the stored resource key from owner into dest,
+// given the first range of it, fetched over t.  A resource larger than a
+// chunk is split into ranges, which are downloaded concurrently over
+// downloadStreams connections spread across every node holding it, and
+// written into place in dest as they arrive, so the resource is never held in
+// memory.  A node from before ranges were supported answers a range with the
+// whole resource, which is written as it is and ends the download.  The
+// ranges which fail are fetched again from the owner alone.  The connections
+// report their progress to progress, if it is not nil.
+func downloadKey(key, id models.Identifier, version uint64, first protocol.Response, owner models.Node, t *protocol.Transport, privateKey *rsa.PrivateKey, dest io.WriterAt, progress protocol.Progress) error {
+	total := first.Header.DataLength
+	if _, err := dest.WriteAt(first.Data, 0); err != nil {
+		return errors.Wrap(err, "failed to write download")
+	}
+	if uint64(len(first.Data)) >= total {
+		return nil
+	}
+	if version == 0 {
+		// pin the version served first, so every range is of the same data
+		version = first.Header.Version
+	}
+
+	// fetch - get the range at offset over st and write it into place, done
+	// is true if the node sent the whole resource instead
+	fetch := func(offset uint64, st *protocol.Transport) (done bool, err error) {
+		resp, err := getRange(key, id, version, offset, downloadChunkSize, st)
+		if err != nil {
+			return false, err
+		}
+		if resp.Header.DataLength != total || !bytes.Equal(resp.Header.Tag, first.Header.Tag) {
+			// a replica which has yet to be sent the latest change
+			return false, errors.New("resource changed during download")
+		}
+		if offset > 0 && uint64(len(resp.Data)) == total {
+			offset, done = 0, true
+		}
+		if _, err := dest.WriteAt(resp.Data, int64(offset)); err != nil {
+			return false, errors.Wrap(err, "failed to write download")
+		}
+		return done, nil
+	}
+
+	var (
+		offsets = make(chan uint64)
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		// pending - the ranges left to fetch from the owner
+		pending []uint64
+		// whole - set once a node has sent the whole resource
+		whole bool
+	)
+	if downloadStreams < 2 {
+		for offset := uint64(downloadChunkSize); offset < total; offset += downloadChunkSize {
+			pending = append(pending, offset)
+		}
+	} else {
+		sources := fileSources(key, id, owner, t)
+		log.Printf("downloading %d bytes in %d streams from %d nodes",
+			total, downloadStreams, len(sources))
+		for i := 0; i < downloadStreams; i++ {
+			wg.Add(1)
+			go func(source models.Node) {
+				defer wg.Done()
+				st, err := createTransport(id, source, privateKey)
+				if err == nil {
+					defer st.Close()
+					st.SetProgress(progress)
+				}
+				for offset := range offsets {
+					mu.Lock()
+					skip := whole
+					mu.Unlock()
+					if skip {
+						continue
+					}
+					if err == nil {
+						var done bool
+						if done, err = fetch(offset, st); done {
+							mu.Lock()
+							whole = true
+							mu.Unlock()
+						}
+						if err == nil {
+							continue
+						}
+						log.Printf("failed to get range at %d from %s: %v", offset, source.Addr, err)
+					}
+					// the rest of this stream's ranges are left to the owner
+					mu.Lock()
+					pending = append(pending, offset)
+					mu.Unlock()
+				}
+			}(sources[i%len(sources)])
+		}
+		for offset := uint64(downloadChunkSize); offset < total; offset += downloadChunkSize {
+			offsets <- offset
+		}
+		close(offsets)
+		wg.Wait()
+		if whole {
+			return nil
+		}
+		if len(pending) > 0 {
+			log.Printf("%d ranges failed, getting them from %s", len(pending), owner.Addr)
+		}
+	}
+
+	for _, offset := range pending {
+		done, err := fetch(offset, t)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get range at %d", offset)
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// rangeReader - reads a stored resource in order, a range at a time, so it
+// can be decrypted as it is downloaded
+type rangeReader struct {
+	key, id models.Identifier
+	version uint64
+	t       *protocol.Transport
+	// buf - the unread part of the last range fetched
+	buf []byte
+	// offset - the offset of the next range to fetch
+	offset uint64
+	total  uint64
+}
+
+// newRangeReader - a reader of the resource key from offset on, given first,
+// the first range of it
+func newRangeReader(key, id models.Identifier, version uint64, first protocol.Response, offset uint64, t *protocol.Transport) *rangeReader {
+	if version == 0 {
+		version = first.Header.Version
+	}
+	rr := &rangeReader{
+		key:     key,
+		id:      id,
+		version: version,
+		t:       t,
+		offset:  offset,
+		total:   first.Header.DataLength,
+	}
+	if offset < uint64(len(first.Data)) {
+		// the start is already fetched
+		rr.buf = first.Data[offset:]
+		rr.offset = uint64(len(first.Data))
+	}
+	return rr
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	if len(rr.buf) == 0 {
+		if rr.offset >= rr.total {
+			return 0, io.EOF
+		}
+		resp, err := getRange(rr.key, rr.id, rr.version, rr.offset, downloadChunkSize, rr.t)
+		if err != nil {
+			return 0, err
+		}
+		if resp.Header.DataLength != rr.total {
+			return 0, errors.New("resource changed during download")
+		}
+		if len(resp.Data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if uint64(len(resp.Data)) == rr.total {
+			// the whole resource, from a node from before ranges
+			resp.Data = resp.Data[rr.offset:]
+		}
+		rr.buf = resp.Data
+		rr.offset += uint64(len(resp.Data))
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
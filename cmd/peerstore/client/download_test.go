@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestDownloadInRanges(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "ranges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	defer func(mode string) { encryption = mode }(encryption)
+	encryption = gcmEncryption
+	// a few ranges, the last of them short
+	want := make([]byte, 2*downloadChunkSize+1000)
+	rand.Read(want)
+	path := filepath.Join(root, "large.bin")
+	if err := ioutil.WriteFile(path, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(streams int) { downloadStreams = streams }(downloadStreams)
+	for _, streams := range []int{1, 4} {
+		downloadStreams = streams
+		dest := filepath.Join(root, "restored.bin")
+		if err := getFileToPath(id, fileToKeyIdentifier("large.bin"), 0, n.peer, privateKey, dest); err != nil {
+			t.Fatalf("%d streams: %v", streams, err)
+		}
+		if got, err := ioutil.ReadFile(dest); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%d streams: restored %d bytes, %v, expected the file", streams, len(got), err)
+		}
+	}
+}
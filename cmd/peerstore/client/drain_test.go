@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestDrainRoutesAround(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 2, ReplicationFactor: 1}
+	first := startTestNode(t, models.Node{}, settings)
+	nodes := []*testNode{first}
+	for i := 0; i < 2; i++ {
+		nodes = append(nodes, startTestNode(t, first.peer, settings))
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	}()
+	positions := make(map[uint64]bool)
+	for _, n := range nodes {
+		positions[models.KeyToID(n.peer.ID)] = true
+	}
+	if len(positions) != len(nodes) {
+		t.Skip("nodes landed on the same ring position")
+	}
+	stabilizeTestRing(t, nodes)
+
+	id, privateKey := registerTestUser(t, first.peer)
+	draining := nodes[1]
+	// lookups of the draining node's own id, from every other node
+	routedTo := func() []models.Node {
+		var found []models.Node
+		for _, n := range nodes {
+			if n == draining {
+				continue
+			}
+			successor, err := n.Local.Successor(draining.peer.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found = append(found, successor)
+		}
+		return found
+	}
+
+	if _, err := drainNode(id, draining.peer, privateKey, false); err == nil {
+		t.Fatal("expected a drain by a user who is not an admin refused")
+	} else if re, ok := err.(*protocol.ResponseError); !ok || re.Code != protocol.UnauthorizedCode {
+		t.Fatalf("expected a drain by a user who is not an admin unauthorized, got %v", err)
+	}
+	if draining.Server.Draining() {
+		t.Fatal("expected a refused drain to leave the node as it was")
+	}
+
+	draining.Server.WithValue(models.AdminsContextKey, []models.Identifier{id})
+	result, err := drainNode(id, draining.peer, privateKey, false)
+	if err != nil || result.Failed > 0 {
+		t.Fatalf("drain = %+v, %v", result, err)
+	}
+	// the drained node is left out as the ring stabilizes, though it is
+	// still running
+	stabilizeTestRing(t, nodes)
+	for _, n := range routedTo() {
+		if n.ID.Equal(draining.peer.ID) {
+			t.Errorf("expected the drained node routed around, got %s", n)
+		}
+	}
+
+	if _, err := drainNode(id, draining.peer, privateKey, true); err != nil {
+		t.Fatalf("undrain failed: %v", err)
+	}
+	if draining.Server.Draining() {
+		t.Error("expected the undrained node to accept new data")
+	}
+	stabilizeTestRing(t, nodes)
+	for _, n := range routedTo() {
+		if !n.ID.Equal(draining.peer.ID) {
+			t.Errorf("expected the undrained node routed to again, got %s", n)
+		}
+	}
+}
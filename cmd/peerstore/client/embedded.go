@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rsa"
+	"log"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/node"
+	"github.com/pkg/errors"
+)
+
+// readPeerKey - read the public key of a peer from its pem file
+func readPeerKey(path string) (rsa.PublicKey, error) {
+	keyFile, err := os.Open(path) // For read access.
+	if err != nil {
+		return rsa.PublicKey{}, errors.Wrap(err, "failed to open peer key file")
+	}
+	defer keyFile.Close()
+	return crypto.ReadPublicKeyAsPem(keyFile)
+}
+
+// embeddedRingSettings - the ring settings of the embedded storage node
+func embeddedRingSettings() models.RingSettings {
+	return models.RingSettings{
+		SuccessorListLength: successorListLength,
+		ReplicationFactor:   replicationFactor,
+	}
+}
+
+// validateEmbeddedAddrs - check the addresses of the embedded storage node,
+// defaulting the advertised address to the one listened on.  A node joining
+// a ring is reached by the other nodes at its advertised address, so it must
+// name a host, :3000 is only reachable from this host.
+func validateEmbeddedAddrs() error {
+	var err error
+	if embeddedAddr, err = models.ParseNodeAddr(embeddedAddr); err != nil {
+		return errors.Wrap(err, "invalid embeddedAddr")
+	}
+	if embeddedAdvertiseAddr == "" {
+		embeddedAdvertiseAddr = embeddedAddr
+	}
+	if embeddedAdvertiseAddr, err = models.ParseNodeAddr(embeddedAdvertiseAddr); err != nil {
+		return errors.Wrap(err, "invalid embeddedAdvertiseAddr")
+	}
+	if host, _, _ := net.SplitHostPort(embeddedAdvertiseAddr); peerAddr != "" && host == "" {
+		return errors.Errorf("embeddedAdvertiseAddr %s must name a host the ring reaches the embedded store at, to join the ring at %s",
+			embeddedAdvertiseAddr, peerAddr)
+	}
+	return nil
+}
+
+// startEmbeddedStore - start a storage node within the client which stores
+// resources in dataPath.  The node joins the ring through peerAddr when it is
+// set, and otherwise runs standalone as a ring of its own.  Returns the node
+// for the client to use as its peer, which is reached in process.
+func startEmbeddedStore() (models.Node, error) {
+	if err := os.MkdirAll(dataPath, 0700); err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to create data dir")
+	}
+	key, err := node.LoadOrCreateKey(dataPath)
+	if err != nil {
+		return models.Node{}, err
+	}
+
+	var ringPeer models.Node
+	if peerAddr != "" {
+		peerKey, err := readPeerKey(peerKeyFile)
+		if err != nil {
+			return models.Node{}, err
+		}
+		// a node's identifier is the hash of the address it is reached at
+		ringPeer = models.Node{
+			Addr:      peerAddr,
+			PublicKey: &peerKey,
+			ID:        models.HashBytes([]byte(peerAddr)),
+		}
+	}
+
+	n, err := node.Start(node.Config{
+		ListenAddr:         embeddedAddr,
+		AdvertiseAddr:      embeddedAdvertiseAddr,
+		DataPath:           dataPath,
+		Peer:               ringPeer,
+		RequestQueueBuffer: uint(runtime.NumCPU() * 20),
+		RequestNumWorkers:  uint(runtime.NumCPU() * 2),
+		RingSettings:       embeddedRingSettings(),
+	}, key)
+	if err != nil {
+		return models.Node{}, err
+	}
+	n.Server.AcceptInProcess()
+	// the node serves peers for as long as the client runs
+	go n.Serve(make(chan bool), make(chan bool))
+
+	if peerAddr != "" {
+		log.Printf("embedded store %s joined the ring at %s", embeddedAdvertiseAddr, peerAddr)
+	} else {
+		log.Printf("embedded store %s running standalone", embeddedAddr)
+	}
+	return models.Node{
+		Addr:      embeddedAddr,
+		PublicKey: key.Public().(*rsa.PublicKey),
+	}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedStoreRoundTrip(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	savedData, savedAddr, savedAdvertise, savedPeer := dataPath, embeddedAddr, embeddedAdvertiseAddr, peerAddr
+	defer func() {
+		dataPath, embeddedAddr, embeddedAdvertiseAddr, peerAddr = savedData, savedAddr, savedAdvertise, savedPeer
+	}()
+	dataPath, embeddedAddr, embeddedAdvertiseAddr, peerAddr = filepath.Join(dir, "store"), addr, "", ""
+	if err := validateEmbeddedAddrs(); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := startEmbeddedStore()
+	if err != nil {
+		t.Fatalf("failed to start the embedded store: %v", err)
+	}
+
+	id, privateKey := registerTestUser(t, peer)
+	root := filepath.Join(dir, "files")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "embedded.txt")
+	if err := ioutil.WriteFile(path, []byte("stored in process"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, path, peer, privateKey, nil, nil); err != nil {
+		t.Fatalf("backup to the embedded store failed: %v", err)
+	}
+	key := fileToKeyIdentifier(testResourceName(t, root, path))
+	if findStored(dataPath, key) == "" {
+		t.Fatal("backup was not stored in the embedded store's data path")
+	}
+
+	dest := filepath.Join(root, "restored")
+	if err := getFileToPath(id, key, 0, peer, privateKey, dest); err != nil {
+		t.Fatalf("get from the embedded store failed: %v", err)
+	}
+	if restored, err := ioutil.ReadFile(dest); err != nil || string(restored) != "stored in process" {
+		t.Errorf("restored %q, %v, expected %q", restored, err, "stored in process")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+// fingerprintKeyFile - the fingerprint of the public key in the pem file at
+// path, which may be a key file with its private key too
+func fingerprintKeyFile(path string) (string, error) {
+	keyFile, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to open key file")
+	}
+	defer keyFile.Close()
+	pub, err := crypto.ReadPublicKeyAsPem(keyFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read public key of %s", path)
+	}
+	return crypto.PublicKeyFingerprint(&pub), nil
+}
+
+// printFingerprints - write the fingerprint of each of the key files set with
+// selfKeyFile, peerKeyFile and shareWithKeyFile to w
+func printFingerprints(w io.Writer) error {
+	for _, f := range []struct{ flag, path string }{
+		{"selfKeyFile", selfKeyFile},
+		{"peerKeyFile", peerKeyFile},
+		{"shareWithKeyFile", shareWithKeyFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		fingerprint, err := fingerprintKeyFile(f.path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s  %s (%s)\n", fingerprint, f.path, f.flag)
+	}
+	return nil
+}
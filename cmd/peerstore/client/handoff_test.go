@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestUserCannotHandOffKeys(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	key := fileToKeyIdentifier("forged.txt")
+	for _, method := range []protocol.RequestMethod{protocol.ReplicateKeyMethod, protocol.TransferKeyMethod} {
+		tr, err := createTransport(id, n.peer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a user transport claiming to be a node in the request
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				From:       id,
+				Type:       protocol.NodeType,
+				PubKey:     privateKey.Public().(*rsa.PublicKey),
+				DataLength: 6,
+			},
+			Method: method,
+			Data:   []byte("forged"),
+		})
+		tr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+			t.Errorf("%s from a user = %d, %v, expected it unauthorized",
+				protocol.RequestMethodToString[method], resp.Status, resp.Err())
+		}
+		if findStored(n.dataPath, key) != "" {
+			t.Errorf("%s from a user stored the resource", protocol.RequestMethodToString[method])
+		}
+	}
+}
+
+func TestNodeRequestsNeedRegisteredKey(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+
+	privateKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// node requests name the node they are sent to, registrations the node
+	// registering
+	nodeRequest := func(method protocol.RequestMethod, from models.Identifier, data []byte) protocol.Response {
+		tr, err := protocol.NewTransport("tcp", n.peer.Addr, protocol.NodeType, n.peer.ID, n.peer.PublicKey, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:        fileToKeyIdentifier("forged.txt"),
+				From:       from,
+				FromAddr:   "127.0.0.1:1",
+				Type:       protocol.NodeType,
+				PubKey:     privateKey.Public().(*rsa.PublicKey),
+				DataLength: uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// a key sent along with the request is not one a node registered
+	resp := nodeRequest(protocol.ReplicateKeyMethod, n.peer.ID, []byte("forged"))
+	if resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("replicate from an unregistered key = %d, %v, expected it unauthorized", resp.Status, resp.Err())
+	}
+	if findStored(n.dataPath, fileToKeyIdentifier("forged.txt")) != "" {
+		t.Error("replicate from an unregistered key stored the resource")
+	}
+
+	// anyone can register as a node, which does not make them an admin
+	if resp := nodeRequest(protocol.NodeRegistrationMethod, models.HashBytes([]byte("127.0.0.1:1")), nil); resp.Status != protocol.Success {
+		t.Fatalf("failed to register as a node: %v", resp.Err())
+	}
+	var buf = new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(models.DrainRequest{})
+	resp = nodeRequest(protocol.DrainMethod, n.peer.ID, buf.Bytes())
+	if resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("drain from a node = %d, %v, expected it unauthorized", resp.Status, resp.Err())
+	}
+	if n.Server.Draining() {
+		t.Error("drain from a node drained the server")
+	}
+}
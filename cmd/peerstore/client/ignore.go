@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignoreFile - the file at the root of localPath listing what backup and
+// sync leave out, one pattern per line as in a .gitignore
+const ignoreFile = ".peerstoreignore"
+
+// patternList - the patterns of a repeatable flag
+type patternList []string
+
+// String - implementation of flag.Value
+func (pl *patternList) String() string {
+	return strings.Join(*pl, ",")
+}
+
+// Set - implementation of flag.Value, each use of the flag adds a pattern
+func (pl *patternList) Set(pattern string) error {
+	*pl = append(*pl, pattern)
+	return nil
+}
+
+// ignoreRule - a pattern of paths to leave out, or with negate to put back
+// in paths an earlier rule left out
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	// dirOnly - the pattern ended with a slash, and only matches directories
+	dirOnly bool
+	// anchored - the pattern contains a slash, and is matched against the
+	// whole path rather than just the last element of it
+	anchored bool
+}
+
+// parseIgnoreRule - the rule of a line of an ignore file, false for blank
+// lines and comments
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate, line = true, line[1:]
+	}
+	if strings.HasSuffix(line, "/**") {
+		// everything within the directory, which leaving the directory
+		// out already does
+		line = strings.TrimSuffix(line, "/**")
+		rule.dirOnly, rule.anchored = true, true
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+	line = strings.TrimPrefix(line, "**/")
+	rule.anchored = rule.anchored || strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+	return rule, rule.pattern != ""
+}
+
+// matches - check if the rule matches the resource name, dir is whether it
+// names a directory
+func (r ignoreRule) matches(name string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if !r.anchored {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(r.pattern, name)
+	return matched
+}
+
+// ignoreRules - the rules of what to leave out, in order, the last matching
+// rule deciding
+type ignoreRules []ignoreRule
+
+// loadIgnoreRules - the rules of the -exclude patterns, followed by those of
+// the ignore file at the root of localPath, if there is one
+func loadIgnoreRules(localPath string, excludes []string) (ignoreRules, error) {
+	var rules ignoreRules
+	for _, pattern := range excludes {
+		if rule, ok := parseIgnoreRule(pattern); ok {
+			rules = append(rules, rule)
+		}
+	}
+	f, err := os.Open(filepath.Join(localPath, ignoreFile))
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, errors.Wrap(err, "failed to open ignore file")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, errors.Wrap(scanner.Err(), "failed to read ignore file")
+}
+
+// match - check if the last rule to match the resource name leaves it out
+func (rules ignoreRules) match(name string, dir bool) bool {
+	var excluded bool
+	for _, r := range rules {
+		if r.matches(name, dir) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+// excluded - check if the resource name, or any directory it is within, is
+// left out.  A file within a left out directory cannot be put back in, as the
+// directory is never walked.  The backup and restore manifests, the
+// tombstones and the known clocks are always left out.
+func (rules ignoreRules) excluded(name string, dir bool) bool {
+	if name == manifestFile || name == manifestFile+".tmp" ||
+		name == restoredFile || name == restoredFile+".tmp" ||
+		name == tombstoneFile || name == tombstoneFile+".tmp" ||
+		name == clocksFile || name == clocksFile+".tmp" {
+		return true
+	}
+	if len(rules) == 0 || name == "" {
+		return false
+	}
+	elements := strings.Split(name, "/")
+	for i := 1; i < len(elements); i++ {
+		if rules.match(strings.Join(elements[:i], "/"), true) {
+			return true
+		}
+	}
+	return rules.match(name, dir)
+}
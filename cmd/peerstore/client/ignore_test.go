@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestIgnoreRulesPruneDirectories(t *testing.T) {
+	rules, err := loadIgnoreRules(os.TempDir(), []string{".git/", "/build/**", "docs/*.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name     string
+		dir      bool
+		excluded bool
+	}{
+		{".git", true, true},
+		{"src/.git", true, true},
+		{".git/config", false, true},
+		{"src/.git/objects/ab", false, true},
+		// only directories match .git/
+		{".git", false, false},
+		{"build", true, true},
+		{"build/out/main.o", false, true},
+		// /build/** is anchored to the root
+		{"src/build", true, false},
+		{"docs/draft.tmp", false, true},
+		{"docs/more/draft.tmp", false, false},
+		{"draft.tmp", false, false},
+		{"src/main.go", false, false},
+	} {
+		if got := rules.excluded(c.name, c.dir); got != c.excluded {
+			t.Errorf("excluded(%q, %v) = %v, expected %v", c.name, c.dir, got, c.excluded)
+		}
+	}
+}
+
+func TestIgnoreFileNegation(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	contents := "# logs are noise\n*.log\n!keep.log\n\n*.swp\n"
+	if err := ioutil.WriteFile(filepath.Join(root, ignoreFile), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadIgnoreRules(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, the comment and blank line skipped, got %+v", rules)
+	}
+	for name, excluded := range map[string]bool{
+		"debug.log":       true,
+		"logs/server.log": true,
+		"keep.log":        false,
+		"logs/keep.log":   false,
+		".notes.txt.swp":  true,
+		"notes.txt":       false,
+		ignoreFile:        false,
+	} {
+		if got := rules.excluded(name, false); got != excluded {
+			t.Errorf("excluded(%q) = %v, expected %v", name, got, excluded)
+		}
+	}
+}
+
+func TestSyncLeavesExcludedPathsAlone(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	savedPath, savedKnown, savedExcludes := localPath, known, excludes
+	defer func() {
+		localPath, known, excludes = savedPath, savedKnown, savedExcludes
+		syncRules = nil
+	}()
+
+	// the first client syncs notes.txt
+	src, err := ioutil.TempDir("", "ignoresrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := ioutil.WriteFile(filepath.Join(src, "notes.txt"), []byte("synced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	localPath, excludes = src, nil
+	if _, err := Synchronize(id, src, n.peer, privateKey, models.TransactionLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second excludes it, along with a directory of its own
+	dest, err := ioutil.TempDir("", "ignoredest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if err := ioutil.WriteFile(filepath.Join(dest, "notes.txt"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dest, "cache", "deep"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, "cache", "deep", "blob"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, ignoreFile), []byte("cache/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	localPath, known, excludes = dest, newKnownClocks(), patternList{"notes.txt"}
+	if _, err := Synchronize(id, dest, n.peer, privateKey, models.TransactionLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	local, err := ioutil.ReadFile(filepath.Join(dest, "notes.txt"))
+	if err != nil || string(local) != "local" {
+		t.Errorf("expected the excluded file left alone, got %q, %v", local, err)
+	}
+	tl, err := GetTransactionLog(id, n.peer, privateKey.Public().(*rsa.PublicKey), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := len(tl["notes.txt"].Entries); entries != 1 {
+		t.Errorf("expected the excluded file not uploaded, the log has %d entries of it", entries)
+	}
+	for _, name := range []string{"cache", "cache/deep", "cache/deep/blob"} {
+		if _, ok := tl[name]; ok {
+			t.Errorf("expected the pruned %s not uploaded", name)
+		}
+	}
+	if _, ok := tl[ignoreFile]; !ok {
+		t.Errorf("expected the ignore file itself synced")
+	}
+	if watched := watchedDirectories(dest); len(watched) != 1 || watched[0] != dest {
+		t.Errorf("expected only the root watched, got %v", watched)
+	}
+}
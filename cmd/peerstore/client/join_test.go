@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestJoinHandsOffKeys(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 1, ReplicationFactor: 1}
+	first := startTestNode(t, models.Node{}, settings)
+	nodes := []*testNode{first}
+	defer func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		nodes = append(nodes, startTestNode(t, first.peer, settings))
+	}
+	stabilizeTestRing(t, nodes)
+
+	id, privateKey := registerTestUser(t, first.peer)
+	root, err := ioutil.TempDir("", "join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	var keys []models.Identifier
+	for i := 0; i < 40; i++ {
+		path := filepath.Join(root, fmt.Sprintf("%d.txt", i))
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(id, root, path, first.peer, privateKey, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, fileToKeyIdentifier(testResourceName(t, root, path)))
+	}
+
+	newcomer := startTestNode(t, first.peer, settings)
+	nodes = append(nodes, newcomer)
+	positions := make(map[uint64]bool)
+	for _, n := range nodes {
+		positions[models.KeyToID(n.peer.ID)] = true
+	}
+	if len(positions) != len(nodes) {
+		t.Skip("nodes landed on the same ring position")
+	}
+	stabilizeTestRing(t, nodes)
+
+	var moved []models.Identifier
+	for _, key := range keys {
+		owner, err := first.Local.Successor(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner.ID.Equal(newcomer.peer.ID) {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) == 0 {
+		t.Skip("no key fell between the newcomer and its predecessor")
+	}
+
+	// keys are handed off in the background
+	for _, key := range moved {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+			if _, err := os.Stat(filepath.Join(newcomer.dataPath, key.String())); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not handed off to the newcomer", key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		dest := filepath.Join(root, "restored")
+		if err := getFileToPath(id, key, 0, first.peer, privateKey, dest); err != nil {
+			t.Fatalf("get of %s after the join failed: %v", key, err)
+		}
+	}
+}
+
+func TestJoinOnlyFromJoiningNode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	forged := models.Node{
+		ID:        models.HashBytes([]byte("127.0.0.1:1")),
+		Addr:      "127.0.0.1:1",
+		PublicKey: privateKey.Public().(*rsa.PublicKey),
+	}
+	data, err := forged.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	join := func(tr *protocol.Transport, from models.Identifier, callerType protocol.CallerType) protocol.Response {
+		defer tr.Close()
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				From:       from,
+				FromAddr:   forged.Addr,
+				Type:       callerType,
+				PubKey:     privateKey.Public().(*rsa.PublicKey),
+				DataLength: uint64(len(data)),
+			},
+			Method: protocol.NodeJoinMethod,
+			Data:   data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := join(tr, id, protocol.UserType); resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("join from a user = %d, %v, expected it unauthorized", resp.Status, resp.Err())
+	}
+
+	// a registered node cannot join in the place of another
+	nodeKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = protocol.NewTransport("tcp", n.peer.Addr, protocol.NodeType, n.peer.ID, n.peer.PublicKey, nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:     models.HashBytes([]byte("127.0.0.1:2")),
+			FromAddr: "127.0.0.1:2",
+			Type:     protocol.NodeType,
+			PubKey:   nodeKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.NodeRegistrationMethod,
+	})
+	tr.Close()
+	if err != nil || resp.Status != protocol.Success {
+		t.Fatalf("failed to register as a node: %v, %v", err, resp.Err())
+	}
+	tr, err = protocol.NewTransport("tcp", n.peer.Addr, protocol.NodeType, n.peer.ID, n.peer.PublicKey, nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := join(tr, forged.ID, protocol.NodeType); resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("join of another node = %d, %v, expected it unauthorized", resp.Status, resp.Err())
+	}
+
+	if predecessor, _ := n.Local.GetPredecessor(); predecessor.ID.Equal(forged.ID) {
+		t.Errorf("refused join set the predecessor to %s", predecessor)
+	}
+}
+
+func TestJoinFollowsALoneNode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 1, ReplicationFactor: 1}
+	first := startTestNode(t, models.Node{}, settings)
+	defer first.stop()
+	second := startTestNode(t, first.peer, settings)
+	defer second.stop()
+
+	// before either has stabilized, first knows second follows it, so the
+	// next node to join between them is sent to second
+	key := models.PositionKey((models.KeyToID(first.peer.ID) + 1) % models.M)
+	owner, err := first.Local.Successor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !owner.ID.Equal(second.peer.ID) {
+		t.Errorf("successor of %s is %s, expected %s", key, owner, second.peer)
+	}
+}
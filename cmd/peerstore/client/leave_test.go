@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestLeaveHandsOffKeys(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 2, ReplicationFactor: 1}
+	first := startTestNode(t, models.Node{}, settings)
+	nodes := []*testNode{first}
+	for i := 0; i < 2; i++ {
+		nodes = append(nodes, startTestNode(t, first.peer, settings))
+	}
+	running := make(map[*testNode]bool)
+	for _, n := range nodes {
+		running[n] = true
+	}
+	defer func() {
+		for n := range running {
+			n.stop()
+		}
+	}()
+	positions := make(map[uint64]bool)
+	for _, n := range nodes {
+		positions[models.KeyToID(n.peer.ID)] = true
+	}
+	if len(positions) != len(nodes) {
+		t.Skip("nodes landed on the same ring position")
+	}
+	stabilizeTestRing(t, nodes)
+
+	id, privateKey := registerTestUser(t, first.peer)
+	root, err := ioutil.TempDir("", "leave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	var keys []models.Identifier
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(root, fmt.Sprintf("%d.txt", i))
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(id, root, path, first.peer, privateKey, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, fileToKeyIdentifier(testResourceName(t, root, path)))
+	}
+
+	// the node to leave, one other than the first, which the client talks
+	// to, holding some of the keys
+	var (
+		leaving *testNode
+		held    []models.Identifier
+	)
+	for _, n := range nodes[1:] {
+		held = nil
+		for _, key := range keys {
+			if _, err := os.Stat(filepath.Join(n.dataPath, key.String())); err == nil {
+				held = append(held, key)
+			}
+		}
+		if len(held) > 0 {
+			leaving = n
+			break
+		}
+	}
+	if leaving == nil {
+		t.Skip("the first node holds every key")
+	}
+
+	result, err := leaving.Local.Leave(leaving.dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Transferred == 0 {
+		t.Errorf("expected keys to be handed off")
+	}
+	leaving.stop()
+	delete(running, leaving)
+
+	// straight away, without stabilizing the ring
+	for _, key := range held {
+		dest := filepath.Join(root, "restored")
+		if err := getFileToPath(id, key, 0, first.peer, privateKey, dest); err != nil {
+			t.Fatalf("get of %s after the leave failed: %v", key, err)
+		}
+	}
+}
+
+func TestLeaveOnlyFromLeavingNode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 1, ReplicationFactor: 1}
+	first := startTestNode(t, models.Node{}, settings)
+	defer first.stop()
+	second := startTestNode(t, first.peer, settings)
+	defer second.stop()
+	stabilizeTestRing(t, []*testNode{first, second})
+	id, privateKey := registerTestUser(t, first.peer)
+
+	forged := models.Node{
+		ID:        models.HashBytes([]byte("127.0.0.1:1")),
+		Addr:      "127.0.0.1:1",
+		PublicKey: privateKey.Public().(*rsa.PublicKey),
+	}
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(models.NodeLeaveRequest{
+		Node:        second.peer,
+		Predecessor: forged,
+		Successor:   forged,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	leave := func(tr *protocol.Transport, from models.Identifier, callerType protocol.CallerType, key *rsa.PrivateKey) protocol.Response {
+		defer tr.Close()
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				From:       from,
+				FromAddr:   forged.Addr,
+				Type:       callerType,
+				PubKey:     key.Public().(*rsa.PublicKey),
+				DataLength: uint64(buf.Len()),
+			},
+			Method: protocol.NodeLeaveMethod,
+			Data:   buf.Bytes(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	tr, err := createTransport(id, first.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := leave(tr, id, protocol.UserType, privateKey); resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("leave from a user = %d, %v, expected it unauthorized", resp.Status, resp.Err())
+	}
+
+	// a registered node cannot leave in the place of another
+	nodeKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = protocol.NewTransport("tcp", first.peer.Addr, protocol.NodeType, first.peer.ID, first.peer.PublicKey, nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:     models.HashBytes([]byte("127.0.0.1:2")),
+			FromAddr: "127.0.0.1:2",
+			Type:     protocol.NodeType,
+			PubKey:   nodeKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.NodeRegistrationMethod,
+	})
+	tr.Close()
+	if err != nil || resp.Status != protocol.Success {
+		t.Fatalf("failed to register as a node: %v, %v", err, resp.Err())
+	}
+	tr, err = protocol.NewTransport("tcp", first.peer.Addr, protocol.NodeType, first.peer.ID, first.peer.PublicKey, nodeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := leave(tr, second.peer.ID, protocol.NodeType, nodeKey); resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("leave of another node = %d, %v, expected it unauthorized", resp.Status, resp.Err())
+	}
+
+	if predecessor, _ := first.Local.GetPredecessor(); !predecessor.ID.Equal(second.peer.ID) {
+		t.Errorf("refused leave set the predecessor to %s, expected %s", predecessor, second.peer)
+	}
+	if successors := first.Local.SuccessorList(); len(successors) == 0 || !successors[0].ID.Equal(second.peer.ID) {
+		t.Errorf("refused leave set the successors to %v, expected %s", successors, second.peer)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// maxListNodes - the most nodes a listing visits, so a ring which is
+// changing while it is walked cannot keep the listing going forever
+const maxListNodes = 1024
+
+// nextIdentifier - the identifier after id on the ring
+func nextIdentifier(id models.Identifier) models.Identifier {
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i]++
+		if id[i] != 0 {
+			break
+		}
+	}
+	return id
+}
+
+// listNode - the resources the node stores which id is an owner of
+func listNode(id models.Identifier, node models.Node, privateKey *rsa.PrivateKey) ([]models.ListedFile, error) {
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	resp, err := roundTrip(st, &protocol.Request{
+		Header: protocol.Header{
+			Type: protocol.UserType,
+			From: id,
+		},
+		Method: protocol.ListFilesMethod,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return nil, resp.Err()
+	}
+	var result models.ListFilesResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "failed to decode listing")
+	}
+	return result.Files, nil
+}
+
+// listFiles - print every resource stored on the ring which id is an owner
+// of, walking the ring from the node peer routes id to.  Nodes only know
+// keys, so names, modification times and content types are taken from the
+// transaction log.
+func listFiles(id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) error {
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+
+	var (
+		names   = map[models.Identifier]string{}
+		changes = map[models.Identifier]models.TransactionEntry{}
+	)
+	if key, err := protocol.TransactionLogKey(privateKey.Public().(*rsa.PublicKey)); err == nil {
+		names[key] = "(transaction log)"
+	}
+	tl, err := GetTransactionLog(id, peer, privateKey.Public().(*rsa.PublicKey), privateKey)
+	if err != nil {
+		log.Printf("listing without names, could not get transaction log: %s", err)
+	}
+	for name, entity := range tl {
+		names[entity.ResourceID] = name
+		if len(entity.Entries) > 0 {
+			changes[entity.ResourceID] = newestChange(entity.Latest())
+		}
+		names[fileToKeyIdentifier(name+xattrsSuffix)] = name + xattrsSuffix
+	}
+
+	first, err := getNode(id, id, t)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	node := first
+	for i := 0; i < maxListNodes; i++ {
+		files, err := listNode(id, node, privateKey)
+		if err != nil {
+			return errors.Wrapf(err, "failed to list %s", node.Addr)
+		}
+		for _, f := range files {
+			name, ok := names[f.Key]
+			if !ok {
+				name = "-"
+			}
+			access := "rw"
+			if f.ReadOnly {
+				access = "r"
+			}
+			var (
+				change                = changes[f.Key]
+				modified, contentType = "-", "-"
+			)
+			if !change.ModTime.IsZero() {
+				modified = change.ModTime.Format(time.RFC3339)
+			}
+			if change.ContentType != "" {
+				contentType = change.ContentType
+			}
+			fmt.Printf("%s\t%d\t%s\t%s\t%s\t%s\n", f.Key, f.Size, access, modified, contentType, name)
+		}
+
+		if node, err = getNode(nextIdentifier(node.ID), id, t); err != nil {
+			return errors.Wrap(err, "failed to get next node")
+		}
+		if node.ID == first.ID {
+			return nil
+		}
+	}
+	return errors.Errorf("stopped listing after %d nodes", maxListNodes)
+}
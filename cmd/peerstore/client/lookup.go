@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rsa"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// lookupEntry - the node a key was found to belong to, and when the lookup
+// stops being trusted
+type lookupEntry struct {
+	node    models.Node
+	expires time.Time
+}
+
+// lookupCache - the nodes keys were recently found to belong to, so repeated
+// operations on a resource skip looking it up again
+type lookupCache struct {
+	entries map[models.Identifier]lookupEntry
+	mu      *sync.Mutex
+}
+
+// lookups - the lookup cache of the client, entries are kept for
+// lookupCacheTTL
+var lookups = &lookupCache{
+	entries: make(map[models.Identifier]lookupEntry),
+	mu:      new(sync.Mutex),
+}
+
+// get - the node key was found to belong to, ok is false if it was not
+// looked up within lookupCacheTTL
+func (lc *lookupCache) get(key models.Identifier) (models.Node, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	entry, ok := lc.entries[key]
+	if !ok {
+		return models.Node{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(lc.entries, key)
+		return models.Node{}, false
+	}
+	return entry.node, true
+}
+
+// put - remember key was found to belong to node, unless the cache is
+// disabled
+func (lc *lookupCache) put(key models.Identifier, node models.Node) {
+	if lookupCacheTTL <= 0 {
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.entries[key] = lookupEntry{node: node, expires: time.Now().Add(lookupCacheTTL)}
+}
+
+// invalidate - forget every key found to belong to node, as it could not be
+// reached, so they are looked up again in case they moved
+func (lc *lookupCache) invalidate(node models.Node) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for key, entry := range lc.entries {
+		if entry.node.Addr == node.Addr {
+			delete(lc.entries, key)
+		}
+	}
+}
+
+// findNode - the node key belongs to, from the lookup cache, or asked of
+// peer if it was not looked up recently
+func findNode(key, id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) (models.Node, error) {
+	if node, ok := lookups.get(key); ok {
+		return node, nil
+	}
+	return findWriteNode(key, id, peer, privateKey)
+}
+
+// findWriteNode - the node key belongs to, always asked of peer.  Nodes
+// store whatever they are sent, so a write sent to a node which has since
+// stopped owning the key would be lost to lookups, and writes never trust
+// the lookup cache.
+func findWriteNode(key, id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) (models.Node, error) {
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	return lookupNode(key, id, t)
+}
+
+// connectNode - find the node key belongs to, asking over t if it was not
+// looked up recently, and connect to it.  The node is evicted from the
+// lookup cache if it cannot be connected to.
+func connectNode(key, id models.Identifier, t *protocol.Transport, privateKey *rsa.PrivateKey) (models.Node, *protocol.Transport, error) {
+	node, err := getNode(key, id, t)
+	if err != nil {
+		return node, nil, errors.Wrap(err, "failed to get node")
+	}
+	return connectFound(node, id, privateKey)
+}
+
+// connectWriteNode - find the node key belongs to, always asking over t, as
+// findWriteNode, and connect to it
+func connectWriteNode(key, id models.Identifier, t *protocol.Transport, privateKey *rsa.PrivateKey) (models.Node, *protocol.Transport, error) {
+	node, err := lookupNode(key, id, t)
+	if err != nil {
+		return node, nil, errors.Wrap(err, "failed to get node")
+	}
+	return connectFound(node, id, privateKey)
+}
+
+// connectFound - connect to node, which a key was found to belong to,
+// evicting it from the lookup cache if it cannot be connected to
+func connectFound(node models.Node, id models.Identifier, privateKey *rsa.PrivateKey) (models.Node, *protocol.Transport, error) {
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		lookups.invalidate(node)
+		return node, nil, errors.Wrap(err, "failed to create transport")
+	}
+	return node, st, nil
+}
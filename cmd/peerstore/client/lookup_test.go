@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// withLookupCacheTTL - run f with the lookup cache enabled for ttl, starting
+// with it empty
+func withLookupCacheTTL(ttl time.Duration, f func()) {
+	saved := lookupCacheTTL
+	lookupCacheTTL = ttl
+	lookups.entries = make(map[models.Identifier]lookupEntry)
+	defer func() {
+		lookupCacheTTL = saved
+		lookups.entries = make(map[models.Identifier]lookupEntry)
+	}()
+	f()
+}
+
+func TestLookupCacheExpires(t *testing.T) {
+	withLookupCacheTTL(10*time.Millisecond, func() {
+		key := models.HashBytes([]byte("key"))
+		lookups.put(key, models.Node{Addr: "node"})
+		if node, ok := lookups.get(key); !ok || node.Addr != "node" {
+			t.Fatalf("expected the cached node, got %v, %v", node, ok)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if _, ok := lookups.get(key); ok {
+			t.Error("expected the entry to have expired")
+		}
+	})
+}
+
+func TestLookupCacheEvictsUnreachableNode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+
+	withLookupCacheTTL(time.Minute, func() {
+		id, privateKey := registerTestUser(t, n.peer)
+		root, err := ioutil.TempDir("", "lookup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		path := filepath.Join(root, "file.txt")
+		contents := []byte("looked up contents")
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		key := fileToKeyIdentifier(testResourceName(t, root, path))
+		if node, ok := lookups.get(key); !ok || node.Addr != n.peer.Addr {
+			t.Fatalf("expected the backup to cache the node, got %v, %v", node, ok)
+		}
+
+		// the key is cached as held by a node which has since gone away
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gone := models.Node{
+			ID:        models.HashBytes([]byte(l.Addr().String())),
+			Addr:      l.Addr().String(),
+			PublicKey: privateKey.Public().(*rsa.PublicKey),
+		}
+		l.Close()
+		lookups.put(key, gone)
+
+		// the get fails on the node, which is evicted, and the key is looked
+		// up again
+		dest := filepath.Join(root, "restored")
+		if err := getFileToPath(id, key, 0, n.peer, privateKey, dest); err != nil {
+			t.Fatalf("get after eviction failed: %v", err)
+		}
+		if node, ok := lookups.get(key); !ok || node.Addr != n.peer.Addr {
+			t.Fatalf("expected the unreachable node to be replaced, got %v, %v", node, ok)
+		}
+		restored, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, contents) {
+			t.Errorf("restored %q, expected %q", restored, contents)
+		}
+	})
+}
+
+func TestWritesSkipLookupCache(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 1, ReplicationFactor: 1}
+	n := startTestNode(t, models.Node{}, settings)
+	defer n.stop()
+	// a node of another ring, which stands in for a node the key has moved
+	// away from, and which stores whatever it is sent
+	stray := startTestNode(t, models.Node{}, settings)
+	defer stray.stop()
+
+	withLookupCacheTTL(time.Minute, func() {
+		id, privateKey := registerTestUser(t, n.peer)
+		root, err := ioutil.TempDir("", "lookup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		path := filepath.Join(root, "file.txt")
+		if err := ioutil.WriteFile(path, []byte("looked up contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		key := fileToKeyIdentifier(testResourceName(t, root, path))
+		lookups.put(key, stray.peer)
+
+		if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if findStored(stray.dataPath, key) != "" {
+			t.Error("expected the write not sent to the node the key was cached on")
+		}
+		if findStored(n.dataPath, key) == "" {
+			t.Error("expected the write sent to the node the key belongs to")
+		}
+		if node, ok := lookups.get(key); !ok || node.Addr != n.peer.Addr {
+			t.Errorf("expected the write to refresh the cached node, got %v, %v", node, ok)
+		}
+	})
+}
+
+// benchmarkGetFile - get the same file repeatedly, as a sync does, with the
+// lookup cache enabled for ttl
+func benchmarkGetFile(b *testing.B, ttl time.Duration) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	n := startTestNode(b, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+
+	withLookupCacheTTL(ttl, func() {
+		id, privateKey := registerTestUser(b, n.peer)
+		root, err := ioutil.TempDir("", "lookupbench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		path := filepath.Join(root, "file.txt")
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			b.Fatal(err)
+		}
+		if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+		key := fileToKeyIdentifier(testResourceName(b, root, path))
+		dest := filepath.Join(root, "restored")
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := getFileToPath(id, key, 0, n.peer, privateKey, dest); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+	})
+}
+
+func BenchmarkGetFileUncached(b *testing.B) {
+	benchmarkGetFile(b, 0)
+}
+
+func BenchmarkGetFileCached(b *testing.B) {
+	benchmarkGetFile(b, time.Minute)
+}
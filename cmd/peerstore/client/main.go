@@ -2,19 +2,19 @@ package main
 
 import (
 	"bytes"
-	"crypto/aes"
+	"context"
 	"crypto/rsa"
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"flag"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/dietsche/rfsnotify"
@@ -37,15 +37,95 @@ var (
 	filename         string
 	filedest         string
 	pollInterval     time.Duration
+	// breakerThreshold - consecutive failures before a peer is skipped
+	breakerThreshold int
+	// breakerCooldown - how long a failing peer is skipped before a probe
+	breakerCooldown time.Duration
+	// xattrs - capture extended attributes on backup, reapply on getfile
+	xattrs bool
+	// fileVersion - the version of the file to getfile, 0 is the latest
+	fileVersion uint64
+	// statusAddr - the address to serve the sync status page on
+	statusAddr string
+	// atomicBackup - commit the transaction log entries of a backup all together
+	atomicBackup bool
+	// since - restore only fetches changes made since the last restore,
+	// after this transaction log clock for a tree restored before changes
+	// were recorded, zero to fetch everything
+	since uint64
+	// cachePath - where to keep the offline cache and queue, empty disables
+	cachePath string
+	// embeddedStore - run a storage node within the client
+	embeddedStore bool
+	// embeddedAddr - the address the embedded storage node listens on
+	embeddedAddr string
+	// embeddedAdvertiseAddr - the address the other nodes of the ring reach
+	// the embedded storage node at, defaults to embeddedAddr
+	embeddedAdvertiseAddr string
+	// successorListLength, replicationFactor - the ring settings of the
+	// embedded storage node, which must match the ring it joins
+	successorListLength int
+	replicationFactor   int
+	// dataPath - where the embedded storage node stores resources
+	dataPath string
+	// readOnly - share a file without allowing it to be changed
+	readOnly bool
+	// privateNames - key resources by a secret derived from our private key
+	// rather than by their bare names
+	privateNames bool
+	// resourceKey - the hex key of the resource to getfile, in place of its
+	// name, for files shared with private names
+	resourceKey string
+	// keyPassphrase - the passphrase the private key in selfKeyFile is
+	// encrypted with, empty falls back to PEERSTORE_PASSPHRASE
+	keyPassphrase string
+	// requestTimeout - how long to wait for a node to answer a lookup, get
+	// or post before giving up on it, 0 waits forever
+	requestTimeout time.Duration
+	// retries - how many times a lookup or get which failed to reach its node
+	// is retried, with exponential backoff
+	retries int
+	// tlsCAFile - connect to nodes over TLS, checking their certificates
+	// against this CA, empty connects over plain tcp
+	tlsCAFile string
+	// poolMaxIdle - idle connections kept to each node for reuse
+	poolMaxIdle int
+	// poolIdleTimeout - how long an idle connection is kept for reuse
+	poolIdleTimeout time.Duration
+	// poolMaxPerHost - connections open to each node at once, 0 is unlimited
+	poolMaxPerHost int
+	// maxUploadBps, maxDownloadBps - the bandwidth used talking to nodes,
+	// in bytes per second, 0 is unlimited
+	maxUploadBps, maxDownloadBps uint64
+	// maxResponseSize - the largest response to read from a node, in bytes
+	maxResponseSize uint64
+	// lookupCacheTTL - how long the node a key was found to belong to is
+	// reused before the key is looked up again, 0 disables the cache
+	lookupCacheTTL time.Duration
+	// allowUntagged - accept stored data without an integrity tag, as
+	// resources stored before tags were added have, without verifying it
+	allowUntagged bool
+	// conflictStrategy - how sync resolves a file changed concurrently by
+	// two clients, newest-wins, keep-both or prompt
+	conflictStrategy string
+	// debounce - how long a file must go unwritten before sync uploads it
+	debounce time.Duration
+	// excludes - patterns of paths backup and sync leave out
+	excludes patternList
+	// configFile - a json file of settings for the flags not given
+	configFile string
 )
 
 func init() {
+	flag.StringVar(
+		&configFile, "config", "",
+		"a json file of settings, an object keyed by flag name such as {\"peerAddr\": \":3001\", \"poll\": \"5s\"}.  Flags given on the command line override the file")
 	flag.StringVar(
 		&peerAddr, "peerAddr", "",
 		"the address of a peer")
 	flag.StringVar(
 		&operation, "operation", "",
-		"choice of operation, backup or getfile.  backup will put localPath in peerstore, getfile will download the file and put it in filedest. specify the file to download by name with -filename flag")
+		"choice of operation, backup or getfile.  backup will put localPath in peerstore, restore will download everything backed up into localPath, getfile will download the file and put it in filedest. specify the file to download by name with -filename flag.  rebalance makes the node at peerAddr redistribute its keys.  drain makes the node at peerAddr hand its keys to its successor and stop accepting new data ahead of shutdown, and undrain makes it accept new data and rejoin the ring again.  list prints every resource you own or are shared on the ring.  stats prints the stored resources and request counts of the node at peerAddr.  ready exits with an error unless the node at peerAddr has joined the ring and can write to its data path.  doctor checks selfKeyFile, peerAddr and peerKeyFile step by step, posting, fetching and deleting a probe file, and reports which step fails and why.  fingerprint prints the identifier each of selfKeyFile, peerKeyFile and shareWithKeyFile that is set gives its key, to check out of band it is the intended user or node  unshare revokes the access the user in shareWithKeyFile was given to filename.  rekey encrypts filename with a new session key, giving every current owner a new secret for it, for when its key may have leaked.  ring walks the ring from the node at peerAddr, asking each node for its own successor and predecessor, and prints the nodes in ring order, failing if the ring loops.  transfer hands filename to the user in shareWithKeyFile, who becomes a read-write owner, and removes you from its owners.  verify fetches and decrypts the remote copy of every file under localPath, and reports those which differ, are not stored remotely, or are recorded in the transaction log but missing locally, changing nothing")
 	flag.StringVar(
 		&localPath, "localPath", "",
 		"the location of the dir you wish to sync")
@@ -65,13 +145,162 @@ func init() {
 		&shareWithKeyFile, "shareWithKeyFile", "",
 		"the key file location of the public key of the user you wish to share with as a pem file")
 	flag.DurationVar(&pollInterval, "poll", time.Second, "the polling interval for sync")
-	flag.Parse()
+	flag.Var(
+		&excludes, "exclude",
+		"a pattern of paths under localPath for backup and sync to leave out, as in a .gitignore, such as .git/ or *.swp.  Can be given more than once, and is added to the patterns in localPath/.peerstoreignore")
+	flag.DurationVar(
+		&debounce, "debounce", 500*time.Millisecond,
+		"how long a file must go unwritten before sync uploads it, so a burst of writes is uploaded once")
+	flag.IntVar(
+		&breakerThreshold, "breakerThreshold", protocol.DefaultBreakerConfig.FailureThreshold,
+		"the number of consecutive failures before a peer is failed fast, 0 disables")
+	flag.DurationVar(
+		&breakerCooldown, "breakerCooldown", protocol.DefaultBreakerConfig.Cooldown,
+		"how long a failing peer is failed fast before it is probed again")
+	flag.BoolVar(
+		&xattrs, "xattrs", false,
+		"capture extended file attributes on backup and reapply them on getfile, where supported")
+	flag.Uint64Var(
+		&fileVersion, "version", 0,
+		"the version of the file to getfile, on nodes which retain versions, 0 is the latest")
+	flag.StringVar(
+		&statusAddr, "statusAddr", "",
+		"the address to serve the sync status page on, such as localhost:8080")
+	flag.BoolVar(
+		&atomicBackup, "atomic", false,
+		"treat a backup as one transaction, the files are only recorded in the transaction log if every upload succeeds")
+	flag.Uint64Var(
+		&since, "since", 0,
+		"restore only the resources changed since localPath was last restored, leaving the rest as they are and removing the files deleted since.  A tree restored before changes were recorded in it compares this transaction log clock, which restore prints when it is done, instead.  Zero restores everything")
+	flag.StringVar(
+		&cachePath, "cachePath", "",
+		"the location to keep a cache of synced files and a queue of changes made while the peer is unreachable, empty disables offline use")
+	flag.BoolVar(
+		&embeddedStore, "embeddedStore", false,
+		"run a storage node within the client, which joins the ring at peerAddr if set and runs standalone otherwise")
+	flag.StringVar(
+		&embeddedAddr, "embeddedAddr", ":3000",
+		"the address the embedded storage node listens on for peers")
+	flag.StringVar(
+		&embeddedAdvertiseAddr, "embeddedAdvertiseAddr", "",
+		"the address the other nodes of the ring reach the embedded storage node at, defaults to -embeddedAddr.  It must name a host to join a ring")
+	flag.IntVar(
+		&successorListLength, "successorListLength", 1,
+		"the number of immediate successors the embedded storage node tracks, must be at least -replicationFactor")
+	flag.IntVar(
+		&replicationFactor, "replicationFactor", 1,
+		"the number of successors each resource is stored on, which the embedded storage node must agree on with the ring it joins")
+	flag.StringVar(
+		&dataPath, "dataPath", "./.peerstore",
+		"the data location for the embedded storage node to store files")
+	flag.BoolVar(
+		&readOnly, "readOnly", false,
+		"on share, allow the user shared with to read the file but not overwrite or delete it")
+	flag.BoolVar(
+		&privateNames, "privateNames", false,
+		"derive resource keys from the names with a secret from your private key, so nodes cannot confirm guessed names.  Every client of the user must agree on this")
+	flag.IntVar(
+		&downloadStreams, "downloadStreams", 4,
+		"on getfile, the number of ranges of a large file to download at once, 1 downloads it in a single request")
+	flag.StringVar(
+		&encryption, "encryption", cbcEncryption,
+		"the mode files are encrypted with on backup, cbc, gcm or stream.  gcm detects a tampered or corrupted file on getfile.  stream encrypts and decrypts files as they are transferred, so large files are never held in memory.  Files with an integrity tag are decrypted in whichever mode they were stored with, those without one only in this mode")
+	flag.StringVar(
+		&keyPassphrase, "keyPassphrase", "",
+		"the passphrase to encrypt a newly generated selfKeyFile with, or to decrypt an existing one with.  Defaults to the PEERSTORE_PASSPHRASE environment variable, which unlike the flag is not visible to other users")
+	flag.StringVar(
+		&resourceKey, "resourceKey", "",
+		"on getfile, the hex key of the resource to get in place of -filename, as given by the sharer of a file with a private name")
+	flag.DurationVar(
+		&requestTimeout, "requestTimeout", time.Minute,
+		"how long to wait for a node to answer a successor lookup, a get or a post before giving up on it, 0 waits forever")
+	flag.IntVar(
+		&retries, "retries", protocol.DefaultRetryPolicy.Attempts-1,
+		"how many times a successor lookup or a get which failed to reach its node, or timed out, is retried, waiting twice as long before each retry")
+	flag.StringVar(
+		&tlsCAFile, "tls", "",
+		"connect to nodes over TLS, checking their certificates against the CA in this pem file.  Every node of the ring must serve TLS")
+	flag.IntVar(
+		&poolMaxIdle, "poolMaxIdle", protocol.DefaultPoolConfig.MaxIdlePerHost,
+		"the number of idle connections kept open to each node for reuse, 0 dials a new connection for every operation")
+	flag.DurationVar(
+		&poolIdleTimeout, "poolIdleTimeout", protocol.DefaultPoolConfig.IdleTimeout,
+		"how long an idle connection to a node is kept open for reuse")
+	flag.IntVar(
+		&poolMaxPerHost, "poolMaxPerHost", protocol.DefaultPoolConfig.MaxPerHost,
+		"the most connections open to each node at once, in use or idle, further requests waiting for one to be free.  0 is unlimited")
+	flag.Uint64Var(
+		&maxUploadBps, "maxUploadBps", 0,
+		"the most bytes per second sent to nodes, shared by every transfer, 0 is unlimited.  -requestTimeout must allow a file to be posted at this rate")
+	flag.Uint64Var(
+		&maxDownloadBps, "maxDownloadBps", 0,
+		"the most bytes per second received from nodes, shared by every transfer, 0 is unlimited.  -requestTimeout must allow a file to be fetched at this rate")
+	flag.Uint64Var(
+		&maxResponseSize, "maxResponseSize", protocol.DefaultMaxResponseSize,
+		"the largest response read from a node, in bytes.  A connection sending a larger one is closed once its length is read.  A file fetched without -encryption stream comes in a single response, and has to fit")
+	flag.DurationVar(
+		&lookupCacheTTL, "lookupCacheTTL", 10*time.Second,
+		"how long the node a file was found on is reused for further operations on it before it is looked up again, 0 looks up every time")
+	flag.BoolVar(
+		&allowUntagged, "allowUntagged", false,
+		"accept files served without an integrity tag, which files backed up before tags were added have.  Their data cannot be verified, and a node could strip the tag of any file")
+	flag.StringVar(
+		&conflictStrategy, "conflict", keepBoth,
+		"how sync resolves a file changed concurrently by two clients.  newest-wins keeps the change made last, keep-both keeps the local file and writes the other change beside it as the file name followed by .conflict- and the id of the client which made it, prompt asks which to keep")
+}
+
+// selfKeyPassphrase - the passphrase of selfKeyFile, nil if it is not
+// encrypted
+func selfKeyPassphrase() []byte {
+	if keyPassphrase != "" {
+		return []byte(keyPassphrase)
+	}
+	if passphrase := os.Getenv("PEERSTORE_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase)
+	}
+	return nil
 }
 
 func validateParams() error {
-	if peerAddr == "" {
+	if operation == "fingerprint" {
+		// only reads key files, so no peer is needed
+		if selfKeyFile == "" && peerKeyFile == "" && shareWithKeyFile == "" {
+			return errors.New("selfKeyFile, peerKeyFile or shareWithKeyFile must be set")
+		}
+		return nil
+	}
+	if encryption != cbcEncryption && encryption != gcmEncryption && encryption != streamEncryption {
+		return errors.New("encryption must be cbc, gcm or stream")
+	}
+	if embeddedStore {
+		if dataPath == "" {
+			return errors.New("dataPath must be set")
+		}
+		if peerAddr != "" && peerKeyFile == "" {
+			return errors.New("peerKeyFile must be set to join the ring at peerAddr")
+		}
+		if err := embeddedRingSettings().Validate(); err != nil {
+			return errors.Wrap(err, "invalid ring settings")
+		}
+		if err := validateEmbeddedAddrs(); err != nil {
+			return err
+		}
+	} else if peerAddr == "" {
 		return errors.New("peerAddr must be set")
 	}
+	if peerAddr != "" {
+		normalized, err := models.ParseNodeAddr(peerAddr)
+		if err != nil {
+			return errors.Wrap(err, "invalid peerAddr")
+		}
+		peerAddr = normalized
+	}
+	if filename != "" {
+		var err error
+		if filename, err = models.NormalizeResourceName(filename); err != nil {
+			return errors.Wrap(err, "invalid filename")
+		}
+	}
 	if operation == "backup" {
 		if localPath == "" {
 			return errors.New("localPath must be set")
@@ -84,6 +313,9 @@ func validateParams() error {
 			return errors.New("localPath must be a valid directory")
 		}
 	} else if operation == "sync" {
+		if conflictStrategy != newestWins && conflictStrategy != keepBoth && conflictStrategy != promptConflict {
+			return errors.New("conflict must be newest-wins, keep-both or prompt")
+		}
 		if localPath == "" {
 			return errors.New("localPath must be set")
 		}
@@ -94,18 +326,37 @@ func validateParams() error {
 		if !info.IsDir() {
 			return errors.New("localPath must be a valid directory")
 		}
+	} else if operation == "restore" || operation == "verify" {
+		if localPath == "" {
+			return errors.New("localPath must be set")
+		}
 	} else if operation == "getfile" {
 		if filedest == "" {
 			return errors.New("filedest must be set")
 		}
+		if filename == "" && resourceKey == "" {
+			return errors.New("filename or resourceKey must be set")
+		}
+	} else if operation == "share" || operation == "unshare" || operation == "transfer" {
 		if filename == "" {
 			return errors.New("filename must be set")
 		}
-	} else if operation == "share" {
+		if shareWithKeyFile == "" {
+			return errors.New("shareWithKeyFile must be set")
+		}
+	} else if operation == "rekey" {
 		if filename == "" {
 			return errors.New("filename must be set")
 		}
-
+	} else if operation == "doctor" {
+		if embeddedStore {
+			return errors.New("doctor checks a remote peer, it cannot be run with embeddedStore")
+		}
+		if selfKeyFile == "" || peerKeyFile == "" {
+			return errors.New("selfKeyFile and peerKeyFile must be set")
+		}
+	} else if operation == "rebalance" || operation == "drain" || operation == "undrain" || operation == "list" || operation == "stats" || operation == "ready" || operation == "ring" {
+		// rebalance, drain, undrain, list, stats, ready and ring only need the peerAddr of a node
 	} else {
 		return errors.New("must specify operation flag, either backup or getfile")
 	}
@@ -113,69 +364,130 @@ func validateParams() error {
 }
 
 func main() {
+	flag.Parse()
 
 	log.Println("starting client")
 
+	if configFile != "" {
+		if err := loadConfig(flag.CommandLine, configFile); err != nil {
+			log.Fatalf("could not load config: %v\n", err)
+		}
+	}
+
 	if err := validateParams(); err != nil {
 		log.Fatalf("could not validate params: %v\n", err)
 	}
 
+	protocol.ConfigureBreakers(protocol.BreakerConfig{
+		FailureThreshold: breakerThreshold,
+		Cooldown:         breakerCooldown,
+	})
+
+	protocol.ConfigurePool(protocol.PoolConfig{
+		MaxIdlePerHost: poolMaxIdle,
+		IdleTimeout:    poolIdleTimeout,
+		MaxPerHost:     poolMaxPerHost,
+		MaxWait:        protocol.DefaultPoolConfig.MaxWait,
+	})
+
+	protocol.ConfigureRateLimit(protocol.RateLimitConfig{
+		MaxUploadBps:   maxUploadBps,
+		MaxDownloadBps: maxDownloadBps,
+	})
+	protocol.SetMaxResponseSize(maxResponseSize)
+
+	if tlsCAFile != "" {
+		tlsConfig, err := protocol.ClientTLSConfig(tlsCAFile)
+		if err != nil {
+			log.Fatalf("could not load TLS CA: %v\n", err)
+		}
+		protocol.ConfigureTLS(tlsConfig)
+	}
+
+	if cachePath != "" {
+		var err error
+		if offline, err = newOfflineStore(cachePath); err != nil {
+			log.Fatalf("could not open cache: %v\n", err)
+		}
+	}
+
+	if operation == "fingerprint" {
+		if !handleError(printFingerprints(os.Stdout)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if operation == "doctor" {
+		// checked before a missing key would be generated
+		if !printDoctor(os.Stdout, runDoctor(selfKeyFile, selfKeyPassphrase(), peerAddr, peerKeyFile)) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	var (
 		privateKey *rsa.PrivateKey
 		err        error
 	)
 
 	if _, err := os.Stat(selfKeyFile); err != nil {
-		// generate our public key
-		privateKey, err = crypto.GenerateKeyPair()
-		if err != nil {
-			log.Printf("failed to generate keypair: %s", err)
-			return
-		}
-		// create our keypair file:
-		keyFile, err := os.Create(fmt.Sprintf("%s", selfKeyFile))
-		if err != nil {
-			glog.Infof("failed to create keypair file: %s", err)
+		if privateKey, err = createSelfKey(selfKeyFile, selfKeyPassphrase()); err != nil {
+			log.Printf("failed to create keypair: %s", err)
 			return
 		}
-		crypto.WritePrivateKeyAsPem(keyFile, privateKey)
-		crypto.WritePublicKeyAsPem(keyFile, privateKey.Public().(*rsa.PublicKey))
-		keyFile.Close()
 	} else {
-		keyFile, err := os.Open(fmt.Sprintf("%s", selfKeyFile))
-		privateKey, err = crypto.ReadKeypairAsPem(keyFile)
+		privateKey, err = readSelfKey(selfKeyFile, selfKeyPassphrase())
 		if err != nil {
 			log.Printf("failed to read keypair: %s", err)
 			return
 		}
 	}
 
+	// resume the clock above every timestamp this user's client stamped
+	// before it was restarted
+	if err := models.ConfigureClockFile(selfKeyFile + ".clock"); err != nil {
+		log.Printf("failed to restore the clock: %s", err)
+		return
+	}
+
 	kb, _ := crypto.GobEncodePublicKey(privateKey.Public().(*rsa.PublicKey))
-	id := models.Identifier(sha1.Sum(kb))
+	id := models.HashBytes(kb)
+	deviceID = clientDeviceID(id, localPath)
 
-	// read in our peer's public key
-	keyFile, err := os.Open(peerKeyFile) // For read access.
-	if err != nil {
-		glog.Infof("failed to read initial peer key file: %s", err)
-		return
+	if privateNames {
+		nameSecret = deriveNameSecret(privateKey)
 	}
 
-	peerKey, err := crypto.ReadPublicKeyAsPem(keyFile)
-	if err != nil {
-		glog.Infof("failed to read keypair file: %s", err)
-		return
+	var peer models.Node
+	if embeddedStore {
+		// the client talks to its own node, which routes to the ring
+		if peer, err = startEmbeddedStore(); err != nil {
+			log.Printf("failed to start embedded store: %s", err)
+			return
+		}
+	} else {
+		// read in our peer's public key
+		peerKey, err := readPeerKey(peerKeyFile)
+		if err != nil {
+			glog.Infof("failed to read initial peer key file: %s", err)
+			return
+		}
+		peer = models.Node{
+			Addr:      peerAddr,
+			PublicKey: &peerKey,
+		}
 	}
 
 	// register the user with the network
-	log.Printf("usertype should be : %d", protocol.UserType)
-	rt, err := protocol.NewTransport("tcp", peerAddr, protocol.UserType, id, &peerKey, privateKey)
-	if err != nil {
+	rt, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, privateKey)
+	if err != nil && offline == nil {
 		log.Printf("ERR: %v", err)
 		return
 	}
 	log.Println("transport established")
 
-	resp, err := rt.RoundTrip(&protocol.Request{
+	resp, err := roundTrip(rt, &protocol.Request{
 		Header: protocol.Header{
 			From:   id,
 			Type:   protocol.UserType,
@@ -183,43 +495,35 @@ func main() {
 		},
 		Method: protocol.UserRegistrationMethod,
 	})
-	log.Println("registered user")
-	if err != nil {
+	rt.Close()
+	var online = err == nil
+	if !online {
 		log.Printf("Failed to round trip the successor request: %v", err)
-		return
+		if offline == nil {
+			return
+		}
+		// keep going, reads are served from the cache and changes queued
+		log.Printf("peer unreachable, working offline")
+	} else {
+		log.Println("registered user")
+		glog.V(protocol.DebugLogLevel).Infof("registration response: %v", resp)
 	}
-	rt.Close()
-	log.Printf("response: %+v", resp)
 
-	var peer = models.Node{
-		Addr:      peerAddr,
-		PublicKey: &peerKey,
+	if online {
+		// we are back online, replay whatever was queued while offline
+		flushPending(id, peer, privateKey)
 	}
 
 	switch operation {
 	case "share":
 		log.Println("starting share!")
 
-		var shareWithKey rsa.PublicKey
-
-		// check that we have a valid shareWithKeyFile
-		_, err := os.Stat(shareWithKeyFile)
+		// the key and ID of the user we are sharing with
+		shareWithKey, shareWithID, err := readShareWithKey(shareWithKeyFile)
 		if !handleError(err) {
 			return
 		}
 
-		keyFile, err := os.Open(fmt.Sprintf("%s", shareWithKeyFile))
-		shareWithKey, err = crypto.ReadPublicKeyAsPem(keyFile)
-		if !handleError(err) {
-			return
-		}
-		// generate the ID of the user we are sharing with
-		gobKey, err := crypto.GobEncodePublicKey(&shareWithKey)
-		if !handleError(err) {
-			return
-		}
-		shareWithID := models.Identifier(sha1.Sum(gobKey))
-
 		// we have our shareWithKey, which we will use to encrypt
 		// the session key
 
@@ -230,7 +534,7 @@ func main() {
 		}
 		defer t.Close()
 		// get the node that has the file
-		node, err := getNode(fileToKeyIdentifier(filename), id, t)
+		node, err := lookupNode(fileToKeyIdentifier(filename), id, t)
 		// connect to node housing the data
 		st, err := createTransport(id, node, privateKey)
 		if !handleError(err) {
@@ -258,14 +562,15 @@ func main() {
 		// populate SharedWith header, shared user's id/encrypted key
 		sharedWith := []protocol.SharedSecret{
 			protocol.SharedSecret{
-				ID:     shareWithID,
-				Secret: encSessionKey,
+				ID:       shareWithID,
+				Secret:   encSessionKey,
+				ReadOnly: readOnly,
 			},
 		}
 
 		// post file
 		log.Println("starting request: ", protocol.PostFileMethod)
-		_, err = st.RoundTrip(&protocol.Request{
+		shareResp, err := roundTrip(st, &protocol.Request{
 			Header: protocol.Header{
 				Key:          fileToKeyIdentifier(filename),
 				Type:         protocol.UserType,
@@ -276,6 +581,8 @@ func main() {
 				Log:          true,
 				SharedWith:   sharedWith,
 				Secret:       resp.Header.Secret,
+				// the data is unchanged, so its tag is too
+				Tag: resp.Header.Tag,
 			},
 			Method: protocol.PostFileMethod,
 			Data:   resp.Data,
@@ -283,6 +590,117 @@ func main() {
 		if !handleError(err) {
 			return
 		}
+		if !handleError(shareResp.Err()) {
+			return
+		}
+		if privateNames {
+			// the user shared with cannot derive the key from the name
+			log.Printf("shared %s, it can be fetched with -resourceKey %s",
+				filename, fileToKeyIdentifier(filename))
+		}
+
+	case "rebalance":
+		log.Println("starting rebalance!")
+
+		result, err := rebalanceNode(id, peer, privateKey)
+		if err != nil {
+			log.Printf("rebalance failed on %s", peer.Addr)
+			logAdminRequired(err, id, peer)
+			handleError(err)
+			return
+		}
+		log.Printf("rebalance complete: transferred=%d, kept=%d, failed=%d",
+			result.Transferred, result.Kept, result.Failed)
+
+	case "unshare":
+		log.Println("starting unshare!")
+
+		// the ID of the user whose access is revoked
+		_, shareWithID, err := readShareWithKey(shareWithKeyFile)
+		if !handleError(err) {
+			return
+		}
+		handleError(revokeShare(id, fileToKeyIdentifier(filename), shareWithID, peer, privateKey))
+
+	case "transfer":
+		log.Println("starting transfer!")
+
+		// the key and ID of the user the file is handed to
+		toKey, toID, err := readShareWithKey(shareWithKeyFile)
+		if !handleError(err) {
+			return
+		}
+		if !handleError(transferOwnership(id, filename, toID, &toKey, peer, privateKey)) {
+			os.Exit(1)
+		}
+		log.Printf("transferred %s to %s", filename, toID)
+
+	case "rekey":
+		log.Println("starting rekey!")
+		if !handleError(rekeyFile(id, filename, peer, privateKey)) {
+			os.Exit(1)
+		}
+
+	case "list":
+		log.Println("starting list!")
+		handleError(listFiles(id, peer, privateKey))
+
+	case "drain":
+		log.Println("starting drain!")
+
+		result, err := drainNode(id, peer, privateKey, false)
+		if err != nil {
+			log.Printf("drain failed on %s", peer.Addr)
+			logAdminRequired(err, id, peer)
+			handleError(err)
+			return
+		}
+		log.Printf("drain complete: transferred=%d, failed=%d",
+			result.Transferred, result.Failed)
+		if result.Failed > 0 {
+			log.Printf("%s is still routed to, run drain again before stopping it", peer.Addr)
+			return
+		}
+		log.Printf("%s can now be stopped", peer.Addr)
+
+	case "undrain":
+		log.Println("starting undrain!")
+
+		if _, err := drainNode(id, peer, privateKey, true); err != nil {
+			log.Printf("undrain failed on %s", peer.Addr)
+			logAdminRequired(err, id, peer)
+			handleError(err)
+			return
+		}
+		log.Printf("%s accepts new data again", peer.Addr)
+
+	case "stats":
+		stats, err := nodeStats(id, peer, privateKey)
+		logAdminRequired(err, id, peer)
+		if !handleError(err) {
+			return
+		}
+		printStats(peer.Addr, stats)
+
+	case "ring":
+		nodes, err := walkRing(id, peer, privateKey)
+		printRing(nodes, err == nil)
+		if !handleError(err) {
+			os.Exit(1)
+		}
+
+	case "ready":
+		t, err := createTransport(id, peer, privateKey)
+		if err == nil {
+			ctx, cancel := requestContext()
+			err = t.Ready(ctx)
+			cancel()
+			t.Close()
+		}
+		if !handleError(err) {
+			os.Exit(1)
+		}
+		log.Printf("%s is ready", peer.Addr)
 
 	case "sync":
 		log.Println("starting sync!")
@@ -290,7 +708,12 @@ func main() {
 		var (
 			quitChan   = make(chan bool)
 			signalChan = make(chan os.Signal)
+			// quiet - files which have stopped being written, to upload
+			quiet = make(chan string)
 		)
+		writes := newDebouncer(debounce, func(name string) {
+			quiet <- name
+		})
 		// need to kickoff a lookup to the transaction log in the DHT
 		// if there is a transaction log, we need to perform a get on all the
 		// resources that are listed in the transaction log and update our
@@ -306,6 +729,16 @@ func main() {
 		defer watcher.Close()
 		log.Println("sync watcher has been created")
 
+		if statusAddr != "" {
+			// serve up the status of the sync loop for monitoring
+			go func() {
+				log.Printf("serving sync status on %s", statusAddr)
+				if err := http.ListenAndServe(statusAddr, status); err != nil {
+					log.Printf("failed to serve sync status: %s", err)
+				}
+			}()
+		}
+
 		// watch for an interrupt
 		signal.Notify(signalChan, os.Interrupt)
 		go func() {
@@ -325,8 +758,17 @@ func main() {
 		// if the timestamp is greater than current clock then pull
 		// that resource.  If timestamp is less than current clock, then post
 		var transactionLog = models.TransactionLog{}
+		tombstones = loadTombstones(localPath)
+		known = loadKnownClocks(localPath)
+		if offline != nil {
+			// start from the log we last synced, so a restart does not
+			// refetch every resource
+			if saved, err := offline.loadLog(); err == nil {
+				transactionLog = saved
+			}
+		}
 		transactionLog, _ = Synchronize(
-			id, localPath, models.Node{Addr: peerAddr, PublicKey: &peerKey},
+			id, localPath, peer,
 			privateKey, transactionLog)
 
 		AddWatchers(watcher, localPath)
@@ -341,23 +783,51 @@ func main() {
 				// if differences, get the resources that are different
 				RemoveWatchers(watcher, localPath)
 				transactionLog, _ = Synchronize(
-					id, localPath, models.Node{Addr: peerAddr, PublicKey: &peerKey},
+					id, localPath, peer,
 					privateKey, transactionLog)
 				AddWatchers(watcher, localPath)
+				for _, stat := range protocol.Breakers.Stats() {
+					log.Printf("peer %s breaker is %s after %d failures",
+						stat.Addr, protocol.BreakerStateToString[stat.State],
+						stat.ConsecutiveFailures)
+				}
+			case name := <-quiet:
+				path, err := resourceName(localPath, name)
+				if !handleError(err) {
+					continue
+				}
+				if err := PostFile(id, path, peer,
+					privateKey); err != nil && offline != nil && isUnreachable(err) {
+					handleError(offline.enqueue(pendingOperation{
+						Kind: postPending, Path: path, LocalPath: localPath,
+					}))
+				}
 			case event := <-watcher.Events:
 				// we got a filesystem event, pull remote transaction log
 				// update it accordingly and save
+				if isConflictCopy(event.Name) {
+					// copies stay local, uploading them would conflict in
+					// turn on every other client
+					continue
+				}
+				path, err := resourceName(localPath, event.Name)
+				if !handleError(err) || syncRules.excluded(path, false) {
+					continue
+				}
 				if event.Op == fsnotify.Write {
 					log.Println("file written: ", event.Name)
-					path := strings.TrimPrefix(event.Name, localPath)
-					PostFile(id, path, models.Node{Addr: peerAddr, PublicKey: &peerKey},
-						privateKey)
+					// uploaded once the writes stop
+					writes.event(event.Name)
 				}
 				if event.Op == fsnotify.Remove {
 					log.Println("file removed: ", event.Name)
-					path := strings.TrimPrefix(event.Name, localPath)
-					DeleteFile(id, path, models.Node{Addr: peerAddr, PublicKey: &peerKey},
-						privateKey)
+					writes.cancel(event.Name)
+					if err := DeleteFile(id, path, peer,
+						privateKey); err != nil && offline != nil && isUnreachable(err) {
+						handleError(offline.enqueue(pendingOperation{
+							Kind: deletePending, Path: path, LocalPath: localPath,
+						}))
+					}
 				}
 			case err := <-watcher.Errors:
 				// somthing terrible happened with our FS watcher
@@ -367,173 +837,315 @@ func main() {
 		}
 
 	case "backup":
-		var walkFn = func(path string, fi os.FileInfo, err error) error {
-			if !fi.IsDir() {
-				log.Printf("file is: %s\n", path)
-
-				// figure out where to connect to
-				t, err := createTransport(id, peer, privateKey)
-				if !handleError(err) {
-					return errors.Wrap(err, "failed to create transport")
-				}
-				defer t.Close()
-
-				node, err := getNode(fileToKeyIdentifier(path), id, t)
-				if !handleError(err) {
-					return errors.Wrap(err, "failed to get node")
-				}
-
-				st, err := createTransport(id, node, privateKey)
-				if !handleError(err) {
-					return errors.Wrap(err, "failed to create transport")
-				}
-				defer st.Close()
-
-				// see if file exists, in order to get secret
-				var (
-					sessionKey []byte
-					secret     []byte
-					iv         []byte
-					ciphertext []byte
-				)
-
-				// read the file
-				plaintext, err := ioutil.ReadFile(path)
-
-				resp, err := getKey(fileToKeyIdentifier(path), id, t)
-				fmt.Println("UHHHH! ", err, resp.Status)
-				if err != nil || resp.Status == protocol.Error {
-					// doesnt exist, create new key
-					log.Println("IN HER$E!!!")
-					sessionKey, secret, err = crypto.GenerateSessionKey(
-						privateKey.Public().(*rsa.PublicKey))
-					log.Printf("plaintext session key: %s", hex.EncodeToString(sessionKey))
-					log.Printf("crypted session key: %s", hex.EncodeToString(secret))
-					log.Printf("len of session key crypted: %d", len(secret))
-					if !handleError(err) {
-						return errors.Wrap(err, "failed to generate session key")
-					}
-					ciphertext, iv, err = crypto.Encrypt(sessionKey, plaintext)
-					if !handleError(err) {
-						return errors.Wrap(err, "failed to encrypt payload")
-					}
-				} else {
-					// user session key from remote
-					secret = resp.Header.Secret
-					sessionKey, err = crypto.DecryptRSA(privateKey, secret)
-					log.Printf("plaintext session key: %s", hex.EncodeToString(sessionKey))
-					log.Printf("crypted session key: %s", hex.EncodeToString(secret))
-					log.Printf("len of session key crypted: %d", len(secret))
-					if !handleError(err) {
-						return errors.Wrap(err, "failed to decrypt session Key")
-					}
-					iv = resp.Data[:aes.BlockSize]
-					ciphertext, iv, err = crypto.EncryptWithIV(sessionKey, plaintext, iv)
-					if !handleError(err) {
-						return errors.Wrap(err, "failed to encrypt payload")
-					}
-				}
+		if !handleError(backupTree(id, localPath, peer, privateKey)) {
+			os.Exit(1)
+		}
 
-				log.Printf("plaintext is: %s", string(plaintext))
-
-				log.Printf("len of ciphertext: %d", len(ciphertext))
-				log.Printf("ciphertext: %s", hex.EncodeToString(ciphertext))
-				log.Printf("len of iv: %d", len(iv))
-				log.Printf("iv: %s", hex.EncodeToString(iv))
-				ciphertext = append(iv, ciphertext...)
-
-				// send the file over
-				log.Println("starting request: ", protocol.PostFileMethod)
-				_, err = st.RoundTrip(&protocol.Request{
-					Header: protocol.Header{
-						Key:          fileToKeyIdentifier(path),
-						Type:         protocol.UserType,
-						From:         id,
-						DataLength:   uint64(len(ciphertext)),
-						PubKey:       privateKey.Public().(*rsa.PublicKey),
-						ResourceName: path,
-						Log:          true,
-						Secret:       secret,
-					},
-					Method: protocol.PostFileMethod,
-					Data:   ciphertext,
-				})
-				if !handleError(err) {
-					return errors.Wrap(err, "failed to post file")
-				}
-			}
-			return nil
+	case "restore":
+		if !handleError(restoreTree(id, localPath, peer, privateKey)) {
+			os.Exit(1)
 		}
 
-		// Open up directory
-		// read each file, and send to peerAddr
-		filepath.Walk(localPath, walkFn)
+	case "verify":
+		report, err := verifyTree(id, localPath, peer, privateKey)
+		report.print(localPath)
+		if !handleError(err) || !report.ok() {
+			os.Exit(1)
+		}
 
 	case "getfile":
+		if resourceKey != "" {
+			// the cache and attributes are looked up by name, which we
+			// do not have
+			key, err := parseResourceKey(resourceKey)
+			if !handleError(err) {
+				return
+			}
+			log.Printf("getting resource: %s, putting %s", key, filedest)
+			handleError(getFileToPath(id, key, fileVersion, peer, privateKey, filedest))
+			return
+		}
 		log.Printf("getting file: %s, putting %s", filename, filedest)
-		t, err := createTransport(id, peer, privateKey)
+		err := getFileToPath(id, fileToKeyIdentifier(filename), fileVersion, peer, privateKey, filedest)
+		if offline != nil {
+			if err == nil {
+				handleError(offline.cacheFileFrom(filename, filedest))
+			} else if isUnreachable(err) && fileVersion == 0 {
+				log.Printf("peer unreachable, reading %s from the cache", filename)
+				var plaintext []byte
+				if plaintext, err = offline.cachedFile(filename); err == nil {
+					err = ioutil.WriteFile(filedest, plaintext, 0644)
+				}
+			}
+		}
 		if !handleError(err) {
 			return
 		}
-		defer t.Close()
 
-		// get the node that houses the file we need
-		node, err := getNode(fileToKeyIdentifier(filename), id, t)
+		if xattrs {
+			t, err := createTransport(id, peer, privateKey)
+			if !handleError(err) {
+				return
+			}
+			defer t.Close()
+			handleError(restoreXattrs(id, filename, filedest, t, privateKey))
+		}
+	}
+}
 
-		st, err := createTransport(id, node, privateKey)
-		if !handleError(err) {
-			return
+// getFileToPath - fetch the resource stored under key, decrypt it and write
+// it to dest.  Nothing is written to dest unless the whole resource is.  A
+// stream encrypted resource is decrypted into dest.part as it is downloaded,
+// and if the download is interrupted the next getfile of the same resource
+// to dest resumes it from there.
+func getFileToPath(id models.Identifier, key models.Identifier, version uint64, peer models.Node, privateKey *rsa.PrivateKey, dest string) error {
+	d, err := startDownload(id, key, version, peer, privateKey)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.reportProgress("getting " + dest)
+
+	tmp := dest + ".part"
+	if d.resumable() {
+		if err := d.resumeTo(tmp); err != nil {
+			return err
 		}
-		defer st.Close()
+		return os.Rename(tmp, dest)
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create destination")
+	}
+	if err := d.writeTo(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to write destination")
+	}
+	return os.Rename(tmp, dest)
+}
+
+// backupFile - encrypt and post the file at path within root, the
+// transaction log entry is staged in txn if given.  If given a manifest, a
+// file it records as already backed up is skipped, and one which is posted
+// is recorded in it.
+func backupFile(id models.Identifier, root, path string, peer models.Node, privateKey *rsa.PrivateKey, txn *stagedTransaction, m *backupManifest) error {
+	// the resource is named relative to root, as sync names it
+	name, err := resourceName(root, path)
+	if !handleError(err) {
+		return err
+	}
+
+	hash, err := hashFile(path)
+	if !handleError(err) {
+		return errors.Wrap(unreadableError{err}, "failed to read file")
+	}
+
+	// figure out where to connect to
+	t, err := createTransport(id, peer, privateKey)
+	if !handleError(err) {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
 
-		// get the key
-		resp, err := getKey(fileToKeyIdentifier(filename), id, t)
+	// connect to the node for the file
+	node, st, err := connectWriteNode(fileToKeyIdentifier(name), id, t, privateKey)
+	if !handleError(err) {
+		return err
+	}
+	defer st.Close()
+
+	// see if file exists, in order to get secret
+	var (
+		sessionKey []byte
+		secret     []byte
+		plaintext  []byte
+		payload    io.Reader
+		// uploaded - the hash of the contents as read for the upload
+		uploaded = sha256.New()
+	)
+
+	// only the first byte of an existing file is fetched, as just the
+	// secret is needed
+	resp, err := getRange(fileToKeyIdentifier(name), id, 0, 0, 1, t)
+	if err != nil || resp.Status == protocol.Error {
+		// doesnt exist, create new key
+		// the node no longer has it, if it ever did
+		handleError(m.forget(name))
+		sessionKey, secret, err = crypto.GenerateSessionKey(
+			privateKey.Public().(*rsa.PublicKey))
 		if !handleError(err) {
-			return
+			return errors.Wrap(err, "failed to generate session key")
 		}
-
-		log.Printf("response from getKey: %+v", resp)
-		log.Printf("secret from getKey: %+v", hex.EncodeToString(resp.Header.Secret))
-		// get the secret from the header,
-		// decrypt secret
-		sessionKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
+		glog.V(protocol.DebugLogLevel).Infof("new session key %s for %s", models.RedactSecret(sessionKey), name)
+	} else if m.unchanged(name, hash, resp.Header.Version) {
+		log.Printf("%s is unchanged since it was backed up", name)
+		return nil
+	} else {
+		// user session key from remote
+		secret = resp.Header.Secret
+		sessionKey, err = crypto.DecryptRSA(privateKey, secret)
 		if !handleError(err) {
-			return
+			return errors.Wrap(err, "failed to decrypt session Key")
 		}
+		glog.V(protocol.DebugLogLevel).Infof("session key %s of %s", models.RedactSecret(sessionKey), name)
+	}
 
-		log.Printf("plaintext session key is: %s", hex.EncodeToString(sessionKey))
+	if atomicBackup && txn != nil {
+		// keep what the post replaces, so a failed group can put it back
+		if err := txn.keep(fileToKeyIdentifier(name), id, node, st); !handleError(err) {
+			return err
+		}
+	}
 
-		// pull iv out of data
-		log.Printf("length of data: %d", len(resp.Data))
-		iv := resp.Data[:aes.BlockSize]
-		ciphertext := resp.Data[aes.BlockSize:]
+	if encryption == streamEncryption {
+		// the file is encrypted as it is uploaded, rather than read in
+		f, err := os.Open(path)
+		if !handleError(err) {
+			return errors.Wrap(unreadableError{err}, "failed to read file")
+		}
+		defer f.Close()
+		if payload, err = sealPayloadStream(sessionKey, io.TeeReader(f, uploaded)); !handleError(err) {
+			return errors.Wrap(err, "failed to encrypt payload")
+		}
+	} else {
+		// read the file
+		plaintext, err = ioutil.ReadFile(path)
+		if !handleError(err) {
+			return errors.Wrap(unreadableError{err}, "failed to read file")
+		}
+		uploaded.Write(plaintext)
+		ciphertext, err := sealPayload(sessionKey, plaintext)
+		if !handleError(err) {
+			return errors.Wrap(err, "failed to encrypt payload")
+		}
+		glog.V(protocol.DebugLogLevel).Infof("%s encrypted to %d bytes", path, len(ciphertext))
+		payload = bytes.NewReader(ciphertext)
+	}
 
-		log.Printf("iv from data: %s", hex.EncodeToString(iv))
-		log.Printf("ciphertext from data: %s", hex.EncodeToString(ciphertext))
+	// send the file over, in chunks when it is streamed
+	log.Println("starting request: ", protocol.PostFileMethod)
+	if info, err := os.Stat(path); err == nil {
+		st.SetProgress(newTransferProgress("backing up "+name, uint64(info.Size()), 0).sent)
+	}
+	postResp, err := postPayload(st, protocol.Header{
+		Key:          fileToKeyIdentifier(name),
+		Type:         protocol.UserType,
+		From:         id,
+		PubKey:       privateKey.Public().(*rsa.PublicKey),
+		ResourceName: name,
+		Log:          true,
+		Secret:       secret,
+	}, sessionKey, payload, encryption == streamEncryption)
+	if !handleError(err) {
+		lookups.invalidate(node)
+		return errors.Wrap(err, "failed to post file")
+	}
 
-		// decrypt data
-		plaintext, err := crypto.Decrypt(sessionKey, ciphertext, iv)
-		if !handleError(err) {
-			log.Printf("err: %s", err.Error())
-			return
+	if postResp.Status != protocol.Success {
+		err := errors.Wrapf(postResp.Err(), "post of %s was rejected", name)
+		if atomicBackup {
+			return err
 		}
-		// store data
+		// the rest of the backup carries on, but say why this file is missing
+		handleError(err)
+	} else {
+		status.recordUpload()
+		if _, err := models.IncrementClock(postResp.Header.Clock); err != nil {
+			status.recordError(err)
+			return errors.Wrap(err, "failed to advance the clock")
+		}
+		if txn != nil {
+			txn.stage(name, fileToKeyIdentifier(name), withMetadata(models.TransactionEntry{
+				Operation: models.UpdateOperation,
+				ClientID:  deviceID,
+				Timestamp: models.GetClock(),
+				Version:   postResp.Header.Version,
+			}, path))
+		}
+		handleError(recordBackup(m, name, path, uploaded.Sum(nil), postResp.Header))
+	}
 
-		log.Printf("plaintext is: %s", plaintext)
+	if xattrs {
+		// not being able to store the attributes should not
+		// fail the backup of the file itself
+		handleError(backupXattrs(id, name, path, sessionKey, secret, t, privateKey))
+	}
 
-		err = ioutil.WriteFile(filedest, plaintext, 0644)
-		if err != nil {
-			log.Println(err)
-			return
+	if offline != nil {
+		if plaintext == nil {
+			handleError(offline.cacheFileFrom(name, path))
+		} else {
+			handleError(offline.cacheFile(name, plaintext))
 		}
 	}
+	return nil
+}
+
+// encryptUpdate - encrypt the new contents of an existing file with its
+// existing session key.  A fresh IV is generated for every update, as
+// reusing the stored IV with the same key in CBC mode leaks information about
+// the plaintext, the IV is stored in front of the data so nothing else changes.
+func encryptUpdate(sessionKey, plaintext []byte) ([]byte, []byte, error) {
+	return crypto.Encrypt(sessionKey, plaintext)
+}
+
+// nameSecret - the secret resource keys are derived with when -privateNames
+// is set, nil derives keys from the bare names
+var nameSecret []byte
+
+// deriveNameSecret - the secret resource names are keyed with, derived from
+// the private key so every client of the user derives the same keys
+func deriveNameSecret(privateKey *rsa.PrivateKey) []byte {
+	sum := sha256.Sum256(append([]byte("peerstore-resource-names"), privateKey.D.Bytes()...))
+	return sum[:]
 }
 
+// fileToKeyIdentifier - the key of a resource, derived from its normalized
+// name so every spelling of the name maps to the same key
 func fileToKeyIdentifier(filename string) models.Identifier {
-	return models.Identifier(sha1.Sum([]byte(filename)))
+	return models.KeyForResource(filename, nameSecret)
+}
+
+// parseResourceKey - parse the hex key of a resource
+func parseResourceKey(key string) (models.Identifier, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		return models.Identifier{}, errors.Wrap(err, "resource key must be hex")
+	}
+	return models.IdentifierFromBytes(raw)
+}
+
+// resourceName - the name of the resource for the file at path within root,
+// backup and sync both name files this way so they agree on keys
+func resourceName(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to name resource")
+	}
+	name, err := models.NormalizeResourceName(filepath.ToSlash(rel))
+	if err != nil {
+		return "", errors.Wrapf(err, "%s is not under %s", path, root)
+	}
+	return name, nil
 }
 
+// getNode - the node key belongs to, from the lookup cache, or asked over t
+// if it was not looked up recently
 func getNode(key, id models.Identifier, t *protocol.Transport) (models.Node, error) {
+	if node, ok := lookups.get(key); ok {
+		return node, nil
+	}
+	return lookupNode(key, id, t)
+}
+
+// lookupNode - ask over t which node key belongs to, caching the answer
+func lookupNode(key, id models.Identifier, t *protocol.Transport) (models.Node, error) {
 	// serialize our get successor request
 	var (
 		idBuf = new(bytes.Buffer)
@@ -543,7 +1155,7 @@ func getNode(key, id models.Identifier, t *protocol.Transport) (models.Node, err
 	// encode successor request
 	enc.Encode(models.SuccessorRequest{key})
 	// perform round trip on transport
-	resp, err := t.RoundTrip(&protocol.Request{
+	resp, err := retryRoundTrip(t, &protocol.Request{
 		Header: protocol.Header{
 			Type: protocol.UserType,
 			From: id,
@@ -559,12 +1171,12 @@ func getNode(key, id models.Identifier, t *protocol.Transport) (models.Node, err
 
 	log.Printf("found node")
 
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
+	node, err = models.DecodeNode(bytes.NewBuffer(resp.Data))
 	if err != nil {
 		log.Printf("Failed to deserialize the node data: %v", err)
 		return node, errors.Wrap(err, "failed to deserialize node data")
 	}
+	lookups.put(key, node)
 	return node, nil
 }
 
@@ -573,6 +1185,32 @@ func createTransport(id models.Identifier, node models.Node, key *rsa.PrivateKey
 		"tcp", node.Addr, protocol.UserType, id, node.PublicKey, key)
 }
 
+// requestContext - the context of a single request to a node, which is
+// given up on after requestTimeout
+func requestContext() (context.Context, context.CancelFunc) {
+	if requestTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
+
+// roundTrip - round trip request on t, giving up after requestTimeout.  The
+// transport is closed if it was given up on.
+func roundTrip(t *protocol.Transport, request *protocol.Request) (protocol.Response, error) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	return t.RoundTripContext(ctx, request)
+}
+
+// retryRoundTrip - round trip request on t, giving up on each attempt after
+// requestTimeout, and retrying as many times as -retries allows.  Only
+// requests which can safely be sent more than once may be retried.
+func retryRoundTrip(t *protocol.Transport, request *protocol.Request) (protocol.Response, error) {
+	policy := protocol.DefaultRetryPolicy
+	policy.Attempts, policy.Timeout = retries+1, requestTimeout
+	return t.RoundTripWithRetry(request, policy)
+}
+
 func handleError(err error) bool {
 	if err != nil {
 		log.Printf("ERR: %v", err)
@@ -581,13 +1219,97 @@ func handleError(err error) bool {
 	return true
 }
 
+// rebalanceNode - have the node peer hand off the keys the ring routes to
+// other nodes, and pull in those routed to it
+func rebalanceNode(id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) (models.RebalanceResponse, error) {
+	var result models.RebalanceResponse
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+
+	var buf = new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(models.RebalanceRequest{})
+	resp, err := roundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.RebalanceMethod,
+		Data:   buf.Bytes(),
+	})
+	if err != nil {
+		return result, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return result, resp.Err()
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&result); err != nil {
+		return result, errors.Wrap(err, "failed to decode rebalance response")
+	}
+	return result, nil
+}
+
+// drainNode - drain the node at peer ahead of it being stopped, or undrain
+// it, which only admins are allowed to
+func drainNode(id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey, undrain bool) (models.DrainResponse, error) {
+	var result models.DrainResponse
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return result, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+
+	var buf = new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(models.DrainRequest{Undrain: undrain})
+	resp, err := roundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.DrainMethod,
+		Data:   buf.Bytes(),
+	})
+	if err != nil {
+		return result, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return result, resp.Err()
+	}
+	if undrain {
+		return result, nil
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&result); err != nil {
+		return result, errors.Wrap(err, "failed to decode drain response")
+	}
+	return result, nil
+}
+
+// logAdminRequired - explain an admin operation refused as unauthorized,
+// which it is unless the user id is one of the admins of the server
+func logAdminRequired(err error, id models.Identifier, peer models.Node) {
+	if re, ok := err.(*protocol.ResponseError); ok && re.Code == protocol.UnauthorizedCode {
+		log.Printf("user %s must be one of the -admins of %s", id, peer.Addr)
+	}
+}
+
 func getKey(key, id models.Identifier, t *protocol.Transport) (protocol.Response, error) {
+	return getKeyVersion(key, id, 0, t)
+}
+
+// getKeyVersion - get a specific version of a resource, on nodes which retain
+// versions.  A version of zero is the latest.
+func getKeyVersion(key, id models.Identifier, version uint64, t *protocol.Transport) (protocol.Response, error) {
 	// perform round trip
-	resp, err := t.RoundTrip(&protocol.Request{
+	resp, err := retryRoundTrip(t, &protocol.Request{
 		Header: protocol.Header{
-			Type: protocol.UserType,
-			From: id,
-			Key:  key,
+			Type:    protocol.UserType,
+			From:    id,
+			Key:     key,
+			Version: version,
 		},
 		Method: protocol.GetFileMethod,
 	})
@@ -596,37 +1318,114 @@ func getKey(key, id models.Identifier, t *protocol.Transport) (protocol.Response
 		return protocol.Response{}, errors.Wrap(err, "failed round trip")
 	}
 	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return resp, errors.New("protocol failure")
+		err := resp.Err()
+		log.Printf("failed to get resource requested: %v", err)
+		return resp, err
 	}
 	return resp, nil
 }
 
 var tl = models.TransactionLog{}
 
+// migrateLegacyNames - fold entries logged under a name from before resource
+// names were normalized, such as "/a.txt", into the entity of the normalized
+// name.  Both are stored under the same key, so without this the legacy
+// entries are never matched by a sync again.  Names outside the root are
+// left as they are, to be skipped.
+func migrateLegacyNames(tl models.TransactionLog) models.TransactionLog {
+	for k, v := range tl {
+		name, err := models.NormalizeResourceName(k)
+		if err != nil || name == k {
+			continue
+		}
+		entity, ok := tl[name]
+		if !ok {
+			entity = models.TransactionEntity{
+				ResourceName: name,
+				ResourceID:   fileToKeyIdentifier(name),
+			}
+		}
+		entity.Entries = append(entity.Entries, v.Entries...)
+		tl[name] = entity
+		delete(tl, k)
+	}
+	return tl
+}
+
+// syncRules - what sync leaves out of localPath, as of the last sync
+var syncRules ignoreRules
+
 func Synchronize(clientID models.Identifier, localPath string, peer models.Node, privateKey *rsa.PrivateKey, oldTransactionLog models.TransactionLog) (models.TransactionLog, error) {
 	// pull transaction log
 	tl, err := GetTransactionLog(
 		clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey)
 
-	log.Printf("local transaction log: %+v", tl)
-	log.Printf("remote transaction log: %+v", tl)
+	glog.V(protocol.DebugLogLevel).Infof("local transaction log: %+v", tl)
 
 	if err != nil {
 		log.Printf("Error getting transaction log: %s", err)
+		status.recordError(err)
+		if !isNoTransactionLog(err) {
+			// a log which could not be fetched or decoded is not an empty
+			// log, syncing against it would re-upload every file.  Keep the
+			// last good log and try again on the next poll, changes made in
+			// the meantime are queued when offline
+			log.Printf("aborting sync, retrying on the next poll")
+			return oldTransactionLog, err
+		}
+	}
+
+	if offline != nil && err == nil {
+		// we are back online, replay what was queued and pick up the log
+		// with those changes in it
+		if flushPending(clientID, peer, privateKey) > 0 {
+			if tl, err = GetTransactionLog(
+				clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey); err != nil {
+				status.recordError(err)
+				return oldTransactionLog, err
+			}
+		}
+	}
+	// entries synced before names were normalized are matched under the
+	// normalized name
+	tl = migrateLegacyNames(tl)
+	oldTransactionLog = migrateLegacyNames(oldTransactionLog)
+
+	// what to leave out, reloaded every sync so changes to the ignore file
+	// are picked up
+	if rules, err := loadIgnoreRules(localPath, excludes); handleError(err) {
+		syncRules = rules
 	}
+
 	// walk directory, if file is not in transaction log post it
 	var walkFn = func(path string, fi os.FileInfo, err error) error {
-		// use relative path
-		path = strings.TrimPrefix(path, localPath)
+		if err != nil {
+			return nil
+		}
+		// use the resource name, relative to localPath
+		name, nameErr := resourceName(localPath, path)
+		if nameErr != nil {
+			return nameErr
+		}
 
-		if !fi.IsDir() {
-			log.Printf("file is: %s\n", path)
-			log.Printf("path is: %s", path)
-			if _, ok := tl[path]; !ok {
+		if syncRules.excluded(name, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			if _, ok := tl[name]; !ok && name != "" {
+				// recorded so it is recreated even if it stays empty
+				log.Printf("directory does not exist in tl: %s", name)
+				PostDirectory(clientID, name, peer, privateKey)
+			}
+		} else if !isConflictCopy(name) {
+			glog.V(protocol.DebugLogLevel).Infof("file is: %s", name)
+			if _, ok := tl[name]; !ok {
 				// remote has never seen this one, post it
 				log.Printf("path does not exist in tl")
-				PostFile(clientID, path, peer, privateKey)
+				PostFile(clientID, name, peer, privateKey)
 			}
 		}
 		return nil
@@ -638,182 +1437,229 @@ func Synchronize(clientID models.Identifier, localPath string, peer models.Node,
 	// now we need to go through the transaction log and pull any new
 	// resources, will omit resources we have already seen
 	for k, v := range tl {
-
-		lastEntry := v.Entries[0]
-		for i, _ := range v.Entries {
-			if v.Entries[i].Timestamp >= lastEntry.Timestamp {
-				lastEntry = v.Entries[i]
+		if name, err := models.NormalizeResourceName(k); err != nil || name != k {
+			// never written to, it would land outside of localPath
+			log.Printf("skipping %q, it is not a valid resource name", k)
+			continue
+		}
+		// entries made concurrently by different clients are all latest,
+		// neither knowing of the other
+		latest := v.Latest()
+		known.learn(k, v.Clock())
+		if syncRules.excluded(k, allDirectories(latest)) {
+			// left alone, whatever the log says of it
+			continue
+		}
+		if len(latest) > 1 && !allDirectories(latest) {
+			log.Printf("conflict: %d concurrent changes to %s", len(latest), k)
+			if status.recordConflict(k) {
+				applyConflictResolution(clientID, k,
+					resolveConflict(conflictStrategy, deviceID, k, latest),
+					peer, privateKey)
 			}
+			continue
 		}
+		lastEntry := latest[0]
+		status.resolveConflict(k)
 
-		log.Printf("Last Entry: %v", lastEntry)
+		glog.V(protocol.DebugLogLevel).Infof("last entry: %v", lastEntry)
 
 		// check if this entry is in our local transaction log
 		if _, ok := oldTransactionLog[k]; !ok {
-			// not in our old transaction log, so we should get this thing
-			GetFile(clientID, k, peer, privateKey)
+			// not in our old transaction log, so we should get this thing,
+			// unless it was deleted here since
+			if !tombstones.admits(k, lastEntry) {
+				log.Printf("%s was deleted after the change the log has, not fetching it", k)
+				continue
+			}
+			restoreEntry(clientID, k, lastEntry, peer, privateKey)
 			continue
 		}
-		oldLastEntry := oldTransactionLog[k].Entries[0]
-		for i, _ := range oldTransactionLog[k].Entries {
-			if oldTransactionLog[k].Entries[i].Timestamp >= oldLastEntry.Timestamp {
-				oldLastEntry = oldTransactionLog[k].Entries[i]
+		oldLatest := oldTransactionLog[k].Latest()
+		oldLastEntry := oldLatest[len(oldLatest)-1]
+
+		glog.V(protocol.DebugLogLevel).Infof("old last entry clock: %v, last entry clock: %v", oldLastEntry.Clock, lastEntry.Clock)
+		switch oldLastEntry.Compare(lastEntry) {
+		case models.HappensBefore:
+			// the remote change was made knowing of ours, so we need to get
+			// the latest change
+			if !tombstones.admits(k, lastEntry) {
+				log.Printf("%s was deleted after the change the log has, not fetching it", k)
+				continue
 			}
-		}
-
-		log.Printf("oldlastentry time: %d, lastentrytime: %d", oldLastEntry.Timestamp, lastEntry.Timestamp)
-		if oldLastEntry.Timestamp < lastEntry.Timestamp {
-			// if the old log last entry is less than the new log last entry
-			// then we need to get the latest change
 			if lastEntry.Operation == models.DeleteOperation {
 				log.Printf("remote says to delete, removing")
 				// remote says remove, so remove
-				os.Remove(filepath.Join(localPath, k))
+				os.Remove(filepath.Join(localPath, filepath.FromSlash(k)))
+				status.recordDelete()
 				continue
 			}
 			log.Printf("Fetch the updated resource!")
-			GetFile(clientID, k, peer, privateKey)
-		} else if oldLastEntry.Timestamp == lastEntry.Timestamp {
+			restoreEntry(clientID, k, lastEntry, peer, privateKey)
+		case models.ClocksEqual:
 			// do nothing!
-		} else {
+		case models.HappensAfter:
 			// we have something locally that is newer.
-			if oldLastEntry.Operation == models.DeleteOperation {
+			switch oldLastEntry.Operation {
+			case models.DeleteOperation:
 				DeleteFile(clientID, k, peer, privateKey)
-				continue
+			case models.DirectoryOperation:
+				PostDirectory(clientID, k, peer, privateKey)
+			default:
+				PostFile(clientID, k, peer, privateKey)
+			}
+		case models.Concurrent:
+			// neither change knew of the other, overwriting either way
+			// would lose one of them
+			log.Printf("conflict: %s changed concurrently", k)
+			if status.recordConflict(k) {
+				applyConflictResolution(clientID, k,
+					resolveConflict(conflictStrategy, deviceID, k,
+						[]models.TransactionEntry{oldLastEntry, lastEntry}),
+					peer, privateKey)
 			}
-			PostFile(clientID, k, peer, privateKey)
 		}
 	}
+	status.recordPoll(len(tl))
+	if offline != nil {
+		handleError(offline.saveLog(tl))
+	}
 	return tl, nil
 }
 
-func GetFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) {
-	// get the specified resource from the DHT, and store it in path
-	log.Printf("getting file: %s, putting %s", path, path)
-	// the key for the distributed lookup
-	key := sha1.Sum([]byte(path))
-
-	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, clientID, peer.PublicKey, privateKey)
-	if err != nil {
-		log.Printf("ERR: %v", err)
+// restoreEntry - bring the resource at path under localPath up to the change
+// entry records, creating it if it is a directory or a symbolic link and
+// fetching it otherwise
+func restoreEntry(clientID models.Identifier, path string, entry models.TransactionEntry, peer models.Node, privateKey *rsa.PrivateKey) {
+	switch entry.Operation {
+	case models.DeleteOperation:
+		// never seen, nothing to fetch
+	case models.DirectoryOperation:
+		if err := os.MkdirAll(filepath.Join(localPath, filepath.FromSlash(path)), 0700); err != nil {
+			log.Println(err)
+			status.recordError(err)
+		}
+	case models.SymlinkOperation:
+		if err := restoreSymlink(filepath.Join(localPath, filepath.FromSlash(path)), entry); err != nil {
+			log.Println(err)
+			status.recordError(err)
+		}
+	default:
+		GetFile(clientID, path, peer, privateKey)
 	}
+}
 
-	// serialize our get successor request
-	var idBuf = new(bytes.Buffer)
-	enc := gob.NewEncoder(idBuf)
-	enc.Encode(models.SuccessorRequest{
-		models.Identifier(key),
-	})
-	resp, err := st.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			Type: protocol.UserType,
-			From: clientID,
-			Key:  key,
-		},
-		Method: protocol.GetSuccessorMethod,
-		Data:   idBuf.Bytes(),
-	})
-
-	st.Close()
-	if err != nil {
-		log.Printf("Failed to round trip the successor request: %v", err)
+// GetFile - get the latest version of the resource at path from the DHT, and
+// store it in path under localPath
+func GetFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) {
+	path, err := models.NormalizeResourceName(path)
+	if !handleError(err) {
 		return
 	}
+	fetchFile(clientID, path, 0, peer, privateKey,
+		filepath.Join(localPath, filepath.FromSlash(path)))
+}
 
-	log.Printf("found node")
+// fetchFile - get the version of the resource at path from the DHT, the
+// latest if version is 0, and store it in dest
+func fetchFile(clientID models.Identifier, path string, version uint64, peer models.Node, privateKey *rsa.PrivateKey, dest string) {
+	// get the specified resource from the DHT, and store it in dest
+	path, err := models.NormalizeResourceName(path)
+	if !handleError(err) {
+		return
+	}
+	log.Printf("getting file: %s, putting %s", path, dest)
+	// the key for the distributed lookup
+	key := fileToKeyIdentifier(path)
 
-	// connect to that host for this file
-	// pull node out of response, and connect to that host
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
+	// figure out where to connect to
+	node, err := findNode(key, clientID, peer, privateKey)
 	if err != nil {
-		log.Printf("Failed to deserialize the node data: %v", err)
+		log.Printf("Failed to find the node holding %s: %v", path, err)
+		status.recordError(err)
 		return
 	}
 
-	// figure out where to connect to
+	// connect to that host for this file
 	t, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, clientID, node.PublicKey, privateKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
 
-	resp, err = t.RoundTrip(&protocol.Request{
+	resp, err := roundTrip(t, &protocol.Request{
 		Header: protocol.Header{
-			Type: protocol.UserType,
-			From: clientID,
-			Key:  key,
+			Type:    protocol.UserType,
+			From:    clientID,
+			Key:     key,
+			Version: version,
 		},
 		Method: protocol.GetFileMethod,
 	})
 	t.Close()
 	if err != nil {
-		log.Printf("Failed to round trip the successor request: %v", err)
+		log.Printf("Failed to round trip the get file request: %v", err)
+		lookups.invalidate(node)
+		status.recordError(err)
 		return
 	}
 	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
+		log.Printf("failed to get resource requested: %v", resp.Err())
+		// the resource may have moved since it was looked up
+		lookups.invalidate(node)
+		status.recordError(errors.Wrapf(resp.Err(), "failed to get %s", path))
 		return
 	}
 
-	models.IncrementClock(resp.Header.Clock)
+	if _, err := models.IncrementClock(resp.Header.Clock); err != nil {
+		log.Printf("failed to advance the clock: %v", err)
+		status.recordError(err)
+		return
+	}
 
 	// make the directory structure needed:
-	dir, _ := filepath.Split(filepath.Join(localPath, path))
+	dir, _ := filepath.Split(dest)
 	os.MkdirAll(dir, 0700)
 
-	log.Printf("The file contents are: %s", string(resp.Data))
+	glog.V(protocol.DebugLogLevel).Infof("got %d bytes of %s", len(resp.Data), path)
 
-	err = ioutil.WriteFile(filepath.Join(localPath, path), resp.Data, 0644)
+	err = ioutil.WriteFile(dest, resp.Data, 0644)
 	if err != nil {
 		log.Println(err)
+		status.recordError(err)
 		return
 	}
+	status.recordDownload()
 }
 
-func PostFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) {
+// PostFile - post the file at path under localPath, and record the update in
+// the transaction log.  A symbolic link is recorded with PostSymlink instead.
+func PostFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) error {
 	// post the specified resource in the DHT
 	// the key for the distributed lookup
-	key := sha1.Sum([]byte(path))
-	data, err := ioutil.ReadFile(filepath.Join(localPath, path)) // path is the path to the file.
-
-	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, clientID, peer.PublicKey, privateKey)
-	if err != nil {
-		log.Printf("ERR: %v", err)
+	path, err := models.NormalizeResourceName(path)
+	if !handleError(err) {
+		return err
 	}
-
-	// serialize our get successor request
-	var idBuf = new(bytes.Buffer)
-	enc := gob.NewEncoder(idBuf)
-	enc.Encode(models.SuccessorRequest{
-		models.Identifier(key),
-	})
-	resp, err := st.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			From:   clientID,
-			Type:   protocol.UserType,
-			PubKey: privateKey.Public().(*rsa.PublicKey),
-		},
-		Method: protocol.GetSuccessorMethod,
-		Data:   idBuf.Bytes(),
-	})
+	if fi, err := os.Lstat(filepath.Join(localPath, filepath.FromSlash(path))); err == nil && isSymlink(fi) {
+		return PostSymlink(clientID, path, peer, privateKey)
+	}
+	key := fileToKeyIdentifier(path)
+	data, err := ioutil.ReadFile(filepath.Join(localPath, filepath.FromSlash(path))) // path is the path to the file.
 	if err != nil {
-		log.Printf("Failed to round trip the successor request: %v", err)
+		// posting anyway would replace the stored resource with nothing
+		log.Printf("Failed to read %s: %v", path, err)
+		return errors.Wrap(unreadableError{err}, "failed to read file")
 	}
-	st.Close()
 
-	// connect to that host for this file
-	// pull node out of response, and connect to that host
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
+	// figure out where to connect to
+	node, err := findWriteNode(key, clientID, peer, privateKey)
 	if err != nil {
-		log.Printf("Failed to deserialize the node data: %v", err)
+		log.Printf("Failed to find the node for %s: %v", path, err)
+		status.recordError(err)
+		return errors.Wrap(err, "failed to get successor")
 	}
 
-	// figure out where to connect to
+	// connect to that host for this file
 	t, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, clientID, node.PublicKey, privateKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
@@ -821,7 +1667,7 @@ func PostFile(clientID models.Identifier, path string, peer models.Node, private
 
 	// send the file over
 	log.Println("starting request: ", protocol.PostFileMethod)
-	response, err := t.RoundTrip(&protocol.Request{
+	response, err := roundTrip(t, &protocol.Request{
 		Header: protocol.Header{
 			Key:          key,
 			Type:         protocol.UserType,
@@ -838,273 +1684,297 @@ func PostFile(clientID models.Identifier, path string, peer models.Node, private
 	t.Close()
 	if err != nil {
 		log.Printf("ERR: %v\n", err)
+		lookups.invalidate(node)
+		status.recordError(err)
+		return errors.Wrap(err, "failed to post file")
+	}
+	if response.Status != protocol.Success {
+		err := errors.Wrapf(response.Err(), "post of %s was rejected", path)
+		log.Printf("ERR: %v\n", err)
+		status.recordError(err)
+		return err
 	}
-	log.Printf("Response: %+v\n", response)
+	status.recordUpload()
+	glog.V(protocol.DebugLogLevel).Infof("post response: %v", response)
 	// increment the clock
-	models.IncrementClock(response.Header.Clock)
+	if _, err := models.IncrementClock(response.Header.Clock); err != nil {
+		status.recordError(err)
+		return errors.Wrap(err, "failed to advance the clock")
+	}
 
 	tl, err := GetTransactionLog(clientID, node, privateKey.Public().(*rsa.PublicKey), privateKey)
 	if err != nil {
 		glog.Error("error getting transaction log: ", err)
+		if !isNoTransactionLog(err) {
+			status.recordError(err)
+			return errors.Wrap(err, "failed to get transaction log")
+		}
 	}
 
-	var timestamp = models.GetClock()
+	var (
+		timestamp = models.GetClock()
+		clock     = known.next(path, deviceID, tl[path])
+	)
 
-	if entity, ok := tl[path]; ok {
-		// entity exists, add entry
-		entity.Entries = append(
-			tl[path].Entries,
-			models.TransactionEntry{
-				Operation: models.UpdateOperation,
-				ClientID:  clientID,
-				Timestamp: timestamp,
-			},
-		)
-		tl[path] = entity
-	} else {
-		// resource is not in transaction log
-		tl[path] = models.TransactionEntity{
+	// only the new entry is sent, the node appends it to the log it holds
+	added := models.TransactionLog{
+		path: models.TransactionEntity{
 			ResourceName: path,
 			ResourceID:   key,
 			Entries: []models.TransactionEntry{
-				models.TransactionEntry{
+				withMetadata(models.TransactionEntry{
 					Operation: models.UpdateOperation,
-					ClientID:  clientID,
+					ClientID:  deviceID,
 					Timestamp: timestamp,
-				},
+					Version:   response.Header.Version,
+					Clock:     clock,
+				}, filepath.Join(localPath, filepath.FromSlash(path))),
 			},
-		}
+		},
 	}
-
-	// Upload the serialized transaction log to the DHT
-	err = PutTransactionLog(clientID, node, privateKey.Public().(*rsa.PublicKey), privateKey, tl)
+	err = PutTransactionLog(clientID, node, privateKey.Public().(*rsa.PublicKey), privateKey, added)
 	if err != nil {
 		glog.Error("error putting transaction log: ", err)
+		return errors.Wrap(err, "failed to put transaction log")
 	}
+	return nil
+}
 
-	t.Close()
+// DeleteFile - record the deletion of the file at path in the transaction log
+func DeleteFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	path, err := models.NormalizeResourceName(path)
+	if err != nil {
+		return err
+	}
+	entry, err := logOperation(clientID, path, models.TransactionEntry{Operation: models.DeleteOperation}, peer, privateKey)
+	if err != nil {
+		return err
+	}
+	status.recordDelete()
+	handleError(tombstones.bury(path, entry))
+	if xattrs {
+		handleError(deleteXattrs(clientID, path, peer, privateKey))
+	}
+	return nil
+}
+
+// PostDirectory - record the directory at path in the transaction log, so it
+// is recreated on restore even when empty
+func PostDirectory(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	_, err := logOperation(clientID, path, models.TransactionEntry{Operation: models.DirectoryOperation}, peer, privateKey)
+	return err
 }
 
-func DeleteFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) {
-	// delete the specified resource from the local file system
-	key := sha1.Sum([]byte(path))
+// logOperation - record an operation on the resource at path, which has no
+// data to post, in the transaction log.  The entry is recorded as made by
+// this device now.  Returns the entry as recorded.
+func logOperation(clientID models.Identifier, path string, entry models.TransactionEntry, peer models.Node, privateKey *rsa.PrivateKey) (models.TransactionEntry, error) {
+	path, err := models.NormalizeResourceName(path)
+	if err != nil {
+		return entry, err
+	}
+	key := fileToKeyIdentifier(path)
 
 	tl, err := GetTransactionLog(clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey)
 	if err != nil {
 		glog.Error("error getting transaction log: ", err)
+		if !isNoTransactionLog(err) {
+			status.recordError(err)
+			return entry, err
+		}
 	}
 
-	var timestamp = models.GetClock()
+	entry.ClientID, entry.Timestamp = deviceID, models.GetClock()
+	entry.Clock = known.next(path, deviceID, tl[path])
 
-	if entity, ok := tl[path]; ok {
-		// entity exists, add entry
-		entity.Entries = append(
-			tl[path].Entries,
-			models.TransactionEntry{
-				Operation: models.DeleteOperation,
-				ClientID:  clientID,
-				Timestamp: timestamp,
-			},
-		)
-		tl[path] = entity
-	} else {
-		// resource is not in transaction log
-		tl[path] = models.TransactionEntity{
+	// only the new entry is sent, the node appends it to the log it holds
+	added := models.TransactionLog{
+		path: models.TransactionEntity{
 			ResourceName: path,
 			ResourceID:   key,
-			Entries: []models.TransactionEntry{
-				models.TransactionEntry{
-					Operation: models.DeleteOperation,
-					ClientID:  clientID,
-					Timestamp: timestamp,
-				},
-			},
-		}
+			Entries:      []models.TransactionEntry{entry},
+		},
 	}
-
-	// Upload the serialized transaction log to the DHT
-	err = PutTransactionLog(clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey, tl)
+	err = PutTransactionLog(clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey, added)
 	if err != nil {
 		glog.Error("error putting transaction log: ", err)
+		status.recordError(err)
+		return entry, errors.Wrap(err, "failed to put transaction log")
 	}
+	return entry, nil
 }
 
-func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (models.TransactionLog, error) {
-	gobKey, _ := crypto.GobEncodePublicKey(userKey)
-	id := models.Identifier(sha1.Sum(append(gobKey, []byte("-transaction-log")...)))
+// isNoTransactionLog - check if err is because the user has no transaction
+// log yet, in which case they start with an empty one.  Any other failure to
+// get the log must not be mistaken for an empty log, as writing it back or
+// syncing against it would lose or re-upload every entry.
+func isNoTransactionLog(err error) bool {
+	return errors.Cause(err) == protocol.ErrResourceNotFound
+}
 
-	log.Printf("Trying to GET Transaction LOG, ID: %x", id)
+func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (models.TransactionLog, error) {
+	tl, _, err := getTransactionLog(thisID, peer, userKey, selfKey)
+	return tl, err
+}
 
-	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, selfKey)
+// getTransactionLog - the user's transaction log, and its digest as stored,
+// which is empty from nodes from before digests were sent
+func getTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (models.TransactionLog, []byte, error) {
+	id, err := protocol.TransactionLogKey(userKey)
 	if err != nil {
-		glog.Error("ERR: %v", err)
+		return models.TransactionLog{}, nil, err
 	}
 
-	var buf = new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	// Perform a Successor Request to our peer
-	enc.Encode(models.SuccessorRequest{
-		models.Identifier(id),
-	})
-	resp, err := t.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			Type: protocol.UserType,
-			From: thisID,
-			Key:  id,
-		},
-		Method: protocol.GetSuccessorMethod,
-		Data:   buf.Bytes(),
-	})
-	t.Close()
-	if err != nil {
-		glog.Info("Failed to round trip the successor request: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get successor: ")
-	}
+	log.Printf("Trying to GET Transaction LOG, ID: %s", id)
 
-	// populate our peer to get the log
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
+	// find the node holding the log
+	node, err := findNode(id, thisID, peer, selfKey)
 	if err != nil {
-		glog.Error("Failed to deserialize the node data: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed deserialize successor: ")
+		glog.Infof("Failed to find the node holding the transaction log: %v", err)
+		return models.TransactionLog{}, nil, errors.Wrap(err, "failed to get successor: ")
 	}
 
-	glog.Info("Peer holding TransactionLog: %s", node.ToString())
+	glog.Infof("Peer holding TransactionLog: %s", node)
 
 	// now connect to the node holding the transaction log
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, thisID, node.PublicKey, selfKey)
+	st, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, thisID, node.PublicKey, selfKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
-	resp, err = st.RoundTrip(&protocol.Request{
+	resp, err := retryRoundTrip(st, &protocol.Request{
 		Header: protocol.Header{
 			Type:   protocol.UserType,
 			From:   thisID,
 			Key:    id,
 			PubKey: selfKey.Public().(*rsa.PublicKey),
 		},
-		Method: protocol.GetFileMethod,
+		Method: protocol.GetTransactionLogMethod,
 	})
 	st.Close()
 	if err != nil {
-		log.Printf("Failed to round trip the get file request: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get file")
+		log.Printf("Failed to round trip the get transaction log request: %v", err)
+		lookups.invalidate(node)
+		return models.TransactionLog{}, nil, errors.Wrap(err, "failed to get transaction log")
 	}
 
 	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get file, protocol error")
+		log.Printf("failed to get transaction log: %v", resp.Err())
+		return models.TransactionLog{}, nil, errors.Wrap(resp.Err(), "failed to get transaction log, protocol error")
 	}
 
-	var transactionLog = models.TransactionLog{}
-	dec = gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&transactionLog)
+	transactionLog, err := models.DecodeTransactionLog(resp.Data)
 	if err != nil {
-		glog.Error("Failed to deserialize the transactionLog data: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed deserialize transaction log: ")
+		glog.Errorf("Failed to deserialize the transactionLog data: %v", err)
+		return models.TransactionLog{}, nil, errors.Wrap(err, "failed deserialize transaction log: ")
 	}
 
-	return transactionLog, nil
+	return transactionLog, resp.Header.LogDigest, nil
 }
 
+// PutTransactionLog - send entries to the node holding the user's transaction
+// log, which appends those it does not already have.  Only new entries need to
+// be sent, the whole log is never overwritten, so clients updating the log at
+// the same time do not lose each other's entries.
 func PutTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey, transactionLog models.TransactionLog) error {
-	gobKey, _ := crypto.GobEncodePublicKey(userKey)
-	glog.Infof("userKey bytes: %x", userKey)
-	glog.Infof("gobKey bytes: %x", gobKey)
-	id := models.Identifier(sha1.Sum(append(gobKey, []byte("-transaction-log")...)))
-
-	glog.Infof("Trying to PUT Transaction LOG, ID: %x", id)
+	return putTransactionLog(thisID, peer, userKey, selfKey, transactionLog, nil)
+}
 
-	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, selfKey)
+// putTransactionLog - send entries to the node holding the user's transaction
+// log as PutTransactionLog does, only if the stored log still has digest.  An
+// empty digest adds them whatever the log holds.
+func putTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey, transactionLog models.TransactionLog, digest []byte) error {
+	id, err := protocol.TransactionLogKey(userKey)
 	if err != nil {
-		glog.Error("ERR: %v", err)
+		return err
 	}
 
-	var buf = new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	// Perform a Successor Request to our peer
-	enc.Encode(models.SuccessorRequest{
-		models.Identifier(id),
-	})
-	resp, err := t.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			Type: protocol.UserType,
-			From: thisID,
-			Key:  id,
-		},
-		Method: protocol.GetSuccessorMethod,
-		Data:   buf.Bytes(),
-	})
-	t.Close()
+	glog.Infof("Trying to PUT Transaction LOG, ID: %s", id)
+
+	// find the node holding the log
+	node, err := findWriteNode(id, thisID, peer, selfKey)
 	if err != nil {
-		glog.Info("Failed to round trip the successor request: %v", err)
+		glog.Infof("Failed to find the node holding the transaction log: %v", err)
 		return errors.Wrap(err, "failed to get successor: ")
 	}
-	// populate our peer to get the log
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
-	if err != nil {
-		glog.Error("Failed to deserialize the node data: %v", err)
-		return errors.Wrap(err, "failed deserialize successor: ")
-	}
 
-	glog.Info("Peer holding TransactionLog: %s", node.ToString())
+	glog.Infof("Peer holding TransactionLog: %s", node)
 
-	// encode the transaction log, and put to our node
-	var logBuf = bytes.NewBuffer([]byte{})
-	enc = gob.NewEncoder(logBuf)
-	err = enc.Encode(&transactionLog)
+	// compact, encode the entries, and put to our node
+	logData, err := models.EncodeTransactionLog(transactionLog.Compact(models.TransactionHistory))
 	if err != nil {
-		glog.Error("Failed to serialize the transactionLog data: %v", err)
+		glog.Errorf("Failed to serialize the transactionLog data: %v", err)
 		return errors.Wrap(err, "failed serialize transaction log: ")
 	}
 
 	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, id, node.PublicKey, selfKey)
+	st, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, thisID, node.PublicKey, selfKey)
 	if err != nil {
-		glog.Error("ERR: %v", err)
+		glog.Errorf("ERR: %v", err)
 		return errors.Wrap(err, "failed serialize transaction log: ")
 	}
 
-	// send the file over
-	glog.Info("starting request: ", protocol.PostFileMethod)
+	// send the entries over, the node merges them into the log it holds
+	glog.Info("starting request: ", protocol.PutTransactionLogMethod)
 	request := &protocol.Request{
 		Header: protocol.Header{
 			Key:        id,
 			Type:       protocol.UserType,
 			From:       thisID,
-			DataLength: uint64(len(logBuf.Bytes())),
+			DataLength: uint64(len(logData)),
 			PubKey:     selfKey.Public().(*rsa.PublicKey),
+			LogDigest:  digest,
 		},
-		Method: protocol.PostFileMethod,
-		Data:   logBuf.Bytes(),
+		Method: protocol.PutTransactionLogMethod,
+		Data:   logData,
 	}
 
-	response, err := st.RoundTrip(request)
-	models.IncrementClock(response.Header.Clock)
+	response, err := roundTrip(st, request)
 	st.Close()
 	if err != nil {
-		glog.Error("ERR: %v\n", err)
+		glog.Errorf("ERR: %v\n", err)
+		lookups.invalidate(node)
 		return errors.Wrap(err, "failed serialize transaction log: ")
 	}
-	log.Printf("!!!!!!!!!!!!!!!!! PUT TRANSACTION LOG !!!!!!!!!!!! Response: %+v\n", response)
+	if response.Status != protocol.Success {
+		return errors.Wrap(response.Err(), "transaction log was rejected")
+	}
+	if _, err := models.IncrementClock(response.Header.Clock); err != nil {
+		return errors.Wrap(err, "failed to advance the clock")
+	}
+	glog.V(protocol.DebugLogLevel).Infof("transaction log put response: %v", response)
 
 	return nil
 
 }
 
+// AddWatchers - watch basePath and every directory under it which sync does
+// not leave out
 func AddWatchers(watcher *rfsnotify.RWatcher, basePath string) {
-	// walk all subdirectories
-	// set the watcher to watch the localpath
-	watcher.AddRecursive(basePath)
+	for _, dir := range watchedDirectories(basePath) {
+		watcher.Add(dir)
+	}
 }
 
+// RemoveWatchers - stop watching the directories AddWatchers watched
 func RemoveWatchers(watcher *rfsnotify.RWatcher, basePath string) {
-	// walk all subdirectories
-	// set the watcher to watch the localpath
-	watcher.RemoveRecursive(basePath)
+	for _, dir := range watchedDirectories(basePath) {
+		watcher.Remove(dir)
+	}
+}
+
+// watchedDirectories - basePath and every directory under it which sync does
+// not leave out
+func watchedDirectories(basePath string) []string {
+	var dirs []string
+	filepath.Walk(basePath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if name, err := resourceName(basePath, path); err != nil || syncRules.excluded(name, true) {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	return dirs
 }
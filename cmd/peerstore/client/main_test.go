@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestEncryptUpdateUsesDistinctIVs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(mode string) { encryption = mode }(encryption)
+	encryption = cbcEncryption
+	path := filepath.Join(root, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("the same contents, backed up twice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// the second backup updates the stored resource with its session key
+	var stored []protocol.Response
+	for i := 0; i < 2; i++ {
+		if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := getKey(fileToKeyIdentifier("a.txt"), id, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) < aes.BlockSize {
+			t.Fatalf("stored payload of %d bytes has no iv", len(resp.Data))
+		}
+		stored = append(stored, resp)
+	}
+	if !bytes.Equal(stored[0].Header.Secret, stored[1].Header.Secret) {
+		t.Fatal("expected the update encrypted with the session key of the stored resource")
+	}
+	if bytes.Equal(stored[0].Data[:aes.BlockSize], stored[1].Data[:aes.BlockSize]) {
+		t.Error("successive updates reused the same iv")
+	}
+}
+
+func TestUntaggedPayloadRefused(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	data := []byte("stored before tags were added")
+	if err := verifyPayloadTag(sessionKey, data, nil); err != errPayloadUntagged {
+		t.Errorf("expected untagged data refused, got %v", err)
+	}
+	defer func(allow bool) { allowUntagged = allow }(allowUntagged)
+	allowUntagged = true
+	if err := verifyPayloadTag(sessionKey, data, nil); err != nil {
+		t.Errorf("expected untagged data accepted with allowUntagged, got %v", err)
+	}
+	if err := verifyPayloadTag(sessionKey, data, []byte{1}); err != errPayloadTampered {
+		t.Errorf("expected a wrong tag refused with allowUntagged, got %v", err)
+	}
+}
+
+func TestOpenPayloadOfEitherMode(t *testing.T) {
+	sessionKey := make([]byte, 32)
+	plaintext := []byte("stored in one mode, read in the other")
+	defer func(mode string) { encryption = mode }(encryption)
+
+	for _, mode := range []string{cbcEncryption, gcmEncryption} {
+		encryption = mode
+		data, err := sealPayload(sessionKey, append([]byte{}, plaintext...))
+		if err != nil {
+			t.Error(err)
+		}
+		tag := payloadTag(sessionKey, data)
+		encryption = cbcEncryption
+		decrypted, err := openPayload(sessionKey, append([]byte{}, data...), tag)
+		if err != nil {
+			t.Errorf("failed to open %s payload: %v", mode, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("opened %s payload doesnt match: %s != %s", mode, decrypted, plaintext)
+		}
+
+		// without a tag nothing authenticates the mode, only the
+		// configured one is opened
+		if _, err := openPayload(sessionKey, append([]byte{}, data...), nil); (err == nil) != (mode == cbcEncryption) {
+			t.Errorf("untagged %s payload opened in cbc mode: %v", mode, err)
+		}
+	}
+
+	encryption = gcmEncryption
+	data, err := sealPayload(sessionKey, plaintext)
+	if err != nil {
+		t.Error(err)
+	}
+	tag := payloadTag(sessionKey, data)
+	data[len(data)-1] ^= 1
+	if _, err := openPayload(sessionKey, data, tag); err == nil {
+		t.Error("tampered gcm payload was opened")
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	root := filepath.Join("home", "user", "docs")
+	for path, expected := range map[string]string{
+		root:                                     "",
+		filepath.Join(root, "taxes", "2017.pdf"): "taxes/2017.pdf",
+	} {
+		if name, err := resourceName(root, path); err != nil || name != expected {
+			t.Errorf("resourceName(%q) = %q, %v, expected %q", path, name, err, expected)
+		}
+	}
+	for _, path := range []string{
+		// shares a prefix with root, but is not under it
+		filepath.Join("home", "user", "docs-old", "2017.pdf"),
+		filepath.Join("home", "user", "2017.pdf"),
+	} {
+		if name, err := resourceName(root, path); err == nil {
+			t.Errorf("resourceName(%q) = %q, expected it refused", path, name)
+		}
+	}
+}
+
+func TestMigrateLegacyNames(t *testing.T) {
+	tl := models.TransactionLog{
+		"/a.txt": models.TransactionEntity{
+			ResourceName: "/a.txt",
+			Entries:      []models.TransactionEntry{{Timestamp: 1}},
+		},
+		"/b.txt": models.TransactionEntity{
+			ResourceName: "/b.txt",
+			Entries:      []models.TransactionEntry{{Timestamp: 2}},
+		},
+		"b.txt": models.TransactionEntity{
+			ResourceName: "b.txt",
+			ResourceID:   fileToKeyIdentifier("b.txt"),
+			Entries:      []models.TransactionEntry{{Timestamp: 3}},
+		},
+		"../outside.txt": models.TransactionEntity{
+			ResourceName: "../outside.txt",
+			Entries:      []models.TransactionEntry{{Timestamp: 4}},
+		},
+	}
+	tl = migrateLegacyNames(tl)
+
+	for _, legacy := range []string{"/a.txt", "/b.txt"} {
+		if _, ok := tl[legacy]; ok {
+			t.Errorf("legacy name %s was not migrated", legacy)
+		}
+	}
+	if a := tl["a.txt"]; len(a.Entries) != 1 || a.ResourceName != "a.txt" ||
+		a.ResourceID != fileToKeyIdentifier("a.txt") {
+		t.Errorf("legacy entry not moved to its normalized name: %+v", a)
+	}
+	if b := tl["b.txt"]; len(b.Entries) != 2 {
+		t.Errorf("legacy entries not merged with the normalized name: %+v", b)
+	}
+	if _, ok := tl["../outside.txt"]; !ok {
+		t.Error("name outside of the root should be left to be skipped")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// manifestFile - the file at the root of localPath recording what backup
+// has already stored, so unchanged files are not uploaded again
+const manifestFile = ".peerstoremanifest"
+
+// manifestEntry - the contents of a file when it was last backed up
+type manifestEntry struct {
+	Hash [sha256.Size]byte
+	// Version - the version the node stored, zero if it keeps no versions
+	Version uint64
+	// Clock - the clock of the node when it stored the file
+	Clock uint64
+}
+
+// backupManifest - the files under a localPath already backed up, by
+// resource name
+type backupManifest struct {
+	path    string
+	mu      *sync.Mutex
+	entries map[string]manifestEntry
+}
+
+// loadManifest - the manifest of the backups of root, empty if there is
+// none.  A manifest which cannot be read is started afresh, as everything is
+// just uploaded again.
+func loadManifest(root string) *backupManifest {
+	m := &backupManifest{
+		path:    filepath.Join(root, manifestFile),
+		mu:      new(sync.Mutex),
+		entries: make(map[string]manifestEntry),
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m
+	}
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&m.entries)
+	}
+	if err != nil {
+		log.Printf("ignoring unreadable manifest %s: %s", m.path, err)
+		m.entries = make(map[string]manifestEntry)
+	}
+	return m
+}
+
+// unchanged - check if the file was last backed up with the same contents,
+// and the node still holds the version it was backed up as.  version is
+// the latest version the node holds.
+func (m *backupManifest) unchanged(name string, hash [sha256.Size]byte, version uint64) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[name]
+	return ok && entry.Hash == hash && entry.Version == version
+}
+
+// record - record the file as backed up, and save the manifest so an
+// interrupted backup resumes from there
+func (m *backupManifest) record(name string, entry manifestEntry) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[name] = entry
+	return m.save()
+}
+
+// forget - drop the file from the manifest, so it is uploaded by the next
+// backup
+func (m *backupManifest) forget(name string) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[name]; !ok {
+		return nil
+	}
+	delete(m.entries, name)
+	return m.save()
+}
+
+func (m *backupManifest) save() error {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m.entries); err != nil {
+		return errors.Wrap(err, "failed to encode manifest")
+	}
+	return errors.Wrap(writeFileAtomic(m.path, buf.Bytes()), "failed to write manifest")
+}
+
+// recordBackup - record the posted file in the manifest, with the hash of the
+// contents uploaded.  A file which changed while it was being read is left
+// out, so the next backup uploads it again.
+func recordBackup(m *backupManifest, name, path string, uploaded []byte, header protocol.Header) error {
+	if m == nil {
+		return nil
+	}
+	current, err := hashFile(path)
+	if err != nil || !bytes.Equal(current[:], uploaded) {
+		log.Printf("%s changed while it was backed up", name)
+		return m.forget(name)
+	}
+	return m.record(name, manifestEntry{
+		Hash:    current,
+		Version: header.Version,
+		Clock:   header.Clock,
+	})
+}
+
+// hashFile - the SHA-256 of the contents of the file at path
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
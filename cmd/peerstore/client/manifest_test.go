@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// uploads - the number of files uploaded since start
+func uploads() uint64 {
+	status.mu.Lock()
+	defer status.mu.Unlock()
+	return status.Uploads
+}
+
+func TestBackupSkipsUnchangedFiles(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"a.txt": "first",
+		"b.txt": "second",
+		"c.txt": "third",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := uploads()
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if posted := uploads() - before; posted != uint64(len(files)) {
+		t.Fatalf("expected every file posted by the first backup, got %d", posted)
+	}
+
+	// nothing changed
+	before = uploads()
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if posted := uploads() - before; posted != 0 {
+		t.Errorf("expected no file posted by a backup with no changes, got %d", posted)
+	}
+
+	// one file changed, and the node lost another
+	if err := ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(n.dataPath, fileToKeyIdentifier("b.txt").String())); err != nil {
+		t.Fatal(err)
+	}
+	before = uploads()
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if posted := uploads() - before; posted != 2 {
+		t.Errorf("expected the changed and the lost file posted, got %d", posted)
+	}
+
+	// the manifest itself is never backed up
+	if _, err := os.Stat(filepath.Join(root, manifestFile)); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := GetTransactionLog(id, n.peer, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tl[manifestFile]; ok {
+		t.Errorf("expected the manifest not backed up")
+	}
+}
+
+func TestRecordBackupFileChangedWhileRead(t *testing.T) {
+	root, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "a.txt")
+	if err := ioutil.WriteFile(path, []byte("as uploaded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := loadManifest(root)
+	if err := ioutil.WriteFile(path, []byte("written during the upload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordBackup(m, "a.txt", path, uploaded[:], protocol.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	current, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.unchanged("a.txt", uploaded, 0) || m.unchanged("a.txt", current, 0) {
+		t.Errorf("expected a file changed while read left out of the manifest")
+	}
+
+	if err := recordBackup(m, "a.txt", path, current[:], protocol.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	// and the manifest is read back as it was saved
+	if !loadManifest(root).unchanged("a.txt", current, 0) {
+		t.Errorf("expected the unchanged file recorded in the saved manifest")
+	}
+}
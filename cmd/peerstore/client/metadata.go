@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// sniffLen - the most bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// withMetadata - entry, recording the size, modification time and content
+// type of the file at path.  A file which cannot be read is recorded without
+// them, as the update itself is already posted.
+func withMetadata(entry models.TransactionEntry, path string) models.TransactionEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		return entry
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return entry
+	}
+	entry.Size, entry.ModTime = uint64(fi.Size()), fi.ModTime()
+	head := make([]byte, sniffLen)
+	if n, err := io.ReadFull(f, head); n > 0 && (err == nil || err == io.ErrUnexpectedEOF) {
+		entry.ContentType = http.DetectContentType(head[:n])
+	}
+	return entry
+}
+
+// applyModTime - set the modification time of the file at dest to the one
+// entry recorded, if it recorded one
+func applyModTime(dest string, entry models.TransactionEntry) error {
+	if entry.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(dest, time.Now(), entry.ModTime)
+}
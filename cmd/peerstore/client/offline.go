@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// pendingKind - the kind of a queued operation, which decides how it is
+// replayed once the peer is reachable again
+type pendingKind int
+
+const (
+	// backupPending - a file from the backup operation to encrypt and post
+	backupPending pendingKind = iota
+	// postPending - a file changed under a synced localPath
+	postPending
+	// deletePending - a file removed from a synced localPath
+	deletePending
+)
+
+// pendingOperation - an operation queued while the peer was unreachable
+type pendingOperation struct {
+	Kind pendingKind
+	// Path - the path of the file for backup operations, the resource name
+	// relative to LocalPath for sync operations
+	Path      string
+	LocalPath string
+	Queued    time.Time
+}
+
+// offlineStore - the local state which lets the client keep working when
+// the peer is unreachable: a cache of file contents so getfile works, the
+// last synced transaction log, and a durable queue of pending operations
+// which is flushed once the peer is reachable again
+type offlineStore struct {
+	path string
+	// mu - guards the cached files and transaction log
+	mu *sync.Mutex
+	// queueMu - guards the queue, which is held while replaying, so replayed
+	// operations can still use the cache
+	queueMu *sync.Mutex
+}
+
+// offline - the offline store, nil unless -cachePath is set
+var offline *offlineStore
+
+// newOfflineStore - open the offline store kept in path, creating it if needed
+func newOfflineStore(path string) (*offlineStore, error) {
+	if err := os.MkdirAll(filepath.Join(path, "files"), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create cache dir")
+	}
+	return &offlineStore{
+		path:    path,
+		mu:      new(sync.Mutex),
+		queueMu: new(sync.Mutex),
+	}, nil
+}
+
+// isUnreachable - check if err was caused by not being able to reach a peer,
+// or by a peer which is draining, as opposed to the peer rejecting the request
+func isUnreachable(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+	return cause == protocol.ErrNotConnected || cause == protocol.ErrCircuitOpen ||
+		cause == protocol.ErrDraining
+}
+
+// writeFileAtomic - write data to a temporary file and rename it into place,
+// so a crash never leaves a partially written file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (o *offlineStore) cachedFilePath(name string) string {
+	return filepath.Join(o.path, "files", fileToKeyIdentifier(name).String())
+}
+
+// cacheFile - keep a copy of the plaintext of the named resource
+func (o *offlineStore) cacheFile(name string, plaintext []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return writeFileAtomic(o.cachedFilePath(name), plaintext)
+}
+
+// cacheFileFrom - keep a copy of the file at path as the plaintext of the
+// named resource, copying it rather than reading it into memory
+func (o *offlineStore) cacheFileFrom(name, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	tmp := o.cachedFilePath(name) + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.cachedFilePath(name))
+}
+
+// cachedFile - the cached plaintext of the named resource
+func (o *offlineStore) cachedFile(name string) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, err := ioutil.ReadFile(o.cachedFilePath(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "resource is not cached")
+	}
+	return data, nil
+}
+
+// saveLog - persist the last synced transaction log
+func (o *offlineStore) saveLog(tl models.TransactionLog) error {
+	data, err := models.EncodeTransactionLog(tl)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return writeFileAtomic(filepath.Join(o.path, "transaction-log"), data)
+}
+
+// loadLog - the last synced transaction log
+func (o *offlineStore) loadLog() (models.TransactionLog, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data, err := ioutil.ReadFile(filepath.Join(o.path, "transaction-log"))
+	if err != nil {
+		return models.TransactionLog{}, errors.Wrap(err, "no saved transaction log")
+	}
+	return models.DecodeTransactionLog(data)
+}
+
+func (o *offlineStore) readQueue() ([]pendingOperation, error) {
+	data, err := ioutil.ReadFile(filepath.Join(o.path, "queue"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read queue")
+	}
+	var queue []pendingOperation
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&queue); err != nil {
+		return nil, errors.Wrap(err, "failed to decode queue")
+	}
+	return queue, nil
+}
+
+func (o *offlineStore) writeQueue(queue []pendingOperation) error {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(queue); err != nil {
+		return errors.Wrap(err, "failed to encode queue")
+	}
+	return writeFileAtomic(filepath.Join(o.path, "queue"), buf.Bytes())
+}
+
+// enqueue - durably queue an operation to replay once the peer is reachable.
+// Only the latest operation on a resource is kept, as replaying a post reads
+// the file as it is at that time.
+func (o *offlineStore) enqueue(op pendingOperation) error {
+	o.queueMu.Lock()
+	defer o.queueMu.Unlock()
+	queue, err := o.readQueue()
+	if err != nil {
+		return err
+	}
+	op.Queued = time.Now()
+	kept := []pendingOperation{}
+	for _, queued := range queue {
+		if queued.Path != op.Path || queued.LocalPath != op.LocalPath {
+			kept = append(kept, queued)
+		}
+	}
+	log.Printf("queueing %s until the peer is reachable", op.Path)
+	return o.writeQueue(append(kept, op))
+}
+
+// flush - replay the queued operations in order.  Replay stops at the first
+// operation which fails because the peer is unreachable, and it and every
+// later operation stay queued.  An operation the peer rejects is dropped, so
+// it cannot hold up the rest of the queue.  Sync operations queued for
+// another localPath are left for that sync.  Returns the number replayed.
+func (o *offlineStore) flush(replay func(pendingOperation) error) (int, error) {
+	o.queueMu.Lock()
+	defer o.queueMu.Unlock()
+	queue, err := o.readQueue()
+	if err != nil || len(queue) == 0 {
+		return 0, err
+	}
+
+	var (
+		kept     = []pendingOperation{}
+		replayed = 0
+	)
+	for i, op := range queue {
+		if op.Kind != backupPending && op.LocalPath != localPath {
+			kept = append(kept, op)
+			continue
+		}
+		if err := replay(op); err != nil {
+			if isUnreachable(err) {
+				kept = append(kept, queue[i:]...)
+				break
+			}
+			log.Printf("dropping queued %s, rejected by peer: %s", op.Path, err)
+			continue
+		}
+		replayed++
+	}
+	return replayed, o.writeQueue(kept)
+}
+
+// flushPending - replay the operations queued while offline, if any
+func flushPending(clientID models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) int {
+	if offline == nil {
+		return 0
+	}
+	replayed, err := offline.flush(func(op pendingOperation) error {
+		log.Printf("replaying queued %s", op.Path)
+		switch op.Kind {
+		case backupPending:
+			txn := newStagedTransaction()
+			if err := backupFile(clientID, op.LocalPath, op.Path, peer, privateKey, txn, loadManifest(op.LocalPath)); err != nil {
+				return err
+			}
+			return txn.commit(clientID, peer, privateKey)
+		case postPending:
+			return PostFile(clientID, op.Path, peer, privateKey)
+		case deletePending:
+			return DeleteFile(clientID, op.Path, peer, privateKey)
+		}
+		return errors.Errorf("unknown queued operation %d", op.Kind)
+	})
+	handleError(err)
+	if replayed > 0 {
+		log.Printf("replayed %d queued operations", replayed)
+	}
+	return replayed
+}
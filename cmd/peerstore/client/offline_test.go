@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestOfflineQueueReplayed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newOfflineStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := localPath
+	defer func() { localPath = saved }()
+	localPath = "/synced"
+
+	for _, op := range []pendingOperation{
+		{Kind: postPending, Path: "a.txt", LocalPath: localPath},
+		{Kind: backupPending, Path: "/backup/b.txt", LocalPath: "/backup"},
+		{Kind: postPending, Path: "other.txt", LocalPath: "/elsewhere"},
+		{Kind: postPending, Path: "rejected.txt", LocalPath: localPath},
+		// only the latest operation on a resource is kept
+		{Kind: deletePending, Path: "a.txt", LocalPath: localPath},
+	} {
+		if err := store.enqueue(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// still offline, nothing is replayed and nothing is lost
+	replayed, err := store.flush(func(op pendingOperation) error {
+		return protocol.ErrNotConnected
+	})
+	if err != nil || replayed != 0 {
+		t.Fatalf("flush while unreachable = %d, %v, expected nothing replayed", replayed, err)
+	}
+	if queue, err := store.readQueue(); err != nil || len(queue) != 4 {
+		t.Fatalf("queue after an unreachable flush = %v, %v, expected 4 operations", queue, err)
+	}
+
+	var got []pendingOperation
+	replayed, err = store.flush(func(op pendingOperation) error {
+		got = append(got, op)
+		if op.Path == "rejected.txt" {
+			return errors.New("rejected by peer")
+		}
+		return nil
+	})
+	if err != nil || replayed != 2 {
+		t.Fatalf("flush = %d, %v, expected 2 replayed", replayed, err)
+	}
+	var paths []string
+	for _, op := range got {
+		paths = append(paths, op.Path)
+	}
+	if len(got) != 3 || got[0].Path != "/backup/b.txt" || got[1].Path != "rejected.txt" ||
+		got[2].Path != "a.txt" || got[2].Kind != deletePending {
+		t.Errorf("replayed %v, expected the backup, the rejected post and the delete in order", paths)
+	}
+	// a sync of another localPath picks up its own operations
+	queue, err := store.readQueue()
+	if err != nil || len(queue) != 1 || queue[0].Path != "other.txt" {
+		t.Errorf("queue after the flush = %v, %v, expected only the other sync's post", queue, err)
+	}
+}
+
+func TestOfflineCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newOfflineStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.cachedFile("docs/a.txt"); err == nil {
+		t.Error("expected a resource never cached to be missing")
+	}
+	if err := store.cacheFile("docs/a.txt", []byte("cached")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.cachedFile("docs/a.txt"); err != nil || string(data) != "cached" {
+		t.Errorf("cached file = %q, %v, expected %q", data, err, "cached")
+	}
+
+	path := filepath.Join(dir, "b.txt")
+	if err := ioutil.WriteFile(path, []byte("copied"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.cacheFileFrom("b.txt", path); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.cachedFile("b.txt"); err != nil || string(data) != "copied" {
+		t.Errorf("cached file = %q, %v, expected %q", data, err, "copied")
+	}
+
+	if _, err := store.loadLog(); err == nil {
+		t.Error("expected no saved transaction log")
+	}
+	tl := models.TransactionLog{"a.txt": models.TransactionEntity{
+		ResourceName: "a.txt",
+		ResourceID:   fileToKeyIdentifier("a.txt"),
+		Entries:      []models.TransactionEntry{{Operation: models.UpdateOperation, ClientID: deviceA}},
+	}}
+	if err := store.saveLog(tl); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := store.loadLog(); err != nil || len(loaded["a.txt"].Entries) != 1 {
+		t.Errorf("loaded transaction log = %+v, %v, expected the saved one", loaded, err)
+	}
+}
+
+func TestDeleteWithCorruptLogAborts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+	userKey := privateKey.Public().(*rsa.PublicKey)
+
+	if err := PutTransactionLog(id, n.peer, userKey, privateKey, models.TransactionLog{
+		"a.txt": models.TransactionEntity{
+			ResourceName: "a.txt",
+			ResourceID:   fileToKeyIdentifier("a.txt"),
+			Entries:      []models.TransactionEntry{{Operation: models.UpdateOperation, ClientID: deviceA}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	logKey, err := protocol.TransactionLogKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := storedPath(t, n.dataPath, logKey)
+	corrupt := []byte("not a transaction log")
+	if err := ioutil.WriteFile(path, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a log which cannot be read is not an empty one, deleting against it
+	// must not replace it
+	if err := DeleteFile(id, "a.txt", n.peer, privateKey); err == nil {
+		t.Fatal("delete with a corrupt transaction log did not fail")
+	} else if isUnreachable(err) {
+		t.Errorf("delete with a corrupt transaction log failed with %v, which would be queued", err)
+	}
+	if stored, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(stored, corrupt) {
+		t.Errorf("stored transaction log = %q, %v, expected it left as it was", stored, err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cbcEncryption - aes in cbc mode, the stored data is the iv followed by
+	// the ciphertext.  A tampered payload decrypts to garbage.
+	cbcEncryption = "cbc"
+	// gcmEncryption - aes in gcm mode, the stored data is gcmPayloadMagic,
+	// the nonce and then the ciphertext.  A tampered payload is an error.
+	gcmEncryption = "gcm"
+	// streamEncryption - aes in ctr mode, the stored data is
+	// streamPayloadMagic, the iv and then the ciphertext.  Files are encrypted
+	// and decrypted as they are uploaded and downloaded, rather than in
+	// memory.  A tampered payload decrypts to garbage.
+	streamEncryption = "stream"
+)
+
+// encryption - the mode new payloads are encrypted with
+var encryption string
+
+// gcmPayloadMagic - the prefix of a gcm encrypted payload, which tells it
+// apart from a cbc payload starting with its random iv
+var gcmPayloadMagic = []byte("PSG1")
+
+// streamPayloadMagic - the prefix of a stream encrypted payload
+var streamPayloadMagic = []byte("PSS1")
+
+// gcmNonceSize - the nonce size of crypto.EncryptGCM
+const gcmNonceSize = 12
+
+// errPayloadTampered - the stored data does not match the integrity tag
+// stored with it, it was truncated or changed after it was posted
+var errPayloadTampered = errors.New("stored data does not match its integrity tag")
+
+// errPayloadUntagged - the stored data was served without an integrity tag,
+// which every post now carries, so it was stored before tags were added or
+// the tag was stripped by the node serving it
+var errPayloadUntagged = errors.New("stored data has no integrity tag, set -allowUntagged to accept data stored before tags were added")
+
+// newPayloadMAC - the HMAC of stored data encrypted with sessionKey, which
+// is posted as the tag of the data.  The server cannot compute it, so a
+// node cannot change the data and its tag together.
+func newPayloadMAC(sessionKey []byte) hash.Hash {
+	return crypto.NewHMAC(crypto.DeriveHMACKey(sessionKey))
+}
+
+// payloadTag - the integrity tag of stored data encrypted with sessionKey
+func payloadTag(sessionKey, data []byte) []byte {
+	return crypto.ComputeHMAC(crypto.DeriveHMACKey(sessionKey), data)
+}
+
+// checkPayloadTag - check the HMAC of stored data, mac, against the tag
+// served with it.  Resources stored before tags were added have none, and
+// are only accepted with allowUntagged, as a node could strip the tag of
+// any resource to have tampered data accepted.
+func checkPayloadTag(mac hash.Hash, tag []byte) error {
+	if len(tag) == 0 {
+		if !allowUntagged {
+			return errPayloadUntagged
+		}
+		log.Println("stored data has no integrity tag, it cannot be verified")
+		return nil
+	}
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return errPayloadTampered
+	}
+	return nil
+}
+
+// verifyPayloadTag - check stored data encrypted with sessionKey against the
+// tag served with it
+func verifyPayloadTag(sessionKey, data, tag []byte) error {
+	mac := newPayloadMAC(sessionKey)
+	mac.Write(data)
+	return checkPayloadTag(mac, tag)
+}
+
+// sealPayload - encrypt plaintext with sessionKey in the configured mode,
+// returning the data to store.  Every payload is encrypted with a fresh iv
+// or nonce.
+func sealPayload(sessionKey, plaintext []byte) ([]byte, error) {
+	if encryption == gcmEncryption {
+		ciphertext, nonce, err := crypto.EncryptGCM(sessionKey, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		data := append(append([]byte{}, gcmPayloadMagic...), nonce...)
+		return append(data, ciphertext...), nil
+	}
+	ciphertext, iv, err := encryptUpdate(sessionKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(iv, ciphertext...), nil
+}
+
+// sealPayloadStream - encrypt plaintext with sessionKey in the stream mode as
+// it is read, the returned reader yields the data to store
+func sealPayloadStream(sessionKey []byte, plaintext io.Reader) (io.Reader, error) {
+	ciphertext, err := crypto.NewEncryptingReader(sessionKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(streamPayloadMagic), ciphertext), nil
+}
+
+// openPayloadStream - decrypt stored data produced by sealPayloadStream as
+// it is read
+func openPayloadStream(sessionKey []byte, data io.Reader) (io.Reader, error) {
+	var magic = make([]byte, len(streamPayloadMagic))
+	if _, err := io.ReadFull(data, magic); err != nil || !bytes.Equal(magic, streamPayloadMagic) {
+		return nil, errors.New("stored data is not stream encrypted")
+	}
+	return crypto.NewDecryptingReader(sessionKey, data)
+}
+
+// payloadMode - the mode stored data was encrypted in, going by its prefix,
+// which only the tag stored with the data authenticates
+func payloadMode(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, streamPayloadMagic):
+		return streamEncryption
+	case bytes.HasPrefix(data, gcmPayloadMagic):
+		return gcmEncryption
+	}
+	return cbcEncryption
+}
+
+// checkPayloadMode - refuse stored data which has no tag, so nothing
+// authenticates the mode its prefix claims, unless it is in the configured
+// mode, or in cbc, which sealPayload stores small payloads in when files are
+// stream encrypted.  Data with a tag, once checked against it, is in
+// whichever mode it was stored with.
+func checkPayloadMode(data, tag []byte) error {
+	if len(tag) > 0 {
+		return nil
+	}
+	mode := payloadMode(data)
+	if mode == encryption || (encryption == streamEncryption && mode == cbcEncryption) {
+		return nil
+	}
+	return errors.Errorf("stored data has no integrity tag and is %s encrypted, not %s", mode, encryption)
+}
+
+// openPayload - decrypt stored data produced by sealPayload or
+// sealPayloadStream, which has been checked against tag, the tag stored with
+// it.  Tagged data decrypts in any mode, so files stored before a mode was
+// enabled still decrypt, and data without a tag only in the configured mode.
+func openPayload(sessionKey, data, tag []byte) ([]byte, error) {
+	if err := checkPayloadMode(data, tag); err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, streamPayloadMagic) {
+		plaintext, err := openPayloadStream(sessionKey, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(plaintext)
+	}
+	if bytes.HasPrefix(data, gcmPayloadMagic) {
+		data = data[len(gcmPayloadMagic):]
+		if len(data) < gcmNonceSize {
+			return nil, errors.New("stored data is too short")
+		}
+		return crypto.DecryptGCM(sessionKey, data[gcmNonceSize:], data[:gcmNonceSize])
+	}
+	if len(data) < aes.BlockSize {
+		return nil, errors.New("stored data is too short")
+	}
+	plaintext, err := crypto.Decrypt(sessionKey, data[aes.BlockSize:], data[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+	if plaintext == nil {
+		return nil, errors.New("invalid padding")
+	}
+	return plaintext, nil
+}
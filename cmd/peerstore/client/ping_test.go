@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestPing(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tr.Ping(ctx); err != nil {
+		t.Errorf("expected a ping of a live node to succeed, got %v", err)
+	}
+	tr.Close()
+
+	// a node which accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	tr, err = createTransport(id, models.Node{Addr: l.Addr().String(), PublicKey: n.peer.PublicKey}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tr.Ping(ctx); err == nil {
+		t.Error("expected a ping of a node which does not answer to fail")
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the ping to give up after its timeout, took %s", elapsed)
+	}
+	tr.Close()
+
+	// nothing listening at all
+	dead := l.Addr().String()
+	l.Close()
+	if tr, err := createTransport(id, models.Node{Addr: dead, PublicKey: n.peer.PublicKey}, privateKey); err == nil {
+		if err := tr.Ping(ctx); err == nil {
+			t.Error("expected a ping of a dead address to fail")
+		}
+		tr.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestPlacedKeysRouteToTheirNodes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	r := startTestRing(t, 3, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer r.stop()
+	c := r.newClient(t)
+
+	// a key at a node's own id is stored by that node, neither is the node
+	// the client makes its requests through
+	placement := map[string]*testNode{
+		"first.txt":  r.nodes[1],
+		"second.txt": r.nodes[2],
+	}
+	models.ConfigureResourceKeys(func(name string, secret []byte) models.Identifier {
+		if n, ok := placement[name]; ok {
+			return n.peer.ID
+		}
+		return models.HashBytes([]byte(name))
+	})
+	defer models.ConfigureResourceKeys(nil)
+
+	root, err := ioutil.TempDir("", "placement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for name := range placement {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte("placed "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(c.id, root, filepath.Join(root, name), c.peer, c.privateKey, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr, err := createTransport(c.id, c.peer, c.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	for name, want := range placement {
+		key := fileToKeyIdentifier(name)
+		if key != want.peer.ID {
+			t.Fatalf("%s placed at %s, expected %s", name, key, want.peer.ID)
+		}
+		node, err := getNode(key, c.id, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.ID != want.peer.ID {
+			t.Errorf("%s routed to %s, expected %s", name, node.Addr, want.peer.Addr)
+		}
+		for _, n := range r.nodes {
+			if stored := findStored(n.dataPath, key) != ""; stored != (n == want) {
+				t.Errorf("%s stored on %s: %t", name, n.peer.Addr, stored)
+			}
+		}
+
+		dest := filepath.Join(root, name+".got")
+		if err := getFileToPath(c.id, key, 0, c.peer, c.privateKey, dest); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ioutil.ReadFile(dest); err != nil || string(got) != "placed "+name {
+			t.Errorf("got %q for %s, %v", got, name, err)
+		}
+	}
+}
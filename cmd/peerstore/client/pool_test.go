@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/node"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// testNode - a standalone node reached over tcp
+type testNode struct {
+	*node.Node
+	// peer - how clients and other nodes reach the node
+	peer       models.Node
+	dataPath   string
+	quit, done chan bool
+}
+
+// startTestNode - start a node, joining the ring of peer unless it is the
+// zero value, stop it with stop
+func startTestNode(tb testing.TB, peer models.Node, settings models.RingSettings) *testNode {
+	dir, err := ioutil.TempDir("", "testnode")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	key, err := node.LoadOrCreateKey(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	n, err := node.Start(node.Config{
+		ListenAddr:         addr,
+		DataPath:           dir,
+		Peer:               peer,
+		RequestQueueBuffer: uint(runtime.NumCPU() * 20),
+		RequestNumWorkers:  16,
+		RingSettings:       settings,
+	}, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tn := &testNode{
+		Node: n,
+		peer: models.Node{
+			ID:        models.HashBytes([]byte(addr)),
+			Addr:      addr,
+			PublicKey: key.Public().(*rsa.PublicKey),
+		},
+		dataPath: dir,
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+	go n.Serve(tn.quit, tn.done)
+	return tn
+}
+
+// stop - stop the node and remove its data
+func (tn *testNode) stop() {
+	tn.quit <- true
+	<-tn.done
+	os.RemoveAll(tn.dataPath)
+}
+
+// stabilizeTestRing - join the nodes into a ring now, rather than waiting
+// for them to stabilize in the background
+func stabilizeTestRing(tb testing.TB, nodes []*testNode) {
+	for round := 0; round < 3; round++ {
+		for _, n := range nodes {
+			n.Local.Stabilize()
+		}
+	}
+	for round := 0; round < 2; round++ {
+		for _, n := range nodes {
+			if err := n.Local.UpdateSuccessorList(); err != nil {
+				tb.Fatal(err)
+			}
+			if err := n.Local.FixFingers(); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// registerTestUser - generate a user and register it with the ring of peer
+func registerTestUser(tb testing.TB, peer models.Node) (models.Identifier, *rsa.PrivateKey) {
+	privateKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	kb, _ := crypto.GobEncodePublicKey(privateKey.Public().(*rsa.PublicKey))
+	id := models.HashBytes(kb)
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = t.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:   id,
+			Type:   protocol.UserType,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.UserRegistrationMethod,
+	})
+	t.Close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return id, privateKey
+}
+
+// testResourceName - the resource name of the file at path under root
+func testResourceName(tb testing.TB, root, path string) string {
+	name, err := resourceName(root, path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return name
+}
+
+// benchmarkBackup - back up 500 small files with the transport pool
+// configured with config
+func benchmarkBackup(b *testing.B, config protocol.PoolConfig) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	n := startTestNode(b, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	// idle connections hold workers of the node, so are closed before it is
+	// stopped
+	protocol.ConfigurePool(config)
+	defer protocol.ConfigurePool(protocol.PoolConfig{})
+
+	root, err := ioutil.TempDir("", "poolbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	var paths []string
+	for i := 0; i < 500; i++ {
+		path := filepath.Join(root, fmt.Sprintf("%d.txt", i))
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			b.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	id, privateKey := registerTestUser(b, n.peer)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkBackupUnpooled(b *testing.B) {
+	benchmarkBackup(b, protocol.PoolConfig{})
+}
+
+func BenchmarkBackupPooled(b *testing.B) {
+	benchmarkBackup(b, protocol.DefaultPoolConfig)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// progressInterval - how often the progress of a transfer is logged
+const progressInterval = 2 * time.Second
+
+// transferProgress - how far the transfer of a file of total bytes has got,
+// which is logged every progressInterval while it runs.  The bytes counted
+// are those going over the connections, so include a little overhead on top
+// of the file itself.
+type transferProgress struct {
+	what   string
+	total  uint64
+	done   uint64
+	logged time.Time
+	mu     *sync.Mutex
+}
+
+// newTransferProgress - the progress of what, a transfer of total bytes,
+// done of which are already transferred
+func newTransferProgress(what string, total, done uint64) *transferProgress {
+	return &transferProgress{
+		what:   what,
+		total:  total,
+		done:   done,
+		logged: time.Now(),
+		mu:     new(sync.Mutex),
+	}
+}
+
+// add - count n more bytes transferred
+func (p *transferProgress) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += uint64(n)
+	if time.Since(p.logged) < progressInterval {
+		return
+	}
+	p.logged = time.Now()
+	if p.total == 0 {
+		log.Printf("%s: %d bytes", p.what, p.done)
+		return
+	}
+	percent := p.done * 100 / p.total
+	if percent > 100 {
+		percent = 100
+	}
+	log.Printf("%s: %d%% of %d bytes", p.what, percent, p.total)
+}
+
+// sent - a protocol.Progress counting the bytes sent
+func (p *transferProgress) sent(sent, _ int) {
+	if sent > 0 {
+		p.add(sent)
+	}
+}
+
+// received - a protocol.Progress counting the bytes received
+func (p *transferProgress) received(_, received int) {
+	if received > 0 {
+		p.add(received)
+	}
+}
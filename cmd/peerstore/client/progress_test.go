@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestTransportProgress(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	data := bytes.Repeat([]byte{0x3c}, 1<<20)
+	// the encryption and encoding of a message add this much at most
+	const overhead = 4 << 10
+	for _, c := range []struct {
+		method protocol.RequestMethod
+		data   []byte
+	}{
+		{protocol.PostFileMethod, data},
+		{protocol.GetFileMethod, nil},
+	} {
+		tr, err := createTransport(id, n.peer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent, received []int
+		total := func(counts []int) int {
+			if len(counts) == 0 {
+				return 0
+			}
+			return counts[len(counts)-1]
+		}
+		tr.SetProgress(func(s, r int) {
+			if s < 0 || r < 0 || s+r == 0 {
+				t.Errorf("progress reported %d sent and %d received", s, r)
+			}
+			if s > 0 {
+				sent = append(sent, total(sent)+s)
+			}
+			if r > 0 {
+				received = append(received, total(received)+r)
+			}
+		})
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:          fileToKeyIdentifier("progress.bin"),
+				Type:         protocol.UserType,
+				From:         id,
+				PubKey:       privateKey.Public().(*rsa.PublicKey),
+				ResourceName: "progress.bin",
+				Secret:       make([]byte, 256),
+				DataLength:   uint64(len(c.data)),
+			},
+			Method: c.method,
+			Data:   c.data,
+		})
+		tr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != protocol.Success {
+			t.Fatalf("%s failed: %v", protocol.RequestMethodToString[c.method], resp.Err())
+		}
+
+		name := protocol.RequestMethodToString[c.method]
+		// the counts only grow, and add up to the payload and a little
+		// more, for the way it was sent
+		moved := sent
+		if c.method == protocol.GetFileMethod {
+			moved = received
+		}
+		for i := 1; i < len(moved); i++ {
+			if moved[i] <= moved[i-1] {
+				t.Errorf("%s: progress went from %d to %d bytes", name, moved[i-1], moved[i])
+			}
+		}
+		if got := total(moved); got < len(data) || got > len(data)+overhead {
+			t.Errorf("%s: expected progress to add up to about %d bytes, got %d", name, len(data), got)
+		}
+		if len(moved) < 2 {
+			t.Errorf("%s: expected a megabyte reported as it went, reported %d times", name, len(moved))
+		}
+	}
+}
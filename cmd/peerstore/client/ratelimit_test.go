@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestRateLimit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	const limit = 64 << 10
+	data := bytes.Repeat([]byte{0x5a}, 3*limit)
+	request := func(method protocol.RequestMethod, data []byte) protocol.Response {
+		tr, err := createTransport(id, n.peer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:          fileToKeyIdentifier("limited.bin"),
+				Type:         protocol.UserType,
+				From:         id,
+				PubKey:       privateKey.Public().(*rsa.PublicKey),
+				ResourceName: "limited.bin",
+				Secret:       make([]byte, 256),
+				DataLength:   uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != protocol.Success {
+			t.Fatalf("%s failed: %v", protocol.RequestMethodToString[method], resp.Err())
+		}
+		return resp
+	}
+	// the payload is three seconds of data at the limit, less the burst
+	// allowed at the start, so it cannot take less than two
+	const least = 2 * time.Second
+
+	protocol.ConfigureRateLimit(protocol.RateLimitConfig{MaxUploadBps: limit})
+	start := time.Now()
+	request(protocol.PostFileMethod, data)
+	if elapsed := time.Since(start); elapsed < least {
+		t.Errorf("expected a post of %d bytes at %d bytes a second to take at least %s, took %s",
+			len(data), limit, least, elapsed)
+	}
+
+	// only uploads were limited, so the download is quick
+	start = time.Now()
+	request(protocol.GetFileMethod, nil)
+	if elapsed := time.Since(start); elapsed >= least {
+		t.Errorf("expected a get without a download limit to be quick, took %s", elapsed)
+	}
+
+	protocol.ConfigureRateLimit(protocol.RateLimitConfig{MaxDownloadBps: limit})
+	defer protocol.ConfigureRateLimit(protocol.RateLimitConfig{})
+	start = time.Now()
+	if resp := request(protocol.GetFileMethod, nil); !bytes.Equal(resp.Data, data) {
+		t.Fatal("expected the limited get to return the posted data")
+	}
+	if elapsed := time.Since(start); elapsed < least {
+		t.Errorf("expected a get of %d bytes at %d bytes a second to take at least %s, took %s",
+			len(data), limit, least, elapsed)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestReady(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	}
+	first := startTestNode(t, models.Node{}, settings)
+	defer first.stop()
+	id, privateKey := registerTestUser(t, first.peer)
+
+	ready := func(n *testNode) error {
+		tr, err := createTransport(id, n.peer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return tr.Ready(ctx)
+	}
+
+	// alone on the ring, and writable
+	if err := ready(first); err != nil {
+		t.Errorf("expected a lone node to be ready, got %v", err)
+	}
+
+	// joined, but its predecessor has not stabilized with it yet
+	second := startTestNode(t, first.peer, settings)
+	defer second.stop()
+	if err := ready(second); err == nil {
+		t.Error("expected a node mid join not to be ready")
+	}
+	stabilizeTestRing(t, []*testNode{first, second})
+	if err := ready(second); err != nil {
+		t.Errorf("expected a node of a stabilized ring to be ready, got %v", err)
+	}
+
+	// a data path made read only
+	if err := os.Chmod(first.dataPath, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(first.dataPath, 0700)
+	if err := ready(first); err == nil {
+		t.Error("expected a node with a read only data path not to be ready")
+	}
+	os.Chmod(first.dataPath, 0700)
+	if err := ready(first); err != nil {
+		t.Errorf("expected the node ready once its data path is writable again, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestRebalanceNeedsAdmin(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	_, err := rebalanceNode(id, n.peer, privateKey)
+	if re, ok := err.(*protocol.ResponseError); !ok || re.Code != protocol.UnauthorizedCode {
+		t.Fatalf("expected a rebalance by a user who is not an admin refused, got %v", err)
+	}
+
+	n.Server.WithValue(models.AdminsContextKey, []models.Identifier{id})
+	if _, err := rebalanceNode(id, n.peer, privateKey); err != nil {
+		t.Errorf("expected a rebalance by an admin, got %v", err)
+	}
+}
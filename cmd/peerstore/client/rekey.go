@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io"
+	"log"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// getOwners - the owners of the resource key, from the node holding it on t
+func getOwners(key, id models.Identifier, privateKey *rsa.PrivateKey, t *protocol.Transport) ([]models.Owner, error) {
+	resp, err := retryRoundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Key:    key,
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.GetOwnersMethod,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return nil, errors.Wrap(resp.Err(), "failed to get owners")
+	}
+	var owners models.OwnersResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&owners); err != nil {
+		return nil, errors.Wrap(err, "failed to decode owners")
+	}
+	return owners.Owners, nil
+}
+
+// getPublicKey - the public key the user userID registered with the ring.
+// The key is checked to give userID, so a node cannot hand out a key of its
+// own for a secret to be encrypted with.
+func getPublicKey(userID, id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) (*rsa.PublicKey, error) {
+	node, err := findNode(userID, id, peer, privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find the node holding the key")
+	}
+	t, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	resp, err := retryRoundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Key:  userID,
+			Type: protocol.UserType,
+			From: id,
+		},
+		Method: protocol.GetPublicKeyMethod,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return nil, errors.Wrapf(resp.Err(), "failed to get the public key of %s", userID)
+	}
+	pub, err := crypto.ReadPublicKeyAsPem(bytes.NewReader(resp.Data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the public key of %s", userID)
+	}
+	gobKey, err := crypto.GobEncodePublicKey(&pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode public key")
+	}
+	if models.HashBytes(gobKey) != userID {
+		return nil, errors.Errorf("the public key served for %s is not theirs", userID)
+	}
+	return &pub, nil
+}
+
+// rekeyFile - encrypt the resource filename with a new session key, and post
+// it with the new key encrypted for each of its current owners, so a session
+// key which leaked no longer reads it.  Every owner keeps the access they
+// have.  Archived versions stay encrypted with the key they were stored with.
+func rekeyFile(id models.Identifier, filename string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	name, err := models.NormalizeResourceName(filename)
+	if err != nil {
+		return err
+	}
+	key := fileToKeyIdentifier(name)
+
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	node, st, err := connectWriteNode(key, id, t, privateKey)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	resp, err := getKey(key, id, st)
+	if err != nil {
+		lookups.invalidate(node)
+		return errors.Wrap(err, "failed to get file")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrapf(resp.Err(), "failed to get %s", name)
+	}
+	oldKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt session key")
+	}
+	if err := verifyPayloadTag(oldKey, resp.Data, resp.Header.Tag); err != nil {
+		return errors.Wrapf(err, "refusing to rekey %s", name)
+	}
+	plaintext, err := openPayload(oldKey, resp.Data, resp.Header.Tag)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt payload")
+	}
+
+	owners, err := getOwners(key, id, privateKey, st)
+	if err != nil {
+		return err
+	}
+	var (
+		others []models.Owner
+		keys   []*rsa.PublicKey
+	)
+	for _, owner := range owners {
+		if owner.ID == id {
+			continue
+		}
+		pub, err := getPublicKey(owner.ID, id, peer, privateKey)
+		if err != nil {
+			return err
+		}
+		others, keys = append(others, owner), append(keys, pub)
+	}
+
+	sessionKey, secret, err := crypto.GenerateSessionKey(privateKey.Public().(*rsa.PublicKey))
+	if err != nil {
+		return errors.Wrap(err, "failed to generate session key")
+	}
+	secrets, err := crypto.WrapSessionKey(sessionKey, keys)
+	if err != nil {
+		return err
+	}
+	shared := make([]protocol.SharedSecret, 0, len(others))
+	for i, owner := range others {
+		shared = append(shared, protocol.SharedSecret{
+			ID:       owner.ID,
+			Secret:   secrets[i],
+			ReadOnly: owner.ReadOnly,
+		})
+	}
+
+	var payload io.Reader
+	if encryption == streamEncryption {
+		if payload, err = sealPayloadStream(sessionKey, bytes.NewReader(plaintext)); err != nil {
+			return errors.Wrap(err, "failed to encrypt payload")
+		}
+	} else {
+		ciphertext, err := sealPayload(sessionKey, plaintext)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt payload")
+		}
+		payload = bytes.NewReader(ciphertext)
+	}
+	// posted whole, so the resource is never left partly under each key
+	postResp, err := postPayload(st, protocol.Header{
+		Key:          key,
+		Type:         protocol.UserType,
+		From:         id,
+		PubKey:       privateKey.Public().(*rsa.PublicKey),
+		ResourceName: name,
+		Log:          true,
+		Secret:       secret,
+		SharedWith:   shared,
+		Rekey:        true,
+	}, sessionKey, payload, false)
+	if err != nil {
+		lookups.invalidate(node)
+		return errors.Wrap(err, "failed to post file")
+	}
+	if postResp.Status != protocol.Success {
+		return errors.Wrapf(postResp.Err(), "rekey of %s was rejected", name)
+	}
+	if _, err := models.IncrementClock(postResp.Header.Clock); err != nil {
+		return errors.Wrap(err, "failed to advance the clock")
+	}
+	log.Printf("rekeyed %s for %d owners", name, len(owners))
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// getTestFile - the stored resource key as the user id gets it from peer,
+// and the session key its secret decrypts to
+func getTestFile(t *testing.T, key, id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) (protocol.Response, []byte) {
+	t.Helper()
+	tr, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	resp, err := getKey(key, id, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != protocol.Success {
+		t.Fatalf("get failed: %v", resp.Err())
+	}
+	sessionKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
+	if err != nil {
+		t.Fatalf("the secret does not decrypt: %v", err)
+	}
+	return resp, sessionKey
+}
+
+func TestRekeyFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+	friendID, friendKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	plaintext := []byte("a file whose key leaked")
+	if err := ioutil.WriteFile(filepath.Join(root, "leaked.txt"), plaintext, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, filepath.Join(root, "leaked.txt"), n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := fileToKeyIdentifier("leaked.txt")
+
+	// share it read-only with the friend, as the share operation does
+	stored, oldKey := getTestFile(t, key, id, n.peer, privateKey)
+	friendSecret, err := crypto.EncryptRSA(&friendKey.PublicKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	resp, err := tr.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			Key:        key,
+			Type:       protocol.UserType,
+			From:       id,
+			PubKey:     &privateKey.PublicKey,
+			DataLength: uint64(len(stored.Data)),
+			Secret:     stored.Header.Secret,
+			SharedWith: []protocol.SharedSecret{{ID: friendID, Secret: friendSecret, ReadOnly: true}},
+			Tag:        stored.Header.Tag,
+		},
+		Method: protocol.PostFileMethod,
+		Data:   stored.Data,
+	})
+	if err != nil || resp.Status != protocol.Success {
+		t.Fatalf("share failed: %v, %v", err, resp.Err())
+	}
+
+	if err := rekeyFile(id, "leaked.txt", n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	rekeyed, newKey := getTestFile(t, key, id, n.peer, privateKey)
+	if bytes.Equal(newKey, oldKey) {
+		t.Fatal("expected a new session key")
+	}
+	if err := verifyPayloadTag(newKey, rekeyed.Data, rekeyed.Header.Tag); err != nil {
+		t.Errorf("the stored tag does not match the new key: %v", err)
+	}
+	if got, err := openPayload(newKey, append([]byte(nil), rekeyed.Data...), rekeyed.Header.Tag); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("the new key does not decrypt the stored file: %q, %v", got, err)
+	}
+	if got, err := openPayload(oldKey, append([]byte(nil), rekeyed.Data...), rekeyed.Header.Tag); err == nil && bytes.Equal(got, plaintext) {
+		t.Error("the old session key still decrypts the stored file")
+	}
+
+	// the friend has a new secret for the new key, and is still read-only
+	shared, friendNewKey := getTestFile(t, key, friendID, n.peer, friendKey)
+	if bytes.Equal(shared.Header.Secret, friendSecret) || !bytes.Equal(friendNewKey, newKey) {
+		t.Error("expected the friend given a secret for the new session key")
+	}
+	owners, err := getOwners(key, id, privateKey, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.Owner{{ID: id}, {ID: friendID, ReadOnly: true}}
+	if len(owners) != len(want) || owners[0] != want[0] || owners[1] != want[1] {
+		t.Errorf("owners after the rekey = %+v, expected %+v", owners, want)
+	}
+	if err := rekeyFile(friendID, "leaked.txt", n.peer, friendKey); err == nil {
+		t.Error("expected a read-only owner unable to rekey")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// recordingProxy - forward a single connection to addr, recording what the
+// client sends, which is complete once done is closed
+func recordingProxy(t *testing.T, addr string) (proxyAddr string, recorded *bytes.Buffer, done chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, done = new(bytes.Buffer), make(chan struct{})
+	go func() {
+		defer close(done)
+		defer l.Close()
+		client, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		server, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		go io.Copy(client, server)
+		io.Copy(server, io.TeeReader(client, recorded))
+	}()
+	return l.Addr().String(), recorded, done
+}
+
+// replay - send the recorded bytes of a request to addr as they are, and
+// decode the response with privateKey
+func replay(t *testing.T, addr string, recorded []byte, privateKey *rsa.PrivateKey) protocol.Response {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(recorded); err != nil {
+		t.Fatal(err)
+	}
+	// the response is framed by its big endian length
+	var length [8]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatalf("no response to the replayed request: %v", err)
+	}
+	var em protocol.EncryptedMessage
+	if err := gob.NewDecoder(io.LimitReader(conn, int64(binary.BigEndian.Uint64(length[:])))).Decode(&em); err != nil {
+		t.Fatalf("no response to the replayed request: %v", err)
+	}
+	sessionKey, err := crypto.DecryptRSA(privateKey, em.SessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := crypto.Decrypt(sessionKey, em.CipherText, em.IV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.Response
+	if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestReplayedRequestRejected(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	key := fileToKeyIdentifier("replay.txt")
+	request := func(addr string, method protocol.RequestMethod, data []byte) protocol.Response {
+		tr, err := createTransport(id, models.Node{Addr: addr, PublicKey: n.peer.PublicKey}, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:          key,
+				Type:         protocol.UserType,
+				From:         id,
+				PubKey:       privateKey.Public().(*rsa.PublicKey),
+				ResourceName: "replay.txt",
+				Secret:       make([]byte, 256),
+				DataLength:   uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	data := []byte("do not delete me twice")
+	if resp := request(n.peer.Addr, protocol.PostFileMethod, data); resp.Status != protocol.Success {
+		t.Fatalf("post failed: %v", resp.Err())
+	}
+
+	// a delete, captured on its way to the node
+	proxyAddr, recorded, done := recordingProxy(t, n.peer.Addr)
+	if resp := request(proxyAddr, protocol.DeleteFileMethod, nil); resp.Status != protocol.Success {
+		t.Fatalf("delete failed: %v", resp.Err())
+	}
+	<-done
+
+	// distinct requests, alike but for their nonces, pass
+	if resp := request(n.peer.Addr, protocol.PostFileMethod, data); resp.Status != protocol.Success {
+		t.Fatalf("second post failed: %v", resp.Err())
+	}
+
+	resp := replay(t, n.peer.Addr, recorded.Bytes(), privateKey)
+	if resp.Status == protocol.Success || resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected the replayed delete refused as unauthorized, got %v", resp.Err())
+	}
+	if resp := request(n.peer.Addr, protocol.GetFileMethod, nil); resp.Status != protocol.Success {
+		t.Errorf("expected the file posted again to survive the replay, got %v", resp.Err())
+	}
+	if resp := request(n.peer.Addr, protocol.DeleteFileMethod, nil); resp.Status != protocol.Success {
+		t.Errorf("expected a new delete to pass, got %v", resp.Err())
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestGetFileFromReplica(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 2, ReplicationFactor: 2}
+	first := startTestNode(t, models.Node{}, settings)
+	nodes := []*testNode{first}
+	for i := 0; i < 2; i++ {
+		nodes = append(nodes, startTestNode(t, first.peer, settings))
+	}
+	running := make(map[*testNode]bool)
+	for _, n := range nodes {
+		running[n] = true
+	}
+	defer func() {
+		for n := range running {
+			n.stop()
+		}
+	}()
+	positions := make(map[uint64]bool)
+	for _, n := range nodes {
+		positions[models.KeyToID(n.peer.ID)] = true
+	}
+	if len(positions) != len(nodes) {
+		t.Skip("nodes landed on the same ring position")
+	}
+
+	stabilizeTestRing(t, nodes)
+
+	id, privateKey := registerTestUser(t, first.peer)
+
+	// back up a file which the first node, which the client talks to, is
+	// not responsible for
+	root, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	var (
+		path  string
+		key   models.Identifier
+		owner models.Node
+	)
+	for i := 0; ; i++ {
+		path = filepath.Join(root, fmt.Sprintf("%d.txt", i))
+		key = fileToKeyIdentifier(testResourceName(t, root, path))
+		if owner, err = first.Local.Successor(key); err != nil {
+			t.Fatal(err)
+		}
+		if !owner.ID.Equal(first.peer.ID) {
+			break
+		}
+	}
+	contents := []byte("replicated contents")
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, path, first.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var primary, replica *testNode
+	for _, n := range nodes {
+		if n.peer.ID.Equal(owner.ID) {
+			primary = n
+		}
+	}
+	replicas := primary.Local.Replicas()
+	if len(replicas) != 1 {
+		t.Fatalf("expected 1 replica, got %d", len(replicas))
+	}
+	for _, n := range nodes {
+		if n.peer.ID.Equal(replicas[0].ID) {
+			replica = n
+		}
+	}
+	// replicas are copied in the background
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join(replica.dataPath, key.String())); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resource was not replicated")
+		}
+	}
+
+	primary.stop()
+	delete(running, primary)
+	// the node before the primary replaces it with the replica as it stabilizes
+	for n := range running {
+		n.Local.Stabilize()
+	}
+
+	dest := filepath.Join(root, "restored")
+	if err := getFileToPath(id, key, 0, first.peer, privateKey, dest); err != nil {
+		t.Fatalf("get with the primary down failed: %v", err)
+	}
+	restored, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, contents) {
+		t.Errorf("restored %q, expected %q", restored, contents)
+	}
+}
+
+func TestNewReplicaGetsCopies(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 2, ReplicationFactor: 2}
+	first := startTestNode(t, models.Node{}, settings)
+	nodes := []*testNode{first}
+	for i := 0; i < 2; i++ {
+		nodes = append(nodes, startTestNode(t, first.peer, settings))
+	}
+	running := make(map[*testNode]bool)
+	for _, n := range nodes {
+		running[n] = true
+	}
+	defer func() {
+		for n := range running {
+			n.stop()
+		}
+	}()
+	positions := make(map[uint64]bool)
+	for _, n := range nodes {
+		positions[models.KeyToID(n.peer.ID)] = true
+	}
+	if len(positions) != len(nodes) {
+		t.Skip("nodes landed on the same ring position")
+	}
+
+	stabilizeTestRing(t, nodes)
+
+	id, privateKey := registerTestUser(t, first.peer)
+	root, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "file.txt")
+	if err := ioutil.WriteFile(path, []byte("replicated contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, path, first.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := fileToKeyIdentifier(testResourceName(t, root, path))
+	owner, err := first.Local.Successor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var primary, replica, other *testNode
+	for _, n := range nodes {
+		if n.peer.ID.Equal(owner.ID) {
+			primary = n
+		}
+	}
+	replicas := primary.Local.Replicas()
+	if len(replicas) != 1 {
+		t.Fatalf("expected 1 replica, got %d", len(replicas))
+	}
+	for _, n := range nodes {
+		if n.peer.ID.Equal(replicas[0].ID) {
+			replica = n
+		} else if n != primary {
+			other = n
+		}
+	}
+	stored := func(n *testNode) bool {
+		_, err := os.Stat(filepath.Join(n.dataPath, key.String()))
+		return err == nil
+	}
+	waitStored := func(n *testNode) {
+		for deadline := time.Now().Add(10 * time.Second); !stored(n); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("resource was not replicated")
+			}
+		}
+	}
+	waitStored(replica)
+	if stored(other) {
+		t.Fatal("expected the resource on its primary and replica only")
+	}
+
+	// the replica fails, so the next node of the primary's successor list
+	// becomes its replica, and is sent what the primary is responsible for
+	replica.stop()
+	delete(running, replica)
+	primary.Local.Stabilize()
+	if err := primary.Local.UpdateSuccessorList(); err != nil {
+		t.Fatal(err)
+	}
+	waitStored(other)
+}
+
+func TestReplicationRetriesFailedCopies(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	settings := models.RingSettings{SuccessorListLength: 2, ReplicationFactor: 2}
+	first := startTestNode(t, models.Node{}, settings)
+	defer first.stop()
+	second := startTestNode(t, first.peer, settings)
+	defer second.stop()
+	nodes := []*testNode{first, second}
+	stabilizeTestRing(t, nodes)
+	for _, n := range nodes {
+		if err := n.Local.UpdateSuccessorList(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, privateKey := registerTestUser(t, first.peer)
+	root, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "file.txt")
+	if err := ioutil.WriteFile(path, []byte("replicated contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, path, first.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := fileToKeyIdentifier(testResourceName(t, root, path))
+	primary, replica := first, second
+	if findStored(primary.dataPath, key) == "" {
+		primary, replica = second, first
+	}
+	waitStored := func() {
+		for deadline := time.Now().Add(10 * time.Second); findStored(replica.dataPath, key) == ""; time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("resource was not replicated")
+			}
+		}
+	}
+	waitStored()
+
+	// a draining replica refuses the copy, which is made once it takes
+	// copies again
+	if err := os.Remove(findStored(replica.dataPath, key)); err != nil {
+		t.Fatal(err)
+	}
+	replica.Server.SetDraining(true)
+	primary.Local.Replicate(primary.dataPath, key)
+	time.Sleep(200 * time.Millisecond)
+	if findStored(replica.dataPath, key) != "" {
+		t.Fatal("draining replica took the copy")
+	}
+	replica.Server.SetDraining(false)
+	waitStored()
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// backupTree - back up every file and directory under root which is not
+// excluded, and record them in the transaction log so they can be restored.
+// Symbolic links are recorded with their targets, not followed.
+// When the backup is atomic nothing is recorded unless every file was posted,
+// otherwise the files which were posted are recorded.  Files unchanged since
+// the last backup, as its manifest records, are not posted again.  Files
+// which cannot be read, such as one deleted while the backup runs, are
+// logged and skipped, unless the backup is atomic, which they fail.
+func backupTree(id models.Identifier, root string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	var (
+		txn      = newStagedTransaction()
+		manifest = loadManifest(root)
+		skipped  int
+	)
+	rules, err := loadIgnoreRules(root, excludes)
+	if err != nil {
+		return err
+	}
+
+	var walkFn = func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == root || atomicBackup {
+				return err
+			}
+			log.Printf("skipping %s, it could not be read: %s", path, err)
+			skipped++
+			return nil
+		}
+		name, err := resourceName(root, path)
+		if err != nil {
+			return err
+		}
+		if rules.excluded(name, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isSymlink(fi) {
+			// recorded as a link, never followed
+			entry, err := symlinkEntry(path)
+			if err != nil {
+				return err
+			}
+			entry.ClientID, entry.Timestamp = deviceID, models.GetClock()
+			txn.stage(name, fileToKeyIdentifier(name), entry)
+			return nil
+		}
+		if fi.IsDir() {
+			// recorded so empty directories are recreated on restore
+			if name != "" {
+				txn.stage(name, fileToKeyIdentifier(name), models.TransactionEntry{
+					Operation: models.DirectoryOperation,
+					ClientID:  deviceID,
+					Timestamp: models.GetClock(),
+				})
+			}
+			return nil
+		}
+		if err := backupFile(id, root, path, peer, privateKey, txn, manifest); err != nil {
+			if isUnreadable(err) && !atomicBackup {
+				log.Printf("skipping %s, it could not be read: %s", name, err)
+				skipped++
+				return nil
+			}
+			// an atomic backup has to reach the peer for every file
+			if offline == nil || atomicBackup || !isUnreachable(err) {
+				return err
+			}
+			return offline.enqueue(pendingOperation{
+				Kind:      backupPending,
+				Path:      path,
+				LocalPath: root,
+			})
+		}
+		return nil
+	}
+
+	// Open up directory
+	// read each file, and send to peerAddr
+	err = filepath.Walk(root, walkFn)
+	if skipped > 0 {
+		log.Printf("skipped %d files which could not be read", skipped)
+	}
+	if err != nil && atomicBackup {
+		txn.fail(err)
+	}
+	if err := txn.commit(id, peer, privateKey); err != nil {
+		return err
+	}
+	return errors.Wrap(err, "backup stopped")
+}
+
+// unreadableError - the error opening or reading a local file to back up,
+// as opposed to any other local file backing it up touches
+type unreadableError struct {
+	error
+}
+
+// isUnreadable - did err come of reading a local file, rather than of
+// storing it
+func isUnreadable(err error) bool {
+	_, ok := errors.Cause(err).(unreadableError)
+	return ok
+}
+
+// restoreTree - fetch every resource in the transaction log which was not
+// deleted to its path under root, recreating directories and symbolic
+// links.  Each resource is fetched at the version its latest change
+// recorded, the newest of them if the resource was changed concurrently, and
+// given the modification time the change recorded.  Small files stored on the
+// same node are fetched together in batches.  With since set only the
+// resources changed since root was last restored are restored, and files
+// deleted since are removed from root, to catch up a tree restored before.
+func restoreTree(id models.Identifier, root string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	tl, err := GetTransactionLog(id, peer, privateKey.Public().(*rsa.PublicKey), privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to get transaction log")
+	}
+	tl = migrateLegacyNames(tl)
+
+	var (
+		restored, unchanged, failed int
+		files                       []restoreFile
+		manifest                    = loadRestoreManifest(root)
+	)
+	for name, entity := range tl {
+		if len(entity.Entries) == 0 {
+			continue
+		}
+		if normalized, err := models.NormalizeResourceName(name); err != nil || normalized != name {
+			// never written to, it would land outside of root
+			log.Printf("skipping %q, it is not a valid resource name", name)
+			failed++
+			continue
+		}
+		latest := newestChange(entity.Latest())
+		if since > 0 && !manifest.changed(name, latest) {
+			manifest.record(name, latest)
+			unchanged++
+			continue
+		}
+		dest := filepath.Join(root, filepath.FromSlash(name))
+		switch latest.Operation {
+		case models.DeleteOperation:
+			deleted := since > 0 && manifest.restored(name)
+			manifest.record(name, latest)
+			if !deleted {
+				continue
+			}
+			// deleted after the tree was last restored
+			if err = os.Remove(dest); os.IsNotExist(err) {
+				continue
+			}
+		case models.DirectoryOperation:
+			err = os.MkdirAll(dest, 0700)
+		case models.SymlinkOperation:
+			err = restoreSymlink(dest, latest)
+		default:
+			// fetched after the loop, in batches from each node
+			files = append(files, restoreFile{name: name, dest: dest, entry: latest})
+			continue
+		}
+		if !handleError(errors.Wrapf(err, "failed to restore %s", name)) {
+			failed++
+			continue
+		}
+		manifest.record(name, latest)
+		restored++
+	}
+	r, f := restoreFiles(id, files, peer, privateKey, manifest)
+	restored, failed = restored+r, failed+f
+	if since > 0 {
+		log.Printf("%d resources unchanged since the last restore", unchanged)
+	}
+	log.Printf("restored %d resources to %s, up to clock %d", restored, root, lastChange(tl))
+	if err := manifest.save(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to restore %d resources", failed)
+	}
+	return nil
+}
+
+// restoredFile - the file at the root of a restored tree recording the
+// latest change restored of each resource, so a later restore with since
+// catches up on every change made after, whichever node stamped it
+const restoredFile = ".peerstorerestored"
+
+// restoreManifest - the latest change restored of each resource in a tree,
+// by resource name
+type restoreManifest struct {
+	path    string
+	entries map[string]models.TransactionEntry
+}
+
+// loadRestoreManifest - the changes restored into root, none if it was never
+// restored.  A manifest which cannot be read is started afresh, as if root
+// was restored before changes were recorded.
+func loadRestoreManifest(root string) *restoreManifest {
+	m := &restoreManifest{
+		path:    filepath.Join(root, restoredFile),
+		entries: make(map[string]models.TransactionEntry),
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m
+	}
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&m.entries)
+	}
+	if err != nil {
+		log.Printf("ignoring unreadable restore manifest %s: %s", m.path, err)
+		m.entries = make(map[string]models.TransactionEntry)
+	}
+	return m
+}
+
+// changed - check if latest, the latest change of the resource name, was not
+// restored yet.  A tree restored before changes were recorded can only
+// compare the clock latest was stamped with to since, which misses changes
+// stamped by a node whose clock was behind.
+func (m *restoreManifest) changed(name string, latest models.TransactionEntry) bool {
+	if len(m.entries) == 0 {
+		return latest.Timestamp > since
+	}
+	restored, ok := m.entries[name]
+	return !ok || !restored.Same(latest)
+}
+
+// restored - check if the resource name is in the tree, as of the last
+// restore
+func (m *restoreManifest) restored(name string) bool {
+	if len(m.entries) == 0 {
+		return true
+	}
+	restored, ok := m.entries[name]
+	return ok && restored.Operation != models.DeleteOperation
+}
+
+// record - record latest as the change of the resource name now restored
+func (m *restoreManifest) record(name string, latest models.TransactionEntry) {
+	if m != nil {
+		m.entries[name] = latest
+	}
+}
+
+func (m *restoreManifest) save() error {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m.entries); err != nil {
+		return errors.Wrap(err, "failed to encode restore manifest")
+	}
+	return errors.Wrap(writeFileAtomic(m.path, buf.Bytes()), "failed to write restore manifest")
+}
+
+// lastChange - the clock of the latest change in the transaction log
+func lastChange(tl models.TransactionLog) uint64 {
+	var last uint64
+	for _, entity := range tl {
+		for _, entry := range entity.Entries {
+			if entry.Timestamp > last {
+				last = entry.Timestamp
+			}
+		}
+	}
+	return last
+}
+
+// restoreAttributes - reapply the extended attributes backed up with the
+// resource name to the file at dest
+func restoreAttributes(id models.Identifier, name, dest string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	return restoreXattrs(id, name, dest, t, privateKey)
+}
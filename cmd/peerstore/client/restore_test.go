@@ -0,0 +1,286 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestBackupAndRestoreTree(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"docs/notes", "docs/empty", "photos"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"docs/notes/todo.txt": "restore the tree",
+		"docs/readme.txt":     "read me",
+		"photos/cat.jpg":      "not really a cat",
+		"empty.txt":           "",
+		"gone.txt":            "deleted after the backup",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modified := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "docs", "readme.txt"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	// deleted resources are not restored
+	if err := DeleteFile(id, "gone.txt", n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	// the manifest is local to the backed up tree, and not restored
+	if err := os.Remove(filepath.Join(root, manifestFile)); err != nil {
+		t.Fatal(err)
+	}
+	want := readTree(t, root)
+
+	// wipe the tree, and restore it
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored tree %v, expected %v", got, want)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "docs", "readme.txt")); err != nil {
+		t.Error(err)
+	} else if !fi.ModTime().Equal(modified) {
+		t.Errorf("expected the restored file modified at %s, got %s", modified, fi.ModTime())
+	}
+
+	tl, err := GetTransactionLog(id, n.peer, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := newestChange(tl["photos/cat.jpg"].Latest())
+	if latest.Size != uint64(len(files["photos/cat.jpg"])) || latest.ContentType != "text/plain; charset=utf-8" || latest.ModTime.IsZero() {
+		t.Errorf("expected the size, content type and modification time logged, got %d, %q, %s",
+			latest.Size, latest.ContentType, latest.ModTime)
+	}
+}
+
+func TestBackupAndRestoreSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links needs privileges on windows")
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "docs", "readme.txt"), []byte("read me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"latest": filepath.Join("docs", "readme.txt"),
+		// a link to the directory it is in, which must not be walked into
+		filepath.Join("docs", "loop"): "..",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for link, target := range links {
+		path := filepath.Join(root, link)
+		if fi, err := os.Lstat(path); err != nil {
+			t.Errorf("expected %s restored: %v", link, err)
+		} else if !isSymlink(fi) {
+			t.Errorf("expected %s restored as a link, not a copy", link)
+		} else if got, err := os.Readlink(path); err != nil || got != target {
+			t.Errorf("expected %s to link to %s, got %s, %v", link, target, got, err)
+		}
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(root, "latest")); err != nil || string(contents) != "read me" {
+		t.Errorf("expected the link to reach the restored file, got %q, %v", contents, err)
+	}
+}
+
+func TestIncrementalRestore(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	src, err := ioutil.TempDir("", "since-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "since-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	write := func(root, name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"kept.txt", "changed.txt", "deleted.txt"} {
+		write(src, name, name)
+	}
+	if err := backupTree(id, src, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTree(id, dest, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := GetTransactionLog(id, n.peer, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredAt := lastChange(tl)
+
+	// a resource fetched again would overwrite the local edit
+	write(dest, "kept.txt", "edited locally")
+	write(src, "changed.txt", "changed remotely")
+	if err := backupTree(id, src, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteFile(id, "deleted.txt", n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	since = restoredAt
+	defer func() { since = 0 }()
+	if err := restoreTree(id, dest, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/":           "",
+		"kept.txt":    "edited locally",
+		"changed.txt": "changed remotely",
+	}
+	if got := readTree(t, dest); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored tree %v, expected %v", got, want)
+	}
+}
+
+func TestIncrementalRestoreIgnoresNodeClocks(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	src, err := ioutil.TempDir("", "since-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "since-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	write := func(root, name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"kept.txt", "changed.txt", "deleted.txt"} {
+		write(src, name, name)
+	}
+	if err := backupTree(id, src, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreTree(id, dest, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	write(dest, "kept.txt", "edited locally")
+	write(src, "changed.txt", "changed remotely")
+	if err := backupTree(id, src, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteFile(id, "deleted.txt", n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// as if the changes were stamped by nodes whose clocks are behind the
+	// one the tree was restored up to
+	since = math.MaxUint64
+	defer func() { since = 0 }()
+	if err := restoreTree(id, dest, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/":           "",
+		"kept.txt":    "edited locally",
+		"changed.txt": "changed remotely",
+	}
+	if got := readTree(t, dest); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored tree %v, expected %v", got, want)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rsa"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// download - a getfile in progress, the first range of the resource has
+// been fetched from the node holding it
+type download struct {
+	id, key    models.Identifier
+	version    uint64
+	node       models.Node
+	privateKey *rsa.PrivateKey
+	// t - the transport to our peer, st to the node holding the resource
+	t, st      *protocol.Transport
+	first      protocol.Response
+	sessionKey []byte
+	// progress - the progress of the rest of the download, nil if it is not
+	// reported
+	progress *transferProgress
+}
+
+// startDownload - find the node holding the resource key, fetch the first
+// range of it, which says how it was encrypted, and decrypt its session key
+func startDownload(id, key models.Identifier, version uint64, peer models.Node, privateKey *rsa.PrivateKey) (*download, error) {
+	d := &download{
+		id:         id,
+		key:        key,
+		version:    version,
+		privateKey: privateKey,
+	}
+	var err error
+	if d.t, err = createTransport(id, peer, privateKey); err != nil {
+		return nil, errors.Wrap(err, "failed to create transport")
+	}
+
+	// get the node that houses the file we need, looking it up again if
+	// the node it was cached as being on has failed
+	_, cached := lookups.get(key)
+	if err = d.fetchFirst(); err != nil && cached {
+		err = d.fetchFirst()
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	if d.sessionKey, err = crypto.DecryptRSA(privateKey, d.first.Header.Secret); err != nil {
+		d.Close()
+		return nil, errors.Wrap(err, "failed to decrypt session key")
+	}
+	if err = checkPayloadMode(d.first.Data, d.first.Header.Tag); err != nil {
+		d.Close()
+		return nil, err
+	}
+	if len(d.first.Header.Tag) == 0 && !allowUntagged {
+		// refused before anything is downloaded, rather than once it all is
+		d.Close()
+		return nil, errPayloadUntagged
+	}
+	glog.V(protocol.DebugLogLevel).Infof("session key %s from secret %s",
+		models.RedactSecret(d.sessionKey), models.RedactSecret(d.first.Header.Secret))
+	return d, nil
+}
+
+// fetchFirst - find the node holding the resource, and fetch the first
+// range of it from there.  The node is evicted from the lookup cache if it
+// fails, as it is unreachable or the resource may have moved since.
+func (d *download) fetchFirst() error {
+	if d.st != nil {
+		d.st.Close()
+	}
+	var err error
+	if d.node, d.st, err = connectNode(d.key, d.id, d.t, d.privateKey); err != nil {
+		return err
+	}
+	if d.first, err = getRange(d.key, d.id, d.version, 0, downloadChunkSize, d.st); err != nil {
+		lookups.invalidate(d.node)
+		return err
+	}
+	return nil
+}
+
+// reportProgress - log the progress of the rest of the download as what
+func (d *download) reportProgress(what string) {
+	d.progress = newTransferProgress(what, d.first.Header.DataLength, uint64(len(d.first.Data)))
+	d.st.SetProgress(d.progress.received)
+}
+
+// Close - close the connections of the download
+func (d *download) Close() {
+	if d.st != nil {
+		d.st.Close()
+	}
+	if d.t != nil {
+		d.t.Close()
+	}
+}
+
+// streamed - is the resource stream encrypted, so it can be decrypted as it
+// is downloaded
+func (d *download) streamed() bool {
+	return bytes.HasPrefix(d.first.Data, streamPayloadMagic)
+}
+
+// resumable - can an interrupted download of the resource be resumed.  Only
+// stream encrypted resources can be decrypted from part way through, and the
+// tag is what tells a partial download is of the same data.
+func (d *download) resumable() bool {
+	return d.streamed() && len(d.first.Header.Tag) > 0
+}
+
+// writeTo - download the whole resource, decrypt it and write it to w.  A
+// stream encrypted resource is decrypted as it is downloaded, so it is never
+// held in memory.  Data which does not match the integrity tag stored with
+// it is an error, which for a stream encrypted resource is only found once
+// it has all been written to w.
+func (d *download) writeTo(w io.Writer) error {
+	if d.streamed() {
+		return d.streamFrom(w, nil, 0)
+	}
+
+	data := d.first.Data
+	if uint64(len(data)) < d.first.Header.DataLength {
+		// get the rest of the key, in parallel ranges, into a temporary
+		// file rather than memory until it is all there
+		f, err := ioutil.TempFile("", "peerstore-download")
+		if err != nil {
+			return errors.Wrap(err, "failed to create download")
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		var progress protocol.Progress
+		if d.progress != nil {
+			progress = d.progress.received
+		}
+		if err := downloadKey(d.key, d.id, d.version, d.first, d.node, d.st, d.privateKey, f, progress); err != nil {
+			return err
+		}
+		// only a stream encrypted resource can be decrypted a part at a
+		// time, the other modes decrypt all of the data at once
+		if data, err = ioutil.ReadAll(io.NewSectionReader(f, 0, int64(d.first.Header.DataLength))); err != nil {
+			return errors.Wrap(err, "failed to read download")
+		}
+	}
+	if err := verifyPayloadTag(d.sessionKey, data, d.first.Header.Tag); err != nil {
+		return err
+	}
+
+	// decrypt data, the iv or nonce is in front of it
+	glog.V(protocol.DebugLogLevel).Infof("length of data: %d", len(data))
+	plaintext, err := openPayload(d.sessionKey, data, d.first.Header.Tag)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt data")
+	}
+	_, err = w.Write(plaintext)
+	return err
+}
+
+// streamFrom - download a stream encrypted resource from done bytes of
+// plaintext on, decrypting it and writing it to w.  part reads the done
+// bytes of plaintext already downloaded, which are encrypted again to check
+// the tag of the whole resource.
+func (d *download) streamFrom(w io.Writer, part io.Reader, done uint64) error {
+	var headerLen = uint64(len(streamPayloadMagic) + aes.BlockSize)
+	if uint64(len(d.first.Data)) < headerLen {
+		return errors.New("stored data is too short")
+	}
+	if headerLen+done > d.first.Header.DataLength {
+		return errors.New("partial download is longer than the resource")
+	}
+	iv := d.first.Data[len(streamPayloadMagic):headerLen]
+
+	mac := newPayloadMAC(d.sessionKey)
+	mac.Write(d.first.Data[:headerLen])
+	if done > 0 {
+		ciphertext, err := crypto.NewStreamReaderAt(d.sessionKey, iv, 0, part)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt partial download")
+		}
+		if _, err := io.CopyN(mac, ciphertext, int64(done)); err != nil {
+			return errors.Wrap(err, "failed to read partial download")
+		}
+	}
+
+	rr := newRangeReader(d.key, d.id, d.version, d.first, headerLen+done, d.st)
+	plaintext, err := crypto.NewStreamReaderAt(d.sessionKey, iv, done, io.TeeReader(rr, mac))
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt data")
+	}
+	if _, err := io.Copy(w, plaintext); err != nil {
+		return errors.Wrap(err, "failed to download data")
+	}
+	return checkPayloadTag(mac, d.first.Header.Tag)
+}
+
+// partialDownload - the resource a partial download is of, saved alongside
+// it so the download can be resumed
+type partialDownload struct {
+	Key     models.Identifier
+	Version uint64
+	Length  uint64
+	Tag     []byte
+}
+
+// partialDownloadOf - the partialDownload record of the download
+func (d *download) partialDownloadOf() partialDownload {
+	return partialDownload{
+		Key:     d.key,
+		Version: d.first.Header.Version,
+		Length:  d.first.Header.DataLength,
+		Tag:     d.first.Header.Tag,
+	}
+}
+
+// resumedLength - the bytes already downloaded to tmp by an interrupted
+// download of the same resource, zero if there are none
+func (d *download) resumedLength(tmp string) int64 {
+	f, err := os.Open(tmp + ".state")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	var saved partialDownload
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return 0
+	}
+	current := d.partialDownloadOf()
+	if saved.Key != current.Key || saved.Version != current.Version ||
+		saved.Length != current.Length || !bytes.Equal(saved.Tag, current.Tag) {
+		// the resource changed since
+		return 0
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// resumeTo - download the resource, decrypting it to tmp, carrying on from
+// what an interrupted download of the same resource left there.  tmp is kept
+// if the download fails part way, so it can be resumed again, unless what
+// was downloaded does not match the tag, and is removed once it succeeds.
+func (d *download) resumeTo(tmp string) error {
+	done := d.resumedLength(tmp)
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create destination")
+	}
+	defer f.Close()
+
+	if done > 0 {
+		log.Printf("resuming download at %d bytes", done)
+	} else {
+		if err := f.Truncate(0); err != nil {
+			return errors.Wrap(err, "failed to create destination")
+		}
+		state, err := os.OpenFile(tmp+".state", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to save download state")
+		}
+		err = gob.NewEncoder(state).Encode(d.partialDownloadOf())
+		state.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to save download state")
+		}
+	}
+	// anything past what was saved from the last attempt was never verified
+	// to have been written in full
+	if err := f.Truncate(done); err != nil {
+		return errors.Wrap(err, "failed to resume download")
+	}
+
+	err = d.streamFrom(&offsetWriter{f: f, offset: done}, io.NewSectionReader(f, 0, done), uint64(done))
+	if err == errPayloadTampered {
+		// start over next time
+		f.Close()
+		os.Remove(tmp)
+		os.Remove(tmp + ".state")
+		return err
+	}
+	if err != nil {
+		log.Printf("download interrupted, getfile again to resume it")
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write destination")
+	}
+	os.Remove(tmp + ".state")
+	return nil
+}
+
+// offsetWriter - writes to f in order from offset, independent of where
+// the file is read from
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.f.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// connCounter - the number of connections a proxy accepted
+type connCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *connCounter) add() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n
+}
+
+func (c *connCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// flakyProxy - forward connections to addr, except the first failures, which
+// are closed as soon as they are accepted
+func flakyProxy(t *testing.T, addr string, failures int) (proxyAddr string, accepted *connCounter, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted = new(connCounter)
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.add() <= failures {
+				client.Close()
+				continue
+			}
+			go func() {
+				defer client.Close()
+				server, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				go io.Copy(client, server)
+				io.Copy(server, client)
+			}()
+		}
+	}()
+	return l.Addr().String(), accepted, func() { l.Close() }
+}
+
+func TestRoundTripWithRetry(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	policy := protocol.RetryPolicy{
+		Attempts:       3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+		Jitter:         0.5,
+		Timeout:        10 * time.Second,
+	}
+	request := func(addr string, policy protocol.RetryPolicy) (protocol.Response, error) {
+		tr, err := createTransport(id, models.Node{Addr: addr, PublicKey: n.peer.PublicKey}, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		return tr.RoundTripWithRetry(&protocol.Request{
+			Header: protocol.Header{
+				Type:   protocol.UserType,
+				From:   id,
+				PubKey: &privateKey.PublicKey,
+			},
+			Method: protocol.PingMethod,
+		}, policy)
+	}
+
+	// fails twice, then succeeds
+	addr, accepted, stop := flakyProxy(t, n.peer.Addr, 2)
+	defer stop()
+	resp, err := request(addr, policy)
+	if err != nil || resp.Status != protocol.Success {
+		t.Fatalf("expected the third attempt to succeed, got %v, %v", err, resp.Err())
+	}
+	if got := accepted.count(); got != 3 {
+		t.Errorf("expected 3 connections, got %d", got)
+	}
+
+	// one attempt too few
+	addr, accepted, stop = flakyProxy(t, n.peer.Addr, 2)
+	defer stop()
+	policy.Attempts = 2
+	if _, err := request(addr, policy); err == nil || !protocol.Retryable(err) {
+		t.Errorf("expected the last retryable failure to be returned, got %v", err)
+	}
+	if got := accepted.count(); got != 2 {
+		t.Errorf("expected 2 connections, got %d", got)
+	}
+
+	// an error response from the node is not retried
+	addr, accepted, stop = flakyProxy(t, n.peer.Addr, 0)
+	defer stop()
+	policy.Attempts = 3
+	tr, err := createTransport(id, models.Node{Addr: addr, PublicKey: n.peer.PublicKey}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	resp, err = tr.RoundTripWithRetry(&protocol.Request{
+		Header: protocol.Header{
+			Type: protocol.UserType,
+			From: id,
+			Key:  fileToKeyIdentifier("missing.txt"),
+		},
+		Method: protocol.GetFileMethod,
+	}, policy)
+	if err != nil || resp.Status != protocol.Error {
+		t.Errorf("expected an error response, got %v, %v", err, resp.Status)
+	}
+	if got := accepted.count(); got != 1 {
+		t.Errorf("expected a single connection, got %d", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// ringNode - a node found walking the ring, with the predecessor it has
+type ringNode struct {
+	models.Node
+	Predecessor models.Node
+}
+
+// getNeighbor - ask node directly for its own predecessor or successor,
+// method being GetPredecessorMethod or GetImmediateSuccessorMethod, rather
+// than having the ring route the request
+func getNeighbor(id models.Identifier, node models.Node, privateKey *rsa.PrivateKey, method protocol.RequestMethod) (models.Node, error) {
+	t, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	resp, err := retryRoundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: method,
+	})
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return models.Node{}, resp.Err()
+	}
+	return models.DecodeNode(bytes.NewBuffer(resp.Data))
+}
+
+// walkRing - the nodes of the ring in order, following each node's own
+// successor from the successor of peer until the walk comes back to where
+// it started.  A walk which comes back to any other node it visited has
+// found a loop, which fails it, as does a node which cannot be reached.
+func walkRing(id models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) ([]ringNode, error) {
+	first, err := getNeighbor(id, peer, privateKey, protocol.GetImmediateSuccessorMethod)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the successor of %s", peer.Addr)
+	}
+	var (
+		nodes   []ringNode
+		visited = map[models.Identifier]int{}
+		node    = first
+	)
+	for len(nodes) < maxListNodes {
+		predecessor, err := getNeighbor(id, node, privateKey, protocol.GetPredecessorMethod)
+		if err != nil {
+			return nodes, errors.Wrapf(err, "failed to get the predecessor of %s", node)
+		}
+		visited[node.ID] = len(nodes)
+		nodes = append(nodes, ringNode{Node: node, Predecessor: predecessor})
+
+		successor, err := getNeighbor(id, node, privateKey, protocol.GetImmediateSuccessorMethod)
+		if err != nil {
+			return nodes, errors.Wrapf(err, "failed to get the successor of %s", node)
+		}
+		if successor.ID == first.ID {
+			return nodes, nil
+		}
+		if i, ok := visited[successor.ID]; ok {
+			return nodes, errors.Errorf("the ring loops from %s back to %s, the node %d of the walk, without returning to %s",
+				node, successor, i+1, first)
+		}
+		node = successor
+	}
+	return nodes, errors.Errorf("stopped walking the ring after %d nodes", maxListNodes)
+}
+
+// printRing - print the nodes of a ring walk in order, with the predecessor
+// each has, marking those whose predecessor is not the node before them.
+// The first node comes after the last only if the walk closed the ring.
+func printRing(nodes []ringNode, closed bool) {
+	for i, n := range nodes {
+		previous := nodes[(i+len(nodes)-1)%len(nodes)]
+		mark := ""
+		if (i > 0 || closed) && n.Predecessor.ID != previous.ID {
+			mark = "\t(expected " + previous.Node.String() + ")"
+		}
+		predecessor := "none"
+		if n.Predecessor.Addr != "" {
+			predecessor = n.Predecessor.String()
+		}
+		fmt.Printf("%d\t%s\tpredecessor %s%s\n", i+1, n.Node, predecessor, mark)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// testRing - nodes on ephemeral ports joined into one ring, for tests to
+// make real round trips through
+type testRing struct {
+	nodes []*testNode
+}
+
+// startTestRing - start size nodes and join them into a ring, stop them
+// with stop.  The test is skipped if two nodes land on the same position, as
+// the ring would then not hold them all.
+func startTestRing(tb testing.TB, size int, settings models.RingSettings) *testRing {
+	first := startTestNode(tb, models.Node{}, settings)
+	r := &testRing{nodes: []*testNode{first}}
+	for len(r.nodes) < size {
+		r.nodes = append(r.nodes, startTestNode(tb, first.peer, settings))
+	}
+	positions := make(map[uint64]bool)
+	for _, n := range r.nodes {
+		positions[models.KeyToID(n.peer.ID)] = true
+	}
+	if len(positions) != len(r.nodes) {
+		r.stop()
+		tb.Skip("nodes landed on the same ring position")
+	}
+	stabilizeTestRing(tb, r.nodes)
+	return r
+}
+
+// stop - stop every node of the ring and remove their data
+func (r *testRing) stop() {
+	for _, n := range r.nodes {
+		n.stop()
+	}
+}
+
+// testClient - a user registered with a test ring, and the node it makes
+// its requests through
+type testClient struct {
+	id         models.Identifier
+	privateKey *rsa.PrivateKey
+	peer       models.Node
+}
+
+// newClient - register a new user with the ring, reaching it through its
+// first node
+func (r *testRing) newClient(tb testing.TB) testClient {
+	peer := r.nodes[0].peer
+	id, privateKey := registerTestUser(tb, peer)
+	return testClient{id: id, privateKey: privateKey, peer: peer}
+}
+
+func TestRingBackupAndGetFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ring := startTestRing(t, 3, models.RingSettings{
+		SuccessorListLength: 2,
+		ReplicationFactor:   2,
+	})
+	defer ring.stop()
+	client := ring.newClient(t)
+
+	root, err := ioutil.TempDir("", "ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	random := make([]byte, 64*1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"notes.txt":         []byte("backed up across the ring"),
+		"empty.txt":         {},
+		"photos/random.bin": random,
+		"docs/deep/a.txt":   bytes.Repeat([]byte("a"), 4096),
+	}
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := backupTree(client.id, root, client.peer, client.privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := ioutil.TempDir("", "ring-get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	for name, contents := range files {
+		path := filepath.Join(dest, filepath.Base(name))
+		if err := getFileToPath(client.id, fileToKeyIdentifier(name), 0, client.peer, client.privateKey, path); err != nil {
+			t.Errorf("getfile of %s: %v", name, err)
+			continue
+		}
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Errorf("%s came back as %d bytes which differ from the %d backed up", name, len(got), len(contents))
+		}
+	}
+}
+
+func TestWalkRing(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ring := startTestRing(t, 3, models.RingSettings{
+		SuccessorListLength: 2,
+		ReplicationFactor:   1,
+	})
+	defer ring.stop()
+	client := ring.newClient(t)
+
+	nodes, err := walkRing(client.id, client.peer, client.privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != len(ring.nodes) {
+		t.Fatalf("walked %d nodes, expected %d", len(nodes), len(ring.nodes))
+	}
+	seen := make(map[models.Identifier]bool)
+	for i, n := range nodes {
+		if seen[n.ID] {
+			t.Errorf("%s was walked twice", n.Node)
+		}
+		seen[n.ID] = true
+		// no other node of the ring falls between a node and the next
+		next := nodes[(i+1)%len(nodes)]
+		for _, other := range ring.nodes {
+			if models.Between(models.KeyToID(other.peer.ID), models.KeyToID(n.ID), models.KeyToID(next.ID)) {
+				t.Errorf("%s is between %s and %s, which the walk has next to each other", other.peer, n.Node, next.Node)
+			}
+		}
+		previous := nodes[(i+len(nodes)-1)%len(nodes)]
+		if n.Predecessor.ID != previous.ID {
+			t.Errorf("%s has predecessor %s, expected %s", n.Node, n.Predecessor, previous.Node)
+		}
+	}
+	for _, n := range ring.nodes {
+		if !seen[n.peer.ID] {
+			t.Errorf("%s was not walked", n.peer)
+		}
+	}
+}
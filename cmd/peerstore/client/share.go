@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"os"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// readShareWithKey - read the public key of the user to share with from the
+// pem file at path, along with the ID the key gives them
+func readShareWithKey(path string) (rsa.PublicKey, models.Identifier, error) {
+	keyFile, err := os.Open(path)
+	if err != nil {
+		return rsa.PublicKey{}, models.Identifier{}, errors.Wrap(err, "failed to open shareWithKeyFile")
+	}
+	defer keyFile.Close()
+	shareWithKey, err := crypto.ReadPublicKeyAsPem(keyFile)
+	if err != nil {
+		return rsa.PublicKey{}, models.Identifier{}, errors.Wrap(err, "failed to read shareWithKeyFile")
+	}
+	gobKey, err := crypto.GobEncodePublicKey(&shareWithKey)
+	if err != nil {
+		return rsa.PublicKey{}, models.Identifier{}, errors.Wrap(err, "failed to encode shareWithKeyFile")
+	}
+	return shareWithKey, models.HashBytes(gobKey), nil
+}
+
+// revokeShare - remove the user shareWithID from the owners of the resource
+// key, so they can no longer read or change it.  Revoking a user the
+// resource is not shared with succeeds.
+func revokeShare(id, key, shareWithID models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) error {
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	node, err := lookupNode(key, id, t)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(models.RevokeShareRequest{ID: shareWithID}); err != nil {
+		return errors.Wrap(err, "failed to encode revoke request")
+	}
+	resp, err := roundTrip(st, &protocol.Request{
+		Header: protocol.Header{
+			Key:    key,
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.RevokeShareMethod,
+		Data:   buf.Bytes(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrap(resp.Err(), "revoke was rejected")
+	}
+	return nil
+}
+
+// transferOwnership - hand the resource name to the user toID, whose public
+// key is toKey, giving them the session key of the resource, and stop being
+// an owner of it.  The resource is then logged as deleted, as deleting a
+// shared file does, so syncs no longer fetch it.
+func transferOwnership(id models.Identifier, name string, toID models.Identifier, toKey *rsa.PublicKey, peer models.Node, privateKey *rsa.PrivateKey) error {
+	name, err := models.NormalizeResourceName(name)
+	if err != nil {
+		return err
+	}
+	key := fileToKeyIdentifier(name)
+
+	t, err := createTransport(id, peer, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+	node, err := lookupNode(key, id, t)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	resp, err := getKey(key, id, st)
+	if err != nil {
+		return errors.Wrap(err, "failed to get file")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrapf(resp.Err(), "failed to get %s", name)
+	}
+	sessionKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt session key")
+	}
+	secret, err := crypto.EncryptRSA(toKey, sessionKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt session key")
+	}
+
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(models.TransferOwnershipRequest{ID: toID, Secret: secret}); err != nil {
+		return errors.Wrap(err, "failed to encode transfer request")
+	}
+	resp, err = roundTrip(st, &protocol.Request{
+		Header: protocol.Header{
+			Key:    key,
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.TransferOwnershipMethod,
+		Data:   buf.Bytes(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return errors.Wrap(resp.Err(), "transfer was rejected")
+	}
+	if _, err := models.IncrementClock(resp.Header.Clock); err != nil {
+		return errors.Wrap(err, "transferred, but failed to advance the clock")
+	}
+	return errors.Wrap(DeleteFile(id, name, peer, privateKey), "transferred, but failed to log it")
+}
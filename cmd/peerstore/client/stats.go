@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"fmt"
+	"sort"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// nodeStats - the stored resources and request counts of node
+func nodeStats(id models.Identifier, node models.Node, privateKey *rsa.PrivateKey) (models.StatsResponse, error) {
+	t, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return models.StatsResponse{}, errors.Wrap(err, "failed to create transport")
+	}
+	defer t.Close()
+
+	resp, err := roundTrip(t, &protocol.Request{
+		Header: protocol.Header{
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.StatsMethod,
+	})
+	if err != nil {
+		return models.StatsResponse{}, errors.Wrap(err, "failed round trip")
+	}
+	if resp.Status != protocol.Success {
+		return models.StatsResponse{}, resp.Err()
+	}
+	var result models.StatsResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&result); err != nil {
+		return models.StatsResponse{}, errors.Wrap(err, "failed to decode stats")
+	}
+	return result, nil
+}
+
+// printStats - print the stats of the node at addr, with a line for each
+// method requested and for each peer breaker
+func printStats(addr string, stats models.StatsResponse) {
+	fmt.Printf("node\t%s\n", addr)
+	fmt.Printf("uptime\t%s\n", stats.Uptime)
+	fmt.Printf("resources\t%d\n", stats.Resources)
+	fmt.Printf("bytes\t%d\n", stats.Bytes)
+
+	methods := make([]string, 0, len(stats.Requests))
+	for method := range stats.Requests {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		fmt.Printf("%s\t%d requests\t%d failed\n", method, stats.Requests[method], stats.Failures[method])
+	}
+
+	peers := make([]string, 0, len(stats.Breakers))
+	for peer := range stats.Breakers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		breaker := stats.Breakers[peer]
+		fmt.Printf("breaker\t%s\t%s\t%d failures\n", peer, breaker.State, breaker.ConsecutiveFailures)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestStatsCountRequests(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	_, err := nodeStats(id, n.peer, privateKey)
+	if re, ok := err.(*protocol.ResponseError); !ok || re.Code != protocol.UnauthorizedCode {
+		t.Fatalf("expected stats refused to a user who is not an admin, got %v", err)
+	}
+	n.Server.WithValue(models.AdminsContextKey, []models.Identifier{id})
+
+	before, err := nodeStats(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := fileToKeyIdentifier("stats.txt")
+	request := func(method protocol.RequestMethod, data []byte) protocol.Response {
+		tr, err := createTransport(id, n.peer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Close()
+		resp, err := tr.RoundTrip(&protocol.Request{
+			Header: protocol.Header{
+				Key:          key,
+				Type:         protocol.UserType,
+				From:         id,
+				PubKey:       privateKey.Public().(*rsa.PublicKey),
+				ResourceName: "stats.txt",
+				Secret:       make([]byte, 256),
+				DataLength:   uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	data := []byte("counted")
+	for _, step := range []struct {
+		method protocol.RequestMethod
+		data   []byte
+		status protocol.ResponseStatus
+	}{
+		{protocol.PostFileMethod, data, protocol.Success},
+		{protocol.GetFileMethod, nil, protocol.Success},
+		{protocol.GetFileMethod, nil, protocol.Success},
+		{protocol.DeleteFileMethod, nil, protocol.Success},
+		// gone now, so fails
+		{protocol.GetFileMethod, nil, protocol.Error},
+	} {
+		if resp := request(step.method, step.data); resp.Status != step.status {
+			t.Fatalf("%s: expected status %d, got %d", protocol.RequestMethodToString[step.method], step.status, resp.Status)
+		}
+	}
+
+	after, err := nodeStats(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method             string
+		requests, failures uint64
+	}{
+		{"PostFile", 1, 0},
+		{"GetFile", 3, 1},
+		{"DeleteFile", 1, 0},
+	} {
+		if got := after.Requests[c.method] - before.Requests[c.method]; got != c.requests {
+			t.Errorf("expected %d %s requests counted, got %d", c.requests, c.method, got)
+		}
+		if got := after.Failures[c.method] - before.Failures[c.method]; got != c.failures {
+			t.Errorf("expected %d %s failures counted, got %d", c.failures, c.method, got)
+		}
+	}
+	if after.Requests["Stats"] != before.Requests["Stats"]+1 {
+		t.Errorf("expected the first stats request counted, got %d", after.Requests["Stats"])
+	}
+	if after.Resources < 1 || after.Bytes == 0 {
+		t.Errorf("expected the registered user's public key counted as stored, got %d resources, %d bytes",
+			after.Resources, after.Bytes)
+	}
+	if after.Uptime <= before.Uptime {
+		t.Errorf("expected uptime to grow, got %s then %s", before.Uptime, after.Uptime)
+	}
+}
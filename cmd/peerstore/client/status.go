@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// syncStatus - an at a glance view of the state of the sync loop, so the
+// daemon can be monitored without reading through the logs
+type syncStatus struct {
+	mu *sync.Mutex
+
+	Started            time.Time
+	LastPoll           time.Time
+	LastError          string
+	LastErrorTime      time.Time
+	Errors             uint64
+	Uploads            uint64
+	Downloads          uint64
+	Deletes            uint64
+	TransactionLogSize int
+	// Conflicts - the resources changed concurrently by different clients,
+	// and when the conflict was first seen.  They are not synced until a
+	// change is made knowing of both.
+	Conflicts map[string]time.Time
+}
+
+// status - the status of this client's sync loop
+var status = &syncStatus{
+	mu:        new(sync.Mutex),
+	Started:   time.Now(),
+	Conflicts: make(map[string]time.Time),
+}
+
+// recordPoll - record a completed poll of the remote transaction log
+func (s *syncStatus) recordPoll(logSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastPoll = time.Now()
+	s.TransactionLogSize = logSize
+}
+
+// recordError - record a failure within the sync loop
+func (s *syncStatus) recordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Errors++
+	s.LastError = err.Error()
+	s.LastErrorTime = time.Now()
+}
+
+func (s *syncStatus) recordUpload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Uploads++
+}
+
+func (s *syncStatus) recordDownload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Downloads++
+}
+
+func (s *syncStatus) recordDelete() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Deletes++
+}
+
+// recordConflict - record the resource at path as changed concurrently,
+// returns false if the conflict was already recorded
+func (s *syncStatus) recordConflict(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Conflicts[path]; ok {
+		return false
+	}
+	s.Conflicts[path] = time.Now()
+	return true
+}
+
+// resolveConflict - record the resource at path as no longer in conflict
+func (s *syncStatus) resolveConflict(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Conflicts, path)
+}
+
+// ServeHTTP - implementation of http.Handler, writes out the status as json
+func (s *syncStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
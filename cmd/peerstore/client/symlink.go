@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// isSymlink - check if fi, as returned by os.Lstat, is a symbolic link.
+// filepath.Walk does not follow links, so a link to a directory above it
+// cannot send a backup or sync round in a loop, it is recorded as a link.
+func isSymlink(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeSymlink != 0
+}
+
+// symlinkEntry - an entry recording the symbolic link at path.  The target is
+// kept as the link records it, so a relative link stays relative.
+func symlinkEntry(path string) (models.TransactionEntry, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return models.TransactionEntry{}, errors.Wrap(err, "failed to read link")
+	}
+	return models.TransactionEntry{
+		Operation:  models.SymlinkOperation,
+		LinkTarget: target,
+	}, nil
+}
+
+// restoreSymlink - create the symbolic link entry records at dest, replacing
+// a link or file already there
+func restoreSymlink(dest string, entry models.TransactionEntry) error {
+	if entry.LinkTarget == "" {
+		return errors.New("link has no target")
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(dest); err == nil && !fi.IsDir() {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(os.Symlink(entry.LinkTarget, dest), "failed to create link")
+}
+
+// PostSymlink - record the symbolic link at path under localPath in the
+// transaction log, with its target rather than the contents of the file it
+// points to
+func PostSymlink(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	path, err := models.NormalizeResourceName(path)
+	if err != nil {
+		status.recordError(err)
+		return err
+	}
+	entry, err := symlinkEntry(filepath.Join(localPath, filepath.FromSlash(path)))
+	if err != nil {
+		status.recordError(err)
+		return err
+	}
+	_, err = logOperation(clientID, path, entry, peer, privateKey)
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// tombstoneFile - the file at the root of localPath recording the resources
+// deleted there, by this client or by a sync, so a transaction log from a
+// node which has not yet seen a delete cannot bring the file back
+const tombstoneFile = ".peerstoretombstones"
+
+// tombstoneSet - the delete entry of each resource deleted under a
+// localPath, by resource name, kept until a change made after it supersedes
+// it
+type tombstoneSet struct {
+	path    string
+	mu      *sync.Mutex
+	entries map[string]models.TransactionEntry
+}
+
+// tombstones - the tombstones of the localPath being synced, nil when not
+// syncing
+var tombstones *tombstoneSet
+
+// loadTombstones - the tombstones of the resources deleted under root,
+// empty if there are none.  Tombstones which cannot be read are started
+// afresh, the transaction log still records the deletes.
+func loadTombstones(root string) *tombstoneSet {
+	ts := &tombstoneSet{
+		path:    filepath.Join(root, tombstoneFile),
+		mu:      new(sync.Mutex),
+		entries: make(map[string]models.TransactionEntry),
+	}
+	data, err := ioutil.ReadFile(ts.path)
+	if os.IsNotExist(err) {
+		return ts
+	}
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewBuffer(data)).Decode(&ts.entries)
+	}
+	if err != nil {
+		log.Printf("ignoring unreadable tombstones %s: %s", ts.path, err)
+		ts.entries = make(map[string]models.TransactionEntry)
+	}
+	return ts
+}
+
+// bury - record entry, the delete of the resource at path, as its tombstone,
+// unless it has one made after it already
+func (ts *tombstoneSet) bury(path string, entry models.TransactionEntry) error {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if current, ok := ts.entries[path]; ok && current.Compare(entry) != models.HappensBefore {
+		return nil
+	}
+	ts.entries[path] = entry
+	return ts.save()
+}
+
+// admits - check entry, the latest change to the resource at path in the
+// transaction log, can be applied.  A change the tombstone of the resource
+// does not happen before is from a log which has not seen the delete, and is
+// not.  A delete is buried, and any change made after the tombstone lifts it.
+func (ts *tombstoneSet) admits(path string, entry models.TransactionEntry) bool {
+	if ts == nil {
+		return true
+	}
+	if entry.Operation == models.DeleteOperation {
+		handleError(ts.bury(path, entry))
+		return true
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	tombstone, ok := ts.entries[path]
+	if !ok {
+		return true
+	}
+	if tombstone.Compare(entry) != models.HappensBefore {
+		return false
+	}
+	delete(ts.entries, path)
+	handleError(ts.save())
+	return true
+}
+
+func (ts *tombstoneSet) save() error {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(ts.entries); err != nil {
+		return errors.Wrap(err, "failed to encode tombstones")
+	}
+	return errors.Wrap(writeFileAtomic(ts.path, buf.Bytes()), "failed to write tombstones")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// findStored - the file under dataPath a node stores the resource key in,
+// empty if it does not store it
+func findStored(dataPath string, key models.Identifier) string {
+	var found string
+	filepath.Walk(dataPath, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fi.Name() == key.String() {
+			found = path
+		}
+		return nil
+	})
+	return found
+}
+
+// storedPath - the file under dataPath a node stores the resource key in
+func storedPath(t *testing.T, dataPath string, key models.Identifier) string {
+	found := findStored(dataPath, key)
+	if found == "" {
+		t.Fatalf("%s is not stored under %s", key, dataPath)
+	}
+	return found
+}
+
+func TestSyncKeepsDeletedFileGone(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	var dirs []string
+	for _, prefix := range []string{"clienta", "clientb"} {
+		dir, err := ioutil.TempDir("", prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	a, b := dirs[0], dirs[1]
+	if err := ioutil.WriteFile(filepath.Join(a, "gone.txt"), []byte("deleted on a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, savedKnown, savedTombstones := localPath, known, tombstones
+	defer func() { localPath, known, tombstones = saved, savedKnown, savedTombstones }()
+	// sync moves between the clients, each with the state it keeps
+	clientB := func() {
+		localPath, known, tombstones = b, newKnownClocks(), loadTombstones(b)
+	}
+
+	localPath, tombstones = a, loadTombstones(a)
+	if _, err := Synchronize(id, a, n.peer, privateKey, models.TransactionLog{}); err != nil {
+		t.Fatal(err)
+	}
+	clientB()
+	tlB, err := Synchronize(id, b, n.peer, privateKey, models.TransactionLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(b, "gone.txt")); err != nil {
+		t.Fatalf("expected gone.txt synced to b: %v", err)
+	}
+
+	// the log as a node which never hears of the delete would keep it
+	logKey, err := protocol.TransactionLogKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := storedPath(t, n.dataPath, logKey)
+	stale, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localPath, tombstones = a, loadTombstones(a)
+	if err := os.Remove(filepath.Join(a, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteFile(id, "gone.txt", n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	clientB()
+	if _, err := Synchronize(id, b, n.peer, privateKey, tlB); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(b, "gone.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected gone.txt removed from b by the sync, got %v", err)
+	}
+
+	// b restarts against a node serving the log from before the delete
+	if err := ioutil.WriteFile(logPath, stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		clientB()
+		if _, err := Synchronize(id, b, n.peer, privateKey, models.TransactionLog{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(b, "gone.txt")); !os.IsNotExist(err) {
+			t.Fatalf("gone.txt came back on sync %d from a stale log: %v", i+1, err)
+		}
+	}
+}
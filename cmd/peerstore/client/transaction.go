@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rsa"
+	"log"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// stagedTransaction - a group of posts whose transaction log entries are
+// committed together in a single log update, or not at all.  The stored
+// copy of each file a post replaces is kept, so a failed group can put it
+// back, and the log only ever references the group as a whole.
+type stagedTransaction struct {
+	entities map[string]models.TransactionEntity
+	// previous - the copy of each resource stored before the group posted
+	// over it, by key
+	previous map[models.Identifier]storedCopy
+	err      error
+}
+
+// storedCopy - a resource as stored before a post of a group replaced it,
+// with the node it is stored on.  A resource which did not exist has no
+// data, and is deleted on a rollback.
+type storedCopy struct {
+	node   models.Node
+	exists bool
+	data   []byte
+	secret []byte
+	tag    []byte
+}
+
+// commitAttempts - how many times a commit is tried against a transaction
+// log another client keeps changing before it gives up
+const commitAttempts = 5
+
+// newStagedTransaction - start a new group of posts
+func newStagedTransaction() *stagedTransaction {
+	return &stagedTransaction{
+		entities: make(map[string]models.TransactionEntity),
+		previous: make(map[models.Identifier]storedCopy),
+	}
+}
+
+// stage - stage the log entry for a successful post of the resource at path
+func (txn *stagedTransaction) stage(path string, key models.Identifier, entry models.TransactionEntry) {
+	entity, ok := txn.entities[path]
+	if !ok {
+		entity = models.TransactionEntity{
+			ResourceName: path,
+			ResourceID:   key,
+		}
+	}
+	entity.Entries = append(entity.Entries, entry)
+	txn.entities[path] = entity
+}
+
+// keep - fetch and keep the copy of the resource key stored on node over
+// st, before the group posts over it, so a rollback can put it back.  Only
+// the first copy of a resource posted more than once is kept.
+func (txn *stagedTransaction) keep(key, id models.Identifier, node models.Node, st *protocol.Transport) error {
+	if _, ok := txn.previous[key]; ok {
+		return nil
+	}
+	resp, err := getKey(key, id, st)
+	if errors.Cause(err) == protocol.ErrResourceNotFound {
+		txn.previous[key] = storedCopy{node: node}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to keep the stored copy")
+	}
+	txn.previous[key] = storedCopy{
+		node:   node,
+		exists: true,
+		data:   resp.Data,
+		secret: resp.Header.Secret,
+		tag:    resp.Header.Tag,
+	}
+	return nil
+}
+
+// fail - mark the group as failed, so nothing is committed
+func (txn *stagedTransaction) fail(err error) {
+	if txn.err == nil {
+		txn.err = err
+	}
+}
+
+// rollback - put back the copy of every resource stored before the group
+// posted over it, deleting those which did not exist.  Every resource is
+// tried, the first failure is returned.
+func (txn *stagedTransaction) rollback(clientID models.Identifier, privateKey *rsa.PrivateKey) error {
+	var first error
+	for key, stored := range txn.previous {
+		if err := stored.restore(key, clientID, privateKey); err != nil {
+			log.Printf("failed to roll back %s: %s", key, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// restore - put the stored copy of the resource key back on its node
+func (stored storedCopy) restore(key, clientID models.Identifier, privateKey *rsa.PrivateKey) error {
+	st, err := createTransport(clientID, stored.node, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	header := protocol.Header{
+		Key:    key,
+		Type:   protocol.UserType,
+		From:   clientID,
+		PubKey: privateKey.Public().(*rsa.PublicKey),
+	}
+	request := &protocol.Request{Header: header, Method: protocol.DeleteFileMethod}
+	if stored.exists {
+		request.Header.Secret = stored.secret
+		request.Header.Tag = stored.tag
+		request.Header.DataLength = uint64(len(stored.data))
+		request.Method, request.Data = protocol.PostFileMethod, stored.data
+	}
+	resp, err := roundTrip(st, request)
+	if err != nil {
+		return errors.Wrap(err, "failed round trip")
+	}
+	if err := resp.Err(); err != nil && !(err == protocol.ErrResourceNotFound && !stored.exists) {
+		return err
+	}
+	return nil
+}
+
+// isLogConflict - did err come of the transaction log changing between it
+// being read and a commit to it
+func isLogConflict(err error) bool {
+	re, ok := errors.Cause(err).(*protocol.ResponseError)
+	return ok && re.Code == protocol.ConflictCode
+}
+
+// commit - add all of the staged entries to the transaction log in a single
+// update, which the node only applies if the log is still the one the
+// entries were stamped against, trying again against the new log if it is
+// not.  If any post in the group failed, or the entries could not be
+// committed, the log is left untouched and the posts are rolled back.
+func (txn *stagedTransaction) commit(clientID models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) error {
+	if txn.err != nil {
+		log.Printf("not committing %d staged resources, group failed: %s",
+			len(txn.entities), txn.err)
+		if err := txn.rollback(clientID, privateKey); err != nil {
+			return errors.Wrapf(txn.err, "transaction rolled back, but not every post was undone (%s)", err)
+		}
+		return errors.Wrap(txn.err, "transaction rolled back")
+	}
+	if len(txn.entities) == 0 {
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt < commitAttempts; attempt++ {
+		if err = txn.commitOnce(clientID, peer, privateKey); !isLogConflict(err) {
+			break
+		}
+		log.Printf("transaction log changed while committing, trying again")
+	}
+	if err != nil {
+		// nothing references the posts, put back what they replaced
+		log.Printf("failed to commit %d staged resources: %s", len(txn.entities), err)
+		if rerr := txn.rollback(clientID, privateKey); rerr != nil {
+			return errors.Wrapf(err, "failed to commit transaction, and not every post was undone (%s)", rerr)
+		}
+		return errors.Wrap(err, "failed to commit transaction, rolled back")
+	}
+	log.Printf("committed %d staged resources", len(txn.entities))
+	return nil
+}
+
+// commitOnce - stamp the staged entries against the current transaction
+// log, and add them to it as long as it has not changed since
+func (txn *stagedTransaction) commitOnce(clientID models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) error {
+	tl, digest, err := getTransactionLog(clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey)
+	if err != nil {
+		// a log which could not be fetched is not an empty log, committing
+		// the staged entries to an empty log would lose every other entry
+		if !isNoTransactionLog(err) {
+			return errors.Wrap(err, "failed to get transaction log")
+		}
+		// a user without a transaction log yet starts with an empty one
+		log.Printf("error getting transaction log: %s", err)
+		tl, digest = models.TransactionLog{}, protocol.TransactionLogDigest(nil)
+	}
+
+	// only the staged entries are sent, the node appends them to its log
+	added := models.TransactionLog{}
+	for path, staged := range txn.entities {
+		entity := models.TransactionEntity{
+			ResourceName: staged.ResourceName,
+			ResourceID:   staged.ResourceID,
+		}
+		for _, entry := range staged.Entries {
+			// stamped now, against the log the entries are committed to
+			entry.Clock = known.next(path, deviceID, tl[path])
+			entity.Entries = append(entity.Entries, entry)
+		}
+		added[path] = entity
+	}
+	return putTransactionLog(clientID, peer, privateKey.Public().(*rsa.PublicKey), privateKey, added, digest)
+}
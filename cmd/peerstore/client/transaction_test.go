@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestConcurrentLogUpdatesKeepBothClients(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+	userKey := privateKey.Public().(*rsa.PublicKey)
+
+	const path, updates = "shared.txt", 10
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 2*updates)
+	)
+	// each device reads the log and adds an entry to the same path, as the
+	// client does after a post, at the same time as the other
+	for _, device := range []models.Identifier{deviceA, deviceB} {
+		wg.Add(1)
+		go func(device models.Identifier) {
+			defer wg.Done()
+			clocks := newKnownClocks()
+			for i := 1; i <= updates; i++ {
+				tl, err := GetTransactionLog(id, n.peer, userKey, privateKey)
+				if err != nil && !isNoTransactionLog(err) {
+					errs <- err
+					return
+				}
+				added := models.TransactionLog{path: models.TransactionEntity{
+					ResourceName: path,
+					ResourceID:   fileToKeyIdentifier(path),
+					Entries: []models.TransactionEntry{{
+						Operation: models.UpdateOperation,
+						ClientID:  device,
+						Timestamp: uint64(i),
+						Clock:     clocks.next(path, device, tl[path]),
+					}},
+				}}
+				if err := PutTransactionLog(id, n.peer, userKey, privateKey, added); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(device)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	tl, err := GetTransactionLog(id, n.peer, userKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[models.Identifier]int{}
+	for _, entry := range tl[path].Entries {
+		count[entry.ClientID]++
+	}
+	if count[deviceA] != updates || count[deviceB] != updates {
+		t.Errorf("expected %d entries from each device to survive, got %d and %d",
+			updates, count[deviceA], count[deviceB])
+	}
+}
+
+func TestCommitToChangedLogRefused(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+	userKey := privateKey.Public().(*rsa.PublicKey)
+
+	entity := func(path string) models.TransactionLog {
+		return models.TransactionLog{path: models.TransactionEntity{
+			ResourceName: path,
+			ResourceID:   fileToKeyIdentifier(path),
+			Entries: []models.TransactionEntry{{
+				Operation: models.UpdateOperation,
+				ClientID:  deviceA,
+			}},
+		}}
+	}
+	stale := protocol.TransactionLogDigest(nil)
+	if err := putTransactionLog(id, n.peer, userKey, privateKey, entity("a.txt"), stale); err != nil {
+		t.Fatal(err)
+	}
+	// the log is no longer empty, so entries stamped against it are refused
+	err := putTransactionLog(id, n.peer, userKey, privateKey, entity("b.txt"), stale)
+	if !isLogConflict(err) {
+		t.Fatalf("expected a commit to a changed log refused, got %v", err)
+	}
+
+	// a group commit stamps its entries again against the new log
+	txn := newStagedTransaction()
+	txn.stage("b.txt", fileToKeyIdentifier("b.txt"), models.TransactionEntry{
+		Operation: models.UpdateOperation,
+		ClientID:  deviceA,
+	})
+	if err := txn.commit(id, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := GetTransactionLog(id, n.peer, userKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tl["a.txt"]; !ok {
+		t.Error("expected the first entry kept")
+	}
+	if _, ok := tl["b.txt"]; !ok {
+		t.Error("expected the group committed")
+	}
+}
+
+func TestFailedGroupRolledBack(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	existing := filepath.Join(root, "existing.txt")
+	added := filepath.Join(root, "added.txt")
+	if err := ioutil.WriteFile(existing, []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, existing, n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	before, err := getKey(fileToKeyIdentifier("existing.txt"), id, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old bool) { atomicBackup = old }(atomicBackup)
+	atomicBackup = true
+	txn := newStagedTransaction()
+	for path, data := range map[string]string{existing: "after", added: "added"} {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(id, root, path, n.peer, privateKey, txn, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txn.fail(errors.New("a later post failed"))
+	if err := txn.commit(id, n.peer, privateKey); err == nil {
+		t.Fatal("expected a failed group reported")
+	}
+
+	after, err := getKey(fileToKeyIdentifier("existing.txt"), id, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after.Data, before.Data) {
+		t.Error("expected the replaced file put back")
+	}
+	if _, err := getKey(fileToKeyIdentifier("added.txt"), id, tr); err != protocol.ErrResourceNotFound {
+		t.Errorf("expected the added file deleted, got %v", err)
+	}
+}
+
+func TestFailedCommitRolledBack(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	existing := filepath.Join(root, "existing.txt")
+	added := filepath.Join(root, "added.txt")
+	if err := ioutil.WriteFile(existing, []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, existing, n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	before, err := getKey(fileToKeyIdentifier("existing.txt"), id, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old bool) { atomicBackup = old }(atomicBackup)
+	atomicBackup = true
+	txn := newStagedTransaction()
+	for path, data := range map[string]string{existing: "after", added: "added"} {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := backupFile(id, root, path, n.peer, privateKey, txn, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every post succeeded, but the log they are committed to cannot be read
+	userKey := privateKey.Public().(*rsa.PublicKey)
+	if err := PutTransactionLog(id, n.peer, userKey, privateKey, models.TransactionLog{
+		"existing.txt": models.TransactionEntity{
+			ResourceName: "existing.txt",
+			ResourceID:   fileToKeyIdentifier("existing.txt"),
+			Entries:      []models.TransactionEntry{{Operation: models.UpdateOperation, ClientID: deviceA}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	logKey, err := protocol.TransactionLogKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(storedPath(t, n.dataPath, logKey), []byte("not a transaction log"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.commit(id, n.peer, privateKey); err == nil {
+		t.Fatal("expected a commit to a corrupt log to fail")
+	}
+
+	after, err := getKey(fileToKeyIdentifier("existing.txt"), id, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after.Data, before.Data) {
+		t.Error("expected the replaced file put back")
+	}
+	if _, err := getKey(fileToKeyIdentifier("added.txt"), id, tr); err != protocol.ErrResourceNotFound {
+		t.Errorf("expected the added file deleted, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestTransferOwnership(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+	toID, toKey := registerTestUser(t, n.peer)
+	otherID, otherKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	plaintext := []byte("handed over when offboarding")
+	if err := ioutil.WriteFile(filepath.Join(root, "handover.txt"), plaintext, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupFile(id, root, filepath.Join(root, "handover.txt"), n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := fileToKeyIdentifier("handover.txt")
+
+	if err := transferOwnership(otherID, "handover.txt", otherID, &otherKey.PublicKey, n.peer, otherKey); err == nil {
+		t.Error("expected a transfer by a user who is not an owner rejected")
+	}
+	if err := transferOwnership(id, "handover.txt", toID, &toKey.PublicKey, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new owner reads it with the secret they were given
+	resp, sessionKey := getTestFile(t, key, toID, n.peer, toKey)
+	if got, err := openPayload(sessionKey, resp.Data, resp.Header.Tag); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("the new owner read %q, %v", got, err)
+	}
+	tr, err := createTransport(toID, n.peer, toKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	owners, err := getOwners(key, toID, toKey, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (models.Owner{ID: toID}); len(owners) != 1 || owners[0] != want {
+		t.Errorf("owners after the transfer = %+v, expected %+v", owners, want)
+	}
+
+	// and the original owner can no longer get it
+	tr, err = createTransport(id, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if resp, err := getKey(key, id, tr); err == nil && resp.Status == protocol.Success {
+		t.Error("expected the original owner unable to get the file")
+	}
+	if err := transferOwnership(id, "handover.txt", id, &privateKey.PublicKey, n.peer, privateKey); err == nil {
+		t.Error("expected the original owner unable to transfer the file back")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// uploadChunkSize - the size of each chunk a streamed file is posted in
+const uploadChunkSize = 8 << 20
+
+// errUploadsNotStaged - the node would store each chunk of an upload as it
+// came, rather than staging them until the last
+var errUploadsNotStaged = errors.New("node does not stage chunked uploads, upgrade it to upload files larger than a chunk")
+
+// postPayload - post the data read from payload as the resource described by
+// header.  A chunked payload is read and posted uploadChunkSize bytes at a
+// time, each chunk but the last marked as having more to follow, so the whole
+// payload is never held in memory.  The node stages the chunks, and replaces
+// the resource only once the last is posted, so an upload is never half
+// stored; nodes which do not are refused any payload larger than a chunk.
+// Otherwise it is posted in a single request.  Every request carries the
+// integrity tag of the payload up to its end, keyed from sessionKey.  Returns
+// the response to the first chunk which was not stored, or to the last chunk.
+func postPayload(t *protocol.Transport, header protocol.Header, sessionKey []byte, payload io.Reader, chunked bool) (protocol.Response, error) {
+	mac := newPayloadMAC(sessionKey)
+	if !chunked {
+		data, err := ioutil.ReadAll(payload)
+		if err != nil {
+			return protocol.Response{}, errors.Wrap(err, "failed to read payload")
+		}
+		mac.Write(data)
+		header.DataLength = uint64(len(data))
+		header.Tag = mac.Sum(nil)
+		return roundTrip(t, &protocol.Request{
+			Header: header,
+			Method: protocol.PostFileMethod,
+			Data:   data,
+		})
+	}
+
+	// a chunk is read ahead of the one posted, to tell whether it is the last
+	var (
+		chunk, next = make([]byte, uploadChunkSize), make([]byte, uploadChunkSize)
+		offset      uint64
+	)
+	n, err := readChunk(payload, chunk)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	for {
+		m, err := readChunk(payload, next)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+		if m > 0 && offset == 0 {
+			ctx, cancel := requestContext()
+			staged, err := t.StagesUploads(ctx)
+			cancel()
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			if !staged {
+				return protocol.Response{}, errUploadsNotStaged
+			}
+		}
+		mac.Write(chunk[:n])
+		header.Offset = offset
+		header.DataLength = uint64(n)
+		header.Tag = mac.Sum(nil)
+		header.More = m > 0
+		resp, err := roundTrip(t, &protocol.Request{
+			Header: header,
+			Method: protocol.PostFileMethod,
+			Data:   chunk[:n],
+		})
+		if err != nil || resp.Status != protocol.Success || m == 0 {
+			return resp, err
+		}
+		offset += uint64(n)
+		if offset%(64*uploadChunkSize) == 0 {
+			log.Printf("uploaded %d bytes of %s", offset, header.ResourceName)
+		}
+		chunk, next, n = next, chunk, m
+	}
+}
+
+// readChunk - fill chunk from payload, returning how much of it was read,
+// which is short only at the end of the payload
+func readChunk(payload io.Reader, chunk []byte) (int, error) {
+	n, err := io.ReadFull(payload, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read payload")
+	}
+	return n, nil
+}
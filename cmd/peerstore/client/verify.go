@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// verifyReport - what verifyTree found, by resource name
+type verifyReport struct {
+	matched int
+	// mismatched - files whose remote copy has different contents
+	mismatched []string
+	// missingRemote - files under the root which are not stored remotely
+	missingRemote []string
+	// missingLocal - files the transaction log records which are not under
+	// the root
+	missingLocal []string
+	// failed - files whose remote copy could not be fetched or decrypted
+	failed []string
+}
+
+// ok - did every file match its remote copy
+func (vr verifyReport) ok() bool {
+	return len(vr.mismatched)+len(vr.missingRemote)+len(vr.missingLocal)+len(vr.failed) == 0
+}
+
+// print - log each problem found, and a summary
+func (vr verifyReport) print(root string) {
+	for _, problem := range []struct {
+		what  string
+		names []string
+	}{
+		{"differs from the remote copy", vr.mismatched},
+		{"is not stored remotely", vr.missingRemote},
+		{"is stored remotely, but missing locally", vr.missingLocal},
+		{"could not be verified", vr.failed},
+	} {
+		sort.Strings(problem.names)
+		for _, name := range problem.names {
+			log.Printf("%s %s", name, problem.what)
+		}
+	}
+	log.Printf("verified %s: %d match, %d differ, %d not stored remotely, %d missing locally, %d failed",
+		root, vr.matched, len(vr.mismatched), len(vr.missingRemote), len(vr.missingLocal), len(vr.failed))
+}
+
+// verifyTree - check every file under root which is not excluded matches
+// its remote copy, fetching and decrypting it and comparing the sha256 of
+// the two, and that every file the transaction log records is under root.
+// Nothing is changed, locally or remotely.  Directories and symbolic links
+// are not checked.
+func verifyTree(id models.Identifier, root string, peer models.Node, privateKey *rsa.PrivateKey) (verifyReport, error) {
+	var report verifyReport
+	rules, err := loadIgnoreRules(root, excludes)
+	if err != nil {
+		return report, err
+	}
+
+	local := make(map[string]bool)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := resourceName(root, path)
+		if err != nil {
+			return err
+		}
+		if rules.excluded(name, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || isSymlink(fi) {
+			return nil
+		}
+		local[name] = true
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", name)
+		}
+		remote, err := remoteHash(id, fileToKeyIdentifier(name), peer, privateKey)
+		switch {
+		case errors.Cause(err) == protocol.ErrResourceNotFound:
+			report.missingRemote = append(report.missingRemote, name)
+		case err != nil:
+			log.Printf("failed to verify %s: %s", name, err)
+			report.failed = append(report.failed, name)
+		case !bytes.Equal(sum[:], remote):
+			report.mismatched = append(report.mismatched, name)
+		default:
+			report.matched++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, errors.Wrap(err, "verify stopped")
+	}
+
+	tl, err := GetTransactionLog(id, peer, privateKey.Public().(*rsa.PublicKey), privateKey)
+	if err != nil && !isNoTransactionLog(err) {
+		return report, errors.Wrap(err, "failed to get transaction log")
+	}
+	for name, entity := range tl {
+		if len(entity.Entries) == 0 || local[name] || rules.excluded(name, false) {
+			continue
+		}
+		if newestChange(entity.Latest()).Operation == models.UpdateOperation {
+			report.missingLocal = append(report.missingLocal, name)
+		}
+	}
+	return report, nil
+}
+
+// remoteHash - the sha256 of the decrypted contents of the resource key
+func remoteHash(id, key models.Identifier, peer models.Node, privateKey *rsa.PrivateKey) ([]byte, error) {
+	d, err := startDownload(id, key, 0, peer, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	h := sha256.New()
+	if err := d.writeTo(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestVerifyTree(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	root, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("docs/notes.txt", "as backed up")
+	write("todo.txt", "verify the backup")
+	write("gone.txt", "removed locally")
+	if err := backupTree(id, root, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := verifyTree(id, root, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.ok() || report.matched != 3 {
+		t.Errorf("expected a clean backup verified, got %+v", report)
+	}
+
+	// changed, added and removed locally, none of it backed up
+	write("docs/notes.txt", "changed since")
+	write("new.txt", "never backed up")
+	if err := os.Remove(filepath.Join(root, "gone.txt")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = verifyTree(id, root, n.peer, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := verifyReport{
+		matched:       1,
+		mismatched:    []string{"docs/notes.txt"},
+		missingRemote: []string{"new.txt"},
+		missingLocal:  []string{"gone.txt"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("verify reported %+v, expected %+v", report, want)
+	}
+}
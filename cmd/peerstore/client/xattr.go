@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"log"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// xattrsSuffix - the extended attributes of a file are stored as their own
+// resource, keyed off the file's name with this suffix.  It starts with a
+// NUL, which no file name can contain, so the key never collides with the
+// key of a real file.
+const xattrsSuffix = "\x00xattrs"
+
+// xattrsName - the resource name the extended attributes of the file name,
+// a normalized resource name, are stored under
+func xattrsName(name string) string {
+	return name + xattrsSuffix
+}
+
+// backupXattrs - capture the extended attributes of the file at path, stored
+// as the resource name, and post them encrypted with the file's session key,
+// so only the owners of the file can read them back
+func backupXattrs(id models.Identifier, name, path string, sessionKey, secret []byte, t *protocol.Transport, privateKey *rsa.PrivateKey) error {
+	attrs, err := readXattrs(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read xattrs")
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(attrs); err != nil {
+		return errors.Wrap(err, "failed to encode xattrs")
+	}
+
+	ciphertext, err := sealPayload(sessionKey, buf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt xattrs")
+	}
+
+	key := fileToKeyIdentifier(xattrsName(name))
+	node, err := lookupNode(key, id, t)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	log.Printf("posting %d xattrs for %s", len(attrs), path)
+	_, err = roundTrip(st, &protocol.Request{
+		Header: protocol.Header{
+			Key:          key,
+			Type:         protocol.UserType,
+			From:         id,
+			DataLength:   uint64(len(ciphertext)),
+			PubKey:       privateKey.Public().(*rsa.PublicKey),
+			ResourceName: xattrsName(name),
+			Secret:       secret,
+			Tag:          payloadTag(sessionKey, ciphertext),
+		},
+		Method: protocol.PostFileMethod,
+		Data:   ciphertext,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to post xattrs")
+	}
+	return nil
+}
+
+// restoreXattrs - fetch the extended attributes stored for filename and
+// apply them to dest.  A file which was backed up without xattrs is skipped,
+// any other failure to fetch them is returned.
+func restoreXattrs(id models.Identifier, filename, dest string, t *protocol.Transport, privateKey *rsa.PrivateKey) error {
+	key := fileToKeyIdentifier(xattrsName(filename))
+	node, err := getNode(key, id, t)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	resp, err := getKey(key, id, st)
+	if errors.Cause(err) == protocol.ErrResourceNotFound {
+		// no xattrs were stored for this file
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get xattrs")
+	}
+	sessionKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt session key")
+	}
+	if err := verifyPayloadTag(sessionKey, resp.Data, resp.Header.Tag); err != nil {
+		return errors.Wrap(err, "failed to verify xattrs")
+	}
+	plaintext, err := openPayload(sessionKey, resp.Data, resp.Header.Tag)
+	if err != nil {
+		return errors.Wrap(err, "failed to decrypt xattrs")
+	}
+
+	var attrs = map[string][]byte{}
+	if err := gob.NewDecoder(bytes.NewBuffer(plaintext)).Decode(&attrs); err != nil {
+		return errors.Wrap(err, "failed to decode xattrs")
+	}
+	log.Printf("applying %d xattrs to %s", len(attrs), dest)
+	return writeXattrs(dest, attrs)
+}
+
+// deleteXattrs - delete the extended attributes stored for the file name,
+// which has been deleted, so they do not outlive it.  A file backed up
+// without xattrs has none to delete.  Only called with -xattrs, so deletes
+// without it make no extra round trips.
+func deleteXattrs(id models.Identifier, name string, peer models.Node, privateKey *rsa.PrivateKey) error {
+	key := fileToKeyIdentifier(xattrsName(name))
+	node, err := findWriteNode(key, id, peer, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node")
+	}
+	st, err := createTransport(id, node, privateKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport")
+	}
+	defer st.Close()
+
+	resp, err := roundTrip(st, &protocol.Request{
+		Header: protocol.Header{
+			Key:    key,
+			Type:   protocol.UserType,
+			From:   id,
+			PubKey: privateKey.Public().(*rsa.PublicKey),
+		},
+		Method: protocol.DeleteFileMethod,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete xattrs")
+	}
+	if err := resp.Err(); err != nil && err != protocol.ErrResourceNotFound {
+		return errors.Wrap(err, "failed to delete xattrs")
+	}
+	return nil
+}
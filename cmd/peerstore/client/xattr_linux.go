@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// listxattr - the names of the extended attributes of the file at path,
+// NUL separated, into dest, or the size they need with an empty dest
+func listxattr(path string, dest []byte) (int, error) {
+	return syscall.Listxattr(path, dest)
+}
+
+// getxattr - the value of the extended attribute name of the file at path
+// into dest, or the size it needs with an empty dest
+func getxattr(path, name string, dest []byte) (int, error) {
+	return syscall.Getxattr(path, name, dest)
+}
+
+// setxattr - set the extended attribute name of the file at path to value
+func setxattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
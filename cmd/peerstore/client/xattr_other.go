@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+// readXattrs - extended attributes are not supported on this platform, so
+// there is nothing to read
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs - extended attributes are not supported on this platform, so
+// they are skipped
+func writeXattrs(path string, attrs map[string][]byte) error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestXattrsDeletedWithFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	root, err := ioutil.TempDir("", "xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "tagged.txt")
+	if err := ioutil.WriteFile(path, []byte("tagged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"user.peerstore.test": []byte("red")}
+	if err := writeXattrs(path, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readXattrs(path); err != nil || !bytes.Equal(got["user.peerstore.test"], want["user.peerstore.test"]) {
+		t.Skipf("xattrs not supported here: %v, %v", got, err)
+	}
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	defer func(old bool) { xattrs = old }(xattrs)
+	xattrs = true
+	if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	key := fileToKeyIdentifier(xattrsName("tagged.txt"))
+	if key == fileToKeyIdentifier("tagged.txt-xattrs") {
+		t.Error("expected the xattrs key apart from the key of any file")
+	}
+	if findStored(n.dataPath, key) == "" {
+		t.Fatal("expected the xattrs stored")
+	}
+
+	if err := DeleteFile(id, "tagged.txt", n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if findStored(n.dataPath, key) != "" {
+		t.Error("expected the xattrs deleted along with the file")
+	}
+}
+
+func TestRestoreXattrs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	root, err := ioutil.TempDir("", "xattrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "tagged.txt")
+	if err := ioutil.WriteFile(path, []byte("tagged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"user.peerstore.test": []byte("red")}
+	if err := writeXattrs(path, want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readXattrs(path); err != nil || !bytes.Equal(got["user.peerstore.test"], want["user.peerstore.test"]) {
+		t.Skipf("xattrs not supported here: %v, %v", got, err)
+	}
+
+	n := startTestNode(t, models.Node{}, models.RingSettings{
+		SuccessorListLength: 1,
+		ReplicationFactor:   1,
+	})
+	defer n.stop()
+	id, privateKey := registerTestUser(t, n.peer)
+
+	defer func(old bool) { xattrs = old }(xattrs)
+	xattrs = true
+	if err := backupFile(id, root, path, n.peer, privateKey, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(root, "restored.txt")
+	if err := ioutil.WriteFile(dest, []byte("tagged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreAttributes(id, "tagged.txt", dest, n.peer, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readXattrs(dest); err != nil || !bytes.Equal(got["user.peerstore.test"], want["user.peerstore.test"]) {
+		t.Errorf("restored xattrs = %v, %v, expected %v", got, err, want)
+	}
+
+	// a file backed up without xattrs has none to restore
+	if err := restoreAttributes(id, "untagged.txt", dest, n.peer, privateKey); err != nil {
+		t.Errorf("restoring xattrs never stored = %v, expected them skipped", err)
+	}
+
+	// any other failure is not mistaken for a file without xattrs
+	otherID, otherKey := registerTestUser(t, n.peer)
+	if err := restoreAttributes(otherID, "tagged.txt", dest, n.peer, otherKey); err == nil {
+		t.Error("expected restoring xattrs we do not own to fail")
+	}
+}
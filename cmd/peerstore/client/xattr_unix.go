@@ -0,0 +1,65 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// xattrUnsupported - errors which mean the platform or filesystem does not
+// support extended attributes, which we skip silently
+func xattrUnsupported(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP
+}
+
+// readXattrs - read all of the extended attributes of the file at path
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := listxattr(path, nil)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to list xattrs: ")
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = listxattr(path, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to list xattrs: ")
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		size, err := getxattr(path, name, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get xattr %s: ", name)
+		}
+		value := make([]byte, size)
+		if size, err = getxattr(path, name, value); err != nil {
+			return nil, errors.Wrapf(err, "failed to get xattr %s: ", name)
+		}
+		attrs[name] = value[:size]
+	}
+	return attrs, nil
+}
+
+// writeXattrs - apply the extended attributes to the file at path
+func writeXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if err := setxattr(path, name, value); err != nil {
+			if xattrUnsupported(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "failed to set xattr %s: ", name)
+		}
+	}
+	return nil
+}
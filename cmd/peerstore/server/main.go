@@ -1,21 +1,22 @@
 package main
 
 import (
-	"crypto/rsa"
-	"crypto/sha1"
+	"crypto/tls"
 	"encoding/hex"
 	"flag"
-	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/husobee/peerstore/chord"
 	"github.com/husobee/peerstore/crypto"
 	"github.com/husobee/peerstore/file"
 	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/node"
 	"github.com/husobee/peerstore/protocol"
 	"github.com/pkg/errors"
 )
@@ -25,6 +26,11 @@ var (
 
 	// addr - the address for the server to listen on
 	addr string
+	// listenAddr - the address for the server to bind to, defaults to addr
+	listenAddr string
+	// advertiseAddr - the address peers should use to reach this server,
+	// which is what is put in the Node responses, defaults to listenAddr
+	advertiseAddr string
 	// initialPeerAddr - the address for a known peer on the network
 	initialPeerAddr string
 	// initialPeerKeyFile - the key file location for a known peer on the network
@@ -35,6 +41,40 @@ var (
 	requestQueueBuffer uint
 	// requestNumWorkers - the number of request processing workers
 	requestNumWorkers uint
+	// breakerThreshold - consecutive failures before a peer is skipped
+	breakerThreshold int
+	// breakerCooldown - how long a failing peer is skipped before a probe
+	breakerCooldown time.Duration
+	// keepVersions - the number of previous versions of each file to retain
+	keepVersions uint
+	// shardDepth - the levels of subdirectories of dataPath resources are
+	// stored in, zero stores them in dataPath itself
+	shardDepth int
+	// minFreeSpace - the bytes of disk space to keep free, zero disables
+	minFreeSpace uint64
+	// maxBytesPerUser - the bytes of resource data to store for each owner,
+	// zero disables quotas
+	maxBytesPerUser uint64
+	// readCacheSize - the bytes of recently read files to keep in memory,
+	// zero disables the read cache
+	readCacheSize uint64
+	// maxRequestSize - the largest request to read, in bytes
+	maxRequestSize uint64
+	// successorListLength - the number of immediate successors each node tracks
+	successorListLength int
+	// replicationFactor - the number of successors each resource is stored on
+	replicationFactor int
+	// tlsCertFile, tlsKeyFile - the certificate and key to serve TLS with,
+	// unset serves plain tcp
+	tlsCertFile string
+	tlsKeyFile  string
+	// tlsCAFile - the CA the certificates of other nodes are checked against,
+	// unset trusts the system roots
+	tlsCAFile string
+	// admins - the comma separated ids of the users allowed the admin
+	// operations, adminIDs once parsed
+	admins   string
+	adminIDs []models.Identifier
 )
 
 func init() {
@@ -42,6 +82,12 @@ func init() {
 	flag.StringVar(
 		&addr, "addr", ":3000",
 		"the address for the server to listen")
+	flag.StringVar(
+		&listenAddr, "listenAddr", "",
+		"the address for the server to bind to, defaults to -addr")
+	flag.StringVar(
+		&advertiseAddr, "advertiseAddr", "",
+		"the address peers should use to reach this server, defaults to -listenAddr")
 	flag.StringVar(
 		&initialPeerAddr, "initialPeerAddr", "",
 		"the address of a known peer on the network")
@@ -57,6 +103,48 @@ func init() {
 	flag.UintVar(
 		&requestNumWorkers, "requestNumWorkers", uint(runtime.NumCPU()*2),
 		"the number of server threads for connection processing")
+	flag.IntVar(
+		&breakerThreshold, "breakerThreshold", protocol.DefaultBreakerConfig.FailureThreshold,
+		"the number of consecutive failures before a peer is failed fast, 0 disables")
+	flag.DurationVar(
+		&breakerCooldown, "breakerCooldown", protocol.DefaultBreakerConfig.Cooldown,
+		"how long a failing peer is failed fast before it is probed again")
+	flag.UintVar(
+		&keepVersions, "keepVersions", 0,
+		"the number of previous versions of each file to retain, 0 disables versioning")
+	flag.IntVar(
+		&shardDepth, "shardDepth", 2,
+		"the levels of subdirectories of dataPath files are stored in, each named by the next byte of their keys, so no directory holds too many files.  0 stores them in dataPath itself.  Files stored at another depth are moved on startup")
+	flag.Uint64Var(
+		&minFreeSpace, "minFreeSpace", 0,
+		"the bytes of disk space to keep free, posts which would leave less are rejected, 0 disables the check")
+	flag.Uint64Var(
+		&maxBytesPerUser, "maxBytesPerUser", 0,
+		"the bytes of file data to store for each user, posts which would store more are rejected, 0 disables quotas")
+	flag.Uint64Var(
+		&readCacheSize, "readCacheSize", 0,
+		"the bytes of recently read files to keep in memory, so files read over and over such as transaction logs and public keys are not read from disk each time.  Files larger than a quarter of it are not kept, 0 disables the cache")
+	flag.Uint64Var(
+		&maxRequestSize, "maxRequestSize", protocol.DefaultMaxRequestSize,
+		"the bytes of the largest request to read, a connection sending a larger one is closed.  Files posted by clients without -encryption stream must fit within it")
+	flag.IntVar(
+		&successorListLength, "successorListLength", 1,
+		"the number of immediate successors each node tracks, must be at least -replicationFactor")
+	flag.IntVar(
+		&replicationFactor, "replicationFactor", 1,
+		"the number of successors each resource is stored on, must match across the ring")
+	flag.StringVar(
+		&tlsCertFile, "tlsCert", "",
+		"the pem certificate to serve TLS with, along with -tlsKey.  Other nodes are then also reached over TLS, so every node of the ring must serve it")
+	flag.StringVar(
+		&tlsKeyFile, "tlsKey", "",
+		"the pem private key of -tlsCert")
+	flag.StringVar(
+		&tlsCAFile, "tlsCA", "",
+		"the pem CA certificate the TLS certificates of other nodes are checked against, defaults to the system roots")
+	flag.StringVar(
+		&admins, "admins", "",
+		"the comma separated ids of the users allowed the admin operations, rebalance, drain and stats")
 	flag.Parse()
 }
 
@@ -64,12 +152,46 @@ func validateParams() error {
 	if addr == "" {
 		return errors.New("addr must be set")
 	}
+	if listenAddr == "" {
+		listenAddr = addr
+	}
+	if advertiseAddr == "" {
+		advertiseAddr = listenAddr
+	}
 	if initialPeerAddr == "" {
 		return errors.New("intialPeerAddr must be set")
 	}
+	for _, a := range []struct {
+		flag string
+		addr *string
+	}{
+		{"addr", &addr},
+		{"listenAddr", &listenAddr},
+		{"advertiseAddr", &advertiseAddr},
+		{"initialPeerAddr", &initialPeerAddr},
+	} {
+		normalized, err := models.ParseNodeAddr(*a.addr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", a.flag)
+		}
+		*a.addr = normalized
+	}
 	if dataPath == "" {
 		return errors.New("dataPath must be set")
 	}
+	if shardDepth < 0 || shardDepth > file.MaxShardDepth {
+		return errors.Errorf("shardDepth must be between 0 and %d", file.MaxShardDepth)
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return errors.New("tlsCert and tlsKey must be set together")
+	}
+	if err := ringSettings().Validate(); err != nil {
+		return errors.Wrap(err, "invalid ring settings")
+	}
+	var err error
+	if adminIDs, err = parseAdmins(admins); err != nil {
+		return errors.Wrap(err, "invalid admins")
+	}
 	info, err := os.Stat(dataPath)
 	if err != nil {
 		return errors.Wrap(err, "error attempting to validate dataPath: ")
@@ -81,6 +203,34 @@ func validateParams() error {
 	return nil
 }
 
+// parseAdmins - the user ids of the comma separated list s
+func parseAdmins(s string) ([]models.Identifier, error) {
+	ids := []models.Identifier{}
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		raw, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%q is not a user id", field)
+		}
+		id, err := models.IdentifierFromBytes(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%q is not a user id", field)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ringSettings - the ring settings from the command line flags
+func ringSettings() models.RingSettings {
+	return models.RingSettings{
+		SuccessorListLength: successorListLength,
+		ReplicationFactor:   replicationFactor,
+	}
+}
+
 func main() {
 	defer glog.Flush()
 	// validate our command line parameters
@@ -88,6 +238,25 @@ func main() {
 		glog.Fatalf("failed to validate command line params: %v\n", err)
 	}
 
+	protocol.ConfigureBreakers(protocol.BreakerConfig{
+		FailureThreshold: breakerThreshold,
+		Cooldown:         breakerCooldown,
+	})
+
+	var tlsConfig *tls.Config
+	if tlsCertFile != "" {
+		var err error
+		if tlsConfig, err = protocol.ServerTLSConfig(tlsCertFile, tlsKeyFile); err != nil {
+			glog.Fatalf("failed to load TLS certificate: %v\n", err)
+		}
+		// the rest of the ring serves TLS too
+		dialConfig, err := protocol.ClientTLSConfig(tlsCAFile)
+		if err != nil {
+			glog.Fatalf("failed to load TLS CA: %v\n", err)
+		}
+		protocol.ConfigureTLS(dialConfig)
+	}
+
 	var (
 		// quit - channel to inform the server to stop listening
 		// signal chord to "leave" the network
@@ -97,61 +266,18 @@ func main() {
 		done = make(chan bool)
 	)
 
-	// handle interupts gracefully
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	go func() {
-		for _ = range signalChan {
-			glog.Info("Interrupt, Killing workers")
-			// signal server to quit processing requests
-			quit <- true
-			// wait for server to be finished
-			<-done
-			glog.Info("Done.")
-			os.Exit(0)
-		}
-	}()
-
-	var (
-		peerNode models.Node
-		key      *rsa.PrivateKey
-		err      error
-	)
-
-	privateKeyFile, err := os.Open(
-		fmt.Sprintf("%s/privatekey.pem", dataPath))
+	var peerNode models.Node
 
+	key, err := node.LoadOrCreateKey(dataPath)
 	if err != nil {
-		// generate our public key
-		key, err = crypto.GenerateKeyPair()
-		if err != nil {
-			glog.Infof("failed to generate keypair: %s", err)
-			return
-		}
-		// create our keypair file:
-		privateKeyFile, err := os.Create(
-			fmt.Sprintf("%s/privatekey.pem", dataPath))
-		if err != nil {
-			glog.Infof("failed to create keypair file: %s", err)
-			return
-		}
-		crypto.WritePrivateKeyAsPem(privateKeyFile, key)
-		privateKeyFile.Close()
+		glog.Infof("failed to load keypair: %s", err)
+		return
+	}
 
-		publicKeyFile, err := os.Create(
-			fmt.Sprintf("%s/publickey.pem", dataPath))
-		if err != nil {
-			glog.Infof("failed to create keypair file: %s", err)
-			return
-		}
-		crypto.WritePublicKeyAsPem(publicKeyFile, key.Public().(*rsa.PublicKey))
-		publicKeyFile.Close()
-	} else {
-		key, err = crypto.ReadKeypairAsPem(privateKeyFile)
-		if err != nil {
-			glog.Infof("failed to read keypair: %s", err)
-			return
-		}
+	// resume the clock above every timestamp handed out before a restart
+	if err := models.ConfigureClockFile(filepath.Join(dataPath, "clock")); err != nil {
+		glog.Infof("failed to restore the clock: %s", err)
+		return
 	}
 
 	// if no peer is specified, we are the only one, so dont read a peer
@@ -171,100 +297,77 @@ func main() {
 		peerNode = models.Node{
 			Addr:      initialPeerAddr,
 			PublicKey: &peerKey,
-			ID:        sha1.Sum([]byte(addr)),
-		}
-	}
-
-	// create a server to listen on
-	server, err := protocol.NewServer(
-		key, peerNode, addr, dataPath, requestQueueBuffer, requestNumWorkers)
-	if err != nil {
-		glog.Fatalf("Failed to create new server: %v", err)
-	}
-
-	if initialPeerKeyFile != "" {
-		// need to register with our peer first thing
-		t, err := protocol.NewTransport("tcp", peerNode.Addr, protocol.NodeType, models.Identifier(sha1.Sum([]byte(addr))), peerNode.PublicKey, key)
-		resp, err := t.RoundTrip(&protocol.Request{
-			Header: protocol.Header{
-				From:     models.Identifier(sha1.Sum([]byte(addr))),
-				FromAddr: addr,
-				Type:     protocol.NodeType,
-				PubKey:   key.Public().(*rsa.PublicKey),
-			},
-			Method: protocol.NodeRegistrationMethod,
-		})
-		if err != nil {
-			// failed to register with peer node
-			glog.Infof("failed to register trust with peer node")
-			return
+			ID:        models.HashBytes([]byte(initialPeerAddr)),
 		}
-		glog.Infof("Response from registration: %+v", resp)
-		// TODO: iterate through all nodes in response, and contact all of
-		// them to "NodeTrustMethod" them
 	}
 
-	// create our local chord node.
-	localNode, err := chord.NewLocalNode(server, addr, peerNode)
-
-	glog.Infof("!!! local node: addr=%s, id=%s\n",
-		localNode.Addr,
-		hex.EncodeToString(localNode.ID[:]))
-
+	// create the server, join the ring and route the handlers
+	n, err := node.Start(node.Config{
+		ListenAddr:         listenAddr,
+		AdvertiseAddr:      advertiseAddr,
+		DataPath:           dataPath,
+		Peer:               peerNode,
+		RequestQueueBuffer: requestQueueBuffer,
+		RequestNumWorkers:  requestNumWorkers,
+		KeepVersions:       keepVersions,
+		ShardDepth:         shardDepth,
+		MinFreeSpace:       minFreeSpace,
+		MaxBytesPerUser:    maxBytesPerUser,
+		ReadCacheSize:      readCacheSize,
+		MaxRequestSize:     maxRequestSize,
+		RingSettings:       ringSettings(),
+		TLSConfig:          tlsConfig,
+		Admins:             adminIDs,
+	}, key)
 	if err != nil {
-		// error condition happens when node is unable to connect to
-		// the peer specified, we shall log the error, and use an uninitialized
-		// peer for now
-		glog.Infof("failed to create chord local node: %v\n", err)
+		glog.Fatalf("Failed to start node: %v", err)
 	}
+	localNode := n.Local
 
-	// Start stabilizing!
+	// handle interupts gracefully, on SIGTERM leaving the ring first so
+	// none of our keys are orphaned
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for {
-			select {
-			case <-time.After(10 * time.Second):
-				localNode.Stabilize()
-				// TODO: use quit chan to stop stabilization
+		for sig := range signalChan {
+			if sig == syscall.SIGTERM {
+				glog.Info("Terminated, leaving the ring")
+				result, err := localNode.Leave(dataPath)
+				if err != nil {
+					glog.Warningf("failed to leave the ring cleanly: %v", err)
+				} else {
+					glog.Infof("handed off %d keys", result.Transferred)
+				}
 			}
+			glog.Info("Interrupt, Killing workers")
+			// signal server to quit processing requests
+			quit <- true
+			// wait for server to be finished
+			<-done
+			glog.Info("Done.")
+			os.Exit(0)
 		}
 	}()
 
-	glog.Infof("Starting server - %s, %s, %d, %d",
-		addr, dataPath, requestQueueBuffer, requestNumWorkers)
-
-	// file handler routes
-	server.Handle(protocol.GetFileMethod, file.GetFileHandler)
-	server.Handle(protocol.PostFileMethod, file.PostFileHandler)
-	server.Handle(protocol.GetPublicKeyMethod, file.GetPublicKeyHandler)
-	server.Handle(protocol.PostPublicKeyMethod, file.PostPublicKeyHandler)
-	server.Handle(protocol.DeleteFileMethod, file.DeleteFileHandler)
-	// chord handler routes
-	server.Handle(protocol.GetSuccessorMethod, localNode.SuccessorHandler)
-	server.Handle(protocol.SetPredecessorMethod, localNode.SetPredecessorHandler)
-	server.Handle(protocol.GetPredecessorMethod, localNode.GetPredecessorHandler)
-	server.Handle(protocol.GetFingerTableMethod, localNode.FingerTableHandler)
-	// registration route
-	server.Handle(protocol.UserRegistrationMethod, server.UserRegistrationHandler)
-	// node registration route
-	server.Handle(protocol.NodeRegistrationMethod, server.NodeRegistrationHandler)
-	server.Handle(protocol.NodeTrustMethod, server.NodeTrustHandler)
+	glog.Infof("Starting server - %s (advertised as %s), %s, %d, %d",
+		listenAddr, advertiseAddr, dataPath, requestQueueBuffer, requestNumWorkers)
 
 	go func() {
 		for {
 			select {
 			case <-time.After(30 * time.Second):
-				hash := sha1.Sum([]byte("hello"))
+				hash := models.HashBytes([]byte("hello"))
 
-				node, err := localNode.Successor(models.Identifier(hash))
+				node, err := localNode.Successor(hash)
 				if err != nil {
-					glog.Infof("!!!!!!!!!!!!!!!!! error finding node : %s", err)
+					glog.Infof("error finding node: %s", err)
 					continue
 				}
-				glog.Infof("!!!!!!!!!!!!!!!!! Hash %d goes to node: %s", models.KeyToID(models.Identifier(hash)), node.ToString())
+				glog.V(protocol.DebugLogLevel).Infof("hash %d goes to node: %s", models.KeyToID(hash), node)
 			}
 		}
 	}()
 
 	// serve requests
-	server.Serve(quit, done)
+	n.Serve(quit, done)
 }
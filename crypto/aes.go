@@ -9,13 +9,16 @@ import (
 	"github.com/pkg/errors"
 )
 
-// padPKCS7 - pad input in using the PKCS7 algorithm and return results
+// padPKCS7 - pad input in using the PKCS7 algorithm and return results, in
+// a new slice, as it is encrypted in place and in is the caller's plaintext
 func padPKCS7(in []byte) []byte {
 	padding := 16 - (len(in) % 16)
+	out := make([]byte, len(in), len(in)+padding)
+	copy(out, in)
 	for i := 0; i < padding; i++ {
-		in = append(in, byte(padding))
+		out = append(out, byte(padding))
 	}
-	return in
+	return out
 }
 
 // unpadPKCS7 - unpad in using PKCS7 algorithm and return results
@@ -112,3 +115,46 @@ func Decrypt(key, ciphertext, iv []byte) ([]byte, error) {
 
 	return unpadPKCS7(ciphertext), nil
 }
+
+// EncryptGCM - encrypt with aes256 in gcm mode, which authenticates the
+// ciphertext as well, returns ciphertext, nonce and error
+func EncryptGCM(key, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create gcm: ")
+	}
+
+	// create nonce, which must never repeat for the same key
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate nonce: ")
+	}
+
+	return aead.Seal(nil, nonce, plaintext, nil), nonce, nil
+}
+
+// DecryptGCM - decrypt with aes256 in gcm mode, returns plaintext and an
+// error if the ciphertext was tampered with or the key is wrong
+func DecryptGCM(key, ciphertext, nonce []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gcm: ")
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("nonce is the wrong size")
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate ciphertext: ")
+	}
+	return plaintext, nil
+}
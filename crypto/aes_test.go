@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// cbcVectors - AES-256-CBC with PKCS7 padding, as stored files are
+// encrypted.  The first block of the first is the CBC-AES256 vector of NIST
+// SP 800-38A, the block after it the padding.
+var cbcVectors = []struct {
+	key, iv, plaintext, ciphertext string
+}{
+	{
+		key:        "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4",
+		iv:         "000102030405060708090a0b0c0d0e0f",
+		plaintext:  "6bc1bee22e409f96e93d7e117393172a",
+		ciphertext: "f58c4c04d6e5f1ba779eabfb5f7bfbd6485a5c81519cf378fa36d42b8547edc0",
+	},
+	{
+		key:        "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4",
+		iv:         "000102030405060708090a0b0c0d0e0f",
+		plaintext:  "",
+		ciphertext: "7e9248e5d829ca7593f0c549db2f5b8c",
+	},
+	{
+		key:        "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4",
+		iv:         "000102030405060708090a0b0c0d0e0f",
+		plaintext:  hex.EncodeToString([]byte("peerstore")),
+		ciphertext: "791294206cab991ffbadf8e690515f08",
+	},
+}
+
+// unhex - decode the hex string s
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptWithIVVectors(t *testing.T) {
+	for _, v := range cbcVectors {
+		key, iv, plaintext := unhex(t, v.key), unhex(t, v.iv), unhex(t, v.plaintext)
+		ciphertext, usedIV, err := EncryptWithIV(key, plaintext, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(ciphertext); got != v.ciphertext {
+			t.Errorf("EncryptWithIV(%q) = %s, expected %s", plaintext, got, v.ciphertext)
+		}
+		if !bytes.Equal(usedIV, unhex(t, v.iv)) {
+			t.Errorf("expected the iv given reused, got %x", usedIV)
+		}
+		decrypted, err := Decrypt(key, unhex(t, v.ciphertext), iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("Decrypt(%s) = %q, expected %q", v.ciphertext, decrypted, plaintext)
+		}
+	}
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	key := unhex(t, cbcVectors[0].key)
+	for _, size := range []int{0, 1, 15, 16, 17, 1000} {
+		plaintext := bytes.Repeat([]byte{'p'}, size)
+		// spare capacity the padding could be appended into
+		original := append(make([]byte, 0, size+32), plaintext...)
+
+		ciphertext, iv, err := Encrypt(key, original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(iv) != 16 {
+			t.Errorf("expected a 16 byte iv, got %d", len(iv))
+		}
+		if len(ciphertext) != (size/16+1)*16 {
+			t.Errorf("%d bytes encrypted to %d, expected them padded to the next block", size, len(ciphertext))
+		}
+		if !bytes.Equal(original, plaintext) {
+			t.Errorf("encrypting %d bytes changed the plaintext", size)
+		}
+		decrypted, err := Decrypt(key, ciphertext, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes did not round trip", size)
+		}
+	}
+
+	// the iv is random, so the same plaintext encrypts differently
+	a, _, err := Encrypt(key, []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := Encrypt(key, []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("expected a fresh iv for each encryption")
+	}
+}
+
+func TestEncryptAndDecryptGCM(t *testing.T) {
+	key := make([]byte, sessionKeySize)
+	plaintext := []byte("authenticated contents")
+
+	ciphertext, nonce, err := EncryptGCM(key, plaintext)
+	if err != nil {
+		t.Error(err)
+	}
+	decrypted, err := DecryptGCM(key, ciphertext, nonce)
+	if err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("decrypted doesnt match: %s != %s", decrypted, plaintext)
+	}
+
+	ciphertext[0] ^= 1
+	if _, err := DecryptGCM(key, ciphertext, nonce); err == nil {
+		t.Error("tampered ciphertext was decrypted")
+	}
+}
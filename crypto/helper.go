@@ -24,3 +24,18 @@ func GenerateSessionKey(key *rsa.PublicKey) ([]byte, []byte, error) {
 	}
 	return b[:], ciphertext, nil
 }
+
+// WrapSessionKey - the session key encrypted with each of keys, in order, as
+// the secrets of the users they belong to, so a resource encrypted with it
+// can be shared with all of them
+func WrapSessionKey(sessionKey []byte, keys []*rsa.PublicKey) ([][]byte, error) {
+	secrets := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		secret, err := EncryptRSA(key, sessionKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encrypt for key %d: ", i)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
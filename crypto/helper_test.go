@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestGenerateSessionKey(t *testing.T) {
+	key, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionKey, secret, err := GenerateSessionKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessionKey) != sessionKeySize {
+		t.Errorf("expected a %d byte session key, got %d", sessionKeySize, len(sessionKey))
+	}
+	// nodes take the secret of a request to be exactly this long, the
+	// sessionKeyLen of the file package
+	if len(secret) != 256 {
+		t.Errorf("expected a 256 byte secret, got %d", len(secret))
+	}
+	decrypted, err := DecryptRSA(key, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, sessionKey) {
+		t.Error("the secret does not decrypt to the session key")
+	}
+
+	// the session key encrypts stored files
+	ciphertext, iv, err := Encrypt(sessionKey, []byte("stored file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := Decrypt(decrypted, ciphertext, iv); err != nil || string(plaintext) != "stored file" {
+		t.Errorf("expected the stored file decrypted, got %q, %v", plaintext, err)
+	}
+
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptRSA(other, secret); err == nil {
+		t.Error("the secret decrypted with another key")
+	}
+}
+
+func TestWrapSessionKey(t *testing.T) {
+	var (
+		keys    []*rsa.PrivateKey
+		publics []*rsa.PublicKey
+	)
+	for i := 0; i < 3; i++ {
+		key, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, publics = append(keys, key), append(publics, &key.PublicKey)
+	}
+	sessionKey := bytes.Repeat([]byte{0x5e}, sessionKeySize)
+
+	secrets, err := WrapSessionKey(sessionKey, publics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != len(keys) {
+		t.Fatalf("got %d secrets for %d keys", len(secrets), len(keys))
+	}
+	for i, key := range keys {
+		decrypted, err := DecryptRSA(key, secrets[i])
+		if err != nil || !bytes.Equal(decrypted, sessionKey) {
+			t.Errorf("secret %d does not decrypt to the session key with its key: %v", i, err)
+		}
+		if _, err := DecryptRSA(keys[(i+1)%len(keys)], secrets[i]); err == nil {
+			t.Errorf("secret %d decrypted with another key", i)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"hash"
+)
+
+// HMACSize - the length of the tags produced by ComputeHMAC
+const HMACSize = sha256.Size
+
+// integrityInfo - the HKDF info binding keys from DeriveHMACKey to their use
+// as payload integrity keys, so they never equal a key derived for anything
+// else from the same session key
+var integrityInfo = []byte("peerstore payload integrity")
+
+// DeriveHMACKey - derive the key of the integrity tags of a payload from its
+// session key with HKDF-SHA256, so the encryption key is never used as is
+// for anything but encryption
+func DeriveHMACKey(sessionKey []byte) []byte {
+	// extract, with the zero salt of RFC 5869
+	prk := ComputeHMAC(make([]byte, sha256.Size), sessionKey)
+	// expand, a single block is the whole key
+	return ComputeHMAC(prk, append(append([]byte{}, integrityInfo...), 1))
+}
+
+// NewHMAC - an HMAC-SHA256 keyed with key, for tagging payloads which are
+// too large to hold in memory as they are written
+func NewHMAC(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
+
+// ComputeHMAC - the HMAC-SHA256 tag of data keyed with key
+func ComputeHMAC(key, data []byte) []byte {
+	mac := NewHMAC(key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// VerifyHMAC - check that tag is the HMAC-SHA256 of data keyed with key, in
+// constant time
+func VerifyHMAC(key, data, tag []byte) bool {
+	return hmac.Equal(ComputeHMAC(key, data), tag)
+}
@@ -0,0 +1,30 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerifyHMAC(t *testing.T) {
+	key := DeriveHMACKey(make([]byte, sessionKeySize))
+	payload := []byte("stored payload contents")
+	tag := ComputeHMAC(key, payload)
+
+	if !VerifyHMAC(key, payload, tag) {
+		t.Error("tag of an untouched payload did not verify")
+	}
+
+	flipped := append([]byte{}, payload...)
+	flipped[3] ^= 0x10
+	if VerifyHMAC(key, flipped, tag) {
+		t.Error("tag verified a payload with a flipped bit")
+	}
+
+	if VerifyHMAC(key, payload[:len(payload)-1], tag) {
+		t.Error("tag verified a truncated payload")
+	}
+
+	if bytes.Equal(key, DeriveHMACKey(bytes.Repeat([]byte{1}, sessionKeySize))) {
+		t.Error("different session keys derived the same integrity key")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 
+	"github.com/husobee/peerstore/models"
 	"github.com/pkg/errors"
 )
 
@@ -37,6 +38,77 @@ func WritePrivateKeyAsPem(w io.Writer, key *rsa.PrivateKey) error {
 	return nil
 }
 
+// WriteKeypairAsPem - write both the private and public key of a keypair in
+// PEM formatting, which is the layout of a key file
+func WriteKeypairAsPem(w io.Writer, key *rsa.PrivateKey) error {
+	if err := WritePrivateKeyAsPem(w, key); err != nil {
+		return err
+	}
+	return WritePublicKeyAsPem(w, key.Public().(*rsa.PublicKey))
+}
+
+// ErrIncorrectPassphrase - the passphrase does not decrypt the private key
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// ErrPassphraseRequired - the private key is encrypted, and no passphrase
+// was given to decrypt it with
+var ErrPassphraseRequired = errors.New("private key is encrypted, a passphrase is required")
+
+// WriteEncryptedPrivateKeyAsPem - convert a keypair to PEM formatting for
+// storage, with the private key encrypted with passphrase, so the key file
+// alone is not enough to use the identity.
+func WriteEncryptedPrivateKeyAsPem(w io.Writer, key *rsa.PrivateKey, passphrase []byte) error {
+	block, err := x509.EncryptPEMBlock(rand.Reader, "PRIVATE KEY",
+		x509.MarshalPKCS1PrivateKey(key), passphrase, x509.PEMCipherAES256)
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt private key of keypair: ")
+	}
+	if err := pem.Encode(w, block); err != nil {
+		return errors.Wrap(err, "failed to encode private key of keypair: ")
+	}
+	return nil
+}
+
+// ReadEncryptedKeypairAsPem - read the private key from a PEM key file whose
+// private key was written by WriteEncryptedPrivateKeyAsPem.  Returns
+// ErrIncorrectPassphrase if passphrase does not decrypt it, and
+// ErrPassphraseRequired if it is empty.  A private key which is not encrypted
+// is read as is.
+func ReadEncryptedKeypairAsPem(r io.Reader, passphrase []byte) (*rsa.PrivateKey, error) {
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read file: ")
+	}
+	for len(rest) > 0 {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return nil, errors.New("invalid pem encoded key file")
+		}
+		if block.Type != "PRIVATE KEY" {
+			continue
+		}
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) {
+			if len(passphrase) == 0 {
+				return nil, ErrPassphraseRequired
+			}
+			if der, err = x509.DecryptPEMBlock(block, passphrase); err != nil {
+				return nil, ErrIncorrectPassphrase
+			}
+		}
+		key, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			if x509.IsEncryptedPEMBlock(block) {
+				// a wrong passphrase can still unpad correctly
+				return nil, ErrIncorrectPassphrase
+			}
+			return nil, errors.New("unable to parse private key from block")
+		}
+		return key, nil
+	}
+	return nil, errors.New("pem encoded key file did not include a private key")
+}
+
 // WritePublicKeyAsPem - convert a keypair to PEM formatting for storage.  This
 // will be used for storing the keypair to disk.
 func WritePublicKeyAsPem(w io.Writer, key *rsa.PublicKey) error {
@@ -65,6 +137,18 @@ func GobEncodePublicKey(pub *rsa.PublicKey) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// PublicKeyFingerprint - the identifier of the user or node with the public
+// key pub in hex, derived as models.HashBytes of the gob encoded key, so two
+// users can check out of band that a key file is the one they meant.  Empty
+// if the key cannot be encoded.
+func PublicKeyFingerprint(pub *rsa.PublicKey) string {
+	b, err := GobEncodePublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	return models.HashBytes(b).String()
+}
+
 // GobDecodePublicKey - decode the public key from gob formatting.
 func GobDecodePublicKey(b []byte) (*rsa.PublicKey, error) {
 	var pub = new(rsa.PublicKey)
@@ -75,6 +159,8 @@ func GobDecodePublicKey(b []byte) (*rsa.PublicKey, error) {
 	return pub, nil
 }
 
+// ReadKeypairAsPem - read the private key from a PEM key file.  Returns
+// ErrPassphraseRequired if the private key is encrypted.
 func ReadKeypairAsPem(r io.Reader) (*rsa.PrivateKey, error) {
 	var (
 		key   *rsa.PrivateKey
@@ -104,6 +190,9 @@ func ReadKeypairAsPem(r io.Reader) (*rsa.PrivateKey, error) {
 		// if this block is a private key block...
 		if block.Type == "PRIVATE KEY" {
 			privFound = true
+			if x509.IsEncryptedPEMBlock(block) {
+				return nil, ErrPassphraseRequired
+			}
 			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
 				return nil, errors.New("unable to parse private key from block")
 			}
@@ -2,7 +2,12 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"testing"
+
+	"github.com/husobee/peerstore/models"
 )
 
 func TestReadAndWriteKeypairAsPem(t *testing.T) {
@@ -32,3 +37,65 @@ func TestReadAndWriteKeypairAsPem(t *testing.T) {
 		t.Error("original key doesnt match new key")
 	}
 }
+
+func TestReadAndWriteEncryptedKeypairAsPem(t *testing.T) {
+	k, err := GenerateKeyPair()
+	if err != nil {
+		t.Error(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteEncryptedPrivateKeyAsPem(buf, k, []byte("secret")); err != nil {
+		t.Error(err)
+	}
+	if err := WritePublicKeyAsPem(buf, k.Public().(*rsa.PublicKey)); err != nil {
+		t.Error(err)
+	}
+	pemBytes := buf.Bytes()
+
+	if _, err := ReadEncryptedKeypairAsPem(bytes.NewBuffer(pemBytes), []byte("wrong")); err != ErrIncorrectPassphrase {
+		t.Error("expected incorrect passphrase, got ", err)
+	}
+	if _, err := ReadKeypairAsPem(bytes.NewBuffer(pemBytes)); err != ErrPassphraseRequired {
+		t.Error("expected a passphrase required, got ", err)
+	}
+	kPrime, err := ReadEncryptedKeypairAsPem(bytes.NewBuffer(pemBytes), []byte("secret"))
+	if err != nil {
+		t.Error(err)
+	}
+	if kPrime == nil || k.D.Cmp(kPrime.D) != 0 {
+		t.Error("original key doesnt match new key")
+	}
+}
+
+func TestPublicKeyFingerprint(t *testing.T) {
+	k, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GobEncodePublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// identifiers are SHA-256 hashes, see models.NewIdentifierHash
+	sum := sha256.Sum256(b)
+	fingerprint := PublicKeyFingerprint(&k.PublicKey)
+	if fingerprint != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the hash of the gob encoded key, got %s", fingerprint)
+	}
+	if fingerprint != models.HashBytes(b).String() {
+		t.Errorf("expected the identifier of the key, got %s", fingerprint)
+	}
+
+	// the public key read back from a key file has the same fingerprint
+	buf := &bytes.Buffer{}
+	if err := WriteKeypairAsPem(buf, k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ReadPublicKeyAsPem(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := PublicKeyFingerprint(&pub); got != fingerprint {
+		t.Errorf("expected %s from the key file, got %s", fingerprint, got)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
@@ -55,3 +57,81 @@ func DecryptRSA(key *rsa.PrivateKey, ciphertext []byte) ([]byte, error) {
 	}
 	return session, nil
 }
+
+// RequestDigest - what a user signs of a request: its method, the key and
+// name of the resource, its data, its clock, every header field which
+// changes what is stored, and the nonce and time it was sent with, so it
+// cannot be replayed as another or changed by a node it passes through
+type RequestDigest struct {
+	Method       uint64
+	Resource     []byte
+	ResourceName string
+	Data         []byte
+	// DataLength - the length of the data the header claims
+	DataLength uint64
+	Clock      uint64
+	Log        bool
+	Secret     []byte
+	SharedWith []SharedDigest
+	Version    uint64
+	Offset     uint64
+	More       bool
+	Archived   bool
+	Rekey      bool
+	Tag        []byte
+	LogDigest  []byte
+	Nonce      []byte
+	Sent       int64
+}
+
+// SharedDigest - what a user signs of an owner a request shares with
+type SharedDigest struct {
+	ID       []byte
+	Secret   []byte
+	ReadOnly bool
+}
+
+// bytes - the canonical bytes of the digest, which are signed, the data
+// hashed so a large request is not copied
+func (d RequestDigest) bytes() []byte {
+	dataHash := sha256.Sum256(d.Data)
+	digest := []byte("peerstore-request")
+	digest = strconv.AppendUint(append(digest, ':'), d.Method, 10)
+	digest = append(append(digest, ':'), hex.EncodeToString(d.Resource)...)
+	digest = append(append(digest, ':'), hex.EncodeToString([]byte(d.ResourceName))...)
+	digest = strconv.AppendUint(append(digest, ':'), d.DataLength, 10)
+	digest = append(append(digest, ':'), hex.EncodeToString(dataHash[:])...)
+	digest = strconv.AppendUint(append(digest, ':'), d.Clock, 10)
+	digest = strconv.AppendBool(append(digest, ':'), d.Log)
+	digest = append(append(digest, ':'), hex.EncodeToString(d.Secret)...)
+	digest = strconv.AppendInt(append(digest, ':'), int64(len(d.SharedWith)), 10)
+	for _, shared := range d.SharedWith {
+		digest = append(append(digest, ':'), hex.EncodeToString(shared.ID)...)
+		digest = append(append(digest, ','), hex.EncodeToString(shared.Secret)...)
+		digest = strconv.AppendBool(append(digest, ','), shared.ReadOnly)
+	}
+	digest = strconv.AppendUint(append(digest, ':'), d.Version, 10)
+	digest = strconv.AppendUint(append(digest, ':'), d.Offset, 10)
+	digest = strconv.AppendBool(append(digest, ':'), d.More)
+	digest = strconv.AppendBool(append(digest, ':'), d.Archived)
+	digest = strconv.AppendBool(append(digest, ':'), d.Rekey)
+	digest = append(append(digest, ':'), hex.EncodeToString(d.Tag)...)
+	digest = append(append(digest, ':'), hex.EncodeToString(d.LogDigest)...)
+	digest = append(append(digest, ':'), hex.EncodeToString(d.Nonce)...)
+	return strconv.AppendInt(append(digest, ':'), d.Sent, 10)
+}
+
+// SignRequest - sign what a request does with the key of the user making
+// it, so a node it passes through cannot make or change it
+func SignRequest(key *rsa.PrivateKey, d RequestDigest) ([]byte, error) {
+	return Sign(key, d.bytes())
+}
+
+// VerifyRequest - verify a signature made by SignRequest with the public key
+// of the user the request is made as
+func VerifyRequest(key *rsa.PublicKey, signature []byte, d RequestDigest) error {
+	if key == nil || len(signature) == 0 {
+		return errors.New("request is not signed")
+	}
+	return Verify(key, signature, d.bytes())
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import "testing"
+
+func TestSignRequest(t *testing.T) {
+	key, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := RequestDigest{
+		Method:     2,
+		Resource:   []byte{1, 2, 3},
+		Data:       []byte("data"),
+		DataLength: 4,
+		Clock:      7,
+		Secret:     []byte{5, 5},
+		SharedWith: []SharedDigest{{ID: []byte{6}, Secret: []byte{6, 6}}},
+		Nonce:      []byte{9, 9},
+		Sent:       100,
+	}
+	signature, err := SignRequest(key, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyRequest(&key.PublicKey, signature, request); err != nil {
+		t.Errorf("valid signature did not verify: %v", err)
+	}
+	for name, tamper := range map[string]func(*RequestDigest){
+		// a post turned into a delete
+		"method":      func(d *RequestDigest) { d.Method = 4 },
+		"resource":    func(d *RequestDigest) { d.Resource = []byte{1, 2, 4} },
+		"data":        func(d *RequestDigest) { d.Data = []byte("atad") },
+		"data length": func(d *RequestDigest) { d.DataLength = 5 },
+		"secret":      func(d *RequestDigest) { d.Secret = []byte{5, 4} },
+		"shared with": func(d *RequestDigest) { d.SharedWith = nil },
+		"nonce":       func(d *RequestDigest) { d.Nonce = []byte{9, 8} },
+		"sent":        func(d *RequestDigest) { d.Sent = 101 },
+	} {
+		tampered := request
+		tamper(&tampered)
+		if err := VerifyRequest(&key.PublicKey, signature, tampered); err == nil {
+			t.Errorf("signature verified a tampered %s", name)
+		}
+	}
+	if err := VerifyRequest(&other.PublicKey, signature, request); err == nil {
+		t.Error("signature verified with the key of another user")
+	}
+	if err := VerifyRequest(&key.PublicKey, nil, request); err == nil {
+		t.Error("missing signature verified")
+	}
+}
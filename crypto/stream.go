@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// NewEncryptingReader - encrypt plaintext with aes256 in ctr mode as it is
+// read, so a file of any size is encrypted a block at a time without being
+// held in memory.  The reader yields a random iv followed by the ciphertext.
+// Like cbc mode the ciphertext is not authenticated.
+func NewEncryptingReader(key []byte, plaintext io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+
+	// create IV
+	var iv = make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, errors.Wrap(err, "failed to generate iv: ")
+	}
+
+	return io.MultiReader(bytes.NewReader(iv), &cipher.StreamReader{
+		S: cipher.NewCTR(block, iv),
+		R: plaintext,
+	}), nil
+}
+
+// NewDecryptingReader - decrypt ciphertext produced by NewEncryptingReader
+// as it is read
+func NewDecryptingReader(key []byte, ciphertext io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+
+	var iv = make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(ciphertext, iv); err != nil {
+		return nil, errors.Wrap(err, "failed to read iv: ")
+	}
+
+	return &cipher.StreamReader{
+		S: cipher.NewCTR(block, iv),
+		R: ciphertext,
+	}, nil
+}
+
+// NewStreamReaderAt - xor r with the ctr keystream of key and iv, starting
+// offset bytes into it.  Applied to plaintext this yields the ciphertext
+// NewEncryptingReader produced for it from offset on, and applied to that
+// ciphertext it yields the plaintext, so a stream can be decrypted part way
+// through, or the ciphertext of a decrypted prefix recreated.
+func NewStreamReaderAt(key, iv []byte, offset uint64, r io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid iv length")
+	}
+
+	// advance the counter, a big endian number, by the whole blocks skipped
+	var (
+		counter = append([]byte{}, iv...)
+		blocks  = offset / aes.BlockSize
+	)
+	for i := len(counter) - 1; i >= 0 && blocks > 0; i-- {
+		sum := uint64(counter[i]) + blocks&0xff
+		counter[i] = byte(sum)
+		blocks = blocks>>8 + sum>>8
+	}
+	stream := cipher.NewCTR(block, counter)
+	// and then the keystream by what is left of a block
+	if skip := offset % aes.BlockSize; skip > 0 {
+		var discard = make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return &cipher.StreamReader{S: stream, R: r}, nil
+}
@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestStreamingEncryptionOfLargeFile(t *testing.T) {
+	const size = 100 << 20
+	key := make([]byte, sessionKeySize)
+
+	plaintext, err := ioutil.TempFile("", "plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(plaintext.Name())
+	defer plaintext.Close()
+	in := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(plaintext, in), zeroReader{}, size); err != nil {
+		t.Fatal(err)
+	}
+	plaintext.Seek(0, 0)
+
+	ciphertext, err := ioutil.TempFile("", "ciphertext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ciphertext.Name())
+	defer ciphertext.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	er, err := NewEncryptingReader(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ciphertext, er); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext.Seek(0, 0)
+	dr, err := NewDecryptingReader(key, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := sha256.New()
+	n, err := io.Copy(out, dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+		t.Errorf("allocated %d bytes to encrypt and decrypt %d bytes", allocated, size)
+	}
+	if n != size {
+		t.Errorf("decrypted %d bytes, expected %d", n, size)
+	}
+	if string(in.Sum(nil)) != string(out.Sum(nil)) {
+		t.Error("decrypted file doesnt match the original")
+	}
+}
+
+// zeroReader - an endless reader of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestStreamReaderAtOffset(t *testing.T) {
+	key := make([]byte, sessionKeySize)
+	plaintext := make([]byte, 1000)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	er, err := NewEncryptingReader(key, bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadAll(er)
+	iv, ciphertext := stored[:aes.BlockSize], stored[aes.BlockSize:]
+
+	// an iv which carries into every byte when the counter is advanced
+	carry := bytes.Repeat([]byte{0xff}, aes.BlockSize)
+	whole, _ := NewStreamReaderAt(key, carry, 0, bytes.NewReader(plaintext))
+	carried, _ := ioutil.ReadAll(whole)
+
+	for _, offset := range []uint64{0, 5, 16, 33, 999} {
+		dr, err := NewStreamReaderAt(key, iv, offset, bytes.NewReader(ciphertext[offset:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, _ := ioutil.ReadAll(dr); !bytes.Equal(out, plaintext[offset:]) {
+			t.Errorf("decrypting from %d did not match the plaintext", offset)
+		}
+		er, _ := NewStreamReaderAt(key, carry, offset, bytes.NewReader(plaintext[offset:]))
+		if out, _ := ioutil.ReadAll(er); !bytes.Equal(out, carried[offset:]) {
+			t.Errorf("encrypting from %d with a carrying counter did not match", offset)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// maxBatchBytes - the most resource data a batch get response carries, the
+// resources past it are left out for the caller to get one by one
+const maxBatchBytes = 8 << 20
+
+// batchResource - the latest version of the resource key, if from is an
+// owner of it
+func batchResource(ctx context.Context, key, from models.Identifier) (models.BatchResource, bool, error) {
+	buf, err := storeFromContext(ctx).Get(key)
+	if err != nil {
+		// not stored here, the caller looks it up again on its own
+		return models.BatchResource{}, false, nil
+	}
+	defer buf.Close()
+
+	idSecrets, tag, data, err := readHeader(buf)
+	if err != nil {
+		return models.BatchResource{}, false, errors.Wrap(err, "failed to read resource header: ")
+	}
+	owner, found := findOwner(idSecrets, from)
+	if !found {
+		return models.BatchResource{}, false, nil
+	}
+	resource := models.BatchResource{
+		Secret: owner.Secret,
+		Tag:    tag,
+	}
+	if keepVersionsFromContext(ctx) > 0 {
+		if resource.Version, err = storeFromContext(ctx).LatestVersion(key); err != nil {
+			return models.BatchResource{}, false, errors.Wrap(err, "failed to read resource versions: ")
+		}
+	}
+	if resource.Data, err = ioutil.ReadAll(data); err != nil {
+		return models.BatchResource{}, false, errors.Wrap(err, "failed to read resource: ")
+	}
+	return resource, true, nil
+}
+
+// BatchGetHandler - This is the server handler which gets many resources in
+// one round trip, the request data being their gob encoded keys.  The
+// response data is a gob encoded models.BatchGetResponse with the resources
+// the caller is an owner of, each authorized as a get file request would be.
+func BatchGetHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		keys []models.Identifier
+		out  = &bytes.Buffer{}
+	)
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(&keys); err != nil {
+		glog.Infof("failed to decode batch get request: %v", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid batch get request")
+	}
+	if len(keys) > models.MaxBatchKeys {
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "too many keys in batch")
+	}
+	glog.Infof("BatchGetHandler Request: %d keys from %s", len(keys), r.Header.From)
+
+	result := models.BatchGetResponse{
+		Resources: make(map[models.Identifier]models.BatchResource),
+	}
+	var size int
+	fileMu.Lock()
+	for _, key := range keys {
+		if _, ok := result.Resources[key]; ok {
+			continue
+		}
+		resource, ok, err := batchResource(ctx, key, r.Header.From)
+		if err != nil {
+			glog.Infof("ERR: %v\n", err)
+			continue
+		}
+		if !ok {
+			glog.V(protocol.DebugLogLevel).Infof("skipping %s in batch for %s", key, r.Header.From)
+			continue
+		}
+		if size += len(resource.Data); size > maxBatchBytes {
+			break
+		}
+		result.Resources[key] = resource
+	}
+	fileMu.Unlock()
+
+	if err := gob.NewEncoder(out).Encode(result); err != nil {
+		glog.Infof("encode batch get response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
@@ -0,0 +1,146 @@
+package file
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// readCache - the stored files of a data path read most recently, kept in
+// memory so a resource requested over and over is not read from disk each
+// time.  The least recently read are dropped once the files held add up to
+// more than maxBytes.
+type readCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	// order - the keys held, the most recently read at the front
+	order   *list.List
+	entries map[models.Identifier]*list.Element
+}
+
+// cachedFile - a file held in a read cache
+type cachedFile struct {
+	key  models.Identifier
+	data []byte
+}
+
+var (
+	// readCaches - the read cache of each data path, absent when reads are
+	// not cached
+	readCaches   = map[string]*readCache{}
+	readCachesMu = new(sync.RWMutex)
+)
+
+// ConfigureReadCache - keep up to maxBytes of the files most recently read
+// from path in memory, so reads of them skip the disk.  A file larger than a
+// quarter of the cache is never held, so one large read cannot flush it.
+// A maxBytes of zero disables the cache.  Writes through this package drop
+// what is held for the key written, so a read never sees stale data.
+func ConfigureReadCache(path string, maxBytes uint64) {
+	readCachesMu.Lock()
+	defer readCachesMu.Unlock()
+	if maxBytes == 0 {
+		delete(readCaches, path)
+		return
+	}
+	readCaches[path] = &readCache{
+		maxBytes: int64(maxBytes),
+		order:    list.New(),
+		entries:  make(map[models.Identifier]*list.Element),
+	}
+}
+
+// readCacheOf - the read cache of path, nil if it has none
+func readCacheOf(path string) *readCache {
+	readCachesMu.RLock()
+	defer readCachesMu.RUnlock()
+	return readCaches[path]
+}
+
+// get - the file held for key, marking it the most recently read
+func (c *readCache) get(key models.Identifier) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedFile).data, true
+}
+
+// cacheable - check if a file of size bytes is small enough to hold
+func (c *readCache) cacheable(size int64) bool {
+	return size <= c.maxBytes/4
+}
+
+// put - hold data as the file of key, dropping the least recently read files
+// to make room for it
+func (c *readCache) put(key models.Identifier, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	c.entries[key] = c.order.PushFront(&cachedFile{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back().Value.(*cachedFile).key)
+	}
+}
+
+// invalidate - drop the file held for key, if any
+func (c *readCache) invalidate(key models.Identifier) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// remove - drop the file held for key, c.mu must be held
+func (c *readCache) remove(key models.Identifier) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.order.Remove(e)
+	delete(c.entries, key)
+	c.size -= int64(len(e.Value.(*cachedFile).data))
+}
+
+// invalidateRead - drop what the read cache of path holds for key, called
+// whenever the file of key is written or removed
+func invalidateRead(path string, key models.Identifier) {
+	if c := readCacheOf(path); c != nil {
+		c.invalidate(key)
+	}
+}
+
+// cachedGet - the file of key in path from its read cache, reading it into
+// the cache if it is small enough.  ok is false if path has no read cache or
+// the file is too large, for the caller to read it from disk.
+func cachedGet(path string, key models.Identifier) (f io.ReadCloser, ok bool, err error) {
+	c := readCacheOf(path)
+	if c == nil {
+		return nil, false, nil
+	}
+	if data, hit := c.get(key); hit {
+		return memoryFile{bytes.NewReader(data)}, true, nil
+	}
+	info, err := os.Stat(keyPath(path, key))
+	if err != nil {
+		return nil, true, err
+	}
+	if !c.cacheable(info.Size()) {
+		return nil, false, nil
+	}
+	data, err := ioutil.ReadFile(keyPath(path, key))
+	if err != nil {
+		return nil, true, err
+	}
+	c.put(key, data)
+	return memoryFile{bytes.NewReader(data)}, true, nil
+}
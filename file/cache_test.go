@@ -0,0 +1,139 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// cacheTestSetup - a data path with the read cache set to cacheSize, and a
+// request for a resource in it made by its owner
+func cacheTestSetup(tb testing.TB, cacheSize uint64) (context.Context, func(protocol.RequestMethod, []byte) *protocol.Request, func()) {
+	dir, err := ioutil.TempDir("", "readcache")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ConfigureReadCache(dir, cacheSize)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner := newTestUser(tb)
+	key := models.Identifier{0x0c, 0xac, 0x4e}
+	request := func(method protocol.RequestMethod, data []byte) *protocol.Request {
+		return owner.sign(tb, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+	}
+	return ctx, request, func() {
+		ConfigureReadCache(dir, 0)
+		delete(quotaLedgers, dir)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	ctx, request, cleanup := cacheTestSetup(t, 1<<20)
+	defer cleanup()
+	dir := ctx.Value(models.DataPathContextKey).(string)
+	cache := readCacheOf(dir)
+	key := request(protocol.GetFileMethod, nil).Header.Key
+
+	get := func(want string) {
+		t.Helper()
+		resp := GetFileHandler(ctx, request(protocol.GetFileMethod, nil))
+		if resp.Status != protocol.Success || string(resp.Data) != want {
+			t.Fatalf("expected %q, got %q, %v", want, resp.Data, resp.Err())
+		}
+	}
+
+	if resp := PostFileHandler(ctx, request(protocol.PostFileMethod, []byte("first"))); resp.Status != protocol.Success {
+		t.Fatalf("post failed: %v", resp.Err())
+	}
+	get("first")
+	if _, ok := cache.get(key); !ok {
+		t.Fatal("expected the resource read to be cached")
+	}
+	get("first")
+
+	// a post drops the cached copy, so the next read sees the new data
+	if resp := PostFileHandler(ctx, request(protocol.PostFileMethod, []byte("second"))); resp.Status != protocol.Success {
+		t.Fatalf("post failed: %v", resp.Err())
+	}
+	if _, ok := cache.get(key); ok {
+		t.Error("expected the post to invalidate the cached resource")
+	}
+	get("second")
+
+	if resp := DeleteFileHandler(ctx, request(protocol.DeleteFileMethod, nil)); resp.Status != protocol.Success {
+		t.Fatalf("delete failed: %v", resp.Err())
+	}
+	if _, ok := cache.get(key); ok {
+		t.Error("expected the delete to invalidate the cached resource")
+	}
+	if resp := GetFileHandler(ctx, request(protocol.GetFileMethod, nil)); resp.Header.ErrorCode != protocol.NotFoundCode {
+		t.Errorf("expected the deleted resource not found, got %v", resp.Err())
+	}
+}
+
+func TestReadCacheEviction(t *testing.T) {
+	dir := "evictions"
+	ConfigureReadCache(dir, 10)
+	defer ConfigureReadCache(dir, 0)
+	cache := readCacheOf(dir)
+
+	a, b, c := models.Identifier{1}, models.Identifier{2}, models.Identifier{3}
+	cache.put(a, []byte("aaaa"))
+	cache.put(b, []byte("bbbb"))
+	// a is now the most recently read, so b is dropped to make room for c
+	cache.get(a)
+	cache.put(c, []byte("cccc"))
+	if _, ok := cache.get(b); ok {
+		t.Error("expected the least recently read file dropped")
+	}
+	for _, key := range []models.Identifier{a, c} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("expected %s kept", key)
+		}
+	}
+	if cache.size != 8 {
+		t.Errorf("expected 8 bytes held, got %d", cache.size)
+	}
+	if cache.cacheable(3) {
+		t.Error("expected a file over a quarter of the cache not to be held")
+	}
+}
+
+// benchmarkReadCache - get the same resource repeatedly with a read cache of
+// cacheSize
+func benchmarkReadCache(b *testing.B, cacheSize uint64) {
+	ctx, request, cleanup := cacheTestSetup(b, cacheSize)
+	defer cleanup()
+	if resp := PostFileHandler(ctx, request(protocol.PostFileMethod, make([]byte, 4096))); resp.Status != protocol.Success {
+		b.Fatalf("post failed: %v", resp.Err())
+	}
+	get := request(protocol.GetFileMethod, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if resp := GetFileHandler(ctx, get); resp.Status != protocol.Success {
+			b.Fatalf("get failed: %v", resp.Err())
+		}
+	}
+}
+
+func BenchmarkGetFileUncached(b *testing.B) {
+	benchmarkReadCache(b, 0)
+}
+
+func BenchmarkGetFileCached(b *testing.B) {
+	benchmarkReadCache(b, 1<<20)
+}
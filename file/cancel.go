@@ -0,0 +1,40 @@
+package file
+
+import (
+	"context"
+	"io"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// cancelChunkSize - the most a contextReader reads at once, so a large read
+// is checked for cancellation between chunks of it
+const cancelChunkSize = 32 * 1024
+
+// contextReader - a reader which stops with the error of ctx once ctx is
+// done, so a handler reading or writing a large resource gives up, and
+// releases fileMu, when the caller has given up on it
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read - read from the underlying reader, at most cancelChunkSize bytes,
+// unless ctx is done
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > cancelChunkSize {
+		p = p[:cancelChunkSize]
+	}
+	return cr.r.Read(p)
+}
+
+// cancelledResponse - the response to a request the caller gave up on part
+// way through, which is not read, but is logged
+func cancelledResponse(ctx context.Context, r *protocol.Request) protocol.Response {
+	glog.Infof("gave up on %s of %s: %v", protocol.RequestMethodToString[r.Method], r.Header.Key, ctx.Err())
+	return protocol.ErrorResponse(protocol.InternalErrorCode, "request cancelled")
+}
@@ -0,0 +1,99 @@
+package file
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// cancellingStore - a DirStore whose reads cancel the request once after
+// bytes have been read, as a caller giving up part way through would
+type cancellingStore struct {
+	DirStore
+	after  int
+	cancel context.CancelFunc
+	read   int
+}
+
+func (s *cancellingStore) Get(key models.Identifier) (io.ReadCloser, error) {
+	rc, err := s.DirStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return cancellingReader{rc, s}, nil
+}
+
+type cancellingReader struct {
+	io.ReadCloser
+	s *cancellingStore
+}
+
+func (r cancellingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.s.read += n; r.s.read >= r.s.after {
+		r.s.cancel()
+	}
+	return n, err
+}
+
+func (r cancellingReader) Seek(offset int64, whence int) (int64, error) {
+	return r.ReadCloser.(io.Seeker).Seek(offset, whence)
+}
+
+func TestGetFileCancelledMidRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner := newTestUser(t)
+	data := make([]byte, 4<<20)
+	post := &protocol.Request{
+		Header: protocol.Header{
+			Key:        models.Identifier{1},
+			Secret:     make([]byte, sessionKeyLen),
+			DataLength: uint64(len(data)),
+		},
+		Method: protocol.PostFileMethod,
+		Data:   data,
+	}
+	if resp := PostFileHandler(ctx, owner.sign(t, post)); resp.Status != protocol.Success {
+		t.Fatalf("post failed: %v", resp.Err())
+	}
+
+	for _, test := range []struct {
+		name           string
+		offset, length uint64
+	}{
+		{"whole", 0, 0},
+		{"range", 1, uint64(len(data) - 1)},
+	} {
+		ctx, cancel := context.WithCancel(ctx)
+		store := &cancellingStore{DirStore: DirStore(dir), after: 64 * 1024, cancel: cancel}
+		get := &protocol.Request{
+			Header: protocol.Header{
+				Key:    models.Identifier{1},
+				Offset: test.offset,
+				Length: test.length,
+			},
+			Method: protocol.GetFileMethod,
+		}
+		owner.sign(t, get)
+		resp := GetFileHandler(context.WithValue(ctx, models.StoreContextKey, Store(store)), get)
+		cancel()
+		if resp.Status == protocol.Success {
+			t.Errorf("%s: expected the cancelled get to fail, got %d bytes", test.name, len(resp.Data))
+		}
+		if store.read >= len(data) {
+			t.Errorf("%s: the cancelled get read all %d bytes", test.name, store.read)
+		}
+	}
+}
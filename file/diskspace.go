@@ -0,0 +1,63 @@
+package file
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// errInsufficientSpace - there is not enough free disk space to store a post
+var errInsufficientSpace = errors.New("not enough free disk space")
+
+// minFreeSpaceFromContext - the bytes of disk space the node is configured to
+// keep free, zero when the free space check is disabled
+func minFreeSpaceFromContext(ctx context.Context) uint64 {
+	if min, ok := ctx.Value(models.MinFreeSpaceContextKey).(uint64); ok {
+		return min
+	}
+	return 0
+}
+
+// checkFreeSpace - check there is room in dataPath to store length bytes
+// while keeping the configured space free, before anything is written.  A
+// write which runs out of space part way through fails far less clearly.
+func checkFreeSpace(ctx context.Context, dataPath string, length uint64) error {
+	min := minFreeSpaceFromContext(ctx)
+	if min == 0 {
+		return nil
+	}
+	free, err := freeSpace(dataPath)
+	if err != nil {
+		// not being able to tell should not stop the node from storing
+		glog.Warningf("failed to check free space of %s: %v", dataPath, err)
+		return nil
+	}
+	if free < length || free-length < min {
+		glog.Infof("rejecting %d bytes, %d bytes free and %d must stay free", length, free, min)
+		return errInsufficientSpace
+	}
+	return nil
+}
+
+// postLength - the bytes a post will take up, the length the caller
+// advertised or the data received, whichever is larger
+func postLength(r *protocol.Request) uint64 {
+	if length := uint64(len(r.Data)); length > r.Header.DataLength {
+		return length
+	}
+	return r.Header.DataLength
+}
+
+// insufficientSpaceResponse - the response to a post the node has no room for
+func insufficientSpaceResponse() protocol.Response {
+	return protocol.Response{
+		Header: protocol.Header{
+			Message:   "node does not have enough free disk space",
+			ErrorCode: protocol.QuotaExceededCode,
+		},
+		Status: protocol.QuotaExceeded,
+	}
+}
@@ -0,0 +1,34 @@
+package file
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := os.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil || free == 0 {
+		t.Fatalf("freeSpace(%s) = %d, %v", dir, free, err)
+	}
+
+	if err := checkFreeSpace(context.Background(), dir, free*2); err != nil {
+		t.Errorf("check with no minimum configured failed: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), models.MinFreeSpaceContextKey, uint64(1))
+	if err := checkFreeSpace(ctx, dir, 1); err != nil {
+		t.Errorf("check of a single byte failed: %v", err)
+	}
+	if err := checkFreeSpace(ctx, dir, free*2); err != errInsufficientSpace {
+		t.Errorf("check of more than is free = %v, expected %v", err, errInsufficientSpace)
+	}
+
+	ctx = context.WithValue(context.Background(), models.MinFreeSpaceContextKey, free*2)
+	if err := checkFreeSpace(ctx, dir, 1); err != errInsufficientSpace {
+		t.Errorf("check leaving less than the minimum = %v, expected %v", err, errInsufficientSpace)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+import "syscall"
+
+// freeSpace - the bytes available to us on the filesystem holding path
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
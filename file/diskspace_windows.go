@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package file
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace - the bytes available to us on the volume holding path
+func freeSpace(path string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if r, _, err := getDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&available)), 0, 0,
+	); r == 0 {
+		return 0, err
+	}
+	return available, nil
+}
@@ -0,0 +1,78 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestErrorCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.MaxBytesPerUserContextKey, uint64(20))
+	owner, other := newTestUser(t), models.Identifier{8}
+	key := models.Identifier{1}
+
+	post := func(header protocol.Header, data []byte) protocol.Response {
+		header.Secret = make([]byte, sessionKeyLen)
+		header.DataLength = uint64(len(data))
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: header,
+			Method: protocol.PostFileMethod,
+			Data:   data,
+		}))
+	}
+	get := func(header protocol.Header) protocol.Response {
+		return GetFileHandler(ctx, &protocol.Request{
+			Header: header,
+			Method: protocol.GetFileMethod,
+		})
+	}
+
+	if resp := post(protocol.Header{Key: key, From: owner.id}, []byte("0123456789")); resp.Status != protocol.Success {
+		t.Fatalf("post = %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(protocol.Header{Key: key, From: owner.id, More: true}, []byte("01")); resp.Status != protocol.Success {
+		t.Fatalf("staging a chunk = %d, %v", resp.Status, resp.Err())
+	}
+
+	cases := []struct {
+		name string
+		resp protocol.Response
+		code protocol.ErrorCode
+	}{
+		{"missing resource", get(protocol.Header{Key: models.Identifier{2}, From: owner.id}), protocol.NotFoundCode},
+		{"not an owner", get(protocol.Header{Key: key, From: other}), protocol.UnauthorizedCode},
+		{"range past the end", get(protocol.Header{Key: key, From: owner.id, Offset: 11, Length: 1}), protocol.BadHeaderCode},
+		{"over quota", post(protocol.Header{Key: models.Identifier{3}, From: owner.id}, make([]byte, 11)), protocol.QuotaExceededCode},
+		{"append at the wrong offset", post(protocol.Header{Key: key, From: owner.id, Offset: 4}, []byte("x")), protocol.ConflictCode},
+	}
+	seen := make(map[protocol.ErrorCode]string)
+	for _, c := range cases {
+		if c.resp.Status == protocol.Success {
+			t.Errorf("%s succeeded", c.name)
+			continue
+		}
+		if c.resp.Header.ErrorCode != c.code {
+			t.Errorf("%s code = %s, expected %s", c.name,
+				protocol.ErrorCodeToString[c.resp.Header.ErrorCode], protocol.ErrorCodeToString[c.code])
+		}
+		if name, ok := seen[c.resp.Header.ErrorCode]; ok {
+			t.Errorf("%s and %s have the same code", name, c.name)
+		}
+		seen[c.resp.Header.ErrorCode] = c.name
+		if c.resp.Header.Message == "" {
+			t.Errorf("%s has no message", c.name)
+		}
+	}
+}
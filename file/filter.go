@@ -0,0 +1,28 @@
+package file
+
+import (
+	"context"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// PostFilter - a hook run against the data of a post before it is stored,
+// which allows a node to apply a content policy (such as an antivirus scan)
+// to what it accepts.  Returning an error rejects the write with a
+// PolicyViolation status.  Note the data is usually client encrypted, so
+// this is only meaningful for resources posted in the clear.
+type PostFilter func(ctx context.Context, key models.Identifier, data []byte) error
+
+// NopPostFilter - the default post filter, which accepts everything
+func NopPostFilter(ctx context.Context, key models.Identifier, data []byte) error {
+	return nil
+}
+
+// postFilterFromContext - get the configured post filter out of the context,
+// falling back to the no-op filter if one was not configured
+func postFilterFromContext(ctx context.Context) PostFilter {
+	if filter, ok := ctx.Value(models.PostFilterContextKey).(PostFilter); ok && filter != nil {
+		return filter
+	}
+	return NopPostFilter
+}
@@ -0,0 +1,60 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestPostFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	var filtered []models.Identifier
+	var filter PostFilter = func(ctx context.Context, key models.Identifier, data []byte) error {
+		filtered = append(filtered, key)
+		if bytes.Contains(data, []byte("infected")) {
+			return errors.New("signature found")
+		}
+		return nil
+	}
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.PostFilterContextKey, filter)
+	owner := newTestUser(t)
+
+	post := func(key models.Identifier, data []byte) protocol.Response {
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+			},
+			Method: protocol.PostFileMethod,
+			Data:   data,
+		}))
+	}
+
+	if resp := post(models.Identifier{1}, []byte("clean")); resp.Status != protocol.Success {
+		t.Fatalf("post of clean data failed: %v", resp.Err())
+	}
+	resp := post(models.Identifier{2}, []byte("infected"))
+	if resp.Status != protocol.PolicyViolation {
+		t.Errorf("post of rejected data = %d, expected %d", resp.Status, protocol.PolicyViolation)
+	}
+	if _, err := Get(dir, models.Identifier{2}); err == nil {
+		t.Error("expected the rejected post not stored")
+	}
+	if len(filtered) != 2 {
+		t.Errorf("filter ran on %d posts, expected 2", len(filtered))
+	}
+}
@@ -3,13 +3,20 @@ package file
 import (
 	"bytes"
 	"context"
+	"crypto/rsa"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"sync"
+	"syscall"
 
 	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
 	"github.com/husobee/peerstore/models"
 	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
 )
 
 var fileMu = &sync.Mutex{}
@@ -17,15 +24,89 @@ var fileMu = &sync.Mutex{}
 type idSecret struct {
 	ID     models.Identifier
 	Secret []byte
+	// ReadOnly - the owner can read the resource, and give up their own
+	// access to it, but not overwrite it
+	ReadOnly bool
 }
 
+// readOnlyResponse - the response to an owner with read-only access
+// attempting to change a resource
+func readOnlyResponse() protocol.Response {
+	return protocol.Response{
+		Header: protocol.Header{
+			Message:   "read-only access to resource",
+			ErrorCode: protocol.UnauthorizedCode,
+		},
+		Status: protocol.Unauthorized,
+	}
+}
+
+// sessionKeyLen - the length of a session key encrypted with a 2048 bit RSA
+// key, which every secret of a header from before secret lengths were stored
+// has, and the length of the zeros stored for an owner without a secret
 const sessionKeyLen = 256
 
+// keepVersionsFromContext - the number of previous versions of a file the
+// node is configured to retain, zero when versioning is disabled
+func keepVersionsFromContext(ctx context.Context) uint {
+	if keep, ok := ctx.Value(models.KeepVersionsContextKey).(uint); ok {
+		return keep
+	}
+	return 0
+}
+
+// storeFile - post the file data to the node's store, retaining previous
+// versions if the node is configured to do so.  Returns the version id of
+// the stored data, which is zero when versioning is disabled.
+func storeFile(ctx context.Context, key models.Identifier, data io.Reader) (uint64, error) {
+	data = contextReader{ctx, data}
+	if keep := keepVersionsFromContext(ctx); keep > 0 {
+		return storeFromContext(ctx).PostVersion(key, data, keep)
+	}
+	return 0, storeFromContext(ctx).Post(key, data)
+}
+
+// getFile - get the requested version of the file based on the key from the
+// node's store, where zero is the current copy
+func getFile(ctx context.Context, key models.Identifier, version uint64) (io.ReadCloser, error) {
+	if version == 0 {
+		return storeFromContext(ctx).Get(key)
+	}
+	return storeFromContext(ctx).GetVersion(key, version)
+}
+
+// storeErrorResponse - the response sent back to the caller when storing a
+// resource fails, the error itself is only logged as it includes the path
+// of our data dir
+func storeErrorResponse(err error) protocol.Response {
+	if pathErr, ok := errors.Cause(err).(*os.PathError); ok && pathErr.Err == syscall.ENOSPC {
+		return protocol.ErrorResponse(protocol.QuotaExceededCode, "disk full")
+	}
+	return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to store resource")
+}
+
+// unsignedResponse - the response to a request to change stored data which
+// was not signed by the user it is made as
+func unsignedResponse(r *protocol.Request, err error) protocol.Response {
+	glog.Infof("rejecting %s of %s: %v", protocol.RequestMethodToString[r.Method], r.Header.Key, err)
+	return protocol.ErrorResponse(protocol.UnauthorizedCode, protocol.ErrBadUserSignature.Error())
+}
+
+// clockErrorResponse - the response to a request the clock could not be
+// advanced for, as the timestamp could be handed out again after a restart
+func clockErrorResponse(r *protocol.Request, err error) protocol.Response {
+	glog.Errorf("failed %s of %s: %v", protocol.RequestMethodToString[r.Method], r.Header.Key, err)
+	return protocol.ErrorResponse(protocol.InternalErrorCode, "could not advance the clock")
+}
+
 // GetPublicKeyHandler - This is the server handler which manages Get public key
 func GetPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
 
-	var timestamp = models.IncrementClock(r.Header.Clock)
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
+	}
 	response := protocol.Response{
 		Header: protocol.Header{
 			Clock: timestamp,
@@ -33,7 +114,7 @@ func GetPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Resp
 		Status: protocol.Success,
 	}
 
-	glog.Infof("GetPublicKeyHandler Request: %v, %x", r.Header.ResourceName, r.Header.Key)
+	glog.Infof("GetPublicKeyHandler Request: %v, %s", r.Header.ResourceName, r.Header.Key)
 
 	fileMu.Lock()
 	defer fileMu.Unlock()
@@ -42,153 +123,99 @@ func GetPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Resp
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
 		// write the get file error out.
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
 	}
 	defer buf.Close()
-	for n := 1; n > 0; {
-		var err error
-		tmp := make([]byte, 256)
-		n, err = buf.Read(tmp)
-		response.Data = append(response.Data, tmp[:n]...)
-		if err != nil {
-			if err == io.EOF {
-				// file is fully read, continue
-				continue
-			}
-			glog.Infof("ERR: %v\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
+	// read to the end, a read which returns nothing is not the end
+	if response.Data, err = ioutil.ReadAll(buf); err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
 	}
 
-	glog.Infof("!!!!!!!!!!!!!!!!!!!!! GET Key response: !!!!!!!!!!! %s", string(response.Data))
+	glog.V(protocol.DebugLogLevel).Infof("public key %s: %s", r.Header.Key, string(response.Data))
 	return response
 }
 
 // GetFileHandler - This is the server handler which manages Get File Requests
 func GetFileHandler(ctx context.Context, r *protocol.Request) protocol.Response {
-	var dataPath = ctx.Value(models.DataPathContextKey).(string)
-
-	glog.Infof("GetFileHandler Request: %v, %x", r.Header.ResourceName, r.Header.Key)
+	glog.Infof("GetFileHandler Request: %v, %s", r.Header.ResourceName, r.Header.Key)
 
 	var response = protocol.Response{
 		Status: protocol.Success,
 	}
 	fileMu.Lock()
 	defer fileMu.Unlock()
-	// perform file get based on key
-	buf, err := Get(dataPath, r.Header.Key)
+	// perform file get based on key, and the requested version if any
+	buf, err := getFile(ctx, r.Header.Key, r.Header.Version)
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
 		// write the get file error out.
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
 	}
 	defer buf.Close()
 
-	// We need to read the first byte of the file to know
-	// how many id/secret pairs are in the file
-	ownerCount := make([]byte, 1)
-	n, err := buf.Read(ownerCount)
-	if n != 1 {
-		glog.Infof("ERR: could not read header from file\n")
-		return protocol.Response{
-			Status: protocol.Error,
+	response.Header.Version = r.Header.Version
+	if response.Header.Version == 0 && keepVersionsFromContext(ctx) > 0 {
+		if response.Header.Version, err = storeFromContext(ctx).LatestVersion(r.Header.Key); err != nil {
+			glog.Infof("ERR: %v\n", err)
+			return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource versions")
 		}
 	}
+
+	idSecrets, tag, data, err := readHeader(buf)
 	if err != nil {
 		glog.Infof("ERR: %s\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
-	}
-
-	idSecrets := []idSecret{}
-
-	for i := byte(0); i < ownerCount[0]; i++ {
-		// read the owner id out of the "header" of the file
-		idSlice := make([]byte, 20)
-		n, err := buf.Read(idSlice)
-		glog.Infof("header is: %x", idSlice)
-		if n != 20 {
-			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-		if err != nil {
-			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-
-		secretSlice := make([]byte, sessionKeyLen)
-		n, err = buf.Read(secretSlice)
-		glog.Infof("secret is: %x", secretSlice)
-		if n != sessionKeyLen {
-			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-		if err != nil {
-			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-
-		id := models.Identifier{}
-		copy(id[:], idSlice)
-
-		idSecrets = append(idSecrets, idSecret{
-			ID: id, Secret: secretSlice})
-	}
-
-	// check each id in the list
-	found := false
-	for _, pair := range idSecrets {
-		// all we need to do here is compare the from in the request
-		// header to what the file "header" has, as we have already
-		// authenticated the request against that from id
-		if bytes.Compare(pair.ID[:], r.Header.From[:]) == 0 {
-			found = true
-			response.Header.Secret = pair.Secret
-		}
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header")
 	}
 
 	// all we need to do here is compare the from in the request
 	// header to what the file "header" has, as we have already
 	// authenticated the request against that from id
+	owner, found := findOwner(idSecrets, r.Header.From)
 	if !found {
 		glog.Infof("invalid ownership of this resource requested\n")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch")
 	}
-
-	for n := 1; n > 0; {
-		var err error
-		tmp := make([]byte, 256)
-		n, err = buf.Read(tmp)
-		response.Data = append(response.Data, tmp[:n]...)
+	response.Header.Secret = owner.Secret
+	glog.V(protocol.DebugLogLevel).Infof("secret of %s for %s: %s", r.Header.Key, r.Header.From, models.RedactSecret(owner.Secret))
+	// the tag is keyed from the session key, which only the owners can
+	// decrypt, so it is verified by the client once the data is fetched
+	response.Header.Tag = tag
+
+	if r.Header.Offset > 0 || r.Header.Length > 0 {
+		f, ok := buf.(io.ReadSeeker)
+		if !ok {
+			return protocol.ErrorResponse(protocol.BadHeaderCode, "ranges are not supported for this resource")
+		}
+		start, err := dataStart(f, data)
 		if err != nil {
-			if err == io.EOF {
-				// file is fully read, continue
-				continue
-			}
 			glog.Infof("ERR: %v\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
+		}
+		response.Data, response.Header.DataLength, err = readRange(
+			ctx, f, start, r.Header.Offset, r.Header.Length)
+		if err == errRangeNotSatisfiable {
+			return protocol.ErrorResponse(protocol.BadHeaderCode, err.Error())
+		}
+		if err != nil && ctx.Err() != nil {
+			return cancelledResponse(ctx, r)
+		}
+		if err != nil {
+			glog.Infof("ERR: %v\n", err)
+			return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
+		}
+		return response
+	}
+
+	if response.Data, err = ioutil.ReadAll(contextReader{ctx, data}); err != nil {
+		if ctx.Err() != nil {
+			return cancelledResponse(ctx, r)
 		}
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
 	}
-	glog.Infof("!!!!!!!!!!!!!!!!!!!!! GET FILE response: !!!!!!!!!!! %s", hex.EncodeToString(response.Data))
+	response.Header.DataLength = uint64(len(response.Data))
+	glog.V(protocol.DebugLogLevel).Infof("get of %s, %d bytes: %s", r.Header.Key, len(response.Data), hex.EncodeToString(response.Data))
 	return response
 }
 
@@ -197,275 +224,303 @@ func PostPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Res
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
 	// add the request owner id to the file "header"
 
+	// keys are posted by the node a user registered with, once it checked
+	// the user has the key, never by users
+	if caller, _ := protocol.CallerTypeFromContext(ctx); caller != protocol.NodeType {
+		glog.Infof("public key %s rejected, not from a node", r.Header.Key)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "public keys are only accepted from nodes")
+	}
+	pub, err := crypto.ReadPublicKeyAsPem(bytes.NewReader(r.Data))
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid public key")
+	}
+	if gobKey, err := crypto.GobEncodePublicKey(&pub); err != nil || models.HashBytes(gobKey) != r.Header.Key {
+		glog.Infof("public key %s rejected, it is not the key of the user", r.Header.Key)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "public key is not the key of the user")
+	}
+
 	fileMu.Lock()
 	defer fileMu.Unlock()
 
-	var timestamp = models.IncrementClock(r.Header.Clock)
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
+	}
 	response := protocol.Response{
 		Header: protocol.Header{
 			Clock: timestamp,
 		},
 	}
 
+	// a user registering again posts the key stored for them, which is
+	// left as it is, and a key is never replaced by another
+	if stored, err := readStoredPublicKey(dataPath, r.Header.Key); err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
+	} else if stored != nil {
+		if stored.N.Cmp(pub.N) != 0 || stored.E != pub.E {
+			glog.Infof("public key %s rejected, another key is stored", r.Header.Key)
+			return protocol.ErrorResponse(protocol.ConflictCode, "another public key is registered for the user")
+		}
+		response.Status = protocol.Success
+		return response
+	}
+
 	if err := Post(
 		dataPath, r.Header.Key, bytes.NewBuffer(r.Data),
 	); err != nil {
 		glog.Infof("ERR: %s", err.Error())
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return storeErrorResponse(err)
 	}
-	glog.Infof("!!!!!!!!!!!!!!!!!!!!! POST Public Key request: !!!!!!!!!!! %s", string(r.Data))
+	glog.V(protocol.DebugLogLevel).Infof("public key %s posted: %s", r.Header.Key, string(r.Data))
+	replicate(ctx, dataPath, r.Header.Key)
 
 	response.Status = protocol.Success
 	return response
 }
 
+// readStoredPublicKey - the public key stored under key, nil if there is none
+func readStoredPublicKey(dataPath string, key models.Identifier) (*rsa.PublicKey, error) {
+	buf, err := Get(dataPath, key)
+	if isNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read public key")
+	}
+	defer buf.Close()
+	pub, err := crypto.ReadPublicKeyAsPem(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read public key")
+	}
+	return &pub, nil
+}
+
 // PostFileHandler - This is the server handler which manages Post File Requests
 func PostFileHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	if err := r.VerifyUserSignature(); err != nil {
+		return unsignedResponse(r, err)
+	}
+
+	// run the content policy against the data before taking the file lock,
+	// as a scan could be slow.  An upload posted in chunks is run against
+	// once all of it is staged.
+	chunked := r.Header.More || r.Header.Offset > 0
+	if !chunked {
+		if err := postFilterFromContext(ctx)(ctx, r.Header.Key, r.Data); err != nil {
+			return policyViolationResponse(err)
+		}
+	}
+
+	if len(r.Header.SharedWith) >= MaxOwners {
+		// too many for a new resource, or an existing one, before anything
+		// is read
+		glog.Infof("post of %s rejected, shared with %d users", r.Header.Key, len(r.Header.SharedWith))
+		return protocol.ErrorResponse(protocol.BadHeaderCode,
+			fmt.Sprintf("a resource can be shared with at most %d users", MaxOwners-1))
+	}
+
+	if err := checkSecrets(r); err != nil {
+		glog.Infof("post of %s rejected: %v", r.Header.Key, err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, err.Error())
+	}
+
+	if err := checkFreeSpace(ctx, dataPath, postLength(r)); err != nil {
+		return insufficientSpaceResponse()
+	}
+
+	// each chunk of an upload posted in chunks is staged, and only the last
+	// goes on to replace the resource, with all of the staged data
+	var (
+		data io.Reader = bytes.NewReader(r.Data)
+		size           = uint64(len(r.Data))
+	)
+	if chunked {
+		if r.Header.Rekey {
+			return protocol.ErrorResponse(protocol.BadHeaderCode, "a rekey must post the whole resource")
+		}
+		staged, resp := stageChunk(ctx, dataPath, r)
+		if staged == nil {
+			return resp
+		}
+		defer staged.Close()
+		if resp, ok := filterUpload(ctx, r.Header.Key, staged); !ok {
+			return resp
+		}
+		data, size = staged, staged.size
+	}
+
 	// add the request owner id to the file "header"
 
 	fileMu.Lock()
 	defer fileMu.Unlock()
 
-	// TODO: we need to check if this is an existing file or not, if existing,
-	// we need to pull the original ownership, validate user has permissions
-	// then update the data, then also include the new "shareWith" header values
-	// perform file get based on key
-	buf, err := Get(dataPath, r.Header.Key)
+	// an existing resource is updated, keeping its owners, and only one
+	// which is not stored is created.  Any other failure to read it fails
+	// the post, as creating it then would replace its owners with the
+	// caller.
+	buf, err := storeFromContext(ctx).Get(r.Header.Key)
+	if err != nil && !isNotExist(err) {
+		glog.Infof("post of %s failed reading the resource: %v", r.Header.Key, err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
+	}
 
-	var timestamp = models.IncrementClock(r.Header.Clock)
+	timestamp, clockErr := models.IncrementClock(r.Header.Clock)
+	if clockErr != nil {
+		return clockErrorResponse(r, clockErr)
+	}
 	response := protocol.Response{
 		Header: protocol.Header{
 			Clock: timestamp,
 		},
 	}
 
-	if err != nil {
-		glog.Infof("Error from GET in the POST call: %v", err)
-		// this can mean it doesn't exist, so we should make it
-
-		header := []byte{}
-		header = append(header, byte(1+len(r.Header.SharedWith)))
-		// user's id and secret
-		header = append(header, r.Header.From[:]...)
-		header = append(header, r.Header.Secret...)
-
-		glog.Infof("length of header: %d", len(header))
-		glog.Info("should be: 1 + 20 + 256 = 277 bytes")
+	if err != nil && r.Header.Rekey {
+		// a rekey of a resource which has no owners to rekey for
+		glog.Infof("rekey of %s rejected, resource does not exist", r.Header.Key)
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
+	}
 
+	if err != nil {
+		// the user posting owns the new resource, along with anyone it is
 		// shared with
-		for _, shareWith := range r.Header.SharedWith {
-			header = append(header, shareWith.ID[:]...)
-			header = append(header, shareWith.Secret...)
+		header, err := writeHeader(shareWith([]idSecret{
+			idSecret{ID: r.Header.From, Secret: r.Header.Secret},
+		}, r.Header.From, r.Header.SharedWith), r.Header.Tag)
+		if err != nil {
+			glog.Infof("ERR: %s", err)
+			return protocol.ErrorResponse(protocol.BadHeaderCode, err.Error())
 		}
 
-		glog.Infof("new file header: %s", hex.EncodeToString(header))
-		glog.Infof("new file data: %s", hex.EncodeToString(r.Data))
+		glog.Infof("creating %s, %d owners", r.Header.Key, len(r.Header.SharedWith)+1)
 
-		if err := Post(
-			dataPath, r.Header.Key, bytes.NewBuffer(append(header, r.Data...)),
+		if err := checkPost(ctx, dataPath, r, size); err != nil {
+			return quotaErrorResponse(err)
+		}
+		if response.Header.Version, err = storeFile(
+			ctx, r.Header.Key, io.MultiReader(bytes.NewReader(header), data),
 		); err != nil {
-			glog.Infof("ERR: %s", err.Error())
-			return protocol.Response{
-				Status: protocol.Error,
+			if ctx.Err() != nil {
+				return cancelledResponse(ctx, r)
 			}
+			glog.Infof("ERR: %s", err.Error())
+			return storeErrorResponse(err)
 		}
+		chargePost(ctx, dataPath, r, size)
 
 	} else {
 		defer buf.Close()
-		// We need to read the first byte of the file to know
-		// how many id/secret pairs are in the file
-		ownerCount := make([]byte, 1)
-		n, err := buf.Read(ownerCount)
-		if n != 1 {
-			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-		glog.Infof("number of shared owners: %d", ownerCount)
+		idSecrets, _, _, err := readHeader(buf)
 		if err != nil {
 			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-
-		idSecrets := []idSecret{}
-
-		for i := byte(0); i < ownerCount[0]; i++ {
-			glog.Infof("reading the owner list from header i=%d", i)
-			// read the owner id out of the "header" of the file
-			idSlice := make([]byte, 20)
-			n, err := buf.Read(idSlice)
-			glog.Infof("header is: %x", idSlice)
-			if n != 20 {
-				glog.Infof("ERR: could not read header from file\n")
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			if err != nil {
-				glog.Infof("ERR: %s\n", err)
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			glog.Infof("id is: %v", idSlice)
-
-			secretSlice := make([]byte, sessionKeyLen)
-			n, err = buf.Read(secretSlice)
-			glog.Infof("secret is: %x", secretSlice)
-			if n != sessionKeyLen {
-				glog.Infof("ERR: could not read header from file\n")
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			if err != nil {
-				glog.Infof("ERR: %s\n", err)
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			glog.Infof("secret is: %v", secretSlice)
-
-			id := models.Identifier{}
-			copy(id[:], idSlice)
-
-			idSecrets = append(idSecrets, idSecret{
-				ID: id, Secret: secretSlice})
-		}
-
-		// check each id in the list
-		found := false
-		for _, pair := range idSecrets {
-			// all we need to do here is compare the from in the request
-			// header to what the file "header" has, as we have already
-			// authenticated the request against that from id
-			if bytes.Compare(pair.ID[:], r.Header.From[:]) == 0 {
-				found = true
-				response.Header.Secret = pair.Secret
-			}
+			return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header")
 		}
+		glog.V(protocol.DebugLogLevel).Infof("number of shared owners: %d", len(idSecrets))
 
+		// all we need to do here is compare the from in the request
+		// header to what the file "header" has, as we have already
+		// authenticated the request against that from id
+		owner, found := findOwner(idSecrets, r.Header.From)
 		if !found {
-			glog.Infof("Unauthorized Post Request: %v", r)
-			return protocol.Response{
-				Status: protocol.Error,
+			glog.Infof("unauthorized post of %s from %s", r.Header.Key, r.Header.From)
+			return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch")
+		}
+		if owner.ReadOnly {
+			glog.Infof("post of %s rejected, owner has read-only access", r.Header.Key)
+			return readOnlyResponse()
+		}
+		response.Header.Secret = owner.Secret
+
+		// package up the owners, along with anyone newly shared with, or
+		// with their new secrets on a rekey
+		var owners []idSecret
+		if r.Header.Rekey {
+			if owners, err = rekeyOwners(idSecrets, r); err != nil {
+				glog.Infof("rekey of %s rejected: %v", r.Header.Key, err)
+				return protocol.ErrorResponse(protocol.ConflictCode, "rekey does not match the owners: "+err.Error())
 			}
+			response.Header.Secret = r.Header.Secret
+			glog.Infof("rekeying %s for %d owners", r.Header.Key, len(owners))
+		} else {
+			owners = shareWith(idSecrets, r.Header.From, r.Header.SharedWith)
 		}
-		// package up the number of shared owners, and keys
-
-		header := []byte{}
-
-		header = append(header, byte(len(idSecrets)+len(r.Header.SharedWith)))
-		for _, pair := range idSecrets {
-			header = append(header, pair.ID[:]...)
-			header = append(header, pair.Secret...)
+		header, err := writeHeader(owners, r.Header.Tag)
+		if err != nil {
+			glog.Infof("ERR: %s", err)
+			return protocol.ErrorResponse(protocol.BadHeaderCode, err.Error())
 		}
-
-		for _, shareWith := range r.Header.SharedWith {
-			header = append(header, shareWith.ID[:]...)
-			header = append(header, shareWith.Secret...)
+		// now we have all our old state, lets post the data changes.  The
+		// stored file is replaced, which windows does not allow while it is
+		// open.
+		buf.Close()
+		if err := checkPost(ctx, dataPath, r, size); err != nil {
+			return quotaErrorResponse(err)
 		}
-		// now we have all our old state, lets post the data changes
-		glog.Infof("header: %s", hex.EncodeToString(header))
-		glog.Infof("data: %s", hex.EncodeToString(r.Data))
-		if err := Post(
-			dataPath, r.Header.Key, bytes.NewBuffer(append(header, r.Data...)),
+		if response.Header.Version, err = storeFile(
+			ctx, r.Header.Key, io.MultiReader(bytes.NewReader(header), data),
 		); err != nil {
-			glog.Infof("ERR: %s", err.Error())
-			return protocol.Response{
-				Status: protocol.Error,
+			if ctx.Err() != nil {
+				return cancelledResponse(ctx, r)
 			}
+			glog.Infof("ERR: %s", err.Error())
+			return storeErrorResponse(err)
 		}
+		chargePost(ctx, dataPath, r, size)
 	}
 
-	glog.Infof("!!!!!!!!!!!!!!!!!!!!! POST FILE request: !!!!!!!!!!! %s", hex.EncodeToString(r.Data))
+	glog.V(protocol.DebugLogLevel).Infof("post of %s, %d bytes: %s", r.Header.Key, size, hex.EncodeToString(r.Data))
 
+	replicate(ctx, dataPath, r.Header.Key)
 	response.Status = protocol.Success
 	return response
 }
 
-// DeleteFileHandler - This is the server handler which manages Delete File Requests
+// policyViolationResponse - the response to a post the post filter rejected
+// with err
+func policyViolationResponse(err error) protocol.Response {
+	glog.Infof("post rejected by filter: %v", err)
+	return protocol.Response{
+		Header: protocol.Header{
+			Message:   "rejected by content policy: " + err.Error(),
+			ErrorCode: protocol.PolicyViolationCode,
+		},
+		Status: protocol.PolicyViolation,
+	}
+}
+
+// DeleteFileHandler - This is the server handler which manages Delete File Requests.
+// A resource shared by several owners is kept, with the requester removed
+// from its owners, and is only deleted by the last of them.  As a delete
+// never takes the resource from anyone else, read-only owners can delete too.
 func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	if err := r.VerifyUserSignature(); err != nil {
+		return unsignedResponse(r, err)
+	}
 	fileMu.Lock()
 	defer fileMu.Unlock()
 
 	// perform file get based on key
-	buf, err := Get(dataPath, r.Header.Key)
+	buf, err := storeFromContext(ctx).Get(r.Header.Key)
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
 		// write the get file error out.
-		buf.Close()
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
 	}
 
-	ownerCount := make([]byte, 1)
-	n, err := buf.Read(ownerCount)
-	if n != 1 {
-		glog.Infof("ERR: could not read header from file\n")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
-	}
+	idSecrets, _, _, err := readHeader(buf)
+	buf.Close()
 	if err != nil {
 		glog.Infof("ERR: %s\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header")
 	}
 
-	idSecrets := []idSecret{}
-
-	for i := byte(0); i < ownerCount[0]; i++ {
-		// read the owner id out of the "header" of the file
-		idSlice := make([]byte, 20)
-		n, err := buf.Read(idSlice)
-		glog.Infof("header is: %x", idSlice)
-		if n != 20 {
-			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-		if err != nil {
-			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-
-		secretSlice := make([]byte, sessionKeyLen)
-		n, err = buf.Read(secretSlice)
-		glog.Infof("secret is: %x", secretSlice)
-		if n != sessionKeyLen {
-			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-		if err != nil {
-			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-
-		id := models.Identifier{}
-		copy(id[:], idSlice)
-
-		idSecrets = append(idSecrets, idSecret{
-			ID: id, Secret: secretSlice})
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
 	}
-
-	var timestamp = models.IncrementClock(r.Header.Clock)
 	response := protocol.Response{
 		Header: protocol.Header{
 			Clock: timestamp,
@@ -473,34 +528,36 @@ func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Respon
 		Status: protocol.Success,
 	}
 
-	// check each id in the list
-	found := false
-	for _, pair := range idSecrets {
-		// all we need to do here is compare the from in the request
-		// header to what the file "header" has, as we have already
-		// authenticated the request against that from id
-		if bytes.Compare(pair.ID[:], r.Header.From[:]) == 0 {
-			found = true
-			response.Header.Secret = pair.Secret
-		}
-	}
-
 	// all we need to do here is compare the from in the request
 	// header to what the file "header" has, as we have already
 	// authenticated the request against that from id
+	owner, found := findOwner(idSecrets, r.Header.From)
 	if !found {
 		glog.Infof("invalid ownership of this resource requested\n")
-		return protocol.Response{
-			Status: protocol.Error,
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch")
+	}
+	response.Header.Secret = owner.Secret
+
+	if len(idSecrets) > 1 {
+		// the resource is shared, so only the requester loses it, the other
+		// owners keep their access
+		if _, err := storeFromContext(ctx).RemoveOwner(r.Header.Key, r.Header.From); err != nil {
+			glog.Infof("ERR: %s", err.Error())
+			return storeErrorResponse(err)
 		}
+		glog.Infof("removed %s from the owners of %s", r.Header.From, r.Header.Key)
+		replicate(ctx, dataPath, r.Header.Key)
+		return response
 	}
 
-	if err := Delete(dataPath, r.Header.Key); err != nil {
+	if err := storeFromContext(ctx).Delete(r.Header.Key); err != nil {
 		glog.Infof("failed to delete")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to delete resource")
+	}
+	if err := releaseQuota(dataPath, r.Header.Key); err != nil {
+		glog.Warningf("failed to credit quota for %s: %v", r.Header.Key, err)
 	}
+	replicate(ctx, dataPath, r.Header.Key)
 
 	return response
 }
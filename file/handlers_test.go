@@ -0,0 +1,563 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/gob"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/golang/glog"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+// testUser - a user, with the id derived from its key as on the ring
+type testUser struct {
+	id  models.Identifier
+	key *rsa.PrivateKey
+}
+
+func newTestUser(t testing.TB) testUser {
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobKey, err := crypto.GobEncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testUser{id: models.HashBytes(gobKey), key: key}
+}
+
+// sign - r made as the user, and signed by it as its transport would
+func (u testUser) sign(t testing.TB, r *protocol.Request) *protocol.Request {
+	r.Header.From, r.Header.PubKey = u.id, &u.key.PublicKey
+	if err := r.SignAsUser(u.key); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestChangesNeedUserSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner, node := newTestUser(t), newTestUser(t)
+	data := []byte("signed")
+	post := func() *protocol.Request {
+		return &protocol.Request{
+			Header: protocol.Header{
+				Key:        models.Identifier{1},
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+			},
+			Method: protocol.PostFileMethod,
+			Data:   data,
+		}
+	}
+	if resp := PostFileHandler(ctx, owner.sign(t, post())); resp.Status != protocol.Success {
+		t.Fatalf("signed post failed: %v", resp.Err())
+	}
+
+	unsigned := post()
+	unsigned.Header.From, unsigned.Header.PubKey = owner.id, &owner.key.PublicKey
+	// a node making the request as the owner, signed with its own key
+	forged := node.sign(t, post())
+	forged.Header.From = owner.id
+	// a post signed by the owner, turned into a delete on the way
+	tampered := owner.sign(t, post())
+	tampered.Method, tampered.Data, tampered.Header.DataLength = protocol.DeleteFileMethod, nil, 0
+	// a post signed by the owner, with other data of the same length
+	swapped := owner.sign(t, post())
+	swapped.Data = []byte("forged")
+	// a post signed by the owner, sent again as new
+	replayed := owner.sign(t, post())
+	replayed.Header.Nonce = []byte{1}
+	for name, c := range map[string]struct {
+		r       *protocol.Request
+		handler protocol.Handler
+	}{
+		"unsigned post":           {unsigned, PostFileHandler},
+		"post signed by another":  {forged, PostFileHandler},
+		"post turned into delete": {tampered, DeleteFileHandler},
+		"post with other data":    {swapped, PostFileHandler},
+		"post with a new nonce":   {replayed, PostFileHandler},
+	} {
+		if resp := c.handler(ctx, c.r); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+			t.Errorf("%s: expected it refused as unauthorized, got %v", name, resp.Err())
+		}
+	}
+	if _, err := Get(dir, models.Identifier{1}); err != nil {
+		t.Errorf("expected the resource to survive, got %v", err)
+	}
+}
+
+// captureLog - what glog logs at verbosity v while f runs
+func captureLog(t *testing.T, v string, f func()) string {
+	for name, value := range map[string]string{"logtostderr": "true", "v": v} {
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		defer flag.Set(name, old)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	out := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		buf.ReadFrom(r)
+		out <- buf.String()
+	}()
+	f()
+	glog.Flush()
+	os.Stderr = stderr
+	w.Close()
+	return <-out
+}
+
+func TestSecretsNotLogged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner := newTestUser(t)
+	secret := make([]byte, sessionKeyLen)
+	for i := range secret {
+		secret[i] = byte(i*7 + 1)
+	}
+	data := []byte("payload which is only logged at debug level")
+	request := func(method protocol.RequestMethod, data []byte) *protocol.Request {
+		return owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        models.Identifier{3},
+				Secret:     secret,
+				DataLength: uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+	}
+	handle := func() {
+		r := request(protocol.PostFileMethod, data)
+		glog.Infof("handling %v", r)
+		PostFileHandler(ctx, r)
+		GetFileHandler(ctx, request(protocol.GetFileMethod, nil))
+	}
+
+	leaked := func(out string) []string {
+		var found []string
+		for name, s := range map[string]string{
+			"secret as hex":   hex.EncodeToString(secret),
+			"secret as bytes": strings.Trim(fmt.Sprint(secret), "[]"),
+			"secret as text":  string(secret),
+		} {
+			if strings.Contains(out, s) {
+				found = append(found, name)
+			}
+		}
+		return found
+	}
+
+	out := captureLog(t, "0", handle)
+	if !strings.Contains(out, models.Identifier{3}.String()) {
+		t.Fatalf("expected the requests logged, got %q", out)
+	}
+	if found := leaked(out); len(found) > 0 {
+		t.Errorf("expected no secrets logged at the default level, found the %s", strings.Join(found, ", "))
+	}
+	if strings.Contains(out, hex.EncodeToString(data)) {
+		t.Error("expected no payloads logged at the default level")
+	}
+
+	out = captureLog(t, fmt.Sprint(protocol.DebugLogLevel), handle)
+	if !strings.Contains(out, hex.EncodeToString(data)) {
+		t.Errorf("expected payloads logged at the debug level, got %q", out)
+	}
+	if found := leaked(out); len(found) > 0 {
+		t.Errorf("expected no secrets logged at the debug level, found the %s", strings.Join(found, ", "))
+	}
+	if !strings.Contains(out, models.RedactSecret(secret)) {
+		t.Errorf("expected the secret logged redacted at the debug level, got %q", out)
+	}
+}
+
+func TestDeleteSharedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner, friend, reader := newTestUser(t), newTestUser(t), newTestUser(t)
+	request := func(u testUser, key models.Identifier, method protocol.RequestMethod, shared []protocol.SharedSecret) protocol.Response {
+		var data []byte
+		if method == protocol.PostFileMethod {
+			data = []byte("shared")
+		}
+		r := &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+				SharedWith: shared,
+			},
+			Method: method,
+			Data:   data,
+		}
+		if method == protocol.DeleteFileMethod {
+			return DeleteFileHandler(ctx, u.sign(t, r))
+		}
+		return PostFileHandler(ctx, u.sign(t, r))
+	}
+	owners := func(key models.Identifier) []idSecret {
+		f, err := Get(dir, key)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		idSecrets, _, _, err := readHeader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idSecrets
+	}
+
+	// a single owner deletes the file
+	single := models.Identifier{4}
+	if resp := request(owner, single, protocol.PostFileMethod, nil); resp.Status != protocol.Success {
+		t.Fatalf("post failed: %v", resp.Err())
+	}
+	if resp := request(owner, single, protocol.DeleteFileMethod, nil); resp.Status != protocol.Success {
+		t.Fatalf("delete failed: %v", resp.Err())
+	}
+	if _, err := Get(dir, single); !os.IsNotExist(err) {
+		t.Errorf("expected the file of a single owner deleted, got %v", err)
+	}
+
+	shared := models.Identifier{5}
+	if resp := request(owner, shared, protocol.PostFileMethod, []protocol.SharedSecret{
+		{ID: friend.id, Secret: make([]byte, sessionKeyLen)},
+		{ID: reader.id, Secret: make([]byte, sessionKeyLen), ReadOnly: true},
+	}); resp.Status != protocol.Success {
+		t.Fatalf("shared post failed: %v", resp.Err())
+	}
+	// each shared delete removes just the owner making it, read-only or not
+	for _, c := range []struct {
+		name   string
+		u      testUser
+		remain int
+	}{
+		{"owner", owner, 2},
+		{"read-only owner", reader, 1},
+	} {
+		if resp := request(c.u, shared, protocol.DeleteFileMethod, nil); resp.Status != protocol.Success {
+			t.Fatalf("delete by the %s failed: %v", c.name, resp.Err())
+		}
+		left := owners(shared)
+		if len(left) != c.remain {
+			t.Fatalf("expected %d owners left after the %s deleted, got %d", c.remain, c.name, len(left))
+		}
+		if _, found := findOwner(left, c.u.id); found {
+			t.Errorf("expected the %s removed from the owners", c.name)
+		}
+	}
+	if _, found := findOwner(owners(shared), friend.id); !found {
+		t.Fatal("expected the friend to keep the file")
+	}
+	if resp := request(owner, shared, protocol.DeleteFileMethod, nil); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected a removed owner's delete refused, got %v", resp.Err())
+	}
+
+	// the last owner deletes the file
+	if resp := request(friend, shared, protocol.DeleteFileMethod, nil); resp.Status != protocol.Success {
+		t.Fatalf("delete by the last owner failed: %v", resp.Err())
+	}
+	if _, err := Get(dir, shared); !os.IsNotExist(err) {
+		t.Errorf("expected the file deleted by its last owner, got %v", err)
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner := newTestUser(t)
+	for name, c := range map[string]struct {
+		method  protocol.RequestMethod
+		handler protocol.Handler
+	}{
+		"delete":         {protocol.DeleteFileMethod, DeleteFileHandler},
+		"get":            {protocol.GetFileMethod, GetFileHandler},
+		"get public key": {protocol.GetPublicKeyMethod, GetPublicKeyHandler},
+		"revoke":         {protocol.RevokeShareMethod, RevokeShareHandler},
+	} {
+		r := &protocol.Request{
+			Header: protocol.Header{Key: models.Identifier{6}},
+			Method: c.method,
+		}
+		if c.method == protocol.RevokeShareMethod {
+			var buf bytes.Buffer
+			gob.NewEncoder(&buf).Encode(models.RevokeShareRequest{ID: models.Identifier{7}})
+			r.Data, r.Header.DataLength = buf.Bytes(), uint64(buf.Len())
+		}
+		resp := c.handler(ctx, owner.sign(t, r))
+		if resp.Status != protocol.Error || resp.Header.ErrorCode != protocol.NotFoundCode {
+			t.Errorf("%s of a missing key: expected not found, got %v", name, resp.Err())
+		}
+	}
+}
+
+func TestPostPublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	nodeCtx := context.WithValue(ctx, models.CallerTypeContextKey, protocol.NodeType)
+
+	user, other := newTestUser(t), newTestUser(t)
+	post := func(ctx context.Context, key models.Identifier, u testUser) protocol.Response {
+		var buf bytes.Buffer
+		if err := crypto.WritePublicKeyAsPem(&buf, &u.key.PublicKey); err != nil {
+			t.Fatal(err)
+		}
+		return PostPublicKeyHandler(ctx, &protocol.Request{
+			Header: protocol.Header{Key: key, DataLength: uint64(buf.Len())},
+			Method: protocol.PostPublicKeyMethod,
+			Data:   buf.Bytes(),
+		})
+	}
+
+	if resp := post(ctx, user.id, user); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected a key posted by a user refused, got %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(nodeCtx, user.id, other); resp.Header.ErrorCode != protocol.BadHeaderCode {
+		t.Errorf("expected a key posted under another user's id refused, got %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(nodeCtx, user.id, user); resp.Status != protocol.Success {
+		t.Fatalf("post = %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(nodeCtx, user.id, user); resp.Status != protocol.Success {
+		t.Errorf("expected the user's key posted again accepted, got %d, %v", resp.Status, resp.Err())
+	}
+
+	// a key stored for a user is never replaced by another
+	var buf bytes.Buffer
+	crypto.WritePublicKeyAsPem(&buf, &user.key.PublicKey)
+	if err := Post(dir, other.id, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp := post(nodeCtx, other.id, other); resp.Header.ErrorCode != protocol.ConflictCode {
+		t.Errorf("expected a key replacing another refused, got %d, %v", resp.Status, resp.Err())
+	}
+}
+
+func TestPostSharedWithTooMany(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner := newTestUser(t)
+	post := func(key models.Identifier, shares int) protocol.Response {
+		shared := make([]protocol.SharedSecret, shares)
+		for i := range shared {
+			shared[i] = protocol.SharedSecret{ID: models.Identifier{byte(i), 2}, Secret: make([]byte, sessionKeyLen)}
+		}
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				SharedWith: shared,
+			},
+			Method: protocol.PostFileMethod,
+		}))
+	}
+	// the poster and everyone it is shared with make up the owners
+	if resp := post(models.Identifier{8}, MaxOwners-1); resp.Status != protocol.Success {
+		t.Errorf("post shared with %d users failed: %v", MaxOwners-1, resp.Err())
+	}
+	if resp := post(models.Identifier{9}, MaxOwners); resp.Header.ErrorCode != protocol.BadHeaderCode {
+		t.Errorf("expected a post shared with %d users refused, got %v", MaxOwners, resp.Err())
+	}
+	if resp := post(models.Identifier{9}, 300); resp.Header.ErrorCode != protocol.BadHeaderCode {
+		t.Errorf("expected a post shared with 300 users refused, got %v", resp.Err())
+	}
+	if _, err := Get(dir, models.Identifier{9}); !os.IsNotExist(err) {
+		t.Errorf("expected nothing stored for the refused posts, got %v", err)
+	}
+}
+
+// flakyStore - a Store whose Get fails with err while it is set, as a disk
+// which cannot be read would
+type flakyStore struct {
+	Store
+	err error
+}
+
+func (s *flakyStore) Get(key models.Identifier) (io.ReadCloser, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Store.Get(key)
+}
+
+func TestPostCreateOrUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	store := &flakyStore{Store: NewMemoryStore()}
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.StoreContextKey, store)
+
+	owner, other := newTestUser(t), newTestUser(t)
+	key := models.Identifier{0x0c}
+	post := func(u testUser, data string) protocol.Response {
+		return PostFileHandler(ctx, u.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     []byte(strings.Repeat("s", sessionKeyLen)),
+				DataLength: uint64(len(data)),
+			},
+			Method: protocol.PostFileMethod,
+			Data:   []byte(data),
+		}))
+	}
+	get := func(want string) {
+		t.Helper()
+		resp := GetFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{Key: key},
+			Method: protocol.GetFileMethod,
+		}))
+		if resp.Status != protocol.Success || string(resp.Data) != want {
+			t.Fatalf("expected %q stored, got %q, %v", want, resp.Data, resp.Err())
+		}
+	}
+
+	// a key which is not stored is created
+	if resp := post(owner, "first"); resp.Status != protocol.Success {
+		t.Fatalf("create failed: %v", resp.Err())
+	}
+	get("first")
+
+	// an existing resource is updated by its owner, and only by its owner
+	if resp := post(owner, "second"); resp.Status != protocol.Success {
+		t.Fatalf("update failed: %v", resp.Err())
+	}
+	get("second")
+	if resp := post(other, "stolen"); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected a post by another user refused, got %v", resp.Err())
+	}
+
+	// a failure to read the resource is not taken for it being missing, which
+	// would recreate it owned by the caller
+	store.err = &os.PathError{Op: "stat", Path: key.String(), Err: syscall.EIO}
+	resp := post(other, "stolen")
+	if resp.Status != protocol.Error || resp.Header.ErrorCode != protocol.InternalErrorCode {
+		t.Errorf("expected the read failure returned, got %d, %v", resp.Status, resp.Err())
+	}
+	store.err = nil
+	get("second")
+	if resp := post(other, "stolen"); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected the resource still owned by its owner, got %v", resp.Err())
+	}
+}
+
+func TestPostSecretLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretlen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	// a user with a 3072 bit key, whose secrets are 384 bytes
+	key, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobKey, err := crypto.GobEncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := testUser{id: models.HashBytes(gobKey), key: key}
+	secret := bytes.Repeat([]byte{0x38}, key.PublicKey.Size())
+	post := func(secret []byte, shared []protocol.SharedSecret) protocol.Response {
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        models.Identifier{0x38},
+				Secret:     secret,
+				SharedWith: shared,
+				DataLength: 4,
+			},
+			Method: protocol.PostFileMethod,
+			Data:   []byte("data"),
+		}))
+	}
+
+	if resp := post(secret, []protocol.SharedSecret{
+		{ID: models.Identifier{2}, Secret: make([]byte, sessionKeyLen)},
+	}); resp.Status != protocol.Success {
+		t.Fatalf("post with a %d byte secret failed: %v", len(secret), resp.Err())
+	}
+	resp := GetFileHandler(ctx, owner.sign(t, &protocol.Request{
+		Header: protocol.Header{Key: models.Identifier{0x38}},
+		Method: protocol.GetFileMethod,
+	}))
+	if resp.Status != protocol.Success || string(resp.Data) != "data" {
+		t.Fatalf("get failed: %q, %v", resp.Data, resp.Err())
+	}
+	if !bytes.Equal(resp.Header.Secret, secret) {
+		t.Errorf("got a %d byte secret back, expected the %d posted", len(resp.Header.Secret), len(secret))
+	}
+
+	// a secret which does not fit the key would not decrypt
+	if resp := post(make([]byte, sessionKeyLen), nil); resp.Header.ErrorCode != protocol.BadHeaderCode {
+		t.Errorf("expected a %d byte secret refused for a 3072 bit key, got %v", sessionKeyLen, resp.Err())
+	}
+	if resp := post(secret, []protocol.SharedSecret{
+		{ID: models.Identifier{2}, Secret: []byte{1, 2, 3}},
+	}); resp.Header.ErrorCode != protocol.BadHeaderCode {
+		t.Errorf("expected a 3 byte shared secret refused, got %v", resp.Err())
+	}
+}
@@ -0,0 +1,278 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// ListKeys - the keys of every resource stored in path, at any depth of
+// sharding, archived versions are not included
+func ListKeys(path string) ([]models.Identifier, error) {
+	keys := []models.Identifier{}
+	err := walkStored(path, func(file string, key models.Identifier) error {
+		if filepath.Base(file) == key.String() {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read data dir: ")
+	}
+	return keys, nil
+}
+
+// ReadKey - read the raw stored bytes of a resource, including the owner
+// header, so it can be handed off to another node as is
+func ReadKey(path string, key models.Identifier) ([]byte, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	return ioutil.ReadFile(keyPath(path, key))
+}
+
+// KeyVersion - the raw stored bytes of a version of a resource
+type KeyVersion struct {
+	Version uint64
+	Data    []byte
+}
+
+// ReadKeyVersions - read the raw stored bytes of a resource, as ReadKey,
+// along with its version id and every archived version of it, oldest first,
+// so its history is handed off with it
+func ReadKeyVersions(path string, key models.Identifier) (KeyVersion, []KeyVersion, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	data, err := ioutil.ReadFile(keyPath(path, key))
+	if err != nil {
+		return KeyVersion{}, nil, err
+	}
+	latest, err := LatestVersion(path, key)
+	if err != nil {
+		return KeyVersion{}, nil, err
+	}
+	versions, err := archivedVersions(path, key)
+	if err != nil {
+		return KeyVersion{}, nil, errors.Wrap(err, "failed to list versions: ")
+	}
+	archived := make([]KeyVersion, 0, len(versions))
+	for _, version := range versions {
+		data, err := ioutil.ReadFile(versionPath(path, key, version))
+		if err != nil {
+			return KeyVersion{}, nil, errors.Wrap(err, "failed to read version: ")
+		}
+		archived = append(archived, KeyVersion{Version: version, Data: data})
+	}
+	return KeyVersion{Version: latest, Data: data}, archived, nil
+}
+
+// errTransferConflict - a resource handed off is already stored, with other
+// data, which is kept rather than replaced by a copy which may be older
+var errTransferConflict = errors.New("a different copy of the resource is already stored")
+
+// storeTransferred - store data handed off as the version id version of the
+// resource key, as an archived version of it if archived.  A copy already
+// stored is kept, and if it is not the same data errTransferConflict is
+// returned.  stored is false if the copy was already there.  The version
+// counter is raised to version, so version ids carry on from where they were
+// on the node the resource was handed off from.
+func storeTransferred(path string, key models.Identifier, version uint64, archived bool, data []byte) (stored bool, err error) {
+	dest := keyPath(path, key)
+	if archived {
+		dest = versionPath(path, key, version)
+	}
+	current, err := ioutil.ReadFile(dest)
+	if err == nil {
+		if !bytes.Equal(current, data) {
+			return false, errTransferConflict
+		}
+		return false, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "failed to read resource: ")
+	}
+
+	tmp, err := writeTemp(path, key, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrap(err, "error storing resource")
+	}
+	invalidateRead(path, key)
+	return true, raiseVersionCounter(path, key, version)
+}
+
+// raiseVersionCounter - raise the version counter of the resource key to
+// version, if it is below it, so version ids carry on from where they were
+// on the node the resource was copied from
+func raiseVersionCounter(path string, key models.Identifier, version uint64) error {
+	counted, err := readVersionCounter(path, key)
+	if err != nil {
+		return err
+	}
+	if version > counted {
+		return writeVersionCounter(path, key, version)
+	}
+	return nil
+}
+
+// RemoveKeyIfUnchanged - remove a resource which was handed off to another
+// node, as long as it has not been written to since it was read.  Returns
+// false if the resource changed and was kept.
+func RemoveKeyIfUnchanged(path string, key models.Identifier, data []byte) (bool, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	current, err := ioutil.ReadFile(keyPath(path, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// deleted while being handed off
+			return true, nil
+		}
+		return false, errors.Wrap(err, "failed to read resource: ")
+	}
+	if !bytes.Equal(current, data) {
+		return false, nil
+	}
+	if err := Delete(path, key); err != nil {
+		return false, err
+	}
+	if err := releaseQuota(path, key); err != nil {
+		glog.Warningf("failed to credit quota for %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// TransferKeyHandler - This is the server handler which accepts a resource
+// handed off by another node.  The raw data is stored as is, along with the
+// archived versions of the resource sent before it when this node retains
+// versions.  A copy we already hold came from a write routed to us as the
+// owner, and is kept: a transfer of the same data succeeds, and one of other
+// data is refused as a conflict, so the sender keeps its copy too.
+func TransferKeyHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	if caller, _ := protocol.CallerTypeFromContext(ctx); caller != protocol.NodeType {
+		glog.Infof("transfer of %s rejected, not from a node", r.Header.Key)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "transfers are only accepted from nodes")
+	}
+
+	if err := checkFreeSpace(ctx, dataPath, postLength(r)); err != nil {
+		return insufficientSpaceResponse()
+	}
+
+	if r.Header.Archived && keepVersionsFromContext(ctx) == 0 {
+		// versions are not retained here
+		return protocol.Response{
+			Status: protocol.Success,
+		}
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	stored, err := storeTransferred(dataPath, r.Header.Key, r.Header.Version, r.Header.Archived, r.Data)
+	if err == errTransferConflict {
+		glog.Infof("transfer of %s refused, a different copy is stored", r.Header.Key)
+		return protocol.ErrorResponse(protocol.ConflictCode, err.Error())
+	}
+	if err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storeErrorResponse(err)
+	}
+	if !stored {
+		glog.Infof("transfer of %s skipped, already stored", r.Header.Key)
+		return protocol.Response{
+			Status: protocol.Success,
+		}
+	}
+	// the resource was already accepted by the ring, so it is charged to its
+	// first owner even if that takes them over quota, and so are its
+	// archived versions
+	if idSecrets, _, data, err := readHeader(bytes.NewReader(r.Data)); err == nil {
+		if size, err := io.Copy(ioutil.Discard, data); err == nil {
+			if r.Header.Archived {
+				err = archiveQuota(ctx, dataPath, r.Header.Key, idSecrets[0].ID, uint64(size))
+			} else {
+				err = chargeQuota(ctx, dataPath, r.Header.Key, idSecrets[0].ID, uint64(size), 0)
+			}
+			if err != nil {
+				glog.Warningf("failed to charge quota for %s: %v", r.Header.Key, err)
+			}
+		}
+	}
+	if r.Header.Archived {
+		glog.Infof("stored transferred version %d of %s", r.Header.Version, r.Header.Key)
+		return protocol.Response{
+			Status: protocol.Success,
+		}
+	}
+	replicate(ctx, dataPath, r.Header.Key)
+	glog.Infof("stored transferred resource %s", r.Header.Key)
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
+
+// replicate - have the resource key, which was just changed, copied to the
+// replicas of this node, if it is part of a ring which replicates
+func replicate(ctx context.Context, dataPath string, key models.Identifier) {
+	if fn, ok := ctx.Value(models.ReplicateFunctionContextKey).(func(string, models.Identifier)); ok {
+		fn(dataPath, key)
+	}
+}
+
+// ReplicateKeyHandler - This is the server handler which accepts a replica
+// of a resource changed on the node responsible for it.  The raw data
+// replaces what we hold, as the version id it has on that node, and a
+// replica with no data is of a deleted resource.  Its archived versions are
+// transferred before it.  Replicas are copies, so are not charged to the
+// owner's quota.
+func ReplicateKeyHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	if caller, _ := protocol.CallerTypeFromContext(ctx); caller != protocol.NodeType {
+		glog.Infof("replica of %s rejected, not from a node", r.Header.Key)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "replicas are only accepted from nodes")
+	}
+
+	if len(r.Data) == 0 {
+		fileMu.Lock()
+		defer fileMu.Unlock()
+		if err := Delete(dataPath, r.Header.Key); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			glog.Infof("ERR: %s", err.Error())
+			return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to delete resource")
+		}
+		glog.Infof("removed replica of deleted resource %s", r.Header.Key)
+		return protocol.Response{
+			Status: protocol.Success,
+		}
+	}
+
+	if err := checkFreeSpace(ctx, dataPath, postLength(r)); err != nil {
+		return insufficientSpaceResponse()
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	if err := Post(dataPath, r.Header.Key, bytes.NewBuffer(r.Data)); err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storeErrorResponse(err)
+	}
+	if err := raiseVersionCounter(dataPath, r.Header.Key, r.Header.Version); err != nil {
+		glog.Warningf("failed to count version of replica of %s: %v", r.Header.Key, err)
+	}
+	glog.Infof("stored replica of %s", r.Header.Key)
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
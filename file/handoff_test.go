@@ -0,0 +1,88 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestTransferKeyVersions(t *testing.T) {
+	from, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(from)
+	to, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(to)
+	defer delete(quotaLedgers, to)
+
+	key := models.Identifier{1}
+	for _, data := range []string{"first", "second", "third"} {
+		if _, err := PostVersion(from, key, strings.NewReader(data), 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current, archived, err := ReadKeyVersions(from, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != 3 || string(current.Data) != "third" || len(archived) != 2 {
+		t.Fatalf("read version %d %q with %d archived", current.Version, current.Data, len(archived))
+	}
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, to)
+	ctx = context.WithValue(ctx, models.KeepVersionsContextKey, uint(5))
+	ctx = context.WithValue(ctx, models.CallerTypeContextKey, protocol.NodeType)
+	transfer := func(version KeyVersion, archived bool) protocol.Response {
+		return TransferKeyHandler(ctx, &protocol.Request{
+			Header: protocol.Header{
+				Type:       protocol.NodeType,
+				Key:        key,
+				Version:    version.Version,
+				Archived:   archived,
+				DataLength: uint64(len(version.Data)),
+			},
+			Method: protocol.TransferKeyMethod,
+			Data:   version.Data,
+		})
+	}
+	for _, version := range archived {
+		if resp := transfer(version, true); resp.Status != protocol.Success {
+			t.Fatalf("transfer of version %d failed: %v", version.Version, resp.Err())
+		}
+	}
+	if resp := transfer(current, false); resp.Status != protocol.Success {
+		t.Fatalf("transfer failed: %v", resp.Err())
+	}
+
+	if latest, err := LatestVersion(to, key); err != nil || latest != 3 {
+		t.Errorf("latest version handed off is %d, %v, expected 3", latest, err)
+	}
+	f, err := GetVersion(to, key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ioutil.ReadAll(f)
+	f.Close()
+	if string(first) != "first" {
+		t.Errorf("version 1 handed off is %q", first)
+	}
+	if version, err := PostVersion(to, key, strings.NewReader("fourth"), 5); err != nil || version != 4 {
+		t.Errorf("post after the handoff is version %d, %v, expected 4", version, err)
+	}
+
+	// the new owner's copy is kept, a transfer of other data is refused
+	if resp := transfer(current, false); resp.Status == protocol.Success {
+		t.Error("expected a transfer of other data than stored refused")
+	} else if err, ok := resp.Err().(*protocol.ResponseError); !ok || err.Code != protocol.ConflictCode {
+		t.Errorf("expected a conflict, got %v", resp.Err())
+	}
+}
@@ -0,0 +1,243 @@
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// headerBufferSize - the read buffer for a resource, large enough that the
+// owner header of a resource shared with a handful of users is parsed from
+// a single read of the file
+const headerBufferSize = 4096
+
+// MaxOwners - the most owners a resource can have, the user who posted it
+// and those it is shared with.  The owner count of a stored header is checked
+// against it too, so a corrupt header cannot make a read allocate for more.
+const MaxOwners = 64
+
+const (
+	// headerMarker - the first byte of a versioned header.  Headers written
+	// before the header was versioned start with the owner count instead,
+	// which is never zero, as every resource has the owner that posted it.
+	// They were written while identifiers were SHA-1 digests, and are no
+	// longer read.
+	headerMarker byte = 0
+	// permissionsVersion - the header version which added a permission byte
+	// to each owner, the oldest version read
+	permissionsVersion byte = 2
+	// tagVersion - the header version which added the integrity tag of the
+	// resource data after the owners
+	tagVersion byte = 3
+	// headerVersion - the current header version, which stores the length
+	// of each owner's secret before it, so the secrets of keys of any size
+	// can be told apart
+	headerVersion byte = 4
+)
+
+const (
+	// minSecretLen, maxSecretLen - the shortest and longest secret an owner
+	// can have, a session key encrypted with an RSA key of 1024 to 8192 bits
+	minSecretLen = 128
+	maxSecretLen = 1024
+)
+
+const (
+	// readWrite - the owner can read and overwrite the resource
+	readWrite byte = iota
+	// readOnly - the owner can only read the resource
+	readOnly
+)
+
+// readHeader - parse the owner header of a stored resource: the owner count,
+// followed by the id, of models.IdentifierLen bytes, permission, and the
+// two byte length and bytes of the session key secret of each owner, and then
+// the length and bytes of the integrity tag the client computed over the
+// resource data.  The file is read through a buffer so the header does not
+// cost a read per field.  Headers from before tags were added have no tag,
+// and headers from before secret lengths were added have secrets of
+// sessionKeyLen bytes.  Returns the owners, the tag and a reader positioned
+// at the start of the resource data.
+func readHeader(r io.Reader) ([]idSecret, []byte, io.Reader, error) {
+	br := bufio.NewReaderSize(r, headerBufferSize)
+
+	marker, err := br.ReadByte()
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to read header marker: ")
+	}
+	if marker != headerMarker {
+		// an unversioned header, which starts with the owner count, and
+		// whose owner ids are too short to be read as current ones
+		return nil, nil, nil, errors.New("unsupported header version 1")
+	}
+	var prefix = make([]byte, 2)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to read header version: ")
+	}
+	version, ownerCount := prefix[0], prefix[1]
+	if version < permissionsVersion || version > headerVersion {
+		return nil, nil, nil, errors.Errorf("unsupported header version %d", version)
+	}
+	if ownerCount == 0 {
+		// nobody could ever read or remove the resource
+		return nil, nil, nil, errors.New("header has no owners")
+	}
+	if ownerCount > MaxOwners {
+		return nil, nil, nil, errors.Errorf("header has %d owners, more than the %d allowed", ownerCount, MaxOwners)
+	}
+
+	idSecrets := make([]idSecret, 0, ownerCount)
+	for i := byte(0); i < ownerCount; i++ {
+		var pair idSecret
+		if _, err := io.ReadFull(br, pair.ID[:models.IdentifierLen]); err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "failed to read id of owner %d: ", i)
+		}
+		permission, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "failed to read permission of owner %d: ", i)
+		}
+		pair.ReadOnly = permission == readOnly
+		secretLen := sessionKeyLen
+		if version >= headerVersion {
+			var length = make([]byte, 2)
+			if _, err := io.ReadFull(br, length); err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "failed to read secret length of owner %d: ", i)
+			}
+			secretLen = int(binary.BigEndian.Uint16(length))
+			if secretLen < minSecretLen || secretLen > maxSecretLen {
+				// checked before allocating, as for the owner count
+				return nil, nil, nil, errors.Errorf("secret of owner %d is %d bytes, not between %d and %d",
+					i, secretLen, minSecretLen, maxSecretLen)
+			}
+		}
+		pair.Secret = make([]byte, secretLen)
+		if _, err := io.ReadFull(br, pair.Secret); err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "failed to read secret of owner %d: ", i)
+		}
+		idSecrets = append(idSecrets, pair)
+	}
+
+	var tag []byte
+	if version >= tagVersion {
+		tagLen, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to read tag length: ")
+		}
+		tag = make([]byte, tagLen)
+		if _, err := io.ReadFull(br, tag); err != nil {
+			return nil, nil, nil, errors.Wrap(err, "failed to read tag: ")
+		}
+	}
+	return idSecrets, tag, br, nil
+}
+
+// writeHeader - serialize the owners and integrity tag of a resource as a
+// header in the current version, to be stored in front of the resource data.
+// The tag is stored last, so it can be replaced in place as chunks of an
+// upload are appended.
+func writeHeader(idSecrets []idSecret, tag []byte) ([]byte, error) {
+	if len(idSecrets) == 0 || len(idSecrets) > MaxOwners {
+		return nil, errors.Errorf("a resource must have between 1 and %d owners, not %d", MaxOwners, len(idSecrets))
+	}
+	if len(tag) > 255 {
+		return nil, errors.Errorf("a tag can be at most 255 bytes, not %d", len(tag))
+	}
+	header := []byte{headerMarker, headerVersion, byte(len(idSecrets))}
+	for _, pair := range idSecrets {
+		header = append(header, pair.ID[:]...)
+		if pair.ReadOnly {
+			header = append(header, readOnly)
+		} else {
+			header = append(header, readWrite)
+		}
+		secret := pair.Secret
+		if len(secret) == 0 {
+			// a resource posted unencrypted, such as the transaction log,
+			// has no session key, which is stored as zeros so the owners
+			// after it can still be read
+			secret = make([]byte, sessionKeyLen)
+		}
+		if len(secret) < minSecretLen || len(secret) > maxSecretLen {
+			return nil, errors.Errorf("the secret of owner %s is %d bytes, not between %d and %d",
+				pair.ID, len(secret), minSecretLen, maxSecretLen)
+		}
+		var length = make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(secret)))
+		header = append(header, length...)
+		header = append(header, secret...)
+	}
+	header = append(header, byte(len(tag)))
+	return append(header, tag...), nil
+}
+
+// checkSecrets - check the secrets of a post can be stored.  The poster's
+// secret is the session key encrypted with their own key, so must be as long
+// as its modulus, and the secrets of those it is shared with must be of a
+// length some RSA key could give.  A post without a secret, such as of the
+// transaction log, is not encrypted.
+func checkSecrets(r *protocol.Request) error {
+	if len(r.Header.Secret) > 0 && r.Header.PubKey != nil && len(r.Header.Secret) != r.Header.PubKey.Size() {
+		return errors.Errorf("the secret is %d bytes, a key of %d bits gives %d",
+			len(r.Header.Secret), r.Header.PubKey.N.BitLen(), r.Header.PubKey.Size())
+	}
+	for _, share := range r.Header.SharedWith {
+		if len(share.Secret) < minSecretLen || len(share.Secret) > maxSecretLen {
+			return errors.Errorf("the secret shared with %s is %d bytes, not between %d and %d",
+				share.ID, len(share.Secret), minSecretLen, maxSecretLen)
+		}
+	}
+	return nil
+}
+
+// findOwner - the owner entry for id, false if id is not an owner of the
+// resource
+func findOwner(idSecrets []idSecret, id models.Identifier) (idSecret, bool) {
+	var (
+		owner idSecret
+		found bool
+	)
+	// every owner is compared, so the time taken does not depend on where
+	// in the header the owner is
+	for _, pair := range idSecrets {
+		if models.IdentifierEqual(pair.ID, id) && !found {
+			owner, found = pair, true
+		}
+	}
+	return owner, found
+}
+
+// isCreator - whether id is the creator of the resource, the first of its
+// owners, whose access no other owner can revoke or change
+func isCreator(idSecrets []idSecret, id models.Identifier) bool {
+	return len(idSecrets) > 0 && models.IdentifierEqual(idSecrets[0].ID, id)
+}
+
+// shareWith - add the users a resource is shared with to its owners.  Sharing
+// with a user who is already an owner replaces their secret and permission,
+// except for the user posting and the creator, who keep the access they
+// already have.
+func shareWith(idSecrets []idSecret, from models.Identifier, shared []protocol.SharedSecret) []idSecret {
+Shared:
+	for _, share := range shared {
+		if share.ID == from || isCreator(idSecrets, share.ID) {
+			continue
+		}
+		var pair = idSecret{
+			ID:       share.ID,
+			Secret:   share.Secret,
+			ReadOnly: share.ReadOnly,
+		}
+		for i := range idSecrets {
+			if idSecrets[i].ID == share.ID {
+				idSecrets[i] = pair
+				continue Shared
+			}
+		}
+		idSecrets = append(idSecrets, pair)
+	}
+	return idSecrets
+}
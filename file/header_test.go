@@ -0,0 +1,366 @@
+package file
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+var testOwners = []idSecret{
+	{ID: models.Identifier{1}, Secret: bytes.Repeat([]byte{0xaa}, sessionKeyLen)},
+	{ID: models.Identifier{2}, Secret: bytes.Repeat([]byte{0xbb}, sessionKeyLen), ReadOnly: true},
+	{ID: models.Identifier{3}, Secret: bytes.Repeat([]byte{0xcc}, sessionKeyLen)},
+}
+
+func TestReadHeader(t *testing.T) {
+	tag := bytes.Repeat([]byte{0xdd}, 32)
+	header, err := writeHeader(testOwners, tag)
+	if err != nil {
+		t.Fatalf("writeHeader failed: %v", err)
+	}
+	stored := append(header, []byte("ciphertext")...)
+
+	idSecrets, readTag, data, err := readHeader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("readHeader failed: %v", err)
+	}
+	if len(idSecrets) != len(testOwners) {
+		t.Fatalf("read %d owners, expected %d", len(idSecrets), len(testOwners))
+	}
+	for i, owner := range testOwners {
+		if idSecrets[i].ID != owner.ID || !bytes.Equal(idSecrets[i].Secret, owner.Secret) ||
+			idSecrets[i].ReadOnly != owner.ReadOnly {
+			t.Errorf("owner %d was not read correctly", i)
+		}
+	}
+	if !bytes.Equal(readTag, tag) {
+		t.Errorf("tag = %x, expected %x", readTag, tag)
+	}
+	if rest, _ := ioutil.ReadAll(data); string(rest) != "ciphertext" {
+		t.Errorf("data after header = %q, expected %q", rest, "ciphertext")
+	}
+	if owner, ok := findOwner(idSecrets, models.Identifier{2}); !ok || !owner.ReadOnly {
+		t.Error("findOwner did not find the read-only owner")
+	}
+	if _, ok := findOwner(idSecrets, models.Identifier{4}); ok {
+		t.Error("findOwner found an id which is not an owner")
+	}
+
+	// a header cut short anywhere must fail rather than return partial owners
+	for _, length := range []int{
+		0, 1, 2, 3, 3 + models.IdentifierLen, 3 + models.IdentifierLen + 1 + 100,
+		3 + 2*(models.IdentifierLen+1+sessionKeyLen), len(header) - 1 - len(tag),
+		len(header) - 1,
+	} {
+		if _, _, _, err := readHeader(bytes.NewReader(stored[:length])); err == nil {
+			t.Errorf("readHeader of a header truncated to %d bytes did not fail", length)
+		}
+	}
+}
+
+func TestReadHeaderWithoutSecret(t *testing.T) {
+	// a resource posted unencrypted, such as the transaction log
+	header, err := writeHeader([]idSecret{{ID: models.Identifier{1}}}, nil)
+	if err != nil {
+		t.Fatalf("writeHeader failed: %v", err)
+	}
+	idSecrets, _, data, err := readHeader(bytes.NewReader(append(header, []byte("log")...)))
+	if err != nil {
+		t.Fatalf("readHeader failed: %v", err)
+	}
+	if len(idSecrets) != 1 || idSecrets[0].ID != (models.Identifier{1}) {
+		t.Errorf("owners = %+v, expected the poster", idSecrets)
+	}
+	if rest, _ := ioutil.ReadAll(data); string(rest) != "log" {
+		t.Errorf("data after header = %q, expected %q", rest, "log")
+	}
+}
+
+func TestReadUnversionedHeader(t *testing.T) {
+	// headers written before permissions were added have no version, and
+	// owner ids of the SHA-1 digests identifiers used to be
+	var stored = []byte{byte(len(testOwners))}
+	for _, owner := range testOwners {
+		stored = append(stored, owner.ID[:20]...)
+		stored = append(stored, owner.Secret...)
+	}
+	stored = append(stored, []byte("ciphertext")...)
+
+	if _, _, _, err := readHeader(bytes.NewReader(stored)); err == nil {
+		t.Error("readHeader of an unversioned header did not fail")
+	} else if !strings.Contains(err.Error(), "unsupported header version") {
+		t.Errorf("readHeader of an unversioned header failed with %v, expected it unsupported", err)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	poster := idSecret{ID: models.Identifier{9}, Secret: bytes.Repeat([]byte{0x99}, sessionKeyLen)}
+	for _, shared := range [][]protocol.SharedSecret{
+		nil,
+		{{ID: models.Identifier{1}, Secret: testOwners[0].Secret}},
+		{
+			{ID: models.Identifier{1}, Secret: testOwners[0].Secret},
+			{ID: models.Identifier{2}, Secret: testOwners[1].Secret, ReadOnly: true},
+			{ID: models.Identifier{3}, Secret: testOwners[2].Secret},
+		},
+	} {
+		owners := shareWith([]idSecret{poster}, poster.ID, shared)
+		header, err := writeHeader(owners, []byte{1, 2, 3})
+		if err != nil {
+			t.Fatalf("writeHeader with %d shared owners failed: %v", len(shared), err)
+		}
+		if header[0] != headerMarker || header[1] != headerVersion {
+			t.Errorf("header with %d shared owners starts %x, expected the version prefix", len(shared), header[:2])
+		}
+		idSecrets, tag, _, err := readHeader(bytes.NewReader(header))
+		if err != nil {
+			t.Fatalf("readHeader with %d shared owners failed: %v", len(shared), err)
+		}
+		if len(idSecrets) != len(shared)+1 || idSecrets[0].ID != poster.ID {
+			t.Fatalf("read %d owners, expected the poster and %d shared", len(idSecrets), len(shared))
+		}
+		for i, share := range shared {
+			if got := idSecrets[i+1]; got.ID != share.ID || !bytes.Equal(got.Secret, share.Secret) ||
+				got.ReadOnly != share.ReadOnly {
+				t.Errorf("shared owner %d of %d was not read correctly", i, len(shared))
+			}
+		}
+		if !bytes.Equal(tag, []byte{1, 2, 3}) {
+			t.Errorf("tag = %x with %d shared owners", tag, len(shared))
+		}
+	}
+}
+
+// writeVersion3Header - the header writeHeader wrote before secret lengths
+// were stored, kept to check those headers are still read
+func writeVersion3Header(idSecrets []idSecret, tag []byte) []byte {
+	header := []byte{headerMarker, tagVersion, byte(len(idSecrets))}
+	for _, pair := range idSecrets {
+		header = append(header, pair.ID[:]...)
+		if pair.ReadOnly {
+			header = append(header, readOnly)
+		} else {
+			header = append(header, readWrite)
+		}
+		header = append(header, pair.Secret...)
+	}
+	header = append(header, byte(len(tag)))
+	return append(header, tag...)
+}
+
+func TestReadVersion3Header(t *testing.T) {
+	// headers written before secret lengths were stored have secrets of
+	// sessionKeyLen bytes, with nothing between them
+	stored := append(writeVersion3Header(testOwners, []byte{0xee, 0xee}), []byte("ciphertext")...)
+
+	idSecrets, tag, data, err := readHeader(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("readHeader failed: %v", err)
+	}
+	for i, owner := range testOwners {
+		if idSecrets[i].ID != owner.ID || !bytes.Equal(idSecrets[i].Secret, owner.Secret) ||
+			idSecrets[i].ReadOnly != owner.ReadOnly {
+			t.Errorf("owner %d was not read correctly", i)
+		}
+	}
+	if !bytes.Equal(tag, []byte{0xee, 0xee}) {
+		t.Errorf("tag = %x, expected eeee", tag)
+	}
+	if rest, _ := ioutil.ReadAll(data); string(rest) != "ciphertext" {
+		t.Errorf("data after header = %q, expected %q", rest, "ciphertext")
+	}
+}
+
+func TestHeaderSecretLengths(t *testing.T) {
+	// owners with keys of 1024, 2048 and 4096 bits
+	owners := []idSecret{
+		{ID: models.Identifier{1}, Secret: bytes.Repeat([]byte{0xaa}, 128)},
+		{ID: models.Identifier{2}, Secret: bytes.Repeat([]byte{0xbb}, 256), ReadOnly: true},
+		{ID: models.Identifier{3}, Secret: bytes.Repeat([]byte{0xcc}, 512)},
+	}
+	header, err := writeHeader(owners, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idSecrets, tag, _, err := readHeader(bytes.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, owner := range owners {
+		if idSecrets[i].ID != owner.ID || !bytes.Equal(idSecrets[i].Secret, owner.Secret) ||
+			idSecrets[i].ReadOnly != owner.ReadOnly {
+			t.Errorf("owner %d with a %d byte secret was not read correctly", i, len(owner.Secret))
+		}
+	}
+	if !bytes.Equal(tag, []byte{1}) {
+		t.Errorf("tag = %x, expected 01", tag)
+	}
+
+	for _, length := range []int{minSecretLen - 1, maxSecretLen + 1} {
+		if _, err := writeHeader([]idSecret{{ID: models.Identifier{1}, Secret: make([]byte, length)}}, nil); err == nil {
+			t.Errorf("writeHeader with a %d byte secret did not fail", length)
+		}
+	}
+	// a stored length out of bounds fails before the secret is allocated
+	header, err = writeHeader(owners[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengthAt := 3 + models.IdentifierLen + 1
+	header[lengthAt], header[lengthAt+1] = 0xff, 0xff
+	if _, _, _, err := readHeader(bytes.NewReader(header)); err == nil ||
+		!strings.Contains(err.Error(), "not between") {
+		t.Errorf("readHeader of a 65535 byte secret returned %v, expected it out of bounds", err)
+	}
+}
+
+func TestReadHeaderUnknownVersion(t *testing.T) {
+	header, err := writeHeader(testOwners, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []byte{1, headerVersion + 1, 0xff} {
+		header[1] = version
+		if _, _, _, err := readHeader(bytes.NewReader(header)); err == nil {
+			t.Errorf("readHeader of header version %d did not fail", version)
+		} else if !strings.Contains(err.Error(), "unsupported header version") {
+			t.Errorf("readHeader of header version %d failed with %v, expected it unsupported", version, err)
+		}
+	}
+}
+
+func TestReadHeaderWithoutOwners(t *testing.T) {
+	// a versioned header can express an owner count of zero, which would
+	// leave the resource to nobody
+	stored := append([]byte{headerMarker, headerVersion, 0, 0}, []byte("ciphertext")...)
+	if _, _, _, err := readHeader(bytes.NewReader(stored)); err == nil {
+		t.Error("readHeader of a header without owners did not fail")
+	}
+	if _, err := writeHeader(nil, nil); err == nil {
+		t.Error("writeHeader without owners did not fail")
+	}
+}
+
+func TestWriteHeaderShortSecret(t *testing.T) {
+	short := []idSecret{
+		testOwners[0],
+		{ID: models.Identifier{2}, Secret: []byte{1, 2, 3}},
+		testOwners[2],
+	}
+	if _, err := writeHeader(short, nil); err == nil {
+		t.Fatal("writeHeader with a short secret did not fail")
+	}
+
+	// a secret cut short in a stored header fails the read, rather than
+	// taking the next owner's bytes
+	header, err := writeHeader(testOwners[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := header[:len(header)-1-sessionKeyLen/2]
+	if _, _, _, err := readHeader(bytes.NewReader(cut)); err == nil ||
+		!strings.Contains(err.Error(), "failed to read secret") {
+		t.Errorf("readHeader of a short secret returned %v, expected a failed read of the secret", err)
+	}
+}
+
+func TestShareWith(t *testing.T) {
+	var owners = []idSecret{
+		{ID: models.Identifier{1}, Secret: []byte{1}},
+		{ID: models.Identifier{2}, Secret: []byte{2}},
+	}
+	shared := shareWith(owners, models.Identifier{1}, []protocol.SharedSecret{
+		// the poster cannot change their own access
+		{ID: models.Identifier{1}, Secret: []byte{9}, ReadOnly: true},
+		// an existing owner is downgraded
+		{ID: models.Identifier{2}, Secret: []byte{8}, ReadOnly: true},
+		{ID: models.Identifier{3}, Secret: []byte{3}, ReadOnly: true},
+	})
+	if len(shared) != 3 {
+		t.Fatalf("shared with %d owners, expected 3", len(shared))
+	}
+	if shared[0].ReadOnly || shared[0].Secret[0] != 1 {
+		t.Error("the poster's access was changed")
+	}
+	if !shared[1].ReadOnly || shared[1].Secret[0] != 8 {
+		t.Error("an existing owner was not updated")
+	}
+	if !shared[2].ReadOnly || shared[2].ID != (models.Identifier{3}) {
+		t.Error("a new owner was not added")
+	}
+}
+
+func TestMaxOwners(t *testing.T) {
+	owners := make([]idSecret, MaxOwners+1)
+	for i := range owners {
+		owners[i] = idSecret{ID: models.Identifier{byte(i), 1}}
+	}
+	header, err := writeHeader(owners[:MaxOwners], nil)
+	if err != nil {
+		t.Fatalf("writeHeader with %d owners failed: %v", MaxOwners, err)
+	}
+	if idSecrets, _, _, err := readHeader(bytes.NewReader(header)); err != nil || len(idSecrets) != MaxOwners {
+		t.Errorf("readHeader of %d owners read %d, %v", MaxOwners, len(idSecrets), err)
+	}
+	if _, err := writeHeader(owners, nil); err == nil {
+		t.Errorf("writeHeader with %d owners did not fail", MaxOwners+1)
+	}
+
+	// a stored header claiming too many owners fails before anything is
+	// read for them
+	header[2] = MaxOwners + 1
+	if _, _, _, err := readHeader(bytes.NewReader(header)); err == nil ||
+		!strings.Contains(err.Error(), "more than the") {
+		t.Errorf("readHeader of %d owners returned %v, expected too many owners", MaxOwners+1, err)
+	}
+}
+
+// stutterReader - a reader returning at most one byte a call, and nothing at
+// all every other call, as io.Reader allows
+type stutterReader struct {
+	r     io.Reader
+	calls int
+}
+
+func (s *stutterReader) Read(p []byte) (int, error) {
+	s.calls++
+	if s.calls%2 == 0 || len(p) == 0 {
+		return 0, nil
+	}
+	return s.r.Read(p[:1])
+}
+
+func TestReadHeaderShortReads(t *testing.T) {
+	poster := idSecret{ID: models.Identifier{9}, Secret: bytes.Repeat([]byte{0x99}, 512)}
+	owners := append([]idSecret{poster}, testOwners...)
+	header, err := writeHeader(owners, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("the resource data after the header")
+
+	idSecrets, tag, rest, err := readHeader(&stutterReader{r: bytes.NewReader(append(header, data...))})
+	if err != nil {
+		t.Fatalf("readHeader of short reads failed: %v", err)
+	}
+	if len(idSecrets) != len(owners) {
+		t.Fatalf("read %d owners, expected %d", len(idSecrets), len(owners))
+	}
+	for i, owner := range owners {
+		if got := idSecrets[i]; got.ID != owner.ID || !bytes.Equal(got.Secret, owner.Secret) ||
+			got.ReadOnly != owner.ReadOnly {
+			t.Errorf("owner %d was not read correctly", i)
+		}
+	}
+	if !bytes.Equal(tag, []byte{1, 2, 3}) {
+		t.Errorf("tag = %x", tag)
+	}
+	if got, err := ioutil.ReadAll(rest); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("data after the header = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,118 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// ListFiles - the resources stored in path which owner is an owner of.
+// Stored data without an owner header, such as public keys, is skipped.
+func ListFiles(path string, owner models.Identifier) ([]models.ListedFile, error) {
+	keys, err := ListKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []models.ListedFile{}
+	for _, key := range keys {
+		listed, ok, err := listFile(path, key, owner)
+		if err != nil {
+			glog.Infof("skipping %s in listing: %v", key, err)
+			continue
+		}
+		if ok {
+			files = append(files, listed)
+		}
+	}
+	return files, nil
+}
+
+// Usage - the number of resources stored in path, and the bytes they take up
+// on disk, including their headers.  Archived versions are not counted.
+func Usage(path string) (int, uint64, error) {
+	keys, err := ListKeys(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var size uint64
+	for _, key := range keys {
+		info, err := os.Stat(keyPath(path, key))
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		size += uint64(info.Size())
+	}
+	return len(keys), size, nil
+}
+
+// listFile - the listing of the resource key, false if owner is not one of
+// its owners
+func listFile(path string, key, owner models.Identifier) (models.ListedFile, bool, error) {
+	f, err := Get(path, key)
+	if err != nil {
+		return models.ListedFile{}, false, err
+	}
+	defer f.Close()
+
+	idSecrets, _, data, err := readHeader(f)
+	if err != nil {
+		return models.ListedFile{}, false, err
+	}
+	pair, found := findOwner(idSecrets, owner)
+	if !found {
+		return models.ListedFile{}, false, nil
+	}
+	seeker, ok := f.(io.Seeker)
+	if !ok {
+		return models.ListedFile{}, false, errors.New("resource is not seekable")
+	}
+	start, err := dataStart(seeker, data)
+	if err != nil {
+		return models.ListedFile{}, false, err
+	}
+	end, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return models.ListedFile{}, false, errors.Wrap(err, "failed to find end of resource: ")
+	}
+	return models.ListedFile{
+		Key:      key,
+		Size:     uint64(end - start),
+		ReadOnly: pair.ReadOnly,
+	}, true, nil
+}
+
+// ListFilesHandler - This is the server handler which lists the resources
+// this node stores which the caller is an owner of.  The response data is a
+// gob encoded models.ListFilesResponse.
+func ListFilesHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		dataPath = ctx.Value(models.DataPathContextKey).(string)
+		out      = &bytes.Buffer{}
+	)
+
+	fileMu.Lock()
+	files, err := ListFiles(dataPath, r.Header.From)
+	fileMu.Unlock()
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not list resources")
+	}
+	glog.Infof("listed %d resources for %s", len(files), r.Header.From)
+
+	if err := gob.NewEncoder(out).Encode(models.ListFilesResponse{Files: files}); err != nil {
+		glog.Infof("encode list files response error: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "failed to encode response")
+	}
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
@@ -0,0 +1,59 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestListFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := func(key models.Identifier, owners []idSecret, data string) {
+		header, err := writeHeader(owners, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Post(dir, key, bytes.NewReader(append(header, data...))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret := make([]byte, sessionKeyLen)
+	store(models.Identifier{1}, []idSecret{{ID: models.Identifier{7}, Secret: secret}}, "mine")
+	store(models.Identifier{2}, []idSecret{{ID: models.Identifier{8}, Secret: secret}}, "theirs")
+	store(models.Identifier{3}, []idSecret{
+		{ID: models.Identifier{8}, Secret: secret},
+		{ID: models.Identifier{7}, Secret: secret, ReadOnly: true},
+	}, "shared")
+	// a public key, stored without an owner header
+	Post(dir, models.Identifier{4}, bytes.NewReader([]byte("not a header")))
+
+	files, err := ListFiles(dir, models.Identifier{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("listed %d files, expected 2: %v", len(files), files)
+	}
+	for _, f := range files {
+		switch f.Key {
+		case models.Identifier{1}:
+			if f.Size != 4 || f.ReadOnly {
+				t.Errorf("owned file listed as %+v", f)
+			}
+		case models.Identifier{3}:
+			if f.Size != 6 || !f.ReadOnly {
+				t.Errorf("read-only shared file listed as %+v", f)
+			}
+		default:
+			t.Errorf("listed a file which is not owned: %s", f.Key)
+		}
+	}
+}
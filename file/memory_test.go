@@ -0,0 +1,174 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	key := models.Identifier{1}
+
+	if _, err := store.Get(key); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing key not to exist, got %v", err)
+	}
+	if err := store.Post(key, bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(key, bytes.NewBufferString(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteAt(key, 0, []byte("J")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the copy read is not changed by later writes
+	if err := store.WriteAt(key, 0, []byte("h")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(f); string(data) != "Jello world" {
+		t.Errorf("expected \"Jello world\", got %q", data)
+	}
+	f.Close()
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(key); !os.IsNotExist(err) {
+		t.Errorf("expected a deleted key not to exist, got %v", err)
+	}
+	if err := store.Delete(key); err == nil {
+		t.Error("expected a second delete to fail")
+	}
+	if err := store.Append(key, bytes.NewBufferString("x")); err == nil {
+		t.Error("expected an append to a missing key to fail")
+	}
+}
+
+func TestHandlersWithMemoryStore(t *testing.T) {
+	// the data path still holds the quota ledger, but no resources
+	dir, err := ioutil.TempDir("", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	store := NewMemoryStore()
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.StoreContextKey, store)
+
+	owner := newTestUser(t)
+	key := models.Identifier{2}
+	request := func(method protocol.RequestMethod, data []byte) *protocol.Request {
+		return owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+	}
+
+	if resp := GetFileHandler(ctx, request(protocol.GetFileMethod, nil)); resp.Header.ErrorCode != protocol.NotFoundCode {
+		t.Fatalf("expected a get of a missing key to be not found, got %v", resp.Err())
+	}
+	// the key is missing, so the post creates the resource
+	if resp := PostFileHandler(ctx, request(protocol.PostFileMethod, []byte("first"))); resp.Status != protocol.Success {
+		t.Fatalf("post failed: %v", resp.Err())
+	}
+	f, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("expected the post to create the resource in the store, got %v", err)
+	}
+	idSecrets, _, _, err := readHeader(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := findOwner(idSecrets, owner.id); !found {
+		t.Error("expected the poster to own the new resource")
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) > 1 {
+		t.Errorf("expected nothing but the quota ledger on disk, got %d files", len(entries))
+	}
+
+	// now it exists, so the post updates it
+	if resp := PostFileHandler(ctx, request(protocol.PostFileMethod, []byte("second"))); resp.Status != protocol.Success {
+		t.Fatalf("update failed: %v", resp.Err())
+	}
+	resp := GetFileHandler(ctx, request(protocol.GetFileMethod, nil))
+	if resp.Status != protocol.Success || string(resp.Data) != "second" {
+		t.Fatalf("expected the updated data, got %q, %v", resp.Data, resp.Err())
+	}
+
+	if resp := DeleteFileHandler(ctx, request(protocol.DeleteFileMethod, nil)); resp.Status != protocol.Success {
+		t.Fatalf("delete failed: %v", resp.Err())
+	}
+	if resp := GetFileHandler(ctx, request(protocol.GetFileMethod, nil)); resp.Header.ErrorCode != protocol.NotFoundCode {
+		t.Errorf("expected a get after delete to be not found, got %v", resp.Err())
+	}
+}
+
+func TestVersionsWithMemoryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.StoreContextKey, NewMemoryStore())
+	ctx = context.WithValue(ctx, models.KeepVersionsContextKey, uint(1))
+
+	owner := newTestUser(t)
+	request := func(method protocol.RequestMethod, version uint64, data []byte) *protocol.Request {
+		return owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        models.Identifier{3},
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+				Version:    version,
+			},
+			Method: method,
+			Data:   data,
+		})
+	}
+	for i, data := range []string{"first", "second", "third"} {
+		resp := PostFileHandler(ctx, request(protocol.PostFileMethod, 0, []byte(data)))
+		if resp.Status != protocol.Success || resp.Header.Version != uint64(i+1) {
+			t.Fatalf("post of %s: expected version %d, got %d, %v", data, i+1, resp.Header.Version, resp.Err())
+		}
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) > 1 {
+		t.Errorf("expected versions kept in the store rather than on disk, got %d files", len(entries))
+	}
+
+	for _, c := range []struct {
+		version uint64
+		data    string
+	}{
+		{0, "third"},
+		{3, "third"},
+		{2, "second"},
+	} {
+		resp := GetFileHandler(ctx, request(protocol.GetFileMethod, c.version, nil))
+		if resp.Status != protocol.Success || string(resp.Data) != c.data {
+			t.Errorf("version %d: expected %q, got %q, %v", c.version, c.data, resp.Data, resp.Err())
+		}
+	}
+	// only one previous version is kept
+	if resp := GetFileHandler(ctx, request(protocol.GetFileMethod, 1, nil)); resp.Header.ErrorCode != protocol.NotFoundCode {
+		t.Errorf("expected the pruned version not found, got %v", resp.Err())
+	}
+}
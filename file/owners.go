@@ -0,0 +1,197 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// GetOwnersHandler - This is the server handler which returns the owners of
+// a resource, as a gob encoded models.OwnersResponse, so an owner can give
+// each of them a new secret when it rekeys the resource.  Only an owner can
+// get the owners.
+func GetOwnersHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	if err := r.VerifyUserSignature(); err != nil {
+		return unsignedResponse(r, err)
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	buf, err := storeFromContext(ctx).Get(r.Header.Key)
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
+	}
+	idSecrets, _, _, err := readHeader(buf)
+	buf.Close()
+	if err != nil {
+		glog.Infof("ERR: %s\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header")
+	}
+	if _, found := findOwner(idSecrets, r.Header.From); !found {
+		glog.Infof("unauthorized get of the owners of %s from %s", r.Header.Key, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch")
+	}
+
+	var owners = models.OwnersResponse{Owners: make([]models.Owner, 0, len(idSecrets))}
+	for _, pair := range idSecrets {
+		owners.Owners = append(owners.Owners, models.Owner{ID: pair.ID, ReadOnly: pair.ReadOnly})
+	}
+	var out = new(bytes.Buffer)
+	if err := gob.NewEncoder(out).Encode(owners); err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not encode owners")
+	}
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
+	}
+	return protocol.Response{
+		Header: protocol.Header{
+			Clock:      timestamp,
+			DataLength: uint64(out.Len()),
+		},
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
+
+// TransferOwnershipHandler - This is the server handler which hands a
+// resource to another user, the gob encoded models.TransferOwnershipRequest
+// in the request data, in a single rewrite of its header: the user becomes a
+// read-write owner with the secret given, and the caller is no longer an
+// owner.  The caller is removed from the archived versions of the resource
+// too, as a revoke would.  Only a read-write owner can transfer a resource,
+// and the storage it takes is charged to the user it is handed to.  A
+// resource its creator transfers has the user it is handed to as its
+// creator.
+func TransferOwnershipHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	if err := r.VerifyUserSignature(); err != nil {
+		return unsignedResponse(r, err)
+	}
+
+	var transfer models.TransferOwnershipRequest
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(&transfer); err != nil {
+		glog.Infof("failed to decode transfer request: %v", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid transfer request")
+	}
+	if transfer.ID == r.Header.From {
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "cannot transfer a resource to its owner")
+	}
+	if len(transfer.Secret) < minSecretLen || len(transfer.Secret) > maxSecretLen {
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid secret for the new owner")
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	buf, err := storeFromContext(ctx).Get(r.Header.Key)
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
+	}
+	idSecrets, tag, data, err := readHeader(buf)
+	if err != nil {
+		buf.Close()
+		glog.Infof("ERR: %s\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header")
+	}
+	owner, found := findOwner(idSecrets, r.Header.From)
+	if !found {
+		buf.Close()
+		glog.Infof("unauthorized transfer of %s from %s", r.Header.Key, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch")
+	}
+	if owner.ReadOnly {
+		buf.Close()
+		glog.Infof("transfer of %s rejected, owner has read-only access", r.Header.Key)
+		return readOnlyResponse()
+	}
+	// read in full, the stored file is replaced, which windows does not allow
+	// while it is open
+	contents, err := ioutil.ReadAll(data)
+	buf.Close()
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource")
+	}
+
+	var owners []idSecret
+	for _, pair := range shareWith(idSecrets, r.Header.From, []protocol.SharedSecret{
+		{ID: transfer.ID, Secret: transfer.Secret},
+	}) {
+		switch {
+		case pair.ID == r.Header.From:
+		case pair.ID == transfer.ID && isCreator(idSecrets, r.Header.From):
+			owners = append([]idSecret{pair}, owners...)
+		default:
+			owners = append(owners, pair)
+		}
+	}
+	header, err := writeHeader(owners, tag)
+	if err != nil {
+		glog.Infof("ERR: %s", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, err.Error())
+	}
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
+	}
+	if err := checkQuota(ctx, dataPath, r.Header.Key, transfer.ID, uint64(len(contents)), 0); err != nil {
+		return quotaErrorResponse(err)
+	}
+	if err := storeFromContext(ctx).Post(r.Header.Key, io.MultiReader(bytes.NewReader(header), bytes.NewReader(contents))); err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storeErrorResponse(err)
+	}
+	// the caller is no longer an owner of the resource, only of the
+	// archived versions, which this removes them from
+	if _, err := storeFromContext(ctx).RemoveOwner(r.Header.Key, r.Header.From); err != nil {
+		glog.Infof("failed to remove %s from the versions of %s: %v", r.Header.From, r.Header.Key, err)
+	}
+	if err := chargeQuota(ctx, dataPath, r.Header.Key, transfer.ID, uint64(len(contents)), 0); err != nil {
+		glog.Warningf("failed to charge quota for %s: %v", r.Header.Key, err)
+	}
+	glog.Infof("transferred %s from %s to %s", r.Header.Key, r.Header.From, transfer.ID)
+	replicate(ctx, dataPath, r.Header.Key)
+
+	return protocol.Response{
+		Header: protocol.Header{
+			Clock: timestamp,
+		},
+		Status: protocol.Success,
+	}
+}
+
+// rekeyOwners - the owners of a resource after the rekey r posts: every
+// owner keeps the access they have, with the new secret r carries for them.
+// Fails if r leaves out an owner, who could no longer read the resource, or
+// carries a secret for a user who is not an owner, as a rekey cannot share.
+func rekeyOwners(idSecrets []idSecret, r *protocol.Request) ([]idSecret, error) {
+	secrets := map[models.Identifier][]byte{r.Header.From: r.Header.Secret}
+	for _, share := range r.Header.SharedWith {
+		secrets[share.ID] = share.Secret
+	}
+	rekeyed := make([]idSecret, 0, len(idSecrets))
+	for _, pair := range idSecrets {
+		secret, ok := secrets[pair.ID]
+		if !ok || len(secret) == 0 {
+			return nil, errors.Errorf("owner %s has no new secret", pair.ID)
+		}
+		rekeyed = append(rekeyed, idSecret{ID: pair.ID, Secret: secret, ReadOnly: pair.ReadOnly})
+		delete(secrets, pair.ID)
+	}
+	for id := range secrets {
+		return nil, errors.Errorf("%s is not an owner", id)
+	}
+	return rekeyed, nil
+}
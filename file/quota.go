@@ -0,0 +1,162 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// quotaFile - the name of the quota ledger within the data path, which is
+// not a hex key so it is never mistaken for a resource
+const quotaFile = "quota"
+
+// errQuotaExceeded - storing a post would take its owner over their quota
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaLedgers - the quota ledger of each data path, loaded the first time
+// it is needed.  Guarded by fileMu.
+var quotaLedgers = map[string]*models.QuotaLedger{}
+
+// maxBytesPerUserFromContext - the bytes of resource data the node stores
+// for each owner, zero when quotas are disabled
+func maxBytesPerUserFromContext(ctx context.Context) uint64 {
+	if max, ok := ctx.Value(models.MaxBytesPerUserContextKey).(uint64); ok {
+		return max
+	}
+	return 0
+}
+
+// loadQuotaLedger - the quota ledger of dataPath, empty if none was saved
+func loadQuotaLedger(dataPath string) (*models.QuotaLedger, error) {
+	if ql, ok := quotaLedgers[dataPath]; ok {
+		return ql, nil
+	}
+	ql := models.NewQuotaLedger()
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", dataPath, quotaFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to read quota ledger: ")
+	}
+	if err == nil {
+		if ql, err = models.DecodeQuotaLedger(data); err != nil {
+			return nil, err
+		}
+	}
+	quotaLedgers[dataPath] = ql
+	return ql, nil
+}
+
+// saveQuotaLedger - persist the quota ledger of dataPath, replacing the
+// saved one atomically so a crash never leaves a partial ledger
+func saveQuotaLedger(dataPath string, ql *models.QuotaLedger) error {
+	data, err := models.EncodeQuotaLedger(ql)
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s/%s", dataPath, quotaFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errors.Wrap(err, "failed to write quota ledger: ")
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errors.Wrap(err, "failed to replace quota ledger: ")
+	}
+	return nil
+}
+
+// checkQuota - check owner can be charged size bytes for the current copy
+// of key, along with the archived versions it keeps as storeFile does with
+// keep, without going over the configured quota
+func checkQuota(ctx context.Context, dataPath string, key, owner models.Identifier, size uint64, keep uint) error {
+	limit := maxBytesPerUserFromContext(ctx)
+	if limit == 0 {
+		return nil
+	}
+	ql, err := loadQuotaLedger(dataPath)
+	if err != nil {
+		return err
+	}
+	if ql.Exceeds(key, ql.Replacement(key, owner, size, keep), limit) {
+		glog.Infof("rejecting %d bytes for %s, %s has used %d of %d",
+			size, key, owner, ql.Usage[owner], limit)
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// chargeQuota - charge owner size bytes for the current copy of key, along
+// with the archived versions it keeps as storeFile does with keep, when
+// quotas are enabled
+func chargeQuota(ctx context.Context, dataPath string, key, owner models.Identifier, size uint64, keep uint) error {
+	if maxBytesPerUserFromContext(ctx) == 0 {
+		return nil
+	}
+	ql, err := loadQuotaLedger(dataPath)
+	if err != nil {
+		return err
+	}
+	ql.Charge(key, ql.Replacement(key, owner, size, keep))
+	return saveQuotaLedger(dataPath, ql)
+}
+
+// archiveQuota - charge owner size bytes for an archived version of key,
+// when quotas are enabled
+func archiveQuota(ctx context.Context, dataPath string, key, owner models.Identifier, size uint64) error {
+	if maxBytesPerUserFromContext(ctx) == 0 {
+		return nil
+	}
+	ql, err := loadQuotaLedger(dataPath)
+	if err != nil {
+		return err
+	}
+	ql.Archive(key, owner, size)
+	return saveQuotaLedger(dataPath, ql)
+}
+
+// releaseQuota - credit back the charge for key, which was removed.  This
+// is done whether or not quotas are enabled now, so a resource stored while
+// they were is never counted once it is gone.
+func releaseQuota(dataPath string, key models.Identifier) error {
+	ql, err := loadQuotaLedger(dataPath)
+	if err != nil {
+		return err
+	}
+	if !ql.Release(key) {
+		return nil
+	}
+	return saveQuotaLedger(dataPath, ql)
+}
+
+// checkPost - check the poster of r can be charged size bytes for the
+// resource it posts, along with the version it archives
+func checkPost(ctx context.Context, dataPath string, r *protocol.Request, size uint64) error {
+	return checkQuota(ctx, dataPath, r.Header.Key, r.Header.From, size, keepVersionsFromContext(ctx))
+}
+
+// chargePost - charge the poster of r size bytes for the resource it
+// stored, along with the version it archived.  The data is already stored,
+// so a failure is only logged.
+func chargePost(ctx context.Context, dataPath string, r *protocol.Request, size uint64) {
+	if err := chargeQuota(ctx, dataPath, r.Header.Key, r.Header.From, size, keepVersionsFromContext(ctx)); err != nil {
+		glog.Warningf("failed to charge quota for %s: %v", r.Header.Key, err)
+	}
+}
+
+// quotaErrorResponse - the response to a post checkQuota failed with err
+func quotaErrorResponse(err error) protocol.Response {
+	if err != errQuotaExceeded {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not check storage quota")
+	}
+	return protocol.Response{
+		Header: protocol.Header{
+			Message:   errQuotaExceeded.Error(),
+			ErrorCode: protocol.QuotaExceededCode,
+		},
+		Status: protocol.QuotaExceeded,
+	}
+}
@@ -0,0 +1,162 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.MaxBytesPerUserContextKey, uint64(100))
+	owner := newTestUser(t)
+
+	post := func(key models.Identifier, length int) protocol.ResponseStatus {
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(length),
+			},
+			Method: protocol.PostFileMethod,
+			Data:   bytes.Repeat([]byte{1}, length),
+		})).Status
+	}
+
+	if status := post(models.Identifier{1}, 60); status != protocol.Success {
+		t.Fatalf("post under quota = %d", status)
+	}
+	if status := post(models.Identifier{2}, 40); status != protocol.Success {
+		t.Fatalf("post up to quota = %d", status)
+	}
+	if status := post(models.Identifier{3}, 1); status != protocol.QuotaExceeded {
+		t.Errorf("post over quota = %d, expected %d", status, protocol.QuotaExceeded)
+	}
+	// an overwrite is only charged the difference
+	if status := post(models.Identifier{2}, 40); status != protocol.Success {
+		t.Errorf("overwrite at quota = %d", status)
+	}
+
+	resp := DeleteFileHandler(ctx, owner.sign(t, &protocol.Request{
+		Header: protocol.Header{Key: models.Identifier{1}},
+		Method: protocol.DeleteFileMethod,
+	}))
+	if resp.Status != protocol.Success {
+		t.Fatalf("delete = %d", resp.Status)
+	}
+	if status := post(models.Identifier{3}, 1); status != protocol.Success {
+		t.Errorf("post after delete = %d", status)
+	}
+
+	// the ledger is persisted, so a restarted node still enforces it
+	delete(quotaLedgers, dir)
+	ql, err := loadQuotaLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ql.Usage[owner.id] != 41 {
+		t.Errorf("persisted usage = %d, expected 41", ql.Usage[owner.id])
+	}
+}
+
+func TestQuotaCountsVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.MaxBytesPerUserContextKey, uint64(100))
+	ctx = context.WithValue(ctx, models.KeepVersionsContextKey, uint(1))
+	owner, key := newTestUser(t), models.Identifier{1}
+
+	post := func(length int) protocol.ResponseStatus {
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(length),
+			},
+			Method: protocol.PostFileMethod,
+			Data:   bytes.Repeat([]byte{1}, length),
+		})).Status
+	}
+
+	if status := post(60); status != protocol.Success {
+		t.Fatalf("post under quota = %d", status)
+	}
+	// the 60 bytes replaced are kept as a version
+	if status := post(60); status != protocol.QuotaExceeded {
+		t.Errorf("overwrite keeping a version over quota = %d, expected %d", status, protocol.QuotaExceeded)
+	}
+	if status := post(30); status != protocol.Success {
+		t.Fatalf("overwrite keeping a version under quota = %d", status)
+	}
+	// only one version is kept, so the 60 bytes are pruned
+	if status := post(70); status != protocol.Success {
+		t.Errorf("overwrite after the version was pruned = %d", status)
+	}
+	ql, err := loadQuotaLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ql.Usage[owner.id] != 100 {
+		t.Errorf("usage = %d, expected 100", ql.Usage[owner.id])
+	}
+}
+
+func TestQuotaCountsStagedUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.MaxBytesPerUserContextKey, uint64(100))
+	owner := newTestUser(t)
+
+	post := func(key models.Identifier, header protocol.Header, length int) protocol.ResponseStatus {
+		header.Key = key
+		header.Secret = make([]byte, sessionKeyLen)
+		header.DataLength = uint64(length)
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: header,
+			Method: protocol.PostFileMethod,
+			Data:   bytes.Repeat([]byte{1}, length),
+		})).Status
+	}
+
+	if status := post(models.Identifier{1}, protocol.Header{More: true}, 60); status != protocol.Success {
+		t.Fatalf("first chunk = %d", status)
+	}
+	// the staged chunk counts, though the upload is not finished
+	if status := post(models.Identifier{2}, protocol.Header{}, 50); status != protocol.QuotaExceeded {
+		t.Errorf("post over quota with an upload staged = %d, expected %d", status, protocol.QuotaExceeded)
+	}
+	if status := post(models.Identifier{1}, protocol.Header{Offset: 60}, 10); status != protocol.Success {
+		t.Fatalf("last chunk = %d", status)
+	}
+	// the upload counts once, as the resource it was stored as
+	if status := post(models.Identifier{2}, protocol.Header{}, 30); status != protocol.Success {
+		t.Errorf("post up to quota after the upload = %d", status)
+	}
+	if status := post(models.Identifier{3}, protocol.Header{}, 1); status != protocol.QuotaExceeded {
+		t.Errorf("post over quota = %d, expected %d", status, protocol.QuotaExceeded)
+	}
+}
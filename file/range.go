@@ -0,0 +1,52 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// errRangeNotSatisfiable - the requested range starts beyond the end of the
+// resource data
+var errRangeNotSatisfiable = errors.New("range starts beyond the end of the resource")
+
+// dataStart - the offset of the resource data within f, where data is the
+// reader readHeader returned after parsing the header of f
+func dataStart(f io.Seeker, data io.Reader) (int64, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to find resource data: ")
+	}
+	if br, ok := data.(*bufio.Reader); ok {
+		// the header was parsed through a buffer which read ahead into the data
+		start -= int64(br.Buffered())
+	}
+	return start, nil
+}
+
+// readRange - read length bytes of the resource data, which starts at start
+// within f, from offset, a zero length reading to the end, giving up once ctx
+// is done.  Returns the bytes read and the length of the whole resource data.
+func readRange(ctx context.Context, f io.ReadSeeker, start int64, offset, length uint64) ([]byte, uint64, error) {
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to find end of resource: ")
+	}
+	total := uint64(end - start)
+	if offset > total {
+		return nil, total, errRangeNotSatisfiable
+	}
+	if length == 0 || length > total-offset {
+		length = total - offset
+	}
+	if _, err := f.Seek(start+int64(offset), io.SeekStart); err != nil {
+		return nil, total, errors.Wrap(err, "failed to seek to range: ")
+	}
+	var out = make([]byte, length)
+	if _, err := io.ReadFull(contextReader{ctx, f}, out); err != nil {
+		return nil, total, errors.Wrap(err, "failed to read range: ")
+	}
+	return out, total, nil
+}
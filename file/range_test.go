@@ -0,0 +1,57 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadRange(t *testing.T) {
+	header, err := writeHeader([]idSecret{
+		{Secret: make([]byte, sessionKeyLen)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(append(header, []byte("0123456789")...))
+	f.Seek(0, 0)
+
+	_, _, data, err := readHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, err := dataStart(f, data)
+	if err != nil || start != int64(len(header)) {
+		t.Fatalf("expected data to start at %d, got %d, %v", len(header), start, err)
+	}
+	out, total, err := readRange(context.Background(), f, start, 3, 4)
+	if err != nil {
+		t.Error("failed to read range: ", err)
+	}
+	if total != 10 {
+		t.Error("expected total of 10, got ", total)
+	}
+	if !bytes.Equal(out, []byte("3456")) {
+		t.Errorf("expected 3456, got %s", out)
+	}
+
+	out, _, err = readRange(context.Background(), f, start, 8, 0)
+	if err != nil || !bytes.Equal(out, []byte("89")) {
+		t.Errorf("expected 89 to the end, got %s, %v", out, err)
+	}
+	out, _, err = readRange(context.Background(), f, start, 6, 100)
+	if err != nil || !bytes.Equal(out, []byte("6789")) {
+		t.Errorf("expected 6789 for a range past the end, got %s, %v", out, err)
+	}
+	if _, _, err = readRange(context.Background(), f, start, 11, 1); err != errRangeNotSatisfiable {
+		t.Error("expected range not satisfiable, got ", err)
+	}
+}
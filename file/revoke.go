@@ -0,0 +1,167 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// errLastOwner - removing the owner would leave the resource with none
+var errLastOwner = errors.New("cannot revoke the last owner")
+
+// removeOwner - rewrite the header of the stored file at filePath without
+// the owner id, copying the data across rather than reading it into memory.
+// Returns false if id was not an owner, in which case the file is left as
+// it is.
+func removeOwner(filePath string, id models.Identifier) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, errors.Wrap(err, "error opening file")
+	}
+	defer f.Close()
+
+	idSecrets, tag, data, err := readHeader(f)
+	if err != nil {
+		return false, err
+	}
+	kept := []idSecret{}
+	for _, pair := range idSecrets {
+		if pair.ID != id {
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) == len(idSecrets) {
+		return false, nil
+	}
+	if len(kept) == 0 {
+		return false, errLastOwner
+	}
+	header, err := writeHeader(kept, tag)
+	if err != nil {
+		return false, err
+	}
+
+	tmp := filePath + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, errors.Wrap(err, "error creating file")
+	}
+	if _, err := io.Copy(out, io.MultiReader(bytes.NewReader(header), data)); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return false, errors.Wrap(err, "error writing file")
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return false, errors.Wrap(err, "error closing file")
+	}
+	// the original must be closed before it can be replaced on windows
+	f.Close()
+	return true, os.Rename(tmp, filePath)
+}
+
+// RevokeShare - remove the owner id from the resource key, and from every
+// archived version of it, so no version can be read with that owner's
+// secret.  An archived version which only id owned is removed.  Returns false if
+// id was not an owner of the resource.
+func RevokeShare(path string, key models.Identifier, id models.Identifier) (bool, error) {
+	defer invalidateRead(path, key)
+	removed, err := removeOwner(keyPath(path, key), id)
+	if err != nil {
+		return false, err
+	}
+	versions, err := archivedVersions(path, key)
+	if err != nil {
+		return removed, errors.Wrap(err, "failed to list versions: ")
+	}
+	for _, version := range versions {
+		_, err := removeOwner(versionPath(path, key, version), id)
+		if err == errLastOwner {
+			glog.Infof("removing version %d of %s, it was only owned by %s", version, key, id)
+			err = os.Remove(versionPath(path, key, version))
+		}
+		if err != nil {
+			return removed, errors.Wrapf(err, "failed to revoke version %d: ", version)
+		}
+	}
+	return removed, nil
+}
+
+// RevokeShareHandler - This is the server handler which removes a user, the
+// gob encoded models.RevokeShareRequest in the request data, from the
+// owners of a resource.  Only a read-write owner can revoke access, the last
+// owner cannot be revoked, nor can the creator by anyone else, and revoking a
+// user who is not an owner succeeds without changing anything.
+func RevokeShareHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	if err := r.VerifyUserSignature(); err != nil {
+		return unsignedResponse(r, err)
+	}
+
+	var revoke models.RevokeShareRequest
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(&revoke); err != nil {
+		glog.Infof("failed to decode revoke request: %v", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "invalid revoke request")
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	buf, err := storeFromContext(ctx).Get(r.Header.Key)
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
+	}
+	idSecrets, _, _, err := readHeader(buf)
+	buf.Close()
+	if err != nil {
+		glog.Infof("ERR: %s\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header")
+	}
+
+	owner, found := findOwner(idSecrets, r.Header.From)
+	if !found {
+		glog.Infof("unauthorized revoke on %s from %s", r.Header.Key, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch")
+	}
+	if owner.ReadOnly {
+		glog.Infof("revoke on %s rejected, owner has read-only access", r.Header.Key)
+		return readOnlyResponse()
+	}
+	if isCreator(idSecrets, revoke.ID) && !isCreator(idSecrets, r.Header.From) {
+		glog.Infof("revoke of the creator of %s from %s rejected", r.Header.Key, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "the creator of a resource cannot be revoked")
+	}
+
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
+	}
+	removed, err := storeFromContext(ctx).RemoveOwner(r.Header.Key, revoke.ID)
+	if err == errLastOwner {
+		return protocol.ErrorResponse(protocol.ConflictCode, err.Error())
+	}
+	if err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storeErrorResponse(err)
+	}
+	if removed {
+		glog.Infof("revoked %s from %s", revoke.ID, r.Header.Key)
+		replicate(ctx, dataPath, r.Header.Key)
+	} else {
+		glog.Infof("revoke of %s from %s skipped, not an owner", revoke.ID, r.Header.Key)
+	}
+	return protocol.Response{
+		Header: protocol.Header{
+			Clock: timestamp,
+		},
+		Status: protocol.Success,
+	}
+}
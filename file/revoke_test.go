@@ -0,0 +1,154 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestRevokeShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		key    = models.Identifier{1}
+		secret = make([]byte, sessionKeyLen)
+		tag    = []byte{9, 9, 9}
+	)
+	header, err := writeHeader([]idSecret{
+		{ID: models.Identifier{7}, Secret: secret},
+		{ID: models.Identifier{8}, Secret: secret, ReadOnly: true},
+	}, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Post(dir, key, bytes.NewReader(append(header, "data"...))); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := RevokeShare(dir, key, models.Identifier{8}); err != nil || !removed {
+		t.Fatalf("revoke of a shared owner = %v, %v", removed, err)
+	}
+	f, err := Get(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idSecrets, readTag, data, err := readHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := ioutil.ReadAll(data)
+	f.Close()
+	if len(idSecrets) != 1 || idSecrets[0].ID != (models.Identifier{7}) {
+		t.Errorf("owners after revoke: %v", idSecrets)
+	}
+	if !bytes.Equal(readTag, tag) || string(rest) != "data" {
+		t.Errorf("revoke changed the tag or data: %x, %q", readTag, rest)
+	}
+
+	// revoking again is a no-op
+	if removed, err := RevokeShare(dir, key, models.Identifier{8}); err != nil || removed {
+		t.Errorf("revoke of a user who is not an owner = %v, %v", removed, err)
+	}
+	if _, err := RevokeShare(dir, key, models.Identifier{7}); err != errLastOwner {
+		t.Errorf("revoke of the last owner = %v, expected %v", err, errLastOwner)
+	}
+}
+
+func TestCreatorKept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "creator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	var key = models.Identifier{6}
+	creator, friend, other := newTestUser(t), newTestUser(t), newTestUser(t)
+	request := func(u testUser, method protocol.RequestMethod, data []byte, shared []protocol.SharedSecret) *protocol.Request {
+		return u.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+				SharedWith: shared,
+			},
+			Method: method,
+			Data:   data,
+		})
+	}
+	encode := func(v interface{}) []byte {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	owners := func() []idSecret {
+		f, err := Get(dir, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		idSecrets, _, _, err := readHeader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return idSecrets
+	}
+
+	if resp := PostFileHandler(ctx, request(creator, protocol.PostFileMethod, []byte("shared"), []protocol.SharedSecret{
+		{ID: friend.id, Secret: make([]byte, sessionKeyLen)},
+	})); resp.Status != protocol.Success {
+		t.Fatalf("shared post failed: %v", resp.Err())
+	}
+
+	// a co-owner sharing with the creator cannot make it read-only
+	if resp := PostFileHandler(ctx, request(friend, protocol.PostFileMethod, []byte("shared"), []protocol.SharedSecret{
+		{ID: creator.id, Secret: bytes.Repeat([]byte{1}, sessionKeyLen), ReadOnly: true},
+	})); resp.Status != protocol.Success {
+		t.Fatalf("post by the co-owner failed: %v", resp.Err())
+	}
+	if owner, _ := findOwner(owners(), creator.id); owner.ReadOnly || !bytes.Equal(owner.Secret, make([]byte, sessionKeyLen)) {
+		t.Errorf("expected the creator's access unchanged by a co-owner, got %+v", owner)
+	}
+
+	// nor revoke it
+	revoke := request(friend, protocol.RevokeShareMethod, encode(models.RevokeShareRequest{ID: creator.id}), nil)
+	if resp := RevokeShareHandler(ctx, revoke); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected a co-owner's revoke of the creator refused, got %v", resp.Err())
+	}
+	if !isCreator(owners(), creator.id) {
+		t.Fatal("expected the creator kept")
+	}
+
+	// the creator hands the resource over, and who it is handed to is the
+	// creator from then on
+	transfer := request(creator, protocol.TransferOwnershipMethod, encode(models.TransferOwnershipRequest{
+		ID: other.id, Secret: make([]byte, sessionKeyLen),
+	}), nil)
+	if resp := TransferOwnershipHandler(ctx, transfer); resp.Status != protocol.Success {
+		t.Fatalf("transfer failed: %v", resp.Err())
+	}
+	if !isCreator(owners(), other.id) {
+		t.Errorf("expected the user handed the resource to be its creator, got %+v", owners())
+	}
+	revoke = request(friend, protocol.RevokeShareMethod, encode(models.RevokeShareRequest{ID: other.id}), nil)
+	if resp := RevokeShareHandler(ctx, revoke); resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected a co-owner's revoke of the new creator refused, got %v", resp.Err())
+	}
+	revoke = request(other, protocol.RevokeShareMethod, encode(models.RevokeShareRequest{ID: friend.id}), nil)
+	if resp := RevokeShareHandler(ctx, revoke); resp.Status != protocol.Success {
+		t.Errorf("expected the creator's revoke of a co-owner, got %v", resp.Err())
+	}
+}
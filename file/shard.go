@@ -0,0 +1,181 @@
+package file
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// MaxShardDepth - the most levels of subdirectories resources are sharded
+// into, each named by a byte of the key
+const MaxShardDepth = 4
+
+// shardFile - the file in a data path recording the depth its resources are
+// sharded to, absent when they are all in the data path itself
+const shardFile = ".shards"
+
+var (
+	// shardDepths - the depth the resources of each data path are sharded
+	// to, as read from its shard file
+	shardDepths   = map[string]int{}
+	shardDepthsMu = new(sync.RWMutex)
+)
+
+// shardDepth - the depth the resources stored in path are sharded to, zero
+// if they are stored in path itself
+func shardDepth(path string) int {
+	shardDepthsMu.RLock()
+	depth, ok := shardDepths[path]
+	shardDepthsMu.RUnlock()
+	if ok {
+		return depth
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(path, shardFile)); err == nil {
+		depth, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || depth < 0 || depth > MaxShardDepth {
+			glog.Infof("ignoring invalid shard depth %q of %s", data, path)
+			depth = 0
+		}
+	}
+	shardDepthsMu.Lock()
+	shardDepths[path] = depth
+	shardDepthsMu.Unlock()
+	return depth
+}
+
+// shardDir - the directory of path the resource key is stored in when its
+// resources are sharded to depth, such as ab/cd for a key starting abcd and a
+// depth of 2
+func shardDir(path string, key models.Identifier, depth int) string {
+	dirs := []string{path}
+	for i := 0; i < depth; i++ {
+		dirs = append(dirs, hex.EncodeToString(key[i:i+1]))
+	}
+	return filepath.Join(dirs...)
+}
+
+// keyPath - the file the resource key is stored in, in path
+func keyPath(path string, key models.Identifier) string {
+	return filepath.Join(shardDir(path, key, shardDepth(path)), key.String())
+}
+
+// isShardDir - check if name could be the directory of a level of sharding
+func isShardDir(name string) bool {
+	_, err := hex.DecodeString(name)
+	return len(name) == 2 && err == nil
+}
+
+// storedName - the key of the resource a file named name in a data path
+// belongs to, either the resource itself, an archived version of it or its
+// version counter
+func storedName(name string) (models.Identifier, bool) {
+	if strings.HasSuffix(name, versionCounterSuffix) {
+		name = strings.TrimSuffix(name, versionCounterSuffix)
+	} else if i := strings.Index(name, ".v"); i >= 0 {
+		if _, err := strconv.ParseUint(name[i+2:], 10, 64); err != nil {
+			return models.Identifier{}, false
+		}
+		name = name[:i]
+	}
+	raw, err := hex.DecodeString(name)
+	if err != nil {
+		return models.Identifier{}, false
+	}
+	key, err := models.IdentifierFromBytes(raw)
+	return key, err == nil
+}
+
+// walkStored - call fn with the path and key of every resource and archived
+// version stored in path, at any depth of sharding
+func walkStored(path string, fn func(file string, key models.Identifier) error) error {
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if file != path && !isShardDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if key, ok := storedName(info.Name()); ok {
+			return fn(file, key)
+		}
+		return nil
+	})
+}
+
+// ConfigureSharding - store the resources of path in subdirectories depth
+// levels deep, each named by the next byte of their keys, so no directory
+// holds too many files.  A depth of zero stores them in path itself.
+// Resources stored at another depth are moved, so it must be called before
+// the node serves requests.
+func ConfigureSharding(path string, depth int) error {
+	if depth < 0 || depth > MaxShardDepth {
+		return errors.Errorf("shard depth must be between 0 and %d", MaxShardDepth)
+	}
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	var moved int
+	err := walkStored(path, func(file string, key models.Identifier) error {
+		dir := shardDir(path, key, depth)
+		dest := filepath.Join(dir, filepath.Base(file))
+		if dest == file {
+			return nil
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		moved++
+		return os.Rename(file, dest)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to move resources to their shards: ")
+	}
+	if moved > 0 {
+		glog.Infof("moved %d stored files to shards %d deep", moved, depth)
+	}
+	removeEmptyShards(path)
+
+	if depth == 0 {
+		err = os.Remove(filepath.Join(path, shardFile))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = ioutil.WriteFile(filepath.Join(path, shardFile), []byte(strconv.Itoa(depth)), 0600)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to record shard depth: ")
+	}
+	shardDepthsMu.Lock()
+	shardDepths[path] = depth
+	shardDepthsMu.Unlock()
+	return nil
+}
+
+// removeEmptyShards - remove the shard directories of path left empty after
+// their resources were moved
+func removeEmptyShards(path string) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() && isShardDir(info.Name()) {
+			dir := filepath.Join(path, info.Name())
+			removeEmptyShards(dir)
+			// fails, as it should, unless the directory is empty
+			os.Remove(dir)
+		}
+	}
+}
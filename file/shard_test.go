@@ -0,0 +1,89 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestShardedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	if err := ConfigureSharding(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.KeepVersionsContextKey, uint(2))
+
+	owner := newTestUser(t)
+	key := models.Identifier{0xab, 0xcd, 0x01}
+	request := func(method protocol.RequestMethod, data []byte) *protocol.Request {
+		return owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: uint64(len(data)),
+			},
+			Method: method,
+			Data:   data,
+		})
+	}
+	for _, data := range []string{"first", "second"} {
+		if resp := PostFileHandler(ctx, request(protocol.PostFileMethod, []byte(data))); resp.Status != protocol.Success {
+			t.Fatalf("post failed: %v", resp.Err())
+		}
+	}
+
+	sharded := filepath.Join(dir, "ab", "cd", key.String())
+	if _, err := os.Stat(sharded); err != nil {
+		t.Errorf("expected the resource stored in its shard, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, key.String())); !os.IsNotExist(err) {
+		t.Errorf("expected nothing stored in the data path itself, got %v", err)
+	}
+	resp := GetFileHandler(ctx, request(protocol.GetFileMethod, nil))
+	if resp.Status != protocol.Success || string(resp.Data) != "second" {
+		t.Fatalf("expected the sharded resource by key, got %q, %v", resp.Data, resp.Err())
+	}
+	if keys, err := ListKeys(dir); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("expected the sharded key listed, got %v, %v", keys, err)
+	}
+
+	// back to a flat data path, the resource and its versions move with it
+	if err := ConfigureSharding(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, key.String())); err != nil {
+		t.Errorf("expected the resource moved out of its shard, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ab")); !os.IsNotExist(err) {
+		t.Errorf("expected the emptied shards removed, got %v", err)
+	}
+	resp = GetFileHandler(ctx, request(protocol.GetFileMethod, nil))
+	if resp.Status != protocol.Success || string(resp.Data) != "second" {
+		t.Errorf("expected the moved resource by key, got %q, %v", resp.Data, resp.Err())
+	}
+	f, err := GetVersion(dir, key, 1)
+	if err != nil {
+		t.Fatalf("expected the archived version moved too, got %v", err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	f.Close()
+	if !bytes.HasSuffix(data, []byte("first")) {
+		t.Errorf("expected the first version, got %q", data)
+	}
+
+	if err := ConfigureSharding(dir, MaxShardDepth+1); err == nil {
+		t.Error("expected a shard depth past the maximum to be refused")
+	}
+}
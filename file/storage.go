@@ -1,27 +1,41 @@
 package file
 
 import (
-	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
 	"github.com/pkg/errors"
 )
 
 // Get - get a file based on the key, returns an io.Reader
-// which will be used to read the file
-func Get(path string, key [20]byte) (io.ReadCloser, error) {
+// which will be used to read the file.  It is served from the read cache of
+// path if it has one.  The error for a key which is not stored is one for
+// which isNotExist is true, any other error is a failure to read it.
+func Get(path string, key models.Identifier) (io.ReadCloser, error) {
+	if f, ok, err := cachedGet(path, key); ok {
+		return f, err
+	}
 
 	if _, err := os.Stat(
-		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:]))); err != nil {
-		glog.Info("file does not exist!")
-		return nil, err
+		keyPath(path, key)); err != nil {
+		if os.IsNotExist(err) {
+			glog.Info("file does not exist!")
+			return nil, err
+		}
+		glog.Info(err)
+		return nil, errors.Wrap(err, "error reading file")
 	}
 
 	f, err := os.OpenFile(
-		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
+		keyPath(path, key),
 		os.O_RDWR|os.O_CREATE, 0600,
 	)
 	if err != nil {
@@ -32,28 +46,101 @@ func Get(path string, key [20]byte) (io.ReadCloser, error) {
 }
 
 // Post - create or update a file based on the key, returns
-// boolean success as well as an error
-func Post(path string, key [20]byte, data io.Reader) error {
+// boolean success as well as an error.  The data is written to a temporary
+// file which is renamed over the file once it is complete, so a failed or
+// interrupted write leaves the previous contents in place, and a reader
+// never sees a partially written file.
+func Post(path string, key models.Identifier, data io.Reader) error {
 	glog.Info("opening destination file",
-		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
+		keyPath(path, key),
 	)
-	// rm existing file first...
-	os.Remove(fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])))
+	tmp, err := writeTemp(path, key, data)
+	if err != nil {
+		return err
+	}
+	defer invalidateRead(path, key)
+	if err := os.Rename(tmp, keyPath(path, key)); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "error replacing file")
+	}
+	return nil
+}
 
+// writeTemp - write data to a new temporary file alongside the file based on
+// the key, returning its path.  It is in the same directory so it can be
+// renamed into place atomically, which is created if the key is the first of
+// its shard.
+func writeTemp(path string, key models.Identifier, data io.Reader) (string, error) {
+	dir := filepath.Dir(keyPath(path, key))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "error creating shard")
+	}
+	f, err := ioutil.TempFile(dir, key.String()+".tmp")
+	if err != nil {
+		glog.Info(err)
+		return "", errors.Wrap(err, "error opening file")
+	}
+	glog.Info("Writing file to storage")
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "error writing file")
+	}
+	// make sure the data is on disk before the file is renamed over the old
+	// one, or a crash could leave an empty file in its place
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "error writing file")
+	}
+
+	glog.Info("Closing file to storage")
+	if err := f.Close(); err != nil {
+		glog.Info(err)
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "error closing file")
+	}
+	return f.Name(), nil
+}
+
+// Append - add data to the end of the file based on the key, which must
+// already exist
+func Append(path string, key models.Identifier, data io.Reader) error {
+	defer invalidateRead(path, key)
 	f, err := os.OpenFile(
-		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
-		os.O_RDWR|os.O_CREATE, 0600,
+		keyPath(path, key),
+		os.O_WRONLY|os.O_APPEND, 0600,
 	)
 	if err != nil {
 		glog.Info(err)
 		return errors.Wrap(err, "error opening file")
 	}
-	glog.Info("Writing file to storage")
 	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
 		return errors.Wrap(err, "error writing file")
 	}
+	if err := f.Close(); err != nil {
+		glog.Info(err)
+		return errors.Wrap(err, "error closing file")
+	}
+	return nil
+}
 
-	glog.Info("Closing file to storage")
+// WriteAt - overwrite the bytes of the file based on the key starting at
+// offset with data, the file must already be long enough to hold them
+func WriteAt(path string, key models.Identifier, offset int64, data []byte) error {
+	defer invalidateRead(path, key)
+	f, err := os.OpenFile(
+		keyPath(path, key), os.O_WRONLY, 0600,
+	)
+	if err != nil {
+		glog.Info(err)
+		return errors.Wrap(err, "error opening file")
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return errors.Wrap(err, "error writing file")
+	}
 	if err := f.Close(); err != nil {
 		glog.Info(err)
 		return errors.Wrap(err, "error closing file")
@@ -62,12 +149,185 @@ func Post(path string, key [20]byte, data io.Reader) error {
 }
 
 // Delete - delete a file based on the key, returns
-// boolean success as well as an error
-func Delete(path string, key [20]byte) error {
+// boolean success as well as an error.  Any retained versions of the file
+// are removed as well, but not its version counter, so the version ids of a
+// file created again under the key carry on from where they left off.
+func Delete(path string, key models.Identifier) error {
+	defer invalidateRead(path, key)
 	if err := os.Remove(
-		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
+		keyPath(path, key),
 	); err != nil {
 		return errors.Wrap(err, "failed to remove file: ")
 	}
+	versions, err := archivedVersions(path, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to list versions: ")
+	}
+	for _, version := range versions {
+		if err := os.Remove(versionPath(path, key, version)); err != nil {
+			return errors.Wrap(err, "failed to remove version: ")
+		}
+	}
+	return nil
+}
+
+// versionPath - the location of an archived version of a file
+func versionPath(path string, key models.Identifier, version uint64) string {
+	return fmt.Sprintf("%s.v%d", keyPath(path, key), version)
+}
+
+// versionCounterSuffix - the suffix of the file recording the highest
+// version id given to a file.  Version ids only ever increase, across deletes
+// and the pruning of every archived version, so a version id recorded in a
+// transaction log never comes to name newer data.
+const versionCounterSuffix = ".version"
+
+// versionCounterPath - the location of the version counter of a file
+func versionCounterPath(path string, key models.Identifier) string {
+	return keyPath(path, key) + versionCounterSuffix
+}
+
+// readVersionCounter - the highest version id given to a file, zero if it
+// was never given one, as for files stored before version ids were counted
+func readVersionCounter(path string, key models.Identifier) (uint64, error) {
+	data, err := ioutil.ReadFile(versionCounterPath(path, key))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read version counter: ")
+	}
+	version, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse version counter: ")
+	}
+	return version, nil
+}
+
+// writeVersionCounter - record version as the highest version id given to a
+// file, replacing the counter atomically
+func writeVersionCounter(path string, key models.Identifier, version uint64) error {
+	counter := versionCounterPath(path, key)
+	if err := ioutil.WriteFile(counter+".tmp", []byte(strconv.FormatUint(version, 10)), 0600); err != nil {
+		return errors.Wrap(err, "failed to write version counter: ")
+	}
+	if err := os.Rename(counter+".tmp", counter); err != nil {
+		os.Remove(counter + ".tmp")
+		return errors.Wrap(err, "failed to write version counter: ")
+	}
 	return nil
 }
+
+// archivedVersions - the version ids of the archived versions of a file, in
+// ascending order
+func archivedVersions(path string, key models.Identifier) ([]uint64, error) {
+	prefix := keyPath(path, key) + ".v"
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	versions := []uint64{}
+	for _, match := range matches {
+		version, err := strconv.ParseUint(strings.TrimPrefix(match, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// LatestVersion - the version id of the current copy of a file, which is
+// the highest version id given to it, or for a file stored before version
+// ids were counted, one past the newest archived version
+func LatestVersion(path string, key models.Identifier) (uint64, error) {
+	versions, err := archivedVersions(path, key)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list versions: ")
+	}
+	latest := uint64(1)
+	if len(versions) > 0 {
+		latest = versions[len(versions)-1] + 1
+	}
+	counted, err := readVersionCounter(path, key)
+	if err != nil {
+		return 0, err
+	}
+	if counted > latest {
+		latest = counted
+	}
+	return latest, nil
+}
+
+// GetVersion - get a specific version of a file based on the key, a version
+// of zero is the latest version
+func GetVersion(path string, key models.Identifier, version uint64) (io.ReadCloser, error) {
+	latest, err := LatestVersion(path, key)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 || version == latest {
+		return Get(path, key)
+	}
+	f, err := os.Open(versionPath(path, key, version))
+	if err != nil {
+		glog.Info(err)
+		return nil, errors.Wrap(err, "error opening version")
+	}
+	return f, nil
+}
+
+// PostVersion - create or update a file based on the key, retaining up to
+// keep previous versions of the file.  Returns the version id of the newly
+// written data.
+func PostVersion(path string, key models.Identifier, data io.Reader, keep uint) (uint64, error) {
+	latest, err := LatestVersion(path, key)
+	if err != nil {
+		return 0, err
+	}
+	counted, err := readVersionCounter(path, key)
+	if err != nil {
+		return 0, err
+	}
+	// the new data is written out in full before the current copy is
+	// touched, so a failed write leaves it in place
+	tmp, err := writeTemp(path, key, data)
+	if err != nil {
+		return 0, err
+	}
+	defer invalidateRead(path, key)
+	current := keyPath(path, key)
+	if _, err := os.Stat(current); err == nil {
+		// archive the current copy before it is replaced
+		if err := os.Rename(current, versionPath(path, key, latest)); err != nil {
+			os.Remove(tmp)
+			return 0, errors.Wrap(err, "failed to archive version: ")
+		}
+		latest++
+	} else if counted > 0 {
+		// the file was deleted, the version id of its last copy is not
+		// given again
+		latest = counted + 1
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "error replacing file")
+	}
+	if err := writeVersionCounter(path, key, latest); err != nil {
+		return 0, err
+	}
+
+	// prune the versions which fall out of the retention window
+	versions, err := archivedVersions(path, key)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list versions: ")
+	}
+	for len(versions) > int(keep) {
+		if err := os.Remove(versionPath(path, key, versions[0])); err != nil {
+			return 0, errors.Wrap(err, "failed to prune version: ")
+		}
+		versions = versions[1:]
+	}
+	return latest, nil
+}
@@ -0,0 +1,115 @@
+package file
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// failingReader - yields some data and then fails, like a connection which
+// drops part way through an upload
+type failingReader struct {
+	data io.Reader
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection lost")
+	}
+	return n, err
+}
+
+func TestPostFailureKeepsPreviousContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := models.Identifier{1}
+
+	if err := Post(dir, key, bytes.NewReader([]byte("previous contents"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := Post(dir, key, failingReader{bytes.NewReader([]byte("new"))}); err == nil {
+		t.Error("post of a failing reader succeeded")
+	}
+	if _, err := PostVersion(dir, key, failingReader{bytes.NewReader([]byte("new"))}, 2); err == nil {
+		t.Error("versioned post of a failing reader succeeded")
+	}
+
+	f, err := Get(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := ioutil.ReadAll(f); string(data) != "previous contents" {
+		t.Errorf("contents after failed posts = %q", data)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 1 {
+		t.Errorf("failed posts left %d files behind", len(infos)-1)
+	}
+}
+
+func TestVersionIDsOnlyIncrease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := models.Identifier{1}
+
+	post := func(contents string, keep uint) uint64 {
+		version, err := PostVersion(dir, key, bytes.NewReader([]byte(contents)), keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+	get := func(version uint64) string {
+		f, err := GetVersion(dir, key, version)
+		if err != nil {
+			t.Fatalf("get of version %d failed: %v", version, err)
+		}
+		defer f.Close()
+		data, _ := ioutil.ReadAll(f)
+		return string(data)
+	}
+
+	for i, contents := range []string{"one", "two", "three"} {
+		if version := post(contents, 2); version != uint64(i+1) {
+			t.Errorf("post of %s = version %d, expected %d", contents, version, i+1)
+		}
+	}
+	if got := get(2); got != "two" {
+		t.Errorf("version 2 = %q", got)
+	}
+
+	if err := Delete(dir, key); err != nil {
+		t.Fatal(err)
+	}
+	if version := post("recreated", 2); version != 4 {
+		t.Errorf("post after a delete = version %d, expected 4", version)
+	}
+	if _, err := GetVersion(dir, key, 2); err == nil {
+		t.Error("expected the versions from before the delete gone")
+	}
+
+	// retaining no versions prunes every archived one, the next is still
+	// given a new id
+	post("unversioned", 0)
+	if version := post("again", 0); version != 6 {
+		t.Errorf("post after pruning every version = version %d, expected 6", version)
+	}
+	if latest, err := LatestVersion(dir, key); err != nil || latest != 6 {
+		t.Errorf("latest version = %d, %v, expected 6", latest, err)
+	}
+	if got := get(0); got != "again" {
+		t.Errorf("latest version = %q", got)
+	}
+}
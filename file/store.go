@@ -0,0 +1,311 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// Store - where a node keeps the resources it stores, by key.  Get of a key
+// which is not stored must return an error for which os.IsNotExist is true,
+// PostFileHandler relies on it to tell a new resource from an update.  The
+// readers Get returns must also be io.Seekers, for range reads and appends.
+// RemoveOwner is as RevokeShare, and PostVersion, GetVersion and
+// LatestVersion as the functions of the same names, but for the store, which
+// keeps the previous versions of a resource alongside it.
+type Store interface {
+	Get(key models.Identifier) (io.ReadCloser, error)
+	Post(key models.Identifier, data io.Reader) error
+	Append(key models.Identifier, data io.Reader) error
+	WriteAt(key models.Identifier, offset int64, data []byte) error
+	Delete(key models.Identifier) error
+	RemoveOwner(key, id models.Identifier) (bool, error)
+	PostVersion(key models.Identifier, data io.Reader, keep uint) (uint64, error)
+	GetVersion(key models.Identifier, version uint64) (io.ReadCloser, error)
+	LatestVersion(key models.Identifier) (uint64, error)
+}
+
+// DirStore - the Store of the files in a data directory
+type DirStore string
+
+// Get - see Get
+func (d DirStore) Get(key models.Identifier) (io.ReadCloser, error) {
+	return Get(string(d), key)
+}
+
+// Post - see Post
+func (d DirStore) Post(key models.Identifier, data io.Reader) error {
+	return Post(string(d), key, data)
+}
+
+// Append - see Append
+func (d DirStore) Append(key models.Identifier, data io.Reader) error {
+	return Append(string(d), key, data)
+}
+
+// WriteAt - see WriteAt
+func (d DirStore) WriteAt(key models.Identifier, offset int64, data []byte) error {
+	return WriteAt(string(d), key, offset, data)
+}
+
+// Delete - see Delete
+func (d DirStore) Delete(key models.Identifier) error {
+	return Delete(string(d), key)
+}
+
+// RemoveOwner - see RevokeShare
+func (d DirStore) RemoveOwner(key, id models.Identifier) (bool, error) {
+	return RevokeShare(string(d), key, id)
+}
+
+// PostVersion - see PostVersion
+func (d DirStore) PostVersion(key models.Identifier, data io.Reader, keep uint) (uint64, error) {
+	return PostVersion(string(d), key, data, keep)
+}
+
+// GetVersion - see GetVersion
+func (d DirStore) GetVersion(key models.Identifier, version uint64) (io.ReadCloser, error) {
+	return GetVersion(string(d), key, version)
+}
+
+// LatestVersion - see LatestVersion
+func (d DirStore) LatestVersion(key models.Identifier) (uint64, error) {
+	return LatestVersion(string(d), key)
+}
+
+// storeFromContext - the Store the node keeps resources in
+func storeFromContext(ctx context.Context) Store {
+	if store, ok := ctx.Value(models.StoreContextKey).(Store); ok {
+		return store
+	}
+	return DirStore(ctx.Value(models.DataPathContextKey).(string))
+}
+
+// memoryStore - a Store which keeps resources in memory
+type memoryStore struct {
+	mu    sync.Mutex
+	files map[models.Identifier][]byte
+	// versions - the archived versions of each resource, by version id
+	versions map[models.Identifier]map[uint64][]byte
+	// counters - the highest version id given to each resource, kept when
+	// it is deleted so the id is not given again
+	counters map[models.Identifier]uint64
+}
+
+// NewMemoryStore - a Store which keeps resources in memory, and so loses
+// them when the node stops.  It is meant for tests, which it spares the
+// disk.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		files:    make(map[models.Identifier][]byte),
+		versions: make(map[models.Identifier]map[uint64][]byte),
+		counters: make(map[models.Identifier]uint64),
+	}
+}
+
+// notExist - the error for a key which is not stored, as the os package
+// would return it for a missing file
+func notExist(op string, key models.Identifier) error {
+	return &os.PathError{Op: op, Path: key.String(), Err: os.ErrNotExist}
+}
+
+// isNotExist - check if err, as returned by a Store, is for a key which is
+// not stored rather than a failure to read it
+func isNotExist(err error) bool {
+	return os.IsNotExist(errors.Cause(err))
+}
+
+// memoryFile - a copy of a stored resource, which can be read and seeked
+type memoryFile struct {
+	*bytes.Reader
+}
+
+// Close - nothing to release
+func (memoryFile) Close() error {
+	return nil
+}
+
+// Get - a copy of the resource based on the key, so later changes do not
+// show through to the reader
+func (m *memoryStore) Get(key models.Identifier) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[key]
+	if !ok {
+		return nil, notExist("open", key)
+	}
+	return memoryFile{bytes.NewReader(append([]byte(nil), data...))}, nil
+}
+
+// Post - create or replace the resource based on the key
+func (m *memoryStore) Post(key models.Identifier, data io.Reader) error {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, data); err != nil {
+		return errors.Wrap(err, "error writing file")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[key] = buf.Bytes()
+	return nil
+}
+
+// Append - add data to the end of the resource based on the key, which must
+// already exist
+func (m *memoryStore) Append(key models.Identifier, data io.Reader) error {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, data); err != nil {
+		return errors.Wrap(err, "error writing file")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.files[key]
+	if !ok {
+		return errors.Wrap(notExist("open", key), "error opening file")
+	}
+	m.files[key] = append(stored, buf.Bytes()...)
+	return nil
+}
+
+// WriteAt - overwrite the bytes of the resource based on the key starting at
+// offset with data, the resource must already be long enough to hold them
+func (m *memoryStore) WriteAt(key models.Identifier, offset int64, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.files[key]
+	if !ok {
+		return errors.Wrap(notExist("open", key), "error opening file")
+	}
+	if offset < 0 || offset+int64(len(data)) > int64(len(stored)) {
+		return errors.New("error writing file: past the end of the resource")
+	}
+	copy(stored[offset:], data)
+	return nil
+}
+
+// Delete - remove the resource based on the key
+func (m *memoryStore) Delete(key models.Identifier) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[key]; !ok {
+		return errors.Wrap(notExist("remove", key), "failed to remove file: ")
+	}
+	delete(m.files, key)
+	return nil
+}
+
+// RemoveOwner - rewrite the header of the resource based on the key without
+// the owner id.  Returns false if id was not an owner, in which case the
+// resource is left as it is.
+func (m *memoryStore) RemoveOwner(key, id models.Identifier) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.files[key]
+	if !ok {
+		return false, errors.Wrap(notExist("open", key), "error opening file")
+	}
+	idSecrets, tag, data, err := readHeader(bytes.NewReader(stored))
+	if err != nil {
+		return false, err
+	}
+	kept := []idSecret{}
+	for _, pair := range idSecrets {
+		if pair.ID != id {
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) == len(idSecrets) {
+		return false, nil
+	}
+	if len(kept) == 0 {
+		return false, errLastOwner
+	}
+	header, err := writeHeader(kept, tag)
+	if err != nil {
+		return false, err
+	}
+	buf := bytes.NewBuffer(header)
+	if _, err := io.Copy(buf, data); err != nil {
+		return false, errors.Wrap(err, "error writing file")
+	}
+	m.files[key] = buf.Bytes()
+	return true, nil
+}
+
+// latestVersion - LatestVersion, with m.mu held
+func (m *memoryStore) latestVersion(key models.Identifier) uint64 {
+	latest := uint64(1)
+	for version := range m.versions[key] {
+		if version >= latest {
+			latest = version + 1
+		}
+	}
+	if counted := m.counters[key]; counted > latest {
+		latest = counted
+	}
+	return latest
+}
+
+// LatestVersion - the version id of the current copy of the resource based
+// on the key
+func (m *memoryStore) LatestVersion(key models.Identifier) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latestVersion(key), nil
+}
+
+// PostVersion - create or replace the resource based on the key, archiving
+// the current copy and keeping up to keep of the archived versions.  Returns
+// the version id of the new copy.
+func (m *memoryStore) PostVersion(key models.Identifier, data io.Reader, keep uint) (uint64, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, data); err != nil {
+		return 0, errors.Wrap(err, "error writing file")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latest := m.latestVersion(key)
+	if current, ok := m.files[key]; ok {
+		if m.versions[key] == nil {
+			m.versions[key] = make(map[uint64][]byte)
+		}
+		m.versions[key][latest] = current
+		latest++
+	} else if counted := m.counters[key]; counted > 0 {
+		latest = counted + 1
+	}
+	m.files[key] = buf.Bytes()
+	m.counters[key] = latest
+
+	// prune the versions which fall out of the retention window
+	for len(m.versions[key]) > int(keep) {
+		oldest := latest
+		for version := range m.versions[key] {
+			if version < oldest {
+				oldest = version
+			}
+		}
+		delete(m.versions[key], oldest)
+	}
+	return latest, nil
+}
+
+// GetVersion - a copy of the version of the resource based on the key, zero
+// being the current copy
+func (m *memoryStore) GetVersion(key models.Identifier, version uint64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	latest := m.latestVersion(key)
+	data, ok := m.versions[key][version]
+	m.mu.Unlock()
+	if version == 0 || version == latest {
+		return m.Get(key)
+	}
+	if !ok {
+		return nil, errors.Wrap(notExist("open", key), "error opening version")
+	}
+	return memoryFile{bytes.NewReader(append([]byte(nil), data...))}, nil
+}
@@ -2,10 +2,9 @@ package file
 
 import (
 	"bytes"
-	"crypto/rsa"
-	"crypto/sha1"
-	"encoding/gob"
-	"log"
+	"context"
+	"io/ioutil"
+	"os"
 
 	"github.com/golang/glog"
 	"github.com/husobee/peerstore/crypto"
@@ -14,166 +13,183 @@ import (
 	"github.com/pkg/errors"
 )
 
-func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (models.TransactionLog, error) {
-	gobKey, _ := crypto.GobEncodePublicKey(userKey)
-	id := models.Identifier(sha1.Sum(append(gobKey, []byte("-transaction-log")...)))
+var (
+	// errNotLogOwner - the caller is not the user the transaction log belongs to
+	errNotLogOwner = errors.New("not the owner of the transaction log")
+	// errNotLogKey - the key of the request is not the caller's transaction log
+	errNotLogKey = errors.New("key is not the transaction log of the caller")
+)
 
-	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, selfKey)
-	if err != nil {
-		glog.Error("ERR: %v", err)
+// checkTransactionLogKey - make sure the request is for the transaction log
+// of the caller, whose public key must be the one the From id is derived from
+func checkTransactionLogKey(r *protocol.Request) error {
+	if r.Header.PubKey == nil {
+		return errNotLogOwner
 	}
-	defer t.Close()
-
-	var buf = new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	// Perform a Successor Request to our peer
-	enc.Encode(models.SuccessorRequest{
-		models.Identifier(id),
-	})
-	resp, err := t.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			Type: protocol.NodeType,
-			From: thisID,
-			Key:  id,
-		},
-		Method: protocol.GetSuccessorMethod,
-		Data:   buf.Bytes(),
-	})
-	if err != nil {
-		glog.Info("Failed to round trip the successor request: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get successor: ")
+	gobKey, err := crypto.GobEncodePublicKey(r.Header.PubKey)
+	if err != nil || models.HashBytes(gobKey) != r.Header.From {
+		return errNotLogOwner
 	}
-
-	// populate our peer to get the log
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
-	if err != nil {
-		glog.Error("Failed to deserialize the node data: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed deserialize successor: ")
+	if key, err := protocol.TransactionLogKey(r.Header.PubKey); err != nil || key != r.Header.Key {
+		return errNotLogKey
 	}
+	return nil
+}
 
-	glog.Info("Peer holding TransactionLog: %s", node.ToString())
-
-	// now connect to the node holding the transaction log
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, thisID, node.PublicKey, selfKey)
+// errLogChanged - the stored transaction log is not the one a put was made
+// against
+var errLogChanged = errors.New("transaction log changed since it was read")
+
+// readTransactionLog - the transaction log stored under key, which must be
+// owned by owner, and its digest, protocol.ErrResourceNotFound if there is
+// none.  Any other failure to read it is returned as is, so a log which is
+// there but could not be read is never taken for a missing one.
+func readTransactionLog(dataPath string, key, owner models.Identifier) (models.TransactionLog, []byte, error) {
+	buf, err := Get(dataPath, key)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, protocol.TransactionLogDigest(nil), protocol.ErrResourceNotFound
+	}
 	if err != nil {
-		log.Printf("ERR: %v", err)
+		return nil, nil, errors.Wrap(err, "could not read resource")
 	}
-	defer st.Close()
-	resp, err = st.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			Type: protocol.NodeType,
-			From: thisID,
-			Key:  id,
-		},
-		Method: protocol.GetFileMethod,
-	})
+	defer buf.Close()
+	idSecrets, _, data, err := readHeader(buf)
 	if err != nil {
-		log.Printf("Failed to round trip the get file request: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get file")
+		return nil, nil, errors.Wrap(err, "could not read resource header")
 	}
-
-	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get file, protocol error")
+	if _, found := findOwner(idSecrets, owner); !found {
+		return nil, nil, errNotLogOwner
 	}
-
-	var transactionLog = models.TransactionLog{}
-	dec = gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&transactionLog)
+	raw, err := ioutil.ReadAll(data)
 	if err != nil {
-		glog.Error("Failed to deserialize the transactionLog data: %v", err)
-		return models.TransactionLog{}, errors.Wrap(err, "failed deserialize transaction log: ")
+		return nil, nil, errors.Wrap(err, "could not read resource")
 	}
+	tl, err := models.DecodeTransactionLog(raw)
+	return tl, protocol.TransactionLogDigest(raw), err
+}
 
-	return transactionLog, nil
+// transactionLogErrorResponse - the response to a transaction log request
+// which failed with err
+func transactionLogErrorResponse(err error) protocol.Response {
+	switch errors.Cause(err) {
+	case protocol.ErrResourceNotFound:
+		return protocol.ErrorResponse(protocol.NotFoundCode, protocol.ErrResourceNotFound.Error())
+	case errNotLogOwner:
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, err.Error())
+	case errNotLogKey:
+		return protocol.ErrorResponse(protocol.BadHeaderCode, err.Error())
+	case errLogChanged:
+		return protocol.ErrorResponse(protocol.ConflictCode, err.Error())
+	}
+	glog.Errorf("transaction log request failed: %v", err)
+	return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read transaction log")
 }
 
-func PutTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.PublicKey, selfKey *rsa.PrivateKey, transactionLog models.TransactionLog) error {
-	gobKey, _ := crypto.GobEncodePublicKey(userKey)
-	glog.Infof("userKey bytes: %x", userKey)
-	glog.Infof("gobKey bytes: %x", gobKey)
-	id := models.Identifier(sha1.Sum(append(gobKey, []byte("-transaction-log")...)))
+// GetTransactionLogHandler - This is the server handler which serves the
+// transaction log of the caller, encoded as models.EncodeTransactionLog does
+func GetTransactionLogHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	if err := checkTransactionLogKey(r); err != nil {
+		return transactionLogErrorResponse(err)
+	}
 
-	glog.Infof("Trying to PUT Transaction LOG, ID: %x", id)
+	fileMu.Lock()
+	defer fileMu.Unlock()
 
-	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, selfKey)
+	tl, digest, err := readTransactionLog(dataPath, r.Header.Key, r.Header.From)
 	if err != nil {
-		glog.Error("ERR: %v", err)
+		return transactionLogErrorResponse(err)
 	}
-
-	var buf = new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	// Perform a Successor Request to our peer
-	enc.Encode(models.SuccessorRequest{
-		models.Identifier(id),
-	})
-	resp, err := t.RoundTrip(&protocol.Request{
+	data, err := models.EncodeTransactionLog(tl)
+	if err != nil {
+		glog.Errorf("failed to encode transaction log %s: %v", r.Header.Key, err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not encode transaction log")
+	}
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		return clockErrorResponse(r, err)
+	}
+	return protocol.Response{
 		Header: protocol.Header{
-			Type: protocol.NodeType,
-			From: thisID,
-			Key:  id,
+			Clock:      timestamp,
+			DataLength: uint64(len(data)),
+			LogDigest:  digest,
 		},
-		Method: protocol.GetSuccessorMethod,
-		Data:   buf.Bytes(),
-	})
-	if err != nil {
-		glog.Info("Failed to round trip the successor request: %v", err)
-		return errors.Wrap(err, "failed to get successor: ")
+		Status: protocol.Success,
+		Data:   data,
+	}
+}
+
+// PutTransactionLogHandler - This is the server handler which merges the
+// entries of the transaction log in the request into the caller's stored log.
+// Entries the stored log does not have are appended, so a client need only
+// send its new entries, and two clients adding entries at the same time keep
+// both of their changes, rather than the last to put overwriting the other.
+// A put with a LogDigest is only merged if the stored log is still the one
+// with that digest, and is otherwise refused with a ConflictCode.
+func PutTransactionLogHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	if err := checkTransactionLogKey(r); err != nil {
+		return transactionLogErrorResponse(err)
 	}
-	// populate our peer to get the log
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
+	if err := r.VerifyUserSignature(); err != nil {
+		return unsignedResponse(r, err)
+	}
+	theirs, err := models.DecodeTransactionLog(r.Data)
 	if err != nil {
-		glog.Error("Failed to deserialize the node data: %v", err)
-		return errors.Wrap(err, "failed deserialize successor: ")
+		glog.Infof("rejecting transaction log put: %v", err)
+		return protocol.ErrorResponse(protocol.BadHeaderCode, "could not decode transaction log")
 	}
 
-	glog.Info("Peer holding TransactionLog: %s", node.ToString())
+	fileMu.Lock()
+	defer fileMu.Unlock()
 
-	// encode the transaction log, and put to our node
-	var logBuf = bytes.NewBuffer([]byte{})
-	enc = gob.NewEncoder(logBuf)
-	err = enc.Encode(&transactionLog)
+	stored, digest, err := readTransactionLog(dataPath, r.Header.Key, r.Header.From)
+	if errors.Cause(err) == protocol.ErrResourceNotFound {
+		// the first put of the log
+		stored, err = models.TransactionLog{}, nil
+	}
 	if err != nil {
-		glog.Error("Failed to serialize the transactionLog data: %v", err)
-		return errors.Wrap(err, "failed serialize transaction log: ")
+		return transactionLogErrorResponse(err)
 	}
-
-	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", node.Addr, protocol.NodeType, id, node.PublicKey, selfKey)
+	if len(r.Header.LogDigest) > 0 && !bytes.Equal(r.Header.LogDigest, digest) {
+		return transactionLogErrorResponse(errLogChanged)
+	}
+	// compacted, so a resource changed over and over does not grow the log
+	// fetched on every sync without bound
+	data, err := models.EncodeTransactionLog(stored.Merge(theirs).Compact(models.TransactionHistory))
 	if err != nil {
-		glog.Error("ERR: %v", err)
-		return errors.Wrap(err, "failed serialize transaction log: ")
+		glog.Errorf("failed to encode transaction log %s: %v", r.Header.Key, err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not encode transaction log")
 	}
 
-	// send the file over
-	glog.Info("starting request: ", protocol.PostFileMethod)
-	request := &protocol.Request{
-		Header: protocol.Header{
-			Key:        id,
-			Type:       protocol.NodeType,
-			From:       thisID,
-			DataLength: uint64(len(logBuf.Bytes())),
-			PubKey:     selfKey.Public().(*rsa.PublicKey),
-		},
-		Method: protocol.PostFileMethod,
-		Data:   logBuf.Bytes(),
+	// the log is stored as a resource owned by the user, so it is handed off
+	// and replicated along with every other resource
+	header, err := writeHeader([]idSecret{idSecret{ID: r.Header.From}}, nil)
+	if err != nil {
+		glog.Infof("ERR: %s", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not write resource header")
 	}
-	glog.Info("!!!!!!!!!!!!!!!!! PUT TRANSACTION LOG !!!!!!!!!!!! Request: %+v\n", request)
-
-	response, err := t.RoundTrip(request)
+	timestamp, err := models.IncrementClock(r.Header.Clock)
 	if err != nil {
-		glog.Error("ERR: %v\n", err)
-		return errors.Wrap(err, "failed serialize transaction log: ")
+		return clockErrorResponse(r, err)
 	}
-	glog.Info("!!!!!!!!!!!!!!!!! PUT TRANSACTION LOG !!!!!!!!!!!! Response: %+v\n", response)
-
-	st.Close()
-	return nil
+	if err := checkQuota(ctx, dataPath, r.Header.Key, r.Header.From, uint64(len(data)), 0); err != nil {
+		return quotaErrorResponse(err)
+	}
+	if err := Post(dataPath, r.Header.Key, bytes.NewBuffer(append(header, data...))); err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storeErrorResponse(err)
+	}
+	if err := chargeQuota(ctx, dataPath, r.Header.Key, r.Header.From, uint64(len(data)), 0); err != nil {
+		glog.Warningf("failed to charge quota for %s: %v", r.Header.Key, err)
+	}
+	replicate(ctx, dataPath, r.Header.Key)
 
+	return protocol.Response{
+		Header: protocol.Header{
+			Clock: timestamp,
+		},
+		Status: protocol.Success,
+	}
 }
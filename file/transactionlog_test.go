@@ -0,0 +1,164 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func (u testUser) logHeader(t *testing.T) protocol.Header {
+	logKey, err := protocol.TransactionLogKey(&u.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.Header{Key: logKey, From: u.id, PubKey: &u.key.PublicKey}
+}
+
+func (u testUser) get(ctx context.Context, t *testing.T) (models.TransactionLog, protocol.Response) {
+	resp := GetTransactionLogHandler(ctx, &protocol.Request{
+		Header: u.logHeader(t),
+		Method: protocol.GetTransactionLogMethod,
+	})
+	if resp.Status != protocol.Success {
+		return nil, resp
+	}
+	tl, err := models.DecodeTransactionLog(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tl, resp
+}
+
+func (u testUser) put(ctx context.Context, t *testing.T, tl models.TransactionLog) protocol.Response {
+	data, err := models.EncodeTransactionLog(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := u.logHeader(t)
+	header.DataLength = uint64(len(data))
+	return PutTransactionLogHandler(ctx, u.sign(t, &protocol.Request{
+		Header: header,
+		Method: protocol.PutTransactionLogMethod,
+		Data:   data,
+	}))
+}
+
+// withEntry - a copy of tl with an update of name by client appended
+func withEntry(tl models.TransactionLog, name string, client models.Identifier, timestamp uint64) models.TransactionLog {
+	copied := tl.Merge(models.TransactionLog{})
+	entity := copied[name]
+	entity.ResourceName = name
+	entity.Entries = append(entity.Entries, models.TransactionEntry{
+		Operation: models.UpdateOperation,
+		ClientID:  client,
+		Timestamp: timestamp,
+		Clock:     models.VectorClock{client: timestamp},
+	})
+	copied[name] = entity
+	return copied
+}
+
+func TestPutTransactionLogMerges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactionlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	user := newTestUser(t)
+	if _, resp := user.get(ctx, t); resp.Header.ErrorCode != protocol.NotFoundCode {
+		t.Fatalf("expected no log before the first put, got %v", resp.Err())
+	}
+	laptop, desktop := models.Identifier{1}, models.Identifier{2}
+	base := withEntry(models.TransactionLog{}, "a.txt", laptop, 1)
+	if resp := user.put(ctx, t, base); resp.Status != protocol.Success {
+		t.Fatalf("first put failed: %v", resp.Err())
+	}
+
+	// both devices fetch the log, each add an entry, and put their log back
+	if resp := user.put(ctx, t, withEntry(base, "a.txt", laptop, 2)); resp.Status != protocol.Success {
+		t.Fatalf("put failed: %v", resp.Err())
+	}
+	if resp := user.put(ctx, t, withEntry(base, "b.txt", desktop, 1)); resp.Status != protocol.Success {
+		t.Fatalf("put failed: %v", resp.Err())
+	}
+	// a log put again changes nothing
+	if resp := user.put(ctx, t, withEntry(base, "b.txt", desktop, 1)); resp.Status != protocol.Success {
+		t.Fatalf("put failed: %v", resp.Err())
+	}
+
+	tl, resp := user.get(ctx, t)
+	if resp.Status != protocol.Success {
+		t.Fatalf("get failed: %v", resp.Err())
+	}
+	if entries := len(tl["a.txt"].Entries); entries != 2 {
+		t.Errorf("expected both changes to a.txt kept, got %d", entries)
+	}
+	if entries := len(tl["b.txt"].Entries); entries != 1 {
+		t.Errorf("expected the other device's change to b.txt kept once, got %d", entries)
+	}
+}
+
+func TestTransactionLogBelongsToCaller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactionlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	owner, other := newTestUser(t), newTestUser(t)
+	if resp := owner.put(ctx, t, withEntry(models.TransactionLog{}, "a.txt", owner.id, 1)); resp.Status != protocol.Success {
+		t.Fatalf("put failed: %v", resp.Err())
+	}
+
+	// claiming to be the owner with another key
+	header := owner.logHeader(t)
+	header.From = other.id
+	resp := GetTransactionLogHandler(ctx, &protocol.Request{Header: header, Method: protocol.GetTransactionLogMethod})
+	if resp.Header.ErrorCode != protocol.UnauthorizedCode {
+		t.Errorf("expected another user's log refused, got %v", resp.Err())
+	}
+
+	// asking for another key than the caller's log
+	header = other.logHeader(t)
+	header.Key = owner.logHeader(t).Key
+	resp = GetTransactionLogHandler(ctx, &protocol.Request{Header: header, Method: protocol.GetTransactionLogMethod})
+	if resp.Header.ErrorCode != protocol.BadHeaderCode {
+		t.Errorf("expected a key other than the caller's log refused, got %v", resp.Err())
+	}
+}
+
+func TestPutTransactionLogKeepsUnreadableLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactionlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+
+	user := newTestUser(t)
+	// the log is there, but cannot be opened
+	path := keyPath(dir, user.logHeader(t).Key)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp := user.get(ctx, t); resp.Header.ErrorCode != protocol.InternalErrorCode {
+		t.Errorf("expected an unreadable log not taken for a missing one, got %d, %v", resp.Status, resp.Err())
+	}
+	resp := user.put(ctx, t, withEntry(models.TransactionLog{}, "a.txt", user.id, 1))
+	if resp.Header.ErrorCode != protocol.InternalErrorCode {
+		t.Errorf("expected a put over an unreadable log to fail, got %d, %v", resp.Status, resp.Err())
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("expected the unreadable log left in place, got %v", err)
+	}
+}
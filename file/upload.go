@@ -0,0 +1,266 @@
+package file
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// uploadSuffix - the suffix of the file an upload posted in chunks is staged
+// in, followed by the id of the user posting it, so uploads of a resource by
+// different owners never mix
+const uploadSuffix = ".upload-"
+
+// uploadPath - the path an upload of key by from is staged in
+func uploadPath(path string, key, from models.Identifier) string {
+	return keyPath(path, key) + uploadSuffix + from.String()
+}
+
+// StaleUploadAge - how long an upload can go without a chunk being posted
+// before its staged data is removed by ExpireUploads
+const StaleUploadAge = 24 * time.Hour
+
+// uploadKey - the key the data staged for an upload of key by from is
+// charged to from under in the quota ledger, which is not the key of any
+// resource, so an abandoned upload counts towards its poster's quota until
+// it is removed
+func uploadKey(key, from models.Identifier) models.Identifier {
+	return models.HashBytes([]byte(key.String() + uploadSuffix + from.String()))
+}
+
+// stagedUpload - all of the data of an upload posted in chunks, once its
+// last chunk is staged.  Closing it removes the staged file.
+type stagedUpload struct {
+	*os.File
+	size uint64
+}
+
+// Close - close and remove the staged file
+func (su *stagedUpload) Close() error {
+	err := su.File.Close()
+	if rmErr := os.Remove(su.Name()); err == nil && rmErr != nil && !os.IsNotExist(rmErr) {
+		err = rmErr
+	}
+	return err
+}
+
+// stageChunk - add the chunk r posts to the upload of its resource staged by
+// its poster.  The first chunk, at offset zero, starts the upload over, and
+// each after it must be at the length staged so far, so a chunk which was
+// lost or repeated fails the upload rather than corrupting it.  The stored
+// resource is left as it is until the last chunk, without More, is staged,
+// when all of the staged data is returned, for the caller to store and then
+// close.  Otherwise the upload is nil, and the response is returned.  The
+// data staged counts towards the quota of its poster until then.
+func stageChunk(ctx context.Context, dataPath string, r *protocol.Request) (*stagedUpload, protocol.Response) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	path := uploadPath(dataPath, r.Header.Key, r.Header.From)
+	size := r.Header.Offset + uint64(len(r.Data))
+	staging := uploadKey(r.Header.Key, r.Header.From)
+	if err := checkQuota(ctx, dataPath, staging, r.Header.From, size, 0); err != nil {
+		return nil, quotaErrorResponse(err)
+	}
+
+	var (
+		f   *os.File
+		err error
+	)
+	if r.Header.Offset == 0 {
+		// fail an upload the poster could never store before any more of
+		// it is sent
+		if resp, ok := checkChunkOwner(ctx, r); !ok {
+			return nil, resp
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			glog.Infof("ERR: %v\n", err)
+			return nil, storeErrorResponse(err)
+		}
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR, 0600)
+		if os.IsNotExist(err) {
+			glog.Infof("post of %s at %d rejected, no upload staged", r.Header.Key, r.Header.Offset)
+			return nil, protocol.ErrorResponse(protocol.NotFoundCode, "no upload of the resource in progress")
+		}
+	}
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return nil, storeErrorResponse(err)
+	}
+
+	staged, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		glog.Infof("ERR: %v\n", err)
+		return nil, protocol.ErrorResponse(protocol.InternalErrorCode, "could not read staged upload")
+	}
+	if uint64(staged) != r.Header.Offset {
+		f.Close()
+		glog.Infof("post of %s at %d rejected, %d bytes staged", r.Header.Key, r.Header.Offset, staged)
+		return nil, protocol.ErrorResponse(protocol.ConflictCode, "upload offset does not match the data staged")
+	}
+	timestamp, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		f.Close()
+		return nil, clockErrorResponse(r, err)
+	}
+	if _, err := f.Write(r.Data); err != nil {
+		f.Close()
+		glog.Infof("ERR: %v\n", err)
+		return nil, storeErrorResponse(errors.Wrap(err, "error staging upload"))
+	}
+
+	if r.Header.More {
+		f.Close()
+		if err := chargeQuota(ctx, dataPath, staging, r.Header.From, size, 0); err != nil {
+			glog.Warningf("failed to charge quota for the upload of %s: %v", r.Header.Key, err)
+		}
+		return nil, protocol.Response{
+			Header: protocol.Header{
+				Clock: timestamp,
+				More:  true,
+			},
+			Status: protocol.Success,
+		}
+	}
+	// the staged data is removed once it is stored or refused, and counts
+	// towards the quota as the resource from here on
+	if err := releaseQuota(dataPath, staging); err != nil {
+		glog.Warningf("failed to credit quota for the upload of %s: %v", r.Header.Key, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(path)
+		glog.Infof("ERR: %v\n", err)
+		return nil, protocol.ErrorResponse(protocol.InternalErrorCode, "could not read staged upload")
+	}
+	return &stagedUpload{File: f, size: size}, protocol.Response{}
+}
+
+// checkChunkOwner - check the poster of the first chunk of an upload could
+// replace the resource, if it is already stored
+func checkChunkOwner(ctx context.Context, r *protocol.Request) (protocol.Response, bool) {
+	buf, err := storeFromContext(ctx).Get(r.Header.Key)
+	if isNotExist(err) {
+		return protocol.Response{}, true
+	}
+	if err != nil {
+		glog.Infof("post of %s failed reading the resource: %v", r.Header.Key, err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource"), false
+	}
+	defer buf.Close()
+	idSecrets, _, _, err := readHeader(buf)
+	if err != nil {
+		glog.Infof("ERR: %s\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read resource header"), false
+	}
+	owner, found := findOwner(idSecrets, r.Header.From)
+	if !found {
+		glog.Infof("unauthorized post of %s from %s", r.Header.Key, r.Header.From)
+		return protocol.ErrorResponse(protocol.UnauthorizedCode, "owner mismatch"), false
+	}
+	if owner.ReadOnly {
+		glog.Infof("post of %s rejected, owner has read-only access", r.Header.Key)
+		return readOnlyResponse(), false
+	}
+	return protocol.Response{}, true
+}
+
+// filterUpload - run the post filter against all of the data of an upload,
+// once its last chunk is staged, leaving it to be read from the start again.
+// The data is only read when a filter is configured.
+func filterUpload(ctx context.Context, key models.Identifier, su *stagedUpload) (protocol.Response, bool) {
+	filter, ok := ctx.Value(models.PostFilterContextKey).(PostFilter)
+	if !ok || filter == nil {
+		return protocol.Response{}, true
+	}
+	data, err := ioutil.ReadAll(su)
+	if err == nil {
+		_, err = su.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.ErrorResponse(protocol.InternalErrorCode, "could not read staged upload"), false
+	}
+	if err := filter(ctx, key, data); err != nil {
+		return policyViolationResponse(err), false
+	}
+	return protocol.Response{}, true
+}
+
+// uploadName - the key and poster of the upload staged in a file named name
+// in a data path
+func uploadName(name string) (key, from models.Identifier, ok bool) {
+	i := strings.Index(name, uploadSuffix)
+	if i < 0 {
+		return key, from, false
+	}
+	for _, part := range []struct {
+		hex string
+		id  *models.Identifier
+	}{{name[:i], &key}, {name[i+len(uploadSuffix):], &from}} {
+		raw, err := hex.DecodeString(part.hex)
+		if err != nil {
+			return key, from, false
+		}
+		if *part.id, err = models.IdentifierFromBytes(raw); err != nil {
+			return key, from, false
+		}
+	}
+	return key, from, true
+}
+
+// ExpireUploads - remove the data staged for the uploads in path which have
+// had no chunk posted for maxAge, abandoned by their posters, and credit it
+// back to their quotas.  Returns the number of uploads removed.
+func ExpireUploads(path string, maxAge time.Duration) (int, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	var (
+		cutoff  = time.Now().Add(-maxAge)
+		expired int
+	)
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if file != path && !isShardDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		key, from, ok := uploadName(info.Name())
+		if !ok || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		expired++
+		if err := releaseQuota(path, uploadKey(key, from)); err != nil {
+			glog.Warningf("failed to credit quota for the upload of %s: %v", key, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return expired, errors.Wrap(err, "failed to expire uploads: ")
+	}
+	if expired > 0 {
+		glog.Infof("removed %d uploads with no chunk posted for %s", expired, maxAge)
+	}
+	return expired, nil
+}
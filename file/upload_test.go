@@ -0,0 +1,188 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestChunksStagedUntilLast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	owner, key := newTestUser(t), models.Identifier{1}
+	post := func(header protocol.Header, data string) protocol.Response {
+		header.Key, header.From = key, owner.id
+		header.Secret = make([]byte, sessionKeyLen)
+		header.DataLength = uint64(len(data))
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: header,
+			Method: protocol.PostFileMethod,
+			Data:   []byte(data),
+		}))
+	}
+	get := func() string {
+		resp := GetFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{Key: key, From: owner.id},
+			Method: protocol.GetFileMethod,
+		}))
+		if resp.Status != protocol.Success {
+			t.Fatalf("get = %d, %v", resp.Status, resp.Err())
+		}
+		return string(resp.Data)
+	}
+
+	if resp := post(protocol.Header{Offset: 3, More: true}, "lost"); resp.Header.ErrorCode != protocol.NotFoundCode {
+		t.Errorf("expected a chunk of an upload never started not found, got %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(protocol.Header{}, "old"); resp.Status != protocol.Success {
+		t.Fatalf("post = %d, %v", resp.Status, resp.Err())
+	}
+
+	resp := post(protocol.Header{More: true}, "new ")
+	if resp.Status != protocol.Success || !resp.Header.More {
+		t.Fatalf("expected the first chunk staged, got %d, %v", resp.Status, resp.Err())
+	}
+	if got := get(); got != "old" {
+		t.Errorf("expected the resource kept until the last chunk, got %q", got)
+	}
+	if resp := post(protocol.Header{Offset: 2, More: true}, "xx"); resp.Header.ErrorCode != protocol.ConflictCode {
+		t.Errorf("expected a chunk at the wrong offset refused, got %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(protocol.Header{Offset: 4}, "data"); resp.Status != protocol.Success || resp.Header.More {
+		t.Fatalf("expected the last chunk stored, got %d, %v", resp.Status, resp.Err())
+	}
+	if got := get(); got != "new data" {
+		t.Errorf("expected the staged upload stored, got %q", got)
+	}
+	if _, err := os.Stat(uploadPath(dir, key, owner.id)); !os.IsNotExist(err) {
+		t.Errorf("expected the staged upload removed, got %v", err)
+	}
+}
+
+func TestUploadFilteredOnceStaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	var filtered []string
+	var filter PostFilter = func(ctx context.Context, key models.Identifier, data []byte) error {
+		filtered = append(filtered, string(data))
+		if strings.Contains(string(data), "bad data") {
+			return errors.New("bad data")
+		}
+		return nil
+	}
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.PostFilterContextKey, filter)
+	owner, key := newTestUser(t), models.Identifier{1}
+	post := func(header protocol.Header, data string) protocol.Response {
+		header.Key = key
+		header.Secret = make([]byte, sessionKeyLen)
+		header.DataLength = uint64(len(data))
+		return PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: header,
+			Method: protocol.PostFileMethod,
+			Data:   []byte(data),
+		}))
+	}
+
+	// neither chunk is bad on its own
+	if resp := post(protocol.Header{More: true}, "bad "); resp.Status != protocol.Success {
+		t.Fatalf("first chunk = %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(protocol.Header{Offset: 4}, "data"); resp.Status != protocol.PolicyViolation {
+		t.Errorf("expected the staged upload rejected by the filter, got %d, %v", resp.Status, resp.Err())
+	}
+	if len(filtered) != 1 || filtered[0] != "bad data" {
+		t.Errorf("filter ran on %q, expected the whole upload once", filtered)
+	}
+	if _, err := os.Stat(uploadPath(dir, key, owner.id)); !os.IsNotExist(err) {
+		t.Errorf("expected the rejected upload removed, got %v", err)
+	}
+
+	filtered = nil
+	if resp := post(protocol.Header{More: true}, "good "); resp.Status != protocol.Success {
+		t.Fatalf("first chunk = %d, %v", resp.Status, resp.Err())
+	}
+	if resp := post(protocol.Header{Offset: 5}, "data"); resp.Status != protocol.Success {
+		t.Fatalf("last chunk = %d, %v", resp.Status, resp.Err())
+	}
+	if len(filtered) != 1 || filtered[0] != "good data" {
+		t.Errorf("filter ran on %q, expected the whole upload once", filtered)
+	}
+	resp := GetFileHandler(ctx, owner.sign(t, &protocol.Request{
+		Header: protocol.Header{Key: key},
+		Method: protocol.GetFileMethod,
+	}))
+	if string(resp.Data) != "good data" {
+		t.Errorf("expected the filtered upload stored whole, got %q", resp.Data)
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(quotaLedgers, dir)
+
+	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dir)
+	ctx = context.WithValue(ctx, models.MaxBytesPerUserContextKey, uint64(100))
+	owner := newTestUser(t)
+	stage := func(key models.Identifier) {
+		resp := PostFileHandler(ctx, owner.sign(t, &protocol.Request{
+			Header: protocol.Header{
+				Key:        key,
+				Secret:     make([]byte, sessionKeyLen),
+				DataLength: 40,
+				More:       true,
+			},
+			Method: protocol.PostFileMethod,
+			Data:   make([]byte, 40),
+		}))
+		if resp.Status != protocol.Success {
+			t.Fatalf("chunk = %d, %v", resp.Status, resp.Err())
+		}
+	}
+	abandoned, active := models.Identifier{1}, models.Identifier{2}
+	stage(abandoned)
+	stage(active)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(uploadPath(dir, abandoned, owner.id), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if expired, err := ExpireUploads(dir, time.Hour); err != nil || expired != 1 {
+		t.Fatalf("expired %d, %v, expected the abandoned upload", expired, err)
+	}
+	if _, err := os.Stat(uploadPath(dir, abandoned, owner.id)); !os.IsNotExist(err) {
+		t.Errorf("expected the abandoned upload removed, got %v", err)
+	}
+	if _, err := os.Stat(uploadPath(dir, active, owner.id)); err != nil {
+		t.Errorf("expected the active upload kept, got %v", err)
+	}
+	ql, err := loadQuotaLedger(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ql.Usage[owner.id] != 40 {
+		t.Errorf("usage = %d, expected only the active upload's 40", ql.Usage[owner.id])
+	}
+}
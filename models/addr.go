@@ -0,0 +1,78 @@
+package models
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxHostnameLen - the longest hostname which can be resolved
+const maxHostnameLen = 253
+
+// ParseNodeAddr - check addr is an address a node can be bound to or reached
+// at, and return it in the host:port form net.Dial and net.Listen take.  The
+// host is an IPv4 address, an IPv6 address in brackets such as [::1]:3000, a
+// hostname, or empty for every interface, as in :3000.  A bare port such as
+// 3000 is taken as :3000.  The host is kept as given, as the address a node
+// advertises decides its identifier.
+func ParseNodeAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("address is empty")
+	}
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		addr = ":" + addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return "", errors.Errorf("invalid address %q, an IPv6 address must be in brackets, as in [::1]:3000", addr)
+		}
+		return "", errors.Errorf("invalid address %q, it must be host:port", addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.Errorf("invalid port %q in address %q, it must be a number from 0 to 65535", port, addr)
+	}
+	if strings.HasPrefix(addr, "[") {
+		// only IPv6 addresses are bracketed, with an optional zone
+		ip := host
+		if i := strings.LastIndex(ip, "%"); i >= 0 {
+			ip = ip[:i]
+		}
+		if net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+			return "", errors.Errorf("invalid IPv6 address %q in address %q", host, addr)
+		}
+	} else if host != "" && net.ParseIP(host) == nil && !validHostname(host) {
+		return "", errors.Errorf("invalid host %q in address %q", host, addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// validHostname - check host is a hostname, dot separated labels of letters,
+// digits, hyphens and underscores, none starting or ending with a hyphen.  The
+// last label cannot be all digits, so a mistyped IPv4 address such as
+// 256.0.0.1 is not taken for a hostname.
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > maxHostnameLen {
+		return false
+	}
+	labels := strings.Split(host, ".")
+	if _, err := strconv.ParseUint(labels[len(labels)-1], 10, 64); err == nil {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package models
+
+import "testing"
+
+func TestParseNodeAddr(t *testing.T) {
+	valid := []struct {
+		addr, want string
+	}{
+		{"127.0.0.1:3000", "127.0.0.1:3000"},
+		{"10.0.0.12:0", "10.0.0.12:0"},
+		{":3000", ":3000"},
+		{"3000", ":3000"},
+		{"[::1]:3000", "[::1]:3000"},
+		{"[2001:db8::7]:443", "[2001:db8::7]:443"},
+		{"[fe80::1%eth0]:3000", "[fe80::1%eth0]:3000"},
+		{"localhost:3000", "localhost:3000"},
+		{"node1.example.com:3001", "node1.example.com:3001"},
+		{"peerstore_node-2:3000", "peerstore_node-2:3000"},
+	}
+	for _, c := range valid {
+		got, err := ParseNodeAddr(c.addr)
+		if err != nil {
+			t.Errorf("%q: expected it to be valid, got %v", c.addr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: expected %q, got %q", c.addr, c.want, got)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"localhost",
+		"::1:3000",
+		"[::1]",
+		"[127.0.0.1]:3000",
+		"[not-an-ip]:3000",
+		"localhost:http",
+		"localhost:65536",
+		"localhost:-1",
+		"256.0.0.1:3000",
+		"-node.example.com:3000",
+		"node..example.com:3000",
+		"node example.com:3000",
+		"node/1:3000",
+	}
+	for _, addr := range invalid {
+		if got, err := ParseNodeAddr(addr); err == nil {
+			t.Errorf("%q: expected it to be invalid, got %q", addr, got)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// clockReserve - how far ahead of the clock the persisted clock is kept, so
+// it is written once every clockReserve increments rather than on each
+const clockReserve = 1000
+
+var (
+	// lamport clock for partial ordering assistance in transaction log
+	clock   uint64 = 1
+	clockMu        = &sync.RWMutex{}
+	// clockFile - where the clock is persisted, empty when it is not
+	clockFile string
+	// clockPersisted - the value last persisted to clockFile, which the
+	// clock is never handed out past without persisting a later one first
+	clockPersisted uint64
+)
+
+func GetClock() uint64 {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return clock
+}
+
+// IncrementClock - advance the clock past base and every value handed out so
+// far, and return it.  When the clock is persisted and the new value is past
+// what was last persisted, it fails unless a later one is persisted first,
+// leaving the clock where it was, as a restart would hand the value out again.
+func IncrementClock(base uint64) (uint64, error) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	next := clock + 1
+	if clock < base {
+		next = base + 1
+	}
+	if clockFile != "" && next > clockPersisted {
+		if err := persistClock(next); err != nil {
+			return clock, errors.Wrapf(err, "failed to persist the clock at %d", next)
+		}
+	}
+	clock = next
+	return clock, nil
+}
+
+// ConfigureClockFile - persist the clock to path, resuming it from the value
+// persisted there by the last run, if that is later, so timestamps never go
+// backwards across a restart.  The clock is persisted ahead of the values
+// handed out, a restart resumes above every one of them.
+func ConfigureClockFile(path string) error {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.Wrap(err, "failed to read clock")
+	case len(data) != 8:
+		return errors.Errorf("clock %s is corrupt", path)
+	default:
+		if persisted := binary.BigEndian.Uint64(data); persisted > clock {
+			clock = persisted
+		}
+	}
+	clockFile = path
+	return persistClock(clock)
+}
+
+// persistClock - atomically persist a clock clockReserve ahead of at,
+// clockMu must be held
+func persistClock(at uint64) error {
+	var data = make([]byte, 8)
+	binary.BigEndian.PutUint64(data, at+clockReserve)
+	tmp := clockFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write clock")
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write clock")
+	}
+	// on disk before it replaces the last one, or a crash could leave none
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write clock")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write clock")
+	}
+	if err := os.Rename(tmp, clockFile); err != nil {
+		return errors.Wrap(err, "failed to replace clock")
+	}
+	clockPersisted = at + clockReserve
+	return nil
+}
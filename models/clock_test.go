@@ -0,0 +1,150 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// restartClock - forget the clock, as a restarted process would
+func restartClock() {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	clock, clockFile, clockPersisted = 1, "", 0
+}
+
+func TestClockSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restartClock()
+	path := filepath.Join(dir, "clock")
+
+	restartClock()
+	if err := ConfigureClockFile(path); err != nil {
+		t.Fatal(err)
+	}
+	var last uint64
+	// past a reservation, so the clock is persisted again along the way
+	for i := 0; i < clockReserve+10; i++ {
+		if last, err = IncrementClock(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// and a jump to a remote clock, well past it
+	if last, err = IncrementClock(last + 5*clockReserve); err != nil {
+		t.Fatal(err)
+	}
+
+	for restart := 0; restart < 2; restart++ {
+		restartClock()
+		if err := ConfigureClockFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if c := GetClock(); c <= last {
+			t.Fatalf("restart %d: clock resumed at %d, at or before %d", restart, c, last)
+		}
+		if c, err := IncrementClock(0); err != nil || c <= last {
+			t.Fatalf("restart %d: clock incremented to %d, %v, at or before %d", restart, c, err, last)
+		}
+		last = GetClock()
+	}
+
+	if err := ioutil.WriteFile(path, []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureClockFile(path); err == nil {
+		t.Error("expected a corrupt clock refused")
+	}
+}
+
+func TestIncrementClockConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restartClock()
+	restartClock()
+	if err := ConfigureClockFile(filepath.Join(dir, "clock")); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 16, 500
+	var (
+		wg     sync.WaitGroup
+		values = make(chan []uint64, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var seen []uint64
+			for j := 0; j < increments; j++ {
+				c, err := IncrementClock(0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				seen = append(seen, c)
+			}
+			values <- seen
+		}()
+	}
+	wg.Wait()
+	close(values)
+
+	unique := make(map[uint64]bool)
+	for seen := range values {
+		for i, v := range seen {
+			if i > 0 && v <= seen[i-1] {
+				t.Fatalf("clock went from %d to %d", seen[i-1], v)
+			}
+			if unique[v] {
+				t.Fatalf("clock handed out %d twice", v)
+			}
+			unique[v] = true
+		}
+	}
+	if len(unique) != workers*increments {
+		t.Errorf("expected %d values, got %d", workers*increments, len(unique))
+	}
+}
+
+func TestIncrementClockPersistFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restartClock()
+	restartClock()
+	path := filepath.Join(dir, "clock")
+	if err := ConfigureClockFile(path); err != nil {
+		t.Fatal(err)
+	}
+	// the clock can no longer be persisted
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// handed out up to what was persisted
+	var last uint64
+	for last < clockPersisted {
+		if last, err = IncrementClock(0); err != nil {
+			t.Fatalf("increment to %d, within what was persisted, failed: %v", last+1, err)
+		}
+	}
+	for _, base := range []uint64{0, last + 5*clockReserve} {
+		if c, err := IncrementClock(base); err == nil {
+			t.Errorf("clock incremented to %d past the persisted %d", c, clockPersisted)
+		}
+		if c := GetClock(); c != last {
+			t.Errorf("failed increment moved the clock from %d to %d", last, c)
+		}
+	}
+}
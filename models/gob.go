@@ -0,0 +1,18 @@
+package models
+
+import "encoding/gob"
+
+// init - register the types of this package which are gob encoded, all in
+// one place, so each is registered under the same name by every peer
+// whichever of them it first encodes
+func init() {
+	gob.Register(Identifier{})
+	gob.Register(Node{})
+	gob.Register(RingSettings{})
+	gob.Register(SuccessorRequest{})
+	gob.Register(TransactionOperation(0))
+	gob.Register(VectorClock{})
+	gob.Register(TransactionEntry{})
+	gob.Register(TransactionEntity{})
+	gob.Register(TransactionLog{})
+}
@@ -1,49 +1,35 @@
 package models
 
 import (
+	"bytes"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math/big"
+	"math/bits"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-var (
-	// lamport clock for partial ordering assistance in transaction log
-	clock   uint64 = 1
-	clockMu        = &sync.RWMutex{}
-)
-
-func GetClock() uint64 {
-	clockMu.RLock()
-	defer clockMu.RUnlock()
-	return clock
-}
-
-func IncrementClock(base uint64) uint64 {
-	clockMu.Lock()
-	defer clockMu.Unlock()
-	if clock < base {
-		clock = base + 1
-	} else {
-		clock = clock + 1
-	}
-	return clock
-}
-
-func init() {
-	gob.Register(SuccessorRequest{})
-	gob.Register(TransactionLog{})
-}
-
 type TransactionOperation int
 
 const (
 	UpdateOperation TransactionOperation = iota
 	DeleteOperation
+	// DirectoryOperation - the resource is a directory, recorded so empty
+	// directories are recreated on restore
+	DirectoryOperation
+	// SymlinkOperation - the resource is a symbolic link, recorded with its
+	// target so it is recreated as a link rather than a copy of its target
+	SymlinkOperation
 )
 
 // TransactionEntity - a record of a transaction
@@ -55,19 +41,322 @@ type TransactionEntity struct {
 
 type TransactionEntry struct {
 	Operation TransactionOperation
+	// ClientID - the client which made the change, each device of a user
+	// being a client of its own
 	ClientID  Identifier
 	Timestamp uint64
+	// Version - the version id the storing node gave this change, zero if
+	// the node does not retain versions
+	Version uint64
+	// Clock - the vector clock of the change, empty for entries written
+	// before vector clocks were added
+	Clock VectorClock
+	// Size, ModTime, ContentType - the length of the file an update
+	// posted, when it was last modified, and the type of content sniffed from
+	// its first bytes.  They are zero for other operations, and for entries
+	// written before they were recorded.
+	Size        uint64
+	ModTime     time.Time
+	ContentType string
+	// LinkTarget - the target of a symbolic link, as the link records it
+	LinkTarget string
+}
+
+// Compare - how the change e records is ordered against the change other
+// records, by their vector clocks.  Entries without a vector clock are
+// ordered by their lamport timestamps, and never conflict.
+func (e TransactionEntry) Compare(other TransactionEntry) ClockOrdering {
+	if len(e.Clock) > 0 && len(other.Clock) > 0 {
+		return e.Clock.Compare(other.Clock)
+	}
+	switch {
+	case e.Timestamp < other.Timestamp:
+		return HappensBefore
+	case e.Timestamp > other.Timestamp:
+		return HappensAfter
+	}
+	return ClocksEqual
+}
+
+// Latest - the latest entries of the entity, which no other entry happened
+// after.  There is just one, unless clients changed the resource
+// concurrently, in which case the changes conflict.
+func (te TransactionEntity) Latest() []TransactionEntry {
+	var latest []TransactionEntry
+	for _, i := range te.latestIndexes() {
+		latest = append(latest, te.Entries[i])
+	}
+	return latest
+}
+
+// latestIndexes - the indexes of the latest entries of the entity, in order.
+// Each entry is only compared with the latest of the entries before it, so a
+// long history of changes made one after the other is quick to go through.
+func (te TransactionEntity) latestIndexes() []int {
+	var heads []int
+Entries:
+	for i, e := range te.Entries {
+		for _, h := range heads {
+			if e.Compare(te.Entries[h]) == HappensBefore {
+				continue Entries
+			}
+		}
+		kept := heads[:0]
+		for _, h := range heads {
+			// an earlier record of the same change is dropped for the last
+			if ord := e.Compare(te.Entries[h]); ord != HappensAfter && ord != ClocksEqual {
+				kept = append(kept, h)
+			}
+		}
+		heads = append(kept, i)
+	}
+	return heads
+}
+
+// Clock - the vector clock which knows of every change to the entity
+func (te TransactionEntity) Clock() VectorClock {
+	var c = VectorClock{}
+	for _, e := range te.Entries {
+		c = c.Merge(e.Clock)
+	}
+	return c
 }
 
 // TransactionLog - a list of TransactionEntities
 type TransactionLog map[string]TransactionEntity
 
+// Same - check if the entries record the same change, made by the same
+// client with the same clock
+func (e TransactionEntry) Same(other TransactionEntry) bool {
+	return e.Operation == other.Operation && e.ClientID == other.ClientID &&
+		e.Timestamp == other.Timestamp && e.Version == other.Version &&
+		len(e.Clock) == len(other.Clock) && e.Clock.Compare(other.Clock) == ClocksEqual
+}
+
+// Merge - the log with the entries of other which it does not already have
+// appended, so the changes of two clients which each updated the log from the
+// same earlier log are all kept.  Neither log is changed.
+func (tl TransactionLog) Merge(other TransactionLog) TransactionLog {
+	merged := make(TransactionLog, len(tl))
+	for name, entity := range tl {
+		entity.Entries = append([]TransactionEntry{}, entity.Entries...)
+		merged[name] = entity
+	}
+	for name, theirs := range other {
+		entity, ok := merged[name]
+		if !ok {
+			entity = TransactionEntity{
+				ResourceName: theirs.ResourceName,
+				ResourceID:   theirs.ResourceID,
+			}
+		}
+	Entries:
+		for _, e := range theirs.Entries {
+			for _, have := range entity.Entries {
+				if have.Same(e) {
+					continue Entries
+				}
+			}
+			entity.Entries = append(entity.Entries, e)
+		}
+		merged[name] = entity
+	}
+	return merged
+}
+
+// TransactionHistory - the entries of each resource the transaction log is
+// compacted to, see Compact
+const TransactionHistory = 100
+
+// Compact - the log with the history of each resource cut down to the
+// keepLast most recent entries by timestamp.  The latest entries of a
+// resource are always kept, all of them if changes conflict, so the log still
+// tells which later changes were made knowing of the ones kept.  Neither the
+// log nor its entities are changed.
+func (tl TransactionLog) Compact(keepLast int) TransactionLog {
+	compacted := make(TransactionLog, len(tl))
+	for name, entity := range tl {
+		entity.Entries = entity.compact(keepLast)
+		compacted[name] = entity
+	}
+	return compacted
+}
+
+// compact - the entries of the entity Compact keeps, in order
+func (te TransactionEntity) compact(keepLast int) []TransactionEntry {
+	if len(te.Entries) <= keepLast {
+		return append([]TransactionEntry{}, te.Entries...)
+	}
+	keep := make([]bool, len(te.Entries))
+	for _, i := range te.latestIndexes() {
+		keep[i] = true
+	}
+	if keepLast > 0 {
+		recent := make([]int, len(te.Entries))
+		for i := range recent {
+			recent[i] = i
+		}
+		// most recent first, the later of two entries with the same timestamp
+		sort.Slice(recent, func(a, b int) bool {
+			ea, eb := te.Entries[recent[a]], te.Entries[recent[b]]
+			if ea.Timestamp != eb.Timestamp {
+				return ea.Timestamp > eb.Timestamp
+			}
+			return recent[a] > recent[b]
+		})
+		for _, i := range recent[:keepLast] {
+			keep[i] = true
+		}
+	}
+	var entries []TransactionEntry
+	for i, e := range te.Entries {
+		if keep[i] {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
 // SuccessorRequest - this is the chord successor request strurture, the ID
 // is the key we are looking to find a successor for.
 type SuccessorRequest struct {
 	ID Identifier
 }
 
+// RebalanceRequest - the rebalance request structure.  PushOnly limits the
+// node to handing off the keys it no longer owns, which is how a rebalancing
+// node asks its successor for keys without the request going around the ring.
+type RebalanceRequest struct {
+	PushOnly bool
+}
+
+// RebalanceResponse - the outcome of a rebalance, the number of keys which
+// were handed off, which stayed put, and which failed to transfer
+type RebalanceResponse struct {
+	Transferred int
+	Kept        int
+	Failed      int
+}
+
+// DrainRequest - the drain request structure.  Undrain takes the node out of
+// draining instead, so it accepts new data and is routed to again.
+type DrainRequest struct {
+	Undrain bool
+}
+
+// DrainResponse - the outcome of a drain, the number of keys which were
+// handed off to the successor and which failed to transfer.  The node only
+// routes its keys on to the successor when none failed.
+type DrainResponse struct {
+	Transferred int
+	Failed      int
+}
+
+// StatsResponse - the figures a node reports for capacity planning: the
+// resources it stores and their bytes on disk, the requests it has handled
+// since it started and how many of them failed, by method, how long it has
+// been up, and the circuit breakers of the peers it has recently failed to
+// reach, by peer address
+type StatsResponse struct {
+	Resources int
+	Bytes     uint64
+	Requests  map[string]uint64
+	Failures  map[string]uint64
+	Uptime    time.Duration
+	Breakers  map[string]BreakerStats
+}
+
+// BreakerStats - the circuit breaker of a peer, its state and the number of
+// consecutive failures to reach it
+type BreakerStats struct {
+	State               string
+	ConsecutiveFailures int
+}
+
+// NodeLeaveRequest - the node request of a node leaving the ring, sent to
+// its predecessor and successor, which take each other in its place
+type NodeLeaveRequest struct {
+	Node        Node
+	Predecessor Node
+	Successor   Node
+}
+
+// ListedFile - a resource listed by a node, with the length of its stored
+// data.  Nodes do not know resource names, only their keys.
+type ListedFile struct {
+	Key      Identifier
+	Size     uint64
+	ReadOnly bool
+}
+
+// ListFilesResponse - the resources a node stores which the caller is an
+// owner of
+type ListFilesResponse struct {
+	Files []ListedFile
+}
+
+// MaxBatchKeys - the most resources a batch get can ask for at once
+const MaxBatchKeys = 256
+
+// BatchResource - a resource fetched in a batch get, as a get file response
+// would carry it
+type BatchResource struct {
+	Data    []byte
+	Secret  []byte
+	Tag     []byte
+	Version uint64
+}
+
+// BatchGetResponse - the resources of a batch get the caller is an owner of,
+// by key.  Keys which are not stored, the caller does not own, or would make
+// the response too large are left out, to be fetched one by one.
+type BatchGetResponse struct {
+	Resources map[Identifier]BatchResource
+}
+
+// RevokeShareRequest - the user to remove from the owners of a resource
+type RevokeShareRequest struct {
+	ID Identifier
+}
+
+// TransferOwnershipRequest - the user to hand a resource to, and the
+// session key of the resource encrypted for them
+type TransferOwnershipRequest struct {
+	ID     Identifier
+	Secret []byte
+}
+
+// Owner - a user who owns a resource, and whether they can only read it
+type Owner struct {
+	ID       Identifier
+	ReadOnly bool
+}
+
+// OwnersResponse - the owners of a resource, the user who posted it first
+type OwnersResponse struct {
+	Owners []Owner
+}
+
+// SuccessorListResponse - the immediate successors of a node, in order
+// around the ring, and how many of them hold a replica of each resource the
+// node is responsible for
+type SuccessorListResponse struct {
+	Successors        []Node
+	ReplicationFactor int
+}
+
+// Replicas - the successors holding a replica of each resource the node is
+// responsible for
+func (slr SuccessorListResponse) Replicas() []Node {
+	if n := slr.ReplicationFactor - 1; n < len(slr.Successors) {
+		if n < 0 {
+			n = 0
+		}
+		return slr.Successors[:n]
+	}
+	return slr.Successors
+}
+
 // ContextKey - this is a type which is used as keys for the context
 type ContextKey uint64
 
@@ -89,16 +378,127 @@ const (
 	SelfNodeContextKey
 	UserPublicKeyContextKey
 	ResourceNameContextKey
+	// PostFilterContextKey - the filter which is run against posted data
+	// before it is stored
+	PostFilterContextKey
+	// KeepVersionsContextKey - the number of previous versions of a file
+	// the node retains, zero disables versioning
+	KeepVersionsContextKey
+	// RingSettingsContextKey - the ring settings this node was configured with
+	RingSettingsContextKey
+	// MinFreeSpaceContextKey - the bytes of disk space which must remain free
+	// after a post is stored, zero disables the free space check
+	MinFreeSpaceContextKey
+	// MaxBytesPerUserContextKey - the bytes of resource data stored for each
+	// owner, zero disables quotas
+	MaxBytesPerUserContextKey
+	// ReplicateFunctionContextKey - the function handlers call with the data
+	// path and key of a resource they changed, to copy it to the replicas
+	ReplicateFunctionContextKey
+	// StoreContextKey - the file.Store the node keeps resources in, the files
+	// of the data path when it is not set
+	StoreContextKey
+	// CallerTypeContextKey - the type the caller of the request being handled
+	// was authenticated as
+	CallerTypeContextKey
+	// AdminsContextKey - the users allowed the admin methods of the node
+	AdminsContextKey
+	// CallerNodeContextKey - the trusted node the request being handled was
+	// signed by, when its caller was authenticated as a node
+	CallerNodeContextKey
 )
 
-func init() {
-	gob.Register(Node{})
-	gob.Register(Identifier{})
+// RingSettings - the settings which need to agree across every node in the
+// ring.  Each node keeps a list of its SuccessorListLength immediate
+// successors, and a write is replicated to the first ReplicationFactor of
+// them, so the successor list must be at least as long as the replication
+// factor.  Nodes with mismatched settings will place replicas inconsistently,
+// so the settings are exchanged when a node registers with a peer.
+type RingSettings struct {
+	SuccessorListLength int
+	ReplicationFactor   int
 }
 
+// Validate - make sure the ring settings are consistent
+func (rs RingSettings) Validate() error {
+	if rs.ReplicationFactor < 1 {
+		return errors.New("replication factor must be at least 1")
+	}
+	if rs.SuccessorListLength < rs.ReplicationFactor {
+		return errors.New(
+			"successor list length must be at least the replication factor")
+	}
+	return nil
+}
+
+// Equal - check if two ring settings are the same
+func (rs RingSettings) Equal(other RingSettings) bool {
+	return rs.SuccessorListLength == other.SuccessorListLength &&
+		rs.ReplicationFactor == other.ReplicationFactor
+}
+
+// ToString - string representation of the ring settings
+func (rs RingSettings) ToString() string {
+	return fmt.Sprintf("successorListLength=%d, replicationFactor=%d",
+		rs.SuccessorListLength, rs.ReplicationFactor)
+}
+
+// IdentifierLen - the length of an Identifier, which is the digest length
+// of the hash identifiers are made with.  It decides the size of the ring and
+// the layout of the owner header of stored resources.
+const IdentifierLen = sha256.Size
+
+// NewIdentifierHash - the hash identifiers are made with, which must produce
+// IdentifierLen byte digests
+var NewIdentifierHash = sha256.New
+
 // Identifier - This is a common Chord Identifier, also used for
 // file names
-type Identifier [20]byte
+type Identifier [IdentifierLen]byte
+
+// HashBytes - the identifier of b, every identifier is made with this
+func HashBytes(b []byte) Identifier {
+	h := NewIdentifierHash()
+	h.Write(b)
+	var id Identifier
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// IdentifierFromBytes - create an Identifier from a slice, which must be
+// exactly the length of an Identifier.  Copying a wrong length slice into an
+// Identifier would silently truncate or zero pad it.
+func IdentifierFromBytes(b []byte) (Identifier, error) {
+	var id Identifier
+	if len(b) != len(id) {
+		return id, errors.Errorf("identifier must be %d bytes, not %d", len(id), len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// String - the hex encoding of the identifier, which is also how it is named
+// on disk
+func (id Identifier) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Bytes - the identifier as a slice
+func (id Identifier) Bytes() []byte {
+	return id[:]
+}
+
+// Equal - check if the identifier is the same as other
+func (id Identifier) Equal(other Identifier) bool {
+	return id == other
+}
+
+// IdentifierEqual - check if a and b are the same in constant time, for
+// comparisons which decide access to a secret, so the time taken does not
+// leak how much of an identifier matched
+func IdentifierEqual(a, b Identifier) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
 
 // Node - This is a peer node representation
 type Node struct {
@@ -111,10 +511,10 @@ type Node struct {
 // node to see which is greater/less/equal
 func (n Node) Compare(nPrime Node) int {
 	nNum := big.NewInt(0)
-	nNum.SetBytes(n.ID[:])
+	nNum.SetBytes(n.ID.Bytes())
 
 	nPrimeNum := big.NewInt(0)
-	nPrimeNum.SetBytes(nPrime.ID[:])
+	nPrimeNum.SetBytes(nPrime.ID.Bytes())
 
 	return nNum.Cmp(nPrimeNum)
 }
@@ -122,22 +522,65 @@ func (n Node) Compare(nPrime Node) int {
 // CompareID - Given a Node, compare it's ID to the id parameter
 func (n Node) CompareID(id Identifier) int {
 	nNum := big.NewInt(0)
-	nNum.SetBytes(n.ID[:])
+	nNum.SetBytes(n.ID.Bytes())
 
 	idNum := big.NewInt(0)
-	idNum.SetBytes(id[:])
+	idNum.SetBytes(id.Bytes())
 
 	return nNum.Cmp(idNum)
 }
 
-// ToString - Implementation of String
+// Equal - is other the same node as n, at the same address with the same
+// public key.  The keys are compared by value, as decoded nodes never share
+// a key pointer.
+func (n Node) Equal(other Node) bool {
+	return n.Addr == other.Addr && publicKeysEqual(n.PublicKey, other.PublicKey)
+}
+
+// publicKeysEqual - are a and b the same key, two nil keys are equal
+func publicKeysEqual(a, b *rsa.PublicKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.E == b.E && a.N.Cmp(b.N) == 0
+}
+
+// Encode - serialize the node, to be sent in a request or response
+func (n Node) Encode() ([]byte, error) {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(n); err != nil {
+		return nil, errors.Wrap(err, "failed to encode node: ")
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeNode - deserialize a node serialized with Encode
+func DecodeNode(r io.Reader) (Node, error) {
+	var n Node
+	if err := gob.NewDecoder(r).Decode(&n); err != nil {
+		return Node{}, errors.Wrap(err, "failed to decode node: ")
+	}
+	return n, nil
+}
+
+// nodeIDPrefixLen - how many hex digits of its identifier String shows of a
+// node, enough to tell nodes apart in the logs
+const nodeIDPrefixLen = 8
+
+// String - the address of the node and the start of its identifier, for
+// logs.  The public key is left out, it is long and only needed to reach the
+// node.
+func (n Node) String() string {
+	return fmt.Sprintf("%s (id=%s)", n.Addr, n.ID.String()[:nodeIDPrefixLen])
+}
+
+// ToString - see String
 func (n Node) ToString() string {
-	return fmt.Sprintf("addr=%s, id=%s, pubkey=%v", n.Addr,
-		hex.EncodeToString(n.ID[:]), n.PublicKey)
+	return n.String()
 }
 
 // M - This is the max number of nodes in a finger table
-const M = 20 * 8
+const M = IdentifierLen * 8
 
 // Interval - This is the interval in which a successor in the
 // finger table is responsible
@@ -153,13 +596,41 @@ func (i Interval) ToString() string {
 // KeyToID - helper to convert a key to a chord ring id
 func KeyToID(key Identifier) uint64 {
 	hash := big.NewInt(0)
-	hash.SetBytes(key[:])
+	hash.SetBytes(key.Bytes())
 	ID := big.NewInt(0)
-	ID.Mod(hash, big.NewInt(160))
+	ID.Mod(hash, big.NewInt(M))
 
 	return ID.Uint64()
 }
 
+// PositionKey - the smallest key at the ring position pos, to look up the
+// node responsible for a position with
+func PositionKey(pos uint64) Identifier {
+	var key Identifier
+	binary.BigEndian.PutUint64(key[IdentifierLen-8:], pos%M)
+	return key
+}
+
+// Between - is the ring position x strictly between low and high, going
+// around the ring from low.  When low and high are the same every other
+// position is between them.
+func Between(x, low, high uint64) bool {
+	if low < high {
+		return low < x && x < high
+	}
+	return low < x || x < high
+}
+
+// NumFingers - the number of fingers a node keeps, the i'th spanning
+// 2^(i-1) positions, so the last one reaches half way around the ring
+var NumFingers = uint64(bits.Len(uint(M - 1)))
+
+// FingerStart - the ring position the i'th finger of the node at id starts
+// at, 2^(i-1) positions on from it
+func FingerStart(id Identifier, i uint64) uint64 {
+	return (KeyToID(id) + 1<<(i-1)) % M
+}
+
 // NewInterval - helper to create a new interval based on two nodes
 func NewInterval(start, end Node) Interval {
 	return Interval{
@@ -194,7 +665,7 @@ func NewFingerTable() *FingerTable {
 func (ft *FingerTable) GetIth(i uint64) (Finger, error) {
 	if i < 1 || i > M {
 		return Finger{},
-			errors.New("i'th entry of finger table must be between 1 and 160")
+			errors.Errorf("i'th entry of finger table must be between 1 and %d", M)
 	}
 	ft.mu.RLock()
 	defer ft.mu.RUnlock()
@@ -204,7 +675,7 @@ func (ft *FingerTable) GetIth(i uint64) (Finger, error) {
 // SetIth - Set the i'th entry in a given finger table
 func (ft *FingerTable) SetIth(i uint64, interval Interval, successor, self Node) error {
 	if i < 1 || i > M {
-		return errors.New("i'th entry of finger table must be between 1 and 160")
+		return errors.Errorf("i'th entry of finger table must be between 1 and %d", M)
 	}
 	ft.mu.Lock()
 	defer ft.mu.Unlock()
@@ -216,6 +687,56 @@ func (ft *FingerTable) SetIth(i uint64, interval Interval, successor, self Node)
 	return nil
 }
 
+// Replace - point every finger at the node old at replacement instead, as
+// old has left the ring
+func (ft *FingerTable) Replace(old, replacement Node) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	for i := range ft.table {
+		if ft.table[i].Successor.Addr != "" && ft.table[i].Successor.ID.Equal(old.ID) {
+			ft.table[i].Successor = replacement
+		}
+	}
+}
+
+// ClosestPreceding - the finger closest before id going around the ring
+// from self, which a lookup of id is forwarded to.  self is returned when no
+// finger lies between them, as the successor of self is then responsible
+// for id.
+func (ft *FingerTable) ClosestPreceding(self Node, id Identifier) Node {
+	selfID, nID := KeyToID(self.ID), KeyToID(id)
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+	for i := len(ft.table) - 1; i >= 0; i-- {
+		successor := ft.table[i].Successor
+		if successor.Addr == "" {
+			continue
+		}
+		if Between(KeyToID(successor.ID), selfID, nID) {
+			return successor
+		}
+	}
+	return self
+}
+
+// Fix - point fingers 2 through NumFingers of the finger table of self at
+// the nodes lookup finds responsible for the positions they start at.  The
+// first finger, the successor, is kept up to date by stabilization.
+func (ft *FingerTable) Fix(self Node, lookup func(Identifier) (Node, error)) error {
+	for i := uint64(2); i <= NumFingers; i++ {
+		start := FingerStart(self.ID, i)
+		node, err := lookup(PositionKey(start))
+		if err != nil {
+			return errors.Wrapf(err, "failed to fix finger %d: ", i)
+		}
+		interval := Interval{Low: start, High: FingerStart(self.ID, i+1)}
+		if err := ft.SetIth(i, interval, node, self); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ToString - string representation of a finger table
 func (ft *FingerTable) ToString() string {
 	ft.mu.RLock()
@@ -223,7 +744,7 @@ func (ft *FingerTable) ToString() string {
 	for _, v := range ft.table {
 		if v.Successor.Addr != "" {
 			fmtFingerTable = fmt.Sprintf("%s%d={interval={%s}, node={%s}}, ",
-				fmtFingerTable, v.I, v.Interval.ToString(), v.Successor.ToString())
+				fmtFingerTable, v.I, v.Interval.ToString(), v.Successor)
 		}
 	}
 	fmtFingerTable += "]"
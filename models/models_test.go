@@ -0,0 +1,275 @@
+package models
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdentifierFromBytes(t *testing.T) {
+	var raw = make([]byte, IdentifierLen)
+	raw[0], raw[IdentifierLen-1] = 0xab, 0xcd
+	id, err := IdentifierFromBytes(raw)
+	if err != nil {
+		t.Fatalf("IdentifierFromBytes failed: %v", err)
+	}
+	if id.String() != "ab"+strings.Repeat("00", IdentifierLen-2)+"cd" {
+		t.Errorf("String() = %s", id)
+	}
+	if !id.Equal(Identifier{0: 0xab, IdentifierLen - 1: 0xcd}) || id.Equal(Identifier{}) {
+		t.Error("Equal did not compare the identifiers")
+	}
+	if string(id.Bytes()) != string(raw) {
+		t.Error("Bytes() did not return the identifier")
+	}
+
+	// a wrong length slice must not be silently truncated or padded
+	for _, length := range []int{0, 20, IdentifierLen - 1, IdentifierLen + 1} {
+		if _, err := IdentifierFromBytes(make([]byte, length)); err == nil {
+			t.Errorf("IdentifierFromBytes of %d bytes did not fail", length)
+		}
+	}
+}
+
+func TestIdentifierEqual(t *testing.T) {
+	var a, b = Identifier{0: 1, IdentifierLen - 1: 2}, Identifier{0: 1, IdentifierLen - 1: 2}
+	if !IdentifierEqual(a, b) || bytes.Compare(a[:], b[:]) != 0 {
+		t.Error("identical identifiers are not equal")
+	}
+	for _, i := range []int{0, 10, IdentifierLen - 1} {
+		c := a
+		c[i]++
+		if IdentifierEqual(a, c) != (bytes.Compare(a[:], c[:]) == 0) {
+			t.Errorf("identifiers differing at byte %d are equal", i)
+		}
+	}
+}
+
+func TestFingerTableLookup(t *testing.T) {
+	const n = 64
+	positions := rand.New(rand.NewSource(1)).Perm(M)[:n]
+	sort.Ints(positions)
+	var (
+		nodes  = make([]Node, n)
+		tables = make(map[Identifier]*FingerTable)
+	)
+	for i, pos := range positions {
+		nodes[i] = Node{ID: PositionKey(uint64(pos)), Addr: fmt.Sprintf("node%d", i)}
+	}
+	// a stabilized ring, where every node knows just its successor
+	for i, node := range nodes {
+		tables[node.ID] = NewFingerTable()
+		successor := nodes[(i+1)%n]
+		tables[node.ID].SetIth(1, NewInterval(node, successor), successor, node)
+	}
+
+	// lookup - route a lookup of id from the node from, the way nodes
+	// forward successor requests, counting the hops taken
+	var hops int
+	lookup := func(from Node, id Identifier) Node {
+		for {
+			next := tables[from.ID].ClosestPreceding(from, id)
+			if next.ID == from.ID {
+				successor, _ := tables[from.ID].GetIth(1)
+				return successor.Successor
+			}
+			from = next
+			hops++
+		}
+	}
+	// responsible - the node responsible for the ring position pos, the
+	// first node at or after it
+	responsible := func(pos int) Node {
+		return nodes[sort.SearchInts(positions, pos)%n]
+	}
+
+	for _, node := range nodes {
+		node := node
+		if err := tables[node.ID].Fix(node, func(id Identifier) (Node, error) {
+			return lookup(node, id), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var maxHops, lookups int
+	hops = 0
+	for _, from := range nodes {
+		for pos := 0; pos < M; pos++ {
+			before := hops
+			if found := lookup(from, PositionKey(uint64(pos))); found.ID != responsible(pos).ID {
+				t.Fatalf("lookup of %d from %s found %s, expected %s",
+					pos, from.Addr, found.Addr, responsible(pos).Addr)
+			}
+			if hops-before > maxHops {
+				maxHops = hops - before
+			}
+			lookups++
+		}
+	}
+	logN := math.Log2(n)
+	if mean := float64(hops) / float64(lookups); mean > logN {
+		t.Errorf("mean hops = %.2f, expected at most log2(%d) = %.0f", mean, n, logN)
+	}
+	if float64(maxHops) > 2*logN {
+		t.Errorf("max hops = %d, expected at most 2*log2(%d) = %.0f", maxHops, n, 2*logN)
+	}
+}
+
+func TestClosestPrecedingLeavesOwnerToSuccessor(t *testing.T) {
+	self := Node{ID: PositionKey(0), Addr: "self"}
+	owner := Node{ID: PositionKey(8), Addr: "owner"}
+	ft := NewFingerTable()
+	ft.SetIth(1, NewInterval(self, owner), owner, self)
+
+	// the node at a position is responsible for it, as its successor, so a
+	// lookup of it is not forwarded there but answered with the successor
+	for pos, expected := range map[uint64]Node{7: self, 8: self, 9: owner} {
+		if next := ft.ClosestPreceding(self, PositionKey(pos)); next.ID != expected.ID {
+			t.Errorf("closest preceding %d = %s, expected %s", pos, next.Addr, expected.Addr)
+		}
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	secret := bytes.Repeat([]byte{0xab, 0xcd}, 128)
+	if got := RedactSecret(secret); got != "abcdabcd…<redacted, 256 bytes>" {
+		t.Errorf("RedactSecret() = %s", got)
+	}
+	// too short to show any of
+	if got := RedactSecret(secret[:8]); strings.Contains(got, "ab") || !strings.Contains(got, "8 bytes") {
+		t.Errorf("RedactSecret() of a short secret = %s", got)
+	}
+	if got := RedactSecret(nil); got != "<empty>" {
+		t.Errorf("RedactSecret(nil) = %s", got)
+	}
+}
+
+func TestNodeEqual(t *testing.T) {
+	key, err := rsa.GenerateKey(crand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(crand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same key, not the same pointer
+	copied := &rsa.PublicKey{N: new(big.Int).Set(key.N), E: key.E}
+
+	n := Node{Addr: "127.0.0.1:3000", PublicKey: &key.PublicKey}
+	for _, c := range []struct {
+		other Node
+		equal bool
+	}{
+		{Node{Addr: "127.0.0.1:3000", PublicKey: copied}, true},
+		{Node{Addr: "127.0.0.1:3001", PublicKey: copied}, false},
+		{Node{Addr: "127.0.0.1:3000", PublicKey: &other.PublicKey}, false},
+		{Node{Addr: "127.0.0.1:3000"}, false},
+	} {
+		if got := n.Equal(c.other); got != c.equal {
+			t.Errorf("Equal(%s) = %t, expected %t", c.other.ToString(), got, c.equal)
+		}
+	}
+	if !(Node{Addr: "a"}).Equal(Node{Addr: "a"}) {
+		t.Error("expected nodes without keys at the same address to be equal")
+	}
+
+	data, err := n.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeNode(bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(n) {
+		t.Errorf("expected the decoded node %s to equal %s", decoded.ToString(), n.ToString())
+	}
+	if _, err := DecodeNode(bytes.NewBuffer(data[:len(data)/2])); err == nil {
+		t.Error("expected a truncated node to fail to decode")
+	}
+}
+
+func TestNodeString(t *testing.T) {
+	key, err := rsa.GenerateKey(crand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "127.0.0.1:3000"
+	n := Node{ID: HashBytes([]byte(addr)), Addr: addr, PublicKey: &key.PublicKey}
+
+	s := fmt.Sprintf("%s", n)
+	if want := addr + " (id=" + n.ID.String()[:8] + ")"; s != want {
+		t.Errorf("String() = %q, expected %q", s, want)
+	}
+	if strings.Contains(s, n.ID.String()) {
+		t.Errorf("expected only a prefix of the id in %q", s)
+	}
+	for _, material := range []string{key.N.String(), key.N.Text(16), fmt.Sprint(key.PublicKey)} {
+		if strings.Contains(s, material) {
+			t.Errorf("expected no key material in %q", s)
+		}
+	}
+	if n.ToString() != s {
+		t.Errorf("ToString() = %q, expected it to match String()", n.ToString())
+	}
+}
+
+func TestTransactionEntryMetadata(t *testing.T) {
+	modified := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	tl := TransactionLog{"a.txt": TransactionEntity{
+		ResourceName: "a.txt",
+		Entries: []TransactionEntry{{
+			Operation:   UpdateOperation,
+			Timestamp:   1,
+			Size:        42,
+			ModTime:     modified,
+			ContentType: "text/plain; charset=utf-8",
+		}},
+	}}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(tl); err != nil {
+		t.Fatal(err)
+	}
+	var decoded TransactionLog
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	e := decoded["a.txt"].Entries[0]
+	if e.Size != 42 || !e.ModTime.Equal(modified) || e.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("metadata did not survive the round trip, got %d, %s, %q", e.Size, e.ModTime, e.ContentType)
+	}
+
+	// a log written before the metadata was recorded
+	type oldEntry struct {
+		Operation TransactionOperation
+		Timestamp uint64
+	}
+	type oldEntity struct {
+		ResourceName string
+		Entries      []oldEntry
+	}
+	buf.Reset()
+	old := map[string]oldEntity{"a.txt": {ResourceName: "a.txt", Entries: []oldEntry{{UpdateOperation, 7}}}}
+	if err := gob.NewEncoder(&buf).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+	decoded = nil
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatalf("failed to decode an old log: %v", err)
+	}
+	e = decoded["a.txt"].Entries[0]
+	if e.Timestamp != 7 || e.Size != 0 || !e.ModTime.IsZero() || e.ContentType != "" {
+		t.Errorf("expected an old entry decoded without metadata, got %+v", e)
+	}
+}
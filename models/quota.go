@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/pkg/errors"
+)
+
+// QuotaCharge - the bytes of resource data charged to an owner for a single
+// resource, its current copy and the archived versions retained with it
+type QuotaCharge struct {
+	Owner Identifier
+	Bytes uint64
+	// Versions - the bytes of each archived version counted in Bytes,
+	// oldest first
+	Versions []uint64
+}
+
+// archived - the bytes of the archived versions of the charge
+func (qc QuotaCharge) archived() uint64 {
+	var total uint64
+	for _, size := range qc.Versions {
+		total += size
+	}
+	return total
+}
+
+// QuotaLedger - the bytes of resource data a node stores for each owner.  A
+// resource is charged to the owner who last posted it, and the charge is
+// kept per resource so it can be credited back in full when the resource is
+// deleted or handed off, whoever removes it.
+type QuotaLedger struct {
+	Usage   map[Identifier]uint64
+	Charges map[Identifier]QuotaCharge
+}
+
+// NewQuotaLedger - an empty ledger
+func NewQuotaLedger() *QuotaLedger {
+	return &QuotaLedger{
+		Usage:   make(map[Identifier]uint64),
+		Charges: make(map[Identifier]QuotaCharge),
+	}
+}
+
+// usageWithout - the usage of owner without the charge for key
+func (ql *QuotaLedger) usageWithout(key, owner Identifier) uint64 {
+	usage := ql.Usage[owner]
+	if charge, ok := ql.Charges[key]; ok && charge.Owner == owner {
+		usage -= charge.Bytes
+	}
+	return usage
+}
+
+// Replacement - the charge to owner for key once its current copy is
+// replaced by size bytes.  With keep above zero the current copy is archived,
+// and the newest keep archived versions stay charged along with the new
+// copy, as the store prunes the rest.  Otherwise the archived versions are
+// left as they are, and stay charged.
+func (ql *QuotaLedger) Replacement(key, owner Identifier, size uint64, keep uint) QuotaCharge {
+	charge, ok := ql.Charges[key]
+	versions := append([]uint64(nil), charge.Versions...)
+	if ok && keep > 0 {
+		versions = append(versions, charge.Bytes-charge.archived())
+		if len(versions) > int(keep) {
+			versions = versions[len(versions)-int(keep):]
+		}
+	}
+	replacement := QuotaCharge{Owner: owner, Versions: versions}
+	replacement.Bytes = size + replacement.archived()
+	return replacement
+}
+
+// Archive - add an archived version of size bytes to the charge for key, as
+// the newest, such as one handed off after the current copy.  The version is
+// charged to owner if key is not charged yet.
+func (ql *QuotaLedger) Archive(key, owner Identifier, size uint64) {
+	charge, ok := ql.Charges[key]
+	if !ok {
+		charge.Owner = owner
+	}
+	charge.Versions = append(append([]uint64(nil), charge.Versions...), size)
+	charge.Bytes += size
+	ql.Charge(key, charge)
+}
+
+// Exceeds - would charging key as charge take its owner over limit,
+// replacing what key is charged now
+func (ql *QuotaLedger) Exceeds(key Identifier, charge QuotaCharge, limit uint64) bool {
+	usage := ql.usageWithout(key, charge.Owner)
+	return charge.Bytes > limit || usage > limit-charge.Bytes
+}
+
+// Charge - charge key as charge, replacing what key is charged now, which
+// may have been charged to another owner
+func (ql *QuotaLedger) Charge(key Identifier, charge QuotaCharge) {
+	ql.Release(key)
+	ql.Usage[charge.Owner] += charge.Bytes
+	ql.Charges[key] = charge
+}
+
+// Release - credit back the charge for key, returns false if key was not
+// charged
+func (ql *QuotaLedger) Release(key Identifier) bool {
+	charge, ok := ql.Charges[key]
+	if !ok {
+		return false
+	}
+	delete(ql.Charges, key)
+	if ql.Usage[charge.Owner] <= charge.Bytes {
+		delete(ql.Usage, charge.Owner)
+	} else {
+		ql.Usage[charge.Owner] -= charge.Bytes
+	}
+	return true
+}
+
+// EncodeQuotaLedger - serialize the ledger to be persisted
+func EncodeQuotaLedger(ql *QuotaLedger) ([]byte, error) {
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(ql); err != nil {
+		return nil, errors.Wrap(err, "failed to encode quota ledger: ")
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeQuotaLedger - deserialize a ledger produced by EncodeQuotaLedger
+func DecodeQuotaLedger(data []byte) (*QuotaLedger, error) {
+	var ql = NewQuotaLedger()
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(ql); err != nil {
+		return nil, errors.Wrap(err, "failed to decode quota ledger: ")
+	}
+	if ql.Usage == nil {
+		ql.Usage = make(map[Identifier]uint64)
+	}
+	if ql.Charges == nil {
+		ql.Charges = make(map[Identifier]QuotaCharge)
+	}
+	return ql, nil
+}
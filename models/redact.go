@@ -0,0 +1,23 @@
+package models
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// redactPrefixLen - the bytes of a secret RedactSecret shows, only enough to
+// tell secrets apart in the logs
+const redactPrefixLen = 4
+
+// RedactSecret - secret masked for logging, as its first few bytes in hex
+// and its length.  Secrets too short to give away a few bytes of are masked
+// completely.  Every secret or key which is logged must go through this.
+func RedactSecret(secret []byte) string {
+	if len(secret) == 0 {
+		return "<empty>"
+	}
+	if len(secret) < 4*redactPrefixLen {
+		return fmt.Sprintf("<redacted, %d bytes>", len(secret))
+	}
+	return fmt.Sprintf("%s…<redacted, %d bytes>", hex.EncodeToString(secret[:redactPrefixLen]), len(secret))
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"crypto/hmac"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResourceNameOutsideRoot - a resource name which, once cleaned, names a
+// file above the root resources are named relative to
+var ErrResourceNameOutsideRoot = errors.New("resource name is outside of the root")
+
+// NormalizeResourceName - the canonical form of a resource name, which is
+// what keys are derived from.  Backslashes are treated as separators, the
+// path is cleaned of redundant slashes and dot elements, and the leading
+// slash is stripped, so every spelling of the same file maps to one key.  A
+// name which leaves the root, such as "../etc/passwd", is refused with
+// ErrResourceNameOutsideRoot, as it would be written outside of it.
+func NormalizeResourceName(name string) (string, error) {
+	name = cleanResourceName(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", ErrResourceNameOutsideRoot
+	}
+	return name, nil
+}
+
+// cleanResourceName - name in its canonical form, which may leave the root
+func cleanResourceName(name string) string {
+	name = path.Clean(strings.Replace(name, "\\", "/", -1))
+	name = strings.TrimLeft(name, "/")
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// ResourceKeyFunc - maps the normalized name of a resource, and the secret
+// names are keyed with if any, to the key the resource is stored under, which
+// decides the node on the ring that stores it
+type ResourceKeyFunc func(name string, secret []byte) Identifier
+
+var (
+	// resourceKeyFunc - how KeyForResource places resources, hashResourceKey
+	// unless configured otherwise
+	resourceKeyFunc   ResourceKeyFunc = hashResourceKey
+	resourceKeyFuncMu                 = new(sync.RWMutex)
+)
+
+// ConfigureResourceKeys - place resources with fn rather than by the hash of
+// their names, so tests can decide which node stores which resource.  nil
+// goes back to hashing.  Every client of a ring has to place resources the
+// same way to find each other's, so this is never set outside of tests.
+func ConfigureResourceKeys(fn ResourceKeyFunc) {
+	if fn == nil {
+		fn = hashResourceKey
+	}
+	resourceKeyFuncMu.Lock()
+	defer resourceKeyFuncMu.Unlock()
+	resourceKeyFunc = fn
+}
+
+// KeyForResource - the key the named resource is stored under.  Without a
+// secret the key is the hash of the normalized name, which anyone who guesses
+// a name can compute to confirm it is stored.  With a secret the key is the
+// HMAC of the normalized name, so only holders of the secret can derive the
+// key for a name.  See ConfigureResourceKeys.
+func KeyForResource(name string, secret []byte) Identifier {
+	resourceKeyFuncMu.RLock()
+	defer resourceKeyFuncMu.RUnlock()
+	return resourceKeyFunc(cleanResourceName(name), secret)
+}
+
+// hashResourceKey - the hash, or HMAC with secret, of the normalized name
+func hashResourceKey(name string, secret []byte) Identifier {
+	if len(secret) == 0 {
+		return HashBytes([]byte(name))
+	}
+	mac := hmac.New(NewIdentifierHash, secret)
+	mac.Write([]byte(name))
+	var key Identifier
+	copy(key[:], mac.Sum(nil))
+	return key
+}
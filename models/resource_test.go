@@ -0,0 +1,54 @@
+package models
+
+import "testing"
+
+func TestNormalizeResourceName(t *testing.T) {
+	var cases = []struct {
+		name, expected string
+	}{
+		{"docs/taxes/2017.pdf", "docs/taxes/2017.pdf"},
+		{"/docs/taxes/2017.pdf", "docs/taxes/2017.pdf"},
+		{"docs\\taxes\\2017.pdf", "docs/taxes/2017.pdf"},
+		{"\\docs\\taxes\\2017.pdf", "docs/taxes/2017.pdf"},
+		{"docs\\taxes/2017.pdf", "docs/taxes/2017.pdf"},
+		{"docs//taxes///2017.pdf", "docs/taxes/2017.pdf"},
+		{"//docs/taxes/2017.pdf", "docs/taxes/2017.pdf"},
+		{"docs/taxes/", "docs/taxes"},
+		{"./docs/./taxes/../taxes/2017.pdf", "docs/taxes/2017.pdf"},
+		{"Docs/Taxes.PDF", "Docs/Taxes.PDF"},
+		{"/", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if actual, err := NormalizeResourceName(c.name); err != nil || actual != c.expected {
+			t.Errorf("NormalizeResourceName(%q) = %q, %v, expected %q", c.name, actual, err, c.expected)
+		}
+	}
+
+	for _, name := range []string{"..", "../etc/passwd", "docs/../../etc/passwd", "..\\secrets", "./../x"} {
+		if actual, err := NormalizeResourceName(name); err != ErrResourceNameOutsideRoot {
+			t.Errorf("NormalizeResourceName(%q) = %q, %v, expected it refused", name, actual, err)
+		}
+	}
+	// a leading slash is the root, so nothing is above it
+	if actual, err := NormalizeResourceName("/../docs"); err != nil || actual != "docs" {
+		t.Errorf("NormalizeResourceName(\"/../docs\") = %q, %v, expected \"docs\"", actual, err)
+	}
+}
+
+func TestKeyForResource(t *testing.T) {
+	if KeyForResource("/docs/2017.pdf", nil) != HashBytes([]byte("docs/2017.pdf")) {
+		t.Error("key without a secret is not the hash of the normalized name")
+	}
+	secret := []byte("secret")
+	keyed := KeyForResource("docs/2017.pdf", secret)
+	if keyed == KeyForResource("docs/2017.pdf", nil) {
+		t.Error("key with a secret is the same as without")
+	}
+	if keyed != KeyForResource("docs\\2017.pdf", secret) {
+		t.Error("key with a secret is not derived from the normalized name")
+	}
+	if keyed == KeyForResource("docs/2017.pdf", []byte("other")) {
+		t.Error("keys with different secrets are the same")
+	}
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCorruptTransactionLog - the transaction log data is truncated or does
+// not match its checksum, and must not be mistaken for an empty log
+var ErrCorruptTransactionLog = errors.New("transaction log is corrupt")
+
+// ErrTransactionLogTooLarge - the transaction log data decompresses past
+// MaxTransactionLogSize
+var ErrTransactionLogTooLarge = errors.New("transaction log is too large")
+
+// MaxTransactionLogSize - the most bytes a compressed transaction log is
+// decompressed to.  A log is uploaded by its user, and a few bytes of gzip
+// can decompress to far more than a node has memory for.
+const MaxTransactionLogSize = 64 << 20
+
+// maxTransactionLogSize - MaxTransactionLogSize, lowered by tests
+var maxTransactionLogSize int64 = MaxTransactionLogSize
+
+// limitedLogReader - a reader of a decompressed transaction log, failing
+// once more than n bytes have been read from r
+type limitedLogReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read - read from the log, failing with ErrTransactionLogTooLarge past the
+// limit rather than ending as if the log did
+func (l *limitedLogReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errors.Wrapf(ErrTransactionLogTooLarge,
+			"decompresses to more than %d bytes", maxTransactionLogSize)
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// gzipMagic - the first two bytes of every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// transactionLogMagic - the prefix of a version 1 transaction log, which is
+// followed by the sha256 of the compressed log and then the compressed log
+var transactionLogMagic = []byte("pstl")
+
+// versionedTransactionLogMagic - the prefix of a transaction log from version
+// 2 on, which is followed by its version byte, and then as version 1
+var versionedTransactionLogMagic = []byte("pstv")
+
+// TransactionLogVersion - the version of the encoding EncodeTransactionLog
+// writes.  It is raised whenever a change to the log would not decode as
+// before on an older peer, and DecodeTransactionLog refuses logs of later
+// versions than it rather than decoding part of them.
+const TransactionLogVersion byte = 2
+
+// ErrUnsupportedTransactionLogVersion - the transaction log was encoded by a
+// later version than this peer decodes, it needs upgrading to read it
+var ErrUnsupportedTransactionLogVersion = errors.New("transaction log version is not supported")
+
+// EncodeTransactionLog - serialize the transaction log for transfer.  The log
+// is gob encoded and then gzipped, as the repetitive resource names and ids
+// compress very well and the whole log is fetched on every sync poll.  A
+// checksum of the compressed log is stored in front of it, so a truncated or
+// damaged log is detected rather than decoded into a partial one, and in
+// front of that the TransactionLogVersion it is encoded with.
+func EncodeTransactionLog(tl TransactionLog) ([]byte, error) {
+	data, err := encodeChecksummedLog(tl)
+	if err != nil {
+		return nil, err
+	}
+	prefix := append(append([]byte{}, versionedTransactionLogMagic...), TransactionLogVersion)
+	return append(prefix, data...), nil
+}
+
+// encodeChecksummedLog - the sha256 of the gzipped gob of tl, followed by it
+func encodeChecksummedLog(tl TransactionLog) ([]byte, error) {
+	var buf = new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if err := gob.NewEncoder(zw).Encode(&tl); err != nil {
+		return nil, errors.Wrap(err, "failed to encode transaction log: ")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress transaction log: ")
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	data := make([]byte, 0, len(sum)+buf.Len())
+	data = append(data, sum[:]...)
+	return append(data, buf.Bytes()...), nil
+}
+
+// DecodeTransactionLog - deserialize a transaction log produced by
+// EncodeTransactionLog.  Returns ErrCorruptTransactionLog if the checksum does
+// not match or the log cannot be decoded, ErrTransactionLogTooLarge if it
+// decompresses past MaxTransactionLogSize, and
+// ErrUnsupportedTransactionLogVersion if it is of a later version.  Version 1
+// logs have no version byte, logs stored before the checksum was added are
+// gzipped gob, and logs stored before compression was added are plain gob,
+// all are still decoded.
+func DecodeTransactionLog(data []byte) (TransactionLog, error) {
+	if bytes.HasPrefix(data, versionedTransactionLogMagic) {
+		data = data[len(versionedTransactionLogMagic):]
+		if len(data) == 0 {
+			return TransactionLog{}, errors.Wrap(ErrCorruptTransactionLog, "version is truncated")
+		}
+		if version := data[0]; version > TransactionLogVersion {
+			return TransactionLog{}, errors.Wrapf(ErrUnsupportedTransactionLogVersion,
+				"version %d, at most %d is supported", version, TransactionLogVersion)
+		}
+		return decodeChecksummedLog(data[1:])
+	}
+	if bytes.HasPrefix(data, transactionLogMagic) {
+		return decodeChecksummedLog(data[len(transactionLogMagic):])
+	}
+	var tl = TransactionLog{}
+	if bytes.HasPrefix(data, gzipMagic) {
+		if zr, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+			defer zr.Close()
+			limited := &limitedLogReader{r: zr, n: maxTransactionLogSize}
+			err := gob.NewDecoder(limited).Decode(&tl)
+			if err == nil {
+				return tl, nil
+			}
+			if errors.Cause(err) == ErrTransactionLogTooLarge {
+				return TransactionLog{}, err
+			}
+			tl = TransactionLog{}
+		}
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tl); err != nil {
+		return TransactionLog{}, errors.Wrap(ErrCorruptTransactionLog, err.Error())
+	}
+	return tl, nil
+}
+
+// decodeChecksummedLog - deserialize a log encoded by encodeChecksummedLog
+func decodeChecksummedLog(data []byte) (TransactionLog, error) {
+	var tl = TransactionLog{}
+	if len(data) < sha256.Size {
+		return TransactionLog{}, errors.Wrap(ErrCorruptTransactionLog, "checksum is truncated")
+	}
+	sum, compressed := data[:sha256.Size], data[sha256.Size:]
+	if actual := sha256.Sum256(compressed); !bytes.Equal(sum, actual[:]) {
+		return TransactionLog{}, errors.Wrap(ErrCorruptTransactionLog, "checksum mismatch")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return TransactionLog{}, errors.Wrap(ErrCorruptTransactionLog, err.Error())
+	}
+	defer zr.Close()
+	limited := &limitedLogReader{r: zr, n: maxTransactionLogSize}
+	if err := gob.NewDecoder(limited).Decode(&tl); err != nil {
+		if errors.Cause(err) == ErrTransactionLogTooLarge {
+			return TransactionLog{}, err
+		}
+		return TransactionLog{}, errors.Wrap(ErrCorruptTransactionLog, err.Error())
+	}
+	return tl, nil
+}
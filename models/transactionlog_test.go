@@ -0,0 +1,172 @@
+package models
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDecodeTransactionLog(t *testing.T) {
+	var tl = TransactionLog{
+		"docs/taxes/2017.pdf": TransactionEntity{
+			ResourceName: "docs/taxes/2017.pdf",
+			ResourceID:   Identifier{1},
+			Entries: []TransactionEntry{
+				{Operation: UpdateOperation, ClientID: Identifier{2}, Timestamp: 7},
+			},
+		},
+	}
+	data, err := EncodeTransactionLog(tl)
+	if err != nil {
+		t.Fatalf("EncodeTransactionLog failed: %v", err)
+	}
+
+	decoded, err := DecodeTransactionLog(data)
+	if err != nil {
+		t.Fatalf("DecodeTransactionLog failed: %v", err)
+	}
+	if entity, ok := decoded["docs/taxes/2017.pdf"]; !ok || len(entity.Entries) != 1 ||
+		entity.Entries[0].Timestamp != 7 {
+		t.Errorf("decoded log %+v does not match %+v", decoded, tl)
+	}
+
+	// a log cut short anywhere, or damaged, must be reported as corrupt
+	// rather than decoded as an empty or partial log
+	for _, length := range []int{0, 2, 10, len(data) / 2, len(data) - 1} {
+		if _, err := DecodeTransactionLog(data[:length]); errors.Cause(err) != ErrCorruptTransactionLog {
+			t.Errorf("log truncated to %d of %d bytes: got %v, expected corrupt", length, len(data), err)
+		}
+	}
+	damaged := append([]byte{}, data...)
+	damaged[len(damaged)-5] ^= 0xff
+	if _, err := DecodeTransactionLog(damaged); errors.Cause(err) != ErrCorruptTransactionLog {
+		t.Errorf("damaged log: got %v, expected corrupt", err)
+	}
+}
+
+func TestDecodeTransactionLogSizeLimit(t *testing.T) {
+	defer func(max int64) { maxTransactionLogSize = max }(maxTransactionLogSize)
+	maxTransactionLogSize = 1 << 10
+
+	// a few hundred bytes of gzip, decompressing past the limit
+	name := strings.Repeat("a", 4<<10)
+	var tl = TransactionLog{name: TransactionEntity{ResourceName: name}}
+	current, err := EncodeTransactionLog(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as logs were encoded before the checksum was added
+	var gzipped = new(bytes.Buffer)
+	zw := gzip.NewWriter(gzipped)
+	if err := gob.NewEncoder(zw).Encode(&tl); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+
+	for format, data := range map[string][]byte{"current": current, "gzip": gzipped.Bytes()} {
+		if len(data) >= int(maxTransactionLogSize) {
+			t.Fatalf("%s: expected the log compressed below the limit, got %d bytes", format, len(data))
+		}
+		if _, err := DecodeTransactionLog(data); errors.Cause(err) != ErrTransactionLogTooLarge {
+			t.Errorf("%s: got %v, expected a log over the limit refused", format, err)
+		}
+	}
+}
+
+func TestDecodeTransactionLogVersions(t *testing.T) {
+	var tl = TransactionLog{
+		"notes.txt": TransactionEntity{
+			ResourceName: "notes.txt",
+			Entries: []TransactionEntry{
+				{Operation: DeleteOperation, ClientID: clientA, Timestamp: 3, Clock: VectorClock{clientA: 3}},
+			},
+		},
+	}
+	checksummed, err := encodeChecksummedLog(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := EncodeTransactionLog(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte{}, versionedTransactionLogMagic...), TransactionLogVersion); !bytes.HasPrefix(current, want) {
+		t.Fatalf("expected the log prefixed with %q, got %q", want, current[:len(want)])
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"current", current, nil},
+		// as logs were encoded before the version byte was added
+		{"v1", append(append([]byte{}, transactionLogMagic...), checksummed...), nil},
+		{"later", append(append([]byte{}, versionedTransactionLogMagic...), append([]byte{TransactionLogVersion + 1}, checksummed...)...), ErrUnsupportedTransactionLogVersion},
+		{"no version", versionedTransactionLogMagic, ErrCorruptTransactionLog},
+	}
+	for _, test := range tests {
+		decoded, err := DecodeTransactionLog(test.data)
+		if errors.Cause(err) != test.want {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.want)
+		}
+		if err != nil {
+			continue
+		}
+		if latest := decoded["notes.txt"].Latest(); len(latest) != 1 || latest[0].Operation != DeleteOperation ||
+			latest[0].Clock.Compare(VectorClock{clientA: 3}) != ClocksEqual {
+			t.Errorf("%s: decoded %+v, expected %+v", test.name, decoded, tl)
+		}
+	}
+
+	// a peer which only decodes version 1 finds the current log corrupt,
+	// rather than decoding part of it
+	if _, err := decodeChecksummedLog(current[len(transactionLogMagic):]); errors.Cause(err) != ErrCorruptTransactionLog {
+		t.Errorf("current log decoded as version 1: got %v, expected corrupt", err)
+	}
+}
+
+func TestCompactTransactionLog(t *testing.T) {
+	var (
+		entity = TransactionEntity{ResourceName: "notes.txt"}
+		clock  = VectorClock{}
+	)
+	for i := 1; i <= 10000; i++ {
+		clock = clock.Increment(clientA)
+		entity.Entries = append(entity.Entries,
+			TransactionEntry{Operation: UpdateOperation, ClientID: clientA, Timestamp: uint64(i), Clock: clock})
+	}
+	entity.Entries[len(entity.Entries)-1].Operation = DeleteOperation
+	tl := TransactionLog{"notes.txt": entity}
+
+	compacted := tl.Compact(10)
+	entries := compacted["notes.txt"].Entries
+	if len(entries) != 10 {
+		t.Fatalf("expected the history compacted to 10 entries, got %d", len(entries))
+	}
+	if len(tl["notes.txt"].Entries) != 10000 {
+		t.Errorf("expected the log compacted left alone")
+	}
+	latest := compacted["notes.txt"].Latest()
+	if len(latest) != 1 || latest[0].Operation != DeleteOperation || latest[0].Timestamp != 10000 {
+		t.Errorf("expected the latest entry kept, got %+v", latest)
+	}
+	if entries[0].Timestamp != 9991 {
+		t.Errorf("expected the most recent entries kept in order, first is %d", entries[0].Timestamp)
+	}
+	if c := compacted["notes.txt"].Clock(); c.Compare(clock) != ClocksEqual {
+		t.Errorf("expected the compacted clock %v, got %v", clock, c)
+	}
+
+	// a conflicting change older than the rest of the history is kept
+	conflict := TransactionEntry{ClientID: clientB, Timestamp: 1, Clock: VectorClock{}.Increment(clientB)}
+	entity.Entries = append(entity.Entries, conflict)
+	latest = TransactionLog{"notes.txt": entity}.Compact(1)["notes.txt"].Latest()
+	if len(latest) != 2 || !latest[1].Same(conflict) {
+		t.Errorf("expected both conflicting changes kept, got %+v", latest)
+	}
+}
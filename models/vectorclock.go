@@ -0,0 +1,83 @@
+package models
+
+// VectorClock - a count of the changes each client has made to a resource,
+// by client ID.  Unlike the lamport clock, two vector clocks tell whether one
+// change was made knowing of the other, or the two were made concurrently.
+type VectorClock map[Identifier]uint64
+
+// ClockOrdering - how the changes two vector clocks stamp are ordered
+type ClockOrdering int
+
+const (
+	// ClocksEqual - the clocks stamp the same change
+	ClocksEqual ClockOrdering = iota
+	// HappensBefore - the change happened before the other, which was made
+	// knowing of it
+	HappensBefore
+	// HappensAfter - the change was made knowing of the other
+	HappensAfter
+	// Concurrent - neither change was made knowing of the other, they
+	// conflict
+	Concurrent
+)
+
+// ClockOrderingToString - Convert from a ClockOrdering to String
+var ClockOrderingToString = map[ClockOrdering]string{
+	ClocksEqual:   "equal",
+	HappensBefore: "happens before",
+	HappensAfter:  "happens after",
+	Concurrent:    "concurrent",
+}
+
+// Copy - a copy of the clock, which can be changed without changing vc
+func (vc VectorClock) Copy() VectorClock {
+	c := make(VectorClock, len(vc))
+	for id, count := range vc {
+		c[id] = count
+	}
+	return c
+}
+
+// Increment - the clock of a change made by the client id after every change
+// vc knows of
+func (vc VectorClock) Increment(id Identifier) VectorClock {
+	c := vc.Copy()
+	c[id]++
+	return c
+}
+
+// Merge - the clock which knows of every change vc or other knows of
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	c := vc.Copy()
+	for id, count := range other {
+		if count > c[id] {
+			c[id] = count
+		}
+	}
+	return c
+}
+
+// Compare - how the change vc stamps is ordered against the change other
+// stamps
+func (vc VectorClock) Compare(other VectorClock) ClockOrdering {
+	var before, after bool
+	for id, count := range vc {
+		if count > other[id] {
+			after = true
+		}
+	}
+	for id, count := range other {
+		if count > vc[id] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return Concurrent
+	case before:
+		return HappensBefore
+	case after:
+		return HappensAfter
+	}
+	return ClocksEqual
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+var (
+	clientA = Identifier{0: 0xa}
+	clientB = Identifier{0: 0xb}
+)
+
+func TestVectorClockHappensBefore(t *testing.T) {
+	// a edits, b syncs a's edit and edits after it
+	a := VectorClock{}.Increment(clientA)
+	b := a.Increment(clientB)
+	if got := a.Compare(b); got != HappensBefore {
+		t.Errorf("a.Compare(b) = %s, expected happens before", ClockOrderingToString[got])
+	}
+	if got := a.Compare(a.Copy()); got != ClocksEqual {
+		t.Errorf("a.Compare(a) = %s, expected equal", ClockOrderingToString[got])
+	}
+	if a[clientB] != 0 {
+		t.Error("Increment changed the clock it was called on")
+	}
+}
+
+func TestVectorClockHappensAfter(t *testing.T) {
+	// a edits twice in a row, b only saw the first
+	first := VectorClock{}.Increment(clientA)
+	second := first.Increment(clientA)
+	if got := second.Compare(first); got != HappensAfter {
+		t.Errorf("second.Compare(first) = %s, expected happens after", ClockOrderingToString[got])
+	}
+}
+
+func TestVectorClockConcurrent(t *testing.T) {
+	// a and b both edit after syncing the same change, neither seeing the
+	// other's edit
+	base := VectorClock{}.Increment(clientA)
+	a := base.Increment(clientA)
+	b := base.Increment(clientB)
+	if got := a.Compare(b); got != Concurrent {
+		t.Errorf("a.Compare(b) = %s, expected concurrent", ClockOrderingToString[got])
+	}
+	if got := b.Compare(a); got != Concurrent {
+		t.Errorf("b.Compare(a) = %s, expected concurrent", ClockOrderingToString[got])
+	}
+
+	// an edit made knowing of both resolves the conflict
+	resolved := a.Merge(b).Increment(clientB)
+	for _, c := range []VectorClock{a, b} {
+		if got := c.Compare(resolved); got != HappensBefore {
+			t.Errorf("Compare(resolved) = %s, expected happens before", ClockOrderingToString[got])
+		}
+	}
+}
+
+func TestTransactionEntityLatest(t *testing.T) {
+	base := VectorClock{}.Increment(clientA)
+	entity := TransactionEntity{
+		Entries: []TransactionEntry{
+			{ClientID: clientA, Timestamp: 1, Clock: base},
+			{ClientID: clientA, Timestamp: 2, Clock: base.Increment(clientA)},
+		},
+	}
+	if latest := entity.Latest(); len(latest) != 1 || latest[0].Timestamp != 2 {
+		t.Errorf("Latest() = %+v, expected the second entry", latest)
+	}
+
+	// b edits concurrently, with a lower timestamp, the edits conflict
+	entity.Entries = append(entity.Entries,
+		TransactionEntry{ClientID: clientB, Timestamp: 1, Clock: base.Increment(clientB)})
+	if latest := entity.Latest(); len(latest) != 2 {
+		t.Errorf("Latest() = %+v, expected both concurrent entries", latest)
+	}
+
+	// entries without clocks fall back to timestamps
+	legacy := TransactionEntity{
+		Entries: []TransactionEntry{{Timestamp: 3}, {Timestamp: 5}, {Timestamp: 4}},
+	}
+	if latest := legacy.Latest(); len(latest) != 1 || latest[0].Timestamp != 5 {
+		t.Errorf("Latest() = %+v, expected the highest timestamp", latest)
+	}
+}
+
+func TestVectorClockGob(t *testing.T) {
+	entry := TransactionEntry{Clock: VectorClock{clientA: 2, clientB: 1}}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		t.Fatal(err)
+	}
+	var decoded TransactionEntry
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Clock.Compare(entry.Clock) != ClocksEqual {
+		t.Errorf("decoded clock %v, expected %v", decoded.Clock, entry.Clock)
+	}
+}
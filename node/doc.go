@@ -0,0 +1,4 @@
+// Package node sets up a peerstore storage node, the server, its chord
+// node and the handler routes, so it can run standalone or be embedded
+//
+package node
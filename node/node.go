@@ -0,0 +1,329 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/chord"
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Config - the configuration of a storage node
+type Config struct {
+	// ListenAddr - the address the node binds to
+	ListenAddr string
+	// AdvertiseAddr - the address peers reach the node at, defaults to
+	// ListenAddr
+	AdvertiseAddr string
+	// DataPath - where the node stores resources and its keypair
+	DataPath string
+	// Peer - a known node of the ring to join, the zero value starts a new
+	// ring
+	Peer               models.Node
+	RequestQueueBuffer uint
+	RequestNumWorkers  uint
+	KeepVersions       uint
+	// ShardDepth - the levels of subdirectories of DataPath resources are
+	// stored in, zero stores them in DataPath itself
+	ShardDepth int
+	// MinFreeSpace - the bytes of disk space to keep free, posts which would
+	// leave less are rejected, zero disables the check
+	MinFreeSpace uint64
+	// MaxBytesPerUser - the bytes of resource data stored for each owner,
+	// posts which would store more are rejected, zero disables quotas
+	MaxBytesPerUser uint64
+	// ReadCacheSize - the bytes of recently read resources kept in memory,
+	// zero disables the read cache
+	ReadCacheSize uint64
+	// MaxRequestSize - the largest request the node reads, zero is
+	// protocol.DefaultMaxRequestSize
+	MaxRequestSize uint64
+	RingSettings   models.RingSettings
+	// TLSConfig - when set, the node accepts connections over TLS with it
+	TLSConfig *tls.Config
+	// PostFilter - when set, run against the data of every post, a post it
+	// rejects is refused with a PolicyViolation status
+	PostFilter file.PostFilter
+	// Admins - the users allowed the admin methods such as rebalance
+	Admins []models.Identifier
+}
+
+// Node - a running storage node
+type Node struct {
+	Server *protocol.Server
+	Local  *chord.LocalNode
+}
+
+// LoadOrCreateKey - read the node's keypair from dataPath, generating and
+// saving a new one the first time the node is started.  A node which cannot
+// save its key fails to start, rather than coming back as another node.
+func LoadOrCreateKey(dataPath string) (*rsa.PrivateKey, error) {
+	privateKeyPath := fmt.Sprintf("%s/privatekey.pem", dataPath)
+	privateKeyFile, err := os.Open(privateKeyPath)
+	if err == nil {
+		defer privateKeyFile.Close()
+		key, err := crypto.ReadKeypairAsPem(privateKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read keypair: ")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		// the key is there, but could not be opened
+		return nil, errors.Wrap(err, "failed to open keypair file: ")
+	}
+
+	// generate our public key
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate keypair: ")
+	}
+	// create our keypair file:
+	if err := writeKeyFile(privateKeyPath, 0600, func(w io.Writer) error {
+		return crypto.WritePrivateKeyAsPem(w, key)
+	}); err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(fmt.Sprintf("%s/publickey.pem", dataPath), 0644, func(w io.Writer) error {
+		return crypto.WritePublicKeyAsPem(w, key.Public().(*rsa.PublicKey))
+	}); err != nil {
+		// the private key alone would be loaded as it is on the next start
+		os.Remove(privateKeyPath)
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeKeyFile - create the key file at path with what write writes to it,
+// removing it again if it could not be written in full
+func writeKeyFile(path string, perm os.FileMode, write func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Wrap(err, "failed to create keypair file: ")
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return errors.Wrap(err, "failed to write keypair file: ")
+	}
+	return nil
+}
+
+// Start - create the node's server, register with the peer if there is one,
+// join the ring and route every request method to its handler.  The node
+// stabilizes in the background, and serves requests once Serve is called.
+func Start(cfg Config, key *rsa.PrivateKey) (*Node, error) {
+	if cfg.AdvertiseAddr == "" {
+		cfg.AdvertiseAddr = cfg.ListenAddr
+	}
+	// move anything stored at another depth before it is looked for
+	if err := file.ConfigureSharding(cfg.DataPath, cfg.ShardDepth); err != nil {
+		return nil, errors.Wrap(err, "failed to shard data path: ")
+	}
+	file.ConfigureReadCache(cfg.DataPath, cfg.ReadCacheSize)
+
+	// create a server to listen on
+	server, err := protocol.NewServer(
+		key, cfg.Peer, cfg.ListenAddr, cfg.AdvertiseAddr, cfg.DataPath,
+		cfg.RequestQueueBuffer, cfg.RequestNumWorkers)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new server: ")
+	}
+	server.WithValue(models.KeepVersionsContextKey, cfg.KeepVersions)
+	server.WithValue(models.MinFreeSpaceContextKey, cfg.MinFreeSpace)
+	server.WithValue(models.MaxBytesPerUserContextKey, cfg.MaxBytesPerUser)
+	server.WithValue(models.RingSettingsContextKey, cfg.RingSettings)
+	server.WithValue(models.AdminsContextKey, cfg.Admins)
+	if cfg.PostFilter != nil {
+		server.WithValue(models.PostFilterContextKey, cfg.PostFilter)
+	}
+	server.SetMaxRequestSize(cfg.MaxRequestSize)
+	if cfg.TLSConfig != nil {
+		server.SetTLSConfig(cfg.TLSConfig)
+	}
+
+	if cfg.Peer.Addr != "" {
+		if err := register(server, key, cfg.Peer, cfg.AdvertiseAddr, cfg.RingSettings); err != nil {
+			return nil, err
+		}
+	}
+
+	// create our local chord node, joining the ring of the peer if there is
+	// one.  A node which failed to join would run as a ring of its own,
+	// apart from the one it was started to be part of.
+	localNode, err := chord.NewLocalNode(server, cfg.AdvertiseAddr, cfg.DataPath, cfg.Peer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create chord local node: ")
+	}
+	glog.Infof("local node: addr=%s, id=%s", localNode.Addr, localNode.ID.String())
+
+	// Start stabilizing!
+	go func() {
+		for {
+			select {
+			case <-time.After(10 * time.Second):
+				localNode.Stabilize()
+				localNode.FixFingers()
+				localNode.UpdateSuccessorList()
+				// TODO: use quit chan to stop stabilization
+			}
+		}
+	}()
+
+	// remove the data staged for uploads abandoned part way, now and every
+	// hour from then on
+	go func() {
+		for {
+			if _, err := file.ExpireUploads(cfg.DataPath, file.StaleUploadAge); err != nil {
+				glog.Warning(err)
+			}
+			<-time.After(time.Hour)
+		}
+	}()
+
+	server.WithValue(models.ReplicateFunctionContextKey, localNode.Replicate)
+	RegisterHandlers(server, localNode)
+
+	return &Node{
+		Server: server,
+		Local:  localNode,
+	}, nil
+}
+
+// Serve - serve requests until quit is signaled, done is signaled once the
+// node has stopped
+func (n *Node) Serve(quit, done chan bool) {
+	n.Server.Serve(quit, done)
+}
+
+// RegisterHandlers - route every request method a storage node serves to
+// its handler
+func RegisterHandlers(server *protocol.Server, localNode *chord.LocalNode) {
+	// file handler routes
+	server.Handle(protocol.GetFileMethod, file.GetFileHandler)
+	server.Handle(protocol.BatchGetMethod, file.BatchGetHandler)
+	server.Handle(protocol.GetOwnersMethod, file.GetOwnersHandler)
+	server.Handle(protocol.PostFileMethod, file.PostFileHandler)
+	server.Handle(protocol.GetPublicKeyMethod, file.GetPublicKeyHandler)
+	server.Handle(protocol.PostPublicKeyMethod, file.PostPublicKeyHandler)
+	server.Handle(protocol.DeleteFileMethod, file.DeleteFileHandler)
+	server.Handle(protocol.ListFilesMethod, file.ListFilesHandler)
+	server.Handle(protocol.RevokeShareMethod, file.RevokeShareHandler)
+	server.Handle(protocol.TransferOwnershipMethod, file.TransferOwnershipHandler)
+	server.Handle(protocol.GetTransactionLogMethod, file.GetTransactionLogHandler)
+	server.Handle(protocol.PutTransactionLogMethod, file.PutTransactionLogHandler)
+	// chord handler routes
+	server.Handle(protocol.GetSuccessorMethod, localNode.SuccessorHandler)
+	server.Handle(protocol.SetPredecessorMethod, localNode.SetPredecessorHandler)
+	server.Handle(protocol.GetPredecessorMethod, localNode.GetPredecessorHandler)
+	server.Handle(protocol.GetImmediateSuccessorMethod, localNode.ImmediateSuccessorHandler)
+	server.Handle(protocol.GetFingerTableMethod, localNode.FingerTableHandler)
+	server.Handle(protocol.RebalanceMethod, localNode.RebalanceHandler)
+	server.Handle(protocol.TransferKeyMethod, file.TransferKeyHandler)
+	server.Handle(protocol.DrainMethod, localNode.DrainHandler)
+	server.Handle(protocol.GetSuccessorListMethod, localNode.SuccessorListHandler)
+	server.Handle(protocol.ReplicateKeyMethod, file.ReplicateKeyHandler)
+	server.Handle(protocol.NodeJoinMethod, localNode.NodeJoinHandler)
+	server.Handle(protocol.NodeLeaveMethod, localNode.NodeLeaveHandler)
+	server.Handle(protocol.StatsMethod, localNode.StatsHandler)
+	// registration route
+	server.Handle(protocol.UserRegistrationMethod, server.UserRegistrationHandler)
+	// node registration route
+	server.Handle(protocol.NodeRegistrationMethod, server.NodeRegistrationHandler)
+	server.Handle(protocol.NodeTrustMethod, server.NodeTrustHandler)
+	// health check route
+	server.Handle(protocol.PingMethod, server.PingHandler)
+	server.Handle(protocol.ReadyMethod, localNode.ReadyHandler)
+}
+
+// register - register the node with its peer, which needs to happen before
+// the peer will trust any of its requests
+func register(server *protocol.Server, key *rsa.PrivateKey, peer models.Node, advertiseAddr string, settings models.RingSettings) error {
+	// send our ring settings along with the registration so the peer
+	// can warn about a mismatch
+	var settingsBuf = new(bytes.Buffer)
+	if err := gob.NewEncoder(settingsBuf).Encode(settings); err != nil {
+		return errors.Wrap(err, "failed to encode ring settings: ")
+	}
+	id := models.HashBytes([]byte(advertiseAddr))
+	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to register trust with peer node: ")
+	}
+	defer t.Close()
+	resp, err := t.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:       id,
+			FromAddr:   advertiseAddr,
+			Type:       protocol.NodeType,
+			PubKey:     key.Public().(*rsa.PublicKey),
+			DataLength: uint64(settingsBuf.Len()),
+		},
+		Method: protocol.NodeRegistrationMethod,
+		Data:   settingsBuf.Bytes(),
+	})
+	if err != nil {
+		// failed to register with peer node
+		return errors.Wrap(err, "failed to register trust with peer node: ")
+	}
+	glog.V(protocol.DebugLogLevel).Infof("response from registration: %v", resp)
+	var nrr protocol.NodeRegistrationResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&nrr); err != nil {
+		glog.Infof("failed to decode registration response: %v", err)
+	} else if !nrr.Settings.Equal(settings) {
+		glog.Warningf("peer %s advertises ring settings {%s}, ours are {%s}, replicas will be placed inconsistently",
+			peer.Addr, nrr.Settings.ToString(), settings.ToString())
+	}
+	// the peer vouches for the rest of the ring to us, and for us to the
+	// rest of the ring, so nodes which did not register with each other
+	// still trust each other's requests
+	for _, n := range nrr.Nodes {
+		if n.Addr == "" || n.ID.Equal(id) || n.Addr == advertiseAddr {
+			continue
+		}
+		server.TrustNode(n)
+		if err := trust(key, n, id, advertiseAddr, nrr); err != nil {
+			glog.Warningf("failed to be vouched for to %s: %v", n.Addr, err)
+		}
+	}
+	return nil
+}
+
+// trust - have node n trust us, on the strength of the signature of our key
+// in the registration response nrr of a node it trusts
+func trust(key *rsa.PrivateKey, n models.Node, id models.Identifier, advertiseAddr string, nrr protocol.NodeRegistrationResponse) error {
+	t, err := protocol.NewTransport("tcp", n.Addr, protocol.NodeType, id, n.PublicKey, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to create transport: ")
+	}
+	defer t.Close()
+	resp, err := t.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:      id,
+			FromAddr:  advertiseAddr,
+			Type:      protocol.NodeType,
+			PubKey:    key.Public().(*rsa.PublicKey),
+			SignedBy:  nrr.SignedBy,
+			Signature: nrr.Signature,
+		},
+		Method: protocol.NodeTrustMethod,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed round trip: ")
+	}
+	return resp.Err()
+}
@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// ErrCircuitOpen - returned when a peer has failed too many times in a row
+// and we are failing fast instead of dialing it
+var ErrCircuitOpen = errors.New("circuit open for peer, failing fast")
+
+// BreakerState - the state of a per peer circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed - the peer is healthy, requests flow normally
+	BreakerClosed BreakerState = iota
+	// BreakerOpen - the peer has failed too often, requests fail fast
+	BreakerOpen
+	// BreakerHalfOpen - the cooldown has passed, a single probe is allowed
+	BreakerHalfOpen
+)
+
+// BreakerStateToString - Convert from a BreakerState to String
+var BreakerStateToString = map[BreakerState]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half-open",
+}
+
+// BreakerConfig - the thresholds for the per peer circuit breakers
+type BreakerConfig struct {
+	// FailureThreshold - the number of consecutive failures before the
+	// breaker opens, zero disables circuit breaking
+	FailureThreshold int
+	// Cooldown - how long an open breaker fails fast before a probe is
+	// allowed through to the peer
+	Cooldown time.Duration
+}
+
+// DefaultBreakerConfig - the breaker configuration used unless configured
+var DefaultBreakerConfig = BreakerConfig{
+	FailureThreshold: 5,
+	Cooldown:         30 * time.Second,
+}
+
+// BreakerStats - the current state of a single peer's breaker
+type BreakerStats struct {
+	Addr                string
+	State               BreakerState
+	ConsecutiveFailures int
+	OpenedAt            time.Time
+}
+
+type peerBreaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probedAt - when the probe of a half-open breaker was let through
+	probedAt time.Time
+}
+
+// BreakerSet - a set of circuit breakers, one per peer address
+type BreakerSet struct {
+	config BreakerConfig
+	peers  map[string]*peerBreaker
+	mu     *sync.Mutex
+}
+
+// NewBreakerSet - create a new set of per peer circuit breakers
+func NewBreakerSet(config BreakerConfig) *BreakerSet {
+	return &BreakerSet{
+		config: config,
+		peers:  make(map[string]*peerBreaker),
+		mu:     new(sync.Mutex),
+	}
+}
+
+// Breakers - the breakers consulted by every transport when dialing a peer
+var Breakers = NewBreakerSet(DefaultBreakerConfig)
+
+// ConfigureBreakers - replace the breaker configuration, resetting the state
+// of every peer
+func ConfigureBreakers(config BreakerConfig) {
+	Breakers.mu.Lock()
+	defer Breakers.mu.Unlock()
+	Breakers.config = config
+	Breakers.peers = make(map[string]*peerBreaker)
+}
+
+// Allow - check if we should attempt to contact the peer at addr, returns
+// ErrCircuitOpen if the breaker for that peer is open
+func (bs *BreakerSet) Allow(addr string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.config.FailureThreshold <= 0 {
+		return nil
+	}
+	pb, ok := bs.peers[addr]
+	if !ok {
+		return nil
+	}
+	switch pb.state {
+	case BreakerOpen:
+		if time.Since(pb.openedAt) < bs.config.Cooldown {
+			return ErrCircuitOpen
+		}
+		// cooldown has passed, allow one probe through
+		glog.Infof("breaker for %s is half-open, probing", addr)
+		pb.state = BreakerHalfOpen
+		pb.probedAt = time.Now()
+		return nil
+	case BreakerHalfOpen:
+		// a probe is already in flight, unless it never reported back, as
+		// when its transport was closed without a round trip, in which case
+		// another is let through once it has had a cooldown to do so
+		if time.Since(pb.probedAt) < bs.config.Cooldown {
+			return ErrCircuitOpen
+		}
+		glog.Infof("probe of %s never completed, probing again", addr)
+		pb.probedAt = time.Now()
+		return nil
+	}
+	return nil
+}
+
+// Success - record a successful exchange with the peer, closing its breaker
+func (bs *BreakerSet) Success(addr string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if pb, ok := bs.peers[addr]; ok {
+		if pb.state != BreakerClosed {
+			glog.Infof("breaker for %s is closed", addr)
+		}
+		delete(bs.peers, addr)
+	}
+}
+
+// Failure - record a failed exchange with the peer, opening its breaker once
+// the failure threshold is reached
+func (bs *BreakerSet) Failure(addr string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.config.FailureThreshold <= 0 {
+		return
+	}
+	pb, ok := bs.peers[addr]
+	if !ok {
+		pb = &peerBreaker{}
+		bs.peers[addr] = pb
+	}
+	pb.failures++
+	if pb.state == BreakerHalfOpen || pb.failures >= bs.config.FailureThreshold {
+		if pb.state != BreakerOpen {
+			glog.Infof("breaker for %s is open after %d failures", addr, pb.failures)
+		}
+		pb.state = BreakerOpen
+		pb.openedAt = time.Now()
+	}
+}
+
+// Stats - the state of every peer which has recently failed
+func (bs *BreakerSet) Stats() []BreakerStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	stats := []BreakerStats{}
+	for addr, pb := range bs.peers {
+		stats = append(stats, BreakerStats{
+			Addr:                addr,
+			State:               pb.state,
+			ConsecutiveFailures: pb.failures,
+			OpenedAt:            pb.openedAt,
+		})
+	}
+	return stats
+}
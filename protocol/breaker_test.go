@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerSet(t *testing.T) {
+	const addr = "peer:3000"
+	cooldown := 50 * time.Millisecond
+	bs := NewBreakerSet(BreakerConfig{FailureThreshold: 2, Cooldown: cooldown})
+
+	state := func() BreakerState {
+		for _, stat := range bs.Stats() {
+			if stat.Addr == addr {
+				return stat.State
+			}
+		}
+		return BreakerClosed
+	}
+
+	bs.Failure(addr)
+	if err := bs.Allow(addr); err != nil {
+		t.Fatalf("expected a peer under the threshold allowed, got %v", err)
+	}
+	bs.Failure(addr)
+	if err := bs.Allow(addr); err != ErrCircuitOpen {
+		t.Fatalf("expected a peer at the threshold failed fast, got %v", err)
+	}
+
+	time.Sleep(cooldown)
+	if err := bs.Allow(addr); err != nil {
+		t.Fatalf("expected a probe allowed after the cooldown, got %v", err)
+	}
+	if state() != BreakerHalfOpen {
+		t.Errorf("breaker is %s while probing", BreakerStateToString[state()])
+	}
+	if err := bs.Allow(addr); err != ErrCircuitOpen {
+		t.Errorf("expected a second request failed fast during the probe, got %v", err)
+	}
+
+	// the probe is abandoned without reporting, as when its transport is
+	// closed without a round trip, so another is let through in time
+	time.Sleep(cooldown)
+	if err := bs.Allow(addr); err != nil {
+		t.Fatalf("expected another probe allowed after an abandoned one, got %v", err)
+	}
+	bs.Failure(addr)
+	if state() != BreakerOpen {
+		t.Errorf("breaker is %s after a failed probe", BreakerStateToString[state()])
+	}
+
+	time.Sleep(cooldown)
+	if err := bs.Allow(addr); err != nil {
+		t.Fatalf("expected a probe allowed after the cooldown, got %v", err)
+	}
+	bs.Success(addr)
+	if len(bs.Stats()) != 0 {
+		t.Errorf("expected no breakers after a successful probe, got %+v", bs.Stats())
+	}
+	if err := bs.Allow(addr); err != nil {
+		t.Errorf("expected a closed breaker to allow requests, got %v", err)
+	}
+}
+
+func TestBreakerSetDisabled(t *testing.T) {
+	bs := NewBreakerSet(BreakerConfig{})
+	for i := 0; i < 10; i++ {
+		bs.Failure("peer:3000")
+	}
+	if err := bs.Allow("peer:3000"); err != nil {
+		t.Errorf("expected a disabled breaker to allow requests, got %v", err)
+	}
+}
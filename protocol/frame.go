@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// frameHeaderLen - the length of the big endian length in front of every
+// message on a connection
+const frameHeaderLen = 8
+
+// frameEncoder - gob encodes each message on its own, and writes it as a
+// frame, its length followed by the message, so the reader knows exactly
+// how much to read for it however the connection splits it
+type frameEncoder struct {
+	w io.Writer
+}
+
+func newFrameEncoder(w io.Writer) *frameEncoder {
+	return &frameEncoder{w: w}
+}
+
+// Encode - write v to the connection as a single frame
+func (e *frameEncoder) Encode(v interface{}) error {
+	var buf = bytes.NewBuffer(make([]byte, frameHeaderLen))
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return errors.Wrap(err, "failed to encode message")
+	}
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint64(frame, uint64(len(frame)-frameHeaderLen))
+	_, err := e.w.Write(frame)
+	return err
+}
+
+// maxFrameLen - the longest frame which can be allocated, whatever the limit
+const maxFrameLen = uint64(int(^uint(0) >> 1))
+
+// frameDecoder - reads the frames a frameEncoder writes, failing on a frame
+// longer than max as soon as its length is read, before room is allocated
+// for it
+type frameDecoder struct {
+	r   io.Reader
+	max uint64
+	// tooLarge - what a frame longer than max fails with
+	tooLarge error
+}
+
+// newFrameDecoder - a decoder of requests read from r, of at most max
+// bytes, zero being any length which can be allocated
+func newFrameDecoder(r io.Reader, max uint64) *frameDecoder {
+	return &frameDecoder{r: r, max: max, tooLarge: ErrRequestTooLarge}
+}
+
+// newResponseDecoder - a decoder of responses read from r, of at most
+// MaxResponseSize bytes
+func newResponseDecoder(r io.Reader) *frameDecoder {
+	return &frameDecoder{r: r, max: MaxResponseSize(), tooLarge: ErrResponseTooLarge}
+}
+
+// Decode - read exactly one frame from the connection, and decode the
+// message within it into v
+func (d *frameDecoder) Decode(v interface{}) error {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint64(header[:])
+	max := d.max
+	if max == 0 || max > maxFrameLen {
+		max = maxFrameLen
+	}
+	if length > max {
+		return errors.Wrapf(d.tooLarge, "%d bytes, at most %d are accepted", length, max)
+	}
+	var frame = make([]byte, length)
+	if _, err := io.ReadFull(d.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(frame)).Decode(v)
+}
@@ -0,0 +1,171 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// trickleConn - a connection which delivers at most 3 bytes a read, so every
+// frame is split across many of them
+type trickleConn struct {
+	net.Conn
+}
+
+func (c trickleConn) Read(p []byte) (int, error) {
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return c.Conn.Read(p)
+}
+
+// trickleReader - as trickleConn, for a reader
+type trickleReader struct {
+	r io.Reader
+}
+
+func (t trickleReader) Read(p []byte) (int, error) {
+	if len(p) > 3 {
+		p = p[:3]
+	}
+	return t.r.Read(p)
+}
+
+func TestFrameSplitReads(t *testing.T) {
+	var (
+		buf      = new(bytes.Buffer)
+		enc      = newFrameEncoder(buf)
+		requests = []Request{
+			{Header: Header{Key: models.Identifier{1}, DataLength: 5}, Method: PostFileMethod, Data: []byte("first")},
+			{Header: Header{Key: models.Identifier{2}}, Method: GetFileMethod},
+		}
+	)
+	// written back to back, as pipelined requests would be
+	for _, r := range requests {
+		if err := enc.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := append([]byte{}, buf.Bytes()...)
+
+	dec := newFrameDecoder(trickleReader{buf}, 0)
+	for i, want := range requests {
+		var got Request
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Method != want.Method || got.Header.Key != want.Header.Key || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("frame %d decoded as %+v, expected %+v", i, got, want)
+		}
+	}
+	if err := dec.Decode(new(Request)); err != io.EOF {
+		t.Errorf("expected EOF after the last frame, got %v", err)
+	}
+
+	// a frame cut short is not decoded as a shorter message
+	for _, length := range []int{3, frameHeaderLen + 10} {
+		err := newFrameDecoder(trickleReader{bytes.NewReader(frames[:length])}, 0).Decode(new(Request))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("frame cut to %d bytes: got %v, expected unexpected EOF", length, err)
+		}
+	}
+	// and one longer than the limit is refused before it is read
+	if err := newFrameDecoder(bytes.NewReader(frames), 10).Decode(new(Request)); errors.Cause(err) != ErrRequestTooLarge {
+		t.Errorf("frame over the limit: got %v, expected %v", err, ErrRequestTooLarge)
+	}
+}
+
+func TestRoundTripSplitReads(t *testing.T) {
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("split"), 1000)
+
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		dec, enc := newFrameDecoder(trickleConn{server}, 0), newFrameEncoder(server)
+		for {
+			if err := dec.Decode(new(EncryptedMessage)); err != nil {
+				return
+			}
+			response := Response{Status: Success, Data: data}
+			response.setChecksum()
+			encryptAndEncode(enc, response, NodeType, &clientKey.PublicKey, models.Identifier{}, serverKey)
+		}
+	}()
+
+	tr, err := dialTransport("pipe", UserType, models.Identifier{}, &serverKey.PublicKey, clientKey, func() (net.Conn, error) {
+		return trickleConn{client}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	// the connection is kept between round trips, so each frame has to end
+	// exactly where the next begins
+	for i := 0; i < 3; i++ {
+		resp, err := tr.RoundTrip(&Request{Method: PingMethod})
+		if err != nil {
+			t.Fatalf("round trip %d: %v", i, err)
+		}
+		if !bytes.Equal(resp.Data, data) {
+			t.Errorf("round trip %d: got %d bytes, expected %d", i, len(resp.Data), len(data))
+		}
+	}
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetMaxResponseSize(4 << 10)
+	defer SetMaxResponseSize(0)
+
+	// a node answering with a response larger than the transport accepts
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		dec, enc := newFrameDecoder(server, 0), newFrameEncoder(server)
+		if err := dec.Decode(new(EncryptedMessage)); err != nil {
+			return
+		}
+		response := Response{Status: Success, Data: bytes.Repeat([]byte("large"), 4<<10)}
+		response.setChecksum()
+		encryptAndEncode(enc, response, NodeType, &clientKey.PublicKey, models.Identifier{}, serverKey)
+	}()
+	tr, err := dialTransport("pipe", UserType, models.Identifier{}, &serverKey.PublicKey, clientKey, func() (net.Conn, error) {
+		return client, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if _, err := tr.RoundTrip(&Request{Method: PingMethod}); errors.Cause(err) != ErrResponseTooLarge {
+		t.Errorf("expected the response refused as too large, got %v", err)
+	}
+
+	// a length which could never be allocated is refused whatever the limit
+	var header [frameHeaderLen]byte
+	for i := range header {
+		header[i] = 0xff
+	}
+	if err := newFrameDecoder(bytes.NewReader(header[:]), 0).Decode(new(Request)); errors.Cause(err) != ErrRequestTooLarge {
+		t.Errorf("frame longer than can be allocated: got %v, expected %v", err, ErrRequestTooLarge)
+	}
+}
@@ -18,10 +18,30 @@ func init() {
 // Handler - This is what a server handler signature should be
 type Handler = func(ctx context.Context, r *Request) Response
 
+// NodeRegistrationResponse - the response to a node registration, Settings
+// are the ring settings of the node registered with
 type NodeRegistrationResponse struct {
 	Signature []byte
 	SignedBy  models.Identifier
 	Nodes     []models.Node
+	Settings  models.RingSettings
+}
+
+// checkRingSettings - the registering node sends its ring settings as the
+// request data, warn if they differ from ours
+func (s *Server) checkRingSettings(r *Request) {
+	if len(r.Data) == 0 {
+		return
+	}
+	var theirs models.RingSettings
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(&theirs); err != nil {
+		glog.Infof("failed to decode ring settings of registering node: %s", err)
+		return
+	}
+	if ours := s.RingSettings(); !ours.Equal(theirs) {
+		glog.Warningf("node %s advertises ring settings {%s}, ours are {%s}, replicas will be placed inconsistently",
+			r.Header.FromAddr, theirs.ToString(), ours.ToString())
+	}
 }
 
 // NodeRegistrationHandler - this handler handles all node registrations.  A node
@@ -33,16 +53,15 @@ func (s *Server) NodeRegistrationHandler(ctx context.Context, r *Request) Respon
 	// add requested node to trustedNodes list
 	if _, err := s.getTrustedNode(r.Header.From); err == nil {
 		// we already have this node, response should error
-		return Response{
-			Status: Error,
-		}
+		return ErrorResponse(ConflictCode, "node is already registered")
 	}
 	node := models.Node{
 		ID:        r.Header.From,
 		Addr:      r.Header.FromAddr,
 		PublicKey: r.Header.PubKey,
 	}
-	glog.Infof("adding this node to trustedNode: %s", node.ToString())
+	glog.Infof("adding this node to trustedNode: %s", node)
+	s.checkRingSettings(r)
 	// we do not have this node, so we should add it
 	s.addTrustedNode(node)
 	// sign the requested node's public key with our private key
@@ -53,15 +72,14 @@ func (s *Server) NodeRegistrationHandler(ctx context.Context, r *Request) Respon
 	signature, err := crypto.Sign(s.PrivateKey, buf.Bytes())
 	if err != nil {
 		glog.Infof("failed to sign signature: %s", err)
-		return Response{
-			Status: Error,
-		}
+		return ErrorResponse(InternalErrorCode, "failed to sign node key")
 	}
 
 	nrr := NodeRegistrationResponse{
 		Signature: signature,
 		SignedBy:  s.id,
 		Nodes:     s.getAllTrustedNodes(),
+		Settings:  s.RingSettings(),
 	}
 
 	buf = bytes.NewBuffer([]byte{})
@@ -88,12 +106,9 @@ func (s *Server) NodeTrustHandler(ctx context.Context, r *Request) Response {
 	// validate invite
 	// add requested node to trustedNodes list
 	signer, err := s.getTrustedNode(r.Header.SignedBy)
-	if err == nil {
-		// we already have this node, response should error
+	if err != nil {
 		glog.Infof("signer node is not trusted")
-		return Response{
-			Status: Error,
-		}
+		return ErrorResponse(UnauthorizedCode, "signer is not trusted")
 	}
 
 	buf := bytes.NewBuffer([]byte{})
@@ -102,9 +117,7 @@ func (s *Server) NodeTrustHandler(ctx context.Context, r *Request) Response {
 
 	if err := crypto.Verify(signer.PublicKey, r.Header.Signature, buf.Bytes()); err != nil {
 		glog.Infof("failed to verify signature of signer: %s", err)
-		return Response{
-			Status: Error,
-		}
+		return ErrorResponse(UnauthorizedCode, "invalid signer signature")
 	}
 	// we do not have this node, so we should add it
 	s.addTrustedNode(models.Node{
@@ -116,14 +129,13 @@ func (s *Server) NodeTrustHandler(ctx context.Context, r *Request) Response {
 	signature, err := crypto.Sign(s.PrivateKey, buf.Bytes())
 	if err != nil {
 		glog.Infof("failed to sign signature: %s", err)
-		return Response{
-			Status: Error,
-		}
+		return ErrorResponse(InternalErrorCode, "failed to sign node key")
 	}
 
 	nrr := NodeRegistrationResponse{
 		Signature: signature,
 		Nodes:     s.getAllTrustedNodes(),
+		Settings:  s.RingSettings(),
 	}
 
 	buf = bytes.NewBuffer([]byte{})
@@ -139,8 +151,15 @@ func (s *Server) NodeTrustHandler(ctx context.Context, r *Request) Response {
 
 // UserRegistrationHandler - this handler handles all user registrations.  A user
 // registration consists of the user giving the server it's public key, and the
-// server will place that public key in the DHT for future validations
+// server will place that public key in the DHT for future validations.  The
+// user must be the user of the key, From the hash of it, and the request
+// signed with it, so no one can register a key under another user's id.
 func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Response {
+	if err := r.VerifyUserSignature(); err != nil {
+		glog.Infof("registration of %s rejected: %v", r.Header.From, err)
+		return ErrorResponse(UnauthorizedCode, ErrBadUserSignature.Error())
+	}
+
 	// take the request pubkey and figure out which node it belongs to,
 	// and write the public key to a file using the file request to said
 	// node for others to lookup as needed
@@ -148,7 +167,7 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	err := crypto.WritePublicKeyAsPem(buf, r.Header.PubKey)
 	if err != nil {
 		glog.Infof("failed to write pub key as pem: %s", err)
-		return Response{Status: Error}
+		return ErrorResponse(BadHeaderCode, "invalid public key")
 	}
 
 	// figure out where to connect to, by asking self
@@ -156,13 +175,13 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	defer t.Close()
 	if err != nil {
 		glog.Infof("ERR: %v", err)
-		return Response{Status: Error}
+		return ErrorResponse(InternalErrorCode, "failed to store public key")
 	}
 	// serialize our get successor request
 	var idBuf = new(bytes.Buffer)
 	enc := gob.NewEncoder(idBuf)
 	enc.Encode(models.SuccessorRequest{
-		models.Identifier(r.Header.Key),
+		models.Identifier(r.Header.From),
 	})
 
 	resp, err := t.RoundTrip(&Request{
@@ -175,16 +194,14 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	})
 	if err != nil {
 		glog.Infof("Failed to round trip the successor request: %v", err)
-		return Response{Status: Error}
+		return ErrorResponse(InternalErrorCode, "failed to store public key")
 	}
 	// connect to that host for this file
 	// pull node out of response, and connect to that host
-	var node = models.Node{}
-	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-	err = dec.Decode(&node)
+	node, err := models.DecodeNode(bytes.NewBuffer(resp.Data))
 	if err != nil {
 		glog.Infof("Failed to deserialize the node data: %v", err)
-		return Response{Status: Error}
+		return ErrorResponse(InternalErrorCode, "failed to store public key")
 	}
 
 	// OKAY, NOW connect to it, and store the file
@@ -193,10 +210,9 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	defer st.Close()
 	if err != nil {
 		glog.Infof("ERR: %v", err)
-		return Response{Status: Error}
+		return ErrorResponse(InternalErrorCode, "failed to store public key")
 	}
 
-	glog.Infof("server id is : %+v", s.id)
 	response, err := st.RoundTrip(&Request{
 		Header: Header{
 			Key:        r.Header.From,
@@ -208,9 +224,32 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	})
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
-		return Response{Status: Error}
+		return ErrorResponse(InternalErrorCode, "failed to store public key")
+	}
+	glog.V(DebugLogLevel).Infof("response from public key post: %v", response)
+	if response.Status != Success {
+		// a node refusing the key, as another is stored for the user, is
+		// passed on to the user
+		return ErrorResponse(response.Header.ErrorCode, response.Header.Message)
 	}
-	glog.Infof("response from file post: %+v", response)
 
 	return Response{Status: Success}
 }
+
+// PingHandler - this handler answers pings, with the server's clock, so a
+// caller can cheaply tell the server is alive, and with what the server
+// supports that older servers do not
+func (s *Server) PingHandler(ctx context.Context, r *Request) Response {
+	clock, err := models.IncrementClock(r.Header.Clock)
+	if err != nil {
+		glog.Errorf("failed ping: %v", err)
+		return ErrorResponse(InternalErrorCode, "could not advance the clock")
+	}
+	return Response{
+		Header: Header{
+			Clock:         clock,
+			StagesUploads: true,
+		},
+		Status: Success,
+	}
+}
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxRequestSize - the largest message a server reads, unless set with
+// SetMaxRequestSize.  A file posted in a single request, rather than streamed
+// in chunks, has to fit within it.
+const DefaultMaxRequestSize = 512 << 20
+
+// DefaultMaxResponseSize - the largest message a transport reads, unless set
+// with SetMaxResponseSize.  It leaves room for a file as large as the largest
+// request, fetched in a single response, with the headers and encryption
+// around it.
+const DefaultMaxResponseSize = 2 * DefaultMaxRequestSize
+
+// maxResponseSize - the largest message transports read, accessed
+// atomically, zero is DefaultMaxResponseSize
+var maxResponseSize uint64
+
+var (
+	// ErrRequestTooLarge - a message was larger than the server accepts
+	ErrRequestTooLarge = errors.New("request is larger than the server accepts")
+	// ErrResponseTooLarge - a message was larger than the transport accepts
+	ErrResponseTooLarge = errors.New("response is larger than the transport accepts")
+	// ErrDataLengthMismatch - the header DataLength of a request is not the
+	// length of its data
+	ErrDataLengthMismatch = errors.New("request data does not match the header data length")
+)
+
+// dataLengthMethods - the methods which carry resource data, and declare its
+// length in the header DataLength
+var dataLengthMethods = map[RequestMethod]bool{
+	PostFileMethod:          true,
+	PostPublicKeyMethod:     true,
+	TransferKeyMethod:       true,
+	ReplicateKeyMethod:      true,
+	PutTransactionLogMethod: true,
+}
+
+// checkDataLength - make sure a request carrying resource data declares the
+// length it actually carries, as handlers size their checks by DataLength
+func (r *Request) checkDataLength() error {
+	if !dataLengthMethods[r.Method] || uint64(len(r.Data)) == r.Header.DataLength {
+		return nil
+	}
+	return errors.Wrapf(ErrDataLengthMismatch, "%d bytes of data, the header declares %d",
+		len(r.Data), r.Header.DataLength)
+}
+
+// SetMaxRequestSize - the largest message the server reads, a connection
+// sending a larger one is closed before it is read, so a client cannot make
+// the server allocate more.  Zero goes back to DefaultMaxRequestSize.
+func (s *Server) SetMaxRequestSize(max uint64) {
+	atomic.StoreUint64(&s.maxRequestSize, max)
+}
+
+// MaxRequestSize - the largest message the server reads
+func (s *Server) MaxRequestSize() uint64 {
+	if max := atomic.LoadUint64(&s.maxRequestSize); max > 0 {
+		return max
+	}
+	return DefaultMaxRequestSize
+}
+
+// SetMaxResponseSize - the largest message transports read, a node sending
+// a larger one fails the round trip before it is read, so a node cannot make
+// a client allocate more.  It applies to transports connected after it is
+// set.  Zero goes back to DefaultMaxResponseSize.
+func SetMaxResponseSize(max uint64) {
+	atomic.StoreUint64(&maxResponseSize, max)
+}
+
+// MaxResponseSize - the largest message transports read
+func MaxResponseSize() uint64 {
+	if max := atomic.LoadUint64(&maxResponseSize); max > 0 {
+		return max
+	}
+	return DefaultMaxResponseSize
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+)
+
+// DebugLogLevel - the glog verbosity, set with -v, from which payloads and
+// other per request detail are logged.  Secrets are not logged at any level,
+// so request and response values are safe to log as they print redacted.
+const DebugLogLevel glog.Level = 2
+
+// String - the header for logging, with the secrets it carries redacted,
+// and its signature, tag and nonce left out
+func (h Header) String() string {
+	shared := make([]string, len(h.SharedWith))
+	for i, s := range h.SharedWith {
+		shared[i] = fmt.Sprintf("%s:%s", s.ID, models.RedactSecret(s.Secret))
+	}
+	return fmt.Sprintf(
+		"{Key:%s From:%s Type:%d ResourceName:%q DataLength:%d Clock:%d Version:%d Offset:%d Length:%d ErrorCode:%d Message:%q Secret:%s SharedWith:%v}",
+		h.Key, h.From, h.Type, h.ResourceName, h.DataLength, h.Clock, h.Version,
+		h.Offset, h.Length, h.ErrorCode, h.Message, models.RedactSecret(h.Secret), shared,
+	)
+}
+
+// String - the request for logging, with its data left out
+func (r Request) String() string {
+	return fmt.Sprintf("{Method:%s Header:%s Data:%d bytes}",
+		RequestMethodToString[r.Method], r.Header, len(r.Data))
+}
+
+// String - the response for logging, with its data left out
+func (r Response) String() string {
+	return fmt.Sprintf("{Status:%d Header:%s Data:%d bytes}", r.Status, r.Header, len(r.Data))
+}
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PoolConfig - the limits of a TransportPool
+type PoolConfig struct {
+	// MaxIdlePerHost - the most idle connections kept to each address, zero
+	// disables pooling
+	MaxIdlePerHost int
+	// IdleTimeout - how long a connection is kept idle before it is closed
+	IdleTimeout time.Duration
+	// MaxPerHost - the most connections open to each address at once, in
+	// use or idle, zero is unlimited.  A transport to an address with as
+	// many open waits up to MaxWait for one to be closed or returned.
+	MaxPerHost int
+	// MaxWait - how long a transport waits for a connection to an address
+	// with MaxPerHost open before failing with ErrPoolExhausted
+	MaxWait time.Duration
+}
+
+// DefaultPoolConfig - the pool configuration of the client unless configured
+var DefaultPoolConfig = PoolConfig{
+	MaxIdlePerHost: 2,
+	IdleTimeout:    30 * time.Second,
+	MaxPerHost:     16,
+	MaxWait:        30 * time.Second,
+}
+
+// ErrPoolExhausted - a transport waited too long for a connection to an
+// address which had MaxPerHost connections open
+var ErrPoolExhausted = errors.New("too many connections open to peer")
+
+// pooledConn - an established connection, and the gob streams on it, which
+// carry type information from one message to the next so must be kept with it
+type pooledConn struct {
+	conn      net.Conn
+	enc       encoder
+	dec       decoder
+	idleSince time.Time
+}
+
+// TransportPool - idle connections to nodes, by address, for transports to
+// reuse rather than dialing a new connection for every operation
+type TransportPool struct {
+	config PoolConfig
+	idle   map[string][]*pooledConn
+	// open - the connections open to each address, in use or idle
+	open map[string]int
+	// released - closed, and replaced, whenever a connection is closed or
+	// returned, to wake transports waiting for one
+	released chan struct{}
+	// evicting - the eviction of idle connections is running
+	evicting bool
+	mu       *sync.Mutex
+}
+
+// NewTransportPool - create a new, empty, transport pool
+func NewTransportPool(config PoolConfig) *TransportPool {
+	return &TransportPool{
+		config:   config,
+		idle:     make(map[string][]*pooledConn),
+		open:     make(map[string]int),
+		released: make(chan struct{}),
+		mu:       new(sync.Mutex),
+	}
+}
+
+// Transports - the pool transports created by NewTransport take their
+// connections from, and return them to when closed.  Pooling is disabled
+// until configured, as a node serves each open connection with one of its
+// workers, even while it is idle.
+var Transports = NewTransportPool(PoolConfig{})
+
+// ConfigurePool - replace the pool configuration, closing every idle
+// connection
+func ConfigurePool(config PoolConfig) {
+	Transports.mu.Lock()
+	defer Transports.mu.Unlock()
+	Transports.config = config
+	Transports.closeIdle()
+}
+
+// get - take an idle connection to addr out of the pool, or make room for
+// a new one to be dialed, returning nil, in which case the caller must
+// release it if the dial fails.  Once MaxPerHost are open to addr, waits for
+// one to be closed or returned.
+func (tp *TransportPool) get(addr string) (*pooledConn, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	var timeout <-chan time.Time
+	for {
+		if pc := tp.takeIdle(addr); pc != nil {
+			return pc, nil
+		}
+		if tp.config.MaxPerHost <= 0 || tp.open[addr] < tp.config.MaxPerHost {
+			tp.open[addr]++
+			return nil, nil
+		}
+		if timeout == nil {
+			timeout = time.After(tp.config.MaxWait)
+		}
+		released := tp.released
+		tp.mu.Unlock()
+		select {
+		case <-released:
+			tp.mu.Lock()
+		case <-timeout:
+			tp.mu.Lock()
+			return nil, errors.Wrap(ErrPoolExhausted, addr)
+		}
+	}
+}
+
+// takeIdle - take an idle connection to addr out of the pool, nil if there
+// are none, must be called with mu held
+func (tp *TransportPool) takeIdle(addr string) *pooledConn {
+	conns := tp.idle[addr]
+	for len(conns) > 0 {
+		// the most recently used is the least likely to have gone stale
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(pc.idleSince) < tp.config.IdleTimeout {
+			tp.idle[addr] = conns
+			return pc
+		}
+		pc.conn.Close()
+		tp.closed(addr)
+	}
+	delete(tp.idle, addr)
+	return nil
+}
+
+// release - record a connection to addr taken from the pool, or made room
+// for, was closed
+func (tp *TransportPool) release(addr string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.closed(addr)
+}
+
+// closed - record a connection to addr was closed, and wake the transports
+// waiting for one, must be called with mu held
+func (tp *TransportPool) closed(addr string) {
+	if tp.open[addr] <= 1 {
+		delete(tp.open, addr)
+	} else {
+		tp.open[addr]--
+	}
+	tp.wake()
+}
+
+// wake - wake the transports waiting for a connection, must be called with
+// mu held
+func (tp *TransportPool) wake() {
+	close(tp.released)
+	tp.released = make(chan struct{})
+}
+
+// put - return an idle connection to addr to the pool, returns false if it
+// was not kept, in which case the caller closes it
+func (tp *TransportPool) put(addr string, pc *pooledConn) bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.idle[addr]) >= tp.config.MaxIdlePerHost {
+		return false
+	}
+	pc.idleSince = time.Now()
+	tp.idle[addr] = append(tp.idle[addr], pc)
+	tp.wake()
+	if !tp.evicting {
+		tp.evicting = true
+		go tp.evict()
+	}
+	return true
+}
+
+// evict - close connections which have been idle longer than the idle
+// timeout, until there are none left
+func (tp *TransportPool) evict() {
+	for {
+		tp.mu.Lock()
+		interval := tp.config.IdleTimeout / 2
+		tp.mu.Unlock()
+		if interval <= 0 {
+			interval = time.Second
+		}
+		time.Sleep(interval)
+
+		tp.mu.Lock()
+		for addr, conns := range tp.idle {
+			var kept []*pooledConn
+			for _, pc := range conns {
+				if time.Since(pc.idleSince) < tp.config.IdleTimeout {
+					kept = append(kept, pc)
+				} else {
+					pc.conn.Close()
+					tp.closed(addr)
+				}
+			}
+			if len(kept) == 0 {
+				delete(tp.idle, addr)
+			} else {
+				tp.idle[addr] = kept
+			}
+		}
+		if len(tp.idle) == 0 {
+			tp.evicting = false
+			tp.mu.Unlock()
+			return
+		}
+		tp.mu.Unlock()
+	}
+}
+
+// closeIdle - close every idle connection, must be called with mu held
+func (tp *TransportPool) closeIdle() {
+	for addr, conns := range tp.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+			tp.closed(addr)
+		}
+		delete(tp.idle, addr)
+	}
+}
+
+// Close - close every idle connection in the pool
+func (tp *TransportPool) Close() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.closeIdle()
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// startPingPeer - listen for connections answering every message with
+// success, closing each connection after answering perConn messages, or
+// never if it is zero
+func startPingPeer(t *testing.T, serverKey *rsa.PrivateKey, clientKey *rsa.PublicKey, perConn int) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dec, enc := newFrameDecoder(conn, 0), newFrameEncoder(conn)
+				for answered := 0; perConn == 0 || answered < perConn; answered++ {
+					if err := dec.Decode(new(EncryptedMessage)); err != nil {
+						return
+					}
+					response := Response{Status: Success}
+					response.setChecksum()
+					encryptAndEncode(enc, response, NodeType, clientKey, models.Identifier{}, serverKey)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestPoolMaxPerHost(t *testing.T) {
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := startPingPeer(t, serverKey, &clientKey.PublicKey, 0)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	ConfigurePool(PoolConfig{MaxIdlePerHost: 1, IdleTimeout: time.Minute, MaxPerHost: 1, MaxWait: 50 * time.Millisecond})
+	defer ConfigurePool(PoolConfig{})
+	dial := func() (*Transport, error) {
+		return NewTransport("tcp", addr, UserType, models.Identifier{}, &serverKey.PublicKey, clientKey)
+	}
+
+	first, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial(); errors.Cause(err) != ErrPoolExhausted {
+		t.Fatalf("expected a second connection refused at the cap, got %v", err)
+	}
+
+	// a transport waiting at the cap takes the connection once it is
+	// returned to the pool
+	ConfigurePool(PoolConfig{MaxIdlePerHost: 1, IdleTimeout: time.Minute, MaxPerHost: 1, MaxWait: 5 * time.Second})
+	waited := make(chan error, 1)
+	go func() {
+		second, err := dial()
+		if err == nil {
+			_, err = second.RoundTrip(&Request{Method: PingMethod})
+			second.Close()
+		}
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := first.RoundTrip(&Request{Method: PingMethod}); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("waiting transport failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting transport never got the returned connection")
+	}
+}
+
+func TestPoolStaleConnectionRedialed(t *testing.T) {
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer closes every connection once it has answered, as a node
+	// closing idle connections would
+	l := startPingPeer(t, serverKey, &clientKey.PublicKey, 1)
+	defer l.Close()
+	addr := l.Addr().String()
+
+	ConfigurePool(PoolConfig{MaxIdlePerHost: 2, IdleTimeout: time.Minute})
+	defer ConfigurePool(PoolConfig{})
+	// a single failure would open the breaker, and fail the redial
+	ConfigureBreakers(BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute})
+	defer ConfigureBreakers(DefaultBreakerConfig)
+
+	for i := 0; i < 3; i++ {
+		tr, err := NewTransport("tcp", addr, UserType, models.Identifier{}, &serverKey.PublicKey, clientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && !tr.reused {
+			t.Errorf("round trip %d: expected the pooled connection reused", i)
+		}
+		if _, err := tr.RoundTrip(&Request{Method: PingMethod}); err != nil {
+			t.Fatalf("round trip %d on a connection the peer closed: %v", i, err)
+		}
+		tr.Close()
+		// let the peer's close arrive
+		time.Sleep(20 * time.Millisecond)
+	}
+}
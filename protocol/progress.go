@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Progress - told of the bytes a transport sends and receives, a piece at a
+// time as they go over its connection
+type Progress func(sent, received int)
+
+// progressChunk - the most bytes written at once while progress is being
+// reported, so a large message is reported as it is sent rather than once
+const progressChunk = 64 << 10
+
+// meteredConn - a connection which reports the bytes going over it to the
+// Progress of the transport using it, if there is one
+type meteredConn struct {
+	net.Conn
+	progress atomic.Value
+}
+
+// meterConn - conn, reporting what goes over it once setProgress is called
+func meterConn(conn net.Conn) *meteredConn {
+	return &meteredConn{Conn: conn}
+}
+
+// setProgress - report to p from now on, nil stops reporting
+func (c *meteredConn) setProgress(p Progress) {
+	c.progress.Store(p)
+}
+
+// report - the Progress to report to, nil if there is none
+func (c *meteredConn) report() Progress {
+	p, _ := c.progress.Load().(Progress)
+	return p
+}
+
+// Write - write b, in pieces when reporting progress
+func (c *meteredConn) Write(b []byte) (int, error) {
+	p := c.report()
+	if p == nil {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		piece := b
+		if len(piece) > progressChunk {
+			piece = piece[:progressChunk]
+		}
+		n, err := c.Conn.Write(piece)
+		if n > 0 {
+			p(n, 0)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Read - read into b, reporting what was read
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if p := c.report(); p != nil && n > 0 {
+		p(0, n)
+	}
+	return n, err
+}
+
+// SetProgress - report the bytes the transport sends and receives to p,
+// until it is closed or SetProgress is called again.  nil stops reporting.
+func (t *Transport) SetProgress(p Progress) {
+	if mc, ok := t.conn.(*meteredConn); ok {
+		mc.setProgress(p)
+	}
+}
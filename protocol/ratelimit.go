@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig - the bandwidth transports created by NewTransport share,
+// in bytes per second, zero being unlimited
+type RateLimitConfig struct {
+	MaxUploadBps   uint64
+	MaxDownloadBps uint64
+}
+
+// minBurst - the fewest bytes a limited connection reads or writes at once
+const minBurst = 512
+
+// tokenBucket - paces a stream of bytes to rate bytes per second, allowing
+// bursts of up to a tenth of a second of them
+type tokenBucket struct {
+	rate  float64
+	burst int
+	// tokens - the bytes which can be sent now, negative when bytes have
+	// been reserved ahead of being sent
+	tokens float64
+	last   time.Time
+	mu     *sync.Mutex
+}
+
+// newTokenBucket - a bucket for bps bytes per second, nil if bps is zero
+func newTokenBucket(bps uint64) *tokenBucket {
+	if bps == 0 {
+		return nil
+	}
+	burst := int(bps / 10)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &tokenBucket{
+		rate:   float64(bps),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+		mu:     new(sync.Mutex),
+	}
+}
+
+// wait - take n bytes from the bucket, sleeping until they have been earned
+func (b *tokenBucket) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	owed := b.tokens
+	b.mu.Unlock()
+	if owed < 0 {
+		time.Sleep(time.Duration(-owed / b.rate * float64(time.Second)))
+	}
+}
+
+var (
+	uploadLimit, downloadLimit *tokenBucket
+	rateLimitMu                = new(sync.RWMutex)
+)
+
+// ConfigureRateLimit - limit the bandwidth of the connections transports
+// dial from now on, which is shared between all of them
+func ConfigureRateLimit(config RateLimitConfig) {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	uploadLimit = newTokenBucket(config.MaxUploadBps)
+	downloadLimit = newTokenBucket(config.MaxDownloadBps)
+}
+
+// rateLimitedConn - a connection whose reads and writes are paced
+type rateLimitedConn struct {
+	net.Conn
+	up, down *tokenBucket
+}
+
+// limitConn - conn, paced to the configured rate limits if there are any
+func limitConn(conn net.Conn) net.Conn {
+	rateLimitMu.RLock()
+	defer rateLimitMu.RUnlock()
+	if uploadLimit == nil && downloadLimit == nil {
+		return conn
+	}
+	return &rateLimitedConn{Conn: conn, up: uploadLimit, down: downloadLimit}
+}
+
+// Write - write b in pieces of no more than the burst of the upload limit,
+// waiting for each to be allowed
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	if c.up == nil {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		piece := b
+		if len(piece) > c.up.burst {
+			piece = piece[:c.up.burst]
+		}
+		c.up.wait(len(piece))
+		n, err := c.Conn.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Read - read no more than the burst of the download limit, and wait for
+// what was read to be allowed before reading more
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	if c.down == nil {
+		return c.Conn.Read(b)
+	}
+	if len(b) > c.down.burst {
+		b = b[:c.down.burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.down.wait(n)
+	}
+	return n, err
+}
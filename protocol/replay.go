@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ReplayWindow - how far from the server's clock the sent time of a
+	// request may be.  Nonces are remembered for this long, so a request
+	// replayed later is refused as stale rather than as a duplicate.
+	ReplayWindow = 5 * time.Minute
+	// maxNoncesPerCaller - the most nonces remembered for one caller, beyond
+	// which its requests are refused until the oldest expire, as forgetting
+	// them early would let their requests be replayed
+	maxNoncesPerCaller = 1 << 16
+	// nonceSize - the random bytes of a nonce
+	nonceSize = 16
+)
+
+var (
+	// ErrReplayedRequest - a request with the same nonce was already received
+	// from the caller
+	ErrReplayedRequest = errors.New("request was already received, it may have been replayed")
+	// ErrStaleRequest - the sent time of a request is outside of ReplayWindow
+	ErrStaleRequest = errors.New("request was not sent recently, it may have been replayed")
+	// ErrTooManyRequests - the caller sent more requests within ReplayWindow
+	// than their nonces can be remembered for
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// newNonce - random bytes to make a request unique
+func newNonce() []byte {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(errors.Wrap(err, "failed to read random nonce"))
+	}
+	return nonce
+}
+
+// seenNonce - a nonce received from a caller, and when it can be forgotten
+type seenNonce struct {
+	nonce   string
+	expires time.Time
+}
+
+// callerNonces - the nonces received from a caller, in the order received,
+// which is also the order they expire in
+type callerNonces struct {
+	seen  map[string]bool
+	order []seenNonce
+}
+
+// expire - forget the nonces which can be forgotten by now
+func (c *callerNonces) expire(now time.Time) {
+	for len(c.order) > 0 && now.After(c.order[0].expires) {
+		delete(c.seen, c.order[0].nonce)
+		c.order = c.order[1:]
+	}
+}
+
+// nonceCache - the nonces received recently, by caller
+type nonceCache struct {
+	mu      sync.Mutex
+	callers map[models.Identifier]*callerNonces
+	// swept - when callers were last swept for any which can be forgotten
+	swept time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{callers: map[models.Identifier]*callerNonces{}}
+}
+
+// check - refuse a request from from which was sent outside of ReplayWindow,
+// whose nonce was already received, or which is one more than
+// maxNoncesPerCaller within the window, and remember the nonce.  Requests
+// without a nonce, from clients older than nonces, are not checked.
+func (nc *nonceCache) check(from models.Identifier, nonce []byte, sent int64, now time.Time) error {
+	if len(nonce) == 0 {
+		return nil
+	}
+	if skew := now.Sub(time.Unix(0, sent)); skew > ReplayWindow || skew < -ReplayWindow {
+		return errors.Wrapf(ErrStaleRequest, "sent %s ago", skew)
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if now.Sub(nc.swept) > ReplayWindow {
+		for id, caller := range nc.callers {
+			if caller.expire(now); len(caller.order) == 0 {
+				delete(nc.callers, id)
+			}
+		}
+		nc.swept = now
+	}
+	caller, ok := nc.callers[from]
+	if !ok {
+		caller = &callerNonces{seen: map[string]bool{}}
+		nc.callers[from] = caller
+	}
+	caller.expire(now)
+	if caller.seen[string(nonce)] {
+		return ErrReplayedRequest
+	}
+	if len(caller.order) >= maxNoncesPerCaller {
+		return ErrTooManyRequests
+	}
+	caller.seen[string(nonce)] = true
+	caller.order = append(caller.order, seenNonce{
+		nonce: string(nonce),
+		// a request sent up to ReplayWindow ahead of now is not stale until
+		// twice the window from now
+		expires: now.Add(2 * ReplayWindow),
+	})
+	return nil
+}
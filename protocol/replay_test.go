@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func TestTooManyRequestsRefused(t *testing.T) {
+	var (
+		nc   = newNonceCache()
+		from = models.HashBytes([]byte("caller"))
+		now  = time.Now()
+	)
+	check := func(i int, at time.Time) error {
+		return nc.check(from, []byte(fmt.Sprint(i)), at.UnixNano(), at)
+	}
+	for i := 0; i < maxNoncesPerCaller; i++ {
+		if err := check(i, now); err != nil {
+			t.Fatalf("request %d refused: %v", i, err)
+		}
+	}
+	if err := check(maxNoncesPerCaller, now); err != ErrTooManyRequests {
+		t.Errorf("got %v, expected a request past the limit refused", err)
+	}
+	// the first nonce is still remembered, so its request cannot be replayed
+	if err := check(0, now.Add(ReplayWindow)); err != ErrReplayedRequest {
+		t.Errorf("got %v, expected the first request refused as replayed", err)
+	}
+
+	// once the nonces expire, the caller is let through again
+	later := now.Add(2*ReplayWindow + time.Second)
+	if err := check(maxNoncesPerCaller, later); err != nil {
+		t.Errorf("request once the nonces expired refused: %v", err)
+	}
+}
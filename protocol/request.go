@@ -1,8 +1,12 @@
 package protocol
 
 import (
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/gob"
 
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
 	"github.com/pkg/errors"
 )
 
@@ -16,18 +20,36 @@ type RequestMethod uint64
 
 // RequestMethodToString - Convert from a Request Method to String
 var RequestMethodToString = map[RequestMethod]string{
-	GetFileMethod:          "GetFile",
-	PostFileMethod:         "PostFile",
-	GetPublicKeyMethod:     "GetPublicKey",
-	PostPublicKeyMethod:    "PostPublicKey",
-	DeleteFileMethod:       "DeleteFile",
-	GetSuccessorMethod:     "GetSuccessor",
-	SetPredecessorMethod:   "SetPredecessor",
-	GetPredecessorMethod:   "GetPredecessor",
-	GetFingerTableMethod:   "GetFingerTable",
-	UserRegistrationMethod: "UserRegistrationMethod",
-	NodeRegistrationMethod: "NodeRegistrationMethod",
-	NodeTrustMethod:        "NodeTrustMethod",
+	GetFileMethod:               "GetFile",
+	PostFileMethod:              "PostFile",
+	GetPublicKeyMethod:          "GetPublicKey",
+	PostPublicKeyMethod:         "PostPublicKey",
+	DeleteFileMethod:            "DeleteFile",
+	GetSuccessorMethod:          "GetSuccessor",
+	SetPredecessorMethod:        "SetPredecessor",
+	GetPredecessorMethod:        "GetPredecessor",
+	GetFingerTableMethod:        "GetFingerTable",
+	UserRegistrationMethod:      "UserRegistrationMethod",
+	NodeRegistrationMethod:      "NodeRegistrationMethod",
+	NodeTrustMethod:             "NodeTrustMethod",
+	RebalanceMethod:             "Rebalance",
+	TransferKeyMethod:           "TransferKey",
+	DrainMethod:                 "Drain",
+	ListFilesMethod:             "ListFiles",
+	RevokeShareMethod:           "RevokeShare",
+	GetSuccessorListMethod:      "GetSuccessorList",
+	ReplicateKeyMethod:          "ReplicateKey",
+	NodeJoinMethod:              "NodeJoin",
+	NodeLeaveMethod:             "NodeLeave",
+	GetTransactionLogMethod:     "GetTransactionLog",
+	PutTransactionLogMethod:     "PutTransactionLog",
+	PingMethod:                  "Ping",
+	StatsMethod:                 "Stats",
+	ReadyMethod:                 "Ready",
+	BatchGetMethod:              "BatchGet",
+	GetOwnersMethod:             "GetOwners",
+	GetImmediateSuccessorMethod: "GetImmediateSuccessor",
+	TransferOwnershipMethod:     "TransferOwnership",
 }
 
 const (
@@ -53,8 +75,145 @@ const (
 	NodeTrustMethod
 	GetPublicKeyMethod
 	PostPublicKeyMethod
+	// RebalanceMethod - admin method to make a node hand off the keys it is
+	// no longer responsible for, and collect the keys it now is
+	RebalanceMethod
+	// TransferKeyMethod - node to node method to hand off a stored resource
+	TransferKeyMethod
+	// DrainMethod - admin method to make a node hand off its keys and stop
+	// accepting new data ahead of being shut down, or to undrain it
+	DrainMethod
+	// ListFilesMethod - list the resources a node stores which the caller
+	// is an owner of
+	ListFilesMethod
+	// RevokeShareMethod - remove a user from the owners of a resource
+	RevokeShareMethod
+	// GetSuccessorListMethod - Chord Method to get the successor list, and
+	// which of the successors hold replicas
+	GetSuccessorListMethod
+	// ReplicateKeyMethod - node to node method to copy a changed resource to
+	// a replica, overwriting what it holds
+	ReplicateKeyMethod
+	// NodeJoinMethod - Chord Method for a node joining the ring to tell its
+	// successor, which hands off the keys the new node is now responsible for
+	NodeJoinMethod
+	// NodeLeaveMethod - Chord Method for a node leaving the ring to tell its
+	// predecessor and successor, which take each other in its place
+	NodeLeaveMethod
+	// GetTransactionLogMethod - get the transaction log of the caller
+	GetTransactionLogMethod
+	// PutTransactionLogMethod - merge the entries of the transaction log in
+	// the request into the caller's stored log
+	PutTransactionLogMethod
+	// PingMethod - check the node is alive and answering requests, before
+	// routing anything larger to it
+	PingMethod
+	// StatsMethod - admin method to get the stored resources and request
+	// counts of a node
+	StatsMethod
+	// ReadyMethod - check the node is ready to serve, not just alive: it has
+	// joined the ring and can write to its data path
+	ReadyMethod
+	// BatchGetMethod - get many resources in one round trip, the request
+	// data being their gob encoded keys
+	BatchGetMethod
+	// GetOwnersMethod - get the owners of a resource the caller owns, the
+	// response data being a gob encoded models.OwnersResponse
+	GetOwnersMethod
+	// GetImmediateSuccessorMethod - Chord Method to get the node's current
+	// successor, rather than the successor of a key, for walking the ring
+	GetImmediateSuccessorMethod
+	// TransferOwnershipMethod - hand a resource the caller owns to another
+	// user, removing the caller from its owners
+	TransferOwnershipMethod
 )
 
+// TransactionLogKey - the key the transaction log of the user with the
+// public key userKey is stored under
+func TransactionLogKey(userKey *rsa.PublicKey) (models.Identifier, error) {
+	gobKey, err := crypto.GobEncodePublicKey(userKey)
+	if err != nil {
+		return models.Identifier{}, errors.Wrap(err, "failed to encode public key")
+	}
+	return models.HashBytes(append(gobKey, []byte("-transaction-log")...)), nil
+}
+
+// TransactionLogDigest - the digest of a stored transaction log, raw, as
+// sent in Header.LogDigest.  A user without a log has the digest of nothing.
+func TransactionLogDigest(raw []byte) []byte {
+	sum := sha256.Sum256(raw)
+	return sum[:]
+}
+
+// ErrBadUserSignature - a request was not signed by the user it is made as
+var ErrBadUserSignature = errors.New("request is not signed by the user it is made as")
+
+// userDigest - what the user making the request signs of it
+func (r *Request) userDigest() crypto.RequestDigest {
+	shared := make([]crypto.SharedDigest, 0, len(r.Header.SharedWith))
+	for i := range r.Header.SharedWith {
+		s := &r.Header.SharedWith[i]
+		shared = append(shared, crypto.SharedDigest{
+			ID:       s.ID[:],
+			Secret:   s.Secret,
+			ReadOnly: s.ReadOnly,
+		})
+	}
+	return crypto.RequestDigest{
+		Method:       uint64(r.Method),
+		Resource:     r.Header.Key[:],
+		ResourceName: r.Header.ResourceName,
+		Data:         r.Data,
+		DataLength:   r.Header.DataLength,
+		Clock:        r.Header.Clock,
+		Log:          r.Header.Log,
+		Secret:       r.Header.Secret,
+		SharedWith:   shared,
+		Version:      r.Header.Version,
+		Offset:       r.Header.Offset,
+		More:         r.Header.More,
+		Archived:     r.Header.Archived,
+		Rekey:        r.Header.Rekey,
+		Tag:          r.Header.Tag,
+		LogDigest:    r.Header.LogDigest,
+		Nonce:        r.Header.Nonce,
+		Sent:         r.Header.Sent,
+	}
+}
+
+// SignAsUser - sign what the request does with the key of the user making
+// it, which the nodes it passes through do not have.  Transports of users
+// sign every request they send.
+func (r *Request) SignAsUser(key *rsa.PrivateKey) error {
+	if r.Header.PubKey == nil {
+		r.Header.PubKey = &key.PublicKey
+	}
+	signature, err := crypto.SignRequest(key, r.userDigest())
+	if err != nil {
+		return errors.Wrap(err, "failed to sign request")
+	}
+	r.Header.Signature = signature
+	return nil
+}
+
+// VerifyUserSignature - make sure the request was signed by the user it is
+// made as, whose public key must be PubKey, so that a node which routes or
+// forwards it cannot have made or changed it.  Handlers which change stored
+// data check this before doing so.
+func (r *Request) VerifyUserSignature() error {
+	if r.Header.PubKey == nil {
+		return errors.Wrap(ErrBadUserSignature, "no public key")
+	}
+	gobKey, err := crypto.GobEncodePublicKey(r.Header.PubKey)
+	if err != nil || models.HashBytes(gobKey) != r.Header.From {
+		return errors.Wrap(ErrBadUserSignature, "public key is not the key of the user")
+	}
+	if err := crypto.VerifyRequest(r.Header.PubKey, r.Header.Signature, r.userDigest()); err != nil {
+		return errors.Wrap(ErrBadUserSignature, err.Error())
+	}
+	return nil
+}
+
 // Request - the standard request, includes a header,
 // method and data.  The resource is defined in the header
 // and the data length is defined in the header as well.
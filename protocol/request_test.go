@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+)
+
+func TestVerifyUserSignature(t *testing.T) {
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobKey, err := crypto.GobEncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signed - a post setting every field a user signs
+	signed := func() *Request {
+		r := &Request{
+			Header: Header{
+				Key:          models.Identifier{1},
+				From:         models.HashBytes(gobKey),
+				ResourceName: "a.txt",
+				DataLength:   4,
+				Clock:        3,
+				Secret:       []byte{5},
+				SharedWith: []SharedSecret{
+					{ID: models.Identifier{6}, Secret: []byte{6}, ReadOnly: true},
+				},
+				Version:   2,
+				Offset:    8,
+				More:      true,
+				Tag:       []byte{7},
+				LogDigest: []byte{8},
+				Nonce:     []byte{9},
+				Sent:      10,
+			},
+			Method: PostFileMethod,
+			Data:   []byte("data"),
+		}
+		if err := r.SignAsUser(key); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if err := signed().VerifyUserSignature(); err != nil {
+		t.Fatalf("valid signature did not verify: %v", err)
+	}
+
+	for name, tamper := range map[string]func(*Request){
+		"method":        func(r *Request) { r.Method = DeleteFileMethod },
+		"key":           func(r *Request) { r.Header.Key = models.Identifier{2} },
+		"resource name": func(r *Request) { r.Header.ResourceName = "b.txt" },
+		"data":          func(r *Request) { r.Data = []byte("atad") },
+		"data length":   func(r *Request) { r.Header.DataLength = 5 },
+		"clock":         func(r *Request) { r.Header.Clock = 4 },
+		"log":           func(r *Request) { r.Header.Log = true },
+		"secret":        func(r *Request) { r.Header.Secret = []byte{4} },
+		"added owner": func(r *Request) {
+			r.Header.SharedWith = append(r.Header.SharedWith, SharedSecret{ID: models.Identifier{7}, Secret: []byte{7}})
+		},
+		"shared secret": func(r *Request) { r.Header.SharedWith[0].Secret = []byte{4} },
+		"write access":  func(r *Request) { r.Header.SharedWith[0].ReadOnly = false },
+		"version":       func(r *Request) { r.Header.Version = 1 },
+		"offset":        func(r *Request) { r.Header.Offset = 0 },
+		"more":          func(r *Request) { r.Header.More = false },
+		"archived":      func(r *Request) { r.Header.Archived = true },
+		"rekey":         func(r *Request) { r.Header.Rekey = true },
+		"tag":           func(r *Request) { r.Header.Tag = []byte{4} },
+		"log digest":    func(r *Request) { r.Header.LogDigest = nil },
+		"nonce":         func(r *Request) { r.Header.Nonce = []byte{4} },
+		"sent":          func(r *Request) { r.Header.Sent = 11 },
+	} {
+		r := signed()
+		tamper(r)
+		if err := r.VerifyUserSignature(); err == nil {
+			t.Errorf("signature verified with a changed %s", name)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"hash/crc32"
 
 	"github.com/pkg/errors"
 )
@@ -18,15 +21,91 @@ const (
 	Success ResponseStatus = 1 << iota
 	// Error - the message request was not successful
 	Error
+	// PolicyViolation - the message request was rejected by the content
+	// policy of the node
+	PolicyViolation
+	// Unauthorized - the caller is an owner of the resource, but does not
+	// have permission for the operation requested
+	Unauthorized
+	// QuotaExceeded - the node does not have room to store the data, or the
+	// owner of the data has used up their storage quota on the node
+	QuotaExceeded
+	// Draining - the node is being drained ahead of shutdown and does not
+	// accept new data, the request should be retried once the ring routes
+	// around it
+	Draining
 )
 
 var (
 	// ValidResponseStatus - Used for verification that a response is right
 	ValidResponseStatus = map[ResponseStatus]bool{
-		Success: true, Error: true,
+		Success: true, Error: true, PolicyViolation: true, Unauthorized: true,
+		QuotaExceeded: true, Draining: true,
 	}
 )
 
+// ErrorCode - the kind of failure of a response which was not successful,
+// for the caller to act on without parsing the message
+type ErrorCode uint8
+
+const (
+	// NoErrorCode - the response was successful, or is from a node which
+	// does not send error codes
+	NoErrorCode ErrorCode = iota
+	// NotFoundCode - the resource requested does not exist
+	NotFoundCode
+	// UnauthorizedCode - the caller could not be authenticated, or is not
+	// allowed to perform the request
+	UnauthorizedCode
+	// QuotaExceededCode - the node, or the owner's quota on it, does not
+	// have room for the data
+	QuotaExceededCode
+	// BadHeaderCode - the request was malformed or asked for something the
+	// resource does not support
+	BadHeaderCode
+	// ConflictCode - the request does not fit the current state of the
+	// resource or node, such as an append at the wrong offset
+	ConflictCode
+	// PolicyViolationCode - the data was rejected by the content policy of
+	// the node
+	PolicyViolationCode
+	// DrainingCode - the node is being drained and does not accept new data
+	DrainingCode
+	// InternalErrorCode - the node failed to perform a valid request
+	InternalErrorCode
+)
+
+// ErrorCodeToString - Convert from an ErrorCode to String
+var ErrorCodeToString = map[ErrorCode]string{
+	NoErrorCode:         "no error",
+	NotFoundCode:        "not found",
+	UnauthorizedCode:    "unauthorized",
+	QuotaExceededCode:   "quota exceeded",
+	BadHeaderCode:       "bad header",
+	ConflictCode:        "conflict",
+	PolicyViolationCode: "policy violation",
+	DrainingCode:        "draining",
+	InternalErrorCode:   "internal error",
+}
+
+// ResponseError - the error a response which was not successful represents
+type ResponseError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Error - the message of the response, and the kind of failure
+func (e *ResponseError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = "protocol failure"
+	}
+	if e.Code == NoErrorCode {
+		return message
+	}
+	return message + " (" + ErrorCodeToString[e.Code] + ")"
+}
+
 // Response - the response structure for any given request
 type Response struct {
 	Header Header
@@ -46,3 +125,86 @@ func (r *Response) Validate() error {
 	}
 	return nil
 }
+
+// ErrChecksumMismatch - the data of a response is not the data the node
+// sent, it was corrupted or cut short in transit
+var ErrChecksumMismatch = errors.New("response checksum mismatch")
+
+// dataChecksum - the checksum of response data sent in its header
+func dataChecksum(data []byte) []byte {
+	sum := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	return sum
+}
+
+// setChecksum - set the checksum of the data of r in its header, once the
+// handler has finished with it
+func (r *Response) setChecksum() {
+	r.Header.Checksum = dataChecksum(r.Data)
+}
+
+// verifyChecksum - check the data of r against the checksum sent with it.
+// Responses from nodes from before checksums have none, and are accepted.
+func (r *Response) verifyChecksum() error {
+	if len(r.Header.Checksum) == 0 {
+		return nil
+	}
+	if !bytes.Equal(dataChecksum(r.Data), r.Header.Checksum) {
+		return errors.Wrapf(ErrChecksumMismatch, "%d bytes of data", len(r.Data))
+	}
+	return nil
+}
+
+// ErrResourceNotFound - the error of a response to a request for a resource
+// the node does not hold
+var ErrResourceNotFound = errors.New("resource not found")
+
+// ErrDraining - the error of a response from a node which is being drained,
+// the request did not fail and can be retried once the ring routes around it
+var ErrDraining = errors.New("node is draining")
+
+// DrainingResponse - the response to a request for new data on a node which
+// is being drained
+func DrainingResponse() Response {
+	return Response{
+		Header: Header{
+			Message:   ErrDraining.Error(),
+			ErrorCode: DrainingCode,
+		},
+		Status: Draining,
+	}
+}
+
+// ErrorResponse - an error response of the kind code, explaining the
+// failure with message
+func ErrorResponse(code ErrorCode, message string) Response {
+	return Response{
+		Header: Header{
+			Message:   message,
+			ErrorCode: code,
+		},
+		Status: Error,
+	}
+}
+
+// Err - the error a response represents, nil if it was successful.  A
+// resource which was not found and a draining node are ErrResourceNotFound
+// and ErrDraining, anything else is a *ResponseError with the code and
+// message sent by the node.
+func (r Response) Err() error {
+	if r.Status == Success {
+		return nil
+	}
+	if r.Status == Draining {
+		return ErrDraining
+	}
+	if r.Header.ErrorCode == NotFoundCode ||
+		r.Header.Message == ErrResourceNotFound.Error() {
+		// nodes from before error codes only send the message
+		return ErrResourceNotFound
+	}
+	return &ResponseError{
+		Code:    r.Header.ErrorCode,
+		Message: r.Header.Message,
+	}
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+func TestResponseChecksum(t *testing.T) {
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	tests := []struct {
+		name string
+		// cut - how many bytes of the response data are lost after its
+		// checksum is set
+		cut  int
+		want error
+	}{
+		{"intact", 0, nil},
+		{"truncated", 300, ErrChecksumMismatch},
+		{"emptied", len(data), ErrChecksumMismatch},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func(cut int) {
+			defer server.Close()
+			if err := newFrameDecoder(server, 0).Decode(new(EncryptedMessage)); err != nil {
+				return
+			}
+			response := Response{Status: Success, Data: data}
+			response.setChecksum()
+			response.Data = response.Data[:len(data)-cut]
+			encryptAndEncode(newFrameEncoder(server), response, NodeType,
+				&clientKey.PublicKey, models.Identifier{}, serverKey)
+		}(test.cut)
+
+		tr, err := dialTransport("pipe", UserType, models.Identifier{}, &serverKey.PublicKey, clientKey, func() (net.Conn, error) {
+			return client, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(&Request{Method: PingMethod})
+		if errors.Cause(err) != test.want {
+			t.Errorf("%s: round trip failed with %v, expected %v", test.name, err, test.want)
+		}
+		if err == nil && len(resp.Data) != len(data) {
+			t.Errorf("%s: got %d bytes, expected %d", test.name, len(resp.Data), len(data))
+		}
+		tr.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy - how RoundTripWithRetry retries a round trip which failed
+type RetryPolicy struct {
+	// Attempts - the most round trips made, including the first, below two
+	// never retrying
+	Attempts int
+	// InitialBackoff - how long to wait before the first retry, doubling for
+	// each retry after it
+	InitialBackoff time.Duration
+	// MaxBackoff - the longest wait between two attempts, zero is unbounded
+	MaxBackoff time.Duration
+	// Jitter - the fraction of each wait randomly added to or taken from it,
+	// between 0 and 1, so clients which failed together retry apart
+	Jitter float64
+	// Timeout - how long each attempt is given before it is abandoned, zero
+	// waiting as long as it takes
+	Timeout time.Duration
+}
+
+// DefaultRetryPolicy - a policy retrying twice, soon after a failure
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Jitter:         0.2,
+}
+
+// backoff - how long to wait before the given retry, the first being 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// Retryable - could the round trip which failed with err pass if it were
+// tried again.  Failures to reach the peer, connections broken part way,
+// responses which did not arrive intact and attempts which timed out are
+// retryable.  Failures to encrypt or decrypt a
+// message, an open circuit breaker, and cancellation are not, nor is an
+// error response from the peer, which is not returned as an error at all.
+func Retryable(err error) bool {
+	switch cause := errors.Cause(err); cause {
+	case nil, ErrCircuitOpen, context.Canceled:
+		return false
+	case ErrNotConnected, ErrChecksumMismatch, context.DeadlineExceeded, io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe:
+		return true
+	default:
+		_, ok := cause.(net.Error)
+		return ok
+	}
+}
+
+// RoundTripWithRetry - RoundTrip, retrying with exponential backoff while
+// the round trip fails with a Retryable error, up to policy.Attempts times.
+// Before each retry the transport is connected again, so only transports
+// created by NewTransport or NewTLSTransport can be retried.  Each attempt is
+// a new request to the peer, so requests which must not be applied twice,
+// such as appends, should not be retried.
+func (t *Transport) RoundTripWithRetry(request *Request, policy RetryPolicy) (Response, error) {
+	response, err := t.roundTripAttempt(request, policy.Timeout)
+	for attempt := 1; attempt < policy.Attempts && Retryable(err); attempt++ {
+		wait := policy.backoff(attempt)
+		glog.Infof("round trip to %s failed, retrying in %s: %s", t.addr, wait, err)
+		time.Sleep(wait)
+		if err = t.reconnect(); err != nil {
+			continue
+		}
+		response, err = t.roundTripAttempt(request, policy.Timeout)
+	}
+	return response, err
+}
+
+// roundTripAttempt - round trip request on t, giving up after timeout unless
+// it is zero
+func (t *Transport) roundTripAttempt(request *Request, timeout time.Duration) (Response, error) {
+	if timeout <= 0 {
+		return t.RoundTrip(request)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.RoundTripContext(ctx, request)
+}
+
+// reconnect - replace the connection of t, which failed, with a new one
+func (t *Transport) reconnect() error {
+	if t.redial == nil {
+		return errors.New("transport cannot reconnect")
+	}
+	var progress Progress
+	if mc, ok := t.conn.(*meteredConn); ok {
+		progress = mc.report()
+	}
+	t.broken = true
+	t.Close()
+	fresh, err := t.redial()
+	if err != nil {
+		return err
+	}
+	t.conn, t.enc, t.dec, t.pool, t.broken = fresh.conn, fresh.enc, fresh.dec, fresh.pool, false
+	t.reused, t.stale = fresh.reused, false
+	t.SetProgress(progress)
+	return nil
+}
@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/rsa"
-	"crypto/sha1"
+	"crypto/tls"
 	"encoding/gob"
-	"encoding/hex"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -20,21 +20,52 @@ import (
 
 // Server - base server type, contains a listener to listen for sockets
 type Server struct {
-	PrivateKey        *rsa.PrivateKey
-	id                models.Identifier
-	addr              string
-	listener          net.Listener
+	PrivateKey    *rsa.PrivateKey
+	id            models.Identifier
+	addr          string
+	advertiseAddr string
+	listener      net.Listener
+	// ctx - the context handlers are called with, configured by WithValue
 	ctx               context.Context
+	ctxMu             *sync.RWMutex
 	connChan          chan net.Conn
 	handlerMap        map[RequestMethod]Handler
 	handlerMapMu      *sync.RWMutex
 	trustedNodes      map[models.Identifier]models.Node
 	trustedNodesMapMu *sync.RWMutex
+	// draining - set while the node is being drained, accessed atomically
+	draining int32
+	// tlsConfig - when set, connections are accepted over TLS
+	tlsConfig *tls.Config
+	// maxRequestSize - the largest message read, accessed atomically, zero
+	// is DefaultMaxRequestSize
+	maxRequestSize uint64
+	// counters - the requests handled by method, for StatsMethod
+	counters requestCounters
+	// started - when the server was created
+	started time.Time
+	// nonces - the nonces of requests received recently, to refuse replays
+	nonces *nonceCache
+	// ringSettings - the ring settings configured with WithValue, read by
+	// the chord goroutines apart from any request
+	ringSettings models.RingSettings
 }
 
-// NewServer - create a new server
-func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string, bufferSize, numWorkers uint) (*Server, error) {
-	listener, err := net.Listen("tcp", address)
+// NewServer - create a new server, listenAddress is the address the server
+// binds to, advertiseAddress is the address peers are told to reach us at,
+// which can differ when running behind NAT or within a container
+func NewServer(key *rsa.PrivateKey, peer models.Node, listenAddress, advertiseAddress, dataPath string, bufferSize, numWorkers uint) (*Server, error) {
+	listenAddress, err := models.ParseNodeAddr(listenAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid listen address")
+	}
+	if advertiseAddress == "" {
+		advertiseAddress = listenAddress
+	}
+	if advertiseAddress, err = models.ParseNodeAddr(advertiseAddress); err != nil {
+		return nil, errors.Wrap(err, "invalid advertise address")
+	}
+	listener, err := net.Listen("tcp", listenAddress)
 	if err != nil {
 		return nil, errors.Wrap(err, "failure to create server: ")
 	}
@@ -43,12 +74,11 @@ func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string,
 		return nil, errors.Wrap(err, "failed to create data dir: ")
 	}
 
-	id := models.Identifier(
-		sha1.Sum([]byte(address)),
-	)
+	// our identity on the ring is derived from the address peers reach us at
+	id := models.HashBytes([]byte(advertiseAddress))
 	trustedNodes := map[models.Identifier]models.Node{
 		id: models.Node{
-			Addr:      address,
+			Addr:      advertiseAddress,
 			ID:        id,
 			PublicKey: key.Public().(*rsa.PublicKey),
 		},
@@ -63,26 +93,102 @@ func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string,
 	ctx = context.WithValue(ctx, models.SelfNodeContextKey, trustedNodes[id])
 
 	return &Server{
-		PrivateKey:   key,
-		listener:     listener,
-		id:           id,
-		addr:         address,
-		ctx:          ctx,
-		connChan:     make(chan net.Conn, bufferSize),
-		handlerMap:   make(map[RequestMethod]Handler),
-		handlerMapMu: new(sync.RWMutex),
+		PrivateKey:    key,
+		listener:      listener,
+		id:            id,
+		addr:          listenAddress,
+		advertiseAddr: advertiseAddress,
+		ctx:           ctx,
+		ctxMu:         new(sync.RWMutex),
+		connChan:      make(chan net.Conn, bufferSize),
+		handlerMap:    make(map[RequestMethod]Handler),
+		handlerMapMu:  new(sync.RWMutex),
 		trustedNodes: map[models.Identifier]models.Node{
 			id: models.Node{
-				Addr:      address,
+				Addr:      advertiseAddress,
 				ID:        id,
 				PublicKey: key.Public().(*rsa.PublicKey),
 			},
 			peer.ID: peer,
 		},
 		trustedNodesMapMu: new(sync.RWMutex),
+		counters:          newRequestCounters(),
+		started:           time.Now(),
+		nonces:            newNonceCache(),
+		ringSettings:      models.RingSettings{SuccessorListLength: 1, ReplicationFactor: 1},
 	}, nil
 }
 
+// WithValue - add a value to the context which is passed to every handler,
+// this is how handlers are configured beyond the defaults
+func (s *Server) WithValue(key models.ContextKey, value interface{}) {
+	if settings, ok := value.(models.RingSettings); ok && key == models.RingSettingsContextKey {
+		s.ringSettings = settings
+	}
+	s.ctxMu.Lock()
+	defer s.ctxMu.Unlock()
+	s.ctx = context.WithValue(s.ctx, key, value)
+}
+
+// baseContext - the context as configured by WithValue, which the context
+// of each request is built on
+func (s *Server) baseContext() context.Context {
+	s.ctxMu.RLock()
+	defer s.ctxMu.RUnlock()
+	return s.ctx
+}
+
+// RingSettings - the ring settings this server was configured with, which
+// defaults to a single copy of each resource.  They are set before the
+// server is started, and not changed after.
+func (s *Server) RingSettings() models.RingSettings {
+	return s.ringSettings
+}
+
+// AdvertiseAddr - the address this server advertises to peers within the
+// Node structures it returns
+func (s *Server) AdvertiseAddr() string {
+	return s.advertiseAddr
+}
+
+// AcceptInProcess - have transports created within this process to this
+// server's addresses connect to it in memory instead of over the network, so
+// a client embedding a server does not round trip through the network stack
+// to reach it.  The server still listens for peers as usual.
+func (s *Server) AcceptInProcess() {
+	inProcessServersMu.Lock()
+	defer inProcessServersMu.Unlock()
+	inProcessServers[s.addr] = s
+	inProcessServers[s.advertiseAddr] = s
+}
+
+// SetDraining - put the server in or out of draining, while draining requests
+// which would store new data on this node are rejected with the Draining
+// status, and every other request is served as usual
+func (s *Server) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&s.draining, v)
+}
+
+// Draining - is the server draining
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// drainRejectedMethods - the methods which store new data on the node, and
+// are rejected while it is draining
+var drainRejectedMethods = map[RequestMethod]bool{
+	PostFileMethod:          true,
+	DeleteFileMethod:        true,
+	TransferKeyMethod:       true,
+	RevokeShareMethod:       true,
+	ReplicateKeyMethod:      true,
+	PutTransactionLogMethod: true,
+}
+
 // addTrustedNode - Add a node as a trusted node in the trustedNodes structure
 func (s *Server) addTrustedNode(node models.Node) {
 	s.trustedNodesMapMu.Lock()
@@ -91,19 +197,41 @@ func (s *Server) addTrustedNode(node models.Node) {
 	s.trustedNodes[node.ID] = node
 }
 
+// TrustNode - trust requests from node, which a trusted node vouched for
+func (s *Server) TrustNode(node models.Node) {
+	s.addTrustedNode(node)
+}
+
 // getTrustedNode - Get a node from the trustedNodes structure
 func (s *Server) getTrustedNode(id models.Identifier) (models.Node, error) {
 	s.trustedNodesMapMu.RLock()
 	defer s.trustedNodesMapMu.RUnlock()
 	glog.Infof("trusted nodes: %+v", s.trustedNodes)
 	if node, ok := s.trustedNodes[id]; ok {
-		glog.Infof("getting trusted node: %s", node.ToString())
+		glog.Infof("getting trusted node: %s", node)
 		return node, nil
 	}
 
 	return models.Node{}, errors.New("node does not exist in trustedNodes")
 }
 
+// getTrustedNodeWithKey - Get the node from the trustedNodes structure which
+// registered key.  Node requests name the node they are sent to rather than
+// the one sending them, so the sender is known by its key.
+func (s *Server) getTrustedNodeWithKey(key *rsa.PublicKey) (models.Node, error) {
+	if key == nil {
+		return models.Node{}, errors.New("no public key to look up a trusted node by")
+	}
+	s.trustedNodesMapMu.RLock()
+	defer s.trustedNodesMapMu.RUnlock()
+	for _, node := range s.trustedNodes {
+		if node.PublicKey != nil && node.PublicKey.E == key.E && node.PublicKey.N.Cmp(key.N) == 0 {
+			return node, nil
+		}
+	}
+	return models.Node{}, errors.New("no node in trustedNodes has the public key")
+}
+
 // getAllTrustedNodes - Get a list of trustedNodes
 func (s *Server) getAllTrustedNodes() []models.Node {
 	s.trustedNodesMapMu.RLock()
@@ -123,7 +251,7 @@ func (s *Server) startWorkers() ([]chan bool, []chan bool) {
 		dChans = []chan bool{}
 	)
 	var i uint
-	for ; i < s.ctx.Value(models.NumRequestWorkerContextKey).(uint); i++ {
+	for ; i < s.baseContext().Value(models.NumRequestWorkerContextKey).(uint); i++ {
 		var (
 			quit = make(chan bool)
 			done = make(chan bool)
@@ -161,6 +289,9 @@ func (s *Server) Serve(q chan bool, done chan bool) {
 		select {
 		case <-q:
 			glog.Info("recieved quit signal, shutting down workers")
+			// stop accepting connections, so peers find this node gone
+			// rather than waiting on a listener nobody accepts from
+			s.listener.Close()
 			// if we are given a quit signal, signal workers to quit
 			// and then return from serving connections
 			for _, qChan := range workerQChans {
@@ -186,6 +317,10 @@ func (s *Server) Serve(q chan bool, done chan bool) {
 				glog.Infof("ERR in listener accept: %v", err)
 				panic("failed to accept socket")
 			}
+			if s.tlsConfig != nil {
+				// the handshake is done by the worker, within a deadline
+				conn = tls.Server(conn, s.tlsConfig)
+			}
 			// pass connection to a worker through channel
 			s.connChan <- conn
 		}
@@ -204,8 +339,17 @@ func (s *Server) handleConnection(conn net.Conn) {
 	// which is an RSA encrypted session key, so decrypt
 	// with the server's private key, then use that decrypted
 	// key to decrypt the AES ciphertext, with the IV in the message.
-	decoder := gob.NewDecoder(conn)
-	encoder := gob.NewEncoder(conn)
+	// the connection is closed once it is done with, so a client whose
+	// request is refused is not left waiting on it
+	defer conn.Close()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := serverHandshake(tlsConn); err != nil {
+			glog.Infof("err: %v\n", err)
+			return
+		}
+	}
+	decoder := newFrameDecoder(conn, s.MaxRequestSize())
+	encoder := newFrameEncoder(conn)
 Outer:
 	for {
 		em, request, raw, err := decryptAndDecodeRequest(decoder, s.PrivateKey)
@@ -214,26 +358,46 @@ Outer:
 			glog.Infof("err: %v\n", err)
 			return
 		}
+		if err := request.checkDataLength(); err != nil {
+			glog.Infof("rejecting %s: %v", RequestMethodToString[request.Method], err)
+			encryptAndEncode(encoder, ErrorResponse(BadHeaderCode, err.Error()),
+				NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+			continue
+		}
 		// at this point we have a request struct,
 		// we will now figure out what type of message it is and perform
 		// the method specified
-		glog.Infof("Request: %14s - header_key: %s, %+v\n",
+		glog.Infof("Request: %14s - from: %s, key: %s",
 			RequestMethodToString[request.Method],
-			hex.EncodeToString(request.Header.From[:]),
-			request,
+			request.Header.From.String(),
+			request.Header.Key.String(),
 		)
-		glog.Infof("EM is %+v", em)
+		glog.V(DebugLogLevel).Infof("Request: %v", request)
 
 		// lookup the handler to call
 		s.handlerMapMu.RLock()
 		handler, ok := s.handlerMap[request.Method]
 		s.handlerMapMu.RUnlock()
-		s.ctx = context.WithValue(s.ctx, models.UserPublicKeyContextKey, em.Header.PubKey)
-		s.ctx = context.WithValue(s.ctx, models.ResourceNameContextKey, request.Header.ResourceName)
+		// built for this request alone, the base context is shared by every
+		// worker
+		requestCtx := context.WithValue(s.baseContext(), models.UserPublicKeyContextKey, em.Header.PubKey)
+		requestCtx = context.WithValue(requestCtx, models.ResourceNameContextKey, request.Header.ResourceName)
 
 		if ok {
+			if request.Header.Type != em.Header.Type {
+				// the message is authenticated as its own type, so a request
+				// claiming another could fool a handler checking the claim
+				glog.Infof("rejecting %s, request type %d does not match message type %d",
+					RequestMethodToString[request.Method], request.Header.Type, em.Header.Type)
+				s.countRequest(request.Method, Error)
+				encryptAndEncode(encoder, ErrorResponse(
+					UnauthorizedCode, "request type does not match the message",
+				), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+				continue Outer
+			}
 			// based on the type, we are going to authenticate this request
 			glog.Infof("header type is: %d", em.Header.Type)
+			var callerNode models.Node
 			switch em.Header.Type {
 			case UserType:
 				// in the event this is a user type we need to call ourself to
@@ -257,7 +421,7 @@ Outer:
 					var idBuf = new(bytes.Buffer)
 					enc := gob.NewEncoder(idBuf)
 					enc.Encode(models.SuccessorRequest{
-						models.Identifier(request.Header.Key),
+						models.Identifier(request.Header.From),
 					})
 
 					glog.Infof("about to round trip to find successor to get file node")
@@ -276,9 +440,7 @@ Outer:
 					}
 					// connect to that host for this file
 					// pull node out of response, and connect to that host
-					var node = models.Node{}
-					dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-					err = dec.Decode(&node)
+					node, err := models.DecodeNode(bytes.NewBuffer(resp.Data))
 					if err != nil {
 						glog.Infof("Failed to deserialize the node data: %v", err)
 						return
@@ -293,7 +455,6 @@ Outer:
 						return
 					}
 
-					glog.Infof("server id is : %+v", s.id)
 					response, err := st.RoundTrip(&Request{
 						Header: Header{
 							Key:  request.Header.From,
@@ -306,7 +467,7 @@ Outer:
 						glog.Infof("ERR: %v\n", err)
 						return
 					}
-					glog.Infof("response from file post: %+v", response)
+					glog.V(DebugLogLevel).Infof("response from public key get: %v", response)
 
 					// response.data has the pem, need to read that
 					pubKey, err := crypto.ReadPublicKeyAsPem(bytes.NewBuffer(response.Data))
@@ -328,45 +489,119 @@ Outer:
 				// there to validate the request, if the request signature is not
 				// valid we will return an error
 				// skip this if this is a node registration request
-				if request.Method != NodeRegistrationMethod {
-					node, err := s.getTrustedNode(request.Header.From)
+				// a trust request is vouched for by the signature of a node
+				// which is trusted, which its handler checks
+				// the key sent with the message is only a claim, the request
+				// has to be signed with the key a trusted node registered
+				if request.Method != NodeRegistrationMethod && request.Method != NodeTrustMethod {
+					node, err := s.getTrustedNodeWithKey(em.Header.PubKey)
 					if err != nil {
 						glog.Infof("failed to get trusted node: %s", err)
 						// if there was an error, respond with error
-						encryptAndEncode(encoder, Response{
-							Status: Error,
-						}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+						encryptAndEncode(encoder, ErrorResponse(
+							UnauthorizedCode, "node is not trusted",
+						), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
 						return
 					}
-					glog.Infof("node from trustedNodes: %s", node.ToString())
-					glog.Infof("bytes are: %x", raw)
-					glog.Infof("signature from header: %x", em.Header.Signature)
+					glog.V(DebugLogLevel).Infof("node from trustedNodes: %s", node)
+					callerNode = node
 
-					if err := crypto.Verify(em.Header.PubKey, em.Header.Signature, raw); err != nil {
+					if err := crypto.Verify(node.PublicKey, em.Header.Signature, raw); err != nil {
 						glog.Infof("Failed to verify node message: %s", err)
-						encryptAndEncode(encoder, Response{
-							Status: Error,
-						}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+						encryptAndEncode(encoder, ErrorResponse(
+							UnauthorizedCode, "invalid request signature",
+						), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
 						return
 					}
 				}
 			default:
 				// has to be one of the above two.
-				encryptAndEncode(encoder, Response{
-					Status: Error,
-				}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+				encryptAndEncode(encoder, ErrorResponse(
+					BadHeaderCode, "unknown caller type",
+				), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+				continue Outer
 			}
 
+			// the nonce is signed with the request, so a replayed request
+			// cannot be given a new one
+			if err := s.nonces.check(request.Header.From, request.Header.Nonce, request.Header.Sent, time.Now()); err != nil {
+				glog.Infof("rejecting %s from %s: %v",
+					RequestMethodToString[request.Method], request.Header.From, err)
+				s.countRequest(request.Method, Error)
+				encryptAndEncode(encoder, ErrorResponse(UnauthorizedCode, errors.Cause(err).Error()),
+					NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+				continue Outer
+			}
+
+			if s.Draining() && drainRejectedMethods[request.Method] {
+				glog.Infof("rejecting %s, node is draining",
+					RequestMethodToString[request.Method])
+				s.countRequest(request.Method, Draining)
+				encryptAndEncode(encoder, DrainingResponse(),
+					NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+				continue Outer
+			}
+
+			ctx, cancel := handlerContext(requestCtx, request.Header.Deadline)
+			ctx = context.WithValue(ctx, models.CallerTypeContextKey, em.Header.Type)
+			if callerNode.PublicKey != nil {
+				ctx = context.WithValue(ctx, models.CallerNodeContextKey, callerNode)
+			}
+			response := handler(ctx, request)
+			cancel()
+			s.countRequest(request.Method, response.Status)
+			response.setChecksum()
 			encryptAndEncode(
-				encoder, handler(s.ctx, request), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+				encoder, response, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
 			continue Outer
 		}
 		// no handler to call
 		glog.Infof("Request is an Unknown Request")
-		encryptAndEncode(encoder, Response{
-			Status: Error,
-		}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+		encryptAndEncode(encoder, ErrorResponse(
+			BadHeaderCode, "unknown request method",
+		), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+	}
+}
+
+// handlerContext - the context a handler is called with, cancelled at
+// deadline, the Deadline of the request, if it has one
+func handlerContext(ctx context.Context, deadline int64) (context.Context, context.CancelFunc) {
+	if deadline == 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithDeadline(ctx, time.Unix(0, deadline))
+}
+
+// CallerTypeFromContext - the type the caller of the request being handled
+// was authenticated as, which handlers check rather than the type the
+// request claims, ok is false outside of a handler
+func CallerTypeFromContext(ctx context.Context) (t CallerType, ok bool) {
+	t, ok = ctx.Value(models.CallerTypeContextKey).(CallerType)
+	return t, ok
+}
+
+// CallerNodeFromContext - the trusted node the request being handled was
+// signed by, ok is false unless its caller was authenticated as a node
+func CallerNodeFromContext(ctx context.Context) (n models.Node, ok bool) {
+	n, ok = ctx.Value(models.CallerNodeContextKey).(models.Node)
+	return n, ok
+}
+
+// IsAdmin - was the request being handled made by one of the users the node
+// was configured with as its admins.  Any process can register as a node, so
+// being one does not make a caller an admin.
+func IsAdmin(ctx context.Context, r *Request) bool {
+	t, ok := CallerTypeFromContext(ctx)
+	if !ok || t != UserType {
+		return false
+	}
+	admins, _ := ctx.Value(models.AdminsContextKey).([]models.Identifier)
+	for _, admin := range admins {
+		if models.IdentifierEqual(admin, r.Header.From) {
+			return true
+		}
+	}
+	return false
 }
 
 // Handle - add handlers to the server
@@ -389,9 +624,10 @@ func encryptAndEncode(enc encoder, payload interface{}, t CallerType, peerKey *r
 
 	// sign the request bytes
 	signature, err := crypto.Sign(selfKey, buf.Bytes())
-
-	glog.Infof("bytes are: %x", buf.Bytes())
-	glog.Infof("computed signature: %x", signature)
+	if err != nil {
+		glog.Infof("failed to sign request: %s", err)
+		return errors.Wrap(err, "failure signing request: ")
+	}
 
 	// generate the session key
 	plaintextKey, ciphertextKey, err := crypto.GenerateSessionKey(peerKey)
@@ -446,8 +682,6 @@ func decryptAndDecodeResponse(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedM
 		return em, nil, nil, errors.Wrap(err, "invalid session key")
 	}
 
-	glog.Infof("session key is: %v from %v", sessionKey, em.SessionKey)
-
 	// now decrypt the actual payload
 	payload, err := crypto.Decrypt(sessionKey, em.CipherText, em.IV)
 	if err != nil {
@@ -491,8 +725,6 @@ func decryptAndDecodeRequest(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedMe
 		return em, nil, nil, errors.Wrap(err, "invalid session key")
 	}
 
-	glog.Infof("session key is: %v from %v", sessionKey, em.SessionKey)
-
 	// now decrypt the actual payload
 	payload, err := crypto.Decrypt(sessionKey, em.CipherText, em.IV)
 	if err != nil {
@@ -501,8 +733,6 @@ func decryptAndDecodeRequest(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedMe
 	}
 
 	// now decode the request from the payload bytes
-
-	glog.Infof("bytes after decryption are: %x", payload)
 	payloadDecoder := gob.NewDecoder(bytes.NewBuffer(payload))
 
 	var request = new(Request)
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// methodCounter - the requests a server has handled with one method, and how
+// many of them failed, accessed atomically
+type methodCounter struct {
+	requests uint64
+	failures uint64
+}
+
+// requestCounters - a counter for every known request method.  The map is
+// never changed once made, so only the counters need to be atomic.
+type requestCounters map[RequestMethod]*methodCounter
+
+func newRequestCounters() requestCounters {
+	counters := make(requestCounters, len(RequestMethodToString))
+	for method := range RequestMethodToString {
+		counters[method] = &methodCounter{}
+	}
+	return counters
+}
+
+// countRequest - tally a request with method, answered with status
+func (s *Server) countRequest(method RequestMethod, status ResponseStatus) {
+	counter, ok := s.counters[method]
+	if !ok {
+		return
+	}
+	atomic.AddUint64(&counter.requests, 1)
+	if status != Success {
+		atomic.AddUint64(&counter.failures, 1)
+	}
+}
+
+// RequestCounts - the requests the server has handled since it started, and
+// how many of them failed, by method name.  Methods not yet requested are
+// left out.
+func (s *Server) RequestCounts() (requests, failures map[string]uint64) {
+	requests, failures = map[string]uint64{}, map[string]uint64{}
+	for method, counter := range s.counters {
+		if n := atomic.LoadUint64(&counter.requests); n > 0 {
+			requests[RequestMethodToString[method]] = n
+		}
+		if n := atomic.LoadUint64(&counter.failures); n > 0 {
+			failures[RequestMethodToString[method]] = n
+		}
+	}
+	return requests, failures
+}
+
+// Uptime - how long since the server was created
+func (s *Server) Uptime() time.Duration {
+	return time.Since(s.started)
+}
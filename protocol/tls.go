@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+var (
+	// dialTLSConfig - when set, transports created by NewTransport connect
+	// over TLS with it rather than plain tcp
+	dialTLSConfig   *tls.Config
+	dialTLSConfigMu = new(sync.RWMutex)
+)
+
+// TLSHandshakeTimeout - how long a TLS handshake may take before it is given
+// up on, by a client dialing a node or a node accepting a connection, so a
+// peer which stalls part way through one cannot hold either forever
+var TLSHandshakeTimeout = 10 * time.Second
+
+// ConfigureTLS - have every transport created by NewTransport connect over
+// TLS with config, which must trust the certificates of the nodes dialed.  A
+// nil config goes back to plain tcp.
+func ConfigureTLS(config *tls.Config) {
+	dialTLSConfigMu.Lock()
+	defer dialTLSConfigMu.Unlock()
+	dialTLSConfig = config
+}
+
+// configuredTLS - the config transports dial with, nil for plain tcp
+func configuredTLS() *tls.Config {
+	dialTLSConfigMu.RLock()
+	defer dialTLSConfigMu.RUnlock()
+	return dialTLSConfig
+}
+
+// ClientTLSConfig - a config to dial nodes over TLS with, trusting the
+// certificates signed by the CA in the pem file caFile.  An empty caFile
+// trusts the system roots.
+func ClientTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CA certificate: ")
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in CA file")
+	}
+	return config, nil
+}
+
+// ServerTLSConfig - a config to serve TLS with, presenting the certificate
+// and private key in the pem files certFile and keyFile
+func ServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load TLS certificate: ")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewTLSTransport - create a new transport connected to addr over TLS with
+// tlsConfig.  Requests are still encrypted and signed within the TLS
+// connection just as they are over tcp, TLS also hides the metadata of
+// each message, and lets the client check it reached the node it meant to.
+// The certificate is checked against the host of addr unless tlsConfig
+// names a server, an address without a host being checked as localhost.
+func NewTLSTransport(proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey, tlsConfig *tls.Config) (*Transport, error) {
+	transport, err := newTLSTransport(proto, addr, t, id, peerKey, selfKey, tlsConfig)
+	transport.redial = func() (*Transport, error) {
+		return newTLSTransport(proto, addr, t, id, peerKey, selfKey, tlsConfig)
+	}
+	return transport, err
+}
+
+// newTLSTransport - create a new transport as NewTLSTransport does, which
+// cannot reconnect
+func newTLSTransport(proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey, tlsConfig *tls.Config) (*Transport, error) {
+	normalized, err := models.ParseNodeAddr(addr)
+	if err != nil {
+		return unconnectedTransport(addr, t, id, peerKey, selfKey), err
+	}
+	addr = normalized
+	if s, ok := inProcessServer(addr); ok {
+		return newPipeTransport(s, addr, t, id, peerKey, selfKey), nil
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+			tlsConfig.ServerName = host
+		} else {
+			tlsConfig.ServerName = "localhost"
+		}
+	}
+	return dialTransport(addr, t, id, peerKey, selfKey, func() (net.Conn, error) {
+		// the dialer timeout covers the handshake as well as the connect
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: TLSHandshakeTimeout}, proto, addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// serverHandshake - complete the TLS handshake of a connection the server
+// accepted, within TLSHandshakeTimeout
+func serverHandshake(conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(TLSHandshakeTimeout)); err != nil {
+		return errors.Wrap(err, "failure setting handshake deadline: ")
+	}
+	if err := conn.Handshake(); err != nil {
+		return errors.Wrap(err, "TLS handshake failed: ")
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// SetTLSConfig - accept connections over TLS with config rather than plain
+// tcp, must be called before Serve.  Connections from within the process
+// are in memory, and skip TLS.
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
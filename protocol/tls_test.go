@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+)
+
+// writeTestCert - write a self signed certificate for localhost and
+// 127.0.0.1, and its key, as pem files in dir, returning their paths
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "peerstore test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// freeAddr - a local address nothing is listening on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestTLSTransport(t *testing.T) {
+	defer func(timeout time.Duration) { TLSHandshakeTimeout = timeout }(TLSHandshakeTimeout)
+	TLSHandshakeTimeout = 200 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+	serverConfig, err := ServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientTLSConfig(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := freeAddr(t)
+	s, err := NewServer(serverKey, models.Node{}, addr, "", dir, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTLSConfig(serverConfig)
+	s.Handle(PingMethod, s.PingHandler)
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	// the node trusts itself, so a transport with its own identity is
+	// served without a ring to look users up in
+	self := models.HashBytes([]byte(addr))
+	tr, err := NewTLSTransport("tcp", addr, NodeType, self, &serverKey.PublicKey, serverKey, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Ping(context.Background()); err != nil {
+		t.Errorf("ping over TLS failed: %v", err)
+	}
+	tr.Close()
+
+	// a client trusting some other CA refuses the node's certificate
+	otherDir, err := ioutil.TempDir("", "tls-other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherDir)
+	otherCert, _ := writeTestCert(t, otherDir)
+	otherConfig, err := ClientTLSConfig(otherCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr, err := NewTLSTransport("tcp", addr, UserType, models.Identifier{1}, &serverKey.PublicKey, clientKey, otherConfig); err == nil {
+		tr.Close()
+		t.Error("expected a certificate from an untrusted CA refused")
+	}
+
+	// a connection which never starts its handshake is closed by the node
+	// rather than holding a worker
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the node to close a connection without a handshake")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Error("the node kept a connection without a handshake open")
+	}
+}
+
+func TestTLSDialHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { TLSHandshakeTimeout = timeout }(TLSHandshakeTimeout)
+	TLSHandshakeTimeout = 200 * time.Millisecond
+
+	// a listener which accepts, but never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ClientTLSConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		tr, err := NewTLSTransport("tcp", l.Addr().String(), UserType, models.Identifier{1}, &key.PublicKey, key, config)
+		if err == nil {
+			tr.Close()
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected a handshake which is never answered to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialing a node which never answers the handshake did not give up")
+	}
+}
@@ -1,10 +1,16 @@
 package protocol
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/rsa"
 	"encoding/gob"
+	"io"
 	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/husobee/peerstore/models"
@@ -15,6 +21,25 @@ func init() {
 	gob.Register(Header{})
 }
 
+// ErrNotConnected - returned when round tripping on a transport which failed
+// to connect to its peer
+var ErrNotConnected = errors.New("transport is not connected")
+
+var (
+	// inProcessServers - servers running within this process which accept
+	// in process connections, by the addresses they are reached at
+	inProcessServers   = map[string]*Server{}
+	inProcessServersMu = new(sync.RWMutex)
+)
+
+// inProcessServer - the server within this process reached at addr, if any
+func inProcessServer(addr string) (*Server, bool) {
+	inProcessServersMu.RLock()
+	defer inProcessServersMu.RUnlock()
+	s, ok := inProcessServers[addr]
+	return s, ok
+}
+
 // RoundTripper - interface which will perform the request, and
 // return the Response
 type RoundTripper interface {
@@ -32,29 +57,127 @@ type decoder interface {
 // transport will also handle all encryption/decryption of the messages
 type Transport struct {
 	Type    CallerType
+	addr    string
 	conn    net.Conn
 	from    models.Identifier
 	peerKey *rsa.PublicKey
 	selfKey *rsa.PrivateKey
 	enc     encoder
 	dec     decoder
+	// pool - the pool the connection is returned to on Close, nil closes it
+	pool *TransportPool
+	// broken - a round trip failed part way, so the connection cannot be
+	// reused
+	broken bool
+	// redial - create a transport connected as this one was, for a retried
+	// round trip to take its connection
+	redial func() (*Transport, error)
+	// reused - the connection was taken idle from the pool
+	reused bool
+	// stale - the last round trip failed because the peer had closed the
+	// pooled connection while it was idle, before it was sent anything
+	stale bool
 }
 
-// Close - close the connection transport
+// Close - close the connection transport, or return the connection to the
+// pool it came from to be reused
 func (t *Transport) Close() {
 	if t.conn != nil {
-		t.conn.Close()
+		t.SetProgress(nil)
+		if t.pool == nil {
+			t.conn.Close()
+		} else if t.broken || !t.pool.put(t.addr, &pooledConn{
+			conn: t.conn,
+			enc:  t.enc,
+			dec:  t.dec,
+		}) {
+			t.conn.Close()
+			t.pool.release(t.addr)
+		}
 		t.conn = nil
 	}
 }
 
-// NewTransport - create a new transport structure
+// NewTransport - create a new transport structure.  If addr is served by a
+// server within this process which accepts in process connections, the
+// transport is connected to it in memory instead of over the network.  Once
+// ConfigureTLS is called the transport connects over TLS, and once
+// ConfigureRateLimit is called it is paced to the limits.  Once ConfigurePool
+// is called the transport reuses an idle connection to addr from Transports
+// if there is one, and returns its connection there when closed, waiting
+// for one to be returned or closed if the pool's MaxPerHost are open.  The
+// transport reconnects the same way for RoundTripWithRetry, and when the
+// pooled connection turns out to have been closed by the peer.
 func NewTransport(proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (*Transport, error) {
-	conn, err := net.Dial(proto, addr)
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
+	transport, err := newTransport(proto, addr, t, id, peerKey, selfKey)
+	transport.redial = func() (*Transport, error) {
+		return newTransport(proto, addr, t, id, peerKey, selfKey)
+	}
+	return transport, err
+}
+
+// newTransport - create a new transport as NewTransport does, which cannot
+// reconnect
+func newTransport(proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (*Transport, error) {
+	normalized, err := models.ParseNodeAddr(addr)
+	if err != nil {
+		return unconnectedTransport(addr, t, id, peerKey, selfKey), err
+	}
+	addr = normalized
+	if s, ok := inProcessServer(addr); ok {
+		return newPipeTransport(s, addr, t, id, peerKey, selfKey), nil
+	}
+	pc, err := Transports.get(addr)
+	if err != nil {
+		return unconnectedTransport(addr, t, id, peerKey, selfKey), err
+	}
+	if pc != nil {
+		return &Transport{
+			Type:    t,
+			addr:    addr,
+			conn:    pc.conn,
+			enc:     pc.enc,
+			dec:     pc.dec,
+			selfKey: selfKey,
+			peerKey: peerKey,
+			from:    id,
+			pool:    Transports,
+			reused:  true,
+		}, nil
+	}
+	var transport *Transport
+	if tlsConfig := configuredTLS(); tlsConfig != nil {
+		transport, err = newTLSTransport(proto, addr, t, id, peerKey, selfKey, tlsConfig)
+	} else {
+		transport, err = dialTransport(addr, t, id, peerKey, selfKey, func() (net.Conn, error) {
+			return net.Dial(proto, addr)
+		})
+	}
+	transport.pool = Transports
+	if err != nil {
+		Transports.release(addr)
+	}
+	return transport, err
+}
+
+// dialTransport - create a transport connected to addr with dial, unless the
+// breaker for addr is open
+func dialTransport(addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey, dial func() (net.Conn, error)) (*Transport, error) {
+	// fail fast if this peer has been failing repeatedly
+	if err := Breakers.Allow(addr); err != nil {
+		return unconnectedTransport(addr, t, id, peerKey, selfKey), errors.Wrap(err, addr)
+	}
+	conn, err := dial()
+	if err != nil {
+		Breakers.Failure(addr)
+	} else {
+		conn = meterConn(limitConn(conn))
+	}
+	enc := newFrameEncoder(conn)
+	dec := newResponseDecoder(conn)
 	return &Transport{
 		Type:    t,
+		addr:    addr,
 		conn:    conn,
 		enc:     enc,
 		dec:     dec,
@@ -64,23 +187,267 @@ func NewTransport(proto, addr string, t CallerType, id models.Identifier, peerKe
 	}, err
 }
 
+// unconnectedTransport - a transport to addr which could not be connected,
+// returned along with the reason
+func unconnectedTransport(addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) *Transport {
+	return &Transport{
+		Type:    t,
+		addr:    addr,
+		selfKey: selfKey,
+		peerKey: peerKey,
+		from:    id,
+	}
+}
+
+// newPipeTransport - create a transport connected to a server within this
+// process through an in memory pipe.  Requests skip the network, but are still
+// encrypted, signed and authenticated just as they are over tcp.
+func newPipeTransport(s *Server, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) *Transport {
+	pipe, serverConn := net.Pipe()
+	go func() {
+		s.handleConnection(serverConn)
+		serverConn.Close()
+	}()
+	conn := meterConn(pipe)
+	return &Transport{
+		Type:    t,
+		addr:    addr,
+		conn:    conn,
+		enc:     newFrameEncoder(conn),
+		dec:     newResponseDecoder(conn),
+		selfKey: selfKey,
+		peerKey: peerKey,
+		from:    id,
+	}
+}
+
 // RoundTrip - Implementation of a round tripper interface,
 // effectively this is how the request will be serialized,
 // and put on the wire, and how the response will be deserialized
 func (t *Transport) RoundTrip(request *Request) (Response, error) {
-	err := encryptAndEncode(t.enc, request, t.Type, t.peerKey, t.from, t.selfKey)
+	return t.RoundTripContext(context.Background(), request)
+}
+
+// RoundTripContext - RoundTrip, giving up when ctx is cancelled or its
+// deadline passes.  The deadline is set on the connection, so a peer which
+// stops responding part way through a message is abandoned too.  A round
+// trip which was given up on leaves the connection part way through a
+// message, so the transport is closed, and must be created again.  One which
+// finished before it was given up on keeps the transport open.  A pooled
+// connection the peer had closed while it was idle is replaced, and the
+// request sent on the new one.
+func (t *Transport) RoundTripContext(ctx context.Context, request *Request) (Response, error) {
+	response, err := t.roundTripContext(ctx, request)
+	for err != nil && t.stale && ctx.Err() == nil {
+		// the connection says nothing of the health of the peer, so it is
+		// not counted against it, and the peer never saw the request
+		glog.Infof("pooled connection to %s was closed by the peer, redialing", t.addr)
+		if err := t.reconnect(); err != nil {
+			return Response{}, err
+		}
+		response, err = t.roundTripContext(ctx, request)
+	}
+	return response, err
+}
+
+// roundTripContext - round trip request on the connection of t, as
+// RoundTripContext does, without replacing a stale pooled connection
+func (t *Transport) roundTripContext(ctx context.Context, request *Request) (Response, error) {
+	if t.conn == nil {
+		return Response{}, ErrNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return Response{}, errors.Wrap(err, "round trip not started: ")
+	}
+	deadline, ok := ctx.Deadline()
+	if err := t.conn.SetDeadline(deadline); err != nil {
+		return Response{}, errors.Wrap(err, "failure setting deadline: ")
+	}
+	if ok {
+		// the server gives up on the request when we do
+		withDeadline := *request
+		withDeadline.Header.Deadline = deadline.UnixNano()
+		request = &withDeadline
+	}
+	var (
+		response Response
+		err      error
+	)
+	// expired - why ctx is done, if it is.  The connection deadline is the
+	// deadline of ctx, and can pass just before ctx notices it has.
+	expired := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+	if ctx.Done() != nil {
+		// on cancellation expire the deadline, which unblocks any read or
+		// write in progress on the connection
+		var (
+			conn    = t.conn
+			done    = make(chan struct{})
+			stopped = make(chan struct{})
+		)
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-stopped
+			if err != nil && expired() != nil {
+				t.broken = true
+				t.Close()
+			} else if t.conn != nil {
+				// a round trip which finished as ctx was done leaves the
+				// connection between messages, and fit for reuse, once the
+				// deadline which may have been expired is cleared
+				t.conn.SetDeadline(time.Time{})
+			}
+		}()
+	}
+
+	response, err = t.roundTrip(request)
+	if err != nil {
+		if cause := expired(); cause != nil {
+			glog.Infof("gave up on roundtrip to %s: %s", t.addr, cause)
+			return Response{}, errors.Wrap(cause, err.Error())
+		}
+	}
+	return response, err
+}
+
+// Ping - check the peer is alive and answering requests, giving up when ctx
+// is cancelled or its deadline passes.  A ping which was given up on closes
+// the transport, as RoundTripContext does.
+func (t *Transport) Ping(ctx context.Context) error {
+	_, err := t.ping(ctx)
+	return err
+}
+
+// StagesUploads - ping the peer, and report whether it stages an upload
+// posted in chunks until its last chunk.  A node which does not would store
+// each chunk as it came, so an upload cut short would leave the resource
+// truncated.
+func (t *Transport) StagesUploads(ctx context.Context) (bool, error) {
+	response, err := t.ping(ctx)
+	if err != nil {
+		return false, err
+	}
+	return response.Header.StagesUploads, nil
+}
+
+// ping - send a ping to the peer, returning its successful response
+func (t *Transport) ping(ctx context.Context) (Response, error) {
+	response, err := t.RoundTripContext(ctx, &Request{
+		Header: Header{
+			From:   t.from,
+			Type:   t.Type,
+			PubKey: &t.selfKey.PublicKey,
+			Clock:  models.GetClock(),
+		},
+		Method: PingMethod,
+	})
+	if err != nil {
+		return Response{}, errors.Wrapf(err, "ping of %s failed", t.addr)
+	}
+	if response.Status != Success {
+		return Response{}, errors.Wrapf(response.Err(), "ping of %s failed", t.addr)
+	}
+	if _, err := models.IncrementClock(response.Header.Clock); err != nil {
+		return Response{}, errors.Wrapf(err, "ping of %s failed", t.addr)
+	}
+	return response, nil
+}
+
+// Ready - check the peer is ready to serve requests, not just alive, giving
+// up when ctx is cancelled or its deadline passes.  The error says why a
+// peer which answered is not ready.
+func (t *Transport) Ready(ctx context.Context) error {
+	response, err := t.RoundTripContext(ctx, &Request{
+		Header: Header{
+			From:   t.from,
+			Type:   t.Type,
+			PubKey: &t.selfKey.PublicKey,
+			Clock:  models.GetClock(),
+		},
+		Method: ReadyMethod,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "readiness check of %s failed", t.addr)
+	}
+	if response.Status != Success {
+		return errors.Wrapf(response.Err(), "%s is not ready", t.addr)
+	}
+	return nil
+}
+
+// roundTrip - encode request on the connection, and decode the response
+func (t *Transport) roundTrip(request *Request) (Response, error) {
+	// a copy is stamped, so the caller can send the request again.  The
+	// server refuses a request whose type is not the transport's.
+	stamped := *request
+	stamped.Header.Nonce, stamped.Header.Sent = newNonce(), time.Now().UnixNano()
+	stamped.Header.Type = t.Type
+	if t.Type == UserType {
+		if err := stamped.SignAsUser(t.selfKey); err != nil {
+			return Response{}, err
+		}
+	}
+	t.stale = false
+	err := encryptAndEncode(t.enc, &stamped, t.Type, t.peerKey, t.from, t.selfKey)
 	if err != nil {
 		glog.Infof("failed to encrypt and encode in roundtrip: %s", err)
+		t.broken = true
+		if t.stale = t.reused && closedByPeer(err); !t.stale {
+			Breakers.Failure(t.addr)
+		}
 		return Response{}, errors.Wrap(err, "failure encoding request: ")
 	}
 	_, response, _, err := decryptAndDecodeResponse(t.dec, t.selfKey)
 	if err != nil {
 		glog.Infof("failed to decrypt and decode in roundtrip: %s", err)
+		t.broken = true
+		if t.stale = t.reused && closedByPeer(err); !t.stale {
+			Breakers.Failure(t.addr)
+		}
 		return Response{}, errors.Wrap(err, "failure decoding response: ")
 	}
+	if err := response.verifyChecksum(); err != nil {
+		glog.Infof("%s of %s in roundtrip: %s", RequestMethodToString[request.Method], t.addr, err)
+		t.broken = true
+		Breakers.Failure(t.addr)
+		return Response{}, err
+	}
+	Breakers.Success(t.addr)
 	return *response, err
 }
 
+// closedByPeer - err is what writing to, or reading the start of a message
+// from, a connection the peer had already closed fails with.  A read which
+// got part of a message fails with io.ErrUnexpectedEOF instead.
+func closedByPeer(err error) bool {
+	cause := errors.Cause(err)
+	if cause == io.EOF {
+		return true
+	}
+	if opErr, ok := cause.(*net.OpError); ok {
+		cause = opErr.Err
+	}
+	if sysErr, ok := cause.(*os.SyscallError); ok {
+		cause = sysErr.Err
+	}
+	return cause == syscall.ECONNRESET || cause == syscall.EPIPE
+}
+
 type CallerType uint8
 
 const (
@@ -105,11 +472,69 @@ type Header struct {
 	Clock        uint64
 	Secret       []byte
 	SharedWith   []SharedSecret
+	// Version - on a get, the version of the resource requested, zero being
+	// the latest.  On a response, the version of the resource served or
+	// stored.  On a transfer, the version id of the data handed off.
+	Version uint64
+	// Message - on an error response, a short human readable explanation of
+	// the failure.  It is sent back to the caller, so it must never include
+	// secrets or key material.
+	Message string
+	// ErrorCode - on an error response, the kind of failure
+	ErrorCode ErrorCode
+	// Offset, Length - on a get, the byte range of the resource data
+	// requested, a zero Length requesting everything from Offset.  The
+	// response DataLength is the length of the whole resource data.
+	Offset uint64
+	Length uint64
+	// Tag - on a post, the HMAC of all of the resource data up to the end of
+	// the posted data, keyed from the session key, which is stored with the
+	// resource.  On a get response, the stored tag, for the client to verify
+	// the resource data was not tampered with.
+	Tag []byte
+	// Nonce, Sent - on a request, random bytes unique to it, and when it was
+	// sent in nanoseconds since the epoch, both signed with the request so a
+	// captured request replayed to the server is refused
+	Nonce []byte
+	Sent  int64
+	// Rekey - on a post by a read-write owner, the data is encrypted with a
+	// new session key.  Secret replaces the poster's secret, and SharedWith
+	// must hold the new secret of every other owner, who keep the access
+	// they have.
+	Rekey bool
+	// Checksum - on a response, the CRC32 of the response data, for the
+	// caller to check it arrived as it was sent
+	Checksum []byte
+	// Deadline - on a request, when the caller gives up waiting for the
+	// response in nanoseconds since the epoch, zero if it never does.  The
+	// handler is cancelled at the deadline, as nobody reads its response.
+	Deadline int64
+	// LogDigest - on a transaction log get response, the digest of the log
+	// as stored.  On a transaction log put, when set, the digest the stored
+	// log must still have for the entries to be added, so a group of
+	// changes is committed against the log it was made from, or not at all.
+	LogDigest []byte
+	// Archived - on a transfer, the data is the archived version Version of
+	// the resource, rather than its current copy
+	Archived bool
+	// More - on a post, the data is a chunk of an upload, at Offset, which
+	// more chunks follow.  The chunks are staged, and the resource replaced
+	// only once the last, without More, is posted.  On a post response, the
+	// chunk was staged.
+	More bool
+	// StagesUploads - on a ping response, the node stages an upload posted
+	// in chunks until its last chunk, rather than storing each as it comes
+	StagesUploads bool
 }
 
+// SharedSecret - a user a resource is shared with, and the session key of
+// the resource encrypted for them
 type SharedSecret struct {
 	ID     models.Identifier
 	Secret []byte
+	// ReadOnly - the user can read the resource, and give up their own
+	// access to it, but not overwrite it
+	ReadOnly bool
 }
 
 // Validate - Implement validate for the header validation
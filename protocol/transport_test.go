@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// startStalledPeer - listen for connections reading the first message of
+// each, then writing the first partial bytes of a response to it and
+// answering nothing more until the listener is closed
+func startStalledPeer(t *testing.T, serverKey *rsa.PrivateKey, clientKey *rsa.PublicKey, partial int) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf = new(bytes.Buffer)
+	response := Response{Status: Success, Data: bytes.Repeat([]byte{1}, 1024)}
+	response.setChecksum()
+	if err := encryptAndEncode(newFrameEncoder(buf), response, NodeType, clientKey, models.Identifier{}, serverKey); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := newFrameDecoder(conn, 0).Decode(new(EncryptedMessage)); err != nil {
+					return
+				}
+				conn.Write(buf.Bytes()[:partial])
+				// stalled until the client gives up and closes
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return l
+}
+
+// transportKeys - a key pair for a peer, and one for the client of it
+func transportKeys(t *testing.T) (serverKey, clientKey *rsa.PrivateKey) {
+	serverKey, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err = crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverKey, clientKey
+}
+
+func TestRoundTripDeadlineStalledPeer(t *testing.T) {
+	serverKey, clientKey := transportKeys(t)
+	l := startStalledPeer(t, serverKey, &clientKey.PublicKey, 0)
+	defer l.Close()
+
+	tr, err := NewTransport("tcp", l.Addr().String(), UserType, models.Identifier{}, &serverKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = tr.RoundTripContext(ctx, &Request{Method: PingMethod})
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("round trip to a stalled peer = %v, expected the deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("round trip gave up after %s, expected at the deadline", elapsed)
+	}
+	// the connection is part way through a message, it cannot be reused
+	if _, err := tr.RoundTrip(&Request{Method: PingMethod}); err != ErrNotConnected {
+		t.Errorf("round trip after giving up = %v, expected %v", err, ErrNotConnected)
+	}
+}
+
+func TestRoundTripCancelledMidMessage(t *testing.T) {
+	serverKey, clientKey := transportKeys(t)
+	l := startStalledPeer(t, serverKey, &clientKey.PublicKey, 64)
+	defer l.Close()
+
+	tr, err := NewTransport("tcp", l.Addr().String(), UserType, models.Identifier{}, &serverKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// long enough for part of the response to arrive
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTripContext(ctx, &Request{Method: PingMethod})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if errors.Cause(err) != context.Canceled {
+			t.Errorf("round trip cancelled mid message = %v, expected it cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("round trip was not abandoned when cancelled")
+	}
+	if _, err := tr.RoundTrip(&Request{Method: PingMethod}); err != ErrNotConnected {
+		t.Errorf("round trip after cancelling = %v, expected %v", err, ErrNotConnected)
+	}
+}
+
+func TestRoundTripReusedAfterCompleting(t *testing.T) {
+	serverKey, clientKey := transportKeys(t)
+	l := startPingPeer(t, serverKey, &clientKey.PublicKey, 0)
+	defer l.Close()
+
+	tr, err := NewTransport("tcp", l.Addr().String(), UserType, models.Identifier{}, &serverKey.PublicKey, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err := tr.RoundTripContext(ctx, &Request{Method: PingMethod}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// neither cancelling nor the deadline passing after the round trip
+	// finished touches the connection
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := tr.RoundTrip(&Request{Method: PingMethod}); err != nil {
+			t.Fatalf("round trip %d after one which completed = %v", i, err)
+		}
+	}
+}